@@ -31,6 +31,7 @@ type Config struct {
 	SubnetMask    tcpip.AddressMask // client address subnet mask
 	Gateway       tcpip.Address     // client default gateway
 	DNS           []tcpip.Address   // client DNS server addresses
+	DomainName    string            // client DNS search domain
 	LeaseLength   time.Duration     // length of the address lease
 }
 
@@ -58,6 +59,8 @@ func (cfg *Config) decode(opts []option) error {
 				}
 				cfg.DNS = append(cfg.DNS, tcpip.Address(b[:4]))
 			}
+		case optDomainName:
+			cfg.DomainName = string(b)
 		}
 	}
 	return nil
@@ -80,17 +83,27 @@ func (cfg Config) encode() (opts []option) {
 		}
 		opts = append(opts, option{optDomainNameServer, dns})
 	}
+	if cfg.DomainName != "" {
+		opts = append(opts, option{optDomainName, []byte(cfg.DomainName)})
+	}
 	if l := cfg.LeaseLength / time.Second; l != 0 {
-		v := make([]byte, 4)
-		v[0] = byte(l >> 24)
-		v[1] = byte(l >> 16)
-		v[2] = byte(l >> 8)
-		v[3] = byte(l >> 0)
-		opts = append(opts, option{optLeaseTime, v})
+		// Renewal (T1) and rebinding (T2) times default to 0.5 and 0.875
+		// of the lease, as in RFC 2131 section 4.4.5.
+		opts = append(opts,
+			option{optLeaseTime, encodeSeconds(l)},
+			option{optRenewalTime, encodeSeconds(l / 2)},
+			option{optRebindingTime, encodeSeconds(l * 7 / 8)},
+		)
 	}
 	return opts
 }
 
+func encodeSeconds(d time.Duration) []byte {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(d))
+	return v
+}
+
 const (
 	// ServerPort is the well-known UDP port number for a DHCP server.
 	ServerPort = 67
@@ -203,13 +216,16 @@ const (
 	optDHCPServer       optionCode = 54
 	optParamReq         optionCode = 55
 	optMessage          optionCode = 56
+	optRenewalTime      optionCode = 58
+	optRebindingTime    optionCode = 59
 	optClientID         optionCode = 61
 )
 
 func (code optionCode) lenValid(l int) bool {
 	switch code {
 	case optSubnetMask, optDefaultGateway,
-		optReqIPAddr, optLeaseTime, optDHCPServer:
+		optReqIPAddr, optLeaseTime, optDHCPServer,
+		optRenewalTime, optRebindingTime:
 		return l == 4
 	case optDHCPMsgType:
 		return l == 1
@@ -242,6 +258,15 @@ func (opts options) dhcpMsgType() (dhcpMsgType, error) {
 	return 0, nil
 }
 
+func (opts options) requestedAddr() tcpip.Address {
+	for _, opt := range opts {
+		if opt.code == optReqIPAddr && len(opt.body) == 4 {
+			return tcpip.Address(opt.body)
+		}
+	}
+	return ""
+}
+
 func (opts options) message() string {
 	for _, opt := range opts {
 		if opt.code == optMessage {
@@ -73,6 +73,10 @@ func (code optionCode) String() string {
 		return "option(parameter-request)"
 	case optMessage:
 		return "option(message)"
+	case optRenewalTime:
+		return "option(renewal-time)"
+	case optRebindingTime:
+		return "option(rebinding-time)"
 	case optClientID:
 		return "option(client-id)"
 	default:
@@ -16,7 +16,9 @@ package dhcp
 
 import (
 	"context"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -80,7 +82,7 @@ func TestDHCP(t *testing.T) {
 	}
 	serverCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	_, err := newEPConnServer(serverCtx, s, clientAddrs, serverCfg)
+	_, err := NewStackServer(serverCtx, s, nicid, clientAddrs, serverCfg, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -149,7 +151,7 @@ func TestRenew(t *testing.T) {
 	}
 	serverCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	_, err := newEPConnServer(serverCtx, s, clientAddrs, serverCfg)
+	_, err := NewStackServer(serverCtx, s, nicid, clientAddrs, serverCfg, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -320,3 +322,128 @@ func TestTwoServers(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+type memLeaseDB struct {
+	mu     sync.Mutex
+	leases map[tcpip.LinkAddress]Lease
+}
+
+func (db *memLeaseDB) Load() ([]Lease, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var leases []Lease
+	for _, l := range db.leases {
+		leases = append(leases, l)
+	}
+	return leases, nil
+}
+
+func (db *memLeaseDB) Store(l Lease) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.leases[l.LinkAddr] = l
+	return nil
+}
+
+func (db *memLeaseDB) Remove(l Lease) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.leases, l.LinkAddr)
+	return nil
+}
+
+func (db *memLeaseDB) get(linkAddr tcpip.LinkAddress) (Lease, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	l, ok := db.leases[linkAddr]
+	return l, ok
+}
+
+func TestAddressRange(t *testing.T) {
+	got := AddressRange("\xc0\xa8\x03\xfe", "\xc0\xa8\x04\x01")
+	want := []tcpip.Address{"\xc0\xa8\x03\xfe", "\xc0\xa8\x03\xff", "\xc0\xa8\x04\x00", "\xc0\xa8\x04\x01"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AddressRange()=%v, want=%v", got, want)
+	}
+	if got := AddressRange("\xc0\xa8\x04\x01", "\xc0\xa8\x03\xfe"); len(got) != 0 {
+		t.Errorf("AddressRange(reversed)=%v, want empty", got)
+	}
+}
+
+func TestLeaseDB(t *testing.T) {
+	s := createStack(t)
+	clientAddrs := AddressRange("\xc0\xa8\x03\x02", "\xc0\xa8\x03\x04")
+
+	const clientLinkAddr0 = tcpip.LinkAddress("\x52\x11\x22\x33\x44\x52")
+	db := &memLeaseDB{leases: map[tcpip.LinkAddress]Lease{
+		clientLinkAddr0: {
+			LinkAddr: clientLinkAddr0,
+			Addr:     clientAddrs[2],
+			Expiry:   time.Now().Add(time.Hour),
+		},
+	}}
+
+	serverCfg := Config{
+		ServerAddress: serverAddr,
+		SubnetMask:    "\xff\xff\xff\x00",
+		DomainName:    "example.com",
+		LeaseLength:   24 * time.Hour,
+	}
+	serverCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewStackServer(serverCtx, s, nicid, clientAddrs, serverCfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The restored lease is handed back to its owner.
+	c0 := NewClient(s, nicid, clientLinkAddr0, nil)
+	cfg, err := c0.Request(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c0.Address(), clientAddrs[2]; got != want {
+		t.Errorf("c.Addr()=%s, want=%s", got, want)
+	}
+	if got, want := cfg.DomainName, serverCfg.DomainName; got != want {
+		t.Errorf("cfg.DomainName=%q, want=%q", got, want)
+	}
+	l, ok := db.get(clientLinkAddr0)
+	if !ok {
+		t.Fatal("lease missing from database")
+	}
+	if d := time.Until(l.Expiry); d < 23*time.Hour {
+		t.Errorf("lease expires in %v, want about %v", d, serverCfg.LeaseLength)
+	}
+
+	// A new client gets the first free address.
+	const clientLinkAddr1 = tcpip.LinkAddress("\x52\x11\x22\x33\x44\x53")
+	c1 := NewClient(s, nicid, clientLinkAddr1, nil)
+	if _, err := c1.Request(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c1.Address(), clientAddrs[0]; got != want {
+		t.Errorf("c.Addr()=%s, want=%s", got, want)
+	}
+	if got := len(srv.Leases()); got != 2 {
+		t.Errorf("len(Leases())=%d, want=2", got)
+	}
+
+	// Releasing the address removes the lease.
+	opts := options{
+		{optDHCPMsgType, []byte{byte(dhcpRELEASE)}},
+		{optDHCPServer, []byte(serverAddr)},
+	}
+	h := make(header, headerBaseSize+opts.len()+1)
+	h.init()
+	h.setOp(opRequest)
+	copy(h.chaddr(), clientLinkAddr1)
+	h.setOptions(opts)
+	srv.handleRelease(h, opts, dhcpRELEASE)
+	if _, ok := db.get(clientLinkAddr1); ok {
+		t.Error("released lease still in database")
+	}
+	if got := len(srv.Leases()); got != 1 {
+		t.Errorf("len(Leases())=%d, want=1", got)
+	}
+}
@@ -16,6 +16,7 @@ package dhcp
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
@@ -37,11 +38,13 @@ type Server struct {
 	addrs     []tcpip.Address // TODO: use a tcpip.AddressMask or range structure
 	cfg       Config
 	cfgopts   []option // cfg to send to client
+	db        LeaseDB
 
 	handlers []chan header
 
-	mu     sync.Mutex
-	leases map[tcpip.LinkAddress]serverLease
+	mu       sync.Mutex
+	leases   map[tcpip.LinkAddress]serverLease
+	declined map[tcpip.Address]time.Time // declined address -> decline time
 }
 
 // conn is a blocking read/write network endpoint.
@@ -114,25 +117,48 @@ func (c *epConn) Write(b []byte, addr *tcpip.FullAddress) error {
 	return nil
 }
 
-func newEPConnServer(ctx context.Context, stack *stack.Stack, addrs []tcpip.Address, cfg Config) (*Server, error) {
+// NewStackServer creates a new DHCP server listening on the NIC nicid of
+// stack and begins serving, handing out addresses from pool. If nicid is 0,
+// the server listens on all NICs.
+//
+// If db is not nil, the leases it holds are restored before serving, and it
+// is kept up to date as leases are granted and given up.
+//
+// The server continues serving until ctx is done.
+func NewStackServer(ctx context.Context, stack *stack.Stack, nicid tcpip.NICID, pool []tcpip.Address, cfg Config, db LeaseDB) (*Server, error) {
 	wq := new(waiter.Queue)
 	ep, err := stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
 	if err != nil {
 		return nil, fmt.Errorf("dhcp: server endpoint: %v", err)
 	}
-	if err := ep.Bind(tcpip.FullAddress{Port: ServerPort}); err != nil {
+	if err := ep.Bind(tcpip.FullAddress{NIC: nicid, Port: ServerPort}); err != nil {
+		ep.Close()
 		return nil, fmt.Errorf("dhcp: server bind: %v", err)
 	}
 	if err := ep.SetSockOpt(tcpip.BroadcastOption(1)); err != nil {
+		ep.Close()
 		return nil, fmt.Errorf("dhcp: server setsockopt: %v", err)
 	}
 	c := newEPConn(ctx, wq, ep)
-	return NewServer(ctx, c, addrs, cfg)
+	srv, serr := newServer(ctx, c, pool, cfg, db)
+	if serr != nil {
+		ep.Close()
+		return nil, serr
+	}
+	go func() {
+		<-ctx.Done()
+		ep.Close()
+	}()
+	return srv, nil
 }
 
 // NewServer creates a new DHCP server and begins serving.
 // The server continues serving until ctx is done.
 func NewServer(ctx context.Context, c conn, addrs []tcpip.Address, cfg Config) (*Server, error) {
+	return newServer(ctx, c, addrs, cfg, nil)
+}
+
+func newServer(ctx context.Context, c conn, addrs []tcpip.Address, cfg Config, db LeaseDB) (*Server, error) {
 	if cfg.ServerAddress == "" {
 		return nil, fmt.Errorf("dhcp: server requires explicit server address")
 	}
@@ -141,6 +167,7 @@ func NewServer(ctx context.Context, c conn, addrs []tcpip.Address, cfg Config) (
 		addrs:   addrs,
 		cfg:     cfg,
 		cfgopts: cfg.encode(),
+		db:      db,
 		broadcast: tcpip.FullAddress{
 			Addr: "\xff\xff\xff\xff",
 			Port: ClientPort,
@@ -148,6 +175,21 @@ func NewServer(ctx context.Context, c conn, addrs []tcpip.Address, cfg Config) (
 
 		handlers: make([]chan header, 8),
 		leases:   make(map[tcpip.LinkAddress]serverLease),
+		declined: make(map[tcpip.Address]time.Time),
+	}
+
+	if db != nil {
+		leases, err := db.Load()
+		if err != nil {
+			return nil, fmt.Errorf("dhcp: loading leases: %v", err)
+		}
+		for _, l := range leases {
+			s.leases[l.LinkAddr] = serverLease{
+				start: l.Expiry.Add(-cfg.LeaseLength),
+				addr:  l.Addr,
+				state: leaseAck,
+			}
+		}
 	}
 
 	for i := 0; i < len(s.handlers); i++ {
@@ -161,6 +203,51 @@ func NewServer(ctx context.Context, c conn, addrs []tcpip.Address, cfg Config) (
 	return s, nil
 }
 
+// Leases returns the leases currently granted by the server.
+func (s *Server) Leases() []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var leases []Lease
+	for linkAddr, lease := range s.leases {
+		if lease.state == leaseAck {
+			leases = append(leases, s.exportLease(linkAddr, lease))
+		}
+	}
+	return leases
+}
+
+func (s *Server) exportLease(linkAddr tcpip.LinkAddress, lease serverLease) Lease {
+	return Lease{
+		LinkAddr: linkAddr,
+		Addr:     lease.addr,
+		Expiry:   lease.start.Add(s.cfg.LeaseLength),
+	}
+}
+
+// storeLease records a granted lease in the lease database.
+//
+// Must be called with s.mu held.
+func (s *Server) storeLease(linkAddr tcpip.LinkAddress, lease serverLease) {
+	if s.db == nil {
+		return
+	}
+	if err := s.db.Store(s.exportLease(linkAddr, lease)); err != nil {
+		log.Printf("dhcp: storing lease for %v: %v", linkAddr, err)
+	}
+}
+
+// removeLease removes a lease that was given up from the lease database.
+//
+// Must be called with s.mu held.
+func (s *Server) removeLease(linkAddr tcpip.LinkAddress, lease serverLease) {
+	if s.db == nil || lease.state != leaseAck {
+		return
+	}
+	if err := s.db.Remove(s.exportLease(linkAddr, lease)); err != nil {
+		log.Printf("dhcp: removing lease for %v: %v", linkAddr, err)
+	}
+}
+
 func (s *Server) expirer(ctx context.Context) {
 	t := time.NewTicker(1 * time.Minute)
 	defer t.Stop()
@@ -169,11 +256,17 @@ func (s *Server) expirer(ctx context.Context) {
 		case <-t.C:
 			s.mu.Lock()
 			for linkAddr, lease := range s.leases {
-				if time.Since(lease.start) > s.cfg.LeaseLength {
+				if lease.state != leaseExpired && time.Since(lease.start) > s.cfg.LeaseLength {
+					s.removeLease(linkAddr, lease)
 					lease.state = leaseExpired
 					s.leases[linkAddr] = lease
 				}
 			}
+			for addr, t := range s.declined {
+				if time.Since(t) > s.cfg.LeaseLength {
+					delete(s.declined, addr)
+				}
+			}
 			s.mu.Unlock()
 		case <-ctx.Done():
 			return
@@ -223,7 +316,6 @@ func (s *Server) handler(ctx context.Context, ch chan header) {
 			if err != nil {
 				continue
 			}
-			// TODO: Handle DHCPRELEASE and DHCPDECLINE.
 			msgtype, err := opts.dhcpMsgType()
 			if err != nil {
 				continue
@@ -233,6 +325,8 @@ func (s *Server) handler(ctx context.Context, ch chan header) {
 				s.handleDiscover(h, opts)
 			case dhcpREQUEST:
 				s.handleRequest(h, opts)
+			case dhcpRELEASE, dhcpDECLINE:
+				s.handleRelease(h, opts, msgtype)
 			}
 		case <-ctx.Done():
 			return
@@ -248,44 +342,19 @@ func (s *Server) handleDiscover(hreq header, opts options) {
 	lease := s.leases[linkAddr]
 	switch lease.state {
 	case leaseNew:
-		if len(s.leases) < len(s.addrs) {
-			// Find an unused address.
-			// TODO: avoid building this state on each request.
-			alloced := make(map[tcpip.Address]bool)
-			for _, lease := range s.leases {
-				alloced[lease.addr] = true
-			}
-			for _, addr := range s.addrs {
-				if !alloced[addr] {
-					lease = serverLease{
-						start: time.Now(),
-						addr:  addr,
-						xid:   xid,
-						state: leaseOffer,
-					}
-					s.leases[linkAddr] = lease
-					break
-				}
-			}
-		} else {
-			// No more addresses, take an expired address.
-			for k, oldLease := range s.leases {
-				if oldLease.state == leaseExpired {
-					delete(s.leases, k)
-					lease = serverLease{
-						start: time.Now(),
-						addr:  lease.addr,
-						xid:   xid,
-						state: leaseOffer,
-					}
-					s.leases[linkAddr] = lease
-					break
-				}
-			}
+		addr, ok := s.freeAddrLocked()
+		if !ok {
 			log.Printf("server has no more addresses")
 			s.mu.Unlock()
 			return
 		}
+		lease = serverLease{
+			start: time.Now(),
+			addr:  addr,
+			xid:   xid,
+			state: leaseOffer,
+		}
+		s.leases[linkAddr] = lease
 	case leaseOffer, leaseAck, leaseExpired:
 		lease = serverLease{
 			start: time.Now(),
@@ -310,6 +379,35 @@ func (s *Server) handleDiscover(hreq header, opts options) {
 	s.conn.Write([]byte(h), &s.broadcast)
 }
 
+// freeAddrLocked picks an address from the pool for a new lease. Unused
+// addresses are preferred; failing that, an expired lease is reclaimed.
+//
+// Must be called with s.mu held.
+func (s *Server) freeAddrLocked() (tcpip.Address, bool) {
+	// TODO: avoid building this state on each request.
+	alloced := make(map[tcpip.Address]bool)
+	for _, lease := range s.leases {
+		alloced[lease.addr] = true
+	}
+	for addr := range s.declined {
+		alloced[addr] = true
+	}
+	for _, addr := range s.addrs {
+		if !alloced[addr] {
+			return addr, true
+		}
+	}
+
+	// No more addresses, take an expired address.
+	for k, oldLease := range s.leases {
+		if oldLease.state == leaseExpired {
+			delete(s.leases, k)
+			return oldLease.addr, true
+		}
+	}
+	return "", false
+}
+
 func (s *Server) nack(hreq header) {
 	// DHCPNACK
 	opts := options([]option{
@@ -348,6 +446,12 @@ func (s *Server) handleRequest(hreq header, opts options) {
 	lease := s.leases[linkAddr]
 	switch lease.state {
 	case leaseOffer, leaseAck, leaseExpired:
+		if reqAddr := reqopts.requestedAddr(); reqAddr != "" && reqAddr != lease.addr {
+			// The client asks for an address it wasn't offered.
+			s.mu.Unlock()
+			s.nack(hreq)
+			return
+		}
 		lease = serverLease{
 			start: time.Now(),
 			addr:  s.leases[linkAddr].addr,
@@ -355,6 +459,7 @@ func (s *Server) handleRequest(hreq header, opts options) {
 			state: leaseAck,
 		}
 		s.leases[linkAddr] = lease
+		s.storeLease(linkAddr, lease)
 	}
 	s.mu.Unlock()
 
@@ -376,6 +481,70 @@ func (s *Server) handleRequest(hreq header, opts options) {
 	s.conn.Write([]byte(h), &s.broadcast)
 }
 
+// handleRelease handles a DHCPRELEASE or DHCPDECLINE from a client. A
+// released address goes back to the pool. A declined address is in use by
+// some other host, so it is kept out of the pool until the lease would have
+// expired.
+func (s *Server) handleRelease(hreq header, opts options, msgtype dhcpMsgType) {
+	var reqcfg Config
+	if err := reqcfg.decode(opts); err != nil || reqcfg.ServerAddress != s.cfg.ServerAddress {
+		return
+	}
+	linkAddr := tcpip.LinkAddress(hreq.chaddr()[:6])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lease, ok := s.leases[linkAddr]
+	if !ok {
+		return
+	}
+	s.removeLease(linkAddr, lease)
+	delete(s.leases, linkAddr)
+	if msgtype == dhcpDECLINE {
+		s.declined[lease.addr] = time.Now()
+	}
+}
+
+// AddressRange returns the IPv4 addresses from first to last inclusive, for
+// use as a server address pool.
+func AddressRange(first, last tcpip.Address) []tcpip.Address {
+	if len(first) != 4 || len(last) != 4 {
+		return nil
+	}
+	lo := binary.BigEndian.Uint32([]byte(first))
+	hi := binary.BigEndian.Uint32([]byte(last))
+	var addrs []tcpip.Address
+	for a := lo; a <= hi && a >= lo; a++ {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, a)
+		addrs = append(addrs, tcpip.Address(b))
+	}
+	return addrs
+}
+
+// Lease is an address lease granted by a Server.
+type Lease struct {
+	LinkAddr tcpip.LinkAddress // client hardware address
+	Addr     tcpip.Address     // leased address
+	Expiry   time.Time         // end of the lease
+}
+
+// LeaseDB persists the leases granted by a Server, so that clients keep their
+// addresses across server restarts.
+//
+// Its methods are called with internal server locks held and must not call
+// back into the Server.
+type LeaseDB interface {
+	// Load returns the leases to restore when the server starts.
+	Load() ([]Lease, error)
+
+	// Store records a lease when it is granted or renewed.
+	Store(Lease) error
+
+	// Remove forgets a lease when it is released, declined or expires.
+	Remove(Lease) error
+}
+
 type leaseState int
 
 const (
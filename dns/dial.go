@@ -0,0 +1,181 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+)
+
+const (
+	// resolutionDelay is how long to wait for the AAAA answer once the A
+	// answer arrived, as recommended by RFC 8305 section 3.
+	resolutionDelay = 50 * time.Millisecond
+
+	// connectionAttemptDelay is how long to wait for a connection attempt
+	// to complete before starting the next one in parallel, as recommended
+	// by RFC 8305 section 5.
+	connectionAttemptDelay = 250 * time.Millisecond
+)
+
+type lookupResult struct {
+	qtype Type
+	addrs []tcpip.Address
+	err   error
+}
+
+type dialResult struct {
+	c   *gonet.Conn
+	err error
+}
+
+// DialTCP connects to port on host over the stack using the Happy Eyeballs
+// algorithm of RFC 8305: the AAAA and A records of host are queried in
+// parallel, and connection attempts alternate between IPv6 and IPv4 addresses
+// with staggered starts. The first connection established is returned and
+// the others are abandoned.
+//
+// host may also be an IP address literal, in which case it is dialed
+// directly.
+func (r *Resolver) DialTCP(ctx context.Context, host string, port uint16) (*gonet.Conn, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		addr := tcpip.Address(ip.To16())
+		if ip4 := ip.To4(); ip4 != nil {
+			addr = tcpip.Address(ip4)
+		}
+		return gonet.DialContextTCP(ctx, r.stack, tcpip.FullAddress{Addr: addr, Port: port}, networkProtocol(addr))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lookups := make(chan lookupResult, 2)
+	for _, qtype := range []Type{TypeAAAA, TypeA} {
+		go func(qtype Type) {
+			records, err := r.Lookup(ctx, host, qtype)
+			res := lookupResult{qtype: qtype, err: err}
+			for _, rec := range records {
+				res.addrs = append(res.addrs, rec.Addr)
+			}
+			lookups <- res
+		}(qtype)
+	}
+
+	var (
+		v6, v4       []tcpip.Address
+		pending      = 2
+		aaaaDone     bool
+		started      bool
+		preferV4     bool
+		inflight     int
+		lookupErr    error
+		dialErr      error
+		resolveTimer <-chan time.Time
+		attemptTimer <-chan time.Time
+		dials        = make(chan dialResult)
+	)
+
+	// startNext starts a connection attempt to the next address, alternating
+	// between address families. It returns false if there is none left.
+	startNext := func() bool {
+		var addr tcpip.Address
+		switch {
+		case len(v6) > 0 && (!preferV4 || len(v4) == 0):
+			addr, v6 = v6[0], v6[1:]
+			preferV4 = true
+		case len(v4) > 0:
+			addr, v4 = v4[0], v4[1:]
+			preferV4 = false
+		default:
+			return false
+		}
+		inflight++
+		go func() {
+			c, err := gonet.DialContextTCP(ctx, r.stack, tcpip.FullAddress{Addr: addr, Port: port}, networkProtocol(addr))
+			dials <- dialResult{c, err}
+		}()
+		attemptTimer = time.After(connectionAttemptDelay)
+		return true
+	}
+
+	for {
+		// Connecting starts as soon as the AAAA answer is in, or once the
+		// resolution delay expired after the A answer.
+		if !started && (aaaaDone || pending == 0) {
+			started = true
+			resolveTimer = nil
+		}
+		if started && inflight == 0 && !startNext() && pending == 0 {
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			return nil, lookupErr
+		}
+
+		select {
+		case res := <-lookups:
+			pending--
+			if res.err != nil {
+				if lookupErr == nil || lookupErr == ErrNotFound {
+					lookupErr = res.err
+				}
+			}
+			if res.qtype == TypeAAAA {
+				v6 = append(v6, res.addrs...)
+				aaaaDone = true
+			} else {
+				v4 = append(v4, res.addrs...)
+				if !started {
+					resolveTimer = time.After(resolutionDelay)
+				}
+			}
+
+		case <-resolveTimer:
+			started = true
+			resolveTimer = nil
+
+		case <-attemptTimer:
+			attemptTimer = nil
+			startNext()
+
+		case d := <-dials:
+			inflight--
+			if d.err == nil {
+				go drainDials(dials, inflight)
+				return d.c, nil
+			}
+			dialErr = d.err
+			startNext()
+
+		case <-ctx.Done():
+			go drainDials(dials, inflight)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// drainDials waits for the n connection attempts still in flight once the
+// race is decided, closing those that manage to connect anyway.
+func drainDials(dials <-chan dialResult, n int) {
+	for ; n > 0; n-- {
+		if d := <-dials; d.c != nil {
+			d.c.Close()
+		}
+	}
+}
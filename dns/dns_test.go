@@ -0,0 +1,484 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/stack/stacktest"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+)
+
+const nicid = stacktest.NICID
+
+var (
+	serverAddr  = tcpip.Address("\x0a\x00\x00\x35")
+	server2Addr = tcpip.Address("\x0a\x00\x00\x36")
+	clientAddr  = tcpip.Address("\x0a\x00\x00\x01")
+	hostAddr4   = tcpip.Address("\xc0\x00\x02\x01")
+	hostAddr6   = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+)
+
+func newStack(t *testing.T) *stack.Stack {
+	s := stacktest.New(t, []string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName}, loopback.New())
+	stacktest.AddAddresses(t, s, serverAddr, server2Addr, clientAddr, hostAddr4, hostAddr6)
+	stacktest.SetDefaultRoutes(s)
+	return s
+}
+
+type answer struct {
+	qtype Type
+	rdata []byte
+}
+
+// testServer is a DNS server answering queries from a fixed zone over UDP and
+// TCP.
+type testServer struct {
+	zone map[string][]answer
+
+	// truncate names are answered with the TC bit set over UDP.
+	truncate map[string]bool
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func mustName(name string) []byte {
+	b, err := appendName(nil, name)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func srvData(priority, weight, port uint16, target string) []byte {
+	b := make([]byte, 6)
+	binary.BigEndian.PutUint16(b[0:], priority)
+	binary.BigEndian.PutUint16(b[2:], weight)
+	binary.BigEndian.PutUint16(b[4:], port)
+	return append(b, mustName(target)...)
+}
+
+// respond builds the response to query q. Answers use a compression pointer
+// to the question name.
+func (ts *testServer) respond(q []byte, overUDP bool) []byte {
+	name, off, err := readName(q, headerSize)
+	if err != nil || off+4 > len(q) {
+		return nil
+	}
+	qtype := Type(binary.BigEndian.Uint16(q[off:]))
+	name = strings.ToLower(name)
+
+	ts.mu.Lock()
+	ts.queries = append(ts.queries, name+" "+qtype.String())
+	ts.mu.Unlock()
+
+	resp := make([]byte, headerSize)
+	copy(resp, q[:2])
+	flags := uint16(flagResponse | flagRecursion | 1<<7)
+	resp = append(resp, q[headerSize:off+4]...)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+
+	answers, ok := ts.zone[name]
+	switch {
+	case !ok:
+		flags |= rcodeNameError
+	case overUDP && ts.truncate[name]:
+		flags |= flagTruncated
+	default:
+		var n uint16
+		for _, a := range answers {
+			if a.qtype != qtype {
+				continue
+			}
+			var rr [12]byte
+			binary.BigEndian.PutUint16(rr[0:], 0xc000|headerSize)
+			binary.BigEndian.PutUint16(rr[2:], uint16(a.qtype))
+			binary.BigEndian.PutUint16(rr[4:], classINET)
+			binary.BigEndian.PutUint32(rr[6:], 300)
+			binary.BigEndian.PutUint16(rr[10:], uint16(len(a.rdata)))
+			resp = append(resp, rr[:]...)
+			resp = append(resp, a.rdata...)
+			n++
+		}
+		binary.BigEndian.PutUint16(resp[6:], n)
+	}
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	return resp
+}
+
+func (ts *testServer) serve(t *testing.T, s *stack.Stack, addr tcpip.Address) func() {
+	full := tcpip.FullAddress{NIC: nicid, Addr: addr, Port: DefaultPort}
+	pc, err := gonet.NewPacketConn(s, full, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("NewPacketConn: %v", err)
+	}
+	l, err := gonet.ListenTCP(s, full, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+
+	go func() {
+		b := make([]byte, maxUDPSize)
+		for {
+			n, from, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if resp := ts.respond(b[:n], true); resp != nil {
+				pc.WriteTo(resp, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var lb [2]byte
+				if _, err := io.ReadFull(c, lb[:]); err != nil {
+					return
+				}
+				q := make([]byte, binary.BigEndian.Uint16(lb[:]))
+				if _, err := io.ReadFull(c, q); err != nil {
+					return
+				}
+				resp := ts.respond(q, false)
+				binary.BigEndian.PutUint16(lb[:], uint16(len(resp)))
+				c.Write(append(lb[:], resp...))
+			}()
+		}
+	}()
+
+	return func() {
+		pc.Close()
+		l.Close()
+	}
+}
+
+func (ts *testServer) count() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.queries)
+}
+
+func newTestServer() *testServer {
+	return &testServer{
+		zone: map[string][]answer{
+			"host.example.": {
+				{TypeA, []byte(hostAddr4)},
+				{TypeAAAA, []byte(hostAddr6)},
+			},
+			"v4only.example.": {
+				{TypeA, []byte(hostAddr4)},
+			},
+			"1.2.0.192.in-addr.arpa.": {
+				{TypePTR, mustName("host.example.")},
+			},
+			"_ldap._tcp.example.": {
+				{TypeSRV, srvData(20, 0, 389, "b.example.")},
+				{TypeSRV, srvData(10, 5, 389, "a.example.")},
+			},
+			"big.example.": {
+				{TypeA, []byte(hostAddr4)},
+			},
+		},
+		truncate: map[string]bool{
+			"big.example.": true,
+		},
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	q, err := newQuery(0x1234, "host.example", TypeA)
+	if err != nil {
+		t.Fatalf("newQuery: %v", err)
+	}
+	name, off, err := readName(q, headerSize)
+	if err != nil {
+		t.Fatalf("readName: %v", err)
+	}
+	if name != "host.example." || off != len(q)-4 {
+		t.Errorf("got readName = %q, %d, want = %q, %d", name, off, "host.example.", len(q)-4)
+	}
+
+	ts := newTestServer()
+	m, err := parseMessage(ts.respond(q, false))
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+	if m.id != 0x1234 || m.flags&flagResponse == 0 {
+		t.Errorf("got id = %#x, flags = %#x, want id = 0x1234 with QR set", m.id, m.flags)
+	}
+	want := []Record{{Name: "host.example.", Type: TypeA, TTL: 300, Addr: hostAddr4}}
+	if !reflect.DeepEqual(m.answers, want) {
+		t.Errorf("got answers = %+v, want = %+v", m.answers, want)
+	}
+
+	// A compression pointer to itself must not loop forever.
+	loop := append(make([]byte, headerSize), 0xc0, headerSize)
+	if _, _, err := readName(loop, headerSize); err != errMalformed {
+		t.Errorf("got readName(loop) = %v, want = %v", err, errMalformed)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	s := newStack(t)
+	ts := newTestServer()
+	defer ts.serve(t, s, serverAddr)()
+
+	r := NewResolver(s, Config{
+		Servers: []tcpip.FullAddress{{NIC: nicid, Addr: serverAddr}},
+		Timeout: time.Second,
+	})
+	ctx := context.Background()
+
+	addrs, err := r.LookupIP(ctx, "host.example")
+	if err != nil {
+		t.Fatalf("LookupIP: %v", err)
+	}
+	if want := []tcpip.Address{hostAddr4, hostAddr6}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("got LookupIP = %v, want = %v", addrs, want)
+	}
+
+	addrs, err = r.LookupIP(ctx, "v4only.example")
+	if err != nil {
+		t.Fatalf("LookupIP: %v", err)
+	}
+	if want := []tcpip.Address{hostAddr4}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("got LookupIP = %v, want = %v", addrs, want)
+	}
+
+	if _, err := r.LookupIP(ctx, "missing.example"); err != ErrNotFound {
+		t.Errorf("got LookupIP(missing) = %v, want = %v", err, ErrNotFound)
+	}
+
+	names, err := r.LookupAddr(ctx, hostAddr4)
+	if err != nil {
+		t.Fatalf("LookupAddr: %v", err)
+	}
+	if want := []string{"host.example."}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got LookupAddr = %v, want = %v", names, want)
+	}
+
+	srvs, err := r.LookupSRV(ctx, "ldap", "tcp", "example")
+	if err != nil {
+		t.Fatalf("LookupSRV: %v", err)
+	}
+	var targets []string
+	for _, srv := range srvs {
+		targets = append(targets, srv.Target)
+	}
+	if want := []string{"a.example.", "b.example."}; !reflect.DeepEqual(targets, want) {
+		t.Errorf("got LookupSRV targets = %v, want = %v", targets, want)
+	}
+
+	// Truncated answers are retried over TCP.
+	addrs, err = r.LookupIP(ctx, "big.example")
+	if err != nil {
+		t.Fatalf("LookupIP(big): %v", err)
+	}
+	if want := []tcpip.Address{hostAddr4}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("got LookupIP(big) = %v, want = %v", addrs, want)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	got, err := reverseName(hostAddr6)
+	if err != nil {
+		t.Fatalf("reverseName: %v", err)
+	}
+	const want = "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."
+	if got != want {
+		t.Errorf("got reverseName = %q, want = %q", got, want)
+	}
+}
+
+func TestCache(t *testing.T) {
+	s := newStack(t)
+	ts := newTestServer()
+	defer ts.serve(t, s, serverAddr)()
+
+	r := NewResolver(s, Config{
+		Servers: []tcpip.FullAddress{{NIC: nicid, Addr: serverAddr}},
+		Timeout: time.Second,
+		Cache:   true,
+	})
+	for i := 0; i < 3; i++ {
+		records, err := r.Lookup(context.Background(), "Host.Example.", TypeA)
+		if err != nil {
+			t.Fatalf("Lookup: %v", err)
+		}
+		if got := records[0].Addr; got != hostAddr4 {
+			t.Errorf("got Lookup #%d address = %v, want = %v", i, got, tcpip.Address(hostAddr4))
+		}
+		// Modifying the records returned mustn't affect the cache.
+		records[0].Addr = clientAddr
+	}
+	if got := ts.count(); got != 1 {
+		t.Errorf("got %d queries, want = 1", got)
+	}
+}
+
+func TestShuffleByWeight(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		records := []Record{
+			{Target: "zero.example.", Weight: 0},
+			{Target: "a.example.", Weight: 1},
+			{Target: "b.example.", Weight: 3},
+		}
+		shuffleByWeight(records)
+		if got := records[2].Target; got != "zero.example." {
+			t.Fatalf("got last target = %q, want = zero.example. (records = %+v)", got, records)
+		}
+	}
+}
+
+func TestRetryNextServer(t *testing.T) {
+	s := newStack(t)
+	ts := newTestServer()
+	defer ts.serve(t, s, server2Addr)()
+
+	// Nothing listens on serverAddr, so queries to it time out.
+	r := NewResolver(s, Config{
+		Servers: []tcpip.FullAddress{
+			{NIC: nicid, Addr: serverAddr},
+			{NIC: nicid, Addr: server2Addr},
+		},
+		Timeout:  100 * time.Millisecond,
+		Attempts: 1,
+		Rotate:   true,
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := r.Lookup(context.Background(), "host.example", TypeA); err != nil {
+			t.Fatalf("Lookup #%d: %v", i, err)
+		}
+	}
+	if got := ts.count(); got != 2 {
+		t.Errorf("got %d queries, want = 2", got)
+	}
+}
+
+func TestNetResolverDial(t *testing.T) {
+	s := newStack(t)
+	ts := newTestServer()
+	defer ts.serve(t, s, serverAddr)()
+
+	r := NewResolver(s, Config{
+		Servers: []tcpip.FullAddress{{NIC: nicid, Addr: serverAddr}},
+	})
+	nr := &net.Resolver{PreferGo: true, Dial: r.Dial}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := nr.LookupHost(ctx, "host.example.")
+	if err != nil {
+		t.Fatalf("LookupHost: %v", err)
+	}
+	sort.Strings(addrs)
+	if want := []string{"192.0.2.1", "2001:db8::1"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("got LookupHost = %v, want = %v", addrs, want)
+	}
+}
+
+func TestDialTCP(t *testing.T) {
+	s := newStack(t)
+	ts := newTestServer()
+	defer ts.serve(t, s, serverAddr)()
+
+	r := NewResolver(s, Config{
+		Servers: []tcpip.FullAddress{{NIC: nicid, Addr: serverAddr}},
+		Timeout: time.Second,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const port = 8080
+	listen := func(addr tcpip.Address) *gonet.Listener {
+		l, err := gonet.ListenTCP(s, tcpip.FullAddress{NIC: nicid, Addr: addr, Port: port}, networkProtocol(addr))
+		if err != nil {
+			t.Fatalf("ListenTCP(%v): %v", addr, err)
+		}
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+			}
+		}()
+		return l
+	}
+
+	// Only IPv4 accepts connections: the IPv6 attempt is refused and the
+	// IPv4 one wins.
+	l4 := listen(hostAddr4)
+	defer l4.Close()
+	c, err := r.DialTCP(ctx, "host.example", port)
+	if err != nil {
+		t.Fatalf("DialTCP: %v", err)
+	}
+	if got, want := c.RemoteAddr().String(), "192.0.2.1:8080"; got != want {
+		t.Errorf("got RemoteAddr = %s, want = %s", got, want)
+	}
+	c.Close()
+
+	// With both families reachable, IPv6 is preferred.
+	l6 := listen(hostAddr6)
+	defer l6.Close()
+	c, err = r.DialTCP(ctx, "host.example", port)
+	if err != nil {
+		t.Fatalf("DialTCP: %v", err)
+	}
+	if got, want := c.RemoteAddr().String(), "[2001:db8::1]:8080"; got != want {
+		t.Errorf("got RemoteAddr = %s, want = %s", got, want)
+	}
+	c.Close()
+
+	// Literal addresses are dialed without a lookup.
+	before := ts.count()
+	c, err = r.DialTCP(ctx, "192.0.2.1", port)
+	if err != nil {
+		t.Fatalf("DialTCP(literal): %v", err)
+	}
+	c.Close()
+	if got := ts.count(); got != before {
+		t.Errorf("got %d queries for a literal address, want = 0", got-before)
+	}
+
+	if _, err := r.DialTCP(ctx, "missing.example", port); err != ErrNotFound {
+		t.Errorf("got DialTCP(missing) = %v, want = %v", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// Type is the type of a resource record, as defined in RFC 1035 section
+// 3.2.2.
+type Type uint16
+
+// Record types supported by the resolver.
+const (
+	TypeA     Type = 1
+	TypeNS    Type = 2
+	TypeCNAME Type = 5
+	TypePTR   Type = 12
+	TypeAAAA  Type = 28
+	TypeSRV   Type = 33
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeA:
+		return "A"
+	case TypeNS:
+		return "NS"
+	case TypeCNAME:
+		return "CNAME"
+	case TypePTR:
+		return "PTR"
+	case TypeAAAA:
+		return "AAAA"
+	case TypeSRV:
+		return "SRV"
+	default:
+		return fmt.Sprintf("TYPE%d", uint16(t))
+	}
+}
+
+const (
+	headerSize = 12
+
+	// classINET is the Internet class.
+	classINET = 1
+
+	// Header flags.
+	flagResponse  = 1 << 15
+	flagTruncated = 1 << 9
+	flagRecursion = 1 << 8
+	rcodeMask     = 0xf
+
+	// Response codes.
+	rcodeSuccess     = 0
+	rcodeFormatError = 1
+	rcodeServerFail  = 2
+	rcodeNameError   = 3
+	rcodeNotImpl     = 4
+	rcodeRefused     = 5
+
+	// maxNameLength is the maximum length of a domain name in wire format.
+	maxNameLength = 255
+
+	// maxPointers bounds the number of compression pointers followed while
+	// reading a name, to detect loops.
+	maxPointers = 64
+)
+
+var errMalformed = errors.New("dns: malformed message")
+
+// A Record is a resource record from the answer section of a response.
+type Record struct {
+	// Name is the owner name of the record, in absolute form (i.e. with a
+	// trailing dot).
+	Name string
+
+	// Type is the type of the record.
+	Type Type
+
+	// TTL is the number of seconds the record may be cached for.
+	TTL uint32
+
+	// Addr is the address held by A and AAAA records.
+	Addr tcpip.Address
+
+	// Target is the domain name held by CNAME, NS, PTR and SRV records.
+	Target string
+
+	// Priority, Weight and Port are the fields of SRV records.
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+}
+
+// message is a parsed response.
+type message struct {
+	id      uint16
+	flags   uint16
+	answers []Record
+}
+
+// appendName appends name in wire format to b. name may or may not have a
+// trailing dot.
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name)+2 > maxNameLength {
+		return nil, fmt.Errorf("dns: name %q is too long", name)
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("dns: bad label in name %q", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// newQuery builds a recursive query for records of type qtype for name.
+func newQuery(id uint16, name string, qtype Type) ([]byte, error) {
+	b := make([]byte, headerSize, headerSize+len(name)+6)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], flagRecursion)
+	binary.BigEndian.PutUint16(b[4:], 1) // QDCOUNT
+
+	b, err := appendName(b, name)
+	if err != nil {
+		return nil, err
+	}
+	var q [4]byte
+	binary.BigEndian.PutUint16(q[0:], uint16(qtype))
+	binary.BigEndian.PutUint16(q[2:], classINET)
+	return append(b, q[:]...), nil
+}
+
+// readName reads the possibly compressed name at offset off of msg. It returns
+// the name in absolute form and the offset following it.
+func readName(msg []byte, off int) (string, int, error) {
+	var (
+		name     []byte
+		end      = -1
+		pointers int
+	)
+	for {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		l := int(msg[off])
+		switch l & 0xc0 {
+		case 0x00:
+			off++
+			if l == 0 {
+				if end < 0 {
+					end = off
+				}
+				if len(name) == 0 {
+					return ".", end, nil
+				}
+				return string(name), end, nil
+			}
+			if off+l > len(msg) || len(name)+l+1 > maxNameLength {
+				return "", 0, errMalformed
+			}
+			name = append(name, msg[off:off+l]...)
+			name = append(name, '.')
+			off += l
+
+		case 0xc0:
+			if off+2 > len(msg) {
+				return "", 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			if pointers++; pointers > maxPointers {
+				return "", 0, errMalformed
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+
+		default:
+			return "", 0, errMalformed
+		}
+	}
+}
+
+// parseMessage parses the header and answer section of a response.
+func parseMessage(msg []byte) (*message, error) {
+	if len(msg) < headerSize {
+		return nil, errMalformed
+	}
+	m := &message{
+		id:    binary.BigEndian.Uint16(msg[0:]),
+		flags: binary.BigEndian.Uint16(msg[2:]),
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := headerSize
+	for i := 0; i < qdcount; i++ {
+		var err error
+		if _, off, err = readName(msg, off); err != nil {
+			return nil, err
+		}
+		// Skip QTYPE and QCLASS.
+		if off += 4; off > len(msg) {
+			return nil, errMalformed
+		}
+	}
+
+	for i := 0; i < ancount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, errMalformed
+		}
+		rtype := Type(binary.BigEndian.Uint16(msg[off:]))
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, errMalformed
+		}
+		rdata := msg[off : off+rdlen]
+		rdoff := off
+		off += rdlen
+
+		if class != classINET {
+			continue
+		}
+		r := Record{Name: name, Type: rtype, TTL: ttl}
+		switch rtype {
+		case TypeA:
+			if rdlen != 4 {
+				return nil, errMalformed
+			}
+			r.Addr = tcpip.Address(rdata)
+		case TypeAAAA:
+			if rdlen != 16 {
+				return nil, errMalformed
+			}
+			r.Addr = tcpip.Address(rdata)
+		case TypeCNAME, TypeNS, TypePTR:
+			if r.Target, _, err = readName(msg, rdoff); err != nil {
+				return nil, err
+			}
+		case TypeSRV:
+			if rdlen < 7 {
+				return nil, errMalformed
+			}
+			r.Priority = binary.BigEndian.Uint16(rdata[0:])
+			r.Weight = binary.BigEndian.Uint16(rdata[2:])
+			r.Port = binary.BigEndian.Uint16(rdata[4:])
+			if r.Target, _, err = readName(msg, rdoff+6); err != nil {
+				return nil, err
+			}
+		default:
+			// Unsupported record types are skipped.
+			continue
+		}
+		m.answers = append(m.answers, r)
+	}
+	return m, nil
+}
@@ -0,0 +1,532 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dns implements a stub DNS resolver that sends its queries over a
+// netstack stack rather than the host network.
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/rand"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	// DefaultPort is the port queries are sent to when a server address
+	// doesn't specify one.
+	DefaultPort = 53
+
+	defaultTimeout  = 5 * time.Second
+	defaultAttempts = 2
+
+	// maxUDPSize is the largest response accepted over UDP. Servers that
+	// don't support EDNS truncate at 512 bytes, but be lenient.
+	maxUDPSize = 4096
+)
+
+var (
+	// ErrNotFound is returned when the name doesn't exist or has no records
+	// of the requested type.
+	ErrNotFound = errors.New("dns: name not found")
+
+	// ErrNoServers is returned when the resolver has no servers configured.
+	ErrNoServers = errors.New("dns: no servers configured")
+
+	errServerFailure = errors.New("dns: server failure")
+	errRefused       = errors.New("dns: query refused")
+)
+
+// Config configures a Resolver.
+type Config struct {
+	// Servers are the addresses of the recursive servers to query. Servers
+	// with a zero port use DefaultPort.
+	Servers []tcpip.FullAddress
+
+	// Timeout is how long to wait for an answer from a single server before
+	// moving on to the next. Zero means 5 seconds.
+	Timeout time.Duration
+
+	// Attempts is the number of times each server is tried. Zero means 2.
+	Attempts int
+
+	// Rotate spreads queries across the servers in round-robin order rather
+	// than always starting with the first one.
+	Rotate bool
+
+	// Cache enables caching of positive answers for their TTL, as measured
+	// by the clock of the stack.
+	Cache bool
+}
+
+type cacheKey struct {
+	name  string
+	qtype Type
+}
+
+type cacheEntry struct {
+	records []Record
+	expires time.Time
+}
+
+// Resolver is a stub resolver that sends queries over a stack.
+type Resolver struct {
+	stack *stack.Stack
+	cfg   Config
+
+	mu    sync.Mutex
+	next  int
+	cache map[cacheKey]cacheEntry
+}
+
+// NewResolver creates a resolver that queries the servers in cfg over s.
+func NewResolver(s *stack.Stack, cfg Config) *Resolver {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = defaultAttempts
+	}
+	servers := make([]tcpip.FullAddress, len(cfg.Servers))
+	for i, srv := range cfg.Servers {
+		if srv.Port == 0 {
+			srv.Port = DefaultPort
+		}
+		servers[i] = srv
+	}
+	cfg.Servers = servers
+
+	r := &Resolver{
+		stack: s,
+		cfg:   cfg,
+	}
+	if cfg.Cache {
+		r.cache = make(map[cacheKey]cacheEntry)
+	}
+	return r
+}
+
+// Lookup queries the records of type qtype for name. Only records of the
+// requested type are returned; CNAMEs followed by the server are dropped.
+func (r *Resolver) Lookup(ctx context.Context, name string, qtype Type) ([]Record, error) {
+	name = absName(name)
+	key := cacheKey{name: strings.ToLower(name), qtype: qtype}
+	if records, ok := r.cached(key); ok {
+		return records, nil
+	}
+
+	m, err := r.exchange(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, rec := range m.answers {
+		if rec.Type == qtype {
+			records = append(records, rec)
+		}
+	}
+	if len(records) == 0 {
+		return nil, ErrNotFound
+	}
+	r.store(key, records)
+	return records, nil
+}
+
+// cloneRecords returns a copy of records, so that callers may modify the
+// records they are handed without affecting the cache.
+func cloneRecords(records []Record) []Record {
+	return append([]Record(nil), records...)
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses of host.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]tcpip.Address, error) {
+	var (
+		addrs    []tcpip.Address
+		firstErr error
+	)
+	for _, qtype := range []Type{TypeA, TypeAAAA} {
+		records, err := r.Lookup(ctx, host, qtype)
+		if err != nil {
+			if firstErr == nil || firstErr == ErrNotFound {
+				firstErr = err
+			}
+			continue
+		}
+		for _, rec := range records {
+			addrs = append(addrs, rec.Addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, firstErr
+	}
+	return addrs, nil
+}
+
+// LookupAddr performs a reverse lookup of addr and returns the names mapping
+// to it.
+func (r *Resolver) LookupAddr(ctx context.Context, addr tcpip.Address) ([]string, error) {
+	name, err := reverseName(addr)
+	if err != nil {
+		return nil, err
+	}
+	records, err := r.Lookup(ctx, name, TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(records))
+	for _, rec := range records {
+		names = append(names, rec.Target)
+	}
+	return names, nil
+}
+
+// LookupSRV queries the SRV records of _service._proto.name, as
+// net.LookupSRV does. If service and proto are both empty, name is queried
+// directly. The records are sorted by priority, and the records of the same
+// priority are ordered by the weighted random selection of RFC 2782.
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) ([]Record, error) {
+	if service != "" || proto != "" {
+		name = "_" + service + "._" + proto + "." + name
+	}
+	records, err := r.Lookup(ctx, name, TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+	for i := 0; i < len(records); {
+		j := i + 1
+		for j < len(records) && records[j].Priority == records[i].Priority {
+			j++
+		}
+		shuffleByWeight(records[i:j])
+		i = j
+	}
+	return records, nil
+}
+
+// shuffleByWeight orders records as the weighted random selection of RFC 2782
+// does: each position is filled by a record picked among those left with a
+// probability proportional to its weight. Records of zero weight are only
+// picked once no other records are left.
+func shuffleByWeight(records []Record) {
+	sum := 0
+	for _, rec := range records {
+		sum += int(rec.Weight)
+	}
+	for sum > 0 && len(records) > 1 {
+		n := mathrand.Intn(sum)
+		s := 0
+		for i := range records {
+			s += int(records[i].Weight)
+			if s > n {
+				records[0], records[i] = records[i], records[0]
+				break
+			}
+		}
+		sum -= int(records[0].Weight)
+		records = records[1:]
+	}
+}
+
+// Dial connects to one of the configured servers over the stack. It is meant
+// to be used as the Dial function of a net.Resolver with PreferGo set, so
+// that the standard library resolver sends its queries through the stack.
+// The address chosen by net.Resolver is ignored.
+func (r *Resolver) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	servers := r.servers()
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+
+	var err error
+	for _, srv := range servers {
+		var c net.Conn
+		switch network {
+		case "udp", "udp4", "udp6":
+			c, err = gonet.DialUDP(r.stack, nil, &srv, networkProtocol(srv.Addr))
+		case "tcp", "tcp4", "tcp6":
+			c, err = gonet.DialContextTCP(ctx, r.stack, srv, networkProtocol(srv.Addr))
+		default:
+			return nil, fmt.Errorf("dns: unsupported network %q", network)
+		}
+		if err == nil {
+			return c, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// servers returns the servers in the order they should be tried for the next
+// query.
+func (r *Resolver) servers() []tcpip.FullAddress {
+	n := len(r.cfg.Servers)
+	if !r.cfg.Rotate || n < 2 {
+		return r.cfg.Servers
+	}
+
+	r.mu.Lock()
+	start := r.next
+	r.next = (r.next + 1) % n
+	r.mu.Unlock()
+
+	servers := make([]tcpip.FullAddress, 0, n)
+	servers = append(servers, r.cfg.Servers[start:]...)
+	return append(servers, r.cfg.Servers[:start]...)
+}
+
+// exchange sends the query to the configured servers until one of them gives
+// a definitive answer or all attempts are exhausted.
+func (r *Resolver) exchange(ctx context.Context, name string, qtype Type) (*message, error) {
+	servers := r.servers()
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < r.cfg.Attempts; attempt++ {
+		for _, srv := range servers {
+			m, err := r.exchangeServer(ctx, srv, name, qtype)
+			switch err {
+			case nil:
+				return m, nil
+			case ErrNotFound:
+				// The name doesn't exist; asking another server won't
+				// change that.
+				return nil, err
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// exchangeServer sends a single query to srv, over UDP first and then over
+// TCP if the response was truncated.
+func (r *Resolver) exchangeServer(ctx context.Context, srv tcpip.FullAddress, name string, qtype Type) (*message, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+	defer cancel()
+
+	var idb [2]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idb[:])
+
+	q, err := newQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := r.exchangeUDP(ctx, srv, id, q)
+	if err != nil {
+		return nil, err
+	}
+	if m.flags&flagTruncated != 0 {
+		if m, err = r.exchangeTCP(ctx, srv, id, q); err != nil {
+			return nil, err
+		}
+	}
+
+	switch m.flags & rcodeMask {
+	case rcodeSuccess:
+		return m, nil
+	case rcodeNameError:
+		return nil, ErrNotFound
+	case rcodeServerFail:
+		return nil, errServerFailure
+	case rcodeRefused:
+		return nil, errRefused
+	default:
+		return nil, fmt.Errorf("dns: server returned rcode %d", m.flags&rcodeMask)
+	}
+}
+
+func (r *Resolver) exchangeUDP(ctx context.Context, srv tcpip.FullAddress, id uint16, q []byte) (*message, error) {
+	c, err := gonet.DialUDP(r.stack, nil, &srv, networkProtocol(srv.Addr))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	defer watchContext(ctx, c)()
+
+	if _, err := c.Write(q); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, maxUDPSize)
+	for {
+		n, err := c.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore anything that isn't the response to our query; it may
+		// be a late answer to a previous attempt or a spoofing attempt.
+		m, err := parseMessage(b[:n])
+		if err != nil || m.id != id || m.flags&flagResponse == 0 {
+			continue
+		}
+		return m, nil
+	}
+}
+
+func (r *Resolver) exchangeTCP(ctx context.Context, srv tcpip.FullAddress, id uint16, q []byte) (*message, error) {
+	c, err := gonet.DialContextTCP(ctx, r.stack, srv, networkProtocol(srv.Addr))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	defer watchContext(ctx, c)()
+
+	b := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(b, uint16(len(q)))
+	copy(b[2:], q)
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+
+	var l [2]byte
+	if _, err := io.ReadFull(c, l[:]); err != nil {
+		return nil, err
+	}
+	b = make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, err
+	}
+	m, err := parseMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	if m.id != id || m.flags&flagResponse == 0 {
+		return nil, errMalformed
+	}
+	return m, nil
+}
+
+// watchContext makes blocked operations on c fail once ctx is done. The
+// returned function must be called to release the watcher.
+func watchContext(ctx context.Context, c net.Conn) func() {
+	if d, ok := ctx.Deadline(); ok {
+		c.SetDeadline(d)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (r *Resolver) cached(key cacheKey) ([]Record, bool) {
+	if r.cache == nil {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if !r.stack.Now().Before(e.expires) {
+		delete(r.cache, key)
+		return nil, false
+	}
+	return cloneRecords(e.records), true
+}
+
+func (r *Resolver) store(key cacheKey, records []Record) {
+	if r.cache == nil {
+		return
+	}
+	ttl := records[0].TTL
+	for _, rec := range records[1:] {
+		if rec.TTL < ttl {
+			ttl = rec.TTL
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+	r.mu.Lock()
+	r.cache[key] = cacheEntry{
+		records: cloneRecords(records),
+		expires: r.stack.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	r.mu.Unlock()
+}
+
+// absName returns name with a trailing dot.
+func absName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of addr.
+func reverseName(addr tcpip.Address) (string, error) {
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	switch len(addr) {
+	case 4:
+		for i := len(addr) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", addr[i])
+		}
+		b.WriteString("in-addr.arpa.")
+	case 16:
+		for i := len(addr) - 1; i >= 0; i-- {
+			b.WriteByte(hex[addr[i]&0xf])
+			b.WriteByte('.')
+			b.WriteByte(hex[addr[i]>>4])
+			b.WriteByte('.')
+		}
+		b.WriteString("ip6.arpa.")
+	default:
+		return "", fmt.Errorf("dns: invalid address %q", addr)
+	}
+	return b.String(), nil
+}
+
+// networkProtocol returns the network protocol used to reach addr.
+func networkProtocol(addr tcpip.Address) tcpip.NetworkProtocolNumber {
+	if len(addr) == 16 {
+		return ipv6.ProtocolNumber
+	}
+	return ipv4.ProtocolNumber
+}
@@ -0,0 +1,321 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ping sends ICMP echo requests over a stack and measures the round
+// trip time of the replies.
+package ping
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/icmp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	defaultInterval = time.Second
+	defaultTimeout  = time.Second
+	defaultSize     = 56
+
+	// echoHeaderSize is the size of the ICMP echo header: type, code,
+	// checksum, identifier and sequence number. It is the same for ICMPv4
+	// and ICMPv6.
+	echoHeaderSize = 8
+)
+
+// Config configures a ping session.
+type Config struct {
+	// NIC is the NIC to send the requests from. If 0, it is chosen by the
+	// route table.
+	NIC tcpip.NICID
+
+	// Count is the number of requests to send. If 0, requests are sent
+	// until the context is done.
+	Count int
+
+	// Interval is the time between requests. Zero means 1 second.
+	Interval time.Duration
+
+	// Size is the number of payload bytes in each request, after the ICMP
+	// header. Zero means 56.
+	Size int
+
+	// TTL is the TTL (or hop limit) of the requests. Zero means the
+	// route's default.
+	TTL uint8
+
+	// Timeout is how long to wait for replies after the last request was
+	// sent. Zero means 1 second.
+	Timeout time.Duration
+
+	// OnReply, if set, is called for each reply as it arrives.
+	OnReply func(Reply)
+}
+
+// Reply is an echo reply matched to one of the requests.
+type Reply struct {
+	From tcpip.Address
+	Seq  uint16
+	Size int // payload bytes, after the ICMP header
+	RTT  time.Duration
+}
+
+// Statistics summarizes a ping session.
+type Statistics struct {
+	Sent     int
+	Received int
+
+	// RTTs holds the round trip time of each reply, in arrival order.
+	RTTs []time.Duration
+
+	MinRTT    time.Duration
+	MaxRTT    time.Duration
+	AvgRTT    time.Duration
+	StdDevRTT time.Duration
+}
+
+// Loss returns the fraction of requests that got no reply.
+func (s *Statistics) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Sent-s.Received) / float64(s.Sent)
+}
+
+func (s *Statistics) add(rtt time.Duration) {
+	if s.Received == 0 || rtt < s.MinRTT {
+		s.MinRTT = rtt
+	}
+	if rtt > s.MaxRTT {
+		s.MaxRTT = rtt
+	}
+	s.Received++
+	s.RTTs = append(s.RTTs, rtt)
+}
+
+func (s *Statistics) finish() {
+	if s.Received == 0 {
+		return
+	}
+	var sum float64
+	for _, rtt := range s.RTTs {
+		sum += float64(rtt)
+	}
+	avg := sum / float64(s.Received)
+	var sq float64
+	for _, rtt := range s.RTTs {
+		d := float64(rtt) - avg
+		sq += d * d
+	}
+	s.AvgRTT = time.Duration(avg)
+	s.StdDevRTT = time.Duration(math.Sqrt(sq / float64(s.Received)))
+}
+
+// Ping sends echo requests to addr, an IPv4 or IPv6 address, as configured by
+// cfg, and returns statistics on the replies. It returns once all requests
+// were sent and either all replies arrived or cfg.Timeout elapsed, or when
+// ctx is done; in the latter case the statistics gathered so far are
+// returned along with ctx.Err().
+func Ping(ctx context.Context, s *stack.Stack, addr tcpip.Address, cfg Config) (*Statistics, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = defaultSize
+	}
+
+	var (
+		netProto   tcpip.NetworkProtocolNumber
+		transProto tcpip.TransportProtocolNumber
+		echoType   byte
+		replyType  byte
+	)
+	switch len(addr) {
+	case header.IPv4AddressSize:
+		netProto, transProto = ipv4.ProtocolNumber, icmp.ProtocolNumber4
+		echoType, replyType = byte(header.ICMPv4Echo), byte(header.ICMPv4EchoReply)
+	case header.IPv6AddressSize:
+		netProto, transProto = ipv6.ProtocolNumber, icmp.ProtocolNumber6
+		echoType, replyType = byte(header.ICMPv6EchoRequest), byte(header.ICMPv6EchoReply)
+	default:
+		return nil, fmt.Errorf("ping: invalid address %q", addr)
+	}
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(transProto, netProto, &wq)
+	if err != nil {
+		return nil, fmt.Errorf("ping: NewEndpoint(): %s", err)
+	}
+	defer ep.Close()
+
+	if cfg.TTL != 0 {
+		if err := ep.SetSockOpt(tcpip.TTLOption(cfg.TTL)); err != nil {
+			return nil, fmt.Errorf("ping: SetSockOpt(TTLOption): %s", err)
+		}
+	}
+	if err := ep.Bind(tcpip.FullAddress{NIC: cfg.NIC}); err != nil {
+		return nil, fmt.Errorf("ping: Bind(): %s", err)
+	}
+	if err := ep.Connect(tcpip.FullAddress{NIC: cfg.NIC, Addr: addr}); err != nil {
+		return nil, fmt.Errorf("ping: Connect(): %s", err)
+	}
+	local, err := ep.GetLocalAddress()
+	if err != nil {
+		return nil, fmt.Errorf("ping: GetLocalAddress(): %s", err)
+	}
+	// The endpoint's port is used as the echo identifier.
+	ident := local.Port
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	var (
+		stats   Statistics
+		mu      sync.Mutex
+		sent    = make(map[uint16]time.Time)
+		replies = make(chan Reply, 16)
+		done    = make(chan struct{})
+		readErr = make(chan error, 1)
+	)
+	defer close(done)
+
+	// Match replies to requests in the background.
+	go func() {
+		for {
+			var from tcpip.FullAddress
+			v, _, err := ep.Read(&from)
+			if err == tcpip.ErrWouldBlock {
+				select {
+				case <-ch:
+					continue
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				readErr <- fmt.Errorf("ping: Read(): %s", err)
+				return
+			}
+			now := time.Now()
+			if len(v) < echoHeaderSize || v[0] != replyType || binary.BigEndian.Uint16(v[4:]) != ident {
+				continue
+			}
+			seq := binary.BigEndian.Uint16(v[6:])
+			mu.Lock()
+			t, ok := sent[seq]
+			delete(sent, seq)
+			mu.Unlock()
+			if !ok {
+				// Duplicate or unsolicited.
+				continue
+			}
+			select {
+			case replies <- Reply{From: from.Addr, Seq: seq, Size: len(v) - echoHeaderSize, RTT: now.Sub(t)}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	var (
+		seq      uint16
+		deadline <-chan time.Time
+		send     = true
+	)
+	for {
+		if send {
+			send = false
+			mu.Lock()
+			sent[seq] = time.Now()
+			mu.Unlock()
+			if err := sendEcho(ctx, ep, echoType, seq, cfg.Size); err != nil {
+				stats.finish()
+				return &stats, err
+			}
+			stats.Sent++
+			seq++
+			if cfg.Count > 0 && stats.Sent >= cfg.Count {
+				ticker.Stop()
+				deadline = time.After(cfg.Timeout)
+			}
+		}
+
+		select {
+		case r := <-replies:
+			stats.add(r.RTT)
+			if cfg.OnReply != nil {
+				cfg.OnReply(r)
+			}
+			if deadline != nil && stats.Received == stats.Sent {
+				stats.finish()
+				return &stats, nil
+			}
+		case <-ticker.C:
+			send = deadline == nil
+		case <-deadline:
+			stats.finish()
+			return &stats, nil
+		case err := <-readErr:
+			stats.finish()
+			return &stats, err
+		case <-ctx.Done():
+			stats.finish()
+			return &stats, ctx.Err()
+		}
+	}
+}
+
+// sendEcho sends an echo request with the given sequence number and size
+// bytes of payload.
+func sendEcho(ctx context.Context, ep tcpip.Endpoint, echoType byte, seq uint16, size int) error {
+	v := buffer.NewView(echoHeaderSize + size)
+	v[0] = echoType
+	// The identifier is filled in by the endpoint.
+	binary.BigEndian.PutUint16(v[6:], seq)
+	for i := echoHeaderSize; i < len(v); i++ {
+		v[i] = byte(i)
+	}
+
+	_, resCh, err := ep.Write(tcpip.SlicePayload(v), tcpip.WriteOptions{})
+	if resCh != nil {
+		select {
+		case <-resCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		_, _, err = ep.Write(tcpip.SlicePayload(v), tcpip.WriteOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("ping: Write(): %s", err)
+	}
+	return nil
+}
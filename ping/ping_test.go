@@ -0,0 +1,123 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ping
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/stack/stacktest"
+	"github.com/google/netstack/tcpip/transport/icmp"
+	"github.com/google/netstack/waiter"
+)
+
+var (
+	addr4 = tcpip.Address("\x0a\x00\x00\x01")
+	addr6 = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+)
+
+func newStack(t *testing.T) *stack.Stack {
+	s := stacktest.New(t, []string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{icmp.ProtocolName4, icmp.ProtocolName6}, loopback.New())
+	stacktest.AddAddresses(t, s, addr4, addr6)
+	stacktest.SetDefaultRoutes(s)
+	return s
+}
+
+func TestPing(t *testing.T) {
+	s := newStack(t)
+	for _, addr := range []tcpip.Address{addr4, addr6} {
+		var replies []Reply
+		stats, err := Ping(context.Background(), s, addr, Config{
+			Count:    3,
+			Interval: 10 * time.Millisecond,
+			Size:     100,
+			TTL:      7,
+			OnReply:  func(r Reply) { replies = append(replies, r) },
+		})
+		if err != nil {
+			t.Fatalf("Ping(%v): %v", addr, err)
+		}
+		if stats.Sent != 3 || stats.Received != 3 || stats.Loss() != 0 {
+			t.Errorf("Ping(%v): got sent = %d, received = %d, loss = %f, want = 3, 3, 0", addr, stats.Sent, stats.Received, stats.Loss())
+		}
+		if stats.MinRTT <= 0 || stats.MinRTT > stats.AvgRTT || stats.AvgRTT > stats.MaxRTT {
+			t.Errorf("Ping(%v): bad RTTs: min = %v, avg = %v, max = %v", addr, stats.MinRTT, stats.AvgRTT, stats.MaxRTT)
+		}
+		if len(replies) != 3 {
+			t.Fatalf("Ping(%v): got %d replies, want = 3", addr, len(replies))
+		}
+		for i, r := range replies {
+			if r.Seq != uint16(i) || r.From != addr || r.Size != 100 {
+				t.Errorf("Ping(%v): got reply %d = %+v, want seq = %d, from = %v, size = 100", addr, i, r, i, addr)
+			}
+		}
+	}
+}
+
+func TestPingNoReply(t *testing.T) {
+	s := newStack(t)
+	// Nothing owns this address, so the requests are dropped.
+	stats, err := Ping(context.Background(), s, "\x0a\x00\x00\x02", Config{
+		Count:    2,
+		Interval: 10 * time.Millisecond,
+		Timeout:  50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if stats.Sent != 2 || stats.Received != 0 || stats.Loss() != 1 {
+		t.Errorf("got sent = %d, received = %d, loss = %f, want = 2, 0, 1", stats.Sent, stats.Received, stats.Loss())
+	}
+}
+
+func TestPingCanceled(t *testing.T) {
+	s := newStack(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stats, err := Ping(ctx, s, addr4, Config{Interval: 10 * time.Millisecond})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got Ping = %v, want = %v", err, context.DeadlineExceeded)
+	}
+	if stats.Sent == 0 || stats.Received == 0 {
+		t.Errorf("got sent = %d, received = %d, want > 0", stats.Sent, stats.Received)
+	}
+}
+
+func TestTTLOption(t *testing.T) {
+	s := newStack(t)
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(icmp.ProtocolNumber4, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint: %v", err)
+	}
+	defer ep.Close()
+
+	if err := ep.SetSockOpt(tcpip.TTLOption(7)); err != nil {
+		t.Fatalf("SetSockOpt(TTLOption(7)): %v", err)
+	}
+	var v tcpip.TTLOption
+	if err := ep.GetSockOpt(&v); err != nil {
+		t.Fatalf("GetSockOpt(&TTLOption): %v", err)
+	}
+	if v != 7 {
+		t.Errorf("got TTLOption = %d, want = 7", v)
+	}
+}
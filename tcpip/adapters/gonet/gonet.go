@@ -16,8 +16,10 @@
 package gonet
 
 import (
+	"context"
 	"errors"
 	"io"
+	"math"
 	"net"
 	"sync"
 	"time"
@@ -35,6 +37,15 @@ var (
 	errWouldBlock = errors.New("operation would block")
 )
 
+var (
+	_ net.Listener   = (*Listener)(nil)
+	_ net.Conn       = (*Conn)(nil)
+	_ io.ReaderFrom  = (*Conn)(nil)
+	_ io.WriterTo    = (*Conn)(nil)
+	_ net.Conn       = (*PacketConn)(nil)
+	_ net.PacketConn = (*PacketConn)(nil)
+)
+
 // timeoutError is how the net package reports timeouts.
 type timeoutError struct{}
 
@@ -45,6 +56,8 @@ func (e *timeoutError) Temporary() bool { return true }
 // A Listener is a wrapper around a tcpip endpoint that implements
 // net.Listener.
 type Listener struct {
+	deadlineTimer
+
 	stack  *stack.Stack
 	ep     tcpip.Endpoint
 	wq     *waiter.Queue
@@ -80,12 +93,20 @@ func NewListener(s *stack.Stack, addr tcpip.FullAddress, network tcpip.NetworkPr
 		}
 	}
 
-	return &Listener{
+	l := &Listener{
 		stack:  s,
 		ep:     ep,
 		wq:     &wq,
 		cancel: make(chan struct{}),
-	}, nil
+	}
+	l.deadlineTimer.init()
+	return l, nil
+}
+
+// ListenTCP creates a new Listener, like net.ListenTCP. It is the same as
+// NewListener.
+func ListenTCP(s *stack.Stack, addr tcpip.FullAddress, network tcpip.NetworkProtocolNumber) (*Listener, error) {
+	return NewListener(s, addr, network)
 }
 
 // Close implements net.Listener.Close.
@@ -100,6 +121,12 @@ func (l *Listener) Shutdown() {
 	close(l.cancel) // broadcast cancellation
 }
 
+// Endpoint returns the endpoint l wraps, e.g. to set socket options that the
+// net.Listener interface doesn't cover.
+func (l *Listener) Endpoint() tcpip.Endpoint {
+	return l.ep
+}
+
 // Addr implements net.Listener.Addr.
 func (l *Listener) Addr() net.Addr {
 	a, err := l.ep.GetLocalAddress()
@@ -237,18 +264,39 @@ func NewConn(wq *waiter.Queue, ep tcpip.Endpoint) *Conn {
 	return c
 }
 
-// Accept implements net.Conn.Accept.
+// Accept implements net.Conn.Accept. It fails with a timeout error once the
+// deadline set with SetDeadline expires.
 func (l *Listener) Accept() (net.Conn, error) {
-	n, wq, err := l.ep.Accept()
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext is like Accept, but also gives up once ctx is done, in which
+// case the returned error wraps ctx.Err().
+func (l *Listener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	deadline := l.readCancel()
+
+	n, wq, err := l.ep.Accept(nil)
 
 	if err == tcpip.ErrWouldBlock {
-		// Create wait queue entry that notifies a channel.
+		// Create wait queue entry that notifies a channel. It is an
+		// exclusive waiter, so that a new connection only wakes one of
+		// the goroutines accepting them.
 		waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+		waitEntry.Exclusive = true
 		l.wq.EventRegister(&waitEntry, waiter.EventIn)
-		defer l.wq.EventUnregister(&waitEntry)
+		defer func() {
+			l.wq.EventUnregister(&waitEntry)
+			// Pass on a notification that wasn't acted on to
+			// another waiter.
+			select {
+			case <-notifyCh:
+				l.wq.Notify(waiter.EventIn)
+			default:
+			}
+		}()
 
 		for {
-			n, wq, err = l.ep.Accept()
+			n, wq, err = l.ep.Accept(nil)
 
 			if err != tcpip.ErrWouldBlock {
 				break
@@ -257,6 +305,20 @@ func (l *Listener) Accept() (net.Conn, error) {
 			select {
 			case <-l.cancel:
 				return nil, errCanceled
+			case <-deadline:
+				return nil, &net.OpError{
+					Op:   "accept",
+					Net:  "tcp",
+					Addr: l.Addr(),
+					Err:  &timeoutError{},
+				}
+			case <-ctx.Done():
+				return nil, &net.OpError{
+					Op:   "accept",
+					Net:  "tcp",
+					Addr: l.Addr(),
+					Err:  ctx.Err(),
+				}
 			case <-notifyCh:
 			}
 		}
@@ -361,8 +423,12 @@ func (c *Conn) Write(b []byte) (int, error) {
 	default:
 	}
 
-	v := buffer.NewViewFromBytes(b)
+	return c.write(buffer.NewViewFromBytes(b), deadline)
+}
 
+// write writes v to the endpoint, which takes ownership of it, blocking until
+// it is written in full or deadline expires.
+func (c *Conn) write(v buffer.View, deadline <-chan struct{}) (int, error) {
 	// We must handle two soft failure conditions simultaneously:
 	//  1. Write may write nothing and return tcpip.ErrWouldBlock.
 	//     If this happens, we need to register for notifications if we have
@@ -380,7 +446,7 @@ func (c *Conn) Write(b []byte) (int, error) {
 		reg      bool
 		notifyCh chan struct{}
 	)
-	for nbytes < len(b) && (err == tcpip.ErrWouldBlock || err == nil) {
+	for len(v) != 0 && (err == tcpip.ErrWouldBlock || err == nil) {
 		if err == tcpip.ErrWouldBlock {
 			if !reg {
 				// Only register once.
@@ -429,6 +495,121 @@ func (c *Conn) Write(b []byte) (int, error) {
 	return nbytes, c.newOpError("write", errors.New(err.String()))
 }
 
+// readFromBufferSize is the size of the buffers ReadFrom reads into.
+const readFromBufferSize = 64 << 10
+
+// ReadFrom implements io.ReaderFrom.ReadFrom. The data read from r is handed
+// to the endpoint as is, instead of being copied again like Write does.
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	deadline := c.writeCancel()
+
+	var (
+		total int64
+		v     buffer.View
+	)
+	for {
+		// The endpoint keeps the parts of v that it is given, so only
+		// read into the rest of it.
+		if len(v) == 0 {
+			v = buffer.NewView(readFromBufferSize)
+		}
+		n, rerr := r.Read(v)
+		if n > 0 {
+			written, err := c.write(v[:n], deadline)
+			total += int64(written)
+			if err != nil {
+				return total, err
+			}
+			v = v[n:]
+		}
+		if rerr == io.EOF {
+			return total, nil
+		}
+		if rerr != nil {
+			return total, rerr
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo.WriteTo. It writes the data received from the
+// peer to w until the peer closes the connection. If the endpoint supports it,
+// w is passed the endpoint's buffers directly, without copying them first.
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	var total int64
+
+	// Data that Read consumed but didn't return comes first.
+	if len(c.read) != 0 {
+		n, err := w.Write(c.read)
+		total += int64(n)
+		c.read.TrimFront(n)
+		if err != nil {
+			return total, err
+		}
+		c.read = nil
+	}
+
+	deadline := c.readCancel()
+
+	zc, ok := c.ep.(tcpip.ZeroCopyReader)
+	if !ok {
+		for {
+			b, err := commonRead(c.ep, c.wq, deadline, nil, c, false)
+			if err == io.EOF {
+				return total, nil
+			}
+			if err != nil {
+				return total, err
+			}
+			n, err := w.Write(b)
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&waitEntry, waiter.EventIn)
+	defer c.wq.EventUnregister(&waitEntry)
+
+	for {
+		vv, release, _, err := zc.ReadWithoutCopy(math.MaxInt32)
+		switch err {
+		case nil:
+		case tcpip.ErrWouldBlock:
+			select {
+			case <-deadline:
+				return total, c.newOpError("read", &timeoutError{})
+			case <-notifyCh:
+			}
+			continue
+		case tcpip.ErrClosedForReceive:
+			return total, nil
+		default:
+			return total, c.newOpError("read", errors.New(err.String()))
+		}
+
+		for _, v := range vv.Views() {
+			n, err := w.Write(v)
+			total += int64(n)
+			if err != nil {
+				release()
+				return total, err
+			}
+		}
+		release()
+	}
+}
+
+// Endpoint returns the endpoint c wraps, e.g. to set socket options that the
+// net.Conn interface doesn't cover.
+func (c *Conn) Endpoint() tcpip.Endpoint {
+	return c.ep
+}
+
 // Close implements net.Conn.Close.
 func (c *Conn) Close() error {
 	c.ep.Close()
@@ -473,6 +654,13 @@ func fullToUDPAddr(addr tcpip.FullAddress) *net.UDPAddr {
 
 // DialTCP creates a new TCP Conn connected to the specified address.
 func DialTCP(s *stack.Stack, addr tcpip.FullAddress, network tcpip.NetworkProtocolNumber) (*Conn, error) {
+	return DialContextTCP(context.Background(), s, addr, network)
+}
+
+// DialContextTCP creates a new TCP Conn connected to the specified address,
+// giving up once ctx is done. In that case, the half-open connection is
+// closed and the returned error wraps ctx.Err().
+func DialContextTCP(ctx context.Context, s *stack.Stack, addr tcpip.FullAddress, network tcpip.NetworkProtocolNumber) (*Conn, error) {
 	// Create TCP endpoint, then connect.
 	var wq waiter.Queue
 	ep, err := s.NewEndpoint(tcp.ProtocolNumber, network, &wq)
@@ -489,7 +677,18 @@ func DialTCP(s *stack.Stack, addr tcpip.FullAddress, network tcpip.NetworkProtoc
 
 	err = ep.Connect(addr)
 	if err == tcpip.ErrConnectStarted {
-		<-notifyCh
+		select {
+		case <-ctx.Done():
+			ep.Close()
+			return nil, &net.OpError{
+				Op:   "connect",
+				Net:  "tcp",
+				Addr: fullToTCPAddr(addr),
+				Err:  ctx.Err(),
+			}
+		case <-notifyCh:
+		}
+
 		err = ep.GetSockOpt(tcpip.ErrorOption{})
 	}
 	if err != nil {
@@ -505,6 +704,50 @@ func DialTCP(s *stack.Stack, addr tcpip.FullAddress, network tcpip.NetworkProtoc
 	return NewConn(&wq, ep), nil
 }
 
+// DialUDP creates a new PacketConn bound to laddr and connected to raddr, like
+// net.DialUDP. If laddr is nil, a local address is chosen automatically. If
+// raddr is nil, the PacketConn isn't connected and can only be used with
+// WriteTo.
+func DialUDP(s *stack.Stack, laddr, raddr *tcpip.FullAddress, network tcpip.NetworkProtocolNumber) (*PacketConn, error) {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, network, &wq)
+	if err != nil {
+		return nil, errors.New(err.String())
+	}
+
+	if laddr != nil {
+		if err := ep.Bind(*laddr); err != nil {
+			ep.Close()
+			return nil, &net.OpError{
+				Op:   "bind",
+				Net:  "udp",
+				Addr: fullToUDPAddr(*laddr),
+				Err:  errors.New(err.String()),
+			}
+		}
+	}
+
+	if raddr != nil {
+		if err := ep.Connect(*raddr); err != nil {
+			ep.Close()
+			return nil, &net.OpError{
+				Op:   "connect",
+				Net:  "udp",
+				Addr: fullToUDPAddr(*raddr),
+				Err:  errors.New(err.String()),
+			}
+		}
+	}
+
+	c := &PacketConn{
+		stack: s,
+		ep:    ep,
+		wq:    &wq,
+	}
+	c.deadlineTimer.init()
+	return c, nil
+}
+
 // A PacketConn is a wrapper around a tcpip endpoint that implements
 // net.PacketConn.
 type PacketConn struct {
@@ -563,7 +806,7 @@ func (c *PacketConn) RemoteAddr() net.Addr {
 	if err != nil {
 		return nil
 	}
-	return fullToTCPAddr(a)
+	return fullToUDPAddr(a)
 }
 
 // Read implements net.Conn.Read
@@ -647,6 +890,12 @@ func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 	return int(n), c.newRemoteOpError("write", addr, errors.New(err.String()))
 }
 
+// Endpoint returns the endpoint c wraps, e.g. to set socket options that the
+// net.PacketConn interface doesn't cover.
+func (c *PacketConn) Endpoint() tcpip.Endpoint {
+	return c.ep
+}
+
 // Close implements net.PacketConn.Close.
 func (c *PacketConn) Close() error {
 	c.ep.Close()
@@ -15,6 +15,8 @@
 package gonet
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"reflect"
@@ -324,6 +326,200 @@ func TestPacketConnTransfer(t *testing.T) {
 	}
 }
 
+func TestDialUDP(t *testing.T) {
+	s, e := newLoopbackStack()
+	if e != nil {
+		t.Fatalf("newLoopbackStack() = %v", e)
+	}
+
+	ip1 := tcpip.Address(net.IPv4(169, 254, 10, 1).To4())
+	addr1 := tcpip.FullAddress{NICID, ip1, 11211}
+	s.AddAddress(NICID, ipv4.ProtocolNumber, ip1)
+	ip2 := tcpip.Address(net.IPv4(169, 254, 10, 2).To4())
+	addr2 := tcpip.FullAddress{NICID, ip2, 11311}
+	s.AddAddress(NICID, ipv4.ProtocolNumber, ip2)
+
+	c1, err := NewPacketConn(s, addr1, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal("NewPacketConn:", err)
+	}
+	defer c1.Close()
+	c2, err := DialUDP(s, &addr2, &addr1, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal("DialUDP:", err)
+	}
+	defer c2.Close()
+
+	if got, want := c2.RemoteAddr(), fullToUDPAddr(addr1); !reflect.DeepEqual(got, want) {
+		t.Errorf("got c2.RemoteAddr() = %v, want = %v", got, want)
+	}
+
+	c1.SetDeadline(time.Now().Add(time.Second))
+	c2.SetDeadline(time.Now().Add(time.Second))
+
+	const sent = "abc123"
+	if n, err := c2.Write([]byte(sent)); err != nil || n != len(sent) {
+		t.Fatalf("got c2.Write(%q) = %d, %v, want = %d, %v", sent, n, err, len(sent), nil)
+	}
+	recv := make([]byte, len(sent))
+	n, recvAddr, err := c1.ReadFrom(recv)
+	if err != nil || string(recv[:n]) != sent {
+		t.Fatalf("got c1.ReadFrom() = %q, %v, want = %q, %v", recv[:n], err, sent, nil)
+	}
+	if want := fullToUDPAddr(addr2); !reflect.DeepEqual(recvAddr, want) {
+		t.Errorf("got recvAddr = %v, want = %v", recvAddr, want)
+	}
+
+	if _, err := c1.WriteTo([]byte(sent), recvAddr); err != nil {
+		t.Fatalf("c1.WriteTo(%q, %v) failed: %v", sent, recvAddr, err)
+	}
+	if n, err := c2.Read(recv); err != nil || string(recv[:n]) != sent {
+		t.Fatalf("got c2.Read() = %q, %v, want = %q, %v", recv[:n], err, sent, nil)
+	}
+}
+
+func TestListenerDeadline(t *testing.T) {
+	s, e := newLoopbackStack()
+	if e != nil {
+		t.Fatalf("newLoopbackStack() = %v", e)
+	}
+
+	ip := tcpip.Address(net.IPv4(169, 254, 10, 1).To4())
+	addr := tcpip.FullAddress{NICID, ip, 11211}
+	s.AddAddress(NICID, ipv4.ProtocolNumber, ip)
+
+	l, err := ListenTCP(s, addr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal("ListenTCP:", err)
+	}
+	defer l.Close()
+
+	l.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	c, err := l.Accept()
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("got l.Accept() = %v, %v, want a timeout error", c, err)
+	}
+
+	// Clearing the deadline lets connections be accepted again.
+	l.SetDeadline(time.Time{})
+	dialed, err := DialTCP(s, addr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal("DialTCP:", err)
+	}
+	defer dialed.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal("l.Accept:", err)
+	}
+	accepted.Close()
+}
+
+func TestDialContextTCPCanceled(t *testing.T) {
+	s, e := newLoopbackStack()
+	if e != nil {
+		t.Fatalf("newLoopbackStack() = %v", e)
+	}
+
+	ip := tcpip.Address(net.IPv4(169, 254, 10, 1).To4())
+	s.AddAddress(NICID, ipv4.ProtocolNumber, ip)
+
+	// Nobody owns this address, so the handshake never completes.
+	addr := tcpip.FullAddress{NICID, tcpip.Address(net.IPv4(169, 254, 10, 9).To4()), 11211}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c, err := DialContextTCP(ctx, s, addr, ipv4.ProtocolNumber)
+	if oe, ok := err.(*net.OpError); !ok || oe.Err != context.DeadlineExceeded {
+		t.Fatalf("got DialContextTCP() = %v, %v, want an error wrapping %v", c, err, context.DeadlineExceeded)
+	}
+}
+
+func TestAcceptContextCanceled(t *testing.T) {
+	s, e := newLoopbackStack()
+	if e != nil {
+		t.Fatalf("newLoopbackStack() = %v", e)
+	}
+
+	ip := tcpip.Address(net.IPv4(169, 254, 10, 1).To4())
+	addr := tcpip.FullAddress{NICID, ip, 11211}
+	s.AddAddress(NICID, ipv4.ProtocolNumber, ip)
+
+	l, err := ListenTCP(s, addr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal("ListenTCP:", err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	c, err := l.AcceptContext(ctx)
+	if oe, ok := err.(*net.OpError); !ok || oe.Err != context.Canceled {
+		t.Fatalf("got l.AcceptContext() = %v, %v, want an error wrapping %v", c, err, context.Canceled)
+	}
+}
+
+func TestConcurrentAccept(t *testing.T) {
+	s, e := newLoopbackStack()
+	if e != nil {
+		t.Fatalf("newLoopbackStack() = %v", e)
+	}
+
+	ip := tcpip.Address(net.IPv4(169, 254, 10, 1).To4())
+	addr := tcpip.FullAddress{NICID, ip, 11211}
+	s.AddAddress(NICID, ipv4.ProtocolNumber, ip)
+
+	l, err := ListenTCP(s, addr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal("ListenTCP:", err)
+	}
+
+	// Each connection wakes a single one of the goroutines blocked in
+	// Accept, and all of them are accepted.
+	const n = 4
+	accepted := make(chan error, n+1)
+	for i := 0; i < n+1; i++ {
+		go func() {
+			c, err := l.Accept()
+			if err == nil {
+				c.Close()
+			}
+			accepted <- err
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < n; i++ {
+		c, err := DialTCP(s, addr, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal("DialTCP:", err)
+		}
+		defer c.Close()
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-accepted:
+			if err != nil {
+				t.Fatal("Accept:", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %d connections accepted, want %d", i, n)
+		}
+	}
+
+	// Closing the listener wakes the last one.
+	l.Close()
+	select {
+	case err := <-accepted:
+		if err == nil {
+			t.Error("Accept succeeded on a closed listener")
+		}
+	case <-time.After(time.Second):
+		t.Error("Accept still blocked after the listener was closed")
+	}
+}
+
 func makePipe() (c1, c2 net.Conn, stop func(), err error) {
 	s, e := newLoopbackStack()
 	if e != nil {
@@ -412,6 +608,48 @@ func TestTCPConnTransfer(t *testing.T) {
 	}
 }
 
+func TestTCPConnReadFromWriteTo(t *testing.T) {
+	c1, c2, stop, err := makePipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	c1.SetDeadline(time.Now().Add(5 * time.Second))
+	c2.SetDeadline(time.Now().Add(5 * time.Second))
+
+	sent := make([]byte, 3*readFromBufferSize+100)
+	for i := range sent {
+		sent[i] = byte(i)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		n, err := c1.(*Conn).ReadFrom(bytes.NewReader(sent))
+		if err == nil && n != int64(len(sent)) {
+			err = fmt.Errorf("got ReadFrom() = %d, want = %d", n, len(sent))
+		}
+		c1.Close()
+		errCh <- err
+	}()
+
+	var recv bytes.Buffer
+	n, err := c2.(*Conn).WriteTo(&recv)
+	if err != nil || n != int64(len(sent)) {
+		t.Fatalf("got WriteTo() = %d, %v, want = %d, %v", n, err, len(sent), nil)
+	}
+	if !bytes.Equal(recv.Bytes(), sent) {
+		t.Errorf("received data doesn't match the data sent")
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if c2.(*Conn).Endpoint() == nil {
+		t.Errorf("got Endpoint() = nil")
+	}
+}
+
 func TestTCPDialError(t *testing.T) {
 	s, e := newLoopbackStack()
 	if e != nil {
@@ -0,0 +1,237 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics exports the statistics of a tcpip stack, either in the
+// Prometheus text exposition format or as an expvar variable.
+//
+// Stack-wide counters are named after their path in tcpip.Stats, so that
+// Stats.TCP.ActiveConnectionOpenings becomes
+// netstack_tcp_active_connection_openings_total. Per-NIC counters are labeled
+// with the NIC's ID and name.
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// Prefix is the prefix of the names of all Prometheus metrics.
+const Prefix = "netstack"
+
+// Sample is the value of a counter, with its labels.
+type Sample struct {
+	Labels map[string]string
+	Value  uint64
+}
+
+// Metric is a counter, with one sample per combination of labels.
+type Metric struct {
+	// Name is the name of the counter, without the "_total" suffix that
+	// Prometheus counters get.
+	Name    string
+	Samples []Sample
+}
+
+var statCounterType = reflect.TypeOf((*tcpip.StatCounter)(nil))
+
+// Collect returns the counters of s, sorted by name.
+func Collect(s *stack.Stack) []Metric {
+	var metrics []Metric
+	walk(reflect.ValueOf(s.Stats()), nil, func(path []string, c *tcpip.StatCounter) {
+		metrics = append(metrics, Metric{
+			Name:    Prefix + "_" + strings.Join(path, "_"),
+			Samples: []Sample{{Value: c.Value()}},
+		})
+	})
+
+	nics := s.NICInfo()
+	ids := make([]int, 0, len(nics))
+	for id := range nics {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	byName := make(map[string]int)
+	for _, id := range ids {
+		info := nics[tcpip.NICID(id)]
+		labels := map[string]string{
+			"nic":  strconv.Itoa(id),
+			"name": info.Name,
+		}
+		walk(reflect.ValueOf(info.Stats), []string{"nic"}, func(path []string, c *tcpip.StatCounter) {
+			name := Prefix + "_" + strings.Join(path, "_")
+			i, ok := byName[name]
+			if !ok {
+				i = len(metrics)
+				byName[name] = i
+				metrics = append(metrics, Metric{Name: name})
+			}
+			metrics[i].Samples = append(metrics[i].Samples, Sample{Labels: labels, Value: c.Value()})
+		})
+	}
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+	return metrics
+}
+
+// walk calls fn with every counter found in v, a struct, along with the path
+// of snake-cased field names that leads to it.
+func walk(v reflect.Value, path []string, fn func([]string, *tcpip.StatCounter)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		p := path
+		// Embedded structs don't add to the path.
+		if !f.Anonymous {
+			p = append(path[:len(path):len(path)], snakeCase(f.Name))
+		}
+		fv := v.Field(i)
+		switch {
+		case f.Type == statCounterType:
+			if c := fv.Interface().(*tcpip.StatCounter); c != nil {
+				fn(p, c)
+			}
+		case f.Type.Kind() == reflect.Struct:
+			walk(fv, p, fn)
+		}
+	}
+}
+
+// snakeCase converts a Go identifier like "SACKRecovery" to "sack_recovery".
+func snakeCase(s string) string {
+	r := []rune(s)
+	var b strings.Builder
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) {
+			prev := r[i-1]
+			nextLower := i+1 < len(r) && unicode.IsLower(r[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(c))
+	}
+	return b.String()
+}
+
+// WritePrometheus writes the counters of s to w in the Prometheus text
+// exposition format.
+func WritePrometheus(w io.Writer, s *stack.Stack) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range Collect(s) {
+		name := m.Name + "_total"
+		fmt.Fprintf(bw, "# TYPE %s counter\n", name)
+		for _, sample := range m.Samples {
+			bw.WriteString(name)
+			writeLabels(bw, sample.Labels)
+			fmt.Fprintf(bw, " %d\n", sample.Value)
+		}
+	}
+	return bw.Flush()
+}
+
+func writeLabels(w *bufio.Writer, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		fmt.Fprintf(w, "%s=%q", k, labels[k])
+	}
+	w.WriteByte('}')
+}
+
+// Handler returns an HTTP handler that serves the counters of s in the
+// Prometheus text exposition format, to be scraped by a Prometheus server.
+func Handler(s *stack.Stack) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WritePrometheus(w, s)
+	})
+}
+
+// Var returns an expvar variable whose value is a JSON object holding the
+// counters of s: the stack-wide ones under "stack", keyed by field name like
+// in tcpip.Stats, and the per-NIC ones under "nics", keyed by NIC ID.
+func Var(s *stack.Stack) expvar.Var {
+	return expvar.Func(func() interface{} {
+		nics := make(map[string]interface{})
+		for id, info := range s.NICInfo() {
+			nic := tree(reflect.ValueOf(info.Stats))
+			nic["Name"] = info.Name
+			nics[strconv.Itoa(int(id))] = nic
+		}
+		return map[string]interface{}{
+			"stack": tree(reflect.ValueOf(s.Stats())),
+			"nics":  nics,
+		}
+	})
+}
+
+// tree returns the counters found in v, a struct, as nested maps keyed by
+// field name.
+func tree(v reflect.Value) map[string]interface{} {
+	m := make(map[string]interface{})
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		fv := v.Field(i)
+		switch {
+		case f.Type == statCounterType:
+			if c := fv.Interface().(*tcpip.StatCounter); c != nil {
+				m[f.Name] = c.Value()
+			}
+		case f.Type.Kind() == reflect.Struct:
+			sub := tree(fv)
+			if !f.Anonymous {
+				m[f.Name] = sub
+				continue
+			}
+			for k, v := range sub {
+				m[k] = v
+			}
+		}
+	}
+	return m
+}
+
+// Publish publishes the counters of s as the expvar variable with the given
+// name, like expvar.Publish. It panics if the name is already registered.
+func Publish(name string, s *stack.Stack) {
+	expvar.Publish(name, Var(s))
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/stack/stacktest"
+	"github.com/google/netstack/tcpip/transport/udp"
+)
+
+// newStack returns a stack with a NIC named "eth0" that received a packet of
+// 30 bytes too short to be an IPv4 packet.
+func newStack(t *testing.T) *stack.Stack {
+	id, linkEP := channel.New(1, 1500, "")
+	s := stacktest.New(t, []string{ipv4.ProtocolName}, []string{udp.ProtocolName}, id)
+	linkEP.Inject(ipv4.ProtocolNumber, buffer.NewView(10).ToVectorisedView())
+	s.Stats().TCP.ActiveConnectionOpenings.IncrementBy(3)
+	return s
+}
+
+func TestSnakeCase(t *testing.T) {
+	for in, want := range map[string]string{
+		"IP":                         "ip",
+		"PacketsReceived":            "packets_received",
+		"SACKRecovery":               "sack_recovery",
+		"V4PacketsSent":              "v4_packets_sent",
+		"UnknownProtocolRcvdPackets": "unknown_protocol_rcvd_packets",
+	} {
+		if got := snakeCase(in); got != want {
+			t.Errorf("got snakeCase(%q) = %q, want = %q", in, got, want)
+		}
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	s := newStack(t)
+	var b bytes.Buffer
+	if err := WritePrometheus(&b, s); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE netstack_tcp_active_connection_openings_total counter\nnetstack_tcp_active_connection_openings_total 3\n",
+		"netstack_malformed_rcvd_packets_total 1\n",
+		"netstack_icmp_v4_packets_sent_echo_total 0\n",
+		"# TYPE netstack_nic_rx_packets_total counter\nnetstack_nic_rx_packets_total{name=\"eth0\",nic=\"1\"} 1\n",
+		"netstack_nic_rx_bytes_total{name=\"eth0\",nic=\"1\"} 10\n",
+		"netstack_nic_rx_errors_total{name=\"eth0\",nic=\"1\"} 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("WritePrometheus output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s := newStack(t)
+	w := httptest.NewRecorder()
+	Handler(s).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if got, want := w.Header().Get("Content-Type"), "text/plain; version=0.0.4"; got != want {
+		t.Errorf("got Content-Type = %q, want = %q", got, want)
+	}
+	if !strings.Contains(w.Body.String(), "netstack_tcp_active_connection_openings_total 3\n") {
+		t.Errorf("unexpected response body:\n%s", w.Body.String())
+	}
+}
+
+func TestVar(t *testing.T) {
+	s := newStack(t)
+	var got struct {
+		Stack struct {
+			MalformedRcvdPackets uint64
+			TCP                  struct {
+				ActiveConnectionOpenings uint64
+			}
+			ICMP struct {
+				V4PacketsSent struct {
+					Echo *uint64
+				}
+			}
+		} `json:"stack"`
+		NICs map[string]struct {
+			Name string
+			Rx   struct {
+				Packets, Bytes, Errors uint64
+			}
+		} `json:"nics"`
+	}
+	if err := json.Unmarshal([]byte(Var(s).String()), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s) failed: %v", Var(s).String(), err)
+	}
+	if got.Stack.MalformedRcvdPackets != 1 || got.Stack.TCP.ActiveConnectionOpenings != 3 || got.Stack.ICMP.V4PacketsSent.Echo == nil {
+		t.Errorf("got stack counters = %+v, want MalformedRcvdPackets = 1, TCP.ActiveConnectionOpenings = 3 and ICMP.V4PacketsSent.Echo", got.Stack)
+	}
+	nic, ok := got.NICs["1"]
+	if !ok || nic.Name != "eth0" || nic.Rx.Packets != 1 || nic.Rx.Bytes != 10 || nic.Rx.Errors != 1 {
+		t.Errorf("got NICs = %+v, want NIC 1 named eth0 with 1 packet, 10 bytes and 1 error received", got.NICs)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package buffer
+
+import (
+	"sync/atomic"
+)
+
+// A Pool recycles Views of a fixed set of sizes, so that link endpoints need
+// not allocate new buffers for every packet they read.
+//
+// Each size has its own free list, which holds at most a fixed number of
+// Views; Views returned to a full free list are left to the garbage
+// collector. A Pool is safe for concurrent use.
+type Pool struct {
+	// free maps a View size to its free list. It is not modified after
+	// NewPool returns.
+	free map[int]chan View
+
+	// The following fields must be accessed atomically.
+	gets  uint64
+	hits  uint64
+	puts  uint64
+	drops uint64
+}
+
+// PoolStats holds the counters of a Pool.
+type PoolStats struct {
+	// Gets is the number of Views requested from the pool.
+	Gets uint64
+
+	// Hits is the number of requested Views that were recycled rather than
+	// newly allocated.
+	Hits uint64
+
+	// Puts is the number of Views returned to the pool.
+	Puts uint64
+
+	// Drops is the number of returned Views that were discarded because
+	// their free list was full or their size is not pooled.
+	Drops uint64
+}
+
+// HitRate returns the fraction of requested Views that were recycled.
+func (s PoolStats) HitRate() float64 {
+	if s.Gets == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Gets)
+}
+
+// NewPool creates a pool of Views of the given sizes, keeping up to capacity
+// free Views of each size.
+func NewPool(sizes []int, capacity int) *Pool {
+	p := &Pool{free: make(map[int]chan View, len(sizes))}
+	for _, s := range sizes {
+		p.free[s] = make(chan View, capacity)
+	}
+	return p
+}
+
+// Get returns a View of the given size, recycled if possible. Its contents
+// are undefined.
+func (p *Pool) Get(size int) View {
+	atomic.AddUint64(&p.gets, 1)
+	select {
+	case v := <-p.free[size]:
+		atomic.AddUint64(&p.hits, 1)
+		return v
+	default:
+		return NewView(size)
+	}
+}
+
+// Put returns v to the pool. v must have been obtained from Get and must not be
+// used afterwards. Views that were trimmed or capped since no longer have their
+// original size and are dropped.
+func (p *Pool) Put(v View) {
+	atomic.AddUint64(&p.puts, 1)
+	select {
+	case p.free[len(v)] <- v:
+	default:
+		atomic.AddUint64(&p.drops, 1)
+	}
+}
+
+// Stats returns a snapshot of the pool's counters.
+func (p *Pool) Stats() PoolStats {
+	return PoolStats{
+		Gets:  atomic.LoadUint64(&p.gets),
+		Hits:  atomic.LoadUint64(&p.hits),
+		Puts:  atomic.LoadUint64(&p.puts),
+		Drops: atomic.LoadUint64(&p.drops),
+	}
+}
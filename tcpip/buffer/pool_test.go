@@ -0,0 +1,48 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package buffer
+
+import (
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	p := NewPool([]int{64, 128}, 1)
+
+	v := p.Get(64)
+	if len(v) != 64 {
+		t.Fatalf("got view of length %d, want 64", len(v))
+	}
+	p.Put(v)
+
+	// The second Put overflows the free list and is dropped, as is a view
+	// of a size that isn't pooled.
+	p.Put(NewView(64))
+	p.Put(NewView(32))
+
+	if v := p.Get(64); len(v) != 64 {
+		t.Fatalf("got view of length %d, want 64", len(v))
+	}
+	p.Get(64)
+	p.Get(128)
+
+	want := PoolStats{Gets: 4, Hits: 1, Puts: 3, Drops: 2}
+	if got := p.Stats(); got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+	if got, want := p.Stats().HitRate(), 0.25; got != want {
+		t.Errorf("got hit rate %v, want %v", got, want)
+	}
+}
@@ -52,6 +52,11 @@ func (p Prependable) UsedLength() int {
 	return len(p.buf) - p.usedIdx
 }
 
+// AvailableLength returns the number of bytes that can still be prepended.
+func (p Prependable) AvailableLength() int {
+	return p.usedIdx
+}
+
 // Prepend reserves the requested space in front of the buffer, returning a
 // slice that represents the reserved space.
 func (p *Prependable) Prepend(size int) []byte {
@@ -0,0 +1,585 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config holds the configuration of a stack: the settings of its
+// NICs, their VRFs, addresses, subnets and static neighbors, the route table,
+// the multicast forwarding cache, the destination NAT rules and the
+// stack-wide options. A configuration can be read from a stack with Get,
+// serialized to a stable, self-describing binary format with MarshalBinary,
+// and applied to a stack with Apply, so that orchestration systems can
+// configure embedded stacks declaratively.
+//
+// NICs are created by the embedder along with their link endpoints, so a
+// configuration only holds the settings of existing NICs.
+package config
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// Config is the configuration of a stack. It is complete: its zero fields are
+// applied as such, rather than left unchanged, so new configurations are best
+// derived from the one returned by Get.
+type Config struct {
+	// NICs are the settings of the NICs of the stack. NICs that aren't
+	// listed are left as they are by Apply.
+	NICs []NIC
+
+	// Routes is the route table of the stack.
+	Routes []tcpip.Route
+
+	// MulticastRoutes are the entries of the multicast forwarding cache.
+	MulticastRoutes []MulticastRoute
+
+	// NATRules are the destination NAT rules of the stack.
+	NATRules []stack.NATRule
+
+	// Options are the stack-wide options.
+	Options Options
+}
+
+// NIC is the configuration of a NIC.
+type NIC struct {
+	// ID is the ID of the NIC, which must exist in the stack.
+	ID tcpip.NICID
+
+	// Up, Promiscuous, Spoofing and Transparent are the flags of the NIC,
+	// as set by Stack.SetNICUp, SetPromiscuousMode, SetSpoofing and
+	// SetTransparent.
+	Up          bool
+	Promiscuous bool
+	Spoofing    bool
+	Transparent bool
+
+	// MTU is the MTU of the NIC. Zero leaves it unchanged.
+	MTU uint32
+
+	// VRF is the VRF of the NIC, as set by Stack.SetNICVRF.
+	VRF tcpip.VRFID
+
+	// ReceiveHostModel and SendHostModel are the host models of the NIC,
+	// as set by Stack.SetNICHostModel.
+	ReceiveHostModel stack.HostModel
+	SendHostModel    stack.HostModel
+
+	// Addresses are the addresses of the NIC. The primary ones are listed
+	// in their order of preference.
+	Addresses []Address
+
+	// Subnets are the subnets of the NIC.
+	Subnets []tcpip.Subnet
+
+	// Neighbors are the static entries of the neighbor cache of the NIC,
+	// as added by Stack.AddStaticNeighbor.
+	Neighbors []Neighbor
+}
+
+// Address is an address of a NIC.
+type Address struct {
+	Protocol tcpip.NetworkProtocolNumber
+	Address  tcpip.Address
+
+	// Behavior tells whether the address can be primary. Only
+	// CanBePrimaryEndpoint and NeverPrimaryEndpoint are reported by Get;
+	// the preference between primary addresses is given by their order.
+	Behavior stack.PrimaryEndpointBehavior
+
+	// Anycast is set for the anycast addresses, added with
+	// Stack.AddAnycastAddress. Behavior is ignored for them.
+	Anycast bool
+}
+
+// Neighbor is a static entry of the neighbor cache of a NIC.
+type Neighbor struct {
+	Address     tcpip.Address
+	LinkAddress tcpip.LinkAddress
+}
+
+// MulticastRoute is an entry of the multicast forwarding cache, as added by
+// Stack.AddMulticastRoute. Source is empty for the route of the sources
+// without one of their own.
+type MulticastRoute struct {
+	Source tcpip.Address
+	Group  tcpip.Address
+	Route  stack.MulticastRoute
+}
+
+// Options are the stack-wide options of a configuration. Each one is set
+// with the Stack method of the same name prefixed by Set.
+type Options struct {
+	Forwarding        bool
+	AcceptRedirects   bool
+	SendRedirects     bool
+	AutoFlowLabels    bool
+	LoopbackFastPath  bool
+	ReceiveHostModel  stack.HostModel
+	SendHostModel     stack.HostModel
+	ICMPRateLimit     stack.ICMPRateLimit
+	ControlMemoryMax  int
+	NodeName          string
+	NodeInfoResponder bool
+}
+
+// Get returns the configuration of s.
+func Get(s *stack.Stack) *Config {
+	cp := s.Configuration()
+	c := &Config{
+		Routes:   cp.Routes,
+		NATRules: s.NATRules(),
+		Options: Options{
+			Forwarding:        s.Forwarding(),
+			AcceptRedirects:   s.AcceptRedirects(),
+			SendRedirects:     s.SendRedirects(),
+			AutoFlowLabels:    s.AutoFlowLabels(),
+			LoopbackFastPath:  s.LoopbackFastPath(),
+			ICMPRateLimit:     s.ICMPRateLimit(),
+			ControlMemoryMax:  s.ControlMemoryMax(),
+			NodeName:          s.NodeName(),
+			NodeInfoResponder: s.NodeInfoResponder(),
+		},
+	}
+	c.Options.ReceiveHostModel, c.Options.SendHostModel = s.HostModel()
+	for _, mc := range cp.MulticastRoutes {
+		c.MulticastRoutes = append(c.MulticastRoutes, MulticastRoute{
+			Source: mc.Source,
+			Group:  mc.Group,
+			Route:  mc.Route,
+		})
+	}
+	for _, nc := range cp.NICs {
+		n := NIC{
+			ID:          nc.ID,
+			Up:          nc.Up,
+			Promiscuous: nc.Promiscuous,
+			Spoofing:    nc.Spoofing,
+			Transparent: nc.Transparent,
+			MTU:         nc.MTU,
+			VRF:         nc.VRF,
+		}
+		// The NIC exists as it was just listed; if it was removed
+		// since, its host models are left at their defaults.
+		n.ReceiveHostModel, n.SendHostModel, _ = s.NICHostModel(nc.ID)
+		for _, a := range nc.Addresses {
+			n.Addresses = append(n.Addresses, Address{
+				Protocol: a.Protocol,
+				Address:  a.Address,
+				Behavior: a.Behavior,
+				Anycast:  a.Anycast,
+			})
+		}
+		for _, sc := range nc.Subnets {
+			// The subnets of the NIC are valid.
+			sn, _ := tcpip.NewSubnet(sc.Address, sc.Mask)
+			n.Subnets = append(n.Subnets, sn)
+		}
+		for _, nb := range nc.Neighbors {
+			n.Neighbors = append(n.Neighbors, Neighbor{
+				Address:     nb.Address,
+				LinkAddress: nb.LinkAddress,
+			})
+		}
+		c.NICs = append(c.NICs, n)
+	}
+	return c
+}
+
+// Apply applies c to s. The whole of c is checked against s before anything
+// is changed, so invalid configurations fail without side effects.
+//
+// Apply isn't atomic: the settings are changed one at a time, and other users
+// of s may observe the intermediate states. If applying c still fails midway,
+// which only happens when s is changed concurrently, the previous
+// configuration is restored and the error is returned as err. If restoring it
+// fails too, its error is returned as restoreErr, and s is left with parts of
+// both configurations.
+//
+// Only the settings that differ are changed, so that the connections using
+// the addresses that are kept aren't disturbed. Addresses whose behavior
+// changes, and primary addresses whose preference changes, are removed and
+// added back. FirstPrimaryEndpoint addresses are added as CanBePrimaryEndpoint
+// ones, in the order of preference they would have.
+func Apply(s *stack.Stack, c *Config) (err, restoreErr *tcpip.Error) {
+	if err := check(s, c); err != nil {
+		return err, nil
+	}
+	old := Get(s)
+	if err := apply(s, c); err != nil {
+		return err, apply(s, old)
+	}
+	return nil, nil
+}
+
+// addressSizes are the sizes of the addresses of the network protocols whose
+// addresses have a fixed size.
+var addressSizes = map[tcpip.NetworkProtocolNumber]int{
+	header.IPv4ProtocolNumber: header.IPv4AddressSize,
+	header.IPv6ProtocolNumber: header.IPv6AddressSize,
+}
+
+// check returns an error if c can't be applied to s, or if the stack would
+// reject any part of it.
+func check(s *stack.Stack, c *Config) *tcpip.Error {
+	if !validHostModel(c.Options.ReceiveHostModel) || !validHostModel(c.Options.SendHostModel) {
+		return tcpip.ErrInvalidOptionValue
+	}
+	nics := s.NICInfo()
+	seen := make(map[tcpip.NICID]bool)
+	for _, n := range c.NICs {
+		if _, ok := nics[n.ID]; !ok {
+			return tcpip.ErrUnknownNICID
+		}
+		if seen[n.ID] {
+			return tcpip.ErrInvalidOptionValue
+		}
+		seen[n.ID] = true
+		if err := checkNIC(s, n); err != nil {
+			return err
+		}
+	}
+	for _, r := range c.Routes {
+		if err := checkRoute(nics, r); err != nil {
+			return err
+		}
+	}
+	groups := make(map[[2]tcpip.Address]bool)
+	for _, mr := range c.MulticastRoutes {
+		if err := checkMulticastRoute(nics, mr); err != nil {
+			return err
+		}
+		key := [2]tcpip.Address{mr.Source, mr.Group}
+		if groups[key] {
+			return tcpip.ErrDuplicateAddress
+		}
+		groups[key] = true
+	}
+	for _, r := range c.NATRules {
+		if err := checkNATRule(nics, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNIC returns an error if the stack would reject the settings of n.
+func checkNIC(s *stack.Stack, n NIC) *tcpip.Error {
+	if !validHostModel(n.ReceiveHostModel) || !validHostModel(n.SendHostModel) {
+		return tcpip.ErrInvalidOptionValue
+	}
+	addrs := make(map[tcpip.Address]bool)
+	for _, a := range n.Addresses {
+		if !s.CheckNetworkProtocol(a.Protocol) {
+			return tcpip.ErrUnknownProtocol
+		}
+		if size, ok := addressSizes[a.Protocol]; ok && len(a.Address) != size {
+			return tcpip.ErrBadAddress
+		}
+		if a.Anycast {
+			if a.Protocol != header.IPv6ProtocolNumber {
+				return tcpip.ErrNotSupported
+			}
+			if header.IsV6MulticastAddress(a.Address) || a.Address == header.IPv6Any {
+				return tcpip.ErrBadAddress
+			}
+		} else if a.Behavior > stack.NeverPrimaryEndpoint {
+			return tcpip.ErrInvalidOptionValue
+		}
+		if addrs[a.Address] {
+			return tcpip.ErrDuplicateAddress
+		}
+		addrs[a.Address] = true
+	}
+	for _, sn := range n.Subnets {
+		if !validIPSize(len(sn.ID())) {
+			return tcpip.ErrBadAddress
+		}
+	}
+	neighbors := make(map[tcpip.Address]bool)
+	for _, nb := range n.Neighbors {
+		if !validIPSize(len(nb.Address)) {
+			return tcpip.ErrBadAddress
+		}
+		if neighbors[nb.Address] {
+			return tcpip.ErrDuplicateAddress
+		}
+		neighbors[nb.Address] = true
+	}
+	return nil
+}
+
+// checkRoute returns an error if r would never match, or would make the stack
+// misbehave, given the NICs of the stack.
+func checkRoute(nics map[tcpip.NICID]stack.NICInfo, r tcpip.Route) *tcpip.Error {
+	if r.Type < tcpip.RouteUnicast || r.Type > tcpip.RouteProhibit {
+		return tcpip.ErrInvalidOptionValue
+	}
+	if _, ok := nics[r.NIC]; r.NIC != 0 && !ok {
+		return tcpip.ErrUnknownNICID
+	}
+	if !validIPSize(len(r.Destination)) || len(r.Mask) != len(r.Destination) {
+		return tcpip.ErrBadAddress
+	}
+	for i := range r.Destination {
+		if r.Destination[i]&^r.Mask[i] != 0 {
+			return tcpip.ErrBadAddress
+		}
+	}
+	if r.Gateway != "" && len(r.Gateway) != len(r.Destination) {
+		return tcpip.ErrBadAddress
+	}
+	return nil
+}
+
+// checkMulticastRoute returns an error if the stack would reject mr given its
+// NICs.
+func checkMulticastRoute(nics map[tcpip.NICID]stack.NICInfo, mr MulticastRoute) *tcpip.Error {
+	if !header.IsV4MulticastAddress(mr.Group) && !header.IsV6MulticastAddress(mr.Group) {
+		return tcpip.ErrBadAddress
+	}
+	if mr.Source != "" && (len(mr.Source) != len(mr.Group) || header.IsV4MulticastAddress(mr.Source) || header.IsV6MulticastAddress(mr.Source)) {
+		return tcpip.ErrBadAddress
+	}
+	if _, ok := nics[mr.Route.InputNIC]; mr.Route.InputNIC != 0 && !ok {
+		return tcpip.ErrUnknownNICID
+	}
+	for _, out := range mr.Route.Outputs {
+		if _, ok := nics[out.NIC]; !ok {
+			return tcpip.ErrUnknownNICID
+		}
+	}
+	return nil
+}
+
+// checkNATRule returns an error if the stack would reject r given its NICs.
+func checkNATRule(nics map[tcpip.NICID]stack.NICInfo, r stack.NATRule) *tcpip.Error {
+	if r.Protocol != header.TCPProtocolNumber && r.Protocol != header.UDPProtocolNumber {
+		return tcpip.ErrUnknownProtocol
+	}
+	if _, ok := nics[r.NIC]; r.NIC != 0 && !ok {
+		return tcpip.ErrUnknownNICID
+	}
+	if !validIPSize(len(r.Destination.ID())) {
+		return tcpip.ErrBadAddress
+	}
+	if r.ToAddress != "" && len(r.ToAddress) != len(r.Destination.ID()) {
+		return tcpip.ErrBadAddress
+	}
+	return nil
+}
+
+// validIPSize returns whether size is the size of an IPv4 or IPv6 address.
+func validIPSize(size int) bool {
+	return size == header.IPv4AddressSize || size == header.IPv6AddressSize
+}
+
+// validHostModel returns whether m is one of the host models of the stack.
+func validHostModel(m stack.HostModel) bool {
+	return m == stack.HostModelInherit || m == stack.HostModelStrict || m == stack.HostModelWeak
+}
+
+// apply applies c to s, and stops at the first error.
+func apply(s *stack.Stack, c *Config) *tcpip.Error {
+	o := c.Options
+	s.SetForwarding(o.Forwarding)
+	s.SetAcceptRedirects(o.AcceptRedirects)
+	s.SetSendRedirects(o.SendRedirects)
+	s.SetAutoFlowLabels(o.AutoFlowLabels)
+	s.SetLoopbackFastPath(o.LoopbackFastPath)
+	if rcv, snd := s.HostModel(); rcv != o.ReceiveHostModel || snd != o.SendHostModel {
+		s.SetHostModel(o.ReceiveHostModel, o.SendHostModel)
+	}
+	// Setting the limit refills the buckets.
+	if s.ICMPRateLimit() != o.ICMPRateLimit {
+		s.SetICMPRateLimit(o.ICMPRateLimit)
+	}
+	s.SetControlMemoryMax(o.ControlMemoryMax)
+	s.SetNodeName(o.NodeName)
+	s.SetNodeInfoResponder(o.NodeInfoResponder)
+
+	cur := make(map[tcpip.NICID]NIC)
+	for _, n := range Get(s).NICs {
+		cur[n.ID] = n
+	}
+	for _, n := range c.NICs {
+		if err := applyNIC(s, cur[n.ID], n); err != nil {
+			return err
+		}
+	}
+
+	s.SetRouteTable(append([]tcpip.Route(nil), c.Routes...))
+
+	// Adding a multicast route replaces any previous one for the same
+	// source and group, so only the others need to be removed.
+	groups := make(map[[2]tcpip.Address]bool)
+	for _, mr := range c.MulticastRoutes {
+		groups[[2]tcpip.Address{mr.Source, mr.Group}] = true
+	}
+	for _, mr := range Get(s).MulticastRoutes {
+		if groups[[2]tcpip.Address{mr.Source, mr.Group}] {
+			continue
+		}
+		if err := s.RemoveMulticastRoute(mr.Source, mr.Group); err != nil {
+			return err
+		}
+	}
+	for _, mr := range c.MulticastRoutes {
+		if err := s.AddMulticastRoute(mr.Source, mr.Group, mr.Route); err != nil {
+			return err
+		}
+	}
+	return s.SetNATRules(c.NATRules)
+}
+
+// applyNIC changes the configuration of a NIC from cur to n.
+func applyNIC(s *stack.Stack, cur, n NIC) *tcpip.Error {
+	if err := s.SetNICUp(n.ID, n.Up); err != nil {
+		return err
+	}
+	if err := s.SetPromiscuousMode(n.ID, n.Promiscuous); err != nil {
+		return err
+	}
+	if err := s.SetSpoofing(n.ID, n.Spoofing); err != nil {
+		return err
+	}
+	if err := s.SetTransparent(n.ID, n.Transparent); err != nil {
+		return err
+	}
+	if n.MTU != 0 && n.MTU != cur.MTU {
+		if err := s.SetNICMTU(n.ID, n.MTU); err != nil {
+			return err
+		}
+	}
+	if err := s.SetNICHostModel(n.ID, n.ReceiveHostModel, n.SendHostModel); err != nil {
+		return err
+	}
+	if n.VRF != cur.VRF {
+		if err := s.SetNICVRF(n.ID, n.VRF); err != nil {
+			return err
+		}
+	}
+
+	// Addresses are added as CanBePrimaryEndpoint in the order of
+	// preference of the primary ones, so the primary addresses are only
+	// kept as long as their order is the same.
+	want := primaryAddresses(n.Addresses)
+	keep := make(map[Address]bool)
+	curPrimary := primaryAddresses(cur.Addresses)
+	for i := 0; i < len(curPrimary) && i < len(want) && curPrimary[i] == want[i]; i++ {
+		keep[want[i]] = true
+	}
+	for _, a := range n.Addresses {
+		if !isPrimary(a) {
+			a = normalize(a)
+			keep[a] = true
+			want = append(want, a)
+		}
+	}
+	have := make(map[Address]bool)
+	for _, a := range cur.Addresses {
+		a = normalize(a)
+		if keep[a] {
+			have[a] = true
+		} else if err := s.RemoveAddress(n.ID, a.Address); err != nil {
+			return err
+		}
+	}
+	for _, a := range want {
+		if have[a] {
+			continue
+		}
+		var err *tcpip.Error
+		if a.Anycast {
+			err = s.AddAnycastAddress(n.ID, a.Protocol, a.Address)
+		} else {
+			err = s.AddAddressWithOptions(n.ID, a.Protocol, a.Address, a.Behavior)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	subnets := make(map[tcpip.Subnet]bool)
+	for _, sn := range n.Subnets {
+		subnets[sn] = true
+	}
+	for _, sn := range cur.Subnets {
+		if subnets[sn] {
+			delete(subnets, sn)
+		} else if err := s.RemoveSubnet(n.ID, sn); err != nil {
+			return err
+		}
+	}
+	for _, sn := range n.Subnets {
+		if subnets[sn] {
+			if err := s.AddSubnet(n.ID, 0, sn); err != nil {
+				return err
+			}
+		}
+	}
+
+	neighbors := make(map[Neighbor]bool)
+	for _, nb := range n.Neighbors {
+		neighbors[nb] = true
+	}
+	for _, nb := range cur.Neighbors {
+		if neighbors[nb] {
+			delete(neighbors, nb)
+		} else if err := s.RemoveNeighbor(n.ID, nb.Address); err != nil {
+			return err
+		}
+	}
+	for _, nb := range n.Neighbors {
+		if neighbors[nb] {
+			if err := s.AddStaticNeighbor(n.ID, nb.Address, nb.LinkAddress); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// normalize returns a with the fields that don't matter cleared, so that
+// equivalent addresses compare equal.
+func normalize(a Address) Address {
+	switch {
+	case a.Anycast:
+		a.Behavior = stack.NeverPrimaryEndpoint
+	case a.Behavior == stack.FirstPrimaryEndpoint:
+		a.Behavior = stack.CanBePrimaryEndpoint
+	}
+	return a
+}
+
+// isPrimary returns whether a can be primary.
+func isPrimary(a Address) bool {
+	return normalize(a).Behavior == stack.CanBePrimaryEndpoint
+}
+
+// primaryAddresses returns the normalized addresses of addrs that can be
+// primary, in order of preference.
+func primaryAddresses(addrs []Address) []Address {
+	var primary, first []Address
+	for _, a := range addrs {
+		if !isPrimary(a) {
+			continue
+		}
+		if a.Behavior == stack.FirstPrimaryEndpoint {
+			first = append([]Address{normalize(a)}, first...)
+		} else {
+			primary = append(primary, normalize(a))
+		}
+	}
+	return append(first, primary...)
+}
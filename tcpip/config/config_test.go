@@ -0,0 +1,239 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/config"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/stack/stacktest"
+)
+
+const (
+	addr1   = tcpip.Address("\x0a\x00\x00\x01")
+	addr2   = tcpip.Address("\x0a\x00\x00\x02")
+	addr3   = tcpip.Address("\x0a\x00\x00\x03")
+	group   = tcpip.Address("\xe0\x00\x01\x01")
+	anycast = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+)
+
+func newStack(t *testing.T) *stack.Stack {
+	id, _ := channel.New(10, 1500, "")
+	s := stacktest.New(t, []string{ipv4.ProtocolName, ipv6.ProtocolName}, nil, id)
+	id, _ = channel.New(10, 1500, "")
+	if err := s.CreateNIC(2, id); err != nil {
+		t.Fatalf("CreateNIC(2): %v", err)
+	}
+	return s
+}
+
+// testConfig returns a configuration of the stack returned by newStack that
+// sets all the fields.
+func testConfig(t *testing.T) *config.Config {
+	subnet, err := tcpip.NewSubnet("\x0a\x01\x00\x00", "\xff\xff\x00\x00")
+	if err != nil {
+		t.Fatalf("NewSubnet: %v", err)
+	}
+	return &config.Config{
+		NICs: []config.NIC{
+			{
+				ID:               1,
+				Up:               true,
+				Promiscuous:      true,
+				MTU:              1500,
+				ReceiveHostModel: stack.HostModelWeak,
+				Addresses: []config.Address{
+					{Protocol: ipv4.ProtocolNumber, Address: addr1, Behavior: stack.CanBePrimaryEndpoint},
+					{Protocol: ipv4.ProtocolNumber, Address: addr2, Behavior: stack.CanBePrimaryEndpoint},
+					{Protocol: ipv4.ProtocolNumber, Address: addr3, Behavior: stack.NeverPrimaryEndpoint},
+					{Protocol: ipv6.ProtocolNumber, Address: anycast, Behavior: stack.NeverPrimaryEndpoint, Anycast: true},
+				},
+				Subnets: []tcpip.Subnet{subnet},
+				Neighbors: []config.Neighbor{
+					{Address: addr2, LinkAddress: "\x02\x00\x00\x00\x00\x02"},
+					{Address: addr3, LinkAddress: "\x02\x00\x00\x00\x00\x03"},
+				},
+			},
+			{
+				ID:          2,
+				Spoofing:    true,
+				Transparent: true,
+				MTU:         1500,
+				VRF:         1,
+			},
+		},
+		Routes: []tcpip.Route{
+			{Destination: "\x0a\x00\x00\x00", Mask: "\xff\x00\x00\x00", NIC: 1, Weight: 2, MTU: 1400, LockMTU: true, InitCwnd: 10},
+			{Destination: header.IPv4Any, Mask: "\x00\x00\x00\x00", Gateway: addr3, NIC: 2, AdvMSS: 1000, HopLimit: 32},
+			{Destination: "\xc0\x00\x02\x00", Mask: "\xff\xff\xff\x00", Type: tcpip.RouteBlackhole},
+		},
+		MulticastRoutes: []config.MulticastRoute{
+			{Group: group, Route: stack.MulticastRoute{Outputs: []stack.MulticastOutput{{NIC: 2}}}},
+			{Source: addr2, Group: group, Route: stack.MulticastRoute{
+				InputNIC: 1,
+				Outputs:  []stack.MulticastOutput{{NIC: 2, TTLThreshold: 3}},
+			}},
+		},
+		NATRules: []stack.NATRule{
+			{NIC: 1, Protocol: header.TCPProtocolNumber, Destination: subnet, DestinationPort: 80, ToPort: 8080},
+			{Protocol: header.UDPProtocolNumber, Destination: subnet, ToAddress: addr1},
+		},
+		Options: config.Options{
+			Forwarding:       true,
+			AcceptRedirects:  true,
+			SendRedirects:    true,
+			AutoFlowLabels:   true,
+			LoopbackFastPath: true,
+			SendHostModel:    stack.HostModelWeak,
+			ICMPRateLimit: stack.ICMPRateLimit{
+				Rate:                1.5,
+				Burst:               3,
+				PerDestinationRate:  0.25,
+				PerDestinationBurst: 1,
+			},
+			ControlMemoryMax:  4096,
+			NodeName:          "host.example.com.",
+			NodeInfoResponder: true,
+		},
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	want := testConfig(t)
+	b, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	var got config.Config
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if !reflect.DeepEqual(&got, want) {
+		t.Fatalf("got UnmarshalBinary() = %+v, want %+v", got, want)
+	}
+
+	// Unknown fields, here a varint and a message, are skipped.
+	unknown := append(append([]byte(nil), b...), 14<<3, 1, 15<<3|2, 2, 8, 1)
+	if err := got.UnmarshalBinary(unknown); err != nil {
+		t.Fatalf("UnmarshalBinary with unknown fields: %v", err)
+	}
+	if !reflect.DeepEqual(&got, want) {
+		t.Fatalf("got UnmarshalBinary() with unknown fields = %+v, want %+v", got, want)
+	}
+
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"bad magic", append([]byte("XXXX"), b[4:]...), config.ErrBadMagic},
+		{"unsupported version", append([]byte("NSCF\x02"), b[5:]...), config.ErrUnsupportedVersion},
+		{"truncated", b[:len(b)-1], config.ErrMalformed},
+		{"wrong wire type", []byte("NSCF\x01\x1a\x02\x0a\x00"), config.ErrMalformed},
+	} {
+		if err := got.UnmarshalBinary(tc.b); err != tc.want {
+			t.Errorf("%s: got UnmarshalBinary() = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	s := newStack(t)
+	want := testConfig(t)
+	if err, _ := config.Apply(s, want); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if got := config.Get(s); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got Get() = %+v, want %+v", got, want)
+	}
+
+	// Changing the order of the primary addresses and the behavior of the
+	// others is applied.
+	want.NICs[0].Addresses = []config.Address{
+		{Protocol: ipv4.ProtocolNumber, Address: addr2, Behavior: stack.CanBePrimaryEndpoint},
+		{Protocol: ipv4.ProtocolNumber, Address: addr3, Behavior: stack.CanBePrimaryEndpoint},
+		{Protocol: ipv4.ProtocolNumber, Address: addr1, Behavior: stack.NeverPrimaryEndpoint},
+	}
+	want.NICs[0].Subnets = nil
+	want.NICs[0].Neighbors = []config.Neighbor{{Address: addr3, LinkAddress: "\x02\x00\x00\x00\x00\x04"}}
+	want.NICs[1].VRF = 0
+	want.MulticastRoutes = want.MulticastRoutes[1:]
+	want.NATRules = want.NATRules[:1]
+	want.Options.NodeInfoResponder = false
+	if err, _ := config.Apply(s, want); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if got := config.Get(s); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got Get() = %+v, want %+v", got, want)
+	}
+
+	// Configurations that can't be applied are rejected as a whole, and
+	// leave the previous one.
+	for _, tc := range []struct {
+		name   string
+		modify func(*config.Config)
+		want   *tcpip.Error
+	}{
+		{"unknown NIC", func(c *config.Config) { c.NICs[1].ID = 3 }, tcpip.ErrUnknownNICID},
+		{"duplicate NIC", func(c *config.Config) { c.NICs[1].ID = 1 }, tcpip.ErrInvalidOptionValue},
+		{"unknown protocol", func(c *config.Config) {
+			c.NICs[1].Addresses = []config.Address{{Protocol: 1234, Address: addr1}}
+		}, tcpip.ErrUnknownProtocol},
+		{"bad address length", func(c *config.Config) {
+			c.NICs[1].Addresses = []config.Address{{Protocol: ipv4.ProtocolNumber, Address: anycast}}
+		}, tcpip.ErrBadAddress},
+		{"duplicate address", func(c *config.Config) {
+			c.NICs[0].Addresses = append(c.NICs[0].Addresses, c.NICs[0].Addresses[0])
+		}, tcpip.ErrDuplicateAddress},
+		{"IPv4 anycast address", func(c *config.Config) {
+			c.NICs[1].Addresses = []config.Address{{Protocol: ipv4.ProtocolNumber, Address: addr1, Anycast: true}}
+		}, tcpip.ErrNotSupported},
+		{"bad behavior", func(c *config.Config) { c.NICs[0].Addresses[0].Behavior = 7 }, tcpip.ErrInvalidOptionValue},
+		{"bad host model", func(c *config.Config) { c.NICs[1].SendHostModel = 7 }, tcpip.ErrInvalidOptionValue},
+		{"route to unknown NIC", func(c *config.Config) { c.Routes[0].NIC = 3 }, tcpip.ErrUnknownNICID},
+		{"route with short mask", func(c *config.Config) { c.Routes[0].Mask = "\xff" }, tcpip.ErrBadAddress},
+		{"route with host bits", func(c *config.Config) { c.Routes[0].Destination = addr1 }, tcpip.ErrBadAddress},
+		{"route with bad gateway", func(c *config.Config) { c.Routes[1].Gateway = anycast }, tcpip.ErrBadAddress},
+		{"bad route type", func(c *config.Config) { c.Routes[2].Type = 7 }, tcpip.ErrInvalidOptionValue},
+		{"bad neighbor address", func(c *config.Config) { c.NICs[0].Neighbors[0].Address = "\x0a" }, tcpip.ErrBadAddress},
+		{"duplicate neighbor", func(c *config.Config) { c.NICs[0].Neighbors[1].Address = addr2 }, tcpip.ErrDuplicateAddress},
+		{"multicast route to unicast group", func(c *config.Config) { c.MulticastRoutes[0].Group = addr1 }, tcpip.ErrBadAddress},
+		{"multicast route out of unknown NIC", func(c *config.Config) {
+			c.MulticastRoutes[1].Route.Outputs[0].NIC = 3
+		}, tcpip.ErrUnknownNICID},
+		{"duplicate multicast route", func(c *config.Config) { c.MulticastRoutes[0].Source = addr2 }, tcpip.ErrDuplicateAddress},
+		{"NAT rule of unknown protocol", func(c *config.Config) { c.NATRules[0].Protocol = 1234 }, tcpip.ErrUnknownProtocol},
+		{"NAT rule to bad address", func(c *config.Config) { c.NATRules[1].ToAddress = anycast }, tcpip.ErrBadAddress},
+	} {
+		bad := testConfig(t)
+		// Settings that would be applied before the bad ones.
+		bad.Options.NodeName = "bad.example.com."
+		bad.NICs[0].Up = false
+		tc.modify(bad)
+		if err, restoreErr := config.Apply(s, bad); err != tc.want || restoreErr != nil {
+			t.Errorf("%s: got Apply() = (%v, %v), want (%v, <nil>)", tc.name, err, restoreErr, tc.want)
+		}
+		if got := config.Get(s); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got Get() after failed Apply() = %+v, want %+v", tc.name, got, want)
+		}
+	}
+}
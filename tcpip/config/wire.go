@@ -0,0 +1,739 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// The binary format starts with magic, followed by the version of the format
+// as a varint, and then by the fields of the Config message.
+//
+// A message is a sequence of fields, each one made of a key and a value. The
+// key is a varint holding the number of the field, shifted left by 3, ORed
+// with the type of the value:
+//
+//	wireVarint  - a varint; signed integers are zigzag encoded
+//	wireFixed64 - 8 little-endian bytes; floats are IEEE 754 binary64
+//	wireBytes   - a varint length followed by that many bytes, holding a
+//	              string, an address or a nested message
+//
+// Repeated fields appear once per element, in order. Fields with the zero
+// value are omitted, and fields with unknown numbers are skipped, so that
+// fields can be added without changing the version. The version only changes
+// when the meaning of existing fields does.
+//
+// The field numbers of each message are the constants below, named after the
+// message and field.
+const (
+	magic   = "NSCF"
+	version = 1
+
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// Fields of Config.
+const (
+	configNIC            = 1
+	configRoute          = 2
+	configOptions        = 3
+	configMulticastRoute = 4
+	configNATRule        = 5
+)
+
+// Fields of NIC.
+const (
+	nicID               = 1
+	nicUp               = 2
+	nicPromiscuous      = 3
+	nicSpoofing         = 4
+	nicTransparent      = 5
+	nicMTU              = 6
+	nicReceiveHostModel = 7
+	nicSendHostModel    = 8
+	nicAddress          = 9
+	nicSubnet           = 10
+	nicVRF              = 11
+	nicNeighbor         = 12
+)
+
+// Fields of Address.
+const (
+	addressProtocol = 1
+	addressAddress  = 2
+	addressBehavior = 3
+	addressAnycast  = 4
+)
+
+// Fields of tcpip.Subnet.
+const (
+	subnetAddress = 1
+	subnetMask    = 2
+)
+
+// Fields of Neighbor.
+const (
+	neighborAddress     = 1
+	neighborLinkAddress = 2
+)
+
+// Fields of tcpip.Route.
+const (
+	routeDestination = 1
+	routeMask        = 2
+	routeGateway     = 3
+	routeNIC         = 4
+	routeType        = 5
+	routeWeight      = 6
+	routeMTU         = 7
+	routeLockMTU     = 8
+	routeAdvMSS      = 9
+	routeInitCwnd    = 10
+	routeHopLimit    = 11
+)
+
+// Fields of MulticastRoute, whose Route is flattened into it.
+const (
+	multicastRouteSource   = 1
+	multicastRouteGroup    = 2
+	multicastRouteInputNIC = 3
+	multicastRouteOutput   = 4
+)
+
+// Fields of stack.MulticastOutput.
+const (
+	multicastOutputNIC          = 1
+	multicastOutputTTLThreshold = 2
+)
+
+// Fields of stack.NATRule, whose Destination is flattened into it.
+const (
+	natRuleNIC             = 1
+	natRuleProtocol        = 2
+	natRuleAddress         = 3
+	natRuleMask            = 4
+	natRuleDestinationPort = 5
+	natRuleToAddress       = 6
+	natRuleToPort          = 7
+)
+
+// Fields of Options.
+const (
+	optionsForwarding        = 1
+	optionsAcceptRedirects   = 2
+	optionsSendRedirects     = 3
+	optionsAutoFlowLabels    = 4
+	optionsLoopbackFastPath  = 5
+	optionsReceiveHostModel  = 6
+	optionsSendHostModel     = 7
+	optionsICMPRateLimit     = 8
+	optionsControlMemoryMax  = 9
+	optionsNodeName          = 10
+	optionsNodeInfoResponder = 11
+)
+
+// Fields of stack.ICMPRateLimit.
+const (
+	rateLimitRate                = 1
+	rateLimitBurst               = 2
+	rateLimitPerDestinationRate  = 3
+	rateLimitPerDestinationBurst = 4
+)
+
+var (
+	// ErrBadMagic is returned when decoding data that doesn't start with
+	// the magic of the format.
+	ErrBadMagic = errors.New("config: bad magic")
+
+	// ErrUnsupportedVersion is returned when decoding data written in an
+	// unknown version of the format.
+	ErrUnsupportedVersion = errors.New("config: unsupported version")
+
+	// ErrMalformed is returned when decoding data that isn't well-formed.
+	ErrMalformed = errors.New("config: malformed data")
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (c *Config) MarshalBinary() ([]byte, error) {
+	e := encoder(magic)
+	e.varint(version)
+	for _, n := range c.NICs {
+		e.message(configNIC, n.encode)
+	}
+	for _, r := range c.Routes {
+		e.message(configRoute, func(e *encoder) { encodeRoute(e, r) })
+	}
+	e.message(configOptions, c.Options.encode)
+	for _, mr := range c.MulticastRoutes {
+		e.message(configMulticastRoute, mr.encode)
+	}
+	for _, r := range c.NATRules {
+		e.message(configNATRule, func(e *encoder) { encodeNATRule(e, r) })
+	}
+	return e, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (c *Config) UnmarshalBinary(b []byte) error {
+	if len(b) < len(magic) || string(b[:len(magic)]) != magic {
+		return ErrBadMagic
+	}
+	b = b[len(magic):]
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return ErrMalformed
+	}
+	if v != version {
+		return ErrUnsupportedVersion
+	}
+	*c = Config{}
+	return decode(b[n:], func(f int, v value) error {
+		switch f {
+		case configNIC:
+			var n NIC
+			if err := v.message(n.decode); err != nil {
+				return err
+			}
+			c.NICs = append(c.NICs, n)
+		case configRoute:
+			var r tcpip.Route
+			if err := v.message(func(f int, v value) error { return decodeRoute(&r, f, v) }); err != nil {
+				return err
+			}
+			c.Routes = append(c.Routes, r)
+		case configOptions:
+			return v.message(c.Options.decode)
+		case configMulticastRoute:
+			var mr MulticastRoute
+			if err := v.message(mr.decode); err != nil {
+				return err
+			}
+			c.MulticastRoutes = append(c.MulticastRoutes, mr)
+		case configNATRule:
+			r, err := decodeNATRule(v)
+			if err != nil {
+				return err
+			}
+			c.NATRules = append(c.NATRules, r)
+		}
+		return nil
+	})
+}
+
+func (n *NIC) encode(e *encoder) {
+	e.uint(nicID, uint64(n.ID))
+	e.bool(nicUp, n.Up)
+	e.bool(nicPromiscuous, n.Promiscuous)
+	e.bool(nicSpoofing, n.Spoofing)
+	e.bool(nicTransparent, n.Transparent)
+	e.uint(nicMTU, uint64(n.MTU))
+	e.uint(nicReceiveHostModel, uint64(n.ReceiveHostModel))
+	e.uint(nicSendHostModel, uint64(n.SendHostModel))
+	for _, a := range n.Addresses {
+		e.message(nicAddress, a.encode)
+	}
+	for _, sn := range n.Subnets {
+		e.message(nicSubnet, func(e *encoder) {
+			e.bytes(subnetAddress, []byte(sn.ID()))
+			e.bytes(subnetMask, []byte(sn.Mask()))
+		})
+	}
+	e.uint(nicVRF, uint64(n.VRF))
+	for _, nb := range n.Neighbors {
+		e.message(nicNeighbor, func(e *encoder) {
+			e.bytes(neighborAddress, []byte(nb.Address))
+			e.bytes(neighborLinkAddress, []byte(nb.LinkAddress))
+		})
+	}
+}
+
+func (n *NIC) decode(f int, v value) error {
+	var err error
+	switch f {
+	case nicID:
+		var id uint64
+		id, err = v.uint()
+		n.ID = tcpip.NICID(id)
+	case nicUp:
+		n.Up, err = v.bool()
+	case nicPromiscuous:
+		n.Promiscuous, err = v.bool()
+	case nicSpoofing:
+		n.Spoofing, err = v.bool()
+	case nicTransparent:
+		n.Transparent, err = v.bool()
+	case nicMTU:
+		var mtu uint64
+		mtu, err = v.uint()
+		n.MTU = uint32(mtu)
+	case nicReceiveHostModel:
+		var m uint64
+		m, err = v.uint()
+		n.ReceiveHostModel = stack.HostModel(m)
+	case nicSendHostModel:
+		var m uint64
+		m, err = v.uint()
+		n.SendHostModel = stack.HostModel(m)
+	case nicAddress:
+		var a Address
+		err = v.message(a.decode)
+		n.Addresses = append(n.Addresses, a)
+	case nicSubnet:
+		var addr, mask []byte
+		err = v.message(func(f int, v value) error {
+			var err error
+			switch f {
+			case subnetAddress:
+				addr, err = v.bytes()
+			case subnetMask:
+				mask, err = v.bytes()
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		sn, serr := tcpip.NewSubnet(tcpip.Address(addr), tcpip.AddressMask(mask))
+		if serr != nil {
+			return ErrMalformed
+		}
+		n.Subnets = append(n.Subnets, sn)
+	case nicVRF:
+		var vrf uint64
+		vrf, err = v.uint()
+		n.VRF = tcpip.VRFID(vrf)
+	case nicNeighbor:
+		var nb Neighbor
+		err = v.message(func(f int, v value) error {
+			var err error
+			var b []byte
+			switch f {
+			case neighborAddress:
+				b, err = v.bytes()
+				nb.Address = tcpip.Address(b)
+			case neighborLinkAddress:
+				b, err = v.bytes()
+				nb.LinkAddress = tcpip.LinkAddress(b)
+			}
+			return err
+		})
+		n.Neighbors = append(n.Neighbors, nb)
+	}
+	return err
+}
+
+func (a *Address) encode(e *encoder) {
+	e.uint(addressProtocol, uint64(a.Protocol))
+	e.bytes(addressAddress, []byte(a.Address))
+	e.uint(addressBehavior, uint64(a.Behavior))
+	e.bool(addressAnycast, a.Anycast)
+}
+
+func (a *Address) decode(f int, v value) error {
+	var err error
+	switch f {
+	case addressProtocol:
+		var p uint64
+		p, err = v.uint()
+		a.Protocol = tcpip.NetworkProtocolNumber(p)
+	case addressAddress:
+		var b []byte
+		b, err = v.bytes()
+		a.Address = tcpip.Address(b)
+	case addressBehavior:
+		var peb uint64
+		peb, err = v.uint()
+		a.Behavior = stack.PrimaryEndpointBehavior(peb)
+	case addressAnycast:
+		a.Anycast, err = v.bool()
+	}
+	return err
+}
+
+func encodeRoute(e *encoder, r tcpip.Route) {
+	e.bytes(routeDestination, []byte(r.Destination))
+	e.bytes(routeMask, []byte(r.Mask))
+	e.bytes(routeGateway, []byte(r.Gateway))
+	e.uint(routeNIC, uint64(r.NIC))
+	e.uint(routeType, uint64(r.Type))
+	e.int(routeWeight, int64(r.Weight))
+	e.uint(routeMTU, uint64(r.MTU))
+	e.bool(routeLockMTU, r.LockMTU)
+	e.uint(routeAdvMSS, uint64(r.AdvMSS))
+	e.int(routeInitCwnd, int64(r.InitCwnd))
+	e.uint(routeHopLimit, uint64(r.HopLimit))
+}
+
+func decodeRoute(r *tcpip.Route, f int, v value) error {
+	var err error
+	var b []byte
+	var u uint64
+	var i int64
+	switch f {
+	case routeDestination:
+		b, err = v.bytes()
+		r.Destination = tcpip.Address(b)
+	case routeMask:
+		b, err = v.bytes()
+		r.Mask = tcpip.AddressMask(b)
+	case routeGateway:
+		b, err = v.bytes()
+		r.Gateway = tcpip.Address(b)
+	case routeNIC:
+		u, err = v.uint()
+		r.NIC = tcpip.NICID(u)
+	case routeType:
+		u, err = v.uint()
+		r.Type = tcpip.RouteType(u)
+	case routeWeight:
+		i, err = v.int()
+		r.Weight = int(i)
+	case routeMTU:
+		u, err = v.uint()
+		r.MTU = uint32(u)
+	case routeLockMTU:
+		r.LockMTU, err = v.bool()
+	case routeAdvMSS:
+		u, err = v.uint()
+		r.AdvMSS = uint16(u)
+	case routeInitCwnd:
+		i, err = v.int()
+		r.InitCwnd = int(i)
+	case routeHopLimit:
+		u, err = v.uint()
+		r.HopLimit = uint8(u)
+	}
+	return err
+}
+
+func (mr *MulticastRoute) encode(e *encoder) {
+	e.bytes(multicastRouteSource, []byte(mr.Source))
+	e.bytes(multicastRouteGroup, []byte(mr.Group))
+	e.uint(multicastRouteInputNIC, uint64(mr.Route.InputNIC))
+	for _, out := range mr.Route.Outputs {
+		e.message(multicastRouteOutput, func(e *encoder) {
+			e.uint(multicastOutputNIC, uint64(out.NIC))
+			e.uint(multicastOutputTTLThreshold, uint64(out.TTLThreshold))
+		})
+	}
+}
+
+func (mr *MulticastRoute) decode(f int, v value) error {
+	var err error
+	var b []byte
+	var u uint64
+	switch f {
+	case multicastRouteSource:
+		b, err = v.bytes()
+		mr.Source = tcpip.Address(b)
+	case multicastRouteGroup:
+		b, err = v.bytes()
+		mr.Group = tcpip.Address(b)
+	case multicastRouteInputNIC:
+		u, err = v.uint()
+		mr.Route.InputNIC = tcpip.NICID(u)
+	case multicastRouteOutput:
+		var out stack.MulticastOutput
+		err = v.message(func(f int, v value) error {
+			var err error
+			var u uint64
+			switch f {
+			case multicastOutputNIC:
+				u, err = v.uint()
+				out.NIC = tcpip.NICID(u)
+			case multicastOutputTTLThreshold:
+				u, err = v.uint()
+				out.TTLThreshold = uint8(u)
+			}
+			return err
+		})
+		mr.Route.Outputs = append(mr.Route.Outputs, out)
+	}
+	return err
+}
+
+func encodeNATRule(e *encoder, r stack.NATRule) {
+	e.uint(natRuleNIC, uint64(r.NIC))
+	e.uint(natRuleProtocol, uint64(r.Protocol))
+	e.bytes(natRuleAddress, []byte(r.Destination.ID()))
+	e.bytes(natRuleMask, []byte(r.Destination.Mask()))
+	e.uint(natRuleDestinationPort, uint64(r.DestinationPort))
+	e.bytes(natRuleToAddress, []byte(r.ToAddress))
+	e.uint(natRuleToPort, uint64(r.ToPort))
+}
+
+func decodeNATRule(v value) (stack.NATRule, error) {
+	var r stack.NATRule
+	var addr, mask []byte
+	err := v.message(func(f int, v value) error {
+		var err error
+		var b []byte
+		var u uint64
+		switch f {
+		case natRuleNIC:
+			u, err = v.uint()
+			r.NIC = tcpip.NICID(u)
+		case natRuleProtocol:
+			u, err = v.uint()
+			r.Protocol = tcpip.TransportProtocolNumber(u)
+		case natRuleAddress:
+			addr, err = v.bytes()
+		case natRuleMask:
+			mask, err = v.bytes()
+		case natRuleDestinationPort:
+			u, err = v.uint()
+			r.DestinationPort = uint16(u)
+		case natRuleToAddress:
+			b, err = v.bytes()
+			r.ToAddress = tcpip.Address(b)
+		case natRuleToPort:
+			u, err = v.uint()
+			r.ToPort = uint16(u)
+		}
+		return err
+	})
+	if err != nil {
+		return r, err
+	}
+	sn, serr := tcpip.NewSubnet(tcpip.Address(addr), tcpip.AddressMask(mask))
+	if serr != nil {
+		return r, ErrMalformed
+	}
+	r.Destination = sn
+	return r, nil
+}
+
+func (o *Options) encode(e *encoder) {
+	e.bool(optionsForwarding, o.Forwarding)
+	e.bool(optionsAcceptRedirects, o.AcceptRedirects)
+	e.bool(optionsSendRedirects, o.SendRedirects)
+	e.bool(optionsAutoFlowLabels, o.AutoFlowLabels)
+	e.bool(optionsLoopbackFastPath, o.LoopbackFastPath)
+	e.uint(optionsReceiveHostModel, uint64(o.ReceiveHostModel))
+	e.uint(optionsSendHostModel, uint64(o.SendHostModel))
+	e.message(optionsICMPRateLimit, func(e *encoder) {
+		l := o.ICMPRateLimit
+		e.float(rateLimitRate, l.Rate)
+		e.int(rateLimitBurst, int64(l.Burst))
+		e.float(rateLimitPerDestinationRate, l.PerDestinationRate)
+		e.int(rateLimitPerDestinationBurst, int64(l.PerDestinationBurst))
+	})
+	e.int(optionsControlMemoryMax, int64(o.ControlMemoryMax))
+	e.bytes(optionsNodeName, []byte(o.NodeName))
+	e.bool(optionsNodeInfoResponder, o.NodeInfoResponder)
+}
+
+func (o *Options) decode(f int, v value) error {
+	var err error
+	var u uint64
+	var i int64
+	switch f {
+	case optionsForwarding:
+		o.Forwarding, err = v.bool()
+	case optionsAcceptRedirects:
+		o.AcceptRedirects, err = v.bool()
+	case optionsSendRedirects:
+		o.SendRedirects, err = v.bool()
+	case optionsAutoFlowLabels:
+		o.AutoFlowLabels, err = v.bool()
+	case optionsLoopbackFastPath:
+		o.LoopbackFastPath, err = v.bool()
+	case optionsReceiveHostModel:
+		u, err = v.uint()
+		o.ReceiveHostModel = stack.HostModel(u)
+	case optionsSendHostModel:
+		u, err = v.uint()
+		o.SendHostModel = stack.HostModel(u)
+	case optionsICMPRateLimit:
+		l := &o.ICMPRateLimit
+		err = v.message(func(f int, v value) error {
+			var err error
+			var i int64
+			switch f {
+			case rateLimitRate:
+				l.Rate, err = v.float()
+			case rateLimitBurst:
+				i, err = v.int()
+				l.Burst = int(i)
+			case rateLimitPerDestinationRate:
+				l.PerDestinationRate, err = v.float()
+			case rateLimitPerDestinationBurst:
+				i, err = v.int()
+				l.PerDestinationBurst = int(i)
+			}
+			return err
+		})
+	case optionsControlMemoryMax:
+		i, err = v.int()
+		o.ControlMemoryMax = int(i)
+	case optionsNodeName:
+		var b []byte
+		b, err = v.bytes()
+		o.NodeName = string(b)
+	case optionsNodeInfoResponder:
+		o.NodeInfoResponder, err = v.bool()
+	}
+	return err
+}
+
+// encoder appends the fields of a message to itself.
+type encoder []byte
+
+func (e *encoder) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	*e = append(*e, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (e *encoder) key(f, wire int) {
+	e.varint(uint64(f)<<3 | uint64(wire))
+}
+
+func (e *encoder) uint(f int, v uint64) {
+	if v != 0 {
+		e.key(f, wireVarint)
+		e.varint(v)
+	}
+}
+
+func (e *encoder) int(f int, v int64) {
+	// Zigzag encoding keeps small negative numbers short.
+	e.uint(f, uint64(v<<1)^uint64(v>>63))
+}
+
+func (e *encoder) bool(f int, v bool) {
+	if v {
+		e.uint(f, 1)
+	}
+}
+
+func (e *encoder) float(f int, v float64) {
+	if v != 0 {
+		e.key(f, wireFixed64)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		*e = append(*e, b[:]...)
+	}
+}
+
+func (e *encoder) bytes(f int, v []byte) {
+	if len(v) != 0 {
+		e.key(f, wireBytes)
+		e.varint(uint64(len(v)))
+		*e = append(*e, v...)
+	}
+}
+
+// message appends a nested message, whose fields are encoded by fn. Unlike
+// the other values, it's appended even if it's empty, as it may be an element
+// of a repeated field.
+func (e *encoder) message(f int, fn func(*encoder)) {
+	var m encoder
+	fn(&m)
+	e.key(f, wireBytes)
+	e.varint(uint64(len(m)))
+	*e = append(*e, m...)
+}
+
+// value is the value of a decoded field.
+type value struct {
+	wire int
+	u    uint64
+	b    []byte
+}
+
+func (v value) uint() (uint64, error) {
+	if v.wire != wireVarint {
+		return 0, ErrMalformed
+	}
+	return v.u, nil
+}
+
+func (v value) int() (int64, error) {
+	u, err := v.uint()
+	return int64(u>>1) ^ -int64(u&1), err
+}
+
+func (v value) bool() (bool, error) {
+	u, err := v.uint()
+	return u != 0, err
+}
+
+func (v value) float() (float64, error) {
+	if v.wire != wireFixed64 {
+		return 0, ErrMalformed
+	}
+	return math.Float64frombits(v.u), nil
+}
+
+func (v value) bytes() ([]byte, error) {
+	if v.wire != wireBytes {
+		return nil, ErrMalformed
+	}
+	return v.b, nil
+}
+
+func (v value) message(fn func(f int, v value) error) error {
+	b, err := v.bytes()
+	if err != nil {
+		return err
+	}
+	return decode(b, fn)
+}
+
+// decode calls fn with each field of the message in b.
+func decode(b []byte, fn func(f int, v value) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 || key>>3 == 0 || key>>3 > math.MaxInt32 {
+			return ErrMalformed
+		}
+		b = b[n:]
+		v := value{wire: int(key & 7)}
+		switch v.wire {
+		case wireVarint:
+			v.u, n = binary.Uvarint(b)
+			if n <= 0 {
+				return ErrMalformed
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return ErrMalformed
+			}
+			v.u = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return ErrMalformed
+			}
+			v.b = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			return ErrMalformed
+		}
+		if err := fn(int(key>>3), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
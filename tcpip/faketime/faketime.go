@@ -0,0 +1,220 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package faketime provides a tcpip.Clock whose time only passes when told
+// to, so tests can exercise timeouts deterministically and without sleeping.
+package faketime
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// ManualClock is a tcpip.Clock that is only advanced by calls to Advance. Its
+// real and monotonic times are the same, and start at the Unix epoch.
+//
+// Timer functions are called synchronously by Advance, in expiration order,
+// with the clock set to their expiration time.
+//
+// This struct is safe for concurrent use.
+type ManualClock struct {
+	mu sync.Mutex
+
+	// now is the current time of the clock, in nanoseconds.
+	now int64
+
+	// timers holds the pending timers, ordered by expiration time.
+	timers timerHeap
+
+	// seq is the number of timers scheduled so far, used to call timers
+	// with the same expiration time in the order they were scheduled.
+	seq uint64
+}
+
+var _ tcpip.Clock = (*ManualClock)(nil)
+
+// NewManualClock returns a manual clock set to the Unix epoch.
+func NewManualClock() *ManualClock {
+	return &ManualClock{}
+}
+
+// NowNanoseconds implements tcpip.Clock.NowNanoseconds.
+func (c *ManualClock) NowNanoseconds() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NowMonotonic implements tcpip.Clock.NowMonotonic.
+func (c *ManualClock) NowMonotonic() int64 {
+	return c.NowNanoseconds()
+}
+
+// Elapsed returns the time elapsed since the clock was created.
+func (c *ManualClock) Elapsed() time.Duration {
+	return time.Duration(c.NowNanoseconds())
+}
+
+// AfterFunc implements tcpip.Clock.AfterFunc.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) tcpip.Timer {
+	t := &manualTimer{clock: c, f: f, index: -1}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, calling the functions of the timers
+// that expire on the way.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now + int64(d)
+	c.mu.Unlock()
+	c.advanceTo(target)
+}
+
+// AdvanceToNext moves the clock forward to the expiration time of the next
+// pending timer and calls the functions of the timers expiring then. It
+// returns false, without changing the time, if there are no pending timers.
+func (c *ManualClock) AdvanceToNext() bool {
+	c.mu.Lock()
+	if len(c.timers) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	target := c.timers[0].when
+	c.mu.Unlock()
+	c.advanceTo(target)
+	return true
+}
+
+// NextExpiration returns the time left until the next pending timer expires,
+// and whether there is one.
+func (c *ManualClock) NextExpiration() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.timers) == 0 {
+		return 0, false
+	}
+	return time.Duration(c.timers[0].when - c.now), true
+}
+
+// advanceTo moves the clock forward to target. Timer functions are called
+// without holding the lock, so they can use the clock and schedule timers,
+// which are called too if they expire before target.
+func (c *ManualClock) advanceTo(target int64) {
+	for {
+		c.mu.Lock()
+		if len(c.timers) == 0 || c.timers[0].when > target {
+			if target > c.now {
+				c.now = target
+			}
+			c.mu.Unlock()
+			return
+		}
+		t := heap.Pop(&c.timers).(*manualTimer)
+		if t.when > c.now {
+			c.now = t.when
+		}
+		f := t.f
+		c.mu.Unlock()
+		f()
+	}
+}
+
+// manualTimer implements tcpip.Timer for ManualClock.
+type manualTimer struct {
+	clock *ManualClock
+	f     func()
+
+	// The fields below are protected by clock.mu.
+
+	// when is the expiration time of the timer.
+	when int64
+
+	// seq orders timers with the same expiration time.
+	seq uint64
+
+	// index is the position of the timer in clock.timers, or -1 if the
+	// timer isn't pending.
+	index int
+}
+
+// Stop implements tcpip.Timer.Stop.
+func (t *manualTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&c.timers, t.index)
+	return true
+}
+
+// Reset implements tcpip.Timer.Reset.
+func (t *manualTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active := t.index >= 0
+	if active {
+		heap.Remove(&c.timers, t.index)
+	}
+	if d < 0 {
+		d = 0
+	}
+	t.when = c.now + int64(d)
+	t.seq = c.seq
+	c.seq++
+	heap.Push(&c.timers, t)
+	return active
+}
+
+// timerHeap is a min-heap of timers, ordered by expiration time.
+type timerHeap []*manualTimer
+
+func (h timerHeap) Len() int {
+	return len(h)
+}
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when != h[j].when {
+		return h[i].when < h[j].when
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*manualTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package faketime_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip/faketime"
+)
+
+func TestAdvance(t *testing.T) {
+	c := faketime.NewManualClock()
+	var fired []time.Duration
+	record := func() { fired = append(fired, c.Elapsed()) }
+
+	c.AfterFunc(3*time.Second, record)
+	c.AfterFunc(time.Second, record)
+	c.AfterFunc(2*time.Second, func() {
+		record()
+		// Timers scheduled by timer functions fire in the same call to
+		// Advance if they expire in time.
+		c.AfterFunc(500*time.Millisecond, record)
+	})
+
+	c.Advance(2500 * time.Millisecond)
+	if want := []time.Duration{time.Second, 2 * time.Second, 2500 * time.Millisecond}; !reflect.DeepEqual(fired, want) {
+		t.Fatalf("got timers fired at %v, want %v", fired, want)
+	}
+	if got, want := c.Elapsed(), 2500*time.Millisecond; got != want {
+		t.Fatalf("got Elapsed() = %v, want %v", got, want)
+	}
+	if got, want := c.NowMonotonic(), int64(2500*time.Millisecond); got != want {
+		t.Fatalf("got NowMonotonic() = %d, want %d", got, want)
+	}
+
+	if d, ok := c.NextExpiration(); !ok || d != 500*time.Millisecond {
+		t.Fatalf("got NextExpiration() = (%v, %t), want (%v, true)", d, ok, 500*time.Millisecond)
+	}
+	if !c.AdvanceToNext() {
+		t.Fatal("AdvanceToNext() = false, want true")
+	}
+	if got, want := len(fired), 4; got != want {
+		t.Fatalf("got %d timers fired, want %d", got, want)
+	}
+	if c.AdvanceToNext() {
+		t.Fatal("AdvanceToNext() = true with no pending timers, want false")
+	}
+}
+
+func TestStopReset(t *testing.T) {
+	c := faketime.NewManualClock()
+	fired := 0
+	tm := c.AfterFunc(time.Second, func() { fired++ })
+
+	if !tm.Stop() {
+		t.Fatal("Stop() = false on a pending timer, want true")
+	}
+	if tm.Stop() {
+		t.Fatal("Stop() = true on a stopped timer, want false")
+	}
+	c.Advance(2 * time.Second)
+	if fired != 0 {
+		t.Fatalf("stopped timer fired %d times", fired)
+	}
+
+	if tm.Reset(time.Second) {
+		t.Fatal("Reset() = true on a stopped timer, want false")
+	}
+	if !tm.Reset(2 * time.Second) {
+		t.Fatal("Reset() = false on a pending timer, want true")
+	}
+	c.Advance(time.Second)
+	if fired != 0 {
+		t.Fatalf("timer fired before its reset expiration time")
+	}
+	c.Advance(time.Second)
+	if fired != 1 {
+		t.Fatalf("got timer fired %d times, want 1", fired)
+	}
+}
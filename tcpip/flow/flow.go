@@ -0,0 +1,205 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flow extracts the flow that packets belong to from their headers,
+// and hashes flows so that all the packets of one, and the endpoints handling
+// it, get the same hash. The stack uses it to spread flows over REUSEPORT
+// endpoints, RSS queues and ECMP next hops, and embedders can use it to keep
+// the same affinity.
+package flow
+
+import (
+	"encoding/binary"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/network/hash"
+)
+
+// maxExtensionHeaders is the largest number of IPv6 extension headers Dissect
+// skips to find the transport header.
+const maxExtensionHeaders = 8
+
+// Key identifies a flow: the packets with the same Key belong to the same flow,
+// in the same direction.
+type Key struct {
+	// NetProto is the network protocol of the flow.
+	NetProto tcpip.NetworkProtocolNumber
+
+	// TransProto is the transport protocol of the flow.
+	TransProto tcpip.TransportProtocolNumber
+
+	// Src and Dst are the source and destination addresses of the flow.
+	Src tcpip.Address
+	Dst tcpip.Address
+
+	// SrcPort and DstPort are the source and destination ports of the
+	// flow, for the transport protocols that have ports. ICMP echo
+	// requests and replies use their identifier as both. They are zero for
+	// the other protocols, and for IP fragments.
+	SrcPort uint16
+	DstPort uint16
+}
+
+// Reverse returns the key of the flow in the other direction.
+func (k Key) Reverse() Key {
+	k.Src, k.Dst = k.Dst, k.Src
+	k.SrcPort, k.DstPort = k.DstPort, k.SrcPort
+	return k
+}
+
+// Fields selects the fields of a Key that Hash uses.
+type Fields uint8
+
+const (
+	// Addresses hashes the source and destination addresses.
+	Addresses Fields = 1 << iota
+
+	// Protocol hashes the transport protocol.
+	Protocol
+
+	// Ports hashes the source and destination ports.
+	Ports
+
+	// Symmetric makes both directions of a flow hash the same, so that a
+	// flow and its Reverse do.
+	Symmetric
+)
+
+const (
+	// FourTuple hashes the addresses and ports of a flow.
+	FourTuple = Addresses | Ports
+
+	// FiveTuple hashes the addresses, transport protocol and ports of a
+	// flow.
+	FiveTuple = Addresses | Protocol | Ports
+)
+
+// Hash returns the hash of the fields of k selected by fields. The hash only
+// depends on these fields and on seed, so it's stable for a given seed.
+func (k Key) Hash(fields Fields, seed uint32) uint32 {
+	if fields&Addresses == 0 {
+		k.Src, k.Dst = "", ""
+	}
+	if fields&Protocol == 0 {
+		k.TransProto = 0
+	}
+	if fields&Ports == 0 {
+		k.SrcPort, k.DstPort = 0, 0
+	}
+	if fields&Symmetric != 0 && (k.Dst < k.Src || (k.Dst == k.Src && k.DstPort < k.SrcPort)) {
+		k = k.Reverse()
+	}
+	return hash.TupleHash(k.Src, k.Dst, k.TransProto, k.SrcPort, k.DstPort, seed)
+}
+
+// Dissect returns the key of the flow of the packet in b, which starts with a
+// network header of the given protocol. It returns false if the protocol isn't
+// IPv4 or IPv6, or if the network header is truncated. IPv6 extension headers
+// are skipped to find the transport header.
+func Dissect(protocol tcpip.NetworkProtocolNumber, b []byte) (Key, bool) {
+	k := Key{NetProto: protocol}
+	var payload []byte
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		if len(b) < header.IPv4MinimumSize {
+			return Key{}, false
+		}
+		ip := header.IPv4(b)
+		k.Src, k.Dst = ip.SourceAddress(), ip.DestinationAddress()
+		k.TransProto = ip.TransportProtocol()
+		// Fragments are kept with the rest of their datagram, so their
+		// ports aren't used.
+		fragment := ip.FragmentOffset() != 0 || ip.Flags()&header.IPv4FlagMoreFragments != 0
+		if hl := int(ip.HeaderLength()); hl <= len(b) && !fragment {
+			payload = b[hl:]
+		}
+	case header.IPv6ProtocolNumber:
+		if len(b) < header.IPv6MinimumSize {
+			return Key{}, false
+		}
+		ip := header.IPv6(b)
+		k.Src, k.Dst = ip.SourceAddress(), ip.DestinationAddress()
+		k.TransProto, payload = skipExtensionHeaders(ip.NextHeader(), b[header.IPv6MinimumSize:])
+	default:
+		return Key{}, false
+	}
+
+	switch k.TransProto {
+	case header.TCPProtocolNumber, header.UDPProtocolNumber:
+		if len(payload) >= 4 {
+			k.SrcPort = binary.BigEndian.Uint16(payload)
+			k.DstPort = binary.BigEndian.Uint16(payload[2:])
+		}
+	case header.ICMPv4ProtocolNumber:
+		if len(payload) >= header.ICMPv4EchoMinimumSize {
+			if t := header.ICMPv4(payload).Type(); t == header.ICMPv4Echo || t == header.ICMPv4EchoReply {
+				k.SrcPort = binary.BigEndian.Uint16(payload[4:])
+				k.DstPort = k.SrcPort
+			}
+		}
+	case header.ICMPv6ProtocolNumber:
+		if len(payload) >= header.ICMPv6EchoMinimumSize {
+			if t := header.ICMPv6(payload).Type(); t == header.ICMPv6EchoRequest || t == header.ICMPv6EchoReply {
+				k.SrcPort = binary.BigEndian.Uint16(payload[4:])
+				k.DstPort = k.SrcPort
+			}
+		}
+	}
+	return k, true
+}
+
+// skipExtensionHeaders skips the IPv6 extension headers at the start of b, the
+// first of which is next, and returns the transport protocol and header that
+// follow. The header is nil if it can't be found, or if the packet is a
+// fragment.
+func skipExtensionHeaders(next uint8, b []byte) (tcpip.TransportProtocolNumber, []byte) {
+	for i := 0; i < maxExtensionHeaders; i++ {
+		switch next {
+		case header.IPv6HopByHopOptionsHeader, header.IPv6RoutingHeader, header.IPv6DestinationOptionsHeader:
+			if len(b) < 2 {
+				return tcpip.TransportProtocolNumber(next), nil
+			}
+			n := (int(b[1]) + 1) * 8
+			if len(b) < n {
+				return tcpip.TransportProtocolNumber(next), nil
+			}
+			next, b = b[0], b[n:]
+		case header.IPv6FragmentHeader:
+			f := header.IPv6Fragment(b)
+			if !f.IsValid() {
+				return tcpip.TransportProtocolNumber(next), nil
+			}
+			next = f.NextHeader()
+			if f.FragmentOffset() != 0 || f.More() {
+				return tcpip.TransportProtocolNumber(next), nil
+			}
+			b = f.Payload()
+		default:
+			return tcpip.TransportProtocolNumber(next), b
+		}
+	}
+	return tcpip.TransportProtocolNumber(next), nil
+}
+
+// Hash dissects the packet in b, which starts with a network header of the
+// given protocol, and returns the hash of the fields of its flow selected by
+// fields. Packets that can't be dissected hash to zero.
+func Hash(protocol tcpip.NetworkProtocolNumber, b []byte, fields Fields, seed uint32) uint32 {
+	k, ok := Dissect(protocol, b)
+	if !ok {
+		return 0
+	}
+	return k.Hash(fields, seed)
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flow_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/flow"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/network/hash"
+)
+
+const (
+	v4Src = tcpip.Address("\x0a\x00\x00\x01")
+	v4Dst = tcpip.Address("\x0a\x00\x00\x02")
+	v6Src = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+	v6Dst = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02")
+)
+
+// ipv4Packet builds an IPv4 packet carrying payload with the given transport
+// protocol and fragment fields.
+func ipv4Packet(proto tcpip.TransportProtocolNumber, flags uint8, offset uint16, payload []byte) []byte {
+	b := make([]byte, header.IPv4MinimumSize+len(payload))
+	header.IPv4(b).Encode(&header.IPv4Fields{
+		IHL:            header.IPv4MinimumSize,
+		TotalLength:    uint16(len(b)),
+		Flags:          flags,
+		FragmentOffset: offset,
+		TTL:            64,
+		Protocol:       uint8(proto),
+		SrcAddr:        v4Src,
+		DstAddr:        v4Dst,
+	})
+	copy(b[header.IPv4MinimumSize:], payload)
+	return b
+}
+
+// ipv6Packet builds an IPv6 packet whose first next header is next, followed
+// by payload.
+func ipv6Packet(next uint8, payload []byte) []byte {
+	b := make([]byte, header.IPv6MinimumSize+len(payload))
+	header.IPv6(b).Encode(&header.IPv6Fields{
+		PayloadLength: uint16(len(payload)),
+		NextHeader:    next,
+		HopLimit:      64,
+		SrcAddr:       v6Src,
+		DstAddr:       v6Dst,
+	})
+	copy(b[header.IPv6MinimumSize:], payload)
+	return b
+}
+
+// key returns the flow.Key with the given fields.
+func key(netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, src, dst tcpip.Address, srcPort, dstPort uint16) flow.Key {
+	return flow.Key{
+		NetProto:   netProto,
+		TransProto: transProto,
+		Src:        src,
+		Dst:        dst,
+		SrcPort:    srcPort,
+		DstPort:    dstPort,
+	}
+}
+
+// ports returns a transport header starting with the given ports.
+func ports(src, dst uint16) []byte {
+	b := make([]byte, header.UDPMinimumSize)
+	binary.BigEndian.PutUint16(b, src)
+	binary.BigEndian.PutUint16(b[2:], dst)
+	return b
+}
+
+// echo returns an ICMP echo header of the given type and identifier.
+func echo(typ uint8, id uint16) []byte {
+	b := make([]byte, 8)
+	b[0] = typ
+	binary.BigEndian.PutUint16(b[4:], id)
+	return b
+}
+
+func TestDissect(t *testing.T) {
+	// A hop-by-hop options header of 8 bytes with padding only, then a
+	// destination options header of 16 bytes.
+	extensions := append([]byte{header.IPv6DestinationOptionsHeader, 0, 1, 4, 0, 0, 0, 0}, uint8(header.UDPProtocolNumber), 1, 1, 12)
+	extensions = append(extensions, make([]byte, 12)...)
+	// A fragment header for the first fragment, with more to follow.
+	fragment := []byte{uint8(header.UDPProtocolNumber), 0, 0, 1, 0, 0, 0, 1}
+
+	for _, tc := range []struct {
+		name     string
+		protocol tcpip.NetworkProtocolNumber
+		packet   []byte
+		want     flow.Key
+	}{
+		{
+			name:     "IPv4 TCP",
+			protocol: header.IPv4ProtocolNumber,
+			packet:   ipv4Packet(header.TCPProtocolNumber, 0, 0, ports(1000, 80)),
+			want:     key(header.IPv4ProtocolNumber, header.TCPProtocolNumber, v4Src, v4Dst, 1000, 80),
+		},
+		{
+			name:     "IPv4 fragment",
+			protocol: header.IPv4ProtocolNumber,
+			packet:   ipv4Packet(header.UDPProtocolNumber, header.IPv4FlagMoreFragments, 0, ports(1000, 53)),
+			want:     key(header.IPv4ProtocolNumber, header.UDPProtocolNumber, v4Src, v4Dst, 0, 0),
+		},
+		{
+			name:     "ICMPv4 echo",
+			protocol: header.IPv4ProtocolNumber,
+			packet:   ipv4Packet(header.ICMPv4ProtocolNumber, 0, 0, echo(uint8(header.ICMPv4Echo), 7)),
+			want:     key(header.IPv4ProtocolNumber, header.ICMPv4ProtocolNumber, v4Src, v4Dst, 7, 7),
+		},
+		{
+			name:     "IPv6 UDP after extension headers",
+			protocol: header.IPv6ProtocolNumber,
+			packet:   ipv6Packet(header.IPv6HopByHopOptionsHeader, append(extensions, ports(1000, 53)...)),
+			want:     key(header.IPv6ProtocolNumber, header.UDPProtocolNumber, v6Src, v6Dst, 1000, 53),
+		},
+		{
+			name:     "IPv6 fragment",
+			protocol: header.IPv6ProtocolNumber,
+			packet:   ipv6Packet(header.IPv6FragmentHeader, append(fragment, ports(1000, 53)...)),
+			want:     key(header.IPv6ProtocolNumber, header.UDPProtocolNumber, v6Src, v6Dst, 0, 0),
+		},
+		{
+			name:     "ICMPv6 echo reply",
+			protocol: header.IPv6ProtocolNumber,
+			packet:   ipv6Packet(uint8(header.ICMPv6ProtocolNumber), echo(uint8(header.ICMPv6EchoReply), 9)),
+			want:     key(header.IPv6ProtocolNumber, header.ICMPv6ProtocolNumber, v6Src, v6Dst, 9, 9),
+		},
+		{
+			name:     "truncated transport header",
+			protocol: header.IPv4ProtocolNumber,
+			packet:   ipv4Packet(header.TCPProtocolNumber, 0, 0, []byte{1, 2}),
+			want:     key(header.IPv4ProtocolNumber, header.TCPProtocolNumber, v4Src, v4Dst, 0, 0),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := flow.Dissect(tc.protocol, tc.packet)
+			if !ok {
+				t.Fatal("Dissect failed")
+			}
+			if got != tc.want {
+				t.Fatalf("got Dissect() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+
+	if _, ok := flow.Dissect(header.IPv4ProtocolNumber, make([]byte, header.IPv4MinimumSize-1)); ok {
+		t.Error("Dissect succeeded on a truncated IPv4 header")
+	}
+	if _, ok := flow.Dissect(header.ARPProtocolNumber, make([]byte, header.ARPSize)); ok {
+		t.Error("Dissect succeeded on an ARP packet")
+	}
+}
+
+func TestHash(t *testing.T) {
+	const seed = 0x5eed
+	k := key(header.IPv4ProtocolNumber, header.TCPProtocolNumber, v4Src, v4Dst, 1000, 80)
+
+	if got, want := k.Hash(flow.FiveTuple, seed), hash.TupleHash(v4Src, v4Dst, header.TCPProtocolNumber, 1000, 80, seed); got != want {
+		t.Errorf("got five-tuple hash %#x, want TupleHash %#x", got, want)
+	}
+	if got, want := flow.Hash(header.IPv4ProtocolNumber, ipv4Packet(header.TCPProtocolNumber, 0, 0, ports(1000, 80)), flow.FiveTuple, seed), k.Hash(flow.FiveTuple, seed); got != want {
+		t.Errorf("got packet hash %#x, want key hash %#x", got, want)
+	}
+
+	if k.Hash(flow.FiveTuple, seed) == k.Reverse().Hash(flow.FiveTuple, seed) {
+		t.Error("both directions of a flow have the same asymmetric hash")
+	}
+	if got, want := k.Reverse().Hash(flow.FiveTuple|flow.Symmetric, seed), k.Hash(flow.FiveTuple|flow.Symmetric, seed); got != want {
+		t.Errorf("got symmetric hash %#x of the reverse flow, want %#x", got, want)
+	}
+
+	// Fields that aren't selected don't change the hash.
+	other := k
+	other.TransProto = header.UDPProtocolNumber
+	if k.Hash(flow.FourTuple, seed) != other.Hash(flow.FourTuple, seed) {
+		t.Error("the four-tuple hash depends on the transport protocol")
+	}
+	other = k
+	other.SrcPort++
+	if k.Hash(flow.Addresses, seed) != other.Hash(flow.Addresses, seed) {
+		t.Error("the address hash depends on the ports")
+	}
+	if k.Hash(flow.FourTuple, seed) == other.Hash(flow.FourTuple, seed) {
+		t.Error("the four-tuple hash doesn't depend on the ports")
+	}
+}
@@ -18,24 +18,49 @@ package header
 
 import (
 	"encoding/binary"
+	"math/bits"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 )
 
 func calculateChecksum(buf []byte, initial uint32) uint16 {
-	v := initial
-
-	l := len(buf)
-	if l&1 != 0 {
-		l--
-		v += uint32(buf[l]) << 8
+	// The one's complement sum can be computed with words of any size as
+	// long as the end-around carry is kept (RFC 1071, section 2(B)), so
+	// sum 64-bit words and fold the result down to 16 bits at the end.
+	sum := uint64(initial)
+	var carry uint64
+	for len(buf) >= 32 {
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(buf), carry)
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(buf[8:]), carry)
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(buf[16:]), carry)
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(buf[24:]), carry)
+		buf = buf[32:]
+	}
+	for len(buf) >= 8 {
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(buf), carry)
+		buf = buf[8:]
 	}
+	sum, carry = bits.Add64(sum, 0, carry)
+	sum += carry
 
-	for i := 0; i < l; i += 2 {
-		v += (uint32(buf[i]) << 8) + uint32(buf[i+1])
+	// Fold to 32 bits so that the remaining bytes can't overflow the sum.
+	sum = (sum >> 32) + (sum & 0xffffffff)
+	if len(buf) >= 4 {
+		sum += uint64(binary.BigEndian.Uint32(buf))
+		buf = buf[4:]
+	}
+	if len(buf) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(buf))
+		buf = buf[2:]
+	}
+	if len(buf) == 1 {
+		sum += uint64(buf[0]) << 8
 	}
 
+	sum = (sum >> 32) + (sum & 0xffffffff)
+	sum = (sum >> 32) + (sum & 0xffffffff)
+	v := uint32(sum)
 	return ChecksumCombine(uint16(v), uint16(v>>16))
 }
 
@@ -78,6 +103,25 @@ func ChecksumCombine(a, b uint16) uint16 {
 	return uint16(v + v>>16)
 }
 
+// ChecksumUpdate returns the checksum of a header or packet whose checksum
+// field holds xsum, after a 16-bit word at an even offset covered by the
+// checksum changes from old to new (RFC 1624, equation 3). It lets NAT and
+// other packet rewriters fix up checksums without recomputing them over the
+// whole packet.
+func ChecksumUpdate(xsum, old, new uint16) uint16 {
+	return ^ChecksumCombine(ChecksumCombine(^xsum, ^old), new)
+}
+
+// ChecksumUpdateAddress is like ChecksumUpdate, but for an address at an even
+// offset changing from old to new. Both addresses must have the same, even,
+// length.
+func ChecksumUpdateAddress(xsum uint16, old, new tcpip.Address) uint16 {
+	for i := 0; i+1 < len(old); i += 2 {
+		xsum = ChecksumUpdate(xsum, uint16(old[i])<<8|uint16(old[i+1]), uint16(new[i])<<8|uint16(new[i+1]))
+	}
+	return xsum
+}
+
 // PseudoHeaderChecksum calculates the pseudo-header checksum for the given
 // destination protocol and network address. Pseudo-headers are needed by
 // transport layers when calculating their own checksum.
@@ -92,3 +136,11 @@ func PseudoHeaderChecksum(protocol tcpip.TransportProtocolNumber, srcAddr tcpip.
 
 	return Checksum([]byte{0, uint8(protocol)}, xsum)
 }
+
+// JumboPseudoHeaderChecksum is like PseudoHeaderChecksum, but takes the 32-bit
+// upper-layer packet length of IPv6, which exceeds 16 bits in jumbograms (RFC
+// 2675, section 4).
+func JumboPseudoHeaderChecksum(protocol tcpip.TransportProtocolNumber, srcAddr tcpip.Address, dstAddr tcpip.Address, totalLen uint32) uint16 {
+	xsum := PseudoHeaderChecksum(protocol, srcAddr, dstAddr, uint16(totalLen))
+	return ChecksumCombine(xsum, uint16(totalLen>>16))
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package header_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// referenceChecksum is a straightforward implementation of RFC 1071.
+func referenceChecksum(buf []byte, initial uint16) uint16 {
+	v := uint32(initial)
+	for i := 0; i+1 < len(buf); i += 2 {
+		v += uint32(buf[i])<<8 + uint32(buf[i+1])
+	}
+	if len(buf)&1 != 0 {
+		v += uint32(buf[len(buf)-1]) << 8
+	}
+	for v > 0xffff {
+		v = v>>16 + v&0xffff
+	}
+	return uint16(v)
+}
+
+func TestChecksum(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	buf := make([]byte, 1500)
+	for size := 0; size <= 100; size++ {
+		for _, fill := range []string{"random", "ones"} {
+			b := buf[:size]
+			for i := range b {
+				if fill == "ones" {
+					b[i] = 0xff
+				} else {
+					b[i] = byte(rng.Intn(256))
+				}
+			}
+			initial := uint16(rng.Intn(0x10000))
+			if got, want := header.Checksum(b, initial), referenceChecksum(b, initial); got != want {
+				t.Errorf("got Checksum(%s %d bytes, 0x%x) = 0x%x, want 0x%x", fill, size, initial, got, want)
+			}
+		}
+	}
+}
+
+func TestChecksumVV(t *testing.T) {
+	data := make([]byte, 101)
+	rand.New(rand.NewSource(1)).Read(data)
+	want := referenceChecksum(data, 0)
+	for _, cuts := range [][]int{{1}, {3, 50}, {8, 9, 64, 99}} {
+		var views []buffer.View
+		prev := 0
+		for _, c := range append(cuts, len(data)) {
+			views = append(views, data[prev:c])
+			prev = c
+		}
+		if got := header.ChecksumVV(buffer.NewVectorisedView(len(data), views), 0); got != want {
+			t.Errorf("got ChecksumVV split at %v = 0x%x, want 0x%x", cuts, got, want)
+		}
+	}
+}
+
+func TestChecksumUpdate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		b := make([]byte, 20)
+		rng.Read(b)
+		xsum := ^header.Checksum(b, 0)
+
+		off := 2 * rng.Intn(len(b)/2)
+		old := binary.BigEndian.Uint16(b[off:])
+		new := uint16(rng.Intn(0x10000))
+		binary.BigEndian.PutUint16(b[off:], new)
+
+		got := header.ChecksumUpdate(xsum, old, new)
+		// Either representation of zero is a valid result.
+		if want := ^header.Checksum(b, 0); got != want && header.ChecksumCombine(got, 0) != header.ChecksumCombine(want, 0) {
+			t.Fatalf("got ChecksumUpdate(0x%x, 0x%x, 0x%x) = 0x%x, want 0x%x", xsum, old, new, got, want)
+		}
+	}
+}
+
+func TestChecksumUpdateAddress(t *testing.T) {
+	b := header.IPv4(make([]byte, header.IPv4MinimumSize))
+	b.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: header.IPv4MinimumSize,
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.Address("\x0a\x00\x00\x01"),
+		DstAddr:     tcpip.Address("\x0a\x00\x00\x02"),
+	})
+	b.SetChecksum(^b.CalculateChecksum())
+
+	const newAddr = tcpip.Address("\xc0\xa8\x01\x63")
+	xsum := header.ChecksumUpdateAddress(b.Checksum(), b.SourceAddress(), newAddr)
+	b.SetSourceAddress(newAddr)
+	b.SetChecksum(0)
+	if want := ^b.CalculateChecksum(); xsum != want {
+		t.Errorf("got updated checksum 0x%x, want 0x%x", xsum, want)
+	}
+}
+
+func BenchmarkChecksum(b *testing.B) {
+	for _, size := range []int{64, 1500, 9000} {
+		buf := make([]byte, size)
+		rand.New(rand.NewSource(1)).Read(buf)
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				header.Checksum(buf, 0)
+			}
+		})
+	}
+}
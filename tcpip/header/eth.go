@@ -48,6 +48,20 @@ const (
 
 	// EthernetAddressSize is the size, in bytes, of an ethernet address.
 	EthernetAddressSize = 6
+
+	// EthernetMinimumFrameSize is the minimum size of an ethernet frame on
+	// the wire, excluding the frame check sequence. Shorter frames must be
+	// padded to this size.
+	EthernetMinimumFrameSize = 60
+
+	// EthernetMaximumLength is the largest value of the "ethertype" field
+	// that holds the length of the payload of an IEEE 802.3 frame rather
+	// than a protocol number.
+	EthernetMaximumLength = 1500
+
+	// EthernetTypeMinimum is the smallest value of the "ethertype" field
+	// that holds a protocol number, per IEEE 802.3, clause 3.2.6.
+	EthernetTypeMinimum = 0x0600
 )
 
 // SourceAddress returns the "MAC source" field of the ethernet frame header.
@@ -66,6 +80,56 @@ func (b Ethernet) Type() tcpip.NetworkProtocolNumber {
 	return tcpip.NetworkProtocolNumber(binary.BigEndian.Uint16(b[ethType:]))
 }
 
+// IsValid performs basic validation on the header of an ethernet frame of
+// frameSize bytes: the header must be present, and the "ethertype" field must
+// either hold a protocol number or the length of a payload that fits in the
+// frame.
+func (b Ethernet) IsValid(frameSize int) bool {
+	if len(b) < EthernetMinimumSize || frameSize < EthernetMinimumSize {
+		return false
+	}
+	t := b.Type()
+	if t >= EthernetTypeMinimum {
+		return true
+	}
+	if t > EthernetMaximumLength {
+		return false
+	}
+	return EthernetMinimumSize+int(t) <= frameSize
+}
+
+// UnpaddedSize returns the size of the ethernet frame of frameSize bytes whose
+// header is at the start of b once the padding added to reach
+// EthernetMinimumFrameSize, if any, is removed. b must hold the payload of the
+// frame, or as much of it as is available; the payload's length is taken from
+// its IPv4, IPv6 or ARP header, or from the "ethertype" field of IEEE 802.3
+// frames. If the length can't be determined, frameSize is returned.
+func (b Ethernet) UnpaddedSize(frameSize int) int {
+	if frameSize > EthernetMinimumFrameSize || len(b) < EthernetMinimumSize {
+		return frameSize
+	}
+	payload := b[EthernetMinimumSize:]
+	length := -1
+	switch t := b.Type(); {
+	case t <= EthernetMaximumLength:
+		length = int(t)
+	case t == IPv4ProtocolNumber:
+		if len(payload) >= IPv4MinimumSize {
+			length = int(IPv4(payload).TotalLength())
+		}
+	case t == IPv6ProtocolNumber:
+		if len(payload) >= IPv6MinimumSize {
+			length = IPv6MinimumSize + int(IPv6(payload).PayloadLength())
+		}
+	case t == ARPProtocolNumber:
+		length = ARPSize
+	}
+	if length < 0 || EthernetMinimumSize+length > frameSize {
+		return frameSize
+	}
+	return EthernetMinimumSize + length
+}
+
 // Encode encodes all the fields of the ethernet frame header.
 func (b Ethernet) Encode(e *EthernetFields) {
 	binary.BigEndian.PutUint16(b[ethType:], uint16(e.Type))
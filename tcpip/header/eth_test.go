@@ -0,0 +1,84 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package header_test
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+func TestEthernetIsValid(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		typ       tcpip.NetworkProtocolNumber
+		frameSize int
+		want      bool
+	}{
+		{"IPv4", header.IPv4ProtocolNumber, 100, true},
+		{"TooShort", header.IPv4ProtocolNumber, header.EthernetMinimumSize - 1, false},
+		{"Length", 46, header.EthernetMinimumFrameSize, true},
+		{"LengthBeyondFrame", 47, header.EthernetMinimumFrameSize, false},
+		{"Undefined", header.EthernetMaximumLength + 1, 2000, false},
+		{"TypeMinimum", header.EthernetTypeMinimum, 100, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := header.Ethernet(make([]byte, header.EthernetMinimumSize))
+			b.Encode(&header.EthernetFields{Type: tc.typ})
+			if got := b.IsValid(tc.frameSize); got != tc.want {
+				t.Fatalf("IsValid(%d) = %t, want = %t", tc.frameSize, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEthernetUnpaddedSize(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		typ       tcpip.NetworkProtocolNumber
+		length    int
+		frameSize int
+		want      int
+	}{
+		{"IPv4", header.IPv4ProtocolNumber, 28, header.EthernetMinimumFrameSize, header.EthernetMinimumSize + 28},
+		{"IPv4Unpadded", header.IPv4ProtocolNumber, 28, 100, 100},
+		{"IPv4BeyondFrame", header.IPv4ProtocolNumber, 50, header.EthernetMinimumFrameSize, header.EthernetMinimumFrameSize},
+		{"IPv6", header.IPv6ProtocolNumber, 0, header.EthernetMinimumFrameSize, header.EthernetMinimumSize + header.IPv6MinimumSize},
+		{"ARP", header.ARPProtocolNumber, 0, header.EthernetMinimumFrameSize, header.EthernetMinimumSize + header.ARPSize},
+		{"Length", 10, 0, header.EthernetMinimumFrameSize, header.EthernetMinimumSize + 10},
+		{"Unknown", 0x9000, 0, header.EthernetMinimumFrameSize, header.EthernetMinimumFrameSize},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := header.Ethernet(make([]byte, tc.frameSize))
+			b.Encode(&header.EthernetFields{Type: tc.typ})
+			payload := b[header.EthernetMinimumSize:]
+			switch tc.typ {
+			case header.IPv4ProtocolNumber:
+				header.IPv4(payload).Encode(&header.IPv4Fields{
+					IHL:         header.IPv4MinimumSize,
+					TotalLength: uint16(tc.length),
+				})
+			case header.IPv6ProtocolNumber:
+				header.IPv6(payload).Encode(&header.IPv6Fields{
+					PayloadLength: uint16(tc.length),
+				})
+			}
+			if got := b.UnpaddedSize(tc.frameSize); got != tc.want {
+				t.Fatalf("UnpaddedSize(%d) = %d, want = %d", tc.frameSize, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build gofuzz
+
+package header
+
+// The functions below are entry points for go-fuzz, e.g.:
+//
+//	go-fuzz-build -func FuzzTCP github.com/google/netstack/tcpip/header
+//
+// They check that the parsers never panic, that anything accepted in strict
+// mode is accepted in lenient mode, and that the accessors of accepted headers
+// stay within bounds.
+
+// FuzzIPv4 is the go-fuzz entry point for ParseIPv4.
+func FuzzIPv4(data []byte) int {
+	return fuzz(data, func(b []byte, mode ParseMode) error {
+		h, err := ParseIPv4(b, mode)
+		if err == nil {
+			_ = h.Payload()
+			_ = h.SourceAddress()
+			_ = h.DestinationAddress()
+		}
+		return err
+	})
+}
+
+// FuzzIPv6 is the go-fuzz entry point for ParseIPv6.
+func FuzzIPv6(data []byte) int {
+	return fuzz(data, func(b []byte, mode ParseMode) error {
+		h, err := ParseIPv6(b, mode)
+		if err == nil {
+			_ = h.Payload()
+			_ = h.SourceAddress()
+			_ = h.DestinationAddress()
+		}
+		return err
+	})
+}
+
+// FuzzTCP is the go-fuzz entry point for ParseTCP.
+func FuzzTCP(data []byte) int {
+	return fuzz(data, func(b []byte, mode ParseMode) error {
+		h, err := ParseTCP(b, mode)
+		if err == nil {
+			_ = h.Payload()
+			_ = h.ParsedOptions()
+			_ = ParseSynOptions(h.Options(), h.Flags()&TCPFlagAck != 0)
+		}
+		return err
+	})
+}
+
+// FuzzUDP is the go-fuzz entry point for ParseUDP.
+func FuzzUDP(data []byte) int {
+	return fuzz(data, func(b []byte, mode ParseMode) error {
+		h, err := ParseUDP(b, mode)
+		if err == nil {
+			_ = h.Payload()
+		}
+		return err
+	})
+}
+
+// FuzzICMPv4 is the go-fuzz entry point for ParseICMPv4.
+func FuzzICMPv4(data []byte) int {
+	return fuzz(data, func(b []byte, mode ParseMode) error {
+		h, err := ParseICMPv4(b, mode)
+		if err == nil {
+			_ = h.Payload()
+		}
+		return err
+	})
+}
+
+// FuzzICMPv6 is the go-fuzz entry point for ParseICMPv6.
+func FuzzICMPv6(data []byte) int {
+	return fuzz(data, func(b []byte, mode ParseMode) error {
+		h, err := ParseICMPv6(b, mode)
+		if err == nil {
+			_ = h.Payload()
+		}
+		return err
+	})
+}
+
+// fuzz runs parse on data in both modes. It returns 1 if data is valid in
+// strict mode, so that go-fuzz favors it, and 0 otherwise.
+func fuzz(data []byte, parse func([]byte, ParseMode) error) int {
+	lenientErr := parse(data, ParseLenient)
+	if err := parse(data, ParseStrict); err != nil {
+		return 0
+	}
+	if lenientErr != nil {
+		panic("accepted in strict mode but not in lenient mode: " + lenientErr.Error())
+	}
+	return 1
+}
@@ -34,6 +34,14 @@ const (
 	// destination unreachable packet.
 	ICMPv4DstUnreachableMinimumSize = ICMPv4MinimumSize + 4
 
+	// ICMPv4TimeExceededMinimumSize is the minimum size of a valid ICMP
+	// time exceeded packet.
+	ICMPv4TimeExceededMinimumSize = ICMPv4MinimumSize + 4
+
+	// ICMPv4RedirectMinimumSize is the minimum size of a valid ICMP
+	// redirect packet.
+	ICMPv4RedirectMinimumSize = ICMPv4MinimumSize + 4
+
 	// ICMPv4ProtocolNumber is the ICMP transport protocol number.
 	ICMPv4ProtocolNumber tcpip.TransportProtocolNumber = 1
 )
@@ -58,10 +66,29 @@ const (
 
 // Values for ICMP code as defined in RFC 792.
 const (
+	ICMPv4HostUnreachable     = 1
 	ICMPv4PortUnreachable     = 3
 	ICMPv4FragmentationNeeded = 4
 )
 
+// ICMPv4AdminProhibited is the code of ICMP destination unreachable messages
+// for communication administratively prohibited, defined in RFC 1812.
+const ICMPv4AdminProhibited = 13
+
+// Values for the code of ICMP time exceeded messages, as defined in RFC 792.
+const (
+	ICMPv4TTLExceeded       = 0
+	ICMPv4ReassemblyTimeout = 1
+)
+
+// Values for the code of ICMP redirect messages, as defined in RFC 792.
+const (
+	ICMPv4RedirectNet     = 0
+	ICMPv4RedirectHost    = 1
+	ICMPv4RedirectTOSNet  = 2
+	ICMPv4RedirectTOSHost = 3
+)
+
 // Type is the ICMP type field.
 func (b ICMPv4) Type() ICMPv4Type { return ICMPv4Type(b[0]) }
 
@@ -106,3 +133,15 @@ func (ICMPv4) SetDestinationPort(uint16) {
 func (b ICMPv4) Payload() []byte {
 	return b[ICMPv4MinimumSize:]
 }
+
+// RedirectGateway returns the address of the gateway of an ICMP redirect
+// message.
+func (b ICMPv4) RedirectGateway() tcpip.Address {
+	return tcpip.Address(b[ICMPv4MinimumSize:ICMPv4RedirectMinimumSize])
+}
+
+// SetRedirectGateway sets the address of the gateway of an ICMP redirect
+// message.
+func (b ICMPv4) SetRedirectGateway(addr tcpip.Address) {
+	copy(b[ICMPv4MinimumSize:ICMPv4RedirectMinimumSize], addr)
+}
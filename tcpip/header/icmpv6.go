@@ -47,6 +47,36 @@ const (
 	// ICMPv6PacketTooBigMinimumSize is the minimum size of a valid ICMP
 	// packet-too-big packet.
 	ICMPv6PacketTooBigMinimumSize = ICMPv6MinimumSize + 4
+
+	// ICMPv6TimeExceededMinimumSize is the minimum size of a valid ICMP
+	// time exceeded packet.
+	ICMPv6TimeExceededMinimumSize = ICMPv6MinimumSize + 4
+
+	// NDPHopLimit is the hop limit of NDP messages, which lets their
+	// receivers check that they were sent by a neighbor, per RFC 4861
+	// section 3.1.
+	NDPHopLimit = 255
+
+	// ICMPv6RedirectMinimumSize is the minimum size of a valid ICMP
+	// redirect packet, with its target and destination addresses.
+	ICMPv6RedirectMinimumSize = ICMPv6MinimumSize + 4 + 2*IPv6AddressSize
+
+	// ICMPv6RedirectedHeaderOption is the type of the NDP option that
+	// holds the packet that triggered a redirect, per RFC 4861 section
+	// 4.6.3.
+	ICMPv6RedirectedHeaderOption = 4
+
+	// ICMPv6RedirectedHeaderOptionSize is the size of a redirected
+	// header option, excluding the packet it holds.
+	ICMPv6RedirectedHeaderOptionSize = 8
+
+	// ICMPv6NodeInfoMinimumSize is the minimum size of a valid ICMP node
+	// information query or reply, with its qtype, flags and nonce.
+	ICMPv6NodeInfoMinimumSize = ICMPv6MinimumSize + 4 + ICMPv6NodeInfoNonceSize
+
+	// ICMPv6NodeInfoNonceSize is the size of the nonce of ICMP node
+	// information messages.
+	ICMPv6NodeInfoNonceSize = 8
 )
 
 // ICMPv6Type is the ICMP type field described in RFC 4443 and friends.
@@ -68,13 +98,55 @@ const (
 	ICMPv6NeighborSolicit ICMPv6Type = 135
 	ICMPv6NeighborAdvert  ICMPv6Type = 136
 	ICMPv6RedirectMsg     ICMPv6Type = 137
+
+	// Node information messages, see RFC 4620.
+
+	ICMPv6NodeInfoQuery ICMPv6Type = 139
+	ICMPv6NodeInfoReply ICMPv6Type = 140
 )
 
 // Values for ICMP code as defined in RFC 4443.
 const (
+	ICMPv6NoRoute         = 0
+	ICMPv6AdminProhibited = 1
 	ICMPv6PortUnreachable = 4
 )
 
+// Values for the code of ICMP time exceeded messages, as defined in RFC 4443.
+const (
+	ICMPv6HopLimitExceeded  = 0
+	ICMPv6ReassemblyTimeout = 1
+)
+
+// Values for the code of ICMP node information queries, which gives the type
+// of their subject, as defined in RFC 4620.
+const (
+	ICMPv6NodeInfoSubjectIPv6 = 0
+	ICMPv6NodeInfoSubjectName = 1
+	ICMPv6NodeInfoSubjectIPv4 = 2
+)
+
+// Values for the code of ICMP node information replies, as defined in RFC
+// 4620.
+const (
+	ICMPv6NodeInfoSuccess      = 0
+	ICMPv6NodeInfoRefused      = 1
+	ICMPv6NodeInfoUnknownQtype = 2
+)
+
+// Values for the qtype of ICMP node information messages, the information
+// they query, as defined in RFC 4620.
+const (
+	ICMPv6NodeInfoNoop          = 0
+	ICMPv6NodeInfoNodeName      = 2
+	ICMPv6NodeInfoNodeAddresses = 3
+	ICMPv6NodeInfoIPv4Addresses = 4
+)
+
+// ICMPv6NodeNameTTLSize is the size of the TTL field preceding the names in
+// the data of node name replies.
+const ICMPv6NodeNameTTLSize = 4
+
 // Type is the ICMP type field.
 func (b ICMPv6) Type() ICMPv6Type { return ICMPv6Type(b[0]) }
 
@@ -119,3 +191,126 @@ func (ICMPv6) SetDestinationPort(uint16) {
 func (b ICMPv6) Payload() []byte {
 	return b[ICMPv6MinimumSize:]
 }
+
+// RedirectTarget returns the target address of an ICMP redirect message: the
+// better first hop for its destination, or the destination itself if it is a
+// neighbor.
+func (b ICMPv6) RedirectTarget() tcpip.Address {
+	return tcpip.Address(b[ICMPv6MinimumSize+4 : ICMPv6MinimumSize+4+IPv6AddressSize])
+}
+
+// RedirectDestination returns the destination address of an ICMP redirect
+// message.
+func (b ICMPv6) RedirectDestination() tcpip.Address {
+	return tcpip.Address(b[ICMPv6MinimumSize+4+IPv6AddressSize : ICMPv6RedirectMinimumSize])
+}
+
+// EncodeRedirect encodes the fields of an ICMP redirect message, other than
+// its type, code and checksum, and zeroes its reserved field.
+func (b ICMPv6) EncodeRedirect(target, dst tcpip.Address) {
+	copy(b[ICMPv6MinimumSize:], []byte{0, 0, 0, 0})
+	copy(b[ICMPv6MinimumSize+4:], target)
+	copy(b[ICMPv6MinimumSize+4+IPv6AddressSize:], dst)
+}
+
+// NodeInfoQtype returns the qtype of an ICMP node information message.
+func (b ICMPv6) NodeInfoQtype() uint16 {
+	return binary.BigEndian.Uint16(b[ICMPv6MinimumSize:])
+}
+
+// NodeInfoFlags returns the flags of an ICMP node information message, whose
+// meaning depends on its qtype.
+func (b ICMPv6) NodeInfoFlags() uint16 {
+	return binary.BigEndian.Uint16(b[ICMPv6MinimumSize+2:])
+}
+
+// NodeInfoNonce returns the nonce of an ICMP node information message, which
+// replies copy from their query.
+func (b ICMPv6) NodeInfoNonce() []byte {
+	return b[ICMPv6MinimumSize+4 : ICMPv6NodeInfoMinimumSize]
+}
+
+// NodeInfoData returns the data of an ICMP node information message: the
+// subject of queries, or the information returned by replies.
+func (b ICMPv6) NodeInfoData() []byte {
+	return b[ICMPv6NodeInfoMinimumSize:]
+}
+
+// EncodeNodeInfo encodes the fields of an ICMP node information message, other
+// than its type, code, checksum and data.
+func (b ICMPv6) EncodeNodeInfo(qtype, flags uint16, nonce []byte) {
+	binary.BigEndian.PutUint16(b[ICMPv6MinimumSize:], qtype)
+	binary.BigEndian.PutUint16(b[ICMPv6MinimumSize+2:], flags)
+	copy(b[ICMPv6MinimumSize+4:ICMPv6NodeInfoMinimumSize], nonce)
+}
+
+// AppendNodeInfoName appends name to b in the DNS wire format used by ICMP
+// node information messages, RFC 4620: as a sequence of labels, each
+// preceded by its length, ending with an empty label if name is fully
+// qualified, that is ends with a dot, or with two otherwise. It returns false
+// if a label of name is empty or longer than 63 bytes.
+func AppendNodeInfoName(b []byte, name string) ([]byte, bool) {
+	fqdn := len(name) > 0 && name[len(name)-1] == '.'
+	if fqdn {
+		name = name[:len(name)-1]
+	}
+	for len(name) > 0 {
+		label := name
+		for i := 0; i < len(name); i++ {
+			if name[i] == '.' {
+				label = name[:i]
+				break
+			}
+		}
+		if len(label) == 0 || len(label) > 63 {
+			return b, false
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+		name = name[len(label):]
+		if len(name) > 0 {
+			// Skip the dot, which must be followed by a label.
+			name = name[1:]
+			if len(name) == 0 {
+				return b, false
+			}
+		}
+	}
+	b = append(b, 0)
+	if !fqdn {
+		b = append(b, 0)
+	}
+	return b, true
+}
+
+// ParseNodeInfoName parses the name at the start of b, in the format written
+// by AppendNodeInfoName, and returns it along with the rest of b. Fully
+// qualified names end with a dot. It returns false if b doesn't start with a
+// valid name.
+func ParseNodeInfoName(b []byte) (string, []byte, bool) {
+	var name []byte
+	for {
+		if len(b) == 0 {
+			return "", nil, false
+		}
+		n := int(b[0])
+		b = b[1:]
+		if n == 0 {
+			break
+		}
+		if n > 63 || n > len(b) {
+			return "", nil, false
+		}
+		name = append(name, b[:n]...)
+		name = append(name, '.')
+		b = b[n:]
+	}
+	if len(name) == 0 {
+		return "", nil, false
+	}
+	if len(b) > 0 && b[0] == 0 {
+		// A name that isn't fully qualified.
+		return string(name[:len(name)-1]), b[1:], true
+	}
+	return string(name), b, true
+}
@@ -78,6 +78,14 @@ const (
 	// section 5.
 	IPv6MinimumMTU = 1280
 
+	// IPv6MaximumPayloadSize is the largest payload length that fits in the
+	// "payload length" field. Larger payloads are sent in jumbograms, which
+	// carry their length in a Jumbo Payload option instead (RFC 2675).
+	IPv6MaximumPayloadSize = 0xffff
+
+	// IPv6FlowLabelMask is the mask of the 20-bit flow label.
+	IPv6FlowLabelMask = 0xfffff
+
 	// IPv6Any is the non-routable IPv6 "any" meta address.
 	IPv6Any tcpip.Address = "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
 )
@@ -103,9 +111,46 @@ func (b IPv6) TransportProtocol() tcpip.TransportProtocolNumber {
 	return tcpip.TransportProtocolNumber(b.NextHeader())
 }
 
-// Payload implements Network.Payload.
+// HopByHopOptions returns the hop-by-hop options header that follows the
+// fixed header, or nil if there is none or it is truncated.
+func (b IPv6) HopByHopOptions() IPv6HopByHop {
+	if b.NextHeader() != IPv6HopByHopOptionsHeader {
+		return nil
+	}
+	h := IPv6HopByHop(b[IPv6MinimumSize:])
+	if len(h) < 8 || h.Length() > len(h) {
+		return nil
+	}
+	return h[:h.Length()]
+}
+
+// JumboPayloadLength returns the payload length of the packet if it is a
+// jumbogram, i.e., its "payload length" field is zero and its hop-by-hop
+// options header holds a Jumbo Payload option.
+func (b IPv6) JumboPayloadLength() (uint32, bool) {
+	if b.PayloadLength() != 0 {
+		return 0, false
+	}
+	h := b.HopByHopOptions()
+	if h == nil {
+		return 0, false
+	}
+	return h.JumboPayloadLength()
+}
+
+// payloadSize returns the payload length of the packet, taken from the Jumbo
+// Payload option for jumbograms.
+func (b IPv6) payloadSize() uint64 {
+	if l, ok := b.JumboPayloadLength(); ok {
+		return uint64(l)
+	}
+	return uint64(b.PayloadLength())
+}
+
+// Payload implements Network.Payload. The payload of jumbograms starts with
+// the hop-by-hop options header.
 func (b IPv6) Payload() []byte {
-	return b[IPv6MinimumSize:][:b.PayloadLength()]
+	return b[IPv6MinimumSize:][:b.payloadSize()]
 }
 
 // SourceAddress returns the "source address" field of the ipv6 header.
@@ -128,12 +173,12 @@ func (IPv6) Checksum() uint16 {
 // TOS returns the "traffic class" and "flow label" fields of the ipv6 header.
 func (b IPv6) TOS() (uint8, uint32) {
 	v := binary.BigEndian.Uint32(b[versTCFL:])
-	return uint8(v >> 20), v & 0xfffff
+	return uint8(v >> 20), v & IPv6FlowLabelMask
 }
 
 // SetTOS sets the "traffic class" and "flow label" fields of the ipv6 header.
 func (b IPv6) SetTOS(t uint8, l uint32) {
-	vtf := (6 << 28) | (uint32(t) << 20) | (l & 0xfffff)
+	vtf := (6 << 28) | (uint32(t) << 20) | (l & IPv6FlowLabelMask)
 	binary.BigEndian.PutUint32(b[versTCFL:], vtf)
 }
 
@@ -153,6 +198,11 @@ func (b IPv6) SetDestinationAddress(addr tcpip.Address) {
 	copy(b[v6DstAddr:v6DstAddr+IPv6AddressSize], addr)
 }
 
+// SetHopLimit sets the "hop limit" field of the ipv6 header.
+func (b IPv6) SetHopLimit(v uint8) {
+	b[hopLimit] = v
+}
+
 // SetNextHeader sets the value of the "next header" field of the ipv6 header.
 func (b IPv6) SetNextHeader(v uint8) {
 	b[nextHdr] = v
@@ -179,8 +229,11 @@ func (b IPv6) IsValid(pktSize int) bool {
 		return false
 	}
 
-	dlen := int(b.PayloadLength())
-	if dlen > pktSize-IPv6MinimumSize {
+	if l, ok := b.JumboPayloadLength(); ok && l <= IPv6MaximumPayloadSize {
+		return false
+	}
+
+	if b.payloadSize() > uint64(pktSize-IPv6MinimumSize) {
 		return false
 	}
 
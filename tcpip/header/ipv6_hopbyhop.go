@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package header
+
+import (
+	"encoding/binary"
+)
+
+const (
+	nextHdrHBH = 0
+	hdrExtLen  = 1
+)
+
+// IPv6HopByHop represents an ipv6 hop-by-hop options extension header stored
+// in a byte array. Its methods don't check the boundaries of the underlying
+// slice; use IPv6.HopByHopOptions to get an instance that holds the whole
+// header.
+type IPv6HopByHop []byte
+
+const (
+	// IPv6HopByHopOptionsHeader is the number used to specify that the next
+	// header is a hop-by-hop options header, per RFC 2460.
+	IPv6HopByHopOptionsHeader = 0
+
+	// IPv6JumboPayloadOption is the type of the Jumbo Payload option, per
+	// RFC 2675, section 2.
+	IPv6JumboPayloadOption = 0xc2
+
+	// IPv6JumboPayloadHeaderSize is the size of a hop-by-hop options header
+	// holding only a Jumbo Payload option.
+	IPv6JumboPayloadHeaderSize = 8
+
+	// ipv6JumboPayloadOptionSize is the size of the Jumbo Payload option,
+	// excluding its type and length.
+	ipv6JumboPayloadOptionSize = 4
+)
+
+// NextHeader returns the value of the "next header" field of the hop-by-hop
+// options header.
+func (b IPv6HopByHop) NextHeader() uint8 {
+	return b[nextHdrHBH]
+}
+
+// Length returns the length of the hop-by-hop options header, in bytes.
+func (b IPv6HopByHop) Length() int {
+	return (int(b[hdrExtLen]) + 1) * 8
+}
+
+// JumboPayloadLength returns the value of the Jumbo Payload option, if the
+// header holds one.
+func (b IPv6HopByHop) JumboPayloadLength() (uint32, bool) {
+	opts := b[2:b.Length()]
+	for i := 0; i < len(opts); {
+		if opts[i] == ipv6OptionPad1 {
+			i++
+			continue
+		}
+		if i+2 > len(opts) {
+			return 0, false
+		}
+		l := 2 + int(opts[i+1])
+		if i+l > len(opts) {
+			return 0, false
+		}
+		if opts[i] == IPv6JumboPayloadOption && l == 2+ipv6JumboPayloadOptionSize {
+			return binary.BigEndian.Uint32(opts[i+2:]), true
+		}
+		i += l
+	}
+	return 0, false
+}
+
+// EncodeJumboPayload encodes a hop-by-hop options header of
+// IPv6JumboPayloadHeaderSize bytes holding only a Jumbo Payload option with
+// the given length, which must include the hop-by-hop options header itself.
+func (b IPv6HopByHop) EncodeJumboPayload(nextHeader uint8, length uint32) {
+	b[nextHdrHBH] = nextHeader
+	b[hdrExtLen] = 0
+	b[2] = IPv6JumboPayloadOption
+	b[3] = ipv6JumboPayloadOptionSize
+	binary.BigEndian.PutUint32(b[4:], length)
+}
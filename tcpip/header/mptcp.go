@@ -0,0 +1,365 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package header
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// MPTCPVersion is the version of Multipath TCP implemented, as defined in RFC
+// 8684.
+const MPTCPVersion = 1
+
+// Multipath TCP option subtypes, as defined in RFC 8684 section 3.
+const (
+	MPTCPSubtypeCapable    = 0
+	MPTCPSubtypeJoin       = 1
+	MPTCPSubtypeDSS        = 2
+	MPTCPSubtypeAddAddr    = 3
+	MPTCPSubtypeRemoveAddr = 4
+	MPTCPSubtypePrio       = 5
+	MPTCPSubtypeFail       = 6
+	MPTCPSubtypeFastClose  = 7
+)
+
+// Flags of the MP_CAPABLE option.
+const (
+	// MPCapableChecksum ("A") requires DSS checksums.
+	MPCapableChecksum = 0x80
+
+	// MPCapableExtensibility ("B") is reserved for future extensions.
+	MPCapableExtensibility = 0x40
+
+	// MPCapableNoAddr ("C") asks the peer not to open subflows to the
+	// source address of the SYN.
+	MPCapableNoAddr = 0x20
+
+	// MPCapableHMACSHA256 ("H") selects HMAC-SHA256, the only crypto
+	// algorithm defined.
+	MPCapableHMACSHA256 = 0x01
+)
+
+// Sizes of the MP_CAPABLE option, which depend on the segment carrying it.
+const (
+	// MPCapableSynSize is the size of the option in a SYN.
+	MPCapableSynSize = 4
+
+	// MPCapableSynAckSize is the size of the option in a SYN-ACK, which
+	// carries the sender's key.
+	MPCapableSynAckSize = 12
+
+	// MPCapableAckSize is the size of the option in the ACK completing the
+	// handshake, which carries both keys.
+	MPCapableAckSize = 20
+
+	// MPCapableDataSize is the size of the option in the first data
+	// segment, which also carries the data-level length.
+	MPCapableDataSize = 22
+)
+
+// Flags of the DSS option.
+const (
+	dssDataFin     = 0x10
+	dssDSN8        = 0x08
+	dssMapping     = 0x04
+	dssDataAck8    = 0x02
+	dssDataAckFlag = 0x01
+)
+
+// DSSMaxSize is the size of the largest DSS option this package encodes: an
+// 8-octet data ACK and a mapping with an 8-octet data sequence number, but no
+// checksum.
+const DSSMaxSize = 4 + 8 + 8 + 4 + 2
+
+// MPCapableOption is the MP_CAPABLE option, which negotiates Multipath TCP
+// during the 3-way handshake.
+//
+// The keys are never zero, which is used to tell whether they are present.
+type MPCapableOption struct {
+	Version uint8
+	Flags   uint8
+
+	// SenderKey is the key of the sender of the segment. It is absent from
+	// SYNs.
+	SenderKey uint64
+
+	// ReceiverKey is the key of the receiver of the segment. It is only
+	// present in the ACK completing the handshake and in the first data
+	// segment.
+	ReceiverKey uint64
+
+	// DataLen is the data-level length of the first data segment, or zero.
+	DataLen uint16
+}
+
+// DSSOption is the Data Sequence Signal option, which carries the data-level
+// acknowledgement and the mapping of the subflow's sequence space onto the
+// connection's.
+//
+// 4-octet data ACKs and data sequence numbers are returned as is by the
+// parser; the caller must extend them to 64 bits.
+type DSSOption struct {
+	// DataFin is set if the mapping includes the DATA_FIN.
+	DataFin bool
+
+	HasDataAck bool
+	DataAck    uint64
+
+	HasMapping bool
+	DSN        uint64
+
+	// SSN is the subflow sequence number of the mapping, relative to the
+	// subflow's initial sequence number.
+	SSN     uint32
+	DataLen uint16
+
+	HasChecksum bool
+	Checksum    uint16
+}
+
+// MPTCPOptions holds the Multipath TCP options of a segment other than a SYN
+// or SYN-ACK. They are parsed separately from TCPOptions, only for the
+// connections that negotiated Multipath TCP.
+type MPTCPOptions struct {
+	// MPCapable is true if the segment carries the MP_CAPABLE option,
+	// which is then stored in Capable.
+	MPCapable bool
+	Capable   MPCapableOption
+
+	// HasDSS is true if the segment carries the DSS option, which is then
+	// stored in DSS.
+	HasDSS bool
+	DSS    DSSOption
+}
+
+// ParseMPTCPOptions extracts the Multipath TCP options from the TCP options b.
+// Malformed options are ignored.
+func ParseMPTCPOptions(b []byte) MPTCPOptions {
+	var opts MPTCPOptions
+	limit := len(b)
+	for i := 0; i < limit; {
+		switch b[i] {
+		case TCPOptionEOL:
+			return opts
+		case TCPOptionNOP:
+			i++
+			continue
+		}
+		if i+2 > limit {
+			return opts
+		}
+		l := int(b[i+1])
+		if l < 2 || i+l > limit {
+			return opts
+		}
+		if b[i] == TCPOptionMPTCP {
+			switch mptcpSubtype(b[i : i+l]) {
+			case MPTCPSubtypeCapable:
+				opts.Capable, opts.MPCapable = parseMPCapable(b[i : i+l])
+			case MPTCPSubtypeDSS:
+				opts.DSS, opts.HasDSS = parseDSS(b[i : i+l])
+			}
+		}
+		i += l
+	}
+	return opts
+}
+
+// MPTCPToken returns the token identifying the connection whose receiver
+// chose key, that is the most significant 32 bits of the SHA-256 hash of key.
+func MPTCPToken(key uint64) uint32 {
+	h := mptcpKeyHash(key)
+	return binary.BigEndian.Uint32(h[:4])
+}
+
+// MPTCPIDSN returns the initial data sequence number of the sender that chose
+// key, that is the least significant 64 bits of the SHA-256 hash of key.
+func MPTCPIDSN(key uint64) uint64 {
+	h := mptcpKeyHash(key)
+	return binary.BigEndian.Uint64(h[len(h)-8:])
+}
+
+func mptcpKeyHash(key uint64) [sha256.Size]byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], key)
+	return sha256.Sum256(b[:])
+}
+
+// mptcpSubtype returns the subtype of the Multipath TCP option b, which
+// starts with the option kind.
+func mptcpSubtype(b []byte) int {
+	if len(b) < 3 {
+		return -1
+	}
+	return int(b[2] >> 4)
+}
+
+// parseMPCapable parses the MP_CAPABLE option b, which starts with the option
+// kind and has the length given in it.
+func parseMPCapable(b []byte) (MPCapableOption, bool) {
+	var o MPCapableOption
+	switch len(b) {
+	case MPCapableSynSize, MPCapableSynAckSize, MPCapableAckSize, MPCapableDataSize, MPCapableDataSize + 2:
+	default:
+		return o, false
+	}
+	o.Version = b[2] & 0xf
+	o.Flags = b[3]
+	if len(b) >= MPCapableSynAckSize {
+		o.SenderKey = binary.BigEndian.Uint64(b[4:])
+	}
+	if len(b) >= MPCapableAckSize {
+		o.ReceiverKey = binary.BigEndian.Uint64(b[12:])
+	}
+	if len(b) >= MPCapableDataSize {
+		o.DataLen = binary.BigEndian.Uint16(b[20:])
+	}
+	return o, true
+}
+
+// parseDSS parses the DSS option b, which starts with the option kind and has
+// the length given in it.
+func parseDSS(b []byte) (DSSOption, bool) {
+	var o DSSOption
+	if len(b) < 4 {
+		return o, false
+	}
+	flags := b[3]
+	o.DataFin = flags&dssDataFin != 0
+	i := 4
+	if flags&dssDataAckFlag != 0 {
+		o.HasDataAck = true
+		if flags&dssDataAck8 != 0 {
+			if i+8 > len(b) {
+				return o, false
+			}
+			o.DataAck = binary.BigEndian.Uint64(b[i:])
+			i += 8
+		} else {
+			if i+4 > len(b) {
+				return o, false
+			}
+			o.DataAck = uint64(binary.BigEndian.Uint32(b[i:]))
+			i += 4
+		}
+	}
+	if flags&dssMapping != 0 {
+		o.HasMapping = true
+		if flags&dssDSN8 != 0 {
+			if i+8 > len(b) {
+				return o, false
+			}
+			o.DSN = binary.BigEndian.Uint64(b[i:])
+			i += 8
+		} else {
+			if i+4 > len(b) {
+				return o, false
+			}
+			o.DSN = uint64(binary.BigEndian.Uint32(b[i:]))
+			i += 4
+		}
+		if i+6 > len(b) {
+			return o, false
+		}
+		o.SSN = binary.BigEndian.Uint32(b[i:])
+		o.DataLen = binary.BigEndian.Uint16(b[i+4:])
+		i += 6
+		if i+2 == len(b) {
+			o.HasChecksum = true
+			o.Checksum = binary.BigEndian.Uint16(b[i:])
+			i += 2
+		}
+	}
+	return o, i == len(b)
+}
+
+// EncodeMPCapableOption encodes o in the supplied buffer. Its size is
+// MPCapableSynSize, MPCapableSynAckSize, MPCapableAckSize or
+// MPCapableDataSize, depending on which of the keys and data-level length are
+// set. If the provided buffer is not large enough then it just returns
+// without encoding anything. It returns the number of bytes written to the
+// provided buffer.
+func EncodeMPCapableOption(o MPCapableOption, b []byte) int {
+	size := MPCapableSynSize
+	switch {
+	case o.DataLen != 0:
+		size = MPCapableDataSize
+	case o.ReceiverKey != 0:
+		size = MPCapableAckSize
+	case o.SenderKey != 0:
+		size = MPCapableSynAckSize
+	}
+	if len(b) < size {
+		return 0
+	}
+	b[0], b[1] = TCPOptionMPTCP, byte(size)
+	b[2] = MPTCPSubtypeCapable<<4 | o.Version&0xf
+	b[3] = o.Flags
+	if size >= MPCapableSynAckSize {
+		binary.BigEndian.PutUint64(b[4:], o.SenderKey)
+	}
+	if size >= MPCapableAckSize {
+		binary.BigEndian.PutUint64(b[12:], o.ReceiverKey)
+	}
+	if size >= MPCapableDataSize {
+		binary.BigEndian.PutUint16(b[20:], o.DataLen)
+	}
+	return size
+}
+
+// EncodeDSSOption encodes o in the supplied buffer, always using 8-octet data
+// ACKs and data sequence numbers. If the provided buffer is not large enough
+// then it just returns without encoding anything. It returns the number of
+// bytes written to the provided buffer.
+func EncodeDSSOption(o DSSOption, b []byte) int {
+	size := 4
+	var flags byte
+	if o.DataFin {
+		flags |= dssDataFin
+	}
+	if o.HasDataAck {
+		flags |= dssDataAckFlag | dssDataAck8
+		size += 8
+	}
+	if o.HasMapping {
+		flags |= dssMapping | dssDSN8
+		size += 8 + 4 + 2
+		if o.HasChecksum {
+			size += 2
+		}
+	}
+	if len(b) < size {
+		return 0
+	}
+	b[0], b[1] = TCPOptionMPTCP, byte(size)
+	b[2] = MPTCPSubtypeDSS << 4
+	b[3] = flags
+	i := 4
+	if o.HasDataAck {
+		binary.BigEndian.PutUint64(b[i:], o.DataAck)
+		i += 8
+	}
+	if o.HasMapping {
+		binary.BigEndian.PutUint64(b[i:], o.DSN)
+		binary.BigEndian.PutUint32(b[i+8:], o.SSN)
+		binary.BigEndian.PutUint16(b[i+12:], o.DataLen)
+		i += 14
+		if o.HasChecksum {
+			binary.BigEndian.PutUint16(b[i:], o.Checksum)
+		}
+	}
+	return size
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package header_test
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip/header"
+)
+
+func TestMPCapableOption(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opt  header.MPCapableOption
+		size int
+	}{
+		{"SYN", header.MPCapableOption{Version: 1, Flags: header.MPCapableHMACSHA256}, header.MPCapableSynSize},
+		{"SYN-ACK", header.MPCapableOption{Version: 1, Flags: header.MPCapableHMACSHA256, SenderKey: 0x0102030405060708}, header.MPCapableSynAckSize},
+		{"ACK", header.MPCapableOption{Version: 1, Flags: header.MPCapableHMACSHA256, SenderKey: 1, ReceiverKey: 2}, header.MPCapableAckSize},
+		{"data", header.MPCapableOption{Version: 1, Flags: header.MPCapableChecksum, SenderKey: 1, ReceiverKey: 2, DataLen: 1000}, header.MPCapableDataSize},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := make([]byte, 40)
+			n := header.EncodeMPCapableOption(tc.opt, b)
+			if n != tc.size {
+				t.Fatalf("got EncodeMPCapableOption(%+v) = %d, want = %d", tc.opt, n, tc.size)
+			}
+			// Pad the option to a multiple of 4 bytes, as it would be
+			// in a segment.
+			for n%4 != 0 {
+				b[n] = header.TCPOptionNOP
+				n++
+			}
+
+			if tc.opt.SenderKey == 0 {
+				syn := header.ParseSynOptions(b[:n], false)
+				if !syn.MPCapable || syn.MPTCP != tc.opt {
+					t.Errorf("got ParseSynOptions() = %+v, want MP_CAPABLE option %+v", syn, tc.opt)
+				}
+			}
+			if tc.size == header.MPCapableSynAckSize {
+				syn := header.ParseSynOptions(b[:n], true)
+				if !syn.MPCapable || syn.MPTCP != tc.opt {
+					t.Errorf("got ParseSynOptions() = %+v, want MP_CAPABLE option %+v", syn, tc.opt)
+				}
+			}
+			opts := header.ParseMPTCPOptions(b[:n])
+			if !opts.MPCapable || opts.Capable != tc.opt {
+				t.Errorf("got ParseMPTCPOptions() = %+v, want MP_CAPABLE option %+v", opts, tc.opt)
+			}
+
+			if got := header.EncodeMPCapableOption(tc.opt, b[:tc.size-1]); got != 0 {
+				t.Errorf("got EncodeMPCapableOption(%+v) = %d with a short buffer, want = 0", tc.opt, got)
+			}
+		})
+	}
+}
+
+func TestDSSOption(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opt  header.DSSOption
+		size int
+	}{
+		{"empty", header.DSSOption{}, 4},
+		{"data ACK", header.DSSOption{HasDataAck: true, DataAck: 1 << 40}, 12},
+		{"mapping", header.DSSOption{HasMapping: true, DSN: 1<<40 + 1, SSN: 1, DataLen: 1460}, 18},
+		{"data ACK and mapping", header.DSSOption{HasDataAck: true, DataAck: 7, HasMapping: true, DSN: 8, SSN: 9, DataLen: 10}, header.DSSMaxSize},
+		{"DATA_FIN", header.DSSOption{DataFin: true, HasDataAck: true, DataAck: 7, HasMapping: true, DSN: 8, DataLen: 1}, header.DSSMaxSize},
+		{"checksum", header.DSSOption{HasMapping: true, DSN: 8, SSN: 9, DataLen: 10, HasChecksum: true, Checksum: 0xbeef}, 20},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := make([]byte, 40)
+			n := header.EncodeDSSOption(tc.opt, b)
+			if n != tc.size {
+				t.Fatalf("got EncodeDSSOption(%+v) = %d, want = %d", tc.opt, n, tc.size)
+			}
+			for n%4 != 0 {
+				b[n] = header.TCPOptionNOP
+				n++
+			}
+			opts := header.ParseMPTCPOptions(b[:n])
+			if !opts.HasDSS || opts.DSS != tc.opt {
+				t.Errorf("got ParseMPTCPOptions() = %+v, want DSS option %+v", opts, tc.opt)
+			}
+		})
+	}
+}
+
+func TestDSSOptionShortValues(t *testing.T) {
+	// A DSS option with a 4-octet data ACK and a 4-octet data sequence
+	// number, as sent by peers that don't use 8-octet values.
+	b := []byte{
+		header.TCPOptionMPTCP, 18, header.MPTCPSubtypeDSS << 4, 0x05,
+		0, 0, 0, 1, // data ACK
+		0, 0, 0, 2, // DSN
+		0, 0, 0, 3, // SSN
+		0, 4, // data-level length
+		header.TCPOptionNOP, header.TCPOptionNOP,
+	}
+	want := header.DSSOption{HasDataAck: true, DataAck: 1, HasMapping: true, DSN: 2, SSN: 3, DataLen: 4}
+	opts := header.ParseMPTCPOptions(b)
+	if !opts.HasDSS || opts.DSS != want {
+		t.Errorf("got ParseMPTCPOptions() = %+v, want DSS option %+v", opts, want)
+	}
+
+	// Truncated options are ignored.
+	b[1] = 10
+	if opts := header.ParseMPTCPOptions(b[:10]); opts.HasDSS {
+		t.Errorf("got ParseMPTCPOptions() = %+v for a truncated option, want no DSS option", opts)
+	}
+}
+
+func TestMPTCPKeyDerivation(t *testing.T) {
+	// Test vector computed with SHA-256 over the key in network byte order.
+	const key = 0x0102030405060708
+	if got, want := header.MPTCPToken(key), uint32(0x66840dda); got != want {
+		t.Errorf("got MPTCPToken(%#x) = %#x, want = %#x", key, got, want)
+	}
+	if got, want := header.MPTCPIDSN(key), uint64(0xf5a101d3d29d6f72); got != want {
+		t.Errorf("got MPTCPIDSN(%#x) = %#x, want = %#x", key, got, want)
+	}
+}
@@ -0,0 +1,434 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package header
+
+import (
+	"fmt"
+)
+
+// ParseMode controls how thoroughly the Parse functions validate headers.
+type ParseMode int
+
+const (
+	// ParseLenient only rejects headers that can't be safely accessed, as
+	// the stack does when receiving packets: the lengths must be
+	// consistent with the buffer, but options are not validated.
+	ParseLenient ParseMode = iota
+
+	// ParseStrict also rejects headers with malformed options, invalid
+	// checksums or reserved bits set.
+	ParseStrict
+)
+
+// ParseError describes why a header failed to parse.
+type ParseError struct {
+	// Header is the name of the header, e.g. "IPv4".
+	Header string
+
+	// Offset is the offset of the invalid field from the start of the
+	// header.
+	Offset int
+
+	// Reason describes what is wrong with the field.
+	Reason string
+}
+
+// Error implements error.Error.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid %s header at offset %d: %s", e.Header, e.Offset, e.Reason)
+}
+
+func parseError(hdr string, off int, format string, args ...interface{}) *ParseError {
+	return &ParseError{Header: hdr, Offset: off, Reason: fmt.Sprintf(format, args...)}
+}
+
+// ParseIPv4 validates the IPv4 packet in b. On success, it returns the packet
+// trimmed to its total length, whose methods are safe to call.
+func ParseIPv4(b []byte, mode ParseMode) (IPv4, error) {
+	h, err := ParseIPv4Header(b, len(b), mode)
+	if err != nil {
+		return nil, err
+	}
+	return b[:h.TotalLength()], nil
+}
+
+// ParseIPv4Header is like ParseIPv4 for a packet of size bytes of which b only
+// holds the start, as when the packet is split across views. b must hold the
+// whole header, which is returned on success.
+func ParseIPv4Header(b []byte, size int, mode ParseMode) (IPv4, error) {
+	const hdr = "IPv4"
+	if len(b) < IPv4MinimumSize {
+		return nil, parseError(hdr, 0, "%d bytes is shorter than the minimum of %d", len(b), IPv4MinimumSize)
+	}
+	h := IPv4(b)
+	if v := IPVersion(b); v != IPv4Version {
+		return nil, parseError(hdr, versIHL, "version %d", v)
+	}
+	hlen := int(h.HeaderLength())
+	if hlen < IPv4MinimumSize {
+		return nil, parseError(hdr, versIHL, "header length %d is shorter than the minimum of %d", hlen, IPv4MinimumSize)
+	}
+	tlen := int(h.TotalLength())
+	if tlen < hlen || tlen > size {
+		return nil, parseError(hdr, totalLen, "total length %d is outside of [%d, %d]", tlen, hlen, size)
+	}
+	if hlen > len(b) {
+		return nil, parseError(hdr, versIHL, "header length %d exceeds the %d bytes available", hlen, len(b))
+	}
+	h = h[:hlen]
+	if mode == ParseLenient {
+		return h, nil
+	}
+
+	if h[flagsFO]&0x80 != 0 {
+		return nil, parseError(hdr, flagsFO, "reserved flag set")
+	}
+	if c := Checksum(h, 0); c != 0xffff {
+		return nil, parseError(hdr, checksum, "bad checksum %#04x", h.Checksum())
+	}
+	if err := parseIPv4Options(h[IPv4MinimumSize:]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// IPv4 option types that aren't followed by a length.
+const (
+	ipv4OptionEOL = 0
+	ipv4OptionNOP = 1
+)
+
+func parseIPv4Options(b []byte) error {
+	for i := 0; i < len(b); {
+		switch b[i] {
+		case ipv4OptionEOL:
+			return nil
+		case ipv4OptionNOP:
+			i++
+		default:
+			off := IPv4MinimumSize + i
+			if i+2 > len(b) {
+				return parseError("IPv4", off, "option %d truncated", b[i])
+			}
+			l := int(b[i+1])
+			if l < 2 || i+l > len(b) {
+				return parseError("IPv4", off+1, "option %d has invalid length %d", b[i], l)
+			}
+			i += l
+		}
+	}
+	return nil
+}
+
+const (
+	// IPv6RoutingHeader is the number used to specify that the next header
+	// is a routing header, per RFC 8200 section 4.4.
+	IPv6RoutingHeader = 43
+
+	// IPv6DestinationOptionsHeader is the number used to specify that the
+	// next header is a destination options header, per RFC 8200 section
+	// 4.6.
+	IPv6DestinationOptionsHeader = 60
+)
+
+// ParseIPv6 validates the IPv6 packet in b. On success, it returns the packet
+// trimmed to its payload length, whose methods are safe to call. The payload
+// length of jumbograms is taken from their Jumbo Payload option. In strict
+// mode, the extension headers and their options are validated too.
+func ParseIPv6(b []byte, mode ParseMode) (IPv6, error) {
+	return ParseIPv6Header(b, len(b), mode)
+}
+
+// ParseIPv6Header is like ParseIPv6 for a packet of size bytes of which b only
+// holds the start, as when the packet is split across views. b must hold the
+// fixed header, and the extension headers to be validated in strict mode. On
+// success, it returns b trimmed to the packet.
+func ParseIPv6Header(b []byte, size int, mode ParseMode) (IPv6, error) {
+	const hdr = "IPv6"
+	if len(b) < IPv6MinimumSize {
+		return nil, parseError(hdr, 0, "%d bytes is shorter than the minimum of %d", len(b), IPv6MinimumSize)
+	}
+	h := IPv6(b)
+	if v := IPVersion(b); v != IPv6Version {
+		return nil, parseError(hdr, versTCFL, "version %d", v)
+	}
+	plen := uint64(h.PayloadLength())
+	jlen, jumbo := h.JumboPayloadLength()
+	if jumbo {
+		plen = uint64(jlen)
+	}
+	if plen > uint64(size-IPv6MinimumSize) {
+		return nil, parseError(hdr, payloadLen, "payload length %d exceeds the %d bytes available", plen, size-IPv6MinimumSize)
+	}
+	if l := IPv6MinimumSize + int(plen); l < len(h) {
+		h = h[:l]
+	}
+	if mode == ParseLenient {
+		return h, nil
+	}
+
+	if jumbo && jlen <= IPv6MaximumPayloadSize {
+		return nil, parseError(hdr, IPv6MinimumSize+4, "jumbo payload length %d fits in the payload length field", jlen)
+	}
+	if hbh := h.HopByHopOptions(); !jumbo && hbh != nil {
+		if _, ok := hbh.JumboPayloadLength(); ok {
+			return nil, parseError(hdr, payloadLen, "jumbo payload option with non-zero payload length %d", h.PayloadLength())
+		}
+	}
+
+	next := h.NextHeader()
+	for off := IPv6MinimumSize; ; {
+		rest := h[off:]
+		switch next {
+		case IPv6HopByHopOptionsHeader, IPv6RoutingHeader, IPv6DestinationOptionsHeader:
+			if len(rest) < 8 {
+				return nil, parseError(hdr, off, "extension header %d truncated", next)
+			}
+			l := (int(rest[1]) + 1) * 8
+			if l > len(rest) {
+				return nil, parseError(hdr, off+1, "extension header %d has length %d, but only %d bytes remain", next, l, len(rest))
+			}
+			if next != IPv6RoutingHeader {
+				if err := parseIPv6Options(rest[2:l], off+2); err != nil {
+					return nil, err
+				}
+			}
+			next = rest[0]
+			off += l
+		case IPv6FragmentHeader:
+			if len(rest) < 8 {
+				return nil, parseError(hdr, off, "fragment header truncated")
+			}
+			if jumbo {
+				return nil, parseError(hdr, off, "jumbograms can't be fragmented")
+			}
+			next = rest[0]
+			off += 8
+		default:
+			return h, nil
+		}
+	}
+}
+
+// IPv6 option types that aren't followed by a length.
+const ipv6OptionPad1 = 0
+
+func parseIPv6Options(b []byte, base int) error {
+	for i := 0; i < len(b); {
+		if b[i] == ipv6OptionPad1 {
+			i++
+			continue
+		}
+		if i+2 > len(b) {
+			return parseError("IPv6", base+i, "option %d truncated", b[i])
+		}
+		l := 2 + int(b[i+1])
+		if i+l > len(b) {
+			return parseError("IPv6", base+i+1, "option %d has length %d, but only %d bytes remain", b[i], l, len(b)-i)
+		}
+		i += l
+	}
+	return nil
+}
+
+// ParseTCP validates the TCP segment in b. On success, the methods of the
+// returned header are safe to call. In strict mode, the options are validated
+// too.
+func ParseTCP(b []byte, mode ParseMode) (TCP, error) {
+	const hdr = "TCP"
+	if len(b) < TCPMinimumSize {
+		return nil, parseError(hdr, 0, "%d bytes is shorter than the minimum of %d", len(b), TCPMinimumSize)
+	}
+	h := TCP(b)
+	off := int(h.DataOffset())
+	if off < TCPMinimumSize || off > len(b) {
+		return nil, parseError(hdr, dataOffset, "data offset %d is outside of [%d, %d]", off, TCPMinimumSize, len(b))
+	}
+	if mode == ParseLenient {
+		return h, nil
+	}
+
+	if h[dataOffset]&0xf != 0 {
+		return nil, parseError(hdr, dataOffset, "reserved bits set")
+	}
+	if err := parseTCPOptions(h.Options()); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// tcpOptionSizes holds the size of the TCP options whose size is fixed.
+var tcpOptionSizes = map[byte]int{
+	TCPOptionMSS:           4,
+	TCPOptionWS:            3,
+	TCPOptionSACKPermitted: 2,
+	TCPOptionTS:            10,
+}
+
+func parseTCPOptions(b []byte) error {
+	for i := 0; i < len(b); {
+		switch b[i] {
+		case TCPOptionEOL:
+			return nil
+		case TCPOptionNOP:
+			i++
+			continue
+		}
+		off := TCPMinimumSize + i
+		if i+2 > len(b) {
+			return parseError("TCP", off, "option %d truncated", b[i])
+		}
+		l := int(b[i+1])
+		if l < 2 || i+l > len(b) {
+			return parseError("TCP", off+1, "option %d has invalid length %d", b[i], l)
+		}
+		if want, ok := tcpOptionSizes[b[i]]; ok && l != want {
+			return parseError("TCP", off+1, "option %d has length %d, want %d", b[i], l, want)
+		}
+		if b[i] == TCPOptionSACK {
+			if n := (l - 2) / 8; (l-2)%8 != 0 || n < 1 || n > TCPMaxSACKBlocks {
+				return parseError("TCP", off+1, "SACK option has invalid length %d", l)
+			}
+		}
+		i += l
+	}
+	return nil
+}
+
+// ParseUDP validates the UDP datagram in b, which must hold the whole network
+// layer payload. On success, it returns the datagram trimmed to its length,
+// whose methods are safe to call. In strict mode, the length must match the
+// size of b exactly. A zero length stands for the size of b if it doesn't fit
+// in the length field, as in jumbograms.
+func ParseUDP(b []byte, mode ParseMode) (UDP, error) {
+	h, err := ParseUDPHeader(b, len(b), mode)
+	if err != nil {
+		return nil, err
+	}
+	if l := int(h.Length()); l != 0 {
+		b = b[:l]
+	}
+	return b, nil
+}
+
+// ParseUDPHeader is like ParseUDP for a datagram of size bytes of which b only
+// holds the start, as when the datagram is split across views. b must hold the
+// header, which is returned on success.
+func ParseUDPHeader(b []byte, size int, mode ParseMode) (UDP, error) {
+	const hdr = "UDP"
+	if len(b) < UDPMinimumSize {
+		return nil, parseError(hdr, 0, "%d bytes is shorter than the minimum of %d", len(b), UDPMinimumSize)
+	}
+	h := UDP(b)
+	l := int(h.Length())
+	if l == 0 && size > UDPMaximumSize {
+		l = size
+	}
+	if l < UDPMinimumSize || l > size {
+		return nil, parseError(hdr, udpLength, "length %d is outside of [%d, %d]", l, UDPMinimumSize, size)
+	}
+	if mode == ParseStrict && l != size {
+		return nil, parseError(hdr, udpLength, "length %d doesn't match the %d bytes available", l, size)
+	}
+	return h[:UDPMinimumSize], nil
+}
+
+// ParseICMPv4 validates the ICMPv4 message in b. On success, the methods of
+// the returned header are safe to call, and b is large enough for the message
+// type. In strict mode, the checksum is validated, and error messages must
+// quote at least an IPv4 header.
+func ParseICMPv4(b []byte, mode ParseMode) (ICMPv4, error) {
+	const hdr = "ICMPv4"
+	if len(b) < ICMPv4MinimumSize {
+		return nil, parseError(hdr, 0, "%d bytes is shorter than the minimum of %d", len(b), ICMPv4MinimumSize)
+	}
+	h := ICMPv4(b)
+	min := ICMPv4MinimumSize
+	isError := false
+	switch h.Type() {
+	case ICMPv4Echo, ICMPv4EchoReply:
+		min = ICMPv4EchoMinimumSize
+	case ICMPv4DstUnreachable, ICMPv4TimeExceeded, ICMPv4ParamProblem, ICMPv4Redirect, ICMPv4SrcQuench:
+		min = ICMPv4DstUnreachableMinimumSize
+		isError = true
+	}
+	if len(b) < min {
+		return nil, parseError(hdr, 0, "%d bytes is shorter than the minimum of %d for type %d", len(b), min, h.Type())
+	}
+	if mode == ParseLenient {
+		return h, nil
+	}
+
+	if Checksum(b, 0) != 0xffff {
+		return nil, parseError(hdr, 2, "bad checksum %#04x", h.Checksum())
+	}
+	if isError && len(b) < min+IPv4MinimumSize {
+		return nil, parseError(hdr, min, "quoted packet of %d bytes is shorter than an IPv4 header", len(b)-min)
+	}
+	return h, nil
+}
+
+// ParseICMPv6 validates the ICMPv6 message in b. On success, the methods of
+// the returned header are safe to call, and b is large enough for the message
+// type. The checksum covers a pseudo-header, so it is not validated here, but
+// in strict mode the options of neighbor discovery messages are.
+func ParseICMPv6(b []byte, mode ParseMode) (ICMPv6, error) {
+	const hdr = "ICMPv6"
+	if len(b) < ICMPv6MinimumSize {
+		return nil, parseError(hdr, 0, "%d bytes is shorter than the minimum of %d", len(b), ICMPv6MinimumSize)
+	}
+	h := ICMPv6(b)
+	min := ICMPv6MinimumSize
+	switch h.Type() {
+	case ICMPv6EchoRequest, ICMPv6EchoReply:
+		min = ICMPv6EchoMinimumSize
+	case ICMPv6DstUnreachable, ICMPv6PacketTooBig, ICMPv6TimeExceeded, ICMPv6ParamProblem:
+		min = ICMPv6DstUnreachableMinimumSize
+	case ICMPv6NeighborSolicit:
+		min = ICMPv6NeighborSolicitMinimumSize
+	case ICMPv6NeighborAdvert:
+		min = ICMPv6NeighborAdvertSize
+	}
+	if len(b) < min {
+		return nil, parseError(hdr, 0, "%d bytes is shorter than the minimum of %d for type %d", len(b), min, h.Type())
+	}
+	if mode == ParseLenient {
+		return h, nil
+	}
+
+	switch h.Type() {
+	case ICMPv6NeighborSolicit, ICMPv6NeighborAdvert:
+		if err := parseNDPOptions(b[min:], min); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// parseNDPOptions validates neighbor discovery options, whose length is in
+// units of 8 bytes and must not be zero (RFC 4861 section 4.6).
+func parseNDPOptions(b []byte, base int) error {
+	for i := 0; i < len(b); {
+		if i+2 > len(b) {
+			return parseError("ICMPv6", base+i, "option %d truncated", b[i])
+		}
+		l := int(b[i+1]) * 8
+		if l == 0 || i+l > len(b) {
+			return parseError("ICMPv6", base+i+1, "option %d has invalid length %d", b[i], l)
+		}
+		i += l
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package header_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/google/netstack/tcpip/header"
+)
+
+func ipv4Packet(opts []byte, payloadSize int) []byte {
+	hlen := header.IPv4MinimumSize + len(opts)
+	b := make([]byte, hlen+payloadSize)
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         uint8(hlen),
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     "\x0a\x00\x00\x01",
+		DstAddr:     "\x0a\x00\x00\x02",
+	})
+	copy(b[header.IPv4MinimumSize:], opts)
+	ip.SetChecksum(^ip.CalculateChecksum())
+	return b
+}
+
+func tcpSegment(opts []byte) []byte {
+	b := make([]byte, header.TCPMinimumSize+len(opts))
+	header.TCP(b).Encode(&header.TCPFields{
+		SrcPort:    1,
+		DstPort:    2,
+		DataOffset: uint8(len(b)),
+		Flags:      header.TCPFlagSyn,
+	})
+	copy(b[header.TCPMinimumSize:], opts)
+	return b
+}
+
+func TestParse(t *testing.T) {
+	corrupt := func(b []byte, i int, v byte) []byte {
+		b[i] = v
+		return b
+	}
+	ipv4 := func(b []byte, mode header.ParseMode) error {
+		_, err := header.ParseIPv4(b, mode)
+		return err
+	}
+	tcp := func(b []byte, mode header.ParseMode) error {
+		_, err := header.ParseTCP(b, mode)
+		return err
+	}
+	udp := func(b []byte, mode header.ParseMode) error {
+		_, err := header.ParseUDP(b, mode)
+		return err
+	}
+
+	udpDatagram := func(length uint16, size int) []byte {
+		b := make([]byte, size)
+		header.UDP(b).Encode(&header.UDPFields{Length: length})
+		return b
+	}
+
+	for _, test := range []struct {
+		name                string
+		parse               func([]byte, header.ParseMode) error
+		b                   []byte
+		lenientOK, strictOK bool
+	}{
+		{"ipv4 valid", ipv4, ipv4Packet(nil, 10), true, true},
+		{"ipv4 valid options", ipv4, ipv4Packet([]byte{1, 7, 3, 0}, 10), true, true},
+		{"ipv4 short", ipv4, make([]byte, 10), false, false},
+		{"ipv4 bad version", ipv4, corrupt(ipv4Packet(nil, 10), 0, 0x65), false, false},
+		{"ipv4 short header length", ipv4, corrupt(ipv4Packet(nil, 10), 0, 0x44), false, false},
+		{"ipv4 total length too long", ipv4, ipv4Packet(nil, 10)[:25], false, false},
+		{"ipv4 bad checksum", ipv4, corrupt(ipv4Packet(nil, 10), 10, 0), true, false},
+		{"ipv4 bad option length", ipv4, ipv4Packet([]byte{7, 9, 0, 0}, 10), true, false},
+		{"tcp valid", tcp, tcpSegment(nil), true, true},
+		{"tcp valid options", tcp, tcpSegment([]byte{2, 4, 5, 0xb4, 1, 3, 3, 7}), true, true},
+		{"tcp short", tcp, make([]byte, 19), false, false},
+		{"tcp data offset too large", tcp, tcpSegment([]byte{1, 1, 1, 1})[:22], false, false},
+		{"tcp bad mss length", tcp, tcpSegment([]byte{2, 3, 5, 0}), true, false},
+		{"tcp truncated option", tcp, tcpSegment([]byte{1, 1, 1, 8}), true, false},
+		{"tcp empty sack", tcp, tcpSegment([]byte{5, 2, 1, 1}), true, false},
+		{"tcp reserved bits", tcp, corrupt(tcpSegment(nil), 12, 0x51), true, false},
+		{"udp valid", udp, udpDatagram(12, 12), true, true},
+		{"udp padded", udp, udpDatagram(10, 12), true, false},
+		{"udp length too long", udp, udpDatagram(14, 12), false, false},
+		{"udp length too short", udp, udpDatagram(4, 12), false, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.parse(test.b, header.ParseLenient); (err == nil) != test.lenientOK {
+				t.Errorf("got lenient parse error = %v, want success = %t", err, test.lenientOK)
+			}
+			err := test.parse(test.b, header.ParseStrict)
+			if (err == nil) != test.strictOK {
+				t.Errorf("got strict parse error = %v, want success = %t", err, test.strictOK)
+			}
+			if err != nil {
+				if _, ok := err.(*header.ParseError); !ok {
+					t.Errorf("got error of type %T, want *header.ParseError", err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseIPv4Trims(t *testing.T) {
+	b := append(ipv4Packet(nil, 10), 0, 0, 0)
+	ip, err := header.ParseIPv4(b, header.ParseStrict)
+	if err != nil {
+		t.Fatalf("ParseIPv4 failed: %v", err)
+	}
+	if got, want := len(ip.Payload()), 10; got != want {
+		t.Errorf("got len(Payload()) = %d, want = %d", got, want)
+	}
+}
+
+func TestParseHeaderOfSplitPacket(t *testing.T) {
+	b := ipv4Packet(nil, 10)
+	if _, err := header.ParseIPv4Header(b[:header.IPv4MinimumSize], len(b), header.ParseStrict); err != nil {
+		t.Errorf("ParseIPv4Header failed: %v", err)
+	}
+	if _, err := header.ParseIPv4Header(b[:header.IPv4MinimumSize], len(b)-1, header.ParseStrict); err == nil {
+		t.Error("ParseIPv4Header succeeded with a total length beyond the packet")
+	}
+	if _, err := header.ParseIPv4Header(ipv4Packet(make([]byte, 4), 0)[:header.IPv4MinimumSize], 24, header.ParseLenient); err == nil {
+		t.Error("ParseIPv4Header succeeded without the whole header")
+	}
+
+	u := make([]byte, header.UDPMinimumSize)
+	header.UDP(u).Encode(&header.UDPFields{Length: 20})
+	if h, err := header.ParseUDPHeader(u, 20, header.ParseStrict); err != nil {
+		t.Errorf("ParseUDPHeader failed: %v", err)
+	} else if len(h) != header.UDPMinimumSize {
+		t.Errorf("got len(ParseUDPHeader(...)) = %d, want = %d", len(h), header.UDPMinimumSize)
+	}
+	if _, err := header.ParseUDPHeader(u, 19, header.ParseLenient); err == nil {
+		t.Error("ParseUDPHeader succeeded with a length beyond the datagram")
+	}
+}
+
+func TestParseIPv6ExtensionHeaders(t *testing.T) {
+	packet := func(ext []byte) []byte {
+		b := make([]byte, header.IPv6MinimumSize+len(ext))
+		header.IPv6(b).Encode(&header.IPv6Fields{
+			PayloadLength: uint16(len(ext)),
+			NextHeader:    0, // Hop-by-hop options.
+			HopLimit:      64,
+		})
+		copy(b[header.IPv6MinimumSize:], ext)
+		return b
+	}
+
+	// A hop-by-hop options header with a PadN option, followed by no next
+	// header.
+	valid := packet([]byte{59, 0, 1, 4, 0, 0, 0, 0})
+	if _, err := header.ParseIPv6(valid, header.ParseStrict); err != nil {
+		t.Errorf("ParseIPv6 of a valid packet failed: %v", err)
+	}
+
+	// The PadN option overflows the extension header.
+	invalid := packet([]byte{59, 0, 1, 5, 0, 0, 0, 0})
+	if _, err := header.ParseIPv6(invalid, header.ParseLenient); err != nil {
+		t.Errorf("lenient ParseIPv6 of a packet with invalid options failed: %v", err)
+	}
+	if _, err := header.ParseIPv6(invalid, header.ParseStrict); err == nil {
+		t.Error("strict ParseIPv6 of a packet with invalid options succeeded")
+	}
+
+	// The extension header is longer than the payload.
+	truncated := packet([]byte{59, 1, 1, 4, 0, 0, 0, 0})
+	if _, err := header.ParseIPv6(truncated, header.ParseStrict); err == nil {
+		t.Error("strict ParseIPv6 of a packet with a truncated extension header succeeded")
+	}
+}
+
+func TestParseIPv6Jumbogram(t *testing.T) {
+	jumbogram := func(payloadSize int, jumboLength uint32) []byte {
+		b := make([]byte, header.IPv6MinimumSize+header.IPv6JumboPayloadHeaderSize+payloadSize)
+		header.IPv6(b).Encode(&header.IPv6Fields{
+			NextHeader: header.IPv6HopByHopOptionsHeader,
+			HopLimit:   64,
+		})
+		header.IPv6HopByHop(b[header.IPv6MinimumSize:]).EncodeJumboPayload(uint8(header.UDPProtocolNumber), jumboLength)
+		return b
+	}
+
+	const size = 70000
+	b := append(jumbogram(size, header.IPv6JumboPayloadHeaderSize+size), 0, 0)
+	ip, err := header.ParseIPv6(b, header.ParseStrict)
+	if err != nil {
+		t.Fatalf("ParseIPv6 of a jumbogram failed: %v", err)
+	}
+	if got, want := len(ip.Payload()), header.IPv6JumboPayloadHeaderSize+size; got != want {
+		t.Errorf("got len(Payload()) = %d, want = %d", got, want)
+	}
+	if !ip.IsValid(len(ip)) {
+		t.Error("IsValid of a jumbogram returned false")
+	}
+
+	// The jumbo payload length exceeds the packet.
+	long := jumbogram(size, header.IPv6JumboPayloadHeaderSize+size+1)
+	if _, err := header.ParseIPv6(long, header.ParseLenient); err == nil {
+		t.Error("lenient ParseIPv6 of a truncated jumbogram succeeded")
+	}
+
+	// Jumbograms must not fit in the payload length field.
+	small := jumbogram(100, header.IPv6JumboPayloadHeaderSize+100)
+	if _, err := header.ParseIPv6(small, header.ParseLenient); err != nil {
+		t.Errorf("lenient ParseIPv6 of a small jumbogram failed: %v", err)
+	}
+	if _, err := header.ParseIPv6(small, header.ParseStrict); err == nil {
+		t.Error("strict ParseIPv6 of a small jumbogram succeeded")
+	}
+	if header.IPv6(small).IsValid(len(small)) {
+		t.Error("IsValid of a small jumbogram returned true")
+	}
+
+	// The length of UDP datagrams carried by jumbograms is zero.
+	udp := make([]byte, size)
+	header.UDP(udp).Encode(&header.UDPFields{})
+	if u, err := header.ParseUDP(udp, header.ParseStrict); err != nil {
+		t.Errorf("ParseUDP of a jumbo datagram failed: %v", err)
+	} else if got := len(u); got != size {
+		t.Errorf("got len(ParseUDP(...)) = %d, want = %d", got, size)
+	}
+}
+
+// TestParseRandom checks that the parsers don't panic on random input, and
+// that the accessors of the headers they accept stay within bounds.
+func TestParseRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		b := make([]byte, r.Intn(80))
+		r.Read(b)
+		for _, mode := range []header.ParseMode{header.ParseLenient, header.ParseStrict} {
+			if h, err := header.ParseIPv4(b, mode); err == nil {
+				_ = h.Payload()
+			}
+			if h, err := header.ParseIPv6(b, mode); err == nil {
+				_ = h.Payload()
+			}
+			if h, err := header.ParseTCP(b, mode); err == nil {
+				_ = h.Payload()
+				_ = h.ParsedOptions()
+			}
+			if h, err := header.ParseUDP(b, mode); err == nil {
+				_ = h.Payload()
+			}
+			if h, err := header.ParseICMPv4(b, mode); err == nil {
+				_ = h.Payload()
+			}
+			if h, err := header.ParseICMPv6(b, mode); err == nil {
+				_ = h.Payload()
+			}
+		}
+	}
+}
@@ -42,6 +42,12 @@ const (
 	// TCPMaxSACKBlocks is the maximum number of SACK blocks that can
 	// be encoded in a TCP option field.
 	TCPMaxSACKBlocks = 4
+
+	// TCPMaxMSS is the largest MSS that fits in the MSS option. When
+	// received on a connection whose route carries jumbograms, it stands
+	// for infinity: the MSS is then only limited by the MTU (RFC 2675,
+	// section 5.2).
+	TCPMaxMSS = 0xffff
 )
 
 // Flags that may be set in a TCP segment.
@@ -63,6 +69,7 @@ const (
 	TCPOptionTS            = 8
 	TCPOptionSACKPermitted = 4
 	TCPOptionSACK          = 5
+	TCPOptionMPTCP         = 30
 )
 
 // TCPFields contains the fields of a TCP packet. It is used to describe the
@@ -118,6 +125,11 @@ type TCPSynOptions struct {
 
 	// SACKPermitted is true if the SACK option was provided in the SYN/SYN-ACK.
 	SACKPermitted bool
+
+	// MPCapable is true if the MP_CAPABLE option was provided in the
+	// SYN/SYN-ACK, in which case MPTCP holds it.
+	MPCapable bool
+	MPTCP     MPCapableOption
 }
 
 // SACKBlock represents a single contiguous SACK block.
@@ -354,6 +366,19 @@ func ParseSynOptions(opts []byte, isAck bool) TCPSynOptions {
 			synOpts.SACKPermitted = true
 			i += 2
 
+		case TCPOptionMPTCP:
+			if i+2 > limit {
+				return synOpts
+			}
+			l := int(opts[i+1])
+			if l < 2 || i+l > limit {
+				return synOpts
+			}
+			if mptcpSubtype(opts[i:i+l]) == MPTCPSubtypeCapable {
+				synOpts.MPTCP, synOpts.MPCapable = parseMPCapable(opts[i : i+l])
+			}
+			i += l
+
 		default:
 			// We don't recognize this option, just skip over it.
 			if i+2 > limit {
@@ -50,6 +50,11 @@ const (
 	// UDPMinimumSize is the minimum size of a valid UDP packet.
 	UDPMinimumSize = 8
 
+	// UDPMaximumSize is the largest datagram size that fits in the length
+	// field. Larger datagrams, carried by IPv6 jumbograms, have a length of
+	// zero (RFC 2675, section 4).
+	UDPMaximumSize = 0xffff
+
 	// UDPProtocolNumber is UDP's transport protocol number.
 	UDPProtocolNumber tcpip.TransportProtocolNumber = 17
 )
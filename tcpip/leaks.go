@@ -0,0 +1,158 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpip
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Leak checking records where objects that must be explicitly released, such
+// as endpoints, routes and packet buffers, were created, so that those that
+// never are can be reported. Capturing stacks is expensive, so it is disabled
+// unless SetLeakCheck is called or the leakcheck build tag is set.
+
+// leakCheck is 1 if leak checking is enabled. It is accessed atomically.
+var leakCheck int32
+
+// trackedObjectsMu protects trackedObjects and lastTrackedID.
+var trackedObjectsMu sync.Mutex
+
+// trackedObjects holds the objects that haven't been released yet, indexed by
+// their tracking ID.
+var trackedObjects = make(map[uint64]*trackedObject)
+
+// lastTrackedID is the tracking ID given to the last tracked object.
+var lastTrackedID uint64
+
+type trackedObject struct {
+	kind    string
+	created time.Time
+	pcs     []uintptr
+}
+
+// TrackedObject describes an object created while leak checking was enabled
+// and not released yet.
+type TrackedObject struct {
+	// ID is the tracking ID of the object.
+	ID uint64
+
+	// Kind is the type of the object, e.g. "tcp endpoint" or "route".
+	Kind string
+
+	// Created is when the object was created.
+	Created time.Time
+
+	// Stack is the stack trace of the goroutine that created the object.
+	Stack string
+}
+
+// SetLeakCheck enables or disables leak checking. Objects created while it is
+// disabled are never tracked, while those already tracked remain so until they
+// are released.
+func SetLeakCheck(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&leakCheck, v)
+}
+
+// LeakCheckEnabled returns whether leak checking is enabled.
+func LeakCheckEnabled() bool {
+	return atomic.LoadInt32(&leakCheck) != 0
+}
+
+// TrackObject records the creation of an object of the given kind by the
+// caller, if leak checking is enabled. It returns the tracking ID to pass to
+// UntrackObject when the object is released, or 0 if it isn't tracked.
+func TrackObject(kind string) uint64 {
+	if !LeakCheckEnabled() {
+		return 0
+	}
+	pcs := make([]uintptr, 32)
+	// Skip runtime.Callers and TrackObject.
+	pcs = pcs[:runtime.Callers(2, pcs)]
+
+	trackedObjectsMu.Lock()
+	defer trackedObjectsMu.Unlock()
+	lastTrackedID++
+	trackedObjects[lastTrackedID] = &trackedObject{
+		kind:    kind,
+		created: time.Now(),
+		pcs:     pcs,
+	}
+	return lastTrackedID
+}
+
+// UntrackObject records the release of the object with the given tracking ID.
+// It does nothing if id is 0.
+func UntrackObject(id uint64) {
+	if id == 0 {
+		return
+	}
+	trackedObjectsMu.Lock()
+	delete(trackedObjects, id)
+	trackedObjectsMu.Unlock()
+}
+
+// GetTrackedObjects returns the tracked objects that haven't been released
+// yet, oldest first.
+func GetTrackedObjects() []TrackedObject {
+	trackedObjectsMu.Lock()
+	objs := make([]TrackedObject, 0, len(trackedObjects))
+	pcs := make([][]uintptr, 0, len(trackedObjects))
+	for id, o := range trackedObjects {
+		objs = append(objs, TrackedObject{ID: id, Kind: o.kind, Created: o.created})
+		pcs = append(pcs, o.pcs)
+	}
+	trackedObjectsMu.Unlock()
+
+	// Symbolize outside of the lock, as it is slow.
+	for i := range objs {
+		objs[i].Stack = formatStack(pcs[i])
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].ID < objs[j].ID })
+	return objs
+}
+
+// DumpTrackedObjects writes the tracked objects that haven't been released
+// yet to w, along with where they were created.
+func DumpTrackedObjects(w io.Writer) {
+	objs := GetTrackedObjects()
+	fmt.Fprintf(w, "%d unreleased objects\n", len(objs))
+	for _, o := range objs {
+		fmt.Fprintf(w, "\n%s #%d created at %s:\n%s", o.Kind, o.ID, o.Created.Format(time.RFC3339Nano), o.Stack)
+	}
+}
+
+func formatStack(pcs []uintptr) string {
+	var b strings.Builder
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(&b, "\t%s\n\t\t%s:%d\n", f.Function, f.File, f.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
@@ -14,13 +14,18 @@
 
 // Package channel provides the implemention of channel-based data-link layer
 // endpoints. Such endpoints allow injection of inbound packets and store
-// outbound packets in a channel.
+// outbound packets in a channel, or in a lock-free ring for endpoints created
+// with NewRing.
 package channel
 
 import (
+	"sync"
+	"sync/atomic"
+
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
 )
 
 // PacketInfo holds all the information about an outbound packet.
@@ -32,15 +37,31 @@ type PacketInfo struct {
 
 // Endpoint is link layer endpoint that stores outbound packets in a channel
 // and allows injection of inbound packets.
+//
+// Endpoint implements waiter.Waitable: waiters registered for waiter.EventIn
+// are notified whenever an outbound packet is queued.
 type Endpoint struct {
+	waiter.Queue
+
 	dispatcher stack.NetworkDispatcher
-	mtu        uint32
 	linkAddr   tcpip.LinkAddress
 
-	// C is where outbound packets are queued.
+	// mtu must be accessed atomically.
+	mtu uint32
+
+	// C is where outbound packets are queued. It is nil if the endpoint was
+	// created with NewRing.
 	C chan PacketInfo
+
+	// ring is where outbound packets are queued if the endpoint was created
+	// with NewRing. As the stack may write packets from several goroutines,
+	// writeMu serializes the producers.
+	writeMu sync.Mutex
+	ring    *ring
 }
 
+var _ waiter.Waitable = (*Endpoint)(nil)
+
 // New creates a new channel endpoint.
 func New(size int, mtu uint32, linkAddr tcpip.LinkAddress) (tcpip.LinkEndpointID, *Endpoint) {
 	e := &Endpoint{
@@ -52,19 +73,73 @@ func New(size int, mtu uint32, linkAddr tcpip.LinkAddress) (tcpip.LinkEndpointID
 	return stack.RegisterLinkEndpoint(e), e
 }
 
+// NewRing creates a new channel endpoint that queues outbound packets in a
+// lock-free single-consumer ring holding at least size packets, instead of in
+// C. Packets are retrieved with Read or ReadBatch, which must not be called
+// concurrently with each other.
+func NewRing(size int, mtu uint32, linkAddr tcpip.LinkAddress) (tcpip.LinkEndpointID, *Endpoint) {
+	e := &Endpoint{
+		ring:     newRing(size),
+		mtu:      mtu,
+		linkAddr: linkAddr,
+	}
+
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// Read removes the next outbound packet from the endpoint. It returns false if
+// no packet is queued.
+func (e *Endpoint) Read() (PacketInfo, bool) {
+	var p [1]PacketInfo
+	n := e.ReadBatch(p[:])
+	return p[0], n == 1
+}
+
+// ReadBatch removes up to len(pkts) outbound packets from the endpoint and
+// stores them in pkts, without blocking. It returns the number of packets
+// removed.
+func (e *Endpoint) ReadBatch(pkts []PacketInfo) int {
+	if e.ring != nil {
+		return e.ring.pop(pkts)
+	}
+	for i := range pkts {
+		select {
+		case pkts[i] = <-e.C:
+		default:
+			return i
+		}
+	}
+	return len(pkts)
+}
+
 // Drain removes all outbound packets from the channel and counts them.
 func (e *Endpoint) Drain() int {
 	c := 0
+	var pkts [16]PacketInfo
 	for {
-		select {
-		case <-e.C:
-			c++
-		default:
+		n := e.ReadBatch(pkts[:])
+		if n == 0 {
 			return c
 		}
+		c += n
 	}
 }
 
+// Readiness implements waiter.Waitable.Readiness. The endpoint is readable
+// when an outbound packet is queued.
+func (e *Endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
+	var n int
+	if e.ring != nil {
+		n = e.ring.len()
+	} else {
+		n = len(e.C)
+	}
+	if n == 0 {
+		return 0
+	}
+	return mask & waiter.EventIn
+}
+
 // Inject injects an inbound packet.
 func (e *Endpoint) Inject(protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
 	e.InjectLinkAddr(protocol, "", vv)
@@ -75,6 +150,28 @@ func (e *Endpoint) InjectLinkAddr(protocol tcpip.NetworkProtocolNumber, remote t
 	e.dispatcher.DeliverNetworkPacket(e, remote, "" /* local */, protocol, vv.Clone(nil))
 }
 
+// InjectBatch injects several inbound packets of the given protocol in a
+// single call to the dispatcher.
+func (e *Endpoint) InjectBatch(protocol tcpip.NetworkProtocolNumber, vvs []buffer.VectorisedView) {
+	pkts := make([]stack.InboundPacket, len(vvs))
+	for i, vv := range vvs {
+		pkts[i] = stack.InboundPacket{
+			Protocol: protocol,
+			Pkt:      stack.NewPacketBuffer(vv.Clone(nil)),
+		}
+	}
+	stack.DeliverPacketBatch(e.dispatcher, e, pkts)
+	for _, p := range pkts {
+		p.Pkt.DecRef()
+	}
+}
+
+// SetLinkState reports a carrier change to the dispatcher, as a link endpoint
+// backed by a real device would.
+func (e *Endpoint) SetLinkState(up bool) {
+	stack.DeliverLinkState(e.dispatcher, up)
+}
+
 // Attach saves the stack network-layer dispatcher for use later when packets
 // are injected.
 func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
@@ -89,7 +186,16 @@ func (e *Endpoint) IsAttached() bool {
 // MTU implements stack.LinkEndpoint.MTU. It returns the value initialized
 // during construction.
 func (e *Endpoint) MTU() uint32 {
-	return e.mtu
+	return atomic.LoadUint32(&e.mtu)
+}
+
+// SetMTU implements stack.MTUSettableLinkEndpoint.SetMTU.
+func (e *Endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	if mtu == 0 {
+		return tcpip.ErrInvalidOptionValue
+	}
+	atomic.StoreUint32(&e.mtu, mtu)
+	return nil
 }
 
 // Capabilities implements stack.LinkEndpoint.Capabilities.
@@ -109,17 +215,28 @@ func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
 }
 
 // WritePacket stores outbound packets into the channel.
-func (e *Endpoint) WritePacket(_ *stack.Route, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+func (e *Endpoint) WritePacket(_ *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
 	p := PacketInfo{
-		Header:  hdr.View(),
+		Header:  pkt.Header.View(),
 		Proto:   protocol,
-		Payload: payload.ToView(),
+		Payload: pkt.Data.ToView(),
 	}
 
-	select {
-	case e.C <- p:
-	default:
+	if e.ring != nil {
+		e.writeMu.Lock()
+		ok := e.ring.push(p)
+		e.writeMu.Unlock()
+		if !ok {
+			return nil
+		}
+	} else {
+		select {
+		case e.C <- p:
+		default:
+			return nil
+		}
 	}
 
+	e.Notify(waiter.EventIn)
 	return nil
 }
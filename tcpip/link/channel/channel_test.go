@@ -0,0 +1,110 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package channel
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+func TestRing(t *testing.T) {
+	r := newRing(3)
+	if got, want := len(r.slots), 4; got != want {
+		t.Fatalf("got %d slots, want %d", got, want)
+	}
+
+	// Go around the ring a few times.
+	next := 0
+	var pkts [3]PacketInfo
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 3; j++ {
+			if !r.push(PacketInfo{Proto: tcpip.NetworkProtocolNumber(next + j)}) {
+				t.Fatalf("push failed with %d packets queued", r.len())
+			}
+		}
+		if n := r.pop(pkts[:2]); n != 2 {
+			t.Fatalf("got pop = %d, want 2", n)
+		}
+		if n := r.pop(pkts[2:]); n != 1 {
+			t.Fatalf("got pop = %d, want 1", n)
+		}
+		for j, p := range pkts {
+			if got, want := p.Proto, tcpip.NetworkProtocolNumber(next+j); got != want {
+				t.Fatalf("got packet %d, want %d", got, want)
+			}
+		}
+		next += 3
+	}
+
+	for i := 0; i < 4; i++ {
+		if !r.push(PacketInfo{}) {
+			t.Fatalf("push failed with %d packets queued", r.len())
+		}
+	}
+	if r.push(PacketInfo{}) {
+		t.Errorf("push succeeded on a full ring")
+	}
+	if n := r.pop(make([]PacketInfo, 10)); n != 4 {
+		t.Errorf("got pop = %d, want 4", n)
+	}
+}
+
+func TestRingEndpoint(t *testing.T) {
+	_, e := NewRing(2, 1500, "")
+	if e.C != nil {
+		t.Fatalf("got non-nil C for ring endpoint")
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	e.EventRegister(&we, waiter.EventIn)
+	defer e.EventUnregister(&we)
+
+	if got := e.Readiness(waiter.EventIn); got != 0 {
+		t.Fatalf("got Readiness = %v on an empty endpoint, want 0", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		hdr := buffer.NewPrependable(1)
+		hdr.Prepend(1)[0] = byte(i)
+		if err := e.WritePacket(nil, stack.NewOutboundPacketBuffer(hdr, buffer.VectorisedView{}), tcpip.NetworkProtocolNumber(i)); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+
+	select {
+	case <-ch:
+	default:
+		t.Fatalf("waiter not notified of queued packet")
+	}
+	if got := e.Readiness(waiter.EventIn); got != waiter.EventIn {
+		t.Fatalf("got Readiness = %v, want %v", got, waiter.EventIn)
+	}
+
+	// The third packet was dropped as the ring only holds two.
+	p, ok := e.Read()
+	if !ok || p.Proto != 0 || p.Header[0] != 0 {
+		t.Fatalf("got Read = %+v, %t, want the first packet", p, ok)
+	}
+	if n := e.Drain(); n != 1 {
+		t.Fatalf("got Drain = %d, want 1", n)
+	}
+	if _, ok := e.Read(); ok {
+		t.Fatalf("Read succeeded on an empty endpoint")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package channel
+
+import (
+	"sync/atomic"
+)
+
+// cacheLineSize is the assumed size of a CPU cache line.
+const cacheLineSize = 64
+
+// ring is a bounded, lock-free, single-producer/single-consumer queue of
+// packets. push may only be called by one goroutine at a time, and likewise
+// for pop, but the two may run concurrently without synchronization.
+type ring struct {
+	// head is the index of the next packet to pop. It is only written by
+	// the consumer, and must be accessed atomically.
+	head uint64
+	_    [cacheLineSize - 8]byte
+
+	// tail is the index of the next packet to push. It is only written by
+	// the producer, and must be accessed atomically.
+	tail uint64
+	_    [cacheLineSize - 8]byte
+
+	// mask is len(slots)-1. Indices are reduced modulo len(slots) by
+	// masking them with it.
+	mask  uint64
+	slots []PacketInfo
+}
+
+// newRing creates a ring that holds at least size packets. The actual capacity
+// is size rounded up to a power of two.
+func newRing(size int) *ring {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	return &ring{
+		mask:  uint64(n - 1),
+		slots: make([]PacketInfo, n),
+	}
+}
+
+// push appends p to the ring. It returns false if the ring is full.
+func (r *ring) push(p PacketInfo) bool {
+	tail := atomic.LoadUint64(&r.tail)
+	if tail-atomic.LoadUint64(&r.head) > r.mask {
+		return false
+	}
+	r.slots[tail&r.mask] = p
+	atomic.StoreUint64(&r.tail, tail+1)
+	return true
+}
+
+// pop removes up to len(pkts) packets from the ring and stores them in pkts.
+// It returns the number of packets removed.
+func (r *ring) pop(pkts []PacketInfo) int {
+	head := atomic.LoadUint64(&r.head)
+	n := atomic.LoadUint64(&r.tail) - head
+	if n > uint64(len(pkts)) {
+		n = uint64(len(pkts))
+	}
+	for i := uint64(0); i < n; i++ {
+		s := &r.slots[(head+i)&r.mask]
+		pkts[i] = *s
+		// Don't keep the packet alive until the slot is reused.
+		*s = PacketInfo{}
+	}
+	atomic.StoreUint64(&r.head, head+n)
+	return int(n)
+}
+
+// len returns the number of packets in the ring.
+func (r *ring) len() int {
+	return int(atomic.LoadUint64(&r.tail) - atomic.LoadUint64(&r.head))
+}
@@ -25,7 +25,9 @@ package fdbased
 
 import (
 	"fmt"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
@@ -43,6 +45,28 @@ const (
 // BufConfig defines the shape of the vectorised view used to read packets from the NIC.
 var BufConfig = []int{128, 256, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768}
 
+// jumboBufSize is the size of the views added to BufConfig to read frames
+// larger than its total size, e.g., frames carrying IPv6 jumbograms.
+const jumboBufSize = 65536
+
+// bufConfigFor returns the shape of the vectorised view used to read frames of
+// up to size bytes: BufConfig, followed by as many views of jumboBufSize bytes
+// as needed.
+func bufConfigFor(size int) []int {
+	total := 0
+	for _, s := range BufConfig {
+		total += s
+	}
+	if total >= size {
+		return BufConfig
+	}
+	c := append([]int(nil), BufConfig...)
+	for ; total < size; total += jumboBufSize {
+		c = append(c, jumboBufSize)
+	}
+	return c
+}
+
 // linkDispatcher reads packets from the link FD and dispatches them to the
 // NetworkDispatcher.
 type linkDispatcher func() (bool, *tcpip.Error)
@@ -75,7 +99,8 @@ type endpoint struct {
 	// fd is the file descriptor used to send and receive packets.
 	fd int
 
-	// mtu (maximum transmission unit) is the maximum size of a packet.
+	// mtu (maximum transmission unit) is the maximum size of a packet. It
+	// must be accessed atomically.
 	mtu uint32
 
 	// hdrSize specifies the link-layer header size. If set to 0, no header
@@ -97,6 +122,12 @@ type endpoint struct {
 	// msgHdrs is only used by the RecvMMsg dispatcher.
 	msgHdrs []rawfile.MMsgHdr
 
+	// batch and batchUsed are only used by the RecvMMsg dispatcher. They
+	// hold the packets read by a single recvmmsg() call, and the number of
+	// views of e.views each of them uses, until they are delivered.
+	batch     []stack.InboundPacket
+	batchUsed []int
+
 	inboundDispatcher linkDispatcher
 	dispatcher        stack.NetworkDispatcher
 
@@ -111,6 +142,18 @@ type endpoint struct {
 	// ringOffset is the current offset into the ring buffer where the next
 	// inbound packet will be placed by the kernel.
 	ringOffset int
+
+	// linkDown is 1 when the host has reported that the link is down and 0
+	// otherwise. It must be accessed atomically.
+	linkDown uint32
+
+	// pool, if not nil, provides the views packets are read into. They
+	// are returned to it once the stack is done with the packet.
+	pool *buffer.Pool
+
+	// bufConfig is the shape of the vectorised view packets are read
+	// into. It is BufConfig unless the MTU requires larger frames.
+	bufConfig []int
 }
 
 // Options specify the details about the fd-based endpoint to be created.
@@ -124,6 +167,20 @@ type Options struct {
 	SaveRestore        bool
 	DisconnectOk       bool
 	PacketDispatchMode PacketDispatchMode
+
+	// BufferPool, if not nil, is used to recycle the views that inbound
+	// packets are read into, instead of allocating new ones for every
+	// packet. It must have been created by NewBufferPool, and may be
+	// shared by several endpoints. It is not used by the PacketMMap
+	// dispatch mode.
+	BufferPool *buffer.Pool
+}
+
+// NewBufferPool creates a pool for Options.BufferPool, keeping up to capacity
+// free views of each size in BufConfig, and of the views added to it for jumbo
+// frames.
+func NewBufferPool(capacity int) *buffer.Pool {
+	return buffer.NewPool(append(append([]int(nil), BufConfig...), jumboBufSize), capacity)
 }
 
 // New creates a new fd-based endpoint.
@@ -163,6 +220,8 @@ func New(opts *Options) tcpip.LinkEndpointID {
 		addr:               opts.Address,
 		hdrSize:            hdrSize,
 		packetDispatchMode: opts.PacketDispatchMode,
+		pool:               opts.BufferPool,
+		bufConfig:          bufConfigFor(int(opts.MTU) + hdrSize),
 	}
 
 	if isSocketFD(opts.FD) && e.packetDispatchMode == PacketMMap {
@@ -186,17 +245,19 @@ func New(opts *Options) tcpip.LinkEndpointID {
 
 	e.views = make([][]buffer.View, msgsPerRecv)
 	for i, _ := range e.views {
-		e.views[i] = make([]buffer.View, len(BufConfig))
+		e.views[i] = make([]buffer.View, len(e.bufConfig))
 	}
 	e.iovecs = make([][]syscall.Iovec, msgsPerRecv)
 	for i, _ := range e.iovecs {
-		e.iovecs[i] = make([]syscall.Iovec, len(BufConfig))
+		e.iovecs[i] = make([]syscall.Iovec, len(e.bufConfig))
 	}
 	e.msgHdrs = make([]rawfile.MMsgHdr, msgsPerRecv)
 	for i, _ := range e.msgHdrs {
 		e.msgHdrs[i].Msg.Iov = &e.iovecs[i][0]
-		e.msgHdrs[i].Msg.Iovlen = uint64(len(BufConfig))
+		e.msgHdrs[i].Msg.Iovlen = uint64(len(e.bufConfig))
 	}
+	e.batch = make([]stack.InboundPacket, 0, msgsPerRecv)
+	e.batchUsed = make([]int, msgsPerRecv)
 
 	return stack.RegisterLinkEndpoint(e)
 }
@@ -226,9 +287,30 @@ func (e *endpoint) IsAttached() bool {
 }
 
 // MTU implements stack.LinkEndpoint.MTU. It returns the value initialized
-// during construction.
+// during construction, or the one last set with SetMTU.
 func (e *endpoint) MTU() uint32 {
-	return e.mtu
+	return atomic.LoadUint32(&e.mtu)
+}
+
+// SetMTU implements stack.MTUSettableLinkEndpoint.SetMTU. It only changes the
+// MTU seen by the stack; the MTU of the host device, if any, must be changed
+// separately. The receive buffers are sized when the endpoint is created, so
+// the MTU can't grow beyond what they hold.
+func (e *endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	if mtu == 0 {
+		return tcpip.ErrInvalidOptionValue
+	}
+	if e.views != nil {
+		size := 0
+		for _, s := range e.bufConfig {
+			size += s
+		}
+		if int(mtu)+e.hdrSize > size {
+			return tcpip.ErrInvalidOptionValue
+		}
+	}
+	atomic.StoreUint32(&e.mtu, mtu)
+	return nil
 }
 
 // Capabilities implements stack.LinkEndpoint.Capabilities.
@@ -248,10 +330,10 @@ func (e *endpoint) LinkAddress() tcpip.LinkAddress {
 
 // WritePacket writes outbound packets to the file descriptor. If it is not
 // currently writable, the packet is dropped.
-func (e *endpoint) WritePacket(r *stack.Route, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+func (e *endpoint) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
 	if e.hdrSize > 0 {
 		// Add ethernet header if needed.
-		eth := header.Ethernet(hdr.Prepend(header.EthernetMinimumSize))
+		eth := header.Ethernet(pkt.Header.Prepend(header.EthernetMinimumSize))
 		ethHdr := &header.EthernetFields{
 			DstAddr: r.RemoteLinkAddress,
 			Type:    protocol,
@@ -266,11 +348,32 @@ func (e *endpoint) WritePacket(r *stack.Route, hdr buffer.Prependable, payload b
 		eth.Encode(ethHdr)
 	}
 
-	if payload.Size() == 0 {
-		return rawfile.NonBlockingWrite(e.fd, hdr.View())
+	data := pkt.Data.ToView()
+	if e.hdrSize > 0 {
+		data = padFrame(pkt.Header.UsedLength(), data)
+	}
+
+	var err *tcpip.Error
+	if len(data) == 0 {
+		err = rawfile.NonBlockingWrite(e.fd, pkt.Header.View())
+	} else {
+		err = rawfile.NonBlockingWrite2(e.fd, pkt.Header.View(), data)
 	}
+	e.noteResult(err)
+	return err
+}
 
-	return rawfile.NonBlockingWrite2(e.fd, hdr.View(), payload.ToView())
+// padFrame returns payload padded with zeroes so that, once preceded by hdrLen
+// bytes of headers, it makes up an ethernet frame of at least the minimum
+// size. Some host drivers reject shorter frames.
+func padFrame(hdrLen int, payload buffer.View) buffer.View {
+	pad := header.EthernetMinimumFrameSize - hdrLen - len(payload)
+	if pad <= 0 {
+		return payload
+	}
+	// payload may be a view of the caller's packet, so never append to it in
+	// place.
+	return append(payload[:len(payload):len(payload)], make([]byte, pad)...)
 }
 
 // WriteRawPacket writes a raw packet directly to the file descriptor.
@@ -296,7 +399,12 @@ func (e *endpoint) allocateViews(bufConfig []int) {
 			if e.views[k][i] != nil {
 				break
 			}
-			b := buffer.NewView(bufConfig[i])
+			var b buffer.View
+			if e.pool != nil {
+				b = e.pool.Get(bufConfig[i])
+			} else {
+				b = buffer.NewView(bufConfig[i])
+			}
 			e.views[k][i] = b
 			e.iovecs[k][i] = syscall.Iovec{
 				Base: &b[0],
@@ -306,46 +414,120 @@ func (e *endpoint) allocateViews(bufConfig []int) {
 	}
 }
 
-// dispatch reads one packet from the file descriptor and dispatches it.
-func (e *endpoint) dispatch() (bool, *tcpip.Error) {
-	e.allocateViews(BufConfig)
+// deliver dispatches the packet of n bytes that was read into e.views[k], and
+// returns the number of views it used. Ownership of those views passes to the
+// stack.
+func (e *endpoint) deliver(k, n int, remote, local tcpip.LinkAddress, p tcpip.NetworkProtocolNumber) int {
+	if e.pool == nil {
+		used := e.capViews(k, n, e.bufConfig)
+		vv := buffer.NewVectorisedView(n, e.views[k][:used])
+		vv.TrimFront(e.hdrSize)
+		e.dispatcher.DeliverNetworkPacket(e, remote, local, p, vv)
+		return used
+	}
 
-	n, err := rawfile.BlockingReadv(e.fd, e.iovecs[0])
-	if err != nil {
-		return false, err
+	pkt, used := e.packet(k, n)
+	stack.DeliverPacketBuffer(e.dispatcher, e, remote, local, p, pkt)
+	pkt.DecRef()
+	return used
+}
+
+// packet wraps the packet of n bytes that was read into e.views[k] in a
+// PacketBuffer, and returns it along with the number of views it uses. If the
+// views aren't pooled, the packet refers to e.views[k], so it must be delivered
+// before the used views are released.
+func (e *endpoint) packet(k, n int) (*stack.PacketBuffer, int) {
+	if e.pool == nil {
+		used := e.capViews(k, n, e.bufConfig)
+		vv := buffer.NewVectorisedView(n, e.views[k][:used])
+		vv.TrimFront(e.hdrSize)
+		return stack.NewPacketBuffer(vv), used
 	}
 
-	if n <= e.hdrSize {
-		return false, nil
+	// The views must be returned to the pool whole, so they are capped in
+	// the packet rather than in e.views.
+	used, size := 0, 0
+	for size < n && used < len(e.bufConfig) {
+		size += len(e.views[k][used])
+		used++
 	}
+	pkt := stack.NewPooledPacketBuffer(buffer.NewVectorisedView(size, e.views[k][:used]), e.pool)
+	pkt.Data.CapLength(n)
+	pkt.Data.TrimFront(e.hdrSize)
+	return pkt, used
+}
 
-	var (
-		p             tcpip.NetworkProtocolNumber
-		remote, local tcpip.LinkAddress
-	)
-	if e.hdrSize > 0 {
-		eth := header.Ethernet(e.views[0][0])
-		p = eth.Type()
-		remote = eth.SourceAddress()
-		local = eth.DestinationAddress()
-	} else {
+// deliverBatch delivers the packets in e.batch, and releases the views they
+// used, as recorded in e.batchUsed.
+func (e *endpoint) deliverBatch() {
+	if len(e.batch) == 0 {
+		return
+	}
+	stack.DeliverPacketBatch(e.dispatcher, e, e.batch)
+	for k := range e.batch {
+		e.batch[k].Pkt.DecRef()
+		e.batch[k] = stack.InboundPacket{}
+	}
+	e.batch = e.batch[:0]
+
+	// Prepare e.views for other packets: release used views. Frames that
+	// were dropped didn't use any.
+	for k, used := range e.batchUsed {
+		for i := 0; i < used; i++ {
+			e.views[k][i] = nil
+		}
+		e.batchUsed[k] = 0
+	}
+}
+
+// parseHeader parses the link-layer header of the frame of n bytes whose first
+// view is first. It returns the frame's network protocol and link addresses,
+// along with its size once any ethernet padding is removed. ok is false if the
+// frame must be dropped; malformed frames are reported to the dispatcher.
+func (e *endpoint) parseHeader(first buffer.View, n int) (p tcpip.NetworkProtocolNumber, remote, local tcpip.LinkAddress, size int, ok bool) {
+	if e.hdrSize == 0 {
 		// We don't get any indication of what the packet is, so try to guess
 		// if it's an IPv4 or IPv6 packet.
-		switch header.IPVersion(e.views[0][0]) {
+		switch header.IPVersion(first) {
 		case header.IPv4Version:
-			p = header.IPv4ProtocolNumber
+			return header.IPv4ProtocolNumber, "", "", n, true
 		case header.IPv6Version:
-			p = header.IPv6ProtocolNumber
+			return header.IPv6ProtocolNumber, "", "", n, true
 		default:
-			return true, nil
+			return 0, "", "", 0, false
 		}
 	}
 
-	used := e.capViews(0, n, BufConfig)
-	vv := buffer.NewVectorisedView(n, e.views[0][:used])
-	vv.TrimFront(e.hdrSize)
+	if n < len(first) {
+		first = first[:n]
+	}
+	eth := header.Ethernet(first)
+	if !eth.IsValid(n) {
+		stack.DeliverLinkDrop(e.dispatcher, tcpip.DropMalformed, first.ToVectorisedView())
+		return 0, "", "", 0, false
+	}
+	return eth.Type(), eth.SourceAddress(), eth.DestinationAddress(), eth.UnpaddedSize(n), true
+}
+
+// dispatch reads one packet from the file descriptor and dispatches it.
+func (e *endpoint) dispatch() (bool, *tcpip.Error) {
+	e.allocateViews(e.bufConfig)
+
+	n, err := rawfile.BlockingReadv(e.fd, e.iovecs[0])
+	if err != nil {
+		return false, err
+	}
+
+	if n == 0 {
+		return false, nil
+	}
 
-	e.dispatcher.DeliverNetworkPacket(e, remote, local, p, vv)
+	p, remote, local, n, ok := e.parseHeader(e.views[0][0], n)
+	if !ok {
+		return true, nil
+	}
+
+	used := e.deliver(0, n, remote, local, p)
 
 	// Prepare e.views for another packet: release used views.
 	for i := 0; i < used; i++ {
@@ -358,50 +540,33 @@ func (e *endpoint) dispatch() (bool, *tcpip.Error) {
 // recvMMsgDispatch reads more than one packet at a time from the file
 // descriptor and dispatches it.
 func (e *endpoint) recvMMsgDispatch() (bool, *tcpip.Error) {
-	e.allocateViews(BufConfig)
+	e.allocateViews(e.bufConfig)
 
 	nMsgs, err := rawfile.BlockingRecvMMsg(e.fd, e.msgHdrs)
 	if err != nil {
 		return false, err
 	}
-	// Process each of received packets.
+	// Process each of received packets, and deliver them all at once.
+	defer e.deliverBatch()
 	for k := 0; k < nMsgs; k++ {
-		n := e.msgHdrs[k].Len
-		if n <= uint32(e.hdrSize) {
+		n := int(e.msgHdrs[k].Len)
+		if n == 0 {
 			return false, nil
 		}
 
-		var (
-			p             tcpip.NetworkProtocolNumber
-			remote, local tcpip.LinkAddress
-		)
-		if e.hdrSize > 0 {
-			eth := header.Ethernet(e.views[k][0])
-			p = eth.Type()
-			remote = eth.SourceAddress()
-			local = eth.DestinationAddress()
-		} else {
-			// We don't get any indication of what the packet is, so try to guess
-			// if it's an IPv4 or IPv6 packet.
-			switch header.IPVersion(e.views[k][0]) {
-			case header.IPv4Version:
-				p = header.IPv4ProtocolNumber
-			case header.IPv6Version:
-				p = header.IPv6ProtocolNumber
-			default:
-				return true, nil
-			}
+		p, remote, local, n, ok := e.parseHeader(e.views[k][0], n)
+		if !ok {
+			continue
 		}
 
-		used := e.capViews(k, int(n), BufConfig)
-		vv := buffer.NewVectorisedView(int(n), e.views[k][:used])
-		vv.TrimFront(e.hdrSize)
-		e.dispatcher.DeliverNetworkPacket(e, remote, local, p, vv)
-
-		// Prepare e.views for another packet: release used views.
-		for i := 0; i < used; i++ {
-			e.views[k][i] = nil
-		}
+		pkt, used := e.packet(k, n)
+		e.batch = append(e.batch, stack.InboundPacket{
+			Remote:   remote,
+			Local:    local,
+			Protocol: p,
+			Pkt:      pkt,
+		})
+		e.batchUsed[k] = used
 	}
 
 	for k := 0; k < nMsgs; k++ {
@@ -411,11 +576,69 @@ func (e *endpoint) recvMMsgDispatch() (bool, *tcpip.Error) {
 	return true, nil
 }
 
+// setLinkState records the carrier state of the host link and reports it to
+// the dispatcher if it changed.
+func (e *endpoint) setLinkState(up bool) {
+	var down uint32
+	if !up {
+		down = 1
+	}
+	if atomic.SwapUint32(&e.linkDown, down) != down {
+		stack.DeliverLinkState(e.dispatcher, up)
+	}
+}
+
+// noteResult translates the result of a read from or write to the file
+// descriptor into a carrier state. The host reports ENETDOWN when the
+// underlying interface loses carrier or is brought down, and any successful
+// operation means that it is back up.
+func (e *endpoint) noteResult(err *tcpip.Error) {
+	switch {
+	case err == tcpip.ErrNetworkDown:
+		e.setLinkState(false)
+	case err == nil && atomic.LoadUint32(&e.linkDown) != 0:
+		e.setLinkState(true)
+	}
+}
+
+// Bounds of the time dispatchLoop waits between reads while the host reports
+// that the link is down.
+const (
+	minLinkDownBackoff = time.Millisecond
+	maxLinkDownBackoff = 500 * time.Millisecond
+)
+
+// linkDownBackoff returns the time to wait before the next read after one more
+// read failed because the link is down, given the time waited after the
+// previous one, 0 if it succeeded.
+func linkDownBackoff(prev time.Duration) time.Duration {
+	switch {
+	case prev < minLinkDownBackoff:
+		return minLinkDownBackoff
+	case prev >= maxLinkDownBackoff/2:
+		return maxLinkDownBackoff
+	default:
+		return 2 * prev
+	}
+}
+
 // dispatchLoop reads packets from the file descriptor in a loop and dispatches
 // them to the network stack.
 func (e *endpoint) dispatchLoop() *tcpip.Error {
+	var backoff time.Duration
 	for {
 		cont, err := e.inboundDispatcher()
+		e.noteResult(err)
+		if err == tcpip.ErrNetworkDown {
+			// The host fails reads for as long as the link is down,
+			// and the file descriptor stays readable. Keep reading
+			// so that the link is seen again once it comes back up,
+			// but back off instead of spinning until then.
+			backoff = linkDownBackoff(backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
 		if err != nil || !cont {
 			if e.closed != nil {
 				e.closed(err)
@@ -12,6 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build linux
 // +build linux
 
 package fdbased
@@ -46,14 +47,25 @@ type packetInfo struct {
 }
 
 type context struct {
-	t    *testing.T
-	fds  [2]int
-	ep   stack.LinkEndpoint
-	ch   chan packetInfo
-	done chan struct{}
+	t     *testing.T
+	fds   [2]int
+	ep    stack.LinkEndpoint
+	ch    chan packetInfo
+	drops chan tcpip.DropReason
+	done  chan struct{}
+
+	// packetBuffers is whether the context takes the PacketBuffers
+	// delivered by the endpoint, rather than their data.
+	packetBuffers bool
 }
 
 func newContext(t *testing.T, opt *Options) *context {
+	return newContextWithPacketBuffers(t, opt, false)
+}
+
+// newContextWithPacketBuffers is like newContext, but sets whether the context
+// takes PacketBuffers.
+func newContextWithPacketBuffers(t *testing.T, opt *Options, packetBuffers bool) *context {
 	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
 	if err != nil {
 		t.Fatalf("Socketpair failed: %v", err)
@@ -68,11 +80,14 @@ func newContext(t *testing.T, opt *Options) *context {
 	ep := stack.FindLinkEndpoint(New(opt)).(*endpoint)
 
 	c := &context{
-		t:    t,
-		fds:  fds,
-		ep:   ep,
-		ch:   make(chan packetInfo, 100),
-		done: done,
+		t:     t,
+		fds:   fds,
+		ep:    ep,
+		ch:    make(chan packetInfo, 100),
+		drops: make(chan tcpip.DropReason, 100),
+		done:  done,
+
+		packetBuffers: packetBuffers,
 	}
 
 	ep.Attach(c)
@@ -86,10 +101,25 @@ func (c *context) cleanup() {
 	syscall.Close(c.fds[1])
 }
 
+// DeliverPacketBuffer implements stack.PacketBufferDispatcher. Unless
+// c.packetBuffers is set, the packet is delivered as a dispatcher that doesn't
+// take PacketBuffers would get it.
+func (c *context) DeliverPacketBuffer(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	if !c.packetBuffers {
+		c.DeliverNetworkPacket(linkEP, remote, local, protocol, pkt.OwnedData(nil))
+		return
+	}
+	c.ch <- packetInfo{remote, protocol, append(buffer.View(nil), pkt.Data.ToView()...)}
+}
+
 func (c *context) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote tcpip.LinkAddress, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
 	c.ch <- packetInfo{remote, protocol, vv.ToView()}
 }
 
+func (c *context) DeliverLinkDrop(reason tcpip.DropReason, frame buffer.VectorisedView) {
+	c.drops <- reason
+}
+
 func TestNoEthernetProperties(t *testing.T) {
 	c := newContext(t, &Options{MTU: mtu})
 	defer c.cleanup()
@@ -157,7 +187,7 @@ func TestWritePacket(t *testing.T) {
 					payload[i] = uint8(rand.Intn(256))
 				}
 				want := append(hdr.View(), payload...)
-				if err := c.ep.WritePacket(r, hdr, payload.ToVectorisedView(), proto); err != nil {
+				if err := c.ep.WritePacket(r, stack.NewOutboundPacketBuffer(hdr, payload.ToVectorisedView()), proto); err != nil {
 					t.Fatalf("WritePacket failed: %v", err)
 				}
 
@@ -195,6 +225,105 @@ func TestWritePacket(t *testing.T) {
 	}
 }
 
+func TestWritePacketPadding(t *testing.T) {
+	c := newContext(t, &Options{Address: laddr, MTU: mtu, EthernetHeader: true})
+	defer c.cleanup()
+
+	r := &stack.Route{
+		RemoteLinkAddress: raddr,
+	}
+
+	hdr := buffer.NewPrependable(int(c.ep.MaxHeaderLength()) + 20)
+	copy(hdr.Prepend(20), bytes.Repeat([]byte{0xff}, 20))
+	payload := buffer.View{1, 2, 3}
+	if err := c.ep.WritePacket(r, stack.NewOutboundPacketBuffer(hdr, payload.ToVectorisedView()), header.IPv4ProtocolNumber); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+
+	b := make([]byte, mtu)
+	n, err := syscall.Read(c.fds[0], b)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if n != header.EthernetMinimumFrameSize {
+		t.Fatalf("Read returned %v bytes, want %v", n, header.EthernetMinimumFrameSize)
+	}
+	want := append(bytes.Repeat([]byte{0xff}, 20), 1, 2, 3)
+	want = append(want, make([]byte, n-header.EthernetMinimumSize-len(want))...)
+	if got := b[header.EthernetMinimumSize:n]; !bytes.Equal(got, want) {
+		t.Fatalf("Read returned payload %x, want %x", got, want)
+	}
+
+	// The caller's payload must be left untouched.
+	if want := (buffer.View{1, 2, 3}); !bytes.Equal(payload, want) {
+		t.Fatalf("payload = %x, want %x", payload, want)
+	}
+}
+
+func TestDeliverPaddedPacket(t *testing.T) {
+	c := newContext(t, &Options{Address: laddr, MTU: mtu, EthernetHeader: true})
+	defer c.cleanup()
+
+	// Build a 28-byte IPv4 packet, padded to the minimum frame size.
+	frame := make([]byte, header.EthernetMinimumFrameSize)
+	header.Ethernet(frame).Encode(&header.EthernetFields{
+		SrcAddr: raddr,
+		DstAddr: laddr,
+		Type:    header.IPv4ProtocolNumber,
+	})
+	ip := header.IPv4(frame[header.EthernetMinimumSize:])
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: 28,
+	})
+
+	if _, err := syscall.Write(c.fds[0], frame); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	select {
+	case pi := <-c.ch:
+		want := packetInfo{
+			raddr:    raddr,
+			proto:    header.IPv4ProtocolNumber,
+			contents: buffer.View(ip[:28]),
+		}
+		if !reflect.DeepEqual(want, pi) {
+			t.Fatalf("Unexpected received packet: %+v, want %+v", pi, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for packet")
+	}
+}
+
+func TestDropMalformedFrame(t *testing.T) {
+	c := newContext(t, &Options{Address: laddr, MTU: mtu, EthernetHeader: true})
+	defer c.cleanup()
+
+	// The ethertype holds neither a protocol number nor a valid length.
+	frame := make([]byte, 100)
+	header.Ethernet(frame).Encode(&header.EthernetFields{
+		SrcAddr: raddr,
+		DstAddr: laddr,
+		Type:    header.EthernetMaximumLength + 1,
+	})
+
+	if _, err := syscall.Write(c.fds[0], frame); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	select {
+	case reason := <-c.drops:
+		if reason != tcpip.DropMalformed {
+			t.Fatalf("got drop reason = %v, want = %v", reason, tcpip.DropMalformed)
+		}
+	case pi := <-c.ch:
+		t.Fatalf("Unexpected received packet: %+v", pi)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for drop")
+	}
+}
+
 func TestPreserveSrcAddress(t *testing.T) {
 	baddr := tcpip.LinkAddress("\xcc\xbb\xaa\x77\x88\x99")
 
@@ -210,7 +339,7 @@ func TestPreserveSrcAddress(t *testing.T) {
 	// WritePacket panics given a prependable with anything less than
 	// the minimum size of the ethernet header.
 	hdr := buffer.NewPrependable(header.EthernetMinimumSize)
-	if err := c.ep.WritePacket(r, hdr, buffer.VectorisedView{}, proto); err != nil {
+	if err := c.ep.WritePacket(r, stack.NewOutboundPacketBuffer(hdr, buffer.VectorisedView{}), proto); err != nil {
 		t.Fatalf("WritePacket failed: %v", err)
 	}
 
@@ -286,6 +415,106 @@ func TestDeliverPacket(t *testing.T) {
 	}
 }
 
+func TestDeliverPacketPooled(t *testing.T) {
+	pool := NewBufferPool(len(BufConfig))
+	c := newContextWithPacketBuffers(t, &Options{MTU: mtu, BufferPool: pool}, true)
+	defer c.cleanup()
+
+	const packets = 3
+	for i := 0; i < packets; i++ {
+		b := make([]byte, 1000)
+		for j := range b {
+			b[j] = uint8(rand.Intn(256))
+		}
+		// So that it looks like an IPv4 packet.
+		b[0] = 0x40
+
+		if _, err := syscall.Write(c.fds[0], b); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		select {
+		case pi := <-c.ch:
+			if !bytes.Equal(pi.contents, b) {
+				t.Fatalf("got packet %d = %x, want %x", i, pi.contents, b)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for packet %d", i)
+		}
+	}
+
+	// A 1000 byte packet is read into the first 4 views, which are
+	// recycled for the next read once the packet has been delivered.
+	if got, want := pool.Stats().Hits, uint64(4*(packets-1)); got < want {
+		t.Errorf("got %d pool hits, want at least %d", got, want)
+	}
+}
+
+// batchDispatcher is a stack.BatchDispatcher that records the batches it is
+// handed.
+type batchDispatcher struct {
+	batches chan []buffer.View
+}
+
+func (d *batchDispatcher) DeliverNetworkPacket(stack.LinkEndpoint, tcpip.LinkAddress, tcpip.LinkAddress, tcpip.NetworkProtocolNumber, buffer.VectorisedView) {
+	panic("packet delivered outside of a batch")
+}
+
+func (d *batchDispatcher) DeliverPacketBatch(linkEP stack.LinkEndpoint, pkts []stack.InboundPacket) {
+	var b []buffer.View
+	for _, p := range pkts {
+		b = append(b, p.Pkt.Data.ToView())
+	}
+	d.batches <- b
+}
+
+func TestDeliverPacketBatch(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair failed: %v", err)
+	}
+	defer syscall.Close(fds[1])
+
+	// Queue the packets before the endpoint starts reading, so that they
+	// are all read by a single recvmmsg() call.
+	var want []buffer.View
+	for i := 0; i < 3; i++ {
+		b := make([]byte, 100+i)
+		for j := range b {
+			b[j] = uint8(rand.Intn(256))
+		}
+		// So that it looks like an IPv4 packet.
+		b[0] = 0x40
+		if _, err := syscall.Write(fds[0], b); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		want = append(want, b)
+	}
+
+	done := make(chan struct{})
+	ep := stack.FindLinkEndpoint(New(&Options{
+		FD:                 fds[1],
+		MTU:                mtu,
+		ClosedFunc:         func(*tcpip.Error) { close(done) },
+		PacketDispatchMode: RecvMMsg,
+	}))
+	d := &batchDispatcher{batches: make(chan []buffer.View, 1)}
+	ep.Attach(d)
+	defer func() {
+		syscall.Close(fds[0])
+		<-done
+	}()
+
+	select {
+	case got := <-d.batches:
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got batch %x, want %x", got, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for packets")
+	}
+}
+
 func TestBufConfigMaxLength(t *testing.T) {
 	got := 0
 	for _, i := range BufConfig {
@@ -384,3 +613,62 @@ func TestCapLength(t *testing.T) {
 
 	}
 }
+
+type linkStateDispatcher struct {
+	context
+	states []bool
+}
+
+func (d *linkStateDispatcher) DeliverLinkState(up bool) {
+	d.states = append(d.states, up)
+}
+
+func TestLinkState(t *testing.T) {
+	d := &linkStateDispatcher{}
+	e := &endpoint{dispatcher: d}
+
+	// Only changes in the carrier state are reported.
+	for _, err := range []*tcpip.Error{nil, tcpip.ErrNetworkDown, tcpip.ErrNetworkDown, tcpip.ErrWouldBlock, nil, nil} {
+		e.noteResult(err)
+	}
+
+	if want := []bool{false, true}; !reflect.DeepEqual(d.states, want) {
+		t.Fatalf("got link states = %v, want = %v", d.states, want)
+	}
+}
+
+func TestLinkDownBackoff(t *testing.T) {
+	var got []time.Duration
+	for d := time.Duration(0); d != maxLinkDownBackoff; {
+		d = linkDownBackoff(d)
+		got = append(got, d)
+	}
+	want := []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 8 * time.Millisecond, 16 * time.Millisecond, 32 * time.Millisecond, 64 * time.Millisecond, 128 * time.Millisecond, 256 * time.Millisecond, maxLinkDownBackoff}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got backoffs = %v, want = %v", got, want)
+	}
+}
+
+func TestDispatchLoopLinkDown(t *testing.T) {
+	d := &linkStateDispatcher{}
+	e := &endpoint{dispatcher: d}
+
+	// The loop waits between the reads failing while the link is down,
+	// and stops once the dispatcher is done.
+	results := []*tcpip.Error{tcpip.ErrNetworkDown, tcpip.ErrNetworkDown, tcpip.ErrNetworkDown, nil}
+	e.inboundDispatcher = func() (bool, *tcpip.Error) {
+		err := results[0]
+		results = results[1:]
+		return len(results) != 0, err
+	}
+	start := time.Now()
+	if err := e.dispatchLoop(); err != nil {
+		t.Fatalf("dispatchLoop failed: %v", err)
+	}
+	if got, want := time.Since(start), 7*time.Millisecond; got < want {
+		t.Errorf("dispatchLoop returned after %v, want at least %v", got, want)
+	}
+	if want := []bool{false, true}; !reflect.DeepEqual(d.states, want) {
+		t.Fatalf("got link states = %v, want = %v", d.states, want)
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mirror provides the implementation of data-link layer endpoints that
+// wrap another endpoint and copy the packets flowing through it, inbound,
+// outbound or both, to a secondary consumer endpoint, e.g. a TAP device read by
+// an intrusion detection system or a packet capture tool.
+//
+// Copies are handed to the consumer from a dedicated goroutine through a
+// bounded queue. When the consumer can't keep up, copies are dropped and
+// counted, so that mirroring never stalls the main path.
+//
+// Mirror endpoints can be used in the networking stack by calling
+// New(eID, consumerID, opts) to create a new endpoint, where eID is the ID of
+// the endpoint being wrapped and consumerID is the ID of the consumer, and
+// then passing it as an argument to Stack.CreateNIC(). The consumer is never
+// attached to a dispatcher; it is only written to.
+package mirror
+
+import (
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// Direction selects the packets that are mirrored.
+type Direction int
+
+const (
+	// Ingress mirrors the packets received by the wrapped endpoint.
+	Ingress Direction = 1 << iota
+
+	// Egress mirrors the packets written to the wrapped endpoint.
+	Egress
+
+	// Both mirrors the packets received by and written to the wrapped
+	// endpoint.
+	Both = Ingress | Egress
+)
+
+const defaultQueueLen = 256
+
+// Options configures a mirror endpoint.
+type Options struct {
+	// Direction selects the packets that are mirrored. If zero, Both is
+	// used.
+	Direction Direction
+
+	// QueueLen is the number of copies that may be waiting to be written
+	// to the consumer. Copies made when the queue is full are dropped. If
+	// zero, 256 is used.
+	QueueLen int
+}
+
+// Stats holds mirroring statistics.
+type Stats struct {
+	// Mirrored is the number of copies written to the consumer.
+	Mirrored *tcpip.StatCounter
+
+	// Dropped is the number of copies dropped because the queue was full
+	// or the endpoint was closed.
+	Dropped *tcpip.StatCounter
+
+	// WriteErrors is the number of copies the consumer failed to write.
+	WriteErrors *tcpip.StatCounter
+}
+
+// packet is a copy of a mirrored packet, along with the link addresses of the
+// frame that carried it.
+type packet struct {
+	remote   tcpip.LinkAddress
+	local    tcpip.LinkAddress
+	protocol tcpip.NetworkProtocolNumber
+	pkt      *stack.PacketBuffer
+}
+
+// Endpoint is a link-layer endpoint that passes packets through to the
+// endpoint it wraps unmodified, and writes copies of them to a consumer
+// endpoint.
+type Endpoint struct {
+	dispatcher stack.NetworkDispatcher
+	lower      stack.LinkEndpoint
+	consumer   stack.LinkEndpoint
+	direction  Direction
+
+	// Stats are the mirroring counters of the endpoint.
+	Stats Stats
+
+	queue chan packet
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	closeMu  sync.RWMutex
+	isClosed bool
+}
+
+// New creates a new mirror link-layer endpoint wrapping the endpoint with the
+// given ID and mirroring to the consumer endpoint with the given ID, and
+// starts the goroutine that writes to the consumer.
+func New(lower, consumer tcpip.LinkEndpointID, opts Options) (tcpip.LinkEndpointID, *Endpoint) {
+	if opts.Direction == 0 {
+		opts.Direction = Both
+	}
+	if opts.QueueLen <= 0 {
+		opts.QueueLen = defaultQueueLen
+	}
+	e := &Endpoint{
+		lower:     stack.FindLinkEndpoint(lower),
+		consumer:  stack.FindLinkEndpoint(consumer),
+		direction: opts.Direction,
+		queue:     make(chan packet, opts.QueueLen),
+		done:      make(chan struct{}),
+		Stats: Stats{
+			Mirrored:    &tcpip.StatCounter{},
+			Dropped:     &tcpip.StatCounter{},
+			WriteErrors: &tcpip.StatCounter{},
+		},
+	}
+	e.wg.Add(1)
+	go e.mirrorLoop()
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// Close stops the goroutine writing to the consumer. Copies still queued are
+// dropped, as are copies of packets that flow through the endpoint afterwards;
+// the packets themselves still reach their destination.
+func (e *Endpoint) Close() {
+	e.closeMu.Lock()
+	if !e.isClosed {
+		e.isClosed = true
+		close(e.done)
+	}
+	e.closeMu.Unlock()
+	e.wg.Wait()
+
+	for {
+		select {
+		case p := <-e.queue:
+			p.pkt.DecRef()
+			e.Stats.Dropped.Increment()
+		default:
+			return
+		}
+	}
+}
+
+// mirrorLoop writes queued copies to the consumer until the endpoint is
+// closed.
+func (e *Endpoint) mirrorLoop() {
+	defer e.wg.Done()
+	for {
+		select {
+		case p := <-e.queue:
+			r := stack.Route{
+				RemoteLinkAddress: p.remote,
+				LocalLinkAddress:  p.local,
+			}
+			if err := e.consumer.WritePacket(&r, p.pkt, p.protocol); err != nil {
+				e.Stats.WriteErrors.Increment()
+			} else {
+				e.Stats.Mirrored.Increment()
+			}
+			p.pkt.DecRef()
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// mirror queues a copy of a packet for the consumer. src and dst are the
+// source and destination link addresses of the frame carrying it, and become
+// the local and remote addresses of the copy, so that the consumer sees the
+// frame as it was on the wire.
+func (e *Endpoint) mirror(src, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, hdr buffer.View, payload buffer.VectorisedView) {
+	e.closeMu.RLock()
+	defer e.closeMu.RUnlock()
+	if e.isClosed || len(e.queue) == cap(e.queue) {
+		e.Stats.Dropped.Increment()
+		return
+	}
+
+	// The caller retains ownership of the packet, so it must be copied.
+	h := buffer.NewPrependable(len(hdr) + int(e.consumer.MaxHeaderLength()))
+	copy(h.Prepend(len(hdr)), hdr)
+	var data buffer.VectorisedView
+	if payload.Size() != 0 {
+		data = payload.ToView().ToVectorisedView()
+	}
+	p := packet{
+		remote:   dst,
+		local:    src,
+		protocol: protocol,
+		pkt:      stack.NewOutboundPacketBuffer(h, data),
+	}
+	select {
+	case e.queue <- p:
+	default:
+		p.pkt.DecRef()
+		e.Stats.Dropped.Increment()
+	}
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.DeliverNetworkPacket.
+// It mirrors the packet if ingress mirroring is enabled, then delivers it to
+// the actual dispatcher.
+func (e *Endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	if e.direction&Ingress != 0 {
+		e.mirror(remote, local, protocol, nil, vv)
+	}
+	e.dispatcher.DeliverNetworkPacket(e, remote, local, protocol, vv)
+}
+
+// DeliverLinkState implements stack.LinkStateDispatcher.DeliverLinkState. It
+// just forwards the carrier change to the actual dispatcher.
+func (e *Endpoint) DeliverLinkState(up bool) {
+	stack.DeliverLinkState(e.dispatcher, up)
+}
+
+// DeliverLinkDrop implements stack.LinkDropDispatcher.DeliverLinkDrop. It
+// just forwards the dropped frame to the actual dispatcher.
+func (e *Endpoint) DeliverLinkDrop(reason tcpip.DropReason, frame buffer.VectorisedView) {
+	stack.DeliverLinkDrop(e.dispatcher, reason, frame)
+}
+
+// Attach implements stack.LinkEndpoint.Attach. It saves the dispatcher and
+// registers with the lower endpoint as its dispatcher so that "e" is called
+// for inbound packets.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.lower.Attach(e)
+}
+
+// IsAttached implements stack.LinkEndpoint.IsAttached.
+func (e *Endpoint) IsAttached() bool {
+	return e.dispatcher != nil
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It just forwards the request to the
+// lower endpoint.
+func (e *Endpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+// SetMTU implements stack.MTUSettableLinkEndpoint.SetMTU. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	return stack.SetLinkMTU(e.lower, mtu)
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. It just
+// forwards the request to the lower endpoint.
+func (e *Endpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+// LinkAddress implements stack.LinkEndpoint.LinkAddress. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
+	return e.lower.LinkAddress()
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. It mirrors the packet
+// if egress mirroring is enabled, then writes it to the lower endpoint.
+func (e *Endpoint) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	if e.direction&Egress != 0 {
+		src := r.LocalLinkAddress
+		if src == "" {
+			src = e.lower.LinkAddress()
+		}
+		e.mirror(src, r.RemoteLinkAddress, protocol, pkt.Header.View(), pkt.Data)
+	}
+	return e.lower.WritePacket(r, pkt, protocol)
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mirror
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	lowerAddr  = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	remoteAddr = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+)
+
+// copyInfo is a copy written to a consumer.
+type copyInfo struct {
+	remote, local tcpip.LinkAddress
+	packet        buffer.View
+}
+
+// consumer is a link endpoint that records the copies written to it. Writes
+// block until release is closed, if it is set.
+type consumer struct {
+	*channel.Endpoint
+	copies  chan copyInfo
+	release chan struct{}
+}
+
+func newConsumer(release chan struct{}) (tcpip.LinkEndpointID, *consumer) {
+	_, ep := channel.New(1, 1500, "")
+	c := &consumer{
+		Endpoint: ep,
+		copies:   make(chan copyInfo, 100),
+		release:  release,
+	}
+	return stack.RegisterLinkEndpoint(c), c
+}
+
+func (c *consumer) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	if c.release != nil {
+		<-c.release
+	}
+	c.copies <- copyInfo{
+		remote: r.RemoteLinkAddress,
+		local:  r.LocalLinkAddress,
+		packet: append(pkt.Header.View(), pkt.Data.ToView()...),
+	}
+	return nil
+}
+
+func (c *consumer) next(t *testing.T) copyInfo {
+	t.Helper()
+	select {
+	case ci := <-c.copies:
+		return ci
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a copy")
+		return copyInfo{}
+	}
+}
+
+type dispatcher chan buffer.View
+
+func (d dispatcher) DeliverNetworkPacket(_ stack.LinkEndpoint, _, _ tcpip.LinkAddress, _ tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	d <- vv.ToView()
+}
+
+func TestMirrorBothDirections(t *testing.T) {
+	lowerID, lower := channel.New(10, 1500, lowerAddr)
+	consumerID, c := newConsumer(nil)
+	_, e := New(lowerID, consumerID, Options{})
+	defer e.Close()
+
+	d := make(dispatcher, 10)
+	e.Attach(d)
+
+	// Inbound packets reach both the dispatcher and the consumer, with the
+	// addresses of the original frame.
+	in := buffer.View("inbound")
+	lower.InjectLinkAddr(header.IPv4ProtocolNumber, remoteAddr, in.ToVectorisedView())
+	if got := <-d; !bytes.Equal(got, in) {
+		t.Fatalf("got delivered packet %q, want %q", got, in)
+	}
+	ci := c.next(t)
+	if !bytes.Equal(ci.packet, in) || ci.local != remoteAddr {
+		t.Fatalf("got copy %+v, want packet %q from %q", ci, in, remoteAddr)
+	}
+
+	// Outbound packets reach both the lower endpoint and the consumer.
+	hdr := buffer.NewPrependable(10)
+	copy(hdr.Prepend(3), "out")
+	r := &stack.Route{RemoteLinkAddress: remoteAddr}
+	if err := e.WritePacket(r, stack.NewOutboundPacketBuffer(hdr, buffer.View("bound").ToVectorisedView()), header.IPv4ProtocolNumber); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	p := <-lower.C
+	if got := append(p.Header, p.Payload...); string(got) != "outbound" {
+		t.Fatalf("got written packet %q, want %q", got, "outbound")
+	}
+	ci = c.next(t)
+	want := copyInfo{remote: remoteAddr, local: lowerAddr, packet: buffer.View("outbound")}
+	if !bytes.Equal(ci.packet, want.packet) || ci.remote != want.remote || ci.local != want.local {
+		t.Fatalf("got copy %+v, want %+v", ci, want)
+	}
+
+	if got := e.Stats.Mirrored.Value(); got != 2 {
+		t.Errorf("got %d packets mirrored, want 2", got)
+	}
+}
+
+func TestMirrorIngressOnly(t *testing.T) {
+	lowerID, lower := channel.New(10, 1500, lowerAddr)
+	consumerID, c := newConsumer(nil)
+	_, e := New(lowerID, consumerID, Options{Direction: Ingress})
+	defer e.Close()
+	e.Attach(make(dispatcher, 10))
+
+	hdr := buffer.NewPrependable(10)
+	copy(hdr.Prepend(3), "out")
+	if err := e.WritePacket(&stack.Route{}, stack.NewOutboundPacketBuffer(hdr, buffer.VectorisedView{}), header.IPv4ProtocolNumber); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	<-lower.C
+
+	lower.Inject(header.IPv4ProtocolNumber, buffer.View("in").ToVectorisedView())
+	if ci := c.next(t); string(ci.packet) != "in" {
+		t.Fatalf("got copy %q, want %q", ci.packet, "in")
+	}
+}
+
+func TestQueueFullDrops(t *testing.T) {
+	lowerID, lower := channel.New(10, 1500, lowerAddr)
+	release := make(chan struct{})
+	consumerID, _ := newConsumer(release)
+	_, e := New(lowerID, consumerID, Options{QueueLen: 1})
+	d := make(dispatcher, 10)
+	e.Attach(d)
+
+	// The consumer blocks, so that the queue fills up, but the main path
+	// must not.
+	for i := 0; i < 10; i++ {
+		lower.Inject(header.IPv4ProtocolNumber, buffer.View("in").ToVectorisedView())
+		<-d
+	}
+
+	// At most one copy is being written and one is queued.
+	if got := e.Stats.Dropped.Value(); got < 8 {
+		t.Errorf("got %d copies dropped, want at least 8", got)
+	}
+
+	close(release)
+	e.Close()
+	if got, want := e.Stats.Mirrored.Value()+e.Stats.Dropped.Value(), uint64(10); got != want {
+		t.Errorf("got %d copies mirrored or dropped, want %d", got, want)
+	}
+}
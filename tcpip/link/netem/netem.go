@@ -0,0 +1,402 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package netem provides the implementation of data-link layer endpoints that
+// wrap another endpoint and emulate an imperfect network on outbound packets,
+// in the spirit of Linux's netem queueing discipline: packets can be delayed
+// (with jitter), lost, duplicated and reordered.
+//
+// Netem endpoints can be used in the networking stack by calling New(eID, opts)
+// to create a new endpoint, where eID is the ID of the endpoint being wrapped,
+// and then passing it as an argument to Stack.CreateNIC(). They are mostly
+// useful to exercise transport protocols under adverse conditions in tests and
+// simulations.
+package netem
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// Distribution is the distribution of the jitter added to the delay of each
+// packet.
+type Distribution int
+
+const (
+	// Uniform jitter is uniformly distributed in [-Jitter, Jitter].
+	Uniform Distribution = iota
+
+	// Normal jitter is normally distributed with a standard deviation of
+	// Jitter.
+	Normal
+)
+
+// Options configures the impairments applied by a netem endpoint.
+// Probabilities are in the range [0, 1].
+type Options struct {
+	// Delay is the base delay added to every packet.
+	Delay time.Duration
+
+	// Jitter is the amount of random variation added to Delay, following
+	// Distribution. The resulting delay is never negative.
+	Jitter time.Duration
+
+	// Distribution is the distribution of the jitter.
+	Distribution Distribution
+
+	// Loss is the probability that a packet is silently dropped.
+	Loss float64
+
+	// Duplicate is the probability that a packet is sent twice.
+	Duplicate float64
+
+	// Reorder is the probability that a packet is held back and sent right
+	// after the packet that follows it, so that the two are swapped. It
+	// applies whether or not packets are delayed. Only one packet is held
+	// back at a time.
+	Reorder float64
+
+	// ReorderTimeout is how long a held back packet waits for a packet to
+	// follow it before being sent anyway. Zero means
+	// DefaultReorderTimeout.
+	ReorderTimeout time.Duration
+
+	// Seed seeds the random number generator, so that a given sequence of
+	// packets is always impaired in the same way.
+	Seed int64
+
+	// Clock is the clock delays are measured with, like the stack's one. If
+	// nil, the system clock is used.
+	Clock tcpip.Clock
+}
+
+// DefaultReorderTimeout is the default value of Options.ReorderTimeout.
+const DefaultReorderTimeout = 10 * time.Millisecond
+
+// Stats holds the number of packets affected by each impairment.
+type Stats struct {
+	Dropped    *tcpip.StatCounter
+	Duplicated *tcpip.StatCounter
+	Reordered  *tcpip.StatCounter
+	Delayed    *tcpip.StatCounter
+}
+
+// Endpoint is a link-layer endpoint that impairs outbound packets before
+// passing them to the endpoint it wraps. Inbound packets are delivered
+// unmodified.
+type Endpoint struct {
+	dispatcher stack.NetworkDispatcher
+	lower      stack.LinkEndpoint
+
+	// Stats are the impairment counters of the endpoint.
+	Stats Stats
+
+	mu   sync.Mutex
+	opts Options
+	rand *rand.Rand
+
+	// held is the packet held back to be sent after the next one, if any.
+	// It is protected by mu.
+	held *heldPacket
+
+	// pending tracks packets waiting for their delay to expire.
+	pending sync.WaitGroup
+}
+
+// New creates a new netem link-layer endpoint wrapping the endpoint with the
+// given ID.
+func New(lower tcpip.LinkEndpointID, opts Options) (tcpip.LinkEndpointID, *Endpoint) {
+	e := &Endpoint{
+		lower: stack.FindLinkEndpoint(lower),
+		opts:  opts,
+		rand:  rand.New(rand.NewSource(opts.Seed)),
+		Stats: Stats{
+			Dropped:    &tcpip.StatCounter{},
+			Duplicated: &tcpip.StatCounter{},
+			Reordered:  &tcpip.StatCounter{},
+			Delayed:    &tcpip.StatCounter{},
+		},
+	}
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// SetOptions replaces the impairments applied to subsequent packets. The
+// random number generator is reseeded with opts.Seed.
+func (e *Endpoint) SetOptions(opts Options) {
+	e.mu.Lock()
+	e.opts = opts
+	e.rand = rand.New(rand.NewSource(opts.Seed))
+	e.mu.Unlock()
+}
+
+// Options returns the impairments currently applied.
+func (e *Endpoint) Options() Options {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.opts
+}
+
+// Wait blocks until all delayed and held back packets have been passed to the
+// lower endpoint.
+func (e *Endpoint) Wait() {
+	e.pending.Wait()
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.DeliverNetworkPacket.
+func (e *Endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	e.dispatcher.DeliverNetworkPacket(e, remote, local, protocol, vv)
+}
+
+// DeliverLinkState implements stack.LinkStateDispatcher.DeliverLinkState. It
+// just forwards the carrier change to the actual dispatcher.
+func (e *Endpoint) DeliverLinkState(up bool) {
+	stack.DeliverLinkState(e.dispatcher, up)
+}
+
+// DeliverLinkDrop implements stack.LinkDropDispatcher.DeliverLinkDrop. It
+// just forwards the dropped frame to the actual dispatcher.
+func (e *Endpoint) DeliverLinkDrop(reason tcpip.DropReason, frame buffer.VectorisedView) {
+	stack.DeliverLinkDrop(e.dispatcher, reason, frame)
+}
+
+// Attach implements stack.LinkEndpoint.Attach. It saves the dispatcher and
+// registers with the lower endpoint as its dispatcher so that "e" is called
+// for inbound packets.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.lower.Attach(e)
+}
+
+// IsAttached implements stack.LinkEndpoint.IsAttached.
+func (e *Endpoint) IsAttached() bool {
+	return e.dispatcher != nil
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It just forwards the request to the
+// lower endpoint.
+func (e *Endpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+// SetMTU implements stack.MTUSettableLinkEndpoint.SetMTU. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	return stack.SetLinkMTU(e.lower, mtu)
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. It just
+// forwards the request to the lower endpoint.
+func (e *Endpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+// LinkAddress implements stack.LinkEndpoint.LinkAddress. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
+	return e.lower.LinkAddress()
+}
+
+// clockLocked returns the clock delays are measured with. e.mu must be held.
+func (e *Endpoint) clockLocked() tcpip.Clock {
+	if e.opts.Clock == nil {
+		return &tcpip.StdClock{}
+	}
+	return e.opts.Clock
+}
+
+// clock returns the clock delays are measured with.
+func (e *Endpoint) clock() tcpip.Clock {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.clockLocked()
+}
+
+// verdict is the fate of a single outbound packet.
+type verdict struct {
+	drop      bool
+	duplicate bool
+	reorder   bool
+	delay     time.Duration
+}
+
+// heldPacket is a packet held back to be sent after the next one.
+type heldPacket struct {
+	route    stack.Route
+	pkt      *stack.PacketBuffer
+	protocol tcpip.NetworkProtocolNumber
+
+	// copies is the number of times the packet is sent.
+	copies int
+
+	// timer sends the packet if no packet follows it in time.
+	timer tcpip.Timer
+}
+
+// decide draws the impairments for the next packet.
+func (e *Endpoint) decide() verdict {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	o := &e.opts
+	if o.Loss > 0 && e.rand.Float64() < o.Loss {
+		return verdict{drop: true}
+	}
+	v := verdict{
+		duplicate: o.Duplicate > 0 && e.rand.Float64() < o.Duplicate,
+		reorder:   o.Reorder > 0 && e.rand.Float64() < o.Reorder,
+	}
+	v.delay = o.Delay
+	if o.Jitter > 0 {
+		switch o.Distribution {
+		case Normal:
+			v.delay += time.Duration(e.rand.NormFloat64() * float64(o.Jitter))
+		default:
+			v.delay += time.Duration(e.rand.Int63n(2*int64(o.Jitter)+1)) - o.Jitter
+		}
+	}
+	if v.delay < 0 {
+		v.delay = 0
+	}
+	return v
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. Dropped packets are
+// reported as successfully written, as a lossy network would.
+func (e *Endpoint) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	v := e.decide()
+	if v.drop {
+		e.Stats.Dropped.Increment()
+		return nil
+	}
+
+	n := 1
+	if v.duplicate {
+		e.Stats.Duplicated.Increment()
+		n = 2
+	}
+
+	if v.reorder && e.holdBack(r, pkt, protocol, n) {
+		return nil
+	}
+	// A packet held back before this one is sent right after it.
+	held := e.takeHeld(nil)
+
+	if v.delay == 0 {
+		for i := 0; i < n; i++ {
+			if err := e.writeCopy(r, pkt, protocol, i < n-1); err != nil {
+				e.sendHeld(held)
+				return err
+			}
+		}
+		e.sendHeld(held)
+		return nil
+	}
+
+	// The caller may reuse the buffers and release the route as soon as we
+	// return, so hold on to copies.
+	e.Stats.Delayed.Increment()
+	route := r.Clone()
+	pkts := make([]*stack.PacketBuffer, n)
+	for i := range pkts {
+		pkts[i] = pkt.Clone()
+	}
+	e.pending.Add(1)
+	e.clock().AfterFunc(v.delay, func() {
+		for _, p := range pkts {
+			e.lower.WritePacket(&route, p, protocol)
+			p.DecRef()
+		}
+		route.Release()
+		e.sendHeld(held)
+		e.pending.Done()
+	})
+	return nil
+}
+
+// holdBack holds back a copy of a packet, to be sent n times after the next
+// packet, and returns true, unless a packet is already held back.
+func (e *Endpoint) holdBack(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber, n int) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.held != nil {
+		return false
+	}
+	e.Stats.Reordered.Increment()
+	h := &heldPacket{
+		route:    r.Clone(),
+		pkt:      pkt.Clone(),
+		protocol: protocol,
+		copies:   n,
+	}
+	timeout := e.opts.ReorderTimeout
+	if timeout == 0 {
+		timeout = DefaultReorderTimeout
+	}
+	e.pending.Add(1)
+	e.held = h
+	h.timer = e.clockLocked().AfterFunc(timeout, func() {
+		e.sendHeld(e.takeHeld(h))
+	})
+	return true
+}
+
+// takeHeld takes the packet held back, if it is want or want is nil, so that
+// the caller sends it.
+func (e *Endpoint) takeHeld(want *heldPacket) *heldPacket {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	h := e.held
+	if h == nil || (want != nil && h != want) {
+		return nil
+	}
+	e.held = nil
+	h.timer.Stop()
+	return h
+}
+
+// sendHeld sends a packet taken with takeHeld, if any.
+func (e *Endpoint) sendHeld(h *heldPacket) {
+	if h == nil {
+		return
+	}
+	for i := 0; i < h.copies; i++ {
+		e.writeCopy(&h.route, h.pkt, h.protocol, i < h.copies-1)
+	}
+	h.pkt.DecRef()
+	h.route.Release()
+	e.pending.Done()
+}
+
+// writeCopy writes pkt to the lower endpoint, or a clone of it if more copies
+// of pkt are to be written, since the lower endpoint prepends its own headers
+// to the packet it is given.
+func (e *Endpoint) writeCopy(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber, more bool) *tcpip.Error {
+	if !more {
+		return e.lower.WritePacket(r, pkt, protocol)
+	}
+	c := pkt.Clone()
+	defer c.DecRef()
+	return e.lower.WritePacket(r, c, protocol)
+}
@@ -0,0 +1,171 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/faketime"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	localAddr  = tcpip.Address("\x0a\x00\x00\x01")
+	remoteAddr = tcpip.Address("\x0a\x00\x00\x02")
+)
+
+func newEndpoint(t *testing.T, opts Options) (*Endpoint, *channel.Endpoint, stack.Route) {
+	lowerID, lower := channel.New(100, 1500, "")
+	id, e := New(lowerID, opts)
+	s := stack.New([]string{ipv4.ProtocolName}, nil, stack.Options{})
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+	r, err := s.FindRoute(1, localAddr, remoteAddr, ipv4.ProtocolNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	return e, lower, r
+}
+
+func write(t *testing.T, e *Endpoint, r *stack.Route, b byte) {
+	hdr := buffer.NewPrependable(int(e.MaxHeaderLength()) + 1)
+	hdr.Prepend(1)[0] = b
+	if err := e.WritePacket(r, stack.NewOutboundPacketBuffer(hdr, buffer.VectorisedView{}), ipv4.ProtocolNumber); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+}
+
+func TestLoss(t *testing.T) {
+	e, lower, r := newEndpoint(t, Options{Loss: 1})
+	defer r.Release()
+
+	for i := 0; i < 10; i++ {
+		write(t, e, &r, byte(i))
+	}
+	if n := lower.Drain(); n != 0 {
+		t.Errorf("got %d packets, want 0", n)
+	}
+	if got := e.Stats.Dropped.Value(); got != 10 {
+		t.Errorf("got Dropped = %d, want 10", got)
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	e, lower, r := newEndpoint(t, Options{Duplicate: 1})
+	defer r.Release()
+
+	write(t, e, &r, 1)
+	if n := lower.Drain(); n != 2 {
+		t.Errorf("got %d packets, want 2", n)
+	}
+}
+
+// expect checks that lower holds the given packets, in order, and no other.
+func expect(t *testing.T, lower *channel.Endpoint, want ...byte) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case p := <-lower.C:
+			if got := p.Header[0]; got != w {
+				t.Errorf("got packet %d, want %d", got, w)
+			}
+		default:
+			t.Fatalf("missing packet %d", w)
+		}
+	}
+	if n := lower.Drain(); n != 0 {
+		t.Errorf("got %d more packets, want 0", n)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	e, lower, r := newEndpoint(t, Options{Delay: 50 * time.Millisecond})
+	defer r.Release()
+
+	write(t, e, &r, 1)
+	if n := lower.Drain(); n != 0 {
+		t.Fatalf("got %d packets before delay expired, want 0", n)
+	}
+	e.Wait()
+	expect(t, lower, 1)
+	if got := e.Stats.Delayed.Value(); got != 1 {
+		t.Errorf("got Delayed = %d, want 1", got)
+	}
+}
+
+func TestReorder(t *testing.T) {
+	for _, delay := range []time.Duration{0, 10 * time.Millisecond} {
+		e, lower, r := newEndpoint(t, Options{Delay: delay, Reorder: 1, ReorderTimeout: time.Hour})
+
+		// Every packet is held back unless one already is, so each
+		// pair of packets is swapped. Delayed pairs are awaited in
+		// turn, as timers of equal duration may fire in any order.
+		for i := byte(1); i <= 4; i += 2 {
+			write(t, e, &r, i)
+			write(t, e, &r, i+1)
+			e.Wait()
+		}
+		expect(t, lower, 2, 1, 4, 3)
+		if got := e.Stats.Reordered.Value(); got != 2 {
+			t.Errorf("delay %s: got Reordered = %d, want 2", delay, got)
+		}
+		r.Release()
+	}
+}
+
+func TestReorderTimeout(t *testing.T) {
+	e, lower, r := newEndpoint(t, Options{Reorder: 1, ReorderTimeout: 10 * time.Millisecond})
+	defer r.Release()
+
+	// No packet follows, so the held back packet is sent once the timeout
+	// expires.
+	write(t, e, &r, 1)
+	if n := lower.Drain(); n != 0 {
+		t.Fatalf("got %d packets before timeout expired, want 0", n)
+	}
+	e.Wait()
+	expect(t, lower, 1)
+}
+
+func TestClock(t *testing.T) {
+	clock := faketime.NewManualClock()
+	e, lower, r := newEndpoint(t, Options{Delay: 50 * time.Millisecond, Clock: clock})
+	defer r.Release()
+
+	write(t, e, &r, 1)
+	clock.Advance(49 * time.Millisecond)
+	if n := lower.Drain(); n != 0 {
+		t.Fatalf("got %d packets before delay expired, want 0", n)
+	}
+	clock.Advance(time.Millisecond)
+	if n := lower.Drain(); n != 1 {
+		t.Fatalf("got %d packets once delay expired, want 1", n)
+	}
+	e.Wait()
+}
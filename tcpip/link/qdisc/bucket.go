@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qdisc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// TokenBucket is a token bucket rate limiter. Tokens are bytes; they
+// accumulate at a fixed rate up to the bucket's burst size.
+type TokenBucket struct {
+	rate  float64
+	burst float64
+
+	// clock is the clock the refill rate is measured with. It is
+	// immutable.
+	clock tcpip.Clock
+
+	mu     sync.Mutex
+	tokens float64
+
+	// last is the monotonic time of the last refill.
+	last int64
+}
+
+// NewTokenBucket returns a full token bucket that refills at rate bytes per
+// second, as measured by clock, and holds at most burst bytes.
+func NewTokenBucket(rate, burst uint64, clock tcpip.Clock) *TokenBucket {
+	return &TokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		clock:  clock,
+		tokens: float64(burst),
+		last:   clock.NowMonotonic(),
+	}
+}
+
+// Take removes n tokens from the bucket and returns how long the caller must
+// wait before the tokens are actually available. A packet larger than the
+// burst size is allowed through once the bucket has refilled enough to pay
+// back the debt, so it is never starved.
+func (b *TokenBucket) Take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refillLocked()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Allow removes n tokens from the bucket if they are available right now, and
+// returns whether it did.
+func (b *TokenBucket) Allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refillLocked()
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// refillLocked adds the tokens accumulated since the last call.
+//
+// Precondition: b.mu must be held.
+func (b *TokenBucket) refillLocked() {
+	now := b.clock.NowMonotonic()
+	b.tokens += time.Duration(now-b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
@@ -0,0 +1,240 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qdisc
+
+import (
+	"github.com/google/netstack/tcpip/flow"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/network/hash"
+)
+
+// packetQueue is a FIFO of packets.
+type packetQueue struct {
+	pkts []*Packet
+}
+
+func (q *packetQueue) push(p *Packet) {
+	q.pkts = append(q.pkts, p)
+}
+
+func (q *packetQueue) pop() *Packet {
+	if len(q.pkts) == 0 {
+		return nil
+	}
+	p := q.pkts[0]
+	q.pkts[0] = nil
+	q.pkts = q.pkts[1:]
+	return p
+}
+
+func (q *packetQueue) front() *Packet {
+	if len(q.pkts) == 0 {
+		return nil
+	}
+	return q.pkts[0]
+}
+
+func (q *packetQueue) len() int {
+	return len(q.pkts)
+}
+
+// FIFO is a Discipline that sends packets in arrival order and drops new
+// packets when full.
+type FIFO struct {
+	limit int
+	q     packetQueue
+}
+
+// NewFIFO creates a FIFO holding at most limit packets.
+func NewFIFO(limit int) *FIFO {
+	return &FIFO{limit: limit}
+}
+
+// Enqueue implements Discipline.Enqueue.
+func (f *FIFO) Enqueue(p *Packet) bool {
+	if f.q.len() >= f.limit {
+		return false
+	}
+	f.q.push(p)
+	return true
+}
+
+// Dequeue implements Discipline.Dequeue.
+func (f *FIFO) Dequeue() *Packet {
+	return f.q.pop()
+}
+
+// Len implements Discipline.Len.
+func (f *FIFO) Len() int {
+	return f.q.len()
+}
+
+// Priority is a Discipline with a number of bands, each a FIFO. Packets in a
+// band are only sent once all lower-numbered bands are empty.
+type Priority struct {
+	bands    []FIFO
+	classify func(*Packet) int
+}
+
+// NewPriority creates a Priority discipline with the given number of bands,
+// each holding at most limit packets. classify returns the band of a packet;
+// out-of-range values are clamped to the last band.
+func NewPriority(bands, limit int, classify func(*Packet) int) *Priority {
+	p := &Priority{
+		bands:    make([]FIFO, bands),
+		classify: classify,
+	}
+	for i := range p.bands {
+		p.bands[i].limit = limit
+	}
+	return p
+}
+
+// Enqueue implements Discipline.Enqueue.
+func (p *Priority) Enqueue(pkt *Packet) bool {
+	b := p.classify(pkt)
+	if b < 0 || b >= len(p.bands) {
+		b = len(p.bands) - 1
+	}
+	return p.bands[b].Enqueue(pkt)
+}
+
+// Dequeue implements Discipline.Dequeue.
+func (p *Priority) Dequeue() *Packet {
+	for i := range p.bands {
+		if pkt := p.bands[i].Dequeue(); pkt != nil {
+			return pkt
+		}
+	}
+	return nil
+}
+
+// Len implements Discipline.Len.
+func (p *Priority) Len() int {
+	n := 0
+	for i := range p.bands {
+		n += p.bands[i].Len()
+	}
+	return n
+}
+
+// ClassifyByTOS is a Priority classifier that maps packets to three bands
+// from their IPv4 TOS or IPv6 traffic class, following the Linux pfifo_fast
+// convention: low-delay packets go to band 0, bulk traffic to band 2 and
+// everything else to band 1.
+func ClassifyByTOS(p *Packet) int {
+	var tos uint8
+	switch h := p.NetworkHeader(); p.Protocol {
+	case header.IPv4ProtocolNumber:
+		if len(h) < header.IPv4MinimumSize {
+			return 1
+		}
+		tos, _ = header.IPv4(h).TOS()
+	case header.IPv6ProtocolNumber:
+		if len(h) < header.IPv6MinimumSize {
+			return 1
+		}
+		tos, _ = header.IPv6(h).TOS()
+	default:
+		return 1
+	}
+	switch {
+	case tos&0x10 != 0: // IPTOS_LOWDELAY
+		return 0
+	case tos&0x08 != 0: // IPTOS_THROUGHPUT
+		return 2
+	default:
+		return 1
+	}
+}
+
+// FairQueue is a Discipline that hashes packets into per-flow queues and
+// serves them with deficit round robin, so that a single busy flow can't
+// monopolize the link.
+type FairQueue struct {
+	limit   int
+	quantum int
+	seed    uint32
+	flows   []fairFlow
+	// active is the list of indices of flows with queued packets, in
+	// round robin order.
+	active []int
+	n      int
+}
+
+type fairFlow struct {
+	q       packetQueue
+	deficit int
+	active  bool
+}
+
+// NewFairQueue creates a FairQueue with the given number of flow queues,
+// holding at most limit packets in total. quantum is the number of bytes a
+// flow may send in each round; it should be at least the MTU.
+func NewFairQueue(flows, limit, quantum int) *FairQueue {
+	return &FairQueue{
+		limit:   limit,
+		quantum: quantum,
+		seed:    hash.RandN32(1)[0],
+		flows:   make([]fairFlow, flows),
+	}
+}
+
+// Enqueue implements Discipline.Enqueue.
+func (f *FairQueue) Enqueue(p *Packet) bool {
+	if f.n >= f.limit {
+		return false
+	}
+	i := int(flow.Hash(p.Protocol, p.NetworkHeader(), flow.FiveTuple, f.seed) % uint32(len(f.flows)))
+	fl := &f.flows[i]
+	fl.q.push(p)
+	if !fl.active {
+		fl.active = true
+		fl.deficit = f.quantum
+		f.active = append(f.active, i)
+	}
+	f.n++
+	return true
+}
+
+// Dequeue implements Discipline.Dequeue.
+func (f *FairQueue) Dequeue() *Packet {
+	for len(f.active) > 0 {
+		i := f.active[0]
+		fl := &f.flows[i]
+		p := fl.q.front()
+		if p == nil {
+			fl.active = false
+			f.active = f.active[1:]
+			continue
+		}
+		if fl.deficit < p.Size() {
+			// Move to the back of the round with a fresh quantum.
+			fl.deficit += f.quantum
+			f.active = append(f.active[1:], i)
+			continue
+		}
+		fl.deficit -= p.Size()
+		fl.q.pop()
+		f.n--
+		return p
+	}
+	return nil
+}
+
+// Len implements Discipline.Len.
+func (f *FairQueue) Len() int {
+	return f.n
+}
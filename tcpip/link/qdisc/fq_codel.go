@@ -0,0 +1,303 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qdisc
+
+import (
+	"math"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/flow"
+	"github.com/google/netstack/tcpip/network/hash"
+)
+
+// DroppingDiscipline is a Discipline that drops packets it already queued. The
+// endpoint gives it the function to pass them to, which accounts for them and
+// frees them.
+type DroppingDiscipline interface {
+	Discipline
+
+	// SetDropFunc sets the function the discipline passes the packets it
+	// drops to.
+	SetDropFunc(drop func(*Packet))
+}
+
+// FQCoDelOptions configures an FQCoDel discipline. Zero fields take the
+// defaults of RFC 8290.
+type FQCoDelOptions struct {
+	// Flows is the number of flow queues. It defaults to 1024.
+	Flows int
+
+	// Limit is the number of packets held in all queues. When it is
+	// reached, packets are dropped from the head of the queue holding the
+	// most bytes. It defaults to 10240.
+	Limit int
+
+	// Quantum is the number of bytes a flow may send in each round. It
+	// should be at least the MTU, and defaults to 1514.
+	Quantum int
+
+	// Target is the queueing delay CoDel lets packets have. It defaults
+	// to 5ms.
+	Target time.Duration
+
+	// Interval is how long the queueing delay may stay above Target
+	// before CoDel starts dropping packets. It should be about the round
+	// trip time of the flows, and defaults to 100ms.
+	Interval time.Duration
+
+	// Clock is the clock queueing delays are measured with, like the
+	// stack's one. If nil, the system clock is used.
+	Clock tcpip.Clock
+}
+
+// FQCoDel is a Discipline that hashes packets into per-flow queues, serves
+// them with deficit round robin favoring the flows that just became active,
+// and controls the queueing delay of each flow with CoDel, as described in RFC
+// 8290. Interactive flows sharing a link with bulk ones so keep a low
+// latency, and bulk flows see drops as soon as they build a standing queue.
+type FQCoDel struct {
+	opts  FQCoDelOptions
+	seed  uint32
+	flows []codelFlow
+
+	// newFlows and oldFlows are the indices of the active flows, in round
+	// robin order. Flows that just became active are served first.
+	newFlows []int
+	oldFlows []int
+
+	n    int
+	drop func(*Packet)
+}
+
+// codelFlow is a flow queue of FQCoDel, with its CoDel state.
+type codelFlow struct {
+	q       packetQueue
+	bytes   int
+	deficit int
+	active  bool
+
+	// dropping is set while CoDel drops packets of the flow, at dropNext
+	// and more and more often as count grows.
+	dropping  bool
+	count     uint32
+	lastCount uint32
+	dropNext  time.Time
+
+	// firstAbove is when the queueing delay went above target, plus an
+	// interval, or zero while it's below.
+	firstAbove time.Time
+}
+
+var _ DroppingDiscipline = (*FQCoDel)(nil)
+
+// NewFQCoDel creates an FQCoDel discipline.
+func NewFQCoDel(opts FQCoDelOptions) *FQCoDel {
+	if opts.Flows <= 0 {
+		opts.Flows = 1024
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = 10240
+	}
+	if opts.Quantum <= 0 {
+		opts.Quantum = 1514
+	}
+	if opts.Target <= 0 {
+		opts.Target = 5 * time.Millisecond
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 100 * time.Millisecond
+	}
+	if opts.Clock == nil {
+		opts.Clock = &tcpip.StdClock{}
+	}
+	return &FQCoDel{
+		opts:  opts,
+		seed:  hash.RandN32(1)[0],
+		flows: make([]codelFlow, opts.Flows),
+		drop:  func(*Packet) {},
+	}
+}
+
+// SetDropFunc implements DroppingDiscipline.SetDropFunc.
+func (f *FQCoDel) SetDropFunc(drop func(*Packet)) {
+	f.drop = drop
+}
+
+// Enqueue implements Discipline.Enqueue. Packets are never rejected: when the
+// discipline is full, the oldest packet of the flow with the most queued bytes
+// is dropped instead.
+func (f *FQCoDel) Enqueue(p *Packet) bool {
+	if f.n >= f.opts.Limit {
+		f.dropFromFattest()
+	}
+	i := int(flow.Hash(p.Protocol, p.NetworkHeader(), flow.FiveTuple, f.seed) % uint32(len(f.flows)))
+	fl := &f.flows[i]
+	p.enqueued = f.now()
+	fl.q.push(p)
+	fl.bytes += p.Size()
+	f.n++
+	if !fl.active {
+		fl.active = true
+		fl.deficit = f.opts.Quantum
+		f.newFlows = append(f.newFlows, i)
+	}
+	return true
+}
+
+// dropFromFattest drops the packet at the head of the flow queue holding the
+// most bytes.
+func (f *FQCoDel) dropFromFattest() {
+	fattest := -1
+	for i := range f.flows {
+		if f.flows[i].bytes > 0 && (fattest < 0 || f.flows[i].bytes > f.flows[fattest].bytes) {
+			fattest = i
+		}
+	}
+	if fattest < 0 {
+		return
+	}
+	f.drop(f.pop(&f.flows[fattest]))
+}
+
+// pop removes the packet at the head of fl.
+func (f *FQCoDel) pop(fl *codelFlow) *Packet {
+	p := fl.q.pop()
+	if p != nil {
+		fl.bytes -= p.Size()
+		f.n--
+	}
+	return p
+}
+
+// Dequeue implements Discipline.Dequeue.
+func (f *FQCoDel) Dequeue() *Packet {
+	for {
+		var list *[]int
+		switch {
+		case len(f.newFlows) > 0:
+			list = &f.newFlows
+		case len(f.oldFlows) > 0:
+			list = &f.oldFlows
+		default:
+			return nil
+		}
+		i := (*list)[0]
+		fl := &f.flows[i]
+
+		if fl.deficit <= 0 {
+			fl.deficit += f.opts.Quantum
+			*list = (*list)[1:]
+			f.oldFlows = append(f.oldFlows, i)
+			continue
+		}
+
+		p := f.codelDequeue(fl)
+		if p == nil {
+			*list = (*list)[1:]
+			// An emptied new flow goes through the old flows once,
+			// so that it can't get priority again right away.
+			if list == &f.newFlows && len(f.oldFlows) > 0 {
+				f.oldFlows = append(f.oldFlows, i)
+			} else {
+				fl.active = false
+			}
+			continue
+		}
+		fl.deficit -= p.Size()
+		return p
+	}
+}
+
+// Len implements Discipline.Len.
+func (f *FQCoDel) Len() int {
+	return f.n
+}
+
+// now returns the current time of the clock of the discipline. Only the
+// differences between the times it returns are meaningful.
+func (f *FQCoDel) now() time.Time {
+	return time.Unix(0, f.opts.Clock.NowMonotonic())
+}
+
+// codelDequeue dequeues the next packet of fl, dropping the packets that CoDel
+// decides to drop on the way, as in RFC 8289 section 5.
+func (f *FQCoDel) codelDequeue(fl *codelFlow) *Packet {
+	now := f.now()
+	p, okToDrop := f.codelPop(fl, now)
+	if p == nil {
+		fl.dropping = false
+		return nil
+	}
+
+	if fl.dropping {
+		if !okToDrop {
+			fl.dropping = false
+		}
+		for fl.dropping && !now.Before(fl.dropNext) {
+			f.drop(p)
+			fl.count++
+			if p, okToDrop = f.codelPop(fl, now); p == nil || !okToDrop {
+				fl.dropping = false
+			} else {
+				fl.dropNext = f.controlLaw(fl.dropNext, fl.count)
+			}
+		}
+		return p
+	}
+
+	if okToDrop {
+		f.drop(p)
+		p, _ = f.codelPop(fl, now)
+		fl.dropping = true
+		// Start dropping close to the rate that ended the previous
+		// dropping state, if it was recent.
+		delta := fl.count - fl.lastCount
+		if delta > 1 && now.Sub(fl.dropNext) < 16*f.opts.Interval {
+			fl.count = delta
+		} else {
+			fl.count = 1
+		}
+		fl.lastCount = fl.count
+		fl.dropNext = f.controlLaw(now, fl.count)
+	}
+	return p
+}
+
+// codelPop pops the packet at the head of fl and returns whether its queueing
+// delay has been above target for at least an interval, so that it may be
+// dropped.
+func (f *FQCoDel) codelPop(fl *codelFlow, now time.Time) (*Packet, bool) {
+	p := f.pop(fl)
+	if p == nil {
+		fl.firstAbove = time.Time{}
+		return nil, false
+	}
+	if now.Sub(p.enqueued) < f.opts.Target || fl.bytes <= f.opts.Quantum {
+		fl.firstAbove = time.Time{}
+		return p, false
+	}
+	if fl.firstAbove.IsZero() {
+		fl.firstAbove = now.Add(f.opts.Interval)
+		return p, false
+	}
+	return p, !now.Before(fl.firstAbove)
+}
+
+// controlLaw returns when CoDel drops the next packet, after having dropped
+// count packets since it started dropping, the last one at t.
+func (f *FQCoDel) controlLaw(t time.Time, count uint32) time.Time {
+	return t.Add(time.Duration(float64(f.opts.Interval) / math.Sqrt(float64(count))))
+}
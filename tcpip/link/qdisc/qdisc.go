@@ -0,0 +1,369 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package qdisc provides the implementation of data-link layer endpoints that
+// wrap another endpoint and queue outbound packets according to a queueing
+// discipline, optionally shaping the traffic to a given rate with a token
+// bucket.
+//
+// Qdisc endpoints can be used in the networking stack by calling New(eID, opts)
+// to create a new endpoint, where eID is the ID of the endpoint being wrapped,
+// and then passing it as an argument to Stack.CreateNIC(). Since each NIC has
+// its own link endpoint, this gives every NIC its own egress queue.
+package qdisc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// Packet is an outbound packet held in a queue. Packets own a copy of the
+// packet written to the endpoint, and a reference to their route.
+type Packet struct {
+	Route    stack.Route
+	Buffer   *stack.PacketBuffer
+	Protocol tcpip.NetworkProtocolNumber
+
+	// enqueued is when the packet was queued, for disciplines that track
+	// queueing delays.
+	enqueued time.Time
+}
+
+// Size returns the number of bytes of the packet, excluding link-layer headers.
+func (p *Packet) Size() int {
+	return p.Buffer.Size()
+}
+
+// NetworkHeader returns the start of the packet, beginning with the network
+// layer header.
+func (p *Packet) NetworkHeader() buffer.View {
+	return p.Buffer.Header.View()
+}
+
+// release frees the resources held by the packet.
+func (p *Packet) release() {
+	p.Buffer.DecRef()
+	p.Route.Release()
+}
+
+// A Discipline decides which queued packet is sent next. Disciplines are not
+// required to be safe for concurrent use; the endpoint serializes all calls.
+type Discipline interface {
+	// Enqueue adds p to the queue. It returns false if the packet was
+	// rejected, in which case the caller retains ownership of it.
+	Enqueue(p *Packet) bool
+
+	// Dequeue removes and returns the next packet to be sent, or nil if
+	// the queue is empty. Disciplines that drop queued packets (rather
+	// than rejecting them in Enqueue) implement DroppingDiscipline to
+	// report them to the endpoint.
+	Dequeue() *Packet
+
+	// Len returns the number of queued packets.
+	Len() int
+}
+
+// Options configures a qdisc endpoint.
+type Options struct {
+	// Discipline is the queueing discipline. If nil, a FIFO of 1000
+	// packets is used.
+	Discipline Discipline
+
+	// Rate is the rate, in bytes per second, at which packets leave the
+	// queue. If zero, packets are dequeued as fast as the lower endpoint
+	// accepts them.
+	Rate uint64
+
+	// Burst is the number of bytes that may be sent back-to-back at more
+	// than Rate after the queue has been idle. It defaults to 64KiB.
+	Burst uint64
+
+	// Clock is the clock Rate is measured with, like the stack's one. If
+	// nil, the system clock is used.
+	Clock tcpip.Clock
+}
+
+// Stats holds queueing statistics.
+type Stats struct {
+	// Enqueued is the number of packets accepted by the discipline.
+	Enqueued *tcpip.StatCounter
+
+	// Dropped is the number of packets dropped by the discipline.
+	Dropped *tcpip.StatCounter
+
+	// Sent is the number of packets passed to the lower endpoint.
+	Sent *tcpip.StatCounter
+
+	// SendErrors is the number of packets the lower endpoint failed to
+	// write.
+	SendErrors *tcpip.StatCounter
+}
+
+// Endpoint is a link-layer endpoint that queues outbound packets and writes
+// them to the endpoint it wraps from a dedicated goroutine.
+type Endpoint struct {
+	dispatcher stack.NetworkDispatcher
+	lower      stack.LinkEndpoint
+
+	// Stats are the queueing counters of the endpoint.
+	Stats Stats
+
+	// clock is the clock the rate is measured with. It is immutable.
+	clock tcpip.Clock
+
+	// wake is signalled when a packet is enqueued or the endpoint is
+	// closed, and closing is closed when the endpoint is.
+	wake    chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+
+	mu         sync.Mutex
+	discipline Discipline
+	bucket     *TokenBucket
+	closed     bool
+}
+
+const (
+	defaultQueueLen = 1000
+	defaultBurst    = 64 << 10
+)
+
+// New creates a new qdisc link-layer endpoint wrapping the endpoint with the
+// given ID, and starts the goroutine that drains its queue.
+func New(lower tcpip.LinkEndpointID, opts Options) (tcpip.LinkEndpointID, *Endpoint) {
+	d := opts.Discipline
+	if d == nil {
+		d = NewFIFO(defaultQueueLen)
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = &tcpip.StdClock{}
+	}
+	e := &Endpoint{
+		lower:      stack.FindLinkEndpoint(lower),
+		discipline: d,
+		clock:      clock,
+		wake:       make(chan struct{}, 1),
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+		Stats: Stats{
+			Enqueued:   &tcpip.StatCounter{},
+			Dropped:    &tcpip.StatCounter{},
+			Sent:       &tcpip.StatCounter{},
+			SendErrors: &tcpip.StatCounter{},
+		},
+	}
+	if dd, ok := d.(DroppingDiscipline); ok {
+		dd.SetDropFunc(func(p *Packet) {
+			e.Stats.Dropped.Increment()
+			p.release()
+		})
+	}
+	if opts.Rate != 0 {
+		burst := opts.Burst
+		if burst == 0 {
+			burst = defaultBurst
+		}
+		e.bucket = NewTokenBucket(opts.Rate, burst, clock)
+	}
+	go e.dequeueLoop()
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// SetRate changes the shaping rate and burst of the endpoint. A zero rate
+// disables shaping.
+func (e *Endpoint) SetRate(rate, burst uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if rate == 0 {
+		e.bucket = nil
+		return
+	}
+	if burst == 0 {
+		burst = defaultBurst
+	}
+	e.bucket = NewTokenBucket(rate, burst, e.clock)
+}
+
+// Len returns the number of packets waiting in the queue.
+func (e *Endpoint) Len() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.discipline.Len()
+}
+
+// Close stops the goroutine draining the queue and drops all queued packets.
+func (e *Endpoint) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	e.mu.Unlock()
+	close(e.closing)
+	e.signal()
+	<-e.done
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for p := e.discipline.Dequeue(); p != nil; p = e.discipline.Dequeue() {
+		e.Stats.Dropped.Increment()
+		p.release()
+	}
+}
+
+func (e *Endpoint) signal() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dequeueLoop writes queued packets to the lower endpoint until the endpoint
+// is closed.
+func (e *Endpoint) dequeueLoop() {
+	defer close(e.done)
+	for {
+		e.mu.Lock()
+		if e.closed {
+			e.mu.Unlock()
+			return
+		}
+		p := e.discipline.Dequeue()
+		bucket := e.bucket
+		e.mu.Unlock()
+
+		if p == nil {
+			<-e.wake
+			continue
+		}
+
+		if bucket != nil {
+			if d := bucket.Take(p.Size()); d > 0 && !e.sleep(d) {
+				e.Stats.Dropped.Increment()
+				p.release()
+				return
+			}
+		}
+		if err := e.lower.WritePacket(&p.Route, p.Buffer, p.Protocol); err != nil {
+			e.Stats.SendErrors.Increment()
+		} else {
+			e.Stats.Sent.Increment()
+		}
+		p.release()
+	}
+}
+
+// sleep waits for d to elapse on the clock of the endpoint. It returns false if
+// the endpoint is closed first.
+func (e *Endpoint) sleep(d time.Duration) bool {
+	expired := make(chan struct{})
+	t := e.clock.AfterFunc(d, func() { close(expired) })
+	select {
+	case <-expired:
+		return true
+	case <-e.closing:
+		t.Stop()
+		return false
+	}
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.DeliverNetworkPacket.
+func (e *Endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	e.dispatcher.DeliverNetworkPacket(e, remote, local, protocol, vv)
+}
+
+// DeliverLinkState implements stack.LinkStateDispatcher.DeliverLinkState. It
+// just forwards the carrier change to the actual dispatcher.
+func (e *Endpoint) DeliverLinkState(up bool) {
+	stack.DeliverLinkState(e.dispatcher, up)
+}
+
+// DeliverLinkDrop implements stack.LinkDropDispatcher.DeliverLinkDrop. It
+// just forwards the dropped frame to the actual dispatcher.
+func (e *Endpoint) DeliverLinkDrop(reason tcpip.DropReason, frame buffer.VectorisedView) {
+	stack.DeliverLinkDrop(e.dispatcher, reason, frame)
+}
+
+// Attach implements stack.LinkEndpoint.Attach. It saves the dispatcher and
+// registers with the lower endpoint as its dispatcher so that "e" is called
+// for inbound packets.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.lower.Attach(e)
+}
+
+// IsAttached implements stack.LinkEndpoint.IsAttached.
+func (e *Endpoint) IsAttached() bool {
+	return e.dispatcher != nil
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It just forwards the request to the
+// lower endpoint.
+func (e *Endpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+// SetMTU implements stack.MTUSettableLinkEndpoint.SetMTU. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	return stack.SetLinkMTU(e.lower, mtu)
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. It just
+// forwards the request to the lower endpoint.
+func (e *Endpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+// LinkAddress implements stack.LinkEndpoint.LinkAddress. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
+	return e.lower.LinkAddress()
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. It queues a copy of
+// the packet; the result of the eventual write to the lower endpoint is only
+// reflected in the endpoint's stats. Packets rejected by the discipline fail
+// with ErrNoBufferSpace.
+func (e *Endpoint) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	p := &Packet{
+		Route:    r.Clone(),
+		Buffer:   pkt.Clone(),
+		Protocol: protocol,
+	}
+
+	e.mu.Lock()
+	if e.closed || !e.discipline.Enqueue(p) {
+		e.mu.Unlock()
+		e.Stats.Dropped.Increment()
+		p.release()
+		return tcpip.ErrNoBufferSpace
+	}
+	e.mu.Unlock()
+	e.Stats.Enqueued.Increment()
+	e.signal()
+	return nil
+}
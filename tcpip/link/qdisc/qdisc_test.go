@@ -0,0 +1,287 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qdisc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/faketime"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// ipPacket returns a queued IPv4/UDP packet of the given size from the given
+// source port.
+func ipPacket(srcPort uint16, tos uint8, size int) *Packet {
+	hdr := buffer.NewPrependable(header.IPv4MinimumSize + header.UDPMinimumSize)
+	udp := header.UDP(hdr.Prepend(header.UDPMinimumSize))
+	udp.Encode(&header.UDPFields{SrcPort: srcPort, DstPort: 80})
+	ip := header.IPv4(hdr.Prepend(header.IPv4MinimumSize))
+	ip.Encode(&header.IPv4Fields{
+		IHL:      header.IPv4MinimumSize,
+		TOS:      tos,
+		Protocol: uint8(header.UDPProtocolNumber),
+		SrcAddr:  "\x0a\x00\x00\x01",
+		DstAddr:  "\x0a\x00\x00\x02",
+	})
+	return &Packet{
+		Buffer:   stack.NewOutboundPacketBuffer(hdr, buffer.NewView(size-hdr.UsedLength()).ToVectorisedView()),
+		Protocol: header.IPv4ProtocolNumber,
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	clock := faketime.NewManualClock()
+	b := NewTokenBucket(1000, 500, clock)
+
+	if !b.Allow(500) {
+		t.Fatalf("Allow(500) on full bucket = false, want true")
+	}
+	if b.Allow(1) {
+		t.Fatalf("Allow(1) on empty bucket = true, want false")
+	}
+	clock.Advance(100 * time.Millisecond)
+	if d := b.Take(200); d != 100*time.Millisecond {
+		t.Errorf("Take(200) = %v, want 100ms", d)
+	}
+	clock.Advance(10 * time.Second)
+	if d := b.Take(500); d != 0 {
+		t.Errorf("Take(500) after refill = %v, want 0", d)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	p := NewPriority(3, 10, ClassifyByTOS)
+	bulk := ipPacket(1, 0x08, 100)
+	normal := ipPacket(2, 0, 100)
+	interactive := ipPacket(3, 0x10, 100)
+	for _, pkt := range []*Packet{bulk, normal, interactive} {
+		if !p.Enqueue(pkt) {
+			t.Fatalf("Enqueue failed")
+		}
+	}
+	for _, want := range []*Packet{interactive, normal, bulk} {
+		if got := p.Dequeue(); got != want {
+			t.Errorf("got packet from port %d, want port %d", header.UDP(got.NetworkHeader()[header.IPv4MinimumSize:]).SourcePort(), header.UDP(want.NetworkHeader()[header.IPv4MinimumSize:]).SourcePort())
+		}
+	}
+}
+
+func TestFairQueue(t *testing.T) {
+	f := NewFairQueue(1024, 100, 1500)
+	// A bulk flow queues many packets before a second flow shows up.
+	for i := 0; i < 10; i++ {
+		if !f.Enqueue(ipPacket(1, 0, 1000)) {
+			t.Fatalf("Enqueue failed")
+		}
+	}
+	if !f.Enqueue(ipPacket(2, 0, 100)) {
+		t.Fatalf("Enqueue failed")
+	}
+
+	for i := 0; i < 3; i++ {
+		p := f.Dequeue()
+		if header.UDP(p.NetworkHeader()[header.IPv4MinimumSize:]).SourcePort() == 2 {
+			return
+		}
+	}
+	t.Errorf("second flow wasn't served within 3 packets")
+}
+
+func TestFQCoDelNewFlows(t *testing.T) {
+	f := NewFQCoDel(FQCoDelOptions{})
+	// A bulk flow queues many packets, and uses up its first quantum,
+	// before an interactive flow shows up; the latter is served next as a
+	// new flow.
+	for i := 0; i < 10; i++ {
+		f.Enqueue(ipPacket(1, 0, 1000))
+	}
+	for i := 0; i < 2; i++ {
+		if p := f.Dequeue(); header.UDP(p.NetworkHeader()[header.IPv4MinimumSize:]).SourcePort() != 1 {
+			t.Fatalf("packet %d isn't from the bulk flow", i)
+		}
+	}
+	f.Enqueue(ipPacket(2, 0, 100))
+	if p := f.Dequeue(); header.UDP(p.NetworkHeader()[header.IPv4MinimumSize:]).SourcePort() != 2 {
+		t.Errorf("interactive flow wasn't served next")
+	}
+	if got, want := f.Len(), 8; got != want {
+		t.Errorf("got Len() = %d, want %d", got, want)
+	}
+}
+
+func TestFQCoDelLimit(t *testing.T) {
+	f := NewFQCoDel(FQCoDelOptions{Limit: 4})
+	var dropped []*Packet
+	f.SetDropFunc(func(p *Packet) { dropped = append(dropped, p) })
+
+	// When full, the head of the fattest flow is dropped.
+	bulk := ipPacket(1, 0, 1000)
+	f.Enqueue(bulk)
+	for i := 0; i < 2; i++ {
+		f.Enqueue(ipPacket(1, 0, 1000))
+	}
+	f.Enqueue(ipPacket(2, 0, 100))
+	if !f.Enqueue(ipPacket(3, 0, 100)) {
+		t.Fatalf("Enqueue on a full FQCoDel failed")
+	}
+	if len(dropped) != 1 || dropped[0] != bulk {
+		t.Fatalf("got %d dropped packets, want the head of the bulk flow", len(dropped))
+	}
+	if got, want := f.Len(), 4; got != want {
+		t.Errorf("got Len() = %d, want %d", got, want)
+	}
+}
+
+func TestFQCoDelDropsStandingQueue(t *testing.T) {
+	clock := faketime.NewManualClock()
+	f := NewFQCoDel(FQCoDelOptions{Clock: clock})
+	drops := 0
+	f.SetDropFunc(func(*Packet) { drops++ })
+
+	// A flow keeps 100 packets queued, which spend 50ms in the queue.
+	for i := 0; i < 100; i++ {
+		f.Enqueue(ipPacket(1, 0, 1000))
+	}
+	for i := 0; i < 1000; i++ {
+		clock.Advance(500 * time.Microsecond)
+		if f.Dequeue() == nil {
+			t.Fatalf("queue emptied after %d packets", i)
+		}
+		f.Enqueue(ipPacket(1, 0, 1000))
+		if i == 150 && drops != 0 {
+			t.Fatalf("got %d drops within the first interval, want 0", drops)
+		}
+	}
+	if drops == 0 {
+		t.Error("CoDel didn't drop packets of a standing queue")
+	}
+}
+
+func TestFIFOLimit(t *testing.T) {
+	f := NewFIFO(1)
+	if !f.Enqueue(ipPacket(1, 0, 100)) {
+		t.Fatalf("Enqueue on empty FIFO failed")
+	}
+	if f.Enqueue(ipPacket(1, 0, 100)) {
+		t.Fatalf("Enqueue on full FIFO succeeded")
+	}
+}
+
+func TestEndpointShaping(t *testing.T) {
+	lowerID, lower := channel.New(100, 1500, "")
+	clock := faketime.NewManualClock()
+	id, e := New(lowerID, Options{Rate: 10000, Burst: 1000, Clock: clock})
+	defer e.Close()
+
+	r := routeThrough(t, id)
+	defer r.Release()
+
+	// The first 1000 bytes go out immediately, the next 500 after 50ms,
+	// and the last 500 after 50ms more.
+	for i := 0; i < 4; i++ {
+		p := ipPacket(1, 0, 500)
+		if err := e.WritePacket(&r, p.Buffer, p.Protocol); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if i >= 2 {
+			// Once the endpoint waits for the clock, no packet can
+			// be on its way.
+			d := waitForTimer(t, clock)
+			if d != 50*time.Millisecond {
+				t.Errorf("packet %d waits %v, want 50ms", i, d)
+			}
+			select {
+			case <-lower.C:
+				t.Fatalf("packet %d sent before the clock advanced", i)
+			default:
+			}
+			clock.AdvanceToNext()
+		}
+		select {
+		case <-lower.C:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for packet %d", i)
+		}
+	}
+	e.Close()
+	if got := e.Stats.Sent.Value(); got != 4 {
+		t.Errorf("got Sent = %d, want 4", got)
+	}
+}
+
+func TestEndpointCloseWhileShaping(t *testing.T) {
+	lowerID, _ := channel.New(100, 1500, "")
+	clock := faketime.NewManualClock()
+	id, e := New(lowerID, Options{Rate: 1000, Burst: 100, Clock: clock})
+	r := routeThrough(t, id)
+	defer r.Release()
+
+	p := ipPacket(1, 0, 500)
+	if err := e.WritePacket(&r, p.Buffer, p.Protocol); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	waitForTimer(t, clock)
+
+	// Close doesn't wait for the clock.
+	e.Close()
+	if got := e.Stats.Dropped.Value(); got != 1 {
+		t.Errorf("got Dropped = %d, want 1", got)
+	}
+	if got := e.Stats.Sent.Value(); got != 0 {
+		t.Errorf("got Sent = %d, want 0", got)
+	}
+}
+
+// routeThrough returns a route through a NIC using the link endpoint id.
+func routeThrough(t *testing.T, id tcpip.LinkEndpointID) stack.Route {
+	t.Helper()
+	s := stack.New([]string{ipv4.ProtocolName}, nil, stack.Options{})
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, "\x0a\x00\x00\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", NIC: 1}})
+	r, err := s.FindRoute(1, "", "\x0a\x00\x00\x02", ipv4.ProtocolNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	return r
+}
+
+// waitForTimer waits for a timer to be scheduled on clock, and returns the
+// time left until it expires.
+func waitForTimer(t *testing.T, clock *faketime.ManualClock) time.Duration {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if d, ok := clock.NextExpiration(); ok {
+			return d
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for a timer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -67,4 +67,5 @@ func init() {
 	addTranslation(syscall.ECONNABORTED, tcpip.ErrConnectionAborted)
 	addTranslation(syscall.EMSGSIZE, tcpip.ErrMessageTooLong)
 	addTranslation(syscall.ENOBUFS, tcpip.ErrNoBufferSpace)
+	addTranslation(syscall.ENETDOWN, tcpip.ErrNetworkDown)
 }
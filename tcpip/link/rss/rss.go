@@ -0,0 +1,284 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rss provides the implementation of data-link layer endpoints that
+// spread inbound packets across several goroutines (receive-side scaling).
+//
+// Packets are hashed by flow, so all packets of a given flow are processed by
+// the same goroutine and in the order in which they arrived, while different
+// flows are processed in parallel. An RSS endpoint may wrap a single endpoint,
+// or several endpoints that act as the receive and transmit queues of one
+// device (e.g. the file descriptors of a multi-queue TAP device).
+//
+// RSS endpoints can be used in the networking stack by calling New(eID, opts)
+// or NewMultiQueue(eIDs, opts) to create a new endpoint, and then passing it
+// as an argument to Stack.CreateNIC().
+package rss
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/flow"
+	"github.com/google/netstack/tcpip/network/hash"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const defaultQueueLen = 256
+
+// Options configures an RSS endpoint.
+type Options struct {
+	// Queues is the number of goroutines inbound packets are spread over.
+	// If zero, runtime.GOMAXPROCS(0) is used, giving one goroutine per
+	// CPU the Go scheduler uses.
+	Queues int
+
+	// QueueLen is the number of packets each goroutine may have pending.
+	// Packets that arrive when their queue is full are dropped. If zero,
+	// 256 is used.
+	QueueLen int
+
+	// PinQueue, if not nil, is called by each queue goroutine with the
+	// index of its queue before it delivers any packet. The goroutine is
+	// locked to its OS thread with runtime.LockOSThread until the endpoint
+	// is closed, so that PinQueue can pin the thread, e.g. with
+	// sched_setaffinity(2) on Linux, to align packet processing with the
+	// CPU topology of the host.
+	PinQueue func(queue int)
+}
+
+// QueueStats holds the counters of one receive queue.
+type QueueStats struct {
+	// Delivered is the number of packets delivered to the stack.
+	Delivered *tcpip.StatCounter
+
+	// Dropped is the number of packets dropped because the queue was
+	// full.
+	Dropped *tcpip.StatCounter
+}
+
+type packet struct {
+	remote   tcpip.LinkAddress
+	local    tcpip.LinkAddress
+	protocol tcpip.NetworkProtocolNumber
+	vv       buffer.VectorisedView
+}
+
+type queue struct {
+	ch    chan packet
+	stats QueueStats
+}
+
+// Endpoint is a link-layer endpoint that dispatches inbound packets from one
+// or more lower endpoints to per-queue goroutines, and spreads outbound
+// packets across the lower endpoints, both by flow.
+type Endpoint struct {
+	dispatcher stack.NetworkDispatcher
+	lowers     []stack.LinkEndpoint
+	queues     []queue
+	seed       uint32
+	pinQueue   func(queue int)
+
+	done     chan struct{}
+	wg       sync.WaitGroup
+	closeMu  sync.Mutex
+	isClosed bool
+}
+
+// New creates a new RSS endpoint wrapping a single lower endpoint.
+func New(lower tcpip.LinkEndpointID, opts Options) (tcpip.LinkEndpointID, *Endpoint) {
+	return NewMultiQueue([]tcpip.LinkEndpointID{lower}, opts)
+}
+
+// NewMultiQueue creates a new RSS endpoint over several lower endpoints that
+// act as the queues of a single device. They must have the same MTU, link
+// address and capabilities; those of the first one are reported. Inbound
+// packets from all of them are merged and spread by flow, and outbound packets
+// are written to the lower endpoint selected by flow, so that the packets of a
+// flow are never reordered.
+func NewMultiQueue(lowers []tcpip.LinkEndpointID, opts Options) (tcpip.LinkEndpointID, *Endpoint) {
+	if opts.Queues <= 0 {
+		opts.Queues = runtime.GOMAXPROCS(0)
+	}
+	if opts.QueueLen <= 0 {
+		opts.QueueLen = defaultQueueLen
+	}
+
+	e := &Endpoint{
+		queues:   make([]queue, opts.Queues),
+		seed:     hash.RandN32(1)[0],
+		pinQueue: opts.PinQueue,
+		done:     make(chan struct{}),
+	}
+	for _, id := range lowers {
+		e.lowers = append(e.lowers, stack.FindLinkEndpoint(id))
+	}
+	for i := range e.queues {
+		e.queues[i] = queue{
+			ch: make(chan packet, opts.QueueLen),
+			stats: QueueStats{
+				Delivered: &tcpip.StatCounter{},
+				Dropped:   &tcpip.StatCounter{},
+			},
+		}
+	}
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// NumQueues returns the number of receive queues.
+func (e *Endpoint) NumQueues() int {
+	return len(e.queues)
+}
+
+// QueueStats returns the counters of receive queue i.
+func (e *Endpoint) QueueStats(i int) QueueStats {
+	return e.queues[i].stats
+}
+
+// QueueLen returns the number of packets pending in receive queue i.
+func (e *Endpoint) QueueLen(i int) int {
+	return len(e.queues[i].ch)
+}
+
+// Close stops the queue goroutines. Packets still queued are dropped, as are
+// packets that arrive afterwards.
+func (e *Endpoint) Close() {
+	e.closeMu.Lock()
+	if !e.isClosed {
+		e.isClosed = true
+		close(e.done)
+	}
+	e.closeMu.Unlock()
+	e.wg.Wait()
+}
+
+// queueLoop delivers the packets of queue i to the dispatcher until the
+// endpoint is closed.
+func (e *Endpoint) queueLoop(i int) {
+	defer e.wg.Done()
+	if e.pinQueue != nil {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		e.pinQueue(i)
+	}
+	q := &e.queues[i]
+	for {
+		select {
+		case p := <-q.ch:
+			e.dispatcher.DeliverNetworkPacket(e, p.remote, p.local, p.protocol, p.vv)
+			q.stats.Delivered.Increment()
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.DeliverNetworkPacket.
+// It is called by the lower endpoints when a packet arrives, and queues the
+// packet to the goroutine responsible for its flow.
+func (e *Endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	q := &e.queues[int(flow.Hash(protocol, vv.First(), flow.FiveTuple, e.seed)%uint32(len(e.queues)))]
+
+	// The caller retains ownership of the slice backing vv, but not of the
+	// views themselves.
+	p := packet{
+		remote:   remote,
+		local:    local,
+		protocol: protocol,
+		vv:       vv.Clone(nil),
+	}
+	select {
+	case q.ch <- p:
+	default:
+		q.stats.Dropped.Increment()
+	}
+}
+
+// DeliverLinkState implements stack.LinkStateDispatcher.DeliverLinkState. It
+// just forwards the carrier change to the actual dispatcher.
+func (e *Endpoint) DeliverLinkState(up bool) {
+	stack.DeliverLinkState(e.dispatcher, up)
+}
+
+// DeliverLinkDrop implements stack.LinkDropDispatcher.DeliverLinkDrop. It
+// just forwards the dropped frame to the actual dispatcher.
+func (e *Endpoint) DeliverLinkDrop(reason tcpip.DropReason, frame buffer.VectorisedView) {
+	stack.DeliverLinkDrop(e.dispatcher, reason, frame)
+}
+
+// Attach implements stack.LinkEndpoint.Attach. It saves the dispatcher, starts
+// the queue goroutines and registers with the lower endpoints as their
+// dispatcher so that "e" is called for inbound packets.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	for i := range e.queues {
+		e.wg.Add(1)
+		go e.queueLoop(i)
+	}
+	for _, l := range e.lowers {
+		l.Attach(e)
+	}
+}
+
+// IsAttached implements stack.LinkEndpoint.IsAttached.
+func (e *Endpoint) IsAttached() bool {
+	return e.dispatcher != nil
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It just forwards the request to the
+// first lower endpoint.
+func (e *Endpoint) MTU() uint32 {
+	return e.lowers[0].MTU()
+}
+
+// SetMTU implements stack.MTUSettableLinkEndpoint.SetMTU. It forwards the
+// request to all lower endpoints.
+func (e *Endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	for _, l := range e.lowers {
+		if err := stack.SetLinkMTU(l, mtu); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
+// request to the first lower endpoint.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lowers[0].Capabilities()
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. It just
+// forwards the request to the first lower endpoint.
+func (e *Endpoint) MaxHeaderLength() uint16 {
+	return e.lowers[0].MaxHeaderLength()
+}
+
+// LinkAddress implements stack.LinkEndpoint.LinkAddress. It just forwards the
+// request to the first lower endpoint.
+func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
+	return e.lowers[0].LinkAddress()
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. It writes the packet
+// to the lower endpoint selected by the packet's flow.
+func (e *Endpoint) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	l := e.lowers[0]
+	if len(e.lowers) > 1 {
+		l = e.lowers[int(flow.Hash(protocol, pkt.Header.View(), flow.FiveTuple, e.seed)%uint32(len(e.lowers)))]
+	}
+	return l.WritePacket(r, pkt, protocol)
+}
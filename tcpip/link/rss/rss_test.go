@@ -0,0 +1,207 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rss
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	numFlows       = 8
+	packetsPerFlow = 100
+)
+
+type dispatcher struct {
+	mu sync.Mutex
+	// seqs holds the sequence numbers received for each flow, in order.
+	seqs  map[uint16][]uint32
+	count int
+	done  chan struct{}
+}
+
+func (d *dispatcher) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	v := vv.ToView()
+	udp := header.UDP(v[header.IPv4MinimumSize:])
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seqs[udp.SourcePort()] = append(d.seqs[udp.SourcePort()], binary.BigEndian.Uint32(udp.Payload()))
+	d.count++
+	if d.count == numFlows*packetsPerFlow {
+		close(d.done)
+	}
+}
+
+// udpPacket builds an IPv4 UDP packet for the flow identified by srcPort,
+// carrying seq as its payload.
+func udpPacket(srcPort uint16, seq uint32) buffer.View {
+	v := buffer.NewView(header.IPv4MinimumSize + header.UDPMinimumSize + 4)
+	ip := header.IPv4(v)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(v)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     "\x0a\x00\x00\x01",
+		DstAddr:     "\x0a\x00\x00\x02",
+	})
+	udp := header.UDP(v[header.IPv4MinimumSize:])
+	udp.Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: 80,
+		Length:  uint16(header.UDPMinimumSize + 4),
+	})
+	binary.BigEndian.PutUint32(udp.Payload(), seq)
+	return v
+}
+
+func TestPerFlowOrdering(t *testing.T) {
+	lowerID, lower := channel.New(1, 1500, "")
+	_, e := New(lowerID, Options{Queues: 4, QueueLen: numFlows * packetsPerFlow})
+	defer e.Close()
+
+	d := &dispatcher{seqs: make(map[uint16][]uint32), done: make(chan struct{})}
+	e.Attach(d)
+
+	for seq := uint32(0); seq < packetsPerFlow; seq++ {
+		for f := uint16(0); f < numFlows; f++ {
+			lower.Inject(header.IPv4ProtocolNumber, udpPacket(1000+f, seq).ToVectorisedView())
+		}
+	}
+
+	select {
+	case <-d.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for packets, got %d", d.count)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for f, seqs := range d.seqs {
+		for i, seq := range seqs {
+			if seq != uint32(i) {
+				t.Fatalf("flow %d: got packet %d at position %d", f, seq, i)
+			}
+		}
+	}
+
+	var delivered uint64
+	for i := 0; i < e.NumQueues(); i++ {
+		delivered += e.QueueStats(i).Delivered.Value()
+	}
+	if want := uint64(numFlows * packetsPerFlow); delivered != want {
+		t.Errorf("got %d packets delivered, want %d", delivered, want)
+	}
+}
+
+func TestMultiQueueWrite(t *testing.T) {
+	var ids []tcpip.LinkEndpointID
+	var lowers []*channel.Endpoint
+	for i := 0; i < 4; i++ {
+		id, l := channel.New(100, 1500, "")
+		ids = append(ids, id)
+		lowers = append(lowers, l)
+	}
+	_, e := NewMultiQueue(ids, Options{Queues: 1})
+	defer e.Close()
+
+	for seq := uint32(0); seq < 10; seq++ {
+		for f := uint16(0); f < numFlows; f++ {
+			v := udpPacket(1000+f, seq)
+			hdr := buffer.NewPrependable(len(v))
+			copy(hdr.Prepend(len(v)), v)
+			if err := e.WritePacket(&stack.Route{}, stack.NewOutboundPacketBuffer(hdr, buffer.VectorisedView{}), header.IPv4ProtocolNumber); err != nil {
+				t.Fatalf("WritePacket failed: %v", err)
+			}
+		}
+	}
+
+	// All packets of a flow must leave through the same queue.
+	queueOf := make(map[uint16]int)
+	total := 0
+	for i, l := range lowers {
+		for len(l.C) > 0 {
+			p := <-l.C
+			port := header.UDP(p.Header[header.IPv4MinimumSize:]).SourcePort()
+			if q, ok := queueOf[port]; ok && q != i {
+				t.Fatalf("flow %d was written to queues %d and %d", port, q, i)
+			}
+			queueOf[port] = i
+			total++
+		}
+	}
+	if want := 10 * numFlows; total != want {
+		t.Errorf("got %d packets written, want %d", total, want)
+	}
+}
+
+func TestQueueFullDrops(t *testing.T) {
+	lowerID, lower := channel.New(1, 1500, "")
+	_, e := New(lowerID, Options{Queues: 1, QueueLen: 1})
+
+	// Attach with a dispatcher that blocks until released, so that the
+	// queue fills up.
+	release := make(chan struct{})
+	e.Attach(blockingDispatcher(release))
+	defer e.Close()
+	defer close(release)
+
+	for i := 0; i < 10; i++ {
+		lower.Inject(header.IPv4ProtocolNumber, udpPacket(1000, uint32(i)).ToVectorisedView())
+	}
+
+	// At most one packet is being delivered and one is queued.
+	if got := e.QueueStats(0).Dropped.Value(); got < 8 {
+		t.Errorf("got %d packets dropped, want at least 8", got)
+	}
+}
+
+func TestPinQueue(t *testing.T) {
+	lowerID, _ := channel.New(1, 1500, "")
+	var mu sync.Mutex
+	pinned := make(map[int]bool)
+	_, e := New(lowerID, Options{
+		Queues: 4,
+		PinQueue: func(queue int) {
+			mu.Lock()
+			pinned[queue] = true
+			mu.Unlock()
+		},
+	})
+	e.Attach(blockingDispatcher(nil))
+
+	// Close waits for the queue goroutines, which all start by calling
+	// PinQueue.
+	e.Close()
+	for i := 0; i < e.NumQueues(); i++ {
+		if !pinned[i] {
+			t.Errorf("queue %d wasn't pinned", i)
+		}
+	}
+}
+
+type blockingDispatcher chan struct{}
+
+func (d blockingDispatcher) DeliverNetworkPacket(stack.LinkEndpoint, tcpip.LinkAddress, tcpip.LinkAddress, tcpip.NetworkProtocolNumber, buffer.VectorisedView) {
+	<-d
+}
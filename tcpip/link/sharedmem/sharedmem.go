@@ -184,9 +184,9 @@ func (e *endpoint) LinkAddress() tcpip.LinkAddress {
 
 // WritePacket writes outbound packets to the file descriptor. If it is not
 // currently writable, the packet is dropped.
-func (e *endpoint) WritePacket(r *stack.Route, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+func (e *endpoint) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
 	// Add the ethernet header here.
-	eth := header.Ethernet(hdr.Prepend(header.EthernetMinimumSize))
+	eth := header.Ethernet(pkt.Header.Prepend(header.EthernetMinimumSize))
 	ethHdr := &header.EthernetFields{
 		DstAddr: r.RemoteLinkAddress,
 		Type:    protocol,
@@ -198,10 +198,16 @@ func (e *endpoint) WritePacket(r *stack.Route, hdr buffer.Prependable, payload b
 	}
 	eth.Encode(ethHdr)
 
-	v := payload.ToView()
+	v := pkt.Data.ToView()
+	if pad := header.EthernetMinimumFrameSize - pkt.Header.UsedLength() - len(v); pad > 0 {
+		// Pad the frame to the minimum ethernet frame size, without
+		// appending to the caller's view in place.
+		v = append(v[:len(v):len(v)], make([]byte, pad)...)
+	}
+
 	// Transmit the packet.
 	e.mu.Lock()
-	ok := e.tx.transmit(hdr.View(), v)
+	ok := e.tx.transmit(pkt.Header.View(), v)
 	e.mu.Unlock()
 
 	if !ok {
@@ -247,12 +253,14 @@ func (e *endpoint) dispatchLoop(d stack.NetworkDispatcher) {
 			rxb[i].Size = e.bufferSize
 		}
 
-		if n < header.EthernetMinimumSize {
+		eth := header.Ethernet(b)
+		if !eth.IsValid(len(b)) {
+			stack.DeliverLinkDrop(d, tcpip.DropMalformed, buffer.View(b).ToVectorisedView())
 			continue
 		}
 
-		// Send packet up the stack.
-		eth := header.Ethernet(b)
+		// Send packet up the stack, without any padding.
+		b = b[:eth.UnpaddedSize(len(b))]
 		d.DeliverNetworkPacket(e, eth.SourceAddress(), eth.DestinationAddress(), eth.Type(), buffer.View(b[header.EthernetMinimumSize:]).ToVectorisedView())
 	}
 
@@ -0,0 +1,350 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sniffer
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+)
+
+// BPFInstruction is an instruction of a classic BPF program, laid out as the
+// sock_filter structure of Linux, so that the output of "tcpdump -y RAW -dd"
+// can be used as is.
+type BPFInstruction struct {
+	Op uint16
+	Jt uint8
+	Jf uint8
+	K  uint32
+}
+
+// Classes, sizes, modes and operations of BPF instructions, as defined by
+// linux/filter.h.
+const (
+	bpfLD   = 0x00
+	bpfLDX  = 0x01
+	bpfST   = 0x02
+	bpfSTX  = 0x03
+	bpfALU  = 0x04
+	bpfJMP  = 0x05
+	bpfRET  = 0x06
+	bpfMISC = 0x07
+
+	bpfW = 0x00
+	bpfH = 0x08
+	bpfB = 0x10
+
+	bpfIMM = 0x00
+	bpfABS = 0x20
+	bpfIND = 0x40
+	bpfMEM = 0x60
+	bpfLEN = 0x80
+	bpfMSH = 0xa0
+
+	bpfADD = 0x00
+	bpfSUB = 0x10
+	bpfMUL = 0x20
+	bpfDIV = 0x30
+	bpfOR  = 0x40
+	bpfAND = 0x50
+	bpfLSH = 0x60
+	bpfRSH = 0x70
+	bpfNEG = 0x80
+	bpfMOD = 0x90
+	bpfXOR = 0xa0
+
+	bpfJA   = 0x00
+	bpfJEQ  = 0x10
+	bpfJGT  = 0x20
+	bpfJGE  = 0x30
+	bpfJSET = 0x40
+
+	bpfK = 0x00
+	bpfX = 0x08
+	bpfA = 0x10
+
+	bpfTAX = 0x00
+	bpfTXA = 0x80
+
+	// bpfMemWords is the number of words of the scratch memory.
+	bpfMemWords = 16
+
+	// bpfMaxInstructions is the maximum length of a program, BPF_MAXINSNS.
+	bpfMaxInstructions = 4096
+)
+
+// BPFFilter is a Filter running a classic BPF program, as the filters attached
+// to packet sockets with SO_ATTACH_FILTER do. The program sees the packet from
+// its network layer header, and records the packet if it returns a non-zero
+// value.
+//
+// Only the start of the packet handed to Match is visible to the program:
+// loads beyond it, like those out of the bounds of the packet on Linux, end
+// the program with a zero return value, and BPF_LEN loads its length. The
+// ancillary data loads of Linux aren't supported.
+type BPFFilter struct {
+	prog []BPFInstruction
+}
+
+// NewBPFFilter returns a BPFFilter running prog, after checking it as Linux
+// does: it must have at most 4096 instructions, end with a return, only jump
+// forward within the program, only access the 16 words of scratch memory and
+// never divide by a zero constant.
+func NewBPFFilter(prog []BPFInstruction) (*BPFFilter, error) {
+	if len(prog) == 0 || len(prog) > bpfMaxInstructions {
+		return nil, fmt.Errorf("invalid program length %d", len(prog))
+	}
+	for pc, ins := range prog {
+		if err := checkBPFInstruction(prog, pc, ins); err != nil {
+			return nil, fmt.Errorf("instruction %d %+v: %v", pc, ins, err)
+		}
+	}
+	if prog[len(prog)-1].Op&0x07 != bpfRET {
+		return nil, fmt.Errorf("program doesn't end with a return")
+	}
+	return &BPFFilter{prog: append([]BPFInstruction(nil), prog...)}, nil
+}
+
+// checkBPFInstruction returns an error if the instruction at pc of prog is
+// invalid.
+func checkBPFInstruction(prog []BPFInstruction, pc int, ins BPFInstruction) error {
+	if ins.Op > 0xff {
+		return fmt.Errorf("invalid opcode %#x", ins.Op)
+	}
+	switch ins.Op & 0x07 {
+	case bpfLD:
+		switch ins.Op {
+		case bpfLD | bpfW | bpfABS, bpfLD | bpfH | bpfABS, bpfLD | bpfB | bpfABS,
+			bpfLD | bpfW | bpfIND, bpfLD | bpfH | bpfIND, bpfLD | bpfB | bpfIND,
+			bpfLD | bpfW | bpfIMM, bpfLD | bpfW | bpfLEN:
+			return nil
+		case bpfLD | bpfW | bpfMEM:
+			return checkBPFMem(ins.K)
+		}
+	case bpfLDX:
+		switch ins.Op {
+		case bpfLDX | bpfW | bpfIMM, bpfLDX | bpfW | bpfLEN, bpfLDX | bpfB | bpfMSH:
+			return nil
+		case bpfLDX | bpfW | bpfMEM:
+			return checkBPFMem(ins.K)
+		}
+	case bpfST, bpfSTX:
+		if ins.Op&0xf8 == 0 {
+			return checkBPFMem(ins.K)
+		}
+	case bpfALU:
+		op := ins.Op & 0xf0
+		switch {
+		case op > bpfXOR:
+		case op == bpfNEG:
+			if ins.Op&bpfX == 0 {
+				return nil
+			}
+		case (op == bpfDIV || op == bpfMOD) && ins.Op&bpfX == bpfK && ins.K == 0:
+			return fmt.Errorf("division by zero")
+		default:
+			return nil
+		}
+	case bpfJMP:
+		op := ins.Op & 0xf0
+		switch {
+		case op > bpfJSET:
+		case op == bpfJA:
+			if ins.Op&bpfX == 0 && uint64(pc)+1+uint64(ins.K) < uint64(len(prog)) {
+				return nil
+			}
+			return fmt.Errorf("jump out of the program")
+		default:
+			if pc+1+int(ins.Jt) < len(prog) && pc+1+int(ins.Jf) < len(prog) {
+				return nil
+			}
+			return fmt.Errorf("jump out of the program")
+		}
+	case bpfRET:
+		switch ins.Op {
+		case bpfRET | bpfK, bpfRET | bpfX, bpfRET | bpfA:
+			return nil
+		}
+	case bpfMISC:
+		switch ins.Op {
+		case bpfMISC | bpfTAX, bpfMISC | bpfTXA:
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid opcode %#x", ins.Op)
+}
+
+// checkBPFMem returns an error if k isn't the index of a word of the scratch
+// memory.
+func checkBPFMem(k uint32) error {
+	if k >= bpfMemWords {
+		return fmt.Errorf("invalid scratch memory index %d", k)
+	}
+	return nil
+}
+
+// Match implements Filter.Match.
+func (f *BPFFilter) Match(_ tcpip.NetworkProtocolNumber, b buffer.View) bool {
+	return f.run(b) != 0
+}
+
+// run runs the program over b and returns its return value. The program is
+// valid, so it only ends early, returning zero, on out-of-bounds loads and
+// divisions by a zero X.
+func (f *BPFFilter) run(b []byte) uint32 {
+	var (
+		a, x uint32
+		mem  [bpfMemWords]uint32
+	)
+	for pc := 0; ; pc++ {
+		ins := f.prog[pc]
+		switch ins.Op & 0x07 {
+		case bpfLD:
+			switch ins.Op & 0xe0 {
+			case bpfIMM:
+				a = ins.K
+			case bpfABS, bpfIND:
+				off := uint64(ins.K)
+				if ins.Op&0xe0 == bpfIND {
+					off += uint64(x)
+				}
+				v, ok := bpfLoad(b, off, ins.Op&0x18)
+				if !ok {
+					return 0
+				}
+				a = v
+			case bpfMEM:
+				a = mem[ins.K]
+			case bpfLEN:
+				a = uint32(len(b))
+			}
+		case bpfLDX:
+			switch ins.Op & 0xe0 {
+			case bpfIMM:
+				x = ins.K
+			case bpfMEM:
+				x = mem[ins.K]
+			case bpfLEN:
+				x = uint32(len(b))
+			case bpfMSH:
+				v, ok := bpfLoad(b, uint64(ins.K), bpfB)
+				if !ok {
+					return 0
+				}
+				x = 4 * (v & 0xf)
+			}
+		case bpfST:
+			mem[ins.K] = a
+		case bpfSTX:
+			mem[ins.K] = x
+		case bpfALU:
+			v := ins.K
+			if ins.Op&bpfX != 0 {
+				v = x
+			}
+			switch ins.Op & 0xf0 {
+			case bpfADD:
+				a += v
+			case bpfSUB:
+				a -= v
+			case bpfMUL:
+				a *= v
+			case bpfDIV:
+				if v == 0 {
+					return 0
+				}
+				a /= v
+			case bpfMOD:
+				if v == 0 {
+					return 0
+				}
+				a %= v
+			case bpfOR:
+				a |= v
+			case bpfAND:
+				a &= v
+			case bpfXOR:
+				a ^= v
+			case bpfLSH:
+				a <<= v
+			case bpfRSH:
+				a >>= v
+			case bpfNEG:
+				a = -a
+			}
+		case bpfJMP:
+			v := ins.K
+			if ins.Op&bpfX != 0 {
+				v = x
+			}
+			var cond bool
+			switch ins.Op & 0xf0 {
+			case bpfJA:
+				pc += int(ins.K)
+				continue
+			case bpfJEQ:
+				cond = a == v
+			case bpfJGT:
+				cond = a > v
+			case bpfJGE:
+				cond = a >= v
+			case bpfJSET:
+				cond = a&v != 0
+			}
+			if cond {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case bpfRET:
+			switch ins.Op & 0x18 {
+			case bpfK:
+				return ins.K
+			case bpfX:
+				return x
+			default:
+				return a
+			}
+		case bpfMISC:
+			if ins.Op&0xf8 == bpfTAX {
+				x = a
+			} else {
+				a = x
+			}
+		}
+	}
+}
+
+// bpfLoad loads the word, half-word or byte of b at off, as given by size, and
+// returns false if it isn't all in b.
+func bpfLoad(b []byte, off uint64, size uint16) (uint32, bool) {
+	switch size {
+	case bpfW:
+		if off+4 <= uint64(len(b)) {
+			return binary.BigEndian.Uint32(b[off:]), true
+		}
+	case bpfH:
+		if off+2 <= uint64(len(b)) {
+			return uint32(binary.BigEndian.Uint16(b[off:])), true
+		}
+	default:
+		if off < uint64(len(b)) {
+			return uint32(b[off]), true
+		}
+	}
+	return 0, false
+}
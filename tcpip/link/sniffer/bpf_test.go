@@ -0,0 +1,90 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sniffer
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip/header"
+)
+
+// udpPort53 is the program of "udp dst port 53" for IPv4 packets.
+var udpPort53 = []BPFInstruction{
+	{0x30, 0, 0, 9},     // ldb [9]
+	{0x15, 0, 4, 17},    // jeq #17, L1, L6
+	{0xb1, 0, 0, 0},     // ldxb 4*([0]&0xf)
+	{0x48, 0, 0, 2},     // ldh [x+2]
+	{0x15, 0, 1, 53},    // jeq #53, L5, L6
+	{0x06, 0, 0, 65535}, // ret #65535
+	{0x06, 0, 0, 0},     // ret #0
+}
+
+func TestBPFFilter(t *testing.T) {
+	f, err := NewBPFFilter(udpPort53)
+	if err != nil {
+		t.Fatalf("NewBPFFilter: %v", err)
+	}
+	for _, test := range []struct {
+		name string
+		pkt  []byte
+		want bool
+	}{
+		{"matching", udpPacket("\x0a\x00\x00\x01", "\x0a\x00\x00\x02", 1234, 53), true},
+		{"other port", udpPacket("\x0a\x00\x00\x01", "\x0a\x00\x00\x02", 53, 1234), false},
+		{"truncated", udpPacket("\x0a\x00\x00\x01", "\x0a\x00\x00\x02", 1234, 53)[:header.IPv4MinimumSize+2], false},
+	} {
+		if got := f.Match(header.IPv4ProtocolNumber, test.pkt); got != test.want {
+			t.Errorf("%s: Match = %t, want %t", test.name, got, test.want)
+		}
+	}
+
+	// Arithmetic, scratch memory and register transfers.
+	f, err = NewBPFFilter([]BPFInstruction{
+		{0x80, 0, 0, 0}, // ld #len
+		{0x02, 0, 0, 3}, // st M[3]
+		{0x00, 0, 0, 6}, // ld #6
+		{0x07, 0, 0, 0}, // tax
+		{0x60, 0, 0, 3}, // ld M[3]
+		{0x3c, 0, 0, 0}, // div x
+		{0x94, 0, 0, 3}, // mod #3
+		{0x84, 0, 0, 0}, // neg
+		{0x16, 0, 0, 0}, // ret a
+	})
+	if err != nil {
+		t.Fatalf("NewBPFFilter: %v", err)
+	}
+	// The packets are 28 bytes long: -((28 / 6) % 3) is -1.
+	if got, want := f.run(udpPacket("\x0a\x00\x00\x01", "\x0a\x00\x00\x02", 1, 2)), uint32(0xffffffff); got != want {
+		t.Errorf("run = %#x, want %#x", got, want)
+	}
+
+	for _, test := range []struct {
+		name string
+		prog []BPFInstruction
+	}{
+		{"empty", nil},
+		{"no return", udpPort53[:5]},
+		{"jump out", []BPFInstruction{{0x15, 1, 0, 0}, {0x06, 0, 0, 0}}},
+		{"long jump out", []BPFInstruction{{0x05, 0, 0, 1}, {0x06, 0, 0, 0}}},
+		{"scratch memory out", []BPFInstruction{{0x02, 0, 0, 16}, {0x06, 0, 0, 0}}},
+		{"division by zero", []BPFInstruction{{0x34, 0, 0, 0}, {0x06, 0, 0, 0}}},
+		{"invalid opcode", []BPFInstruction{{0xff, 0, 0, 0}, {0x06, 0, 0, 0}}},
+		{"opcode out of range", []BPFInstruction{{0x28 | 0x100, 0, 0, 0}, {0x06, 0, 0, 0}}},
+	} {
+		if _, err := NewBPFFilter(test.prog); err == nil {
+			t.Errorf("%s: NewBPFFilter succeeded, want error", test.name)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sniffer
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// CaptureStack writes the packets crossing the NIC of s with the given ID, or
+// all its NICs if it is 0, in the given direction to w, in the pcapng format.
+// Unlike the sniffer link endpoints, it doesn't need to be set up when the NICs
+// are created. Each NIC is recorded as a separate interface, named after the
+// NIC or its ID if it has no name.
+//
+// The returned function stops the capture; it doesn't close w.
+func CaptureStack(s *stack.Stack, nic tcpip.NICID, dir stack.CaptureDirection, w *PCAPNGWriter) (stop func()) {
+	var (
+		mu         sync.Mutex
+		interfaces = make(map[tcpip.NICID]uint32)
+	)
+	return s.AddCapture(nic, dir, func(p stack.CapturedPacket) {
+		mu.Lock()
+		id, ok := interfaces[p.NIC]
+		if !ok {
+			name := p.NICName
+			if name == "" {
+				name = strconv.Itoa(int(p.NIC))
+			}
+			var err error
+			if id, err = w.addInterface(name); err != nil {
+				mu.Unlock()
+				panic(err)
+			}
+			interfaces[p.NIC] = id
+		}
+		mu.Unlock()
+
+		if err := w.writePacketAt(id, p.Inbound, p.Timestamp, p.Data.Views()); err != nil {
+			panic(err)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sniffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/faketime"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+func TestCaptureStack(t *testing.T) {
+	const timestamp = 0x0102030405060708
+	clock := faketime.NewManualClock()
+	clock.Advance(timestamp)
+	s := stack.New([]string{ipv4.ProtocolName}, nil, stack.Options{Clock: clock})
+	id, linkEP := channel.New(10, 1500, "")
+	if err := s.CreateNamedNIC(1, "eth0", id); err != nil {
+		t.Fatalf("CreateNamedNIC failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	w, err := NewPCAPNGWriter(PCAPNGOptions{Writer: &out})
+	if err != nil {
+		t.Fatalf("NewPCAPNGWriter failed: %v", err)
+	}
+	stop := CaptureStack(s, 0, stack.CaptureInbound, w)
+
+	pkt := buffer.NewView(header.IPv4MinimumSize)
+	header.IPv4(pkt).Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: header.IPv4MinimumSize,
+		TTL:         64,
+		SrcAddr:     "\x0a\x00\x00\x02",
+		DstAddr:     "\x0a\x00\x00\x01",
+	})
+	linkEP.Inject(ipv4.ProtocolNumber, pkt.ToVectorisedView())
+	stop()
+	linkEP.Inject(ipv4.ProtocolNumber, pkt.ToVectorisedView())
+
+	blocks := parseBlocks(t, out.Bytes())
+	if got, want := len(blocks), 3; got != want {
+		t.Fatalf("got %d blocks, want %d", got, want)
+	}
+	for i, typ := range []uint32{pcapngSectionHeaderBlock, pcapngInterfaceDescBlock, pcapngEnhancedPacketBlock} {
+		if blocks[i].typ != typ {
+			t.Errorf("block %d type = %#x, want %#x", i, blocks[i].typ, typ)
+		}
+	}
+	if !bytes.Contains(blocks[1].body, []byte("eth0")) {
+		t.Errorf("interface block %x doesn't name eth0", blocks[1].body)
+	}
+
+	epb := blocks[2].body
+	if hi, lo := binary.BigEndian.Uint32(epb[4:]), binary.BigEndian.Uint32(epb[8:]); uint64(hi)<<32|uint64(lo) != timestamp {
+		t.Errorf("got timestamp %#x%08x, want %#x", hi, lo, timestamp)
+	}
+	if got, want := epb[20:20+len(pkt)], []byte(pkt); !bytes.Equal(got, want) {
+		t.Errorf("packet data = %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sniffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// A Filter selects which packets a sniffer endpoint records. Packets that
+// don't match are neither logged nor written to a capture file; they are
+// still forwarded as usual.
+type Filter interface {
+	// Match returns whether the packet should be recorded. b holds the
+	// start of the packet, beginning with the network layer header, and
+	// may not contain the whole packet.
+	Match(protocol tcpip.NetworkProtocolNumber, b buffer.View) bool
+}
+
+// FilterFunc is an adapter that allows an ordinary function to be used as a
+// Filter.
+type FilterFunc func(protocol tcpip.NetworkProtocolNumber, b buffer.View) bool
+
+// Match implements Filter.Match.
+func (f FilterFunc) Match(protocol tcpip.NetworkProtocolNumber, b buffer.View) bool {
+	return f(protocol, b)
+}
+
+// MatchFilter is a Filter that selects packets by protocol, address and port.
+// Zero-valued fields match any packet; all non-zero fields must match for a
+// packet to be recorded.
+type MatchFilter struct {
+	// NetworkProtocol is the network protocol of the packet.
+	NetworkProtocol tcpip.NetworkProtocolNumber
+
+	// TransportProtocol is the transport protocol of the packet. Only
+	// IPv4 and IPv6 packets have a transport protocol.
+	TransportProtocol tcpip.TransportProtocolNumber
+
+	// Address is matched against both the source and destination
+	// addresses of IPv4 and IPv6 packets.
+	Address tcpip.Address
+
+	// Port is matched against both the source and destination ports of
+	// TCP and UDP packets.
+	Port uint16
+}
+
+// Match implements Filter.Match.
+func (m *MatchFilter) Match(protocol tcpip.NetworkProtocolNumber, b buffer.View) bool {
+	if m.NetworkProtocol != 0 && m.NetworkProtocol != protocol {
+		return false
+	}
+	if m.TransportProtocol == 0 && m.Address == "" && m.Port == 0 {
+		return true
+	}
+
+	var (
+		src, dst  tcpip.Address
+		transport tcpip.TransportProtocolNumber
+		payload   []byte
+	)
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		if len(b) < header.IPv4MinimumSize {
+			return false
+		}
+		ipv4 := header.IPv4(b)
+		hlen := int(ipv4.HeaderLength())
+		if hlen < header.IPv4MinimumSize || hlen > len(b) {
+			return false
+		}
+		src, dst = ipv4.SourceAddress(), ipv4.DestinationAddress()
+		transport = ipv4.TransportProtocol()
+		// Only the first fragment carries the transport header.
+		if ipv4.FragmentOffset() == 0 {
+			payload = b[hlen:]
+		}
+	case header.IPv6ProtocolNumber:
+		if len(b) < header.IPv6MinimumSize {
+			return false
+		}
+		ipv6 := header.IPv6(b)
+		src, dst = ipv6.SourceAddress(), ipv6.DestinationAddress()
+		transport = ipv6.TransportProtocol()
+		payload = b[header.IPv6MinimumSize:]
+	default:
+		return false
+	}
+
+	if m.TransportProtocol != 0 && m.TransportProtocol != transport {
+		return false
+	}
+	if m.Address != "" && m.Address != src && m.Address != dst {
+		return false
+	}
+	if m.Port != 0 {
+		if transport != header.TCPProtocolNumber && transport != header.UDPProtocolNumber {
+			return false
+		}
+		// The source and destination ports are the first 4 bytes of both
+		// the TCP and UDP headers.
+		if len(payload) < 4 {
+			return false
+		}
+		srcPort := binary.BigEndian.Uint16(payload[0:])
+		dstPort := binary.BigEndian.Uint16(payload[2:])
+		if m.Port != srcPort && m.Port != dstPort {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseFilter parses a MatchFilter from a filter expression, a sequence of
+// whitespace-separated primitives that must all match, in the syntax of
+// tcpdump:
+//
+//	ip, ip6                the network protocol
+//	tcp, udp, icmp, icmp6  the transport protocol
+//	host ADDR              the source or destination address
+//	port PORT              the source or destination port
+//
+// Each kind of primitive may appear once. An empty expression matches every
+// packet.
+func ParseFilter(expr string) (*MatchFilter, error) {
+	var m MatchFilter
+	fields := strings.Fields(expr)
+	for i := 0; i < len(fields); i++ {
+		switch f := fields[i]; f {
+		case "ip", "ip6":
+			if m.NetworkProtocol != 0 {
+				return nil, fmt.Errorf("more than one network protocol: %s", expr)
+			}
+			m.NetworkProtocol = header.IPv4ProtocolNumber
+			if f == "ip6" {
+				m.NetworkProtocol = header.IPv6ProtocolNumber
+			}
+		case "tcp", "udp", "icmp", "icmp6":
+			if m.TransportProtocol != 0 {
+				return nil, fmt.Errorf("more than one transport protocol: %s", expr)
+			}
+			m.TransportProtocol = map[string]tcpip.TransportProtocolNumber{
+				"tcp":   header.TCPProtocolNumber,
+				"udp":   header.UDPProtocolNumber,
+				"icmp":  header.ICMPv4ProtocolNumber,
+				"icmp6": header.ICMPv6ProtocolNumber,
+			}[f]
+		case "host":
+			if i+1 == len(fields) {
+				return nil, fmt.Errorf("missing address: %s", expr)
+			}
+			if m.Address != "" {
+				return nil, fmt.Errorf("more than one host: %s", expr)
+			}
+			i++
+			ip := net.ParseIP(fields[i])
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s: %s", fields[i], expr)
+			}
+			if ip4 := ip.To4(); ip4 != nil && !strings.Contains(fields[i], ":") {
+				m.Address = tcpip.Address(ip4)
+			} else {
+				m.Address = tcpip.Address(ip)
+			}
+		case "port":
+			if i+1 == len(fields) {
+				return nil, fmt.Errorf("missing port: %s", expr)
+			}
+			if m.Port != 0 {
+				return nil, fmt.Errorf("more than one port: %s", expr)
+			}
+			i++
+			port, err := strconv.ParseUint(fields[i], 10, 16)
+			if err != nil || port == 0 {
+				return nil, fmt.Errorf("invalid port %s: %s", fields[i], expr)
+			}
+			m.Port = uint16(port)
+		default:
+			return nil, fmt.Errorf("unknown primitive %s: %s", f, expr)
+		}
+	}
+	return &m, nil
+}
+
+// filterHolder wraps a Filter so that a nil Filter can be stored in an
+// atomic.Value.
+type filterHolder struct {
+	f Filter
+}
+
+// SetFilter attaches a filter to the sniffer endpoint with the given ID,
+// replacing any previous filter. A nil filter records every packet, which is
+// the default. Filters can be built from expressions with ParseFilter, or from
+// classic BPF programs with NewBPFFilter.
+func SetFilter(id tcpip.LinkEndpointID, f Filter) *tcpip.Error {
+	e, ok := stack.FindLinkEndpoint(id).(*endpoint)
+	if !ok {
+		return tcpip.ErrBadLinkEndpoint
+	}
+	e.filter.Store(filterHolder{f})
+	return nil
+}
+
+// shouldRecord returns whether a packet passes the endpoint's filter.
+func (e *endpoint) shouldRecord(protocol tcpip.NetworkProtocolNumber, b buffer.View) bool {
+	h, _ := e.filter.Load().(filterHolder)
+	return h.f == nil || h.f.Match(protocol, b)
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sniffer
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+func udpPacket(src, dst tcpip.Address, srcPort, dstPort uint16) buffer.View {
+	b := buffer.NewView(header.IPv4MinimumSize + header.UDPMinimumSize)
+	header.IPv4(b).Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	header.UDP(b[header.IPv4MinimumSize:]).Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Length:  header.UDPMinimumSize,
+	})
+	return b
+}
+
+func TestMatchFilter(t *testing.T) {
+	pkt := udpPacket("\x0a\x00\x00\x01", "\x0a\x00\x00\x02", 1234, 53)
+
+	tests := []struct {
+		name   string
+		filter MatchFilter
+		want   bool
+	}{
+		{"empty", MatchFilter{}, true},
+		{"network protocol", MatchFilter{NetworkProtocol: header.IPv4ProtocolNumber}, true},
+		{"other network protocol", MatchFilter{NetworkProtocol: header.IPv6ProtocolNumber}, false},
+		{"transport protocol", MatchFilter{TransportProtocol: header.UDPProtocolNumber}, true},
+		{"other transport protocol", MatchFilter{TransportProtocol: header.TCPProtocolNumber}, false},
+		{"source address", MatchFilter{Address: "\x0a\x00\x00\x01"}, true},
+		{"destination address", MatchFilter{Address: "\x0a\x00\x00\x02"}, true},
+		{"other address", MatchFilter{Address: "\x0a\x00\x00\x03"}, false},
+		{"source port", MatchFilter{Port: 1234}, true},
+		{"destination port", MatchFilter{Port: 53}, true},
+		{"other port", MatchFilter{Port: 80}, false},
+		{"all", MatchFilter{header.IPv4ProtocolNumber, header.UDPProtocolNumber, "\x0a\x00\x00\x02", 53}, true},
+	}
+	for _, test := range tests {
+		if got := test.filter.Match(header.IPv4ProtocolNumber, pkt); got != test.want {
+			t.Errorf("%s: Match = %t, want %t", test.name, got, test.want)
+		}
+	}
+
+	if (&MatchFilter{Port: 53}).Match(header.IPv4ProtocolNumber, pkt[:header.IPv4MinimumSize]) {
+		t.Errorf("Match on truncated packet = true, want false")
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		expr string
+		want MatchFilter
+	}{
+		{"", MatchFilter{}},
+		{"ip udp host 10.0.0.2 port 53", MatchFilter{header.IPv4ProtocolNumber, header.UDPProtocolNumber, "\x0a\x00\x00\x02", 53}},
+		{"  ip6   icmp6 ", MatchFilter{NetworkProtocol: header.IPv6ProtocolNumber, TransportProtocol: header.ICMPv6ProtocolNumber}},
+		{"host ::ffff:10.0.0.1", MatchFilter{Address: "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x0a\x00\x00\x01"}},
+		{"port 80 tcp", MatchFilter{TransportProtocol: header.TCPProtocolNumber, Port: 80}},
+	}
+	for _, test := range tests {
+		got, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", test.expr, err)
+			continue
+		}
+		if *got != test.want {
+			t.Errorf("ParseFilter(%q) = %+v, want %+v", test.expr, *got, test.want)
+		}
+	}
+
+	for _, expr := range []string{
+		"ip ip6",
+		"tcp udp",
+		"host",
+		"host bogus",
+		"host 10.0.0.1 host 10.0.0.2",
+		"port",
+		"port 0",
+		"port 65536",
+		"port 53 port 80",
+		"arp",
+	} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("ParseFilter(%q) succeeded, want error", expr)
+		}
+	}
+}
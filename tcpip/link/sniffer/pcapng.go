@@ -0,0 +1,361 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sniffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip/buffer"
+)
+
+// Block types and options, from
+// https://github.com/pcapng/pcapng/blob/master/draft-tuexen-opsawg-pcapng.xml
+const (
+	pcapngSectionHeaderBlock   = 0x0a0d0d0a
+	pcapngInterfaceDescBlock   = 0x00000001
+	pcapngEnhancedPacketBlock  = 0x00000006
+	pcapngByteOrderMagic       = 0x1a2b3c4d
+	pcapngOptEndOfOpt          = 0
+	pcapngOptIfName            = 2
+	pcapngOptIfTSResol         = 9
+	pcapngOptEPBFlags          = 2
+	pcapngTSResolNanoseconds   = 9
+	pcapngLinkTypeRaw          = 101
+	pcapngDefaultSnapLen       = 65535
+	pcapngEPBFlagInbound       = 1
+	pcapngEPBFlagOutbound      = 2
+	pcapngBlockTrailerLen      = 4
+	pcapngEnhancedPacketHdrLen = 28
+)
+
+// PCAPNGOptions configures a PCAPNGWriter.
+type PCAPNGOptions struct {
+	// Path is the file the capture is written to. When MaxFileSize is set,
+	// rotated files are named Path.1, Path.2, and so on.
+	//
+	// Exactly one of Path and Writer must be set.
+	Path string
+
+	// Writer is an alternative destination for the capture. Captures
+	// written to a Writer are never rotated.
+	Writer io.Writer
+
+	// SnapLen is the maximum number of bytes of each packet that are
+	// saved. If zero, 65535 is used.
+	SnapLen uint32
+
+	// MaxFileSize is the size, in bytes, after which the current file is
+	// closed and a new one started. If zero, files are never rotated.
+	MaxFileSize int64
+
+	// MaxFiles is the number of rotated files kept. Once reached, the
+	// oldest file is overwritten. If zero, the number of files is
+	// unbounded.
+	MaxFiles int
+}
+
+type pcapngInterface struct {
+	name string
+}
+
+// PCAPNGWriter writes packets captured by one or more sniffer endpoints in
+// the pcapng format, with nanosecond timestamps. Each sniffer endpoint using
+// the writer is recorded as a separate interface.
+//
+// Capturing can be enabled and disabled at runtime with SetEnabled.
+type PCAPNGWriter struct {
+	opts PCAPNGOptions
+
+	// enabled must be accessed atomically.
+	enabled uint32
+
+	mu         sync.Mutex
+	w          io.Writer
+	file       *os.File
+	fileIndex  int
+	written    int64
+	interfaces []pcapngInterface
+}
+
+// NewPCAPNGWriter creates a new pcapng writer with the given options. The
+// writer starts enabled.
+func NewPCAPNGWriter(opts PCAPNGOptions) (*PCAPNGWriter, error) {
+	if (opts.Path == "") == (opts.Writer == nil) {
+		return nil, fmt.Errorf("exactly one of Path and Writer must be set")
+	}
+	if opts.SnapLen == 0 {
+		opts.SnapLen = pcapngDefaultSnapLen
+	}
+	w := &PCAPNGWriter{
+		opts:    opts,
+		enabled: 1,
+		w:       opts.Writer,
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if opts.Path != "" {
+		if err := w.openLocked(); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	if err := w.writeHeadersLocked(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// SetEnabled enables or disables packet capture.
+func (w *PCAPNGWriter) SetEnabled(enable bool) {
+	v := uint32(0)
+	if enable {
+		v = 1
+	}
+	atomic.StoreUint32(&w.enabled, v)
+}
+
+// Enabled returns whether packet capture is enabled.
+func (w *PCAPNGWriter) Enabled() bool {
+	return atomic.LoadUint32(&w.enabled) == 1
+}
+
+// Close closes the current capture file, if the writer owns one. Packets
+// written after Close are dropped.
+func (w *PCAPNGWriter) Close() error {
+	w.SetEnabled(false)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.w = nil
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// addInterface registers a new interface and returns its pcapng interface ID.
+func (w *PCAPNGWriter) addInterface(name string) (uint32, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	id := uint32(len(w.interfaces))
+	w.interfaces = append(w.interfaces, pcapngInterface{name: name})
+	if w.w == nil {
+		return id, nil
+	}
+	return id, w.writeLocked(w.interfaceBlock(name))
+}
+
+// openLocked opens the file for the current file index and writes the
+// section and interface headers to it.
+//
+// Precondition: w.mu must be held.
+func (w *PCAPNGWriter) openLocked() error {
+	path := w.opts.Path
+	if w.fileIndex != 0 {
+		path = fmt.Sprintf("%s.%d", path, w.fileIndex)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.w = f
+	w.written = 0
+	return w.writeHeadersLocked()
+}
+
+// rotateLocked closes the current file and starts the next one.
+//
+// Precondition: w.mu must be held.
+func (w *PCAPNGWriter) rotateLocked() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.fileIndex++
+	if w.opts.MaxFiles > 0 {
+		w.fileIndex %= w.opts.MaxFiles
+	}
+	return w.openLocked()
+}
+
+// writeHeadersLocked writes a section header block followed by an interface
+// description block for every known interface, so that each file produced by
+// rotation can be read on its own.
+//
+// Precondition: w.mu must be held.
+func (w *PCAPNGWriter) writeHeadersLocked() error {
+	if err := w.writeLocked(sectionHeaderBlock()); err != nil {
+		return err
+	}
+	for _, i := range w.interfaces {
+		if err := w.writeLocked(w.interfaceBlock(i.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLocked writes a complete block to the underlying writer.
+//
+// Precondition: w.mu must be held.
+func (w *PCAPNGWriter) writeLocked(b []byte) error {
+	n, err := w.w.Write(b)
+	w.written += int64(n)
+	return err
+}
+
+// writePacket writes an enhanced packet block containing the concatenation
+// of views, truncated to the snap length, for the given interface.
+func (w *PCAPNGWriter) writePacket(id uint32, inbound bool, views []buffer.View) error {
+	return w.writePacketAt(id, inbound, time.Now().UnixNano(), views)
+}
+
+// writePacketAt is like writePacket, but with the timestamp of the packet in
+// nanoseconds since the Unix epoch.
+func (w *PCAPNGWriter) writePacketAt(id uint32, inbound bool, timestamp int64, views []buffer.View) error {
+	if !w.Enabled() {
+		return nil
+	}
+
+	length := 0
+	for _, v := range views {
+		length += len(v)
+	}
+	capLen := length
+	if capLen > int(w.opts.SnapLen) {
+		capLen = int(w.opts.SnapLen)
+	}
+	flags := uint32(pcapngEPBFlagOutbound)
+	if inbound {
+		flags = pcapngEPBFlagInbound
+	}
+
+	// Block header, packet data, the epb_flags option, the end of options
+	// marker and the trailing block length.
+	blockLen := pcapngEnhancedPacketHdrLen + pad4(capLen) + 8 + 4 + pcapngBlockTrailerLen
+	now := uint64(timestamp)
+
+	buf := bytes.NewBuffer(make([]byte, 0, blockLen))
+	writeUint32s(buf,
+		pcapngEnhancedPacketBlock,
+		uint32(blockLen),
+		id,
+		uint32(now>>32),
+		uint32(now),
+		uint32(capLen),
+		uint32(length),
+	)
+	remaining := capLen
+	for _, v := range views {
+		if remaining == 0 {
+			break
+		}
+		if len(v) > remaining {
+			v = v[:remaining]
+		}
+		buf.Write(v)
+		remaining -= len(v)
+	}
+	buf.Write(make([]byte, pad4(capLen)-capLen))
+	writeOption(buf, pcapngOptEPBFlags, uint32Bytes(flags))
+	writeOption(buf, pcapngOptEndOfOpt, nil)
+	writeUint32s(buf, uint32(blockLen))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.w == nil {
+		return nil
+	}
+	if w.file != nil && w.opts.MaxFileSize > 0 && w.written+int64(blockLen) > w.opts.MaxFileSize {
+		if err := w.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	return w.writeLocked(buf.Bytes())
+}
+
+// interfaceBlock returns an interface description block for an interface
+// with the given name.
+func (w *PCAPNGWriter) interfaceBlock(name string) []byte {
+	var opts bytes.Buffer
+	if name != "" {
+		writeOption(&opts, pcapngOptIfName, []byte(name))
+	}
+	writeOption(&opts, pcapngOptIfTSResol, []byte{pcapngTSResolNanoseconds})
+	writeOption(&opts, pcapngOptEndOfOpt, nil)
+
+	blockLen := 16 + opts.Len() + pcapngBlockTrailerLen
+	buf := bytes.NewBuffer(make([]byte, 0, blockLen))
+	writeUint32s(buf,
+		pcapngInterfaceDescBlock,
+		uint32(blockLen),
+		pcapngLinkTypeRaw<<16, // LinkType and Reserved.
+		w.opts.SnapLen,
+	)
+	buf.Write(opts.Bytes())
+	writeUint32s(buf, uint32(blockLen))
+	return buf.Bytes()
+}
+
+// sectionHeaderBlock returns a section header block with an unspecified
+// section length.
+func sectionHeaderBlock() []byte {
+	const blockLen = 28
+	buf := bytes.NewBuffer(make([]byte, 0, blockLen))
+	writeUint32s(buf,
+		pcapngSectionHeaderBlock,
+		blockLen,
+		pcapngByteOrderMagic,
+		1<<16,                  // Major version 1, minor version 0.
+		0xffffffff, 0xffffffff, // Section length is not specified.
+		blockLen,
+	)
+	return buf.Bytes()
+}
+
+// writeOption appends a pcapng option, padded to 32 bits, to buf.
+func writeOption(buf *bytes.Buffer, code uint16, value []byte) {
+	var hdr [4]byte
+	binary.BigEndian.PutUint16(hdr[0:], code)
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(value)))
+	buf.Write(hdr[:])
+	buf.Write(value)
+	buf.Write(make([]byte, pad4(len(value))-len(value)))
+}
+
+func writeUint32s(buf *bytes.Buffer, vs ...uint32) {
+	for _, v := range vs {
+		buf.Write(uint32Bytes(v))
+	}
+}
+
+func uint32Bytes(v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return b[:]
+}
+
+// pad4 rounds n up to the next multiple of 4.
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sniffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/netstack/tcpip/buffer"
+)
+
+type block struct {
+	typ  uint32
+	body []byte
+}
+
+// parseBlocks splits a pcapng capture into its blocks, checking that the
+// leading and trailing block lengths agree.
+func parseBlocks(t *testing.T, b []byte) []block {
+	var blocks []block
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block: %x", b)
+		}
+		typ := binary.BigEndian.Uint32(b)
+		l := int(binary.BigEndian.Uint32(b[4:]))
+		if l%4 != 0 || l > len(b) {
+			t.Fatalf("bad block length %d, remaining %d", l, len(b))
+		}
+		if trailer := int(binary.BigEndian.Uint32(b[l-4:])); trailer != l {
+			t.Fatalf("block trailer length = %d, want %d", trailer, l)
+		}
+		blocks = append(blocks, block{typ: typ, body: b[8 : l-4]})
+		b = b[l:]
+	}
+	return blocks
+}
+
+func TestPCAPNGWriter(t *testing.T) {
+	var out bytes.Buffer
+	w, err := NewPCAPNGWriter(PCAPNGOptions{Writer: &out, SnapLen: 6})
+	if err != nil {
+		t.Fatalf("NewPCAPNGWriter failed: %v", err)
+	}
+	id, err := w.addInterface("eth0")
+	if err != nil {
+		t.Fatalf("addInterface failed: %v", err)
+	}
+	if err := w.writePacket(id, true, []buffer.View{{1, 2, 3}, {4, 5, 6, 7, 8}}); err != nil {
+		t.Fatalf("writePacket failed: %v", err)
+	}
+	w.SetEnabled(false)
+	if err := w.writePacket(id, false, []buffer.View{{1}}); err != nil {
+		t.Fatalf("writePacket failed: %v", err)
+	}
+
+	blocks := parseBlocks(t, out.Bytes())
+	if got, want := len(blocks), 3; got != want {
+		t.Fatalf("got %d blocks, want %d", got, want)
+	}
+	for i, typ := range []uint32{pcapngSectionHeaderBlock, pcapngInterfaceDescBlock, pcapngEnhancedPacketBlock} {
+		if blocks[i].typ != typ {
+			t.Errorf("block %d type = %#x, want %#x", i, blocks[i].typ, typ)
+		}
+	}
+
+	epb := blocks[2].body
+	if got := binary.BigEndian.Uint32(epb[0:]); got != id {
+		t.Errorf("interface id = %d, want %d", got, id)
+	}
+	if capLen, origLen := binary.BigEndian.Uint32(epb[12:]), binary.BigEndian.Uint32(epb[16:]); capLen != 6 || origLen != 8 {
+		t.Errorf("got captured/original length %d/%d, want 6/8", capLen, origLen)
+	}
+	if got, want := epb[20:26], []byte{1, 2, 3, 4, 5, 6}; !bytes.Equal(got, want) {
+		t.Errorf("packet data = %v, want %v", got, want)
+	}
+	if flags := binary.BigEndian.Uint32(epb[32:]); flags != pcapngEPBFlagInbound {
+		t.Errorf("epb_flags = %d, want %d", flags, pcapngEPBFlagInbound)
+	}
+}
+
+func TestPCAPNGWriterRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapng")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "capture.pcapng")
+	w, err := NewPCAPNGWriter(PCAPNGOptions{Path: path, MaxFileSize: 200, MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("NewPCAPNGWriter failed: %v", err)
+	}
+	id, err := w.addInterface("")
+	if err != nil {
+		t.Fatalf("addInterface failed: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := w.writePacket(id, false, []buffer.View{make([]byte, 40)}); err != nil {
+			t.Fatalf("writePacket failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	for _, p := range []string{path, path + ".1"} {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("ReadFile(%s) failed: %v", p, err)
+		}
+		if len(b) > 200 {
+			t.Errorf("%s is %d bytes, want at most 200", p, len(b))
+		}
+		blocks := parseBlocks(t, b)
+		if len(blocks) < 2 || blocks[0].typ != pcapngSectionHeaderBlock || blocks[1].typ != pcapngInterfaceDescBlock {
+			t.Errorf("%s does not start with section and interface headers", p)
+		}
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Errorf("got Stat(%s.2) = %v, want not exist", path, err)
+	}
+}
@@ -54,6 +54,15 @@ type endpoint struct {
 	lower      stack.LinkEndpoint
 	file       *os.File
 	maxPCAPLen uint32
+
+	// pcapng, if not nil, is the writer packets are captured to. In that
+	// case pcapngID is the interface ID assigned to this endpoint.
+	pcapng   *PCAPNGWriter
+	pcapngID uint32
+
+	// filter holds a filterHolder with the Filter packets must match to be
+	// recorded.
+	filter atomic.Value
 }
 
 // New creates a new sniffer link-layer endpoint. It wraps around another
@@ -113,13 +122,63 @@ func NewWithFile(lower tcpip.LinkEndpointID, file *os.File, snapLen uint32) (tcp
 	}), nil
 }
 
+// NewWithPCAPNG creates a new sniffer link-layer endpoint. It wraps around
+// another endpoint and writes packets as they traverse the endpoint to w, in
+// the pcapng format. name is recorded as the interface name in the capture
+// and may be empty.
+//
+// Several sniffers may share the same writer; each one appears as a distinct
+// interface in the capture. A sniffer created with this function will not emit
+// packets using the standard log package.
+func NewWithPCAPNG(lower tcpip.LinkEndpointID, w *PCAPNGWriter, name string) (tcpip.LinkEndpointID, error) {
+	id, err := w.addInterface(name)
+	if err != nil {
+		return 0, err
+	}
+	return stack.RegisterLinkEndpoint(&endpoint{
+		lower:    stack.FindLinkEndpoint(lower),
+		pcapng:   w,
+		pcapngID: id,
+	}), nil
+}
+
+// shouldLog returns whether packets should be logged via the log package.
+func (e *endpoint) shouldLog() bool {
+	return atomic.LoadUint32(&LogPackets) == 1 && e.file == nil && e.pcapng == nil
+}
+
 // DeliverNetworkPacket implements the stack.NetworkDispatcher interface. It is
 // called by the link-layer endpoint being wrapped when a packet arrives, and
 // logs the packet before forwarding to the actual dispatcher.
 func (e *endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
-	if atomic.LoadUint32(&LogPackets) == 1 && e.file == nil {
+	if e.shouldRecord(protocol, vv.First()) {
+		e.recordInbound(protocol, vv)
+	}
+	e.dispatcher.DeliverNetworkPacket(e, remote, local, protocol, vv)
+}
+
+// DeliverLinkState implements stack.LinkStateDispatcher.DeliverLinkState. It
+// just forwards the carrier change to the actual dispatcher.
+func (e *endpoint) DeliverLinkState(up bool) {
+	stack.DeliverLinkState(e.dispatcher, up)
+}
+
+// DeliverLinkDrop implements stack.LinkDropDispatcher.DeliverLinkDrop. It
+// just forwards the dropped frame to the actual dispatcher.
+func (e *endpoint) DeliverLinkDrop(reason tcpip.DropReason, frame buffer.VectorisedView) {
+	stack.DeliverLinkDrop(e.dispatcher, reason, frame)
+}
+
+// recordInbound logs or captures an inbound packet.
+func (e *endpoint) recordInbound(protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	if e.shouldLog() {
 		logPacket("recv", protocol, vv.First())
 	}
+	if e.pcapng != nil {
+		if err := e.pcapng.writePacket(e.pcapngID, true /* inbound */, vv.Views()); err != nil {
+			panic(err)
+		}
+	}
 	if e.file != nil && atomic.LoadUint32(&LogPacketsToFile) == 1 {
 		vs := vv.Views()
 		length := vv.Size()
@@ -147,7 +206,6 @@ func (e *endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local
 			panic(err)
 		}
 	}
-	e.dispatcher.DeliverNetworkPacket(e, remote, local, protocol, vv)
 }
 
 // Attach implements the stack.LinkEndpoint interface. It saves the dispatcher
@@ -169,6 +227,12 @@ func (e *endpoint) MTU() uint32 {
 	return e.lower.MTU()
 }
 
+// SetMTU implements stack.MTUSettableLinkEndpoint.SetMTU. It just forwards the
+// request to the lower endpoint.
+func (e *endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	return stack.SetLinkMTU(e.lower, mtu)
+}
+
 // Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
 // request to the lower endpoint.
 func (e *endpoint) Capabilities() stack.LinkEndpointCapabilities {
@@ -188,19 +252,33 @@ func (e *endpoint) LinkAddress() tcpip.LinkAddress {
 // WritePacket implements the stack.LinkEndpoint interface. It is called by
 // higher-level protocols to write packets; it just logs the packet and forwards
 // the request to the lower endpoint.
-func (e *endpoint) WritePacket(r *stack.Route, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
-	if atomic.LoadUint32(&LogPackets) == 1 && e.file == nil {
-		logPacket("send", protocol, hdr.View())
+func (e *endpoint) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	if e.shouldRecord(protocol, pkt.Header.View()) {
+		e.recordOutbound(protocol, pkt)
+	}
+	return e.lower.WritePacket(r, pkt, protocol)
+}
+
+// recordOutbound logs or captures an outbound packet.
+func (e *endpoint) recordOutbound(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	if e.shouldLog() {
+		logPacket("send", protocol, pkt.Header.View())
+	}
+	if e.pcapng != nil {
+		views := append([]buffer.View{pkt.Header.View()}, pkt.Data.Views()...)
+		if err := e.pcapng.writePacket(e.pcapngID, false /* inbound */, views); err != nil {
+			panic(err)
+		}
 	}
 	if e.file != nil && atomic.LoadUint32(&LogPacketsToFile) == 1 {
-		hdrBuf := hdr.View()
-		length := len(hdrBuf) + payload.Size()
+		hdrBuf := pkt.Header.View()
+		length := len(hdrBuf) + pkt.Data.Size()
 		if length > int(e.maxPCAPLen) {
 			length = int(e.maxPCAPLen)
 		}
 
 		buf := bytes.NewBuffer(make([]byte, 0, pcapPacketHeaderLen+length))
-		if err := binary.Write(buf, binary.BigEndian, newPCAPPacketHeader(uint32(length), uint32(len(hdrBuf)+payload.Size()))); err != nil {
+		if err := binary.Write(buf, binary.BigEndian, newPCAPPacketHeader(uint32(length), uint32(len(hdrBuf)+pkt.Data.Size()))); err != nil {
 			panic(err)
 		}
 		if len(hdrBuf) > length {
@@ -211,7 +289,7 @@ func (e *endpoint) WritePacket(r *stack.Route, hdr buffer.Prependable, payload b
 		}
 		length -= len(hdrBuf)
 		if length > 0 {
-			for _, v := range payload.Views() {
+			for _, v := range pkt.Data.Views() {
 				if len(v) > length {
 					v = v[:length]
 				}
@@ -229,7 +307,6 @@ func (e *endpoint) WritePacket(r *stack.Route, hdr buffer.Prependable, payload b
 			panic(err)
 		}
 	}
-	return e.lower.WritePacket(r, hdr, payload, protocol)
 }
 
 func logPacket(prefix string, protocol tcpip.NetworkProtocolNumber, b buffer.View) {
@@ -336,6 +413,10 @@ func logPacket(prefix string, protocol tcpip.NetworkProtocolNumber, b buffer.Vie
 			icmpType = "neighbor advert"
 		case header.ICMPv6RedirectMsg:
 			icmpType = "redirect message"
+		case header.ICMPv6NodeInfoQuery:
+			icmpType = "node information query"
+		case header.ICMPv6NodeInfoReply:
+			icmpType = "node information reply"
 		}
 		log.Printf("%s %s %v -> %v %s len:%d id:%04x code:%d", prefix, transName, src, dst, icmpType, size, id, icmp.Code())
 		return
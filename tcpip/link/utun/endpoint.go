@@ -0,0 +1,303 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build darwin
+
+// Package utun provides the implementation of data-link layer endpoints
+// backed by macOS utun devices.
+//
+// Every packet read from or written to a utun file descriptor is preceded by
+// a 4-byte protocol family (AF_INET or AF_INET6) in network byte order. The
+// endpoint strips and adds this prefix, and waits for inbound packets with
+// kqueue so that the file descriptor is only ever used in non-blocking mode.
+// Any datagram file descriptor using the same framing, such as one end of a
+// socket pair fed by a network extension, can be used in place of a utun
+// device.
+//
+// utun endpoints can be used in the networking stack by calling New() to
+// create a new endpoint, and then passing it as an argument to
+// Stack.CreateNIC().
+package utun
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// familySize is the size of the protocol family prefix.
+	familySize = 4
+
+	// maxPacketSize is the largest packet the endpoint reads.
+	maxPacketSize = 0xffff
+)
+
+// Options specify the details about the utun endpoint to be created.
+type Options struct {
+	// FD is the utun file descriptor, as returned by Open.
+	FD int
+
+	// MTU is the maximum transmission unit of the endpoint.
+	MTU uint32
+
+	// ClosedFunc is called when the file descriptor is closed by its peer
+	// or fails, but not when the endpoint is closed with Close.
+	ClosedFunc func(*tcpip.Error)
+}
+
+type endpoint struct {
+	// fd is the file descriptor used to send and receive packets.
+	fd int
+
+	// kq is the kqueue the dispatch loop waits on for fd to become
+	// readable, or for Close to be called.
+	kq int
+
+	// mtu must be accessed atomically.
+	mtu uint32
+
+	closed     func(*tcpip.Error)
+	dispatcher stack.NetworkDispatcher
+
+	closeOnce sync.Once
+	running   sync.WaitGroup
+}
+
+// New creates a new utun endpoint.
+//
+// Makes fd non-blocking, but does not take ownership of fd, which must remain
+// open for the lifetime of the returned endpoint.
+func New(opts *Options) (tcpip.LinkEndpointID, error) {
+	if err := unix.SetNonblock(opts.FD, true); err != nil {
+		return 0, fmt.Errorf("unix.SetNonblock(%v) failed: %v", opts.FD, err)
+	}
+
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return 0, fmt.Errorf("unix.Kqueue() failed: %v", err)
+	}
+	changes := make([]unix.Kevent_t, 2)
+	unix.SetKevent(&changes[0], opts.FD, unix.EVFILT_READ, unix.EV_ADD|unix.EV_CLEAR)
+	// The user event is triggered by Close to stop the dispatch loop.
+	unix.SetKevent(&changes[1], 0, unix.EVFILT_USER, unix.EV_ADD|unix.EV_CLEAR)
+	if _, err := unix.Kevent(kq, changes, nil, nil); err != nil {
+		unix.Close(kq)
+		return 0, fmt.Errorf("unix.Kevent() failed: %v", err)
+	}
+
+	e := &endpoint{
+		fd:     opts.FD,
+		kq:     kq,
+		mtu:    opts.MTU,
+		closed: opts.ClosedFunc,
+	}
+	return stack.RegisterLinkEndpoint(e), nil
+}
+
+// Close stops the dispatch loop of the utun endpoint with the given ID and
+// releases its kqueue. The file descriptor is not closed.
+func Close(id tcpip.LinkEndpointID) *tcpip.Error {
+	e, ok := stack.FindLinkEndpoint(id).(*endpoint)
+	if !ok {
+		return tcpip.ErrBadLinkEndpoint
+	}
+	e.closeOnce.Do(func() {
+		var ev unix.Kevent_t
+		unix.SetKevent(&ev, 0, unix.EVFILT_USER, 0)
+		ev.Fflags = unix.NOTE_TRIGGER
+		unix.Kevent(e.kq, []unix.Kevent_t{ev}, nil, nil)
+		e.running.Wait()
+		unix.Close(e.kq)
+	})
+	return nil
+}
+
+// Attach launches the goroutine that reads packets from the file descriptor and
+// dispatches them via the provided dispatcher.
+func (e *endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.running.Add(1)
+	go e.dispatchLoop()
+}
+
+// IsAttached implements stack.LinkEndpoint.IsAttached.
+func (e *endpoint) IsAttached() bool {
+	return e.dispatcher != nil
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It returns the value initialized
+// during construction, or the one last set with SetMTU.
+func (e *endpoint) MTU() uint32 {
+	return atomic.LoadUint32(&e.mtu)
+}
+
+// SetMTU implements stack.MTUSettableLinkEndpoint.SetMTU. It only changes the
+// MTU seen by the stack; the MTU of the utun device must be changed
+// separately.
+func (e *endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	if mtu == 0 || mtu > maxPacketSize {
+		return tcpip.ErrInvalidOptionValue
+	}
+	atomic.StoreUint32(&e.mtu, mtu)
+	return nil
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities.
+func (*endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
+// MaxHeaderLength returns the maximum size of the link-layer header. The
+// protocol family prefix is added with a separate copy, so it returns 0.
+func (*endpoint) MaxHeaderLength() uint16 {
+	return 0
+}
+
+// LinkAddress returns the link address of this endpoint. utun devices have
+// none.
+func (*endpoint) LinkAddress() tcpip.LinkAddress {
+	return ""
+}
+
+// WritePacket writes outbound packets to the file descriptor, preceded by their
+// protocol family. If it is not currently writable, the packet is dropped.
+func (e *endpoint) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	var family uint32
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		family = unix.AF_INET
+	case header.IPv6ProtocolNumber:
+		family = unix.AF_INET6
+	default:
+		return tcpip.ErrNotSupported
+	}
+
+	// x/sys/unix has no writev on darwin, so the packet is assembled into
+	// a single buffer.
+	b := make([]byte, familySize, familySize+pkt.Size())
+	binary.BigEndian.PutUint32(b, family)
+	b = append(b, pkt.Header.View()...)
+	for _, v := range pkt.Data.Views() {
+		b = append(b, v...)
+	}
+
+	for {
+		_, err := unix.Write(e.fd, b)
+		if err == unix.EINTR {
+			continue
+		}
+		return translateError(err)
+	}
+}
+
+// dispatchLoop reads packets from the file descriptor in a loop and dispatches
+// them to the network stack, waiting on the kqueue whenever none are
+// available.
+func (e *endpoint) dispatchLoop() {
+	defer e.running.Done()
+	buf := make([]byte, familySize+maxPacketSize)
+	for {
+		n, err := unix.Read(e.fd, buf)
+		switch err {
+		case nil:
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			if !e.wait() {
+				return
+			}
+			continue
+		default:
+			if e.closed != nil {
+				e.closed(translateError(err))
+			}
+			return
+		}
+
+		if n == 0 {
+			// The peer closed its end of a socket pair.
+			if e.closed != nil {
+				e.closed(tcpip.ErrClosedForReceive)
+			}
+			return
+		}
+		if n <= familySize {
+			continue
+		}
+
+		var p tcpip.NetworkProtocolNumber
+		switch binary.BigEndian.Uint32(buf) {
+		case unix.AF_INET:
+			p = header.IPv4ProtocolNumber
+		case unix.AF_INET6:
+			p = header.IPv6ProtocolNumber
+		default:
+			continue
+		}
+
+		v := buffer.NewView(n - familySize)
+		copy(v, buf[familySize:n])
+		e.dispatcher.DeliverNetworkPacket(e, "" /* remote */, "" /* local */, p, v.ToVectorisedView())
+	}
+}
+
+// wait blocks until the file descriptor may be readable. It returns false if
+// the endpoint was closed instead.
+func (e *endpoint) wait() bool {
+	events := make([]unix.Kevent_t, 2)
+	for {
+		n, err := unix.Kevent(e.kq, nil, events, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false
+		}
+		for _, ev := range events[:n] {
+			if ev.Filter == unix.EVFILT_USER {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// translateError translates an error returned by package unix into a
+// *tcpip.Error.
+func translateError(err error) *tcpip.Error {
+	switch err {
+	case nil:
+		return nil
+	case unix.EAGAIN:
+		return tcpip.ErrWouldBlock
+	case unix.ENOBUFS:
+		return tcpip.ErrNoBufferSpace
+	case unix.EMSGSIZE:
+		return tcpip.ErrMessageTooLong
+	case unix.ENETDOWN:
+		return tcpip.ErrNetworkDown
+	case unix.EPIPE, unix.ECONNRESET:
+		return tcpip.ErrClosedForSend
+	default:
+		return tcpip.ErrInvalidEndpointState
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build darwin
+
+package utun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"golang.org/x/sys/unix"
+)
+
+type packetInfo struct {
+	proto    tcpip.NetworkProtocolNumber
+	contents buffer.View
+}
+
+type dispatcher chan packetInfo
+
+func (d dispatcher) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	d <- packetInfo{protocol, vv.ToView()}
+}
+
+// newEndpoint creates an endpoint over one end of a datagram socket pair and
+// returns it along with the other end.
+func newEndpoint(t *testing.T) (tcpip.LinkEndpointID, stack.LinkEndpoint, int, dispatcher) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatalf("Socketpair failed: %v", err)
+	}
+	id, err := New(&Options{FD: fds[1], MTU: 1500})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	ep := stack.FindLinkEndpoint(id)
+	d := make(dispatcher, 10)
+	ep.Attach(d)
+	return id, ep, fds[0], d
+}
+
+func TestWritePrependsFamily(t *testing.T) {
+	id, ep, fd, _ := newEndpoint(t)
+	defer unix.Close(fd)
+	defer Close(id)
+
+	for _, test := range []struct {
+		proto  tcpip.NetworkProtocolNumber
+		family uint32
+	}{
+		{header.IPv4ProtocolNumber, unix.AF_INET},
+		{header.IPv6ProtocolNumber, unix.AF_INET6},
+	} {
+		hdr := buffer.NewPrependable(2)
+		copy(hdr.Prepend(2), "hd")
+		payload := buffer.View("payload").ToVectorisedView()
+		if err := ep.WritePacket(&stack.Route{}, stack.NewOutboundPacketBuffer(hdr, payload), test.proto); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+
+		b := make([]byte, 100)
+		n, err := unix.Read(fd, b)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		b = b[:n]
+		if got := binary.BigEndian.Uint32(b); got != test.family {
+			t.Errorf("got family %d, want %d", got, test.family)
+		}
+		if got, want := b[familySize:], []byte("hdpayload"); !bytes.Equal(got, want) {
+			t.Errorf("got packet %q, want %q", got, want)
+		}
+	}
+}
+
+func TestDeliverStripsFamily(t *testing.T) {
+	id, _, fd, d := newEndpoint(t)
+	defer unix.Close(fd)
+	defer Close(id)
+
+	for _, test := range []struct {
+		family uint32
+		proto  tcpip.NetworkProtocolNumber
+	}{
+		{unix.AF_INET, header.IPv4ProtocolNumber},
+		{unix.AF_INET6, header.IPv6ProtocolNumber},
+	} {
+		b := make([]byte, familySize+4)
+		binary.BigEndian.PutUint32(b, test.family)
+		copy(b[familySize:], "data")
+		if _, err := unix.Write(fd, b); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		select {
+		case p := <-d:
+			if p.proto != test.proto {
+				t.Errorf("got protocol %d, want %d", p.proto, test.proto)
+			}
+			if got, want := []byte(p.contents), []byte("data"); !bytes.Equal(got, want) {
+				t.Errorf("got packet %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for packet")
+		}
+	}
+}
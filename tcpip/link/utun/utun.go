@@ -0,0 +1,87 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build darwin
+
+package utun
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// utunControlName is the name of the kernel control that creates utun
+	// devices.
+	utunControlName = "com.apple.net.utun_control"
+
+	// sysprotoControl is SYSPROTO_CONTROL from <sys/sys_domain.h>.
+	sysprotoControl = 2
+
+	// utunOptIfname is UTUN_OPT_IFNAME from <net/if_utun.h>.
+	utunOptIfname = 2
+)
+
+// Open opens the utun device with the given name (e.g. "utun5"), creating it,
+// and returns its file descriptor and interface name. If name is empty, the
+// first free utun device is used. The device is removed when the file
+// descriptor is closed.
+func Open(name string) (int, string, error) {
+	// sc_unit is the utun device number plus one; zero asks the kernel to
+	// pick the first free one.
+	var unit uint32
+	if name != "" {
+		if !strings.HasPrefix(name, "utun") {
+			return -1, "", fmt.Errorf("invalid utun device name %q", name)
+		}
+		n, err := strconv.ParseUint(name[len("utun"):], 10, 31)
+		if err != nil {
+			return -1, "", fmt.Errorf("invalid utun device name %q", name)
+		}
+		unit = uint32(n) + 1
+	}
+
+	fd, err := unix.Socket(unix.AF_SYSTEM, unix.SOCK_DGRAM, sysprotoControl)
+	if err != nil {
+		return -1, "", err
+	}
+
+	info := unix.CtlInfo{}
+	copy(info.Name[:], utunControlName)
+	if err := unix.IoctlCtlInfo(fd, &info); err != nil {
+		unix.Close(fd)
+		return -1, "", err
+	}
+
+	if err := unix.Connect(fd, &unix.SockaddrCtl{ID: info.Id, Unit: unit}); err != nil {
+		unix.Close(fd)
+		return -1, "", err
+	}
+
+	ifname, err := unix.GetsockoptString(fd, sysprotoControl, utunOptIfname)
+	if err != nil {
+		unix.Close(fd)
+		return -1, "", err
+	}
+
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return -1, "", err
+	}
+
+	return fd, ifname, nil
+}
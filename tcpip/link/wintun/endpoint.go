@@ -0,0 +1,280 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build windows
+
+// Package wintun provides the implementation of data-link layer endpoints
+// backed by the Wintun layer-3 TUN driver for Windows (https://www.wintun.net).
+//
+// Wintun exchanges bare IPv4 and IPv6 packets with the application through a
+// pair of rings mapped into its address space, so no TAP adapter is needed.
+// wintun.dll must be present next to the application's executable.
+//
+// Wintun endpoints can be used in the networking stack by calling New() to
+// create a new endpoint, and then passing it as an argument to
+// Stack.CreateNIC().
+package wintun
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"golang.org/x/sys/windows"
+)
+
+const (
+	defaultTunnelType   = "netstack"
+	defaultRingCapacity = 0x400000 // 4MiB
+	minRingCapacity     = 0x20000  // 128KiB
+	maxRingCapacity     = 0x4000000
+)
+
+// Options specify the details about the Wintun endpoint to be created.
+type Options struct {
+	// Name is the name of the adapter. If an adapter with this name
+	// already exists and Create is false, it is opened.
+	Name string
+
+	// Create indicates that a new adapter should be created. It is removed
+	// when the endpoint is closed.
+	Create bool
+
+	// TunnelType is the tunnel type of a created adapter. It defaults to
+	// "netstack".
+	TunnelType string
+
+	// GUID is the GUID of a created adapter. If nil, one is picked by
+	// Windows.
+	GUID *windows.GUID
+
+	// MTU is the maximum transmission unit of the endpoint.
+	MTU uint32
+
+	// RingCapacity is the size, in bytes, of each of the send and receive
+	// rings. It must be a power of two between 128KiB and 64MiB, and
+	// defaults to 4MiB.
+	RingCapacity uint32
+
+	// ClosedFunc is called when the session ends without Close being
+	// called, for example because the adapter was removed.
+	ClosedFunc func(*tcpip.Error)
+}
+
+type endpoint struct {
+	adapter adapter
+	session session
+
+	// readWait is signalled by Wintun when packets are available, and by
+	// Close to stop the dispatch loop.
+	readWait windows.Handle
+
+	// mtu must be accessed atomically.
+	mtu uint32
+
+	closed     func(*tcpip.Error)
+	dispatcher stack.NetworkDispatcher
+
+	// closing is set to 1 when Close is called. It must be accessed
+	// atomically.
+	closing   uint32
+	closeOnce sync.Once
+	running   sync.WaitGroup
+}
+
+// New creates a new Wintun endpoint, creating or opening the adapter and
+// starting a session on it.
+func New(opts *Options) (tcpip.LinkEndpointID, error) {
+	if err := loadDLL(); err != nil {
+		return 0, fmt.Errorf("loading wintun.dll: %v", err)
+	}
+
+	capacity := opts.RingCapacity
+	if capacity == 0 {
+		capacity = defaultRingCapacity
+	}
+	if capacity < minRingCapacity || capacity > maxRingCapacity || capacity&(capacity-1) != 0 {
+		return 0, fmt.Errorf("invalid ring capacity %d", capacity)
+	}
+
+	var (
+		a   adapter
+		err error
+	)
+	if opts.Create {
+		tunnelType := opts.TunnelType
+		if tunnelType == "" {
+			tunnelType = defaultTunnelType
+		}
+		a, err = createAdapter(opts.Name, tunnelType, opts.GUID)
+	} else {
+		a, err = openAdapter(opts.Name)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("opening adapter %q: %v", opts.Name, err)
+	}
+
+	s, err := a.startSession(capacity)
+	if err != nil {
+		a.close()
+		return 0, fmt.Errorf("starting session on adapter %q: %v", opts.Name, err)
+	}
+
+	e := &endpoint{
+		adapter:  a,
+		session:  s,
+		readWait: s.readWaitEvent(),
+		mtu:      opts.MTU,
+		closed:   opts.ClosedFunc,
+	}
+	return stack.RegisterLinkEndpoint(e), nil
+}
+
+// Close ends the session and releases the adapter of the Wintun endpoint with
+// the given ID. Adapters created by New are removed from the system.
+func Close(id tcpip.LinkEndpointID) *tcpip.Error {
+	e, ok := stack.FindLinkEndpoint(id).(*endpoint)
+	if !ok {
+		return tcpip.ErrBadLinkEndpoint
+	}
+	e.close()
+	return nil
+}
+
+func (e *endpoint) close() {
+	e.closeOnce.Do(func() {
+		atomic.StoreUint32(&e.closing, 1)
+		windows.SetEvent(e.readWait)
+		e.running.Wait()
+		e.session.end()
+		e.adapter.close()
+	})
+}
+
+// Attach launches the goroutine that reads packets from the receive ring and
+// dispatches them via the provided dispatcher.
+func (e *endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.running.Add(1)
+	go e.dispatchLoop()
+}
+
+// IsAttached implements stack.LinkEndpoint.IsAttached.
+func (e *endpoint) IsAttached() bool {
+	return e.dispatcher != nil
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It returns the value initialized
+// during construction, or the one last set with SetMTU.
+func (e *endpoint) MTU() uint32 {
+	return atomic.LoadUint32(&e.mtu)
+}
+
+// SetMTU implements stack.MTUSettableLinkEndpoint.SetMTU. It only changes the
+// MTU seen by the stack; the MTU of the adapter must be changed separately.
+func (e *endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	if mtu == 0 || mtu > maxPacketSize {
+		return tcpip.ErrInvalidOptionValue
+	}
+	atomic.StoreUint32(&e.mtu, mtu)
+	return nil
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities.
+func (*endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
+// MaxHeaderLength returns the maximum size of the link-layer header. Wintun
+// carries bare network-layer packets, so it returns 0.
+func (*endpoint) MaxHeaderLength() uint16 {
+	return 0
+}
+
+// LinkAddress returns the link address of this endpoint. Wintun adapters
+// have none.
+func (*endpoint) LinkAddress() tcpip.LinkAddress {
+	return ""
+}
+
+// WritePacket writes outbound packets to the send ring. If the ring is full,
+// the packet is dropped.
+func (e *endpoint) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	size := pkt.Size()
+	if size > maxPacketSize {
+		return tcpip.ErrMessageTooLong
+	}
+
+	views := make([][]byte, 0, 1+len(pkt.Data.Views()))
+	views = append(views, pkt.Header.View())
+	for _, v := range pkt.Data.Views() {
+		views = append(views, v)
+	}
+
+	switch err := e.session.send(size, views...); err {
+	case nil:
+		return nil
+	case windows.ERROR_BUFFER_OVERFLOW:
+		return tcpip.ErrWouldBlock
+	case windows.ERROR_HANDLE_EOF:
+		return tcpip.ErrClosedForSend
+	default:
+		return tcpip.ErrInvalidEndpointState
+	}
+}
+
+// dispatchLoop reads packets from the receive ring in a loop and dispatches
+// them to the network stack, waiting for the read event whenever the ring is
+// empty.
+func (e *endpoint) dispatchLoop() {
+	defer e.running.Done()
+	for atomic.LoadUint32(&e.closing) == 0 {
+		b, err := e.session.receive()
+		switch err {
+		case nil:
+		case windows.ERROR_NO_MORE_ITEMS:
+			windows.WaitForSingleObject(e.readWait, windows.INFINITE)
+			continue
+		case windows.ERROR_HANDLE_EOF:
+			// The adapter was removed.
+			if e.closed != nil {
+				e.closed(tcpip.ErrClosedForReceive)
+			}
+			return
+		default:
+			// The receive ring is corrupt.
+			if e.closed != nil {
+				e.closed(tcpip.ErrInvalidEndpointState)
+			}
+			return
+		}
+
+		var p tcpip.NetworkProtocolNumber
+		switch header.IPVersion(b) {
+		case header.IPv4Version:
+			p = header.IPv4ProtocolNumber
+		case header.IPv6Version:
+			p = header.IPv6ProtocolNumber
+		default:
+			continue
+		}
+
+		v := buffer.View(b)
+		e.dispatcher.DeliverNetworkPacket(e, "" /* remote */, "" /* local */, p, v.ToVectorisedView())
+	}
+}
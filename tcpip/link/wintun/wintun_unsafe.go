@@ -0,0 +1,174 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build windows
+
+package wintun
+
+import (
+	"reflect"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// wintun.dll is not a system DLL; it is expected to be shipped alongside the
+// application's executable.
+var (
+	modwintun = windows.NewLazyDLL("wintun.dll")
+
+	procWintunCreateAdapter        = modwintun.NewProc("WintunCreateAdapter")
+	procWintunOpenAdapter          = modwintun.NewProc("WintunOpenAdapter")
+	procWintunCloseAdapter         = modwintun.NewProc("WintunCloseAdapter")
+	procWintunStartSession         = modwintun.NewProc("WintunStartSession")
+	procWintunEndSession           = modwintun.NewProc("WintunEndSession")
+	procWintunGetReadWaitEvent     = modwintun.NewProc("WintunGetReadWaitEvent")
+	procWintunReceivePacket        = modwintun.NewProc("WintunReceivePacket")
+	procWintunReleaseReceivePacket = modwintun.NewProc("WintunReleaseReceivePacket")
+	procWintunAllocateSendPacket   = modwintun.NewProc("WintunAllocateSendPacket")
+	procWintunSendPacket           = modwintun.NewProc("WintunSendPacket")
+)
+
+// maxPacketSize is the largest packet Wintun accepts or delivers.
+const maxPacketSize = 0xffff
+
+// adapter is a handle to a Wintun adapter.
+type adapter uintptr
+
+// session is a handle to a Wintun session, which owns the send and receive
+// rings of an adapter.
+type session uintptr
+
+// loadDLL checks that wintun.dll and all the functions used from it are
+// available.
+func loadDLL() error {
+	if err := modwintun.Load(); err != nil {
+		return err
+	}
+	for _, p := range []*windows.LazyProc{
+		procWintunCreateAdapter,
+		procWintunOpenAdapter,
+		procWintunCloseAdapter,
+		procWintunStartSession,
+		procWintunEndSession,
+		procWintunGetReadWaitEvent,
+		procWintunReceivePacket,
+		procWintunReleaseReceivePacket,
+		procWintunAllocateSendPacket,
+		procWintunSendPacket,
+	} {
+		if err := p.Find(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createAdapter creates a new adapter with the given name and tunnel type. If
+// guid is nil, Windows picks one.
+func createAdapter(name, tunnelType string, guid *windows.GUID) (adapter, error) {
+	name16, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	type16, err := windows.UTF16PtrFromString(tunnelType)
+	if err != nil {
+		return 0, err
+	}
+	r, _, err := procWintunCreateAdapter.Call(uintptr(unsafe.Pointer(name16)), uintptr(unsafe.Pointer(type16)), uintptr(unsafe.Pointer(guid)))
+	if r == 0 {
+		return 0, err
+	}
+	return adapter(r), nil
+}
+
+// openAdapter opens the existing adapter with the given name.
+func openAdapter(name string) (adapter, error) {
+	name16, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	r, _, err := procWintunOpenAdapter.Call(uintptr(unsafe.Pointer(name16)))
+	if r == 0 {
+		return 0, err
+	}
+	return adapter(r), nil
+}
+
+// close releases the adapter. Adapters created by createAdapter are removed.
+func (a adapter) close() {
+	procWintunCloseAdapter.Call(uintptr(a))
+}
+
+// startSession starts a session with rings of the given capacity, which must
+// be a power of two between 128KiB and 64MiB.
+func (a adapter) startSession(capacity uint32) (session, error) {
+	r, _, err := procWintunStartSession.Call(uintptr(a), uintptr(capacity))
+	if r == 0 {
+		return 0, err
+	}
+	return session(r), nil
+}
+
+// end ends the session and releases its rings.
+func (s session) end() {
+	procWintunEndSession.Call(uintptr(s))
+}
+
+// readWaitEvent returns the event that is signalled when packets are
+// available to receive.
+func (s session) readWaitEvent() windows.Handle {
+	r, _, _ := procWintunGetReadWaitEvent.Call(uintptr(s))
+	return windows.Handle(r)
+}
+
+// receive copies the next packet from the receive ring into a new slice.
+// It returns windows.ERROR_NO_MORE_ITEMS if the ring is empty.
+func (s session) receive() ([]byte, error) {
+	var size uint32
+	r, _, err := procWintunReceivePacket.Call(uintptr(s), uintptr(unsafe.Pointer(&size)))
+	if r == 0 {
+		return nil, err
+	}
+	b := make([]byte, size)
+	copy(b, ringSlice(r, int(size)))
+	procWintunReleaseReceivePacket.Call(uintptr(s), r)
+	return b, nil
+}
+
+// send copies the concatenation of views into the send ring. It returns
+// windows.ERROR_BUFFER_OVERFLOW if the ring is full.
+func (s session) send(size int, views ...[]byte) error {
+	r, _, err := procWintunAllocateSendPacket.Call(uintptr(s), uintptr(size))
+	if r == 0 {
+		return err
+	}
+	b := ringSlice(r, size)
+	for _, v := range views {
+		b = b[copy(b, v):]
+	}
+	procWintunSendPacket.Call(uintptr(s), r)
+	return nil
+}
+
+// ringSlice returns a slice referring to size bytes of ring memory at p. The
+// memory is owned by wintun.dll, not by the Go heap.
+func ringSlice(p uintptr, size int) []byte {
+	var b []byte
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	h.Data = p
+	h.Len = size
+	h.Cap = size
+	return b
+}
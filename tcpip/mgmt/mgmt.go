@@ -0,0 +1,449 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mgmt provides a management API for a stack, so that operators can
+// inspect and change a running netstack-based process the way they would use
+// iproute2 and ss. It is served over HTTP with JSON bodies, and is meant to be
+// exposed on a local socket, as it gives full control over the stack:
+//
+//	l, err := net.Listen("unix", "/run/myapp/netstack.sock")
+//	...
+//	go mgmt.Serve(l, s)
+//
+// The API has the following resources:
+//
+//	GET    /interfaces                      list the NICs, as Interface
+//	GET    /interfaces/{id}                 describe a NIC
+//	PATCH  /interfaces/{id}                 change a NIC, with an InterfaceUpdate
+//	GET    /interfaces/{id}/addresses       list the addresses of a NIC
+//	POST   /interfaces/{id}/addresses       add an Address to a NIC
+//	DELETE /interfaces/{id}/addresses/{a}   remove an address from a NIC
+//	GET    /interfaces/{id}/neighbors       list the neighbor cache of a NIC
+//	POST   /interfaces/{id}/neighbors       add a permanent Neighbor
+//	DELETE /interfaces/{id}/neighbors/{a}   remove a neighbor
+//	GET    /routes                          list the route table, as Route
+//	PUT    /routes                          replace the route table
+//	POST   /routes                          append a Route to the route table
+//	GET    /sockets                         list the transport endpoints
+//	GET    /stats                           dump the tcpip.Stats of the stack
+//
+// Errors are returned with an HTTP error status and a JSON object holding an
+// "error" string.
+package mgmt
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// maxBodySize bounds the size of request bodies.
+const maxBodySize = 1 << 20
+
+// Serve serves the management API of s on the connections accepted by l. It
+// returns when l fails, with its error.
+func Serve(l net.Listener, s *stack.Stack) error {
+	return http.Serve(l, NewHandler(s))
+}
+
+// NewHandler returns an http.Handler serving the management API of s.
+func NewHandler(s *stack.Stack) http.Handler {
+	return &handler{stack: s}
+}
+
+type handler struct {
+	stack *stack.Stack
+
+	// routesMu serializes the changes to the route table, which read and
+	// then replace it.
+	routesMu sync.Mutex
+}
+
+// httpError is an error returned to the client with the given status.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func badRequest(msg string) *httpError {
+	return &httpError{http.StatusBadRequest, msg}
+}
+
+var (
+	errNotFound         = &httpError{http.StatusNotFound, "not found"}
+	errMethodNotAllowed = &httpError{http.StatusMethodNotAllowed, "method not allowed"}
+)
+
+// stackError returns the httpError for an error of the stack.
+func stackError(err *tcpip.Error) *httpError {
+	switch err {
+	case tcpip.ErrUnknownNICID, tcpip.ErrBadLocalAddress:
+		return &httpError{http.StatusNotFound, err.String()}
+	case tcpip.ErrDuplicateAddress, tcpip.ErrDuplicateNICID:
+		return &httpError{http.StatusConflict, err.String()}
+	default:
+		return badRequest(err.String())
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var path []string
+	for _, p := range strings.Split(r.URL.Path, "/") {
+		if p != "" {
+			path = append(path, p)
+		}
+	}
+	v, err := h.serve(r, path)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(err.status)
+		v = struct {
+			Error string `json:"error"`
+		}{err.msg}
+	} else if v == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// serve serves the request for the resource at path, and returns the value of
+// the response, or nil if it has no body.
+func (h *handler) serve(r *http.Request, path []string) (interface{}, *httpError) {
+	if len(path) == 0 {
+		return nil, errNotFound
+	}
+	switch path[0] {
+	case "interfaces":
+		return h.serveInterfaces(r, path[1:])
+	case "routes":
+		if len(path) != 1 {
+			return nil, errNotFound
+		}
+		return h.serveRoutes(r)
+	case "sockets":
+		if len(path) != 1 {
+			return nil, errNotFound
+		}
+		if r.Method != http.MethodGet {
+			return nil, errMethodNotAllowed
+		}
+		socks := make([]Socket, 0)
+		for _, info := range h.stack.Sockets() {
+			socks = append(socks, newSocket(info))
+		}
+		return socks, nil
+	case "stats":
+		if len(path) != 1 {
+			return nil, errNotFound
+		}
+		if r.Method != http.MethodGet {
+			return nil, errMethodNotAllowed
+		}
+		return h.stack.Stats(), nil
+	default:
+		return nil, errNotFound
+	}
+}
+
+func (h *handler) serveInterfaces(r *http.Request, path []string) (interface{}, *httpError) {
+	if len(path) == 0 {
+		if r.Method != http.MethodGet {
+			return nil, errMethodNotAllowed
+		}
+		infos := h.stack.NICInfo()
+		ifs := make([]Interface, 0, len(infos))
+		for id, info := range infos {
+			ifs = append(ifs, newInterface(id, info))
+		}
+		sort.Slice(ifs, func(i, j int) bool { return ifs[i].ID < ifs[j].ID })
+		return ifs, nil
+	}
+
+	id, err := strconv.ParseUint(path[0], 10, 32)
+	if err != nil {
+		return nil, errNotFound
+	}
+	nicID := tcpip.NICID(id)
+	info, ok := h.stack.NICInfo()[nicID]
+	if !ok {
+		return nil, stackError(tcpip.ErrUnknownNICID)
+	}
+	if len(path) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			return newInterface(nicID, info), nil
+		case http.MethodPatch:
+			var u InterfaceUpdate
+			if err := decodeBody(r, &u); err != nil {
+				return nil, err
+			}
+			if err := h.updateInterface(nicID, &u); err != nil {
+				return nil, err
+			}
+			return newInterface(nicID, h.stack.NICInfo()[nicID]), nil
+		default:
+			return nil, errMethodNotAllowed
+		}
+	}
+
+	switch path[1] {
+	case "addresses":
+		return h.serveAddresses(r, nicID, info, path[2:])
+	case "neighbors":
+		return h.serveNeighbors(r, nicID, path[2:])
+	default:
+		return nil, errNotFound
+	}
+}
+
+func newInterface(id tcpip.NICID, info stack.NICInfo) Interface {
+	return Interface{
+		ID:          id,
+		Name:        info.Name,
+		LinkAddress: info.LinkAddress.String(),
+		Up:          info.Flags.Up,
+		Running:     info.Flags.Running,
+		Promiscuous: info.Flags.Promiscuous,
+		Spoofing:    info.Flags.Spoofing,
+		Transparent: info.Flags.Transparent,
+		Loopback:    info.Flags.Loopback,
+		MTU:         info.MTU,
+		VRF:         info.VRF,
+		Addresses:   addresses(info),
+		Stats:       info.Stats,
+	}
+}
+
+// addresses returns the sorted addresses of a NIC.
+func addresses(info stack.NICInfo) []string {
+	addrs := make([]string, 0, len(info.ProtocolAddresses))
+	for _, a := range info.ProtocolAddresses {
+		addrs = append(addrs, formatAddress(a.Address))
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// updateInterface applies u to the NIC id. The whole of u is validated before
+// anything is changed, and the MTU, which the link endpoint may still reject,
+// is set first, so that a rejected update leaves the NIC unchanged. The flags
+// can then only fail to be set if the NIC is removed concurrently.
+func (h *handler) updateInterface(id tcpip.NICID, u *InterfaceUpdate) *httpError {
+	if u.MTU != nil && *u.MTU == 0 {
+		return badRequest("invalid MTU 0")
+	}
+
+	s := h.stack
+	if u.MTU != nil {
+		if err := s.SetNICMTU(id, *u.MTU); err != nil {
+			return stackError(err)
+		}
+	}
+	if u.Promiscuous != nil {
+		if err := s.SetPromiscuousMode(id, *u.Promiscuous); err != nil {
+			return stackError(err)
+		}
+	}
+	if u.Spoofing != nil {
+		if err := s.SetSpoofing(id, *u.Spoofing); err != nil {
+			return stackError(err)
+		}
+	}
+	if u.Transparent != nil {
+		if err := s.SetTransparent(id, *u.Transparent); err != nil {
+			return stackError(err)
+		}
+	}
+	if u.Up != nil {
+		if err := s.SetNICUp(id, *u.Up); err != nil {
+			return stackError(err)
+		}
+	}
+	return nil
+}
+
+func (h *handler) serveAddresses(r *http.Request, id tcpip.NICID, info stack.NICInfo, path []string) (interface{}, *httpError) {
+	switch {
+	case len(path) == 0 && r.Method == http.MethodGet:
+		addrs := make([]Address, 0, len(info.ProtocolAddresses))
+		for _, a := range addresses(info) {
+			addrs = append(addrs, Address{Address: a})
+		}
+		return addrs, nil
+	case len(path) == 0 && r.Method == http.MethodPost:
+		var a Address
+		if err := decodeBody(r, &a); err != nil {
+			return nil, err
+		}
+		addr, proto, err := parseAddress(a.Address)
+		if err != nil {
+			return nil, badRequest(err.Error())
+		}
+		if err := h.stack.AddAddress(id, proto, addr); err != nil {
+			return nil, stackError(err)
+		}
+		return Address{Address: formatAddress(addr)}, nil
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		addr, _, err := parseAddress(path[0])
+		if err != nil {
+			return nil, badRequest(err.Error())
+		}
+		if err := h.stack.RemoveAddress(id, addr); err != nil {
+			return nil, stackError(err)
+		}
+		return nil, nil
+	case len(path) > 1:
+		return nil, errNotFound
+	default:
+		return nil, errMethodNotAllowed
+	}
+}
+
+func (h *handler) serveNeighbors(r *http.Request, id tcpip.NICID, path []string) (interface{}, *httpError) {
+	switch {
+	case len(path) == 0 && r.Method == http.MethodGet:
+		entries, err := h.stack.Neighbors(id)
+		if err != nil {
+			return nil, stackError(err)
+		}
+		neighbors := make([]Neighbor, 0, len(entries))
+		for _, e := range entries {
+			neighbors = append(neighbors, Neighbor{
+				Address:     formatAddress(e.Addr),
+				LinkAddress: e.LinkAddr.String(),
+				State:       e.State.String(),
+				Age:         e.Age.String(),
+			})
+		}
+		return neighbors, nil
+	case len(path) == 0 && r.Method == http.MethodPost:
+		var n Neighbor
+		if err := decodeBody(r, &n); err != nil {
+			return nil, err
+		}
+		addr, _, err := parseAddress(n.Address)
+		if err != nil {
+			return nil, badRequest(err.Error())
+		}
+		linkAddr, err := tcpip.ParseMACAddress(n.LinkAddress)
+		if err != nil {
+			return nil, badRequest(err.Error())
+		}
+		if err := h.stack.AddStaticNeighbor(id, addr, linkAddr); err != nil {
+			return nil, stackError(err)
+		}
+		return Neighbor{
+			Address:     formatAddress(addr),
+			LinkAddress: linkAddr.String(),
+			State:       stack.NeighborPermanent.String(),
+		}, nil
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		addr, _, err := parseAddress(path[0])
+		if err != nil {
+			return nil, badRequest(err.Error())
+		}
+		if err := h.stack.RemoveNeighbor(id, addr); err != nil {
+			if err == tcpip.ErrBadAddress {
+				return nil, errNotFound
+			}
+			return nil, stackError(err)
+		}
+		return nil, nil
+	case len(path) > 1:
+		return nil, errNotFound
+	default:
+		return nil, errMethodNotAllowed
+	}
+}
+
+func (h *handler) serveRoutes(r *http.Request) (interface{}, *httpError) {
+	switch r.Method {
+	case http.MethodGet:
+		return routes(h.stack.GetRouteTable()), nil
+	case http.MethodPut:
+		var rs []Route
+		if err := decodeBody(r, &rs); err != nil {
+			return nil, err
+		}
+		table, err := toRoutes(rs)
+		if err != nil {
+			return nil, err
+		}
+		h.routesMu.Lock()
+		defer h.routesMu.Unlock()
+		h.stack.SetRouteTable(table)
+		return routes(table), nil
+	case http.MethodPost:
+		var rt Route
+		if err := decodeBody(r, &rt); err != nil {
+			return nil, err
+		}
+		route, err := rt.toRoute()
+		if err != nil {
+			return nil, badRequest(err.Error())
+		}
+		h.routesMu.Lock()
+		defer h.routesMu.Unlock()
+		table := append(h.stack.GetRouteTable(), route)
+		h.stack.SetRouteTable(table)
+		return routes(table), nil
+	default:
+		return nil, errMethodNotAllowed
+	}
+}
+
+func routes(table []tcpip.Route) []Route {
+	rs := make([]Route, 0, len(table))
+	for _, r := range table {
+		rs = append(rs, newRoute(r))
+	}
+	return rs
+}
+
+func toRoutes(rs []Route) ([]tcpip.Route, *httpError) {
+	table := make([]tcpip.Route, 0, len(rs))
+	for i := range rs {
+		route, err := rs[i].toRoute()
+		if err != nil {
+			return nil, badRequest(err.Error())
+		}
+		table = append(table, route)
+	}
+	return table, nil
+}
+
+// decodeBody decodes the JSON body of r into v.
+func decodeBody(r *http.Request, v interface{}) *httpError {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return badRequest(err.Error())
+	}
+	return nil
+}
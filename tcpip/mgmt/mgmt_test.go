@@ -0,0 +1,199 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mgmt_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/mgmt"
+	"github.com/google/netstack/tcpip/network/arp"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/stack/stacktest"
+)
+
+const linkAddr = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+
+func newStack(t *testing.T) *stack.Stack {
+	id, _ := channel.New(10, 1500, linkAddr)
+	return stacktest.New(t, []string{ipv4.ProtocolName, ipv6.ProtocolName, arp.ProtocolName}, nil, id)
+}
+
+// do sends a request with the given method, path and body to h, checks that
+// it gets the given status, and decodes the response into v if it isn't nil.
+func do(t *testing.T, h http.Handler, method, path, body string, status int, v interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if w.Code != status {
+		t.Fatalf("%s %s: got status %d, want %d, body %s", method, path, w.Code, status, w.Body)
+	}
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: can't decode %s: %v", method, path, w.Body, err)
+		}
+	}
+}
+
+func TestInterfaces(t *testing.T) {
+	s := newStack(t)
+	h := mgmt.NewHandler(s)
+
+	do(t, h, "POST", "/interfaces/1/addresses", `{"address": "10.0.0.1"}`, http.StatusOK, nil)
+	do(t, h, "POST", "/interfaces/1/addresses", `{"address": "2001:db8::1"}`, http.StatusOK, nil)
+	do(t, h, "POST", "/interfaces/1/addresses", `{"address": "10.0.0.1"}`, http.StatusConflict, nil)
+	do(t, h, "POST", "/interfaces/1/addresses", `{"address": "bogus"}`, http.StatusBadRequest, nil)
+	do(t, h, "POST", "/interfaces/2/addresses", `{"address": "10.0.0.2"}`, http.StatusNotFound, nil)
+	do(t, h, "PATCH", "/interfaces/1", `{"promiscuous": true}`, http.StatusOK, nil)
+	// Rejected updates change nothing.
+	do(t, h, "PATCH", "/interfaces/1", `{"promiscuous": false, "mtu": 0}`, http.StatusBadRequest, nil)
+	do(t, h, "PATCH", "/interfaces/1", `{"promiscuous": false, "mtu": "bogus"}`, http.StatusBadRequest, nil)
+
+	// Counters can't be decoded, so leave them raw.
+	var ifs []struct {
+		mgmt.Interface
+		Stats json.RawMessage `json:"stats"`
+	}
+	do(t, h, "GET", "/interfaces", "", http.StatusOK, &ifs)
+	if len(ifs) != 1 {
+		t.Fatalf("got %d interfaces, want 1", len(ifs))
+	}
+	got := ifs[0].Interface
+	want := mgmt.Interface{
+		ID:          1,
+		Name:        "eth0",
+		LinkAddress: "02:00:00:00:00:01",
+		Up:          true,
+		Running:     true,
+		Promiscuous: true,
+		MTU:         1500,
+		Addresses:   []string{"10.0.0.1", "2001:db8::1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got interface %+v, want %+v", got, want)
+	}
+
+	do(t, h, "DELETE", "/interfaces/1/addresses/10.0.0.1", "", http.StatusNoContent, nil)
+	do(t, h, "DELETE", "/interfaces/1/addresses/10.0.0.1", "", http.StatusNotFound, nil)
+	var addrs []mgmt.Address
+	do(t, h, "GET", "/interfaces/1/addresses", "", http.StatusOK, &addrs)
+	if want := []mgmt.Address{{Address: "2001:db8::1"}}; !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("got addresses %+v, want %+v", addrs, want)
+	}
+
+	do(t, h, "POST", "/interfaces/1/neighbors", `{"address": "10.0.0.9", "link_address": "02:00:00:00:00:09"}`, http.StatusOK, nil)
+	var neighbors []mgmt.Neighbor
+	do(t, h, "GET", "/interfaces/1/neighbors", "", http.StatusOK, &neighbors)
+	if len(neighbors) != 1 || neighbors[0].Address != "10.0.0.9" || neighbors[0].LinkAddress != "02:00:00:00:00:09" || neighbors[0].State != "PERMANENT" {
+		t.Fatalf("got neighbors %+v, want the permanent entry of 10.0.0.9", neighbors)
+	}
+	do(t, h, "DELETE", "/interfaces/1/neighbors/10.0.0.9", "", http.StatusNoContent, nil)
+	do(t, h, "DELETE", "/interfaces/1/neighbors/10.0.0.9", "", http.StatusNotFound, nil)
+}
+
+func TestRoutes(t *testing.T) {
+	s := newStack(t)
+	h := mgmt.NewHandler(s)
+
+	routes := []mgmt.Route{
+		{Destination: "10.0.0.0/8", NIC: 1, Type: "unicast", MTU: 1400},
+		{Destination: "0.0.0.0/0", Gateway: "10.0.0.254", NIC: 1, Type: "unicast"},
+	}
+	b, err := json.Marshal(routes)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	do(t, h, "PUT", "/routes", string(b), http.StatusOK, nil)
+	do(t, h, "POST", "/routes", `{"destination": "2001:db8::/32", "type": "blackhole"}`, http.StatusOK, nil)
+	do(t, h, "POST", "/routes", `{"destination": "10.0.0.0/8", "gateway": "2001:db8::1"}`, http.StatusBadRequest, nil)
+	do(t, h, "POST", "/routes", `{"destination": "10.0.0.0/8", "type": "bogus"}`, http.StatusBadRequest, nil)
+
+	var got []mgmt.Route
+	do(t, h, "GET", "/routes", "", http.StatusOK, &got)
+	want := append(routes, mgmt.Route{Destination: "2001:db8::/32", Type: "blackhole"})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got routes %+v, want %+v", got, want)
+	}
+	if table := s.GetRouteTable(); len(table) != 3 || table[1].Gateway != tcpip.Address("\x0a\x00\x00\xfe") || table[2].Type != tcpip.RouteBlackhole {
+		t.Fatalf("got route table %+v", table)
+	}
+}
+
+func TestServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "netstack.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	s := newStack(t)
+	s.Stats().UDP.PacketsReceived.IncrementBy(3)
+	go mgmt.Serve(l, s)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://netstack/stats")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	var stats struct {
+		UDP struct {
+			PacketsReceived uint64
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got, want := stats.UDP.PacketsReceived, uint64(3); got != want {
+		t.Fatalf("got UDP.PacketsReceived = %d, want %d", got, want)
+	}
+
+	resp, err = client.Get("http://netstack/sockets")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	var socks []mgmt.Socket
+	if err := json.NewDecoder(resp.Body).Decode(&socks); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if socks == nil || len(socks) != 0 {
+		t.Fatalf("got sockets %+v, want an empty list", socks)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mgmt
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// Interface describes a NIC.
+type Interface struct {
+	ID          tcpip.NICID    `json:"id"`
+	Name        string         `json:"name,omitempty"`
+	LinkAddress string         `json:"link_address,omitempty"`
+	Up          bool           `json:"up"`
+	Running     bool           `json:"running"`
+	Promiscuous bool           `json:"promiscuous"`
+	Spoofing    bool           `json:"spoofing"`
+	Transparent bool           `json:"transparent"`
+	Loopback    bool           `json:"loopback"`
+	MTU         uint32         `json:"mtu"`
+	VRF         tcpip.VRFID    `json:"vrf"`
+	Addresses   []string       `json:"addresses"`
+	Stats       stack.NICStats `json:"stats"`
+}
+
+// InterfaceUpdate changes the settings of a NIC. The fields that are null are
+// left unchanged.
+type InterfaceUpdate struct {
+	Up          *bool   `json:"up"`
+	MTU         *uint32 `json:"mtu"`
+	Promiscuous *bool   `json:"promiscuous"`
+	Spoofing    *bool   `json:"spoofing"`
+	Transparent *bool   `json:"transparent"`
+}
+
+// Address is an address of a NIC.
+type Address struct {
+	Address string `json:"address"`
+}
+
+// Route is an entry of the route table. Destination is a prefix in CIDR
+// notation, and Type the name of a tcpip.RouteType, "unicast" if empty. The
+// other fields are those of tcpip.Route.
+type Route struct {
+	Destination string      `json:"destination"`
+	Gateway     string      `json:"gateway,omitempty"`
+	NIC         tcpip.NICID `json:"nic,omitempty"`
+	Type        string      `json:"type,omitempty"`
+	Weight      int         `json:"weight,omitempty"`
+	MTU         uint32      `json:"mtu,omitempty"`
+	LockMTU     bool        `json:"lock_mtu,omitempty"`
+	AdvMSS      uint16      `json:"advmss,omitempty"`
+	InitCwnd    int         `json:"initcwnd,omitempty"`
+	HopLimit    uint8       `json:"hoplimit,omitempty"`
+}
+
+// Neighbor is an entry of the neighbor cache of a NIC. State and Age are only
+// reported, and ignored when adding a neighbor, which is always permanent.
+type Neighbor struct {
+	Address     string `json:"address"`
+	LinkAddress string `json:"link_address,omitempty"`
+	State       string `json:"state,omitempty"`
+	Age         string `json:"age,omitempty"`
+}
+
+// Socket describes a transport endpoint, like a line of ss.
+type Socket struct {
+	Protocol      string              `json:"protocol"`
+	Network       []string            `json:"network"`
+	NIC           tcpip.NICID         `json:"nic,omitempty"`
+	Raw           bool                `json:"raw,omitempty"`
+	LocalAddress  string              `json:"local_address,omitempty"`
+	LocalPort     uint16              `json:"local_port,omitempty"`
+	RemoteAddress string              `json:"remote_address,omitempty"`
+	RemotePort    uint16              `json:"remote_port,omitempty"`
+	State         string              `json:"state,omitempty"`
+	RecvQueue     int                 `json:"recv_queue"`
+	SendQueue     int                 `json:"send_queue"`
+	Options       stack.SocketOptions `json:"options"`
+}
+
+var errBadAddress = errors.New("bad address")
+
+// parseAddress parses an IPv4 or IPv6 address, and returns it with its network
+// protocol.
+func parseAddress(s string) (tcpip.Address, tcpip.NetworkProtocolNumber, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", 0, errBadAddress
+	}
+	if ip4 := ip.To4(); ip4 != nil && !strings.Contains(s, ":") {
+		return tcpip.Address(ip4), header.IPv4ProtocolNumber, nil
+	}
+	return tcpip.Address(ip.To16()), header.IPv6ProtocolNumber, nil
+}
+
+// formatAddress returns the textual form of addr, or the empty string if addr
+// is empty.
+func formatAddress(addr tcpip.Address) string {
+	if addr == "" {
+		return ""
+	}
+	return addr.String()
+}
+
+// protocolName returns the name of a network protocol.
+func protocolName(p tcpip.NetworkProtocolNumber) string {
+	switch p {
+	case header.IPv4ProtocolNumber:
+		return "ipv4"
+	case header.IPv6ProtocolNumber:
+		return "ipv6"
+	case header.ARPProtocolNumber:
+		return "arp"
+	default:
+		return strconv.Itoa(int(p))
+	}
+}
+
+// transportName returns the name of a transport protocol.
+func transportName(p tcpip.TransportProtocolNumber) string {
+	switch p {
+	case header.TCPProtocolNumber:
+		return "tcp"
+	case header.UDPProtocolNumber:
+		return "udp"
+	case header.ICMPv4ProtocolNumber:
+		return "icmp"
+	case header.ICMPv6ProtocolNumber:
+		return "icmpv6"
+	default:
+		return strconv.Itoa(int(p))
+	}
+}
+
+// routeTypes maps the names of route types to them.
+var routeTypes = map[string]tcpip.RouteType{
+	"":            tcpip.RouteUnicast,
+	"unicast":     tcpip.RouteUnicast,
+	"blackhole":   tcpip.RouteBlackhole,
+	"unreachable": tcpip.RouteUnreachable,
+	"prohibit":    tcpip.RouteProhibit,
+}
+
+func newRoute(r tcpip.Route) Route {
+	sn, err := tcpip.NewSubnet(r.Destination, r.Mask)
+	prefix := 0
+	if err == nil {
+		prefix = sn.Prefix()
+	}
+	return Route{
+		Destination: formatAddress(r.Destination) + "/" + strconv.Itoa(prefix),
+		Gateway:     formatAddress(r.Gateway),
+		NIC:         r.NIC,
+		Type:        r.Type.String(),
+		Weight:      r.Weight,
+		MTU:         r.MTU,
+		LockMTU:     r.LockMTU,
+		AdvMSS:      r.AdvMSS,
+		InitCwnd:    r.InitCwnd,
+		HopLimit:    r.HopLimit,
+	}
+}
+
+// toRoute returns the tcpip.Route described by r.
+func (r *Route) toRoute() (tcpip.Route, error) {
+	_, dst, err := net.ParseCIDR(r.Destination)
+	if err != nil {
+		return tcpip.Route{}, err
+	}
+	typ, ok := routeTypes[r.Type]
+	if !ok {
+		return tcpip.Route{}, errors.New("unknown route type " + strconv.Quote(r.Type))
+	}
+	route := tcpip.Route{
+		Destination: tcpip.Address(dst.IP),
+		Mask:        tcpip.AddressMask(dst.Mask),
+		NIC:         r.NIC,
+		Type:        typ,
+		Weight:      r.Weight,
+		MTU:         r.MTU,
+		LockMTU:     r.LockMTU,
+		AdvMSS:      r.AdvMSS,
+		InitCwnd:    r.InitCwnd,
+		HopLimit:    r.HopLimit,
+	}
+	if r.Gateway != "" {
+		gw, _, err := parseAddress(r.Gateway)
+		if err != nil {
+			return tcpip.Route{}, err
+		}
+		if len(gw) != len(route.Destination) {
+			return tcpip.Route{}, errors.New("gateway and destination are of different families")
+		}
+		route.Gateway = gw
+	}
+	return route, nil
+}
+
+func newSocket(info stack.SocketInfo) Socket {
+	s := Socket{
+		Protocol:      transportName(info.TransProto),
+		NIC:           info.NIC,
+		Raw:           info.Raw,
+		LocalAddress:  formatAddress(info.ID.LocalAddress),
+		LocalPort:     info.ID.LocalPort,
+		RemoteAddress: formatAddress(info.ID.RemoteAddress),
+		RemotePort:    info.ID.RemotePort,
+		State:         info.State,
+		RecvQueue:     info.RecvQueue,
+		SendQueue:     info.SendQueue,
+		Options:       info.Options,
+	}
+	for _, p := range info.NetProtos {
+		s.Network = append(s.Network, protocolName(p))
+	}
+	return s
+}
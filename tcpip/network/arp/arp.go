@@ -23,9 +23,14 @@
 //	if err := s.AddAddress(1, arp.ProtocolNumber, "arp"); err != nil {
 //		// handle err
 //	}
+//
+// The package also implements IPv4 link-local address configuration, see
+// StartLinkLocal.
 package arp
 
 import (
+	"sync"
+
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
@@ -49,6 +54,7 @@ type endpoint struct {
 	addr          tcpip.Address
 	linkEP        stack.LinkEndpoint
 	linkAddrCache stack.LinkAddressCache
+	proto         *protocol
 }
 
 // DefaultTTL is unused for ARP. It implements stack.NetworkEndpoint.
@@ -77,19 +83,25 @@ func (e *endpoint) MaxHeaderLength() uint16 {
 	return e.linkEP.MaxHeaderLength() + header.ARPSize
 }
 
-func (e *endpoint) Close() {}
+func (e *endpoint) Close() {
+	e.proto.removeEndpoint(e)
+}
 
-func (e *endpoint) WritePacket(*stack.Route, buffer.Prependable, buffer.VectorisedView, tcpip.TransportProtocolNumber, uint8, stack.PacketLooping) *tcpip.Error {
+func (e *endpoint) WritePacket(*stack.Route, *stack.PacketBuffer, stack.NetworkHeaderParams, stack.PacketLooping) *tcpip.Error {
 	return tcpip.ErrNotSupported
 }
 
-func (e *endpoint) HandlePacket(r *stack.Route, vv buffer.VectorisedView) {
-	v := vv.First()
+func (e *endpoint) HandlePacket(r *stack.Route, pkt *stack.PacketBuffer) {
+	v := pkt.Data.First()
 	h := header.ARP(v)
 	if !h.IsValid() {
 		return
 	}
 
+	if l := e.proto.linkLocalOn(e.nicid); l != nil {
+		l.handlePacket(h)
+	}
+
 	switch h.Op() {
 	case header.ARPRequest:
 		localAddr := tcpip.Address(h.ProtocolAddressTarget())
@@ -103,7 +115,9 @@ func (e *endpoint) HandlePacket(r *stack.Route, vv buffer.VectorisedView) {
 		copy(pkt.HardwareAddressSender(), r.LocalLinkAddress[:])
 		copy(pkt.ProtocolAddressSender(), h.ProtocolAddressTarget())
 		copy(pkt.ProtocolAddressTarget(), h.ProtocolAddressSender())
-		e.linkEP.WritePacket(r, hdr, buffer.VectorisedView{}, ProtocolNumber)
+		reply := stack.NewOutboundPacketBuffer(hdr, buffer.VectorisedView{})
+		e.linkEP.WritePacket(r, reply, ProtocolNumber)
+		reply.DecRef()
 		fallthrough // also fill the cache from requests
 	case header.ARPReply:
 		addr := tcpip.Address(h.ProtocolAddressSender())
@@ -114,6 +128,12 @@ func (e *endpoint) HandlePacket(r *stack.Route, vv buffer.VectorisedView) {
 
 // protocol implements stack.NetworkProtocol and stack.LinkAddressResolver.
 type protocol struct {
+	mu sync.Mutex
+	// endpoints holds the endpoint of each NIC with an ARP address.
+	endpoints map[tcpip.NICID]*endpoint
+	// linkLocal holds the link-local address configuration of each NIC
+	// where it's running.
+	linkLocal map[tcpip.NICID]*LinkLocal
 }
 
 func (p *protocol) Number() tcpip.NetworkProtocolNumber { return ProtocolNumber }
@@ -124,16 +144,62 @@ func (*protocol) ParseAddresses(v buffer.View) (src, dst tcpip.Address) {
 	return tcpip.Address(h.ProtocolAddressSender()), ProtocolAddress
 }
 
-func (p *protocol) NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, linkAddrCache stack.LinkAddressCache, dispatcher stack.TransportDispatcher, sender stack.LinkEndpoint) (stack.NetworkEndpoint, *tcpip.Error) {
+func (p *protocol) NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, linkAddrCache stack.LinkAddressCache, clock tcpip.Clock, dispatcher stack.TransportDispatcher, sender stack.LinkEndpoint) (stack.NetworkEndpoint, *tcpip.Error) {
 	if addr != ProtocolAddress {
 		return nil, tcpip.ErrBadLocalAddress
 	}
-	return &endpoint{
+	e := &endpoint{
 		nicid:         nicid,
 		addr:          addr,
 		linkEP:        sender,
 		linkAddrCache: linkAddrCache,
-	}, nil
+		proto:         p,
+	}
+	p.mu.Lock()
+	p.endpoints[nicid] = e
+	p.mu.Unlock()
+	return e, nil
+}
+
+// endpoint returns the endpoint of the NIC, or nil if it has no ARP address.
+func (p *protocol) endpoint(nicid tcpip.NICID) *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.endpoints[nicid]
+}
+
+func (p *protocol) removeEndpoint(e *endpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.endpoints[e.nicid] == e {
+		delete(p.endpoints, e.nicid)
+	}
+}
+
+// linkLocalOn returns the link-local address configuration running on the
+// NIC, or nil.
+func (p *protocol) linkLocalOn(nicid tcpip.NICID) *LinkLocal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.linkLocal[nicid]
+}
+
+func (p *protocol) addLinkLocal(nicid tcpip.NICID, l *LinkLocal) *tcpip.Error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.linkLocal[nicid]; ok {
+		return tcpip.ErrDuplicateAddress
+	}
+	p.linkLocal[nicid] = l
+	return nil
+}
+
+func (p *protocol) removeLinkLocal(nicid tcpip.NICID, l *LinkLocal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.linkLocal[nicid] == l {
+		delete(p.linkLocal, nicid)
+	}
 }
 
 // LinkAddressProtocol implements stack.LinkAddressResolver.
@@ -155,7 +221,9 @@ func (*protocol) LinkAddressRequest(addr, localAddr tcpip.Address, linkEP stack.
 	copy(h.ProtocolAddressSender(), localAddr)
 	copy(h.ProtocolAddressTarget(), addr)
 
-	return linkEP.WritePacket(r, hdr, buffer.VectorisedView{}, ProtocolNumber)
+	pkt := stack.NewOutboundPacketBuffer(hdr, buffer.VectorisedView{})
+	defer pkt.DecRef()
+	return linkEP.WritePacket(r, pkt, ProtocolNumber)
 }
 
 // ResolveStaticAddress implements stack.LinkAddressResolver.
@@ -198,6 +266,9 @@ var broadcastMAC = tcpip.LinkAddress([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
 
 func init() {
 	stack.RegisterNetworkProtocolFactory(ProtocolName, func() stack.NetworkProtocol {
-		return &protocol{}
+		return &protocol{
+			endpoints: make(map[tcpip.NICID]*endpoint),
+			linkLocal: make(map[tcpip.NICID]*LinkLocal),
+		}
 	})
 }
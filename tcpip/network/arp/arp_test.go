@@ -15,11 +15,14 @@
 package arp_test
 
 import (
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/google/netstack/sleep"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/faketime"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/link/channel"
 	"github.com/google/netstack/tcpip/link/sniffer"
@@ -27,6 +30,8 @@ import (
 	"github.com/google/netstack/tcpip/network/ipv4"
 	"github.com/google/netstack/tcpip/stack"
 	"github.com/google/netstack/tcpip/transport/icmp"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
 )
 
 const (
@@ -147,3 +152,451 @@ func TestDirectRequest(t *testing.T) {
 		// succeed.
 	}
 }
+
+// newLinkLocalTestContext returns a stack with a NIC that only has an ARP
+// address, driven by a manual clock.
+func newLinkLocalTestContext(t *testing.T) (*stack.Stack, *channel.Endpoint, *faketime.ManualClock) {
+	clock := faketime.NewManualClock()
+	s := stack.New([]string{ipv4.ProtocolName, arp.ProtocolName}, nil, stack.Options{Clock: clock})
+	id, linkEP := channel.New(256, 1500, stackLinkAddr)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, arp.ProtocolNumber, arp.ProtocolAddress); err != nil {
+		t.Fatalf("AddAddress for arp failed: %v", err)
+	}
+	return s, linkEP, clock
+}
+
+// nextARP advances the clock to the next timer, and returns the ARP packet
+// sent then.
+func nextARP(t *testing.T, linkEP *channel.Endpoint, clock *faketime.ManualClock) header.ARP {
+	if !clock.AdvanceToNext() {
+		t.Fatalf("no timer pending")
+	}
+	select {
+	case pkt := <-linkEP.C:
+		if pkt.Proto != arp.ProtocolNumber {
+			t.Fatalf("got network protocol number %v, want ARP", pkt.Proto)
+		}
+		h := header.ARP(pkt.Header)
+		if !h.IsValid() || h.Op() != header.ARPRequest {
+			t.Fatalf("got invalid ARP packet or not a request: %x", pkt.Header)
+		}
+		if got := tcpip.LinkAddress(h.HardwareAddressSender()); got != stackLinkAddr {
+			t.Fatalf("got sender hardware address %q, want %q", got, stackLinkAddr)
+		}
+		return h
+	default:
+		t.Fatalf("no packet sent")
+		return nil
+	}
+}
+
+// checkProbe checks that h is a probe and returns its target.
+func checkProbe(t *testing.T, h header.ARP) tcpip.Address {
+	if got := tcpip.Address(h.ProtocolAddressSender()); got != header.IPv4Any {
+		t.Fatalf("probe sender address got %v, want %v", got, header.IPv4Any)
+	}
+	target := tcpip.Address(h.ProtocolAddressTarget())
+	if !arp.LinkLocalSubnet.Contains(target) || target[2] == 0 || target[2] == 255 {
+		t.Fatalf("probe target %v out of the link-local range", target)
+	}
+	return target
+}
+
+// checkAnnouncement checks that h announces addr.
+func checkAnnouncement(t *testing.T, h header.ARP, addr tcpip.Address) {
+	if got := tcpip.Address(h.ProtocolAddressSender()); got != addr {
+		t.Fatalf("announcement sender address got %v, want %v", got, addr)
+	}
+	if got := tcpip.Address(h.ProtocolAddressTarget()); got != addr {
+		t.Fatalf("announcement target address got %v, want %v", got, addr)
+	}
+}
+
+// injectClaim injects an ARP reply from another host using addr.
+func injectClaim(linkEP *channel.Endpoint, addr tcpip.Address) {
+	const senderMAC = "\x01\x02\x03\x04\x05\x06"
+	v := make(buffer.View, header.ARPSize)
+	h := header.ARP(v)
+	h.SetIPv4OverEthernet()
+	h.SetOp(header.ARPReply)
+	copy(h.HardwareAddressSender(), senderMAC)
+	copy(h.ProtocolAddressSender(), addr)
+	copy(h.HardwareAddressTarget(), broadcastMAC)
+	copy(h.ProtocolAddressTarget(), addr)
+	linkEP.Inject(arp.ProtocolNumber, v.ToVectorisedView())
+}
+
+var broadcastMAC = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func TestLinkLocal(t *testing.T) {
+	s, linkEP, clock := newLinkLocalTestContext(t)
+
+	type change struct{ old, new tcpip.Address }
+	var changes []change
+	l, err := arp.StartLinkLocal(s, 1, func(old, new tcpip.Address) {
+		changes = append(changes, change{old, new})
+	})
+	if err != nil {
+		t.Fatalf("StartLinkLocal failed: %v", err)
+	}
+	if _, err := arp.StartLinkLocal(s, 1, nil); err != tcpip.ErrDuplicateAddress {
+		t.Errorf("second StartLinkLocal got %v, want %v", err, tcpip.ErrDuplicateAddress)
+	}
+
+	addr := checkProbe(t, nextARP(t, linkEP, clock))
+	for i := 1; i < 3; i++ {
+		if got := checkProbe(t, nextARP(t, linkEP, clock)); got != addr {
+			t.Fatalf("probe %d got target %v, want %v", i, got, addr)
+		}
+	}
+	if got := l.Address(); got != "" {
+		t.Fatalf("got address %v while probing", got)
+	}
+
+	checkAnnouncement(t, nextARP(t, linkEP, clock), addr)
+	if got := l.Address(); got != addr {
+		t.Fatalf("got address %v, want %v", got, addr)
+	}
+	if got := s.CheckLocalAddress(1, ipv4.ProtocolNumber, addr); got != 1 {
+		t.Fatalf("CheckLocalAddress got %v, want 1", got)
+	}
+	checkAnnouncement(t, nextARP(t, linkEP, clock), addr)
+	if _, ok := clock.NextExpiration(); ok {
+		t.Errorf("timer pending after announcements")
+	}
+
+	l.Stop()
+	if got := s.CheckLocalAddress(1, ipv4.ProtocolNumber, addr); got != 0 {
+		t.Errorf("CheckLocalAddress after Stop got %v, want 0", got)
+	}
+	want := []change{{"", addr}, {addr, ""}}
+	if len(changes) != len(want) || changes[0] != want[0] || changes[1] != want[1] {
+		t.Errorf("got address changes %v, want %v", changes, want)
+	}
+}
+
+func TestLinkLocalProbeConflict(t *testing.T) {
+	s, linkEP, clock := newLinkLocalTestContext(t)
+	l, err := arp.StartLinkLocal(s, 1, nil)
+	if err != nil {
+		t.Fatalf("StartLinkLocal failed: %v", err)
+	}
+	defer l.Stop()
+
+	addr := checkProbe(t, nextARP(t, linkEP, clock))
+	injectClaim(linkEP, addr)
+
+	// Probing starts again for another address.
+	next := checkProbe(t, nextARP(t, linkEP, clock))
+	if next == addr {
+		t.Fatalf("probing %v again after a conflict", addr)
+	}
+	for i := 1; i < 3; i++ {
+		checkProbe(t, nextARP(t, linkEP, clock))
+	}
+	checkAnnouncement(t, nextARP(t, linkEP, clock), next)
+}
+
+func TestLinkLocalDefense(t *testing.T) {
+	s, linkEP, clock := newLinkLocalTestContext(t)
+	l, err := arp.StartLinkLocal(s, 1, nil)
+	if err != nil {
+		t.Fatalf("StartLinkLocal failed: %v", err)
+	}
+	defer l.Stop()
+
+	for i := 0; i < 5; i++ {
+		nextARP(t, linkEP, clock)
+	}
+	addr := l.Address()
+	if addr == "" {
+		t.Fatalf("no address configured")
+	}
+
+	// The first claim is answered with an announcement.
+	injectClaim(linkEP, addr)
+	select {
+	case pkt := <-linkEP.C:
+		checkAnnouncement(t, header.ARP(pkt.Header), addr)
+	default:
+		t.Fatalf("address not defended")
+	}
+
+	// Another claim after DEFEND_INTERVAL is answered too.
+	clock.Advance(11 * time.Second)
+	injectClaim(linkEP, addr)
+	select {
+	case pkt := <-linkEP.C:
+		checkAnnouncement(t, header.ARP(pkt.Header), addr)
+	default:
+		t.Fatalf("address not defended after DEFEND_INTERVAL")
+	}
+
+	// But the address is given up if claimed again within DEFEND_INTERVAL.
+	clock.Advance(time.Second)
+	injectClaim(linkEP, addr)
+	if got := l.Address(); got != "" {
+		t.Fatalf("got address %v after losing it", got)
+	}
+	if got := s.CheckLocalAddress(1, ipv4.ProtocolNumber, addr); got != 0 {
+		t.Fatalf("CheckLocalAddress got %v, want 0", got)
+	}
+	if got := checkProbe(t, nextARP(t, linkEP, clock)); got == addr {
+		t.Fatalf("probing %v again after losing it", got)
+	}
+}
+
+// resolvingEndpoint is a link endpoint that requires link address resolution.
+type resolvingEndpoint struct {
+	stack.LinkEndpoint
+}
+
+func (e resolvingEndpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.LinkEndpoint.Capabilities() | stack.CapabilityResolutionRequired
+}
+
+func TestMultipathDeadNextHop(t *testing.T) {
+	const (
+		gw1 = tcpip.Address("\x0a\x00\x00\x0a")
+		gw2 = tcpip.Address("\x0a\x00\x00\x0b")
+	)
+	clock := faketime.NewManualClock()
+	s := stack.New([]string{ipv4.ProtocolName, arp.ProtocolName}, nil, stack.Options{Clock: clock})
+	_, linkEP := channel.New(256, 1500, stackLinkAddr)
+	if err := s.CreateNIC(1, stack.RegisterLinkEndpoint(resolvingEndpoint{linkEP})); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr1); err != nil {
+		t.Fatalf("AddAddress for ipv4 failed: %v", err)
+	}
+	if err := s.AddAddress(1, arp.ProtocolNumber, arp.ProtocolAddress); err != nil {
+		t.Fatalf("AddAddress for arp failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4Any, Mask: "\x00\x00\x00\x00", Gateway: gw1, NIC: 1},
+		{Destination: header.IPv4Any, Mask: "\x00\x00\x00\x00", Gateway: gw2, NIC: 1},
+	})
+
+	nextHops := func() map[tcpip.Address]tcpip.Address {
+		m := make(map[tcpip.Address]tcpip.Address)
+		for i := 0; i < 64; i++ {
+			dst := tcpip.Address([]byte{192, 168, 0, byte(i)})
+			r, err := s.FindRoute(0, "", dst, ipv4.ProtocolNumber, false /* multicastLoop */)
+			if err != nil {
+				t.Fatalf("FindRoute(%v) failed: %v", dst, err)
+			}
+			m[dst] = r.NextHop
+			r.Release()
+		}
+		return m
+	}
+	before := nextHops()
+	var dst tcpip.Address
+	for d, gw := range before {
+		if gw == gw1 {
+			dst = d
+			break
+		}
+	}
+	if dst == "" {
+		t.Fatalf("no destination routed through %v: %v", gw1, before)
+	}
+
+	failures := make(chan stack.ResolutionFailureEvent, 1)
+	cancel := s.SubscribeResolutionFailure(func(e stack.ResolutionFailureEvent) { failures <- e })
+	defer cancel()
+
+	// Resolving gw1 fails, so it's left out of the route.
+	r, err := s.FindRoute(0, "", dst, ipv4.ProtocolNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute(%v) failed: %v", dst, err)
+	}
+	if _, err := r.Resolve(&sleep.Waker{}); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got Resolve() = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+	r.Release()
+	deadline := time.Now().Add(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case e := <-failures:
+			if e.Addr != gw1 {
+				t.Fatalf("resolution of %v failed, want %v", e.Addr, gw1)
+			}
+			done = true
+		case <-linkEP.C:
+		default:
+			if time.Now().After(deadline) {
+				t.Fatal("resolution didn't fail")
+			}
+			clock.Advance(time.Second)
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for d, gw := range nextHops() {
+		if gw != gw2 {
+			t.Errorf("got next hop %v for %v, want %v while %v is dead", gw, d, gw2, gw1)
+		}
+	}
+	if got := s.Stats().IP.DeadNextHops.Value(); got != 1 {
+		t.Errorf("got IP.DeadNextHops = %d, want 1", got)
+	}
+
+	// It's used again once resolved.
+	s.AddLinkAddress(1, gw1, "\x01\x02\x03\x04\x05\x06")
+	if got := nextHops(); !reflect.DeepEqual(got, before) {
+		t.Errorf("got next hops %v once %v is resolved, want %v", got, gw1, before)
+	}
+}
+
+// linkAddrRecorder records the link address packets are written to.
+type linkAddrRecorder struct {
+	resolvingEndpoint
+	linkAddrs []tcpip.LinkAddress
+}
+
+func (e *linkAddrRecorder) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	if protocol == ipv4.ProtocolNumber {
+		e.linkAddrs = append(e.linkAddrs, r.RemoteLinkAddress)
+	}
+	return e.resolvingEndpoint.WritePacket(r, pkt, protocol)
+}
+
+func TestResolutionQueuing(t *testing.T) {
+	const (
+		neighborAddr     = tcpip.Address("\x0a\x00\x00\x05")
+		neighborLinkAddr = tcpip.LinkAddress("\x01\x02\x03\x04\x05\x06")
+		deadAddr         = tcpip.Address("\x0a\x00\x00\x06")
+		// maxPendingPackets mirrors the stack's limit.
+		maxPendingPackets = 32
+	)
+	clock := faketime.NewManualClock()
+	s := stack.New([]string{ipv4.ProtocolName, arp.ProtocolName}, []string{udp.ProtocolName}, stack.Options{Clock: clock})
+	_, linkEP := channel.New(256, 1500, stackLinkAddr)
+	rec := &linkAddrRecorder{resolvingEndpoint: resolvingEndpoint{linkEP}}
+	if err := s.CreateNIC(1, stack.RegisterLinkEndpoint(rec)); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr1); err != nil {
+		t.Fatalf("AddAddress for ipv4 failed: %v", err)
+	}
+	if err := s.AddAddress(1, arp.ProtocolNumber, arp.ProtocolAddress); err != nil {
+		t.Fatalf("AddAddress for arp failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4Any, Mask: "\x00\x00\x00\x00", NIC: 1}})
+
+	send := func(dst tcpip.Address, n int) {
+		t.Helper()
+		r, err := s.FindRoute(0, "", dst, ipv4.ProtocolNumber, false /* multicastLoop */)
+		if err != nil {
+			t.Fatalf("FindRoute(%v) failed: %v", dst, err)
+		}
+		defer r.Release()
+		for i := 0; i < n; i++ {
+			pkt := stack.NewOutboundPacketBuffer(buffer.NewPrependable(int(r.MaxHeaderLength())), buffer.NewViewFromBytes([]byte{byte(i)}).ToVectorisedView())
+			err := r.WritePacket(pkt, header.UDPProtocolNumber, 64)
+			pkt.DecRef()
+			if err != nil {
+				t.Fatalf("WritePacket #%d failed: %v", i, err)
+			}
+		}
+	}
+	// arps drains the packets sent so far, which must all be ARP requests.
+	arps := func() int {
+		t.Helper()
+		n := 0
+		for {
+			select {
+			case pkt := <-linkEP.C:
+				if pkt.Proto != arp.ProtocolNumber {
+					t.Fatalf("got a packet of protocol %d while resolving, want ARP only", pkt.Proto)
+				}
+				n++
+			default:
+				return n
+			}
+		}
+	}
+
+	// The packets sent while the neighbor is resolved are queued, the
+	// oldest ones being dropped beyond the limit.
+	send(neighborAddr, maxPendingPackets+2)
+	select {
+	case pkt := <-linkEP.C:
+		if pkt.Proto != arp.ProtocolNumber {
+			t.Fatalf("got a packet of protocol %d while resolving, want ARP only", pkt.Proto)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no ARP request sent")
+	}
+	if n := arps(); n != 0 {
+		t.Fatalf("got %d more ARP requests, want 1", n)
+	}
+	if got := s.Stats().Drops.QueueFull.Value(); got != 2 {
+		t.Errorf("got Drops.QueueFull = %d, want 2", got)
+	}
+
+	// They are sent in order once it's resolved.
+	v := make(buffer.View, header.ARPSize)
+	h := header.ARP(v)
+	h.SetIPv4OverEthernet()
+	h.SetOp(header.ARPReply)
+	copy(h.HardwareAddressSender(), neighborLinkAddr)
+	copy(h.ProtocolAddressSender(), neighborAddr)
+	copy(h.HardwareAddressTarget(), stackLinkAddr)
+	copy(h.ProtocolAddressTarget(), stackAddr1)
+	linkEP.Inject(arp.ProtocolNumber, v.ToVectorisedView())
+	for i := 2; i < maxPendingPackets+2; i++ {
+		select {
+		case pkt := <-linkEP.C:
+			if pkt.Proto != ipv4.ProtocolNumber || len(pkt.Payload) != 1 || int(pkt.Payload[0]) != i {
+				t.Fatalf("got packet %+v, want IPv4 packet #%d", pkt, i)
+			}
+		default:
+			t.Fatalf("queued packet #%d not sent after resolution", i)
+		}
+	}
+	for _, a := range rec.linkAddrs {
+		if a != neighborLinkAddr {
+			t.Fatalf("got packet sent to %v, want %v", a, neighborLinkAddr)
+		}
+	}
+
+	// The packets queued for a neighbor that can't be resolved are
+	// dropped, and the endpoints connected through it get an error.
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Connect(tcpip.FullAddress{Addr: deadAddr, Port: 53}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	failures := make(chan stack.ResolutionFailureEvent, 1)
+	cancel := s.SubscribeResolutionFailure(func(e stack.ResolutionFailureEvent) { failures <- e })
+	defer cancel()
+	send(deadAddr, 3)
+	deadline := time.Now().Add(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case <-failures:
+			done = true
+		default:
+			if time.Now().After(deadline) {
+				t.Fatal("resolution didn't fail")
+			}
+			arps()
+			clock.Advance(time.Second)
+			time.Sleep(time.Millisecond)
+		}
+	}
+	arps()
+	if got := s.Stats().Drops.ResolutionFailed.Value(); got != 3 {
+		t.Errorf("got Drops.ResolutionFailed = %d, want 3", got)
+	}
+	if err := ep.GetSockOpt(tcpip.ErrorOption{}); err != tcpip.ErrHostUnreachable {
+		t.Errorf("got GetSockOpt(ErrorOption{}) = %v, want %v", err, tcpip.ErrHostUnreachable)
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arp
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// Protocol constants of RFC 3927 section 9.
+const (
+	linkLocalProbeWait        = 1 * time.Second
+	linkLocalProbeNum         = 3
+	linkLocalProbeMin         = 1 * time.Second
+	linkLocalProbeMax         = 2 * time.Second
+	linkLocalAnnounceWait     = 2 * time.Second
+	linkLocalAnnounceNum      = 2
+	linkLocalAnnounceInterval = 2 * time.Second
+	linkLocalMaxConflicts     = 10
+	linkLocalRateLimit        = 60 * time.Second
+	linkLocalDefendInterval   = 10 * time.Second
+)
+
+// LinkLocalSubnet is the IPv4 link-local subnet, 169.254.0.0/16.
+var LinkLocalSubnet = func() tcpip.Subnet {
+	s, err := tcpip.NewSubnet("\xa9\xfe\x00\x00", "\xff\xff\x00\x00")
+	if err != nil {
+		panic(err)
+	}
+	return s
+}()
+
+type linkLocalState int
+
+const (
+	linkLocalProbing linkLocalState = iota
+	linkLocalAnnouncing
+	linkLocalBound
+	linkLocalStopped
+)
+
+// LinkLocal configures an IPv4 link-local address in 169.254/16 on a NIC, as
+// described in RFC 3927. It is meant for networks without a DHCP server:
+// start it when DHCP gets no answer, so that hosts on the link can still talk
+// to each other, and stop it once a routable address is acquired.
+//
+// Candidate addresses are probed with ARP before being used, and picked again
+// on conflicts. Once added to the NIC, the address is announced and defended
+// against other hosts claiming it; if it can't be defended, it is removed and
+// a new one is configured.
+type LinkLocal struct {
+	stack    *stack.Stack
+	nicid    tcpip.NICID
+	proto    *protocol
+	linkAddr tcpip.LinkAddress
+	acquired func(old, new tcpip.Address)
+
+	mu        sync.Mutex
+	state     linkLocalState
+	rand      *rand.Rand
+	candidate tcpip.Address
+	// addr is the address added to the NIC, if any.
+	addr tcpip.Address
+	// sent is the number of probes or announcements sent in the current
+	// state.
+	sent      int
+	conflicts int
+	// defended is whether an announcement was sent to defend addr, at the
+	// monotonic time lastDefense.
+	defended    bool
+	lastDefense int64
+	timer       tcpip.Timer
+	// timerGen identifies the current timer, so that a stale timer whose
+	// function runs after being replaced does nothing.
+	timerGen uint64
+}
+
+// StartLinkLocal starts configuring an IPv4 link-local address on the NIC.
+// The stack must have the ARP and IPv4 protocols, and the NIC an ARP address.
+//
+// acquired, if not nil, is called with the previous and new address whenever
+// the configured address changes, including to and from the empty address.
+// It is called without holding any lock of the stack, and can be used to add
+// or remove a route to LinkLocalSubnet.
+func StartLinkLocal(s *stack.Stack, nicid tcpip.NICID, acquired func(old, new tcpip.Address)) (*LinkLocal, *tcpip.Error) {
+	p, ok := s.NetworkProtocolInstance(ProtocolNumber).(*protocol)
+	if !ok {
+		return nil, tcpip.ErrUnknownProtocol
+	}
+	e := p.endpoint(nicid)
+	if e == nil {
+		return nil, tcpip.ErrUnknownNICID
+	}
+	linkAddr := e.linkEP.LinkAddress()
+
+	// Seed with the link address, so that the host gets the same sequence
+	// of addresses, and most likely the same address, every time it joins
+	// the network, as suggested by RFC 3927 section 2.1.
+	h := fnv.New64a()
+	h.Write([]byte(linkAddr))
+	h.Write([]byte{byte(nicid), byte(nicid >> 8), byte(nicid >> 16), byte(nicid >> 24)})
+
+	l := &LinkLocal{
+		stack:    s,
+		nicid:    nicid,
+		proto:    p,
+		linkAddr: linkAddr,
+		acquired: acquired,
+		rand:     rand.New(rand.NewSource(int64(h.Sum64()))),
+	}
+	if err := p.addLinkLocal(nicid, l); err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	l.probeLocked(0)
+	l.mu.Unlock()
+	return l, nil
+}
+
+// Address returns the configured link-local address, or the empty address if
+// none is configured yet.
+func (l *LinkLocal) Address() tcpip.Address {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.addr
+}
+
+// Stop stops the configuration and removes the link-local address from the
+// NIC.
+func (l *LinkLocal) Stop() {
+	l.proto.removeLinkLocal(l.nicid, l)
+
+	l.mu.Lock()
+	l.state = linkLocalStopped
+	l.timerGen++
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	old := l.releaseLocked()
+	l.mu.Unlock()
+
+	l.notify(old, "")
+}
+
+// notify calls the acquired function if the address changed.
+func (l *LinkLocal) notify(old, new tcpip.Address) {
+	if old != new && l.acquired != nil {
+		l.acquired(old, new)
+	}
+}
+
+// releaseLocked removes the address from the NIC and returns it.
+//
+// Precondition: l.mu must be held.
+func (l *LinkLocal) releaseLocked() tcpip.Address {
+	old := l.addr
+	if old != "" {
+		l.stack.RemoveAddress(l.nicid, old)
+		l.addr = ""
+	}
+	return old
+}
+
+// pickLocked chooses a new candidate address in 169.254.1.0 to
+// 169.254.254.255, the range allowed by RFC 3927 section 2.1.
+//
+// Precondition: l.mu must be held.
+func (l *LinkLocal) pickLocked() {
+	const first = 0xa9fe0100
+	const count = 0xa9fefeff - first + 1
+	var b [header.IPv4AddressSize]byte
+	binary.BigEndian.PutUint32(b[:], first+uint32(l.rand.Intn(count)))
+	l.candidate = tcpip.Address(b[:])
+}
+
+// probeLocked starts probing a new candidate after delay. A random wait of up
+// to PROBE_WAIT is added, to avoid hosts starting at the same time from
+// probing in lockstep.
+//
+// Precondition: l.mu must be held.
+func (l *LinkLocal) probeLocked(delay time.Duration) {
+	l.pickLocked()
+	l.state = linkLocalProbing
+	l.sent = 0
+	l.scheduleLocked(delay + time.Duration(l.rand.Int63n(int64(linkLocalProbeWait))))
+}
+
+// scheduleLocked arranges for the next step to run after d.
+//
+// Precondition: l.mu must be held.
+func (l *LinkLocal) scheduleLocked(d time.Duration) {
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	l.timerGen++
+	gen := l.timerGen
+	l.timer = l.stack.Clock().AfterFunc(d, func() {
+		l.mu.Lock()
+		if l.timerGen != gen {
+			l.mu.Unlock()
+			return
+		}
+		old := l.addr
+		new := l.stepLocked()
+		l.mu.Unlock()
+		l.notify(old, new)
+	})
+}
+
+// stepLocked sends the next probe or announcement, and returns the address
+// configured afterwards.
+//
+// Precondition: l.mu must be held.
+func (l *LinkLocal) stepLocked() tcpip.Address {
+	switch l.state {
+	case linkLocalProbing:
+		if l.sent < linkLocalProbeNum {
+			l.send("", l.candidate)
+			l.sent++
+			if l.sent < linkLocalProbeNum {
+				l.scheduleLocked(linkLocalProbeMin + time.Duration(l.rand.Int63n(int64(linkLocalProbeMax-linkLocalProbeMin))))
+			} else {
+				l.scheduleLocked(linkLocalAnnounceWait)
+			}
+			break
+		}
+
+		// No conflict was seen, claim the candidate.
+		if err := l.stack.AddAddress(l.nicid, header.IPv4ProtocolNumber, l.candidate); err != nil {
+			l.conflictLocked()
+			break
+		}
+		l.addr = l.candidate
+		l.state = linkLocalAnnouncing
+		l.sent = 0
+		fallthrough
+	case linkLocalAnnouncing:
+		l.send(l.addr, l.addr)
+		l.sent++
+		if l.sent < linkLocalAnnounceNum {
+			l.scheduleLocked(linkLocalAnnounceInterval)
+		} else {
+			l.state = linkLocalBound
+			l.conflicts = 0
+		}
+	}
+	return l.addr
+}
+
+// conflictLocked gives up the candidate, and any configured address, and
+// starts again with a new one. After MAX_CONFLICTS conflicts, new candidates
+// are tried no more often than RATE_LIMIT_INTERVAL, as per RFC 3927 section
+// 2.2.1.
+//
+// Precondition: l.mu must be held.
+func (l *LinkLocal) conflictLocked() {
+	l.releaseLocked()
+	l.defended = false
+	l.conflicts++
+	var delay time.Duration
+	if l.conflicts >= linkLocalMaxConflicts {
+		delay = linkLocalRateLimit
+	}
+	l.probeLocked(delay)
+}
+
+// handlePacket looks for conflicts in an ARP packet received on the NIC.
+func (l *LinkLocal) handlePacket(h header.ARP) {
+	sender := tcpip.Address(h.ProtocolAddressSender())
+	target := tcpip.Address(h.ProtocolAddressTarget())
+	if tcpip.LinkAddress(h.HardwareAddressSender()) == l.linkAddr {
+		return
+	}
+
+	l.mu.Lock()
+	old := l.addr
+	switch l.state {
+	case linkLocalProbing:
+		// Another host uses the candidate, or is probing for it too.
+		if sender == l.candidate || (sender == header.IPv4Any && h.Op() == header.ARPRequest && target == l.candidate) {
+			l.conflictLocked()
+		}
+	case linkLocalAnnouncing, linkLocalBound:
+		if sender != l.addr {
+			break
+		}
+		// Defend the address once, and give it up if it's claimed again
+		// within DEFEND_INTERVAL, as per RFC 3927 section 2.5 (b).
+		now := l.stack.Clock().NowMonotonic()
+		if l.defended && time.Duration(now-l.lastDefense) < linkLocalDefendInterval {
+			l.conflictLocked()
+			break
+		}
+		l.defended = true
+		l.lastDefense = now
+		l.send(l.addr, l.addr)
+	}
+	new := l.addr
+	l.mu.Unlock()
+
+	l.notify(old, new)
+}
+
+// send broadcasts an ARP request for target with the given sender address.
+// It is a probe if sender is empty, and an announcement if sender is target.
+func (l *LinkLocal) send(sender, target tcpip.Address) {
+	e := l.proto.endpoint(l.nicid)
+	if e == nil {
+		return
+	}
+	r := &stack.Route{
+		RemoteLinkAddress: broadcastMAC,
+	}
+
+	hdr := buffer.NewPrependable(int(e.linkEP.MaxHeaderLength()) + header.ARPSize)
+	h := header.ARP(hdr.Prepend(header.ARPSize))
+	h.SetIPv4OverEthernet()
+	h.SetOp(header.ARPRequest)
+	copy(h.HardwareAddressSender(), l.linkAddr)
+	if sender != "" {
+		copy(h.ProtocolAddressSender(), sender)
+	}
+	copy(h.ProtocolAddressTarget(), target)
+
+	pkt := stack.NewOutboundPacketBuffer(hdr, buffer.VectorisedView{})
+	e.linkEP.WritePacket(r, pkt, ProtocolNumber)
+	pkt.DecRef()
+}
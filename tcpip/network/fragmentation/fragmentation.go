@@ -21,6 +21,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 )
 
@@ -49,6 +50,7 @@ type Fragmentation struct {
 	rList        reassemblerList
 	size         int
 	timeout      time.Duration
+	clock        tcpip.Clock
 }
 
 // NewFragmentation creates a new Fragmentation.
@@ -61,9 +63,12 @@ type Fragmentation struct {
 // fragments after reaching highMemoryLimit.
 //
 // reassemblingTimeout specifes the maximum time allowed to reassemble a packet.
-// Fragments are lazily evicted only when a new a packet with an
-// already existing fragmentation-id arrives after the timeout.
-func NewFragmentation(highMemoryLimit, lowMemoryLimit int, reassemblingTimeout time.Duration) *Fragmentation {
+// Fragments of a packet are evicted by a timer of clock once the timeout
+// elapses, so they don't linger until memory runs short.
+//
+// clock is used to measure the reassembling timeout. A stack passes its own
+// clock, so the timers share its timing wheel if it has one.
+func NewFragmentation(highMemoryLimit, lowMemoryLimit int, reassemblingTimeout time.Duration, clock tcpip.Clock) *Fragmentation {
 	if lowMemoryLimit >= highMemoryLimit {
 		lowMemoryLimit = highMemoryLimit
 	}
@@ -77,6 +82,7 @@ func NewFragmentation(highMemoryLimit, lowMemoryLimit int, reassemblingTimeout t
 		highLimit:    highMemoryLimit,
 		lowLimit:     lowMemoryLimit,
 		timeout:      reassemblingTimeout,
+		clock:        clock,
 	}
 }
 
@@ -84,16 +90,22 @@ func NewFragmentation(highMemoryLimit, lowMemoryLimit int, reassemblingTimeout t
 // and returns a complete packet when all the packets belonging to that ID have been received.
 func (f *Fragmentation) Process(id uint32, first, last uint16, more bool, vv buffer.VectorisedView) (buffer.VectorisedView, bool) {
 	f.mu.Lock()
+	now := f.clock.NowMonotonic()
 	r, ok := f.reassemblers[id]
-	if ok && r.tooOld(f.timeout) {
+	if ok && r.tooOld(now, f.timeout) {
 		// This is very likely to be an id-collision or someone performing a slow-rate attack.
 		f.release(r)
 		ok = false
 	}
 	if !ok {
-		r = newReassembler(id)
+		r = newReassembler(id, now)
 		f.reassemblers[id] = r
 		f.rList.PushFront(r)
+		r.timer = f.clock.AfterFunc(f.timeout, func() {
+			f.mu.Lock()
+			f.release(r)
+			f.mu.Unlock()
+		})
 	}
 	f.mu.Unlock()
 
@@ -123,6 +135,9 @@ func (f *Fragmentation) release(r *reassembler) {
 	if r.checkDoneOrMark() {
 		return
 	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
 
 	delete(f.reassemblers, r.id)
 	f.rList.Remove(r)
@@ -19,7 +19,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/faketime"
+	"github.com/google/netstack/tcpip/timerwheel"
 )
 
 // vv is a helper to build VectorisedView from different strings.
@@ -81,7 +84,7 @@ var processTestCases = []struct {
 func TestFragmentationProcess(t *testing.T) {
 	for _, c := range processTestCases {
 		t.Run(c.comment, func(t *testing.T) {
-			f := NewFragmentation(1024, 512, DefaultReassembleTimeout)
+			f := NewFragmentation(1024, 512, DefaultReassembleTimeout, &tcpip.StdClock{})
 			for i, in := range c.in {
 				vv, done := f.Process(in.id, in.first, in.last, in.more, in.vv)
 				if !reflect.DeepEqual(vv, c.out[i].vv) {
@@ -107,11 +110,12 @@ func TestFragmentationProcess(t *testing.T) {
 
 func TestReassemblingTimeout(t *testing.T) {
 	timeout := time.Millisecond
-	f := NewFragmentation(1024, 512, timeout)
+	clock := faketime.NewManualClock()
+	f := NewFragmentation(1024, 512, timeout, clock)
 	// Send first fragment with id = 0, first = 0, last = 0, and more = true.
 	f.Process(0, 0, 0, true, vv(1, "0"))
-	// Sleep more than the timeout.
-	time.Sleep(2 * timeout)
+	// Let more than the timeout elapse.
+	clock.Advance(2 * timeout)
 	// Send another fragment that completes a packet.
 	// However, no packet should be reassembled because the fragment arrived after the timeout.
 	_, done := f.Process(0, 1, 1, false, vv(1, "1"))
@@ -120,8 +124,42 @@ func TestReassemblingTimeout(t *testing.T) {
 	}
 }
 
+func TestReassemblingTimeoutEvicts(t *testing.T) {
+	timeout := time.Second
+	clock := faketime.NewManualClock()
+	wheel := timerwheel.New(clock, 10*time.Millisecond)
+	f := NewFragmentation(1024, 512, timeout, wheel)
+
+	// An incomplete packet arms a timer of the clock.
+	f.Process(0, 0, 0, true, vv(1, "0"))
+	if got := wheel.Pending(); got != 1 {
+		t.Fatalf("got wheel.Pending() = %d, want = 1", got)
+	}
+	// Completing a packet stops its timer.
+	f.Process(1, 0, 0, true, vv(1, "0"))
+	if _, done := f.Process(1, 1, 1, false, vv(1, "1")); !done {
+		t.Fatalf("packet 1 wasn't reassembled")
+	}
+	if got := wheel.Pending(); got != 1 {
+		t.Fatalf("got wheel.Pending() = %d, want = 1", got)
+	}
+
+	// The fragments of the incomplete packet go away once the timeout
+	// elapses, without waiting for another fragment or memory pressure.
+	clock.Advance(2 * timeout)
+	f.mu.Lock()
+	size, n := f.size, len(f.reassemblers)
+	f.mu.Unlock()
+	if size != 0 || n != 0 {
+		t.Errorf("got size = %d with %d reassemblers after the timeout, want = 0 with 0", size, n)
+	}
+	if got := wheel.Pending(); got != 0 {
+		t.Errorf("got wheel.Pending() = %d, want = 0", got)
+	}
+}
+
 func TestMemoryLimits(t *testing.T) {
-	f := NewFragmentation(3, 1, DefaultReassembleTimeout)
+	f := NewFragmentation(3, 1, DefaultReassembleTimeout, &tcpip.StdClock{})
 	// Send first fragment with id = 0.
 	f.Process(0, 0, 0, true, vv(1, "0"))
 	// Send first fragment with id = 1.
@@ -145,7 +183,7 @@ func TestMemoryLimits(t *testing.T) {
 }
 
 func TestMemoryLimitsIgnoresDuplicates(t *testing.T) {
-	f := NewFragmentation(1, 0, DefaultReassembleTimeout)
+	f := NewFragmentation(1, 0, DefaultReassembleTimeout, &tcpip.StdClock{})
 	// Send first fragment with id = 0.
 	f.Process(0, 0, 0, true, vv(1, "0"))
 	// Send the same packet again.
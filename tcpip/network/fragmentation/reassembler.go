@@ -21,6 +21,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 )
 
@@ -39,16 +40,21 @@ type reassembler struct {
 	deleted      int
 	heap         fragHeap
 	done         bool
-	creationTime time.Time
+	creationTime int64
+
+	// timer evicts the reassembler when the reassembling timeout elapses.
+	// It is protected by Fragmentation.mu.
+	timer tcpip.Timer
 }
 
-func newReassembler(id uint32) *reassembler {
+// newReassembler returns a reassembler created at monotonic time now.
+func newReassembler(id uint32, now int64) *reassembler {
 	r := &reassembler{
 		id:           id,
 		holes:        make([]hole, 0, 16),
 		deleted:      0,
 		heap:         make(fragHeap, 0, 8),
-		creationTime: time.Now(),
+		creationTime: now,
 	}
 	r.holes = append(r.holes, hole{
 		first:   0,
@@ -105,8 +111,10 @@ func (r *reassembler) process(first, last uint16, more bool, vv buffer.Vectorise
 	return res, true, consumed
 }
 
-func (r *reassembler) tooOld(timeout time.Duration) bool {
-	return time.Now().Sub(r.creationTime) > timeout
+// tooOld reports whether more than timeout elapsed between the creation of r
+// and monotonic time now.
+func (r *reassembler) tooOld(now int64, timeout time.Duration) bool {
+	return time.Duration(now-r.creationTime) > timeout
 }
 
 func (r *reassembler) checkDoneOrMark() bool {
@@ -19,6 +19,7 @@ import (
 	"encoding/binary"
 
 	"github.com/google/netstack/rand"
+	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/header"
 )
 
@@ -88,6 +89,27 @@ func IPv6FragmentHash(h header.IPv6, f header.IPv6Fragment) uint32 {
 	return Hash3Words(f.ID(), y, z, hashIV)
 }
 
+// TupleHash hashes the addresses, transport protocol and ports of a flow. The
+// flow package uses it to hash the flows of packets.
+func TupleHash(src, dst tcpip.Address, proto tcpip.TransportProtocolNumber, srcPort, dstPort uint16, seed uint32) uint32 {
+	ports := uint32(srcPort)<<16 | uint32(dstPort)
+	return Hash3Words(fold([]byte(src)), fold([]byte(dst)), ports^uint32(proto), seed)
+}
+
+// fold xors an address into a single 32-bit word.
+func fold(a []byte) uint32 {
+	var v uint32
+	for len(a) >= 4 {
+		v ^= binary.BigEndian.Uint32(a)
+		a = a[4:]
+	}
+	// Addresses whose length isn't a multiple of 4 are padded with zeroes.
+	for i, b := range a {
+		v ^= uint32(b) << uint(24-8*i)
+	}
+	return v
+}
+
 func rol32(v, shift uint32) uint32 {
 	return (v << shift) | (v >> ((-shift) & 31))
 }
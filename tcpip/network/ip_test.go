@@ -15,11 +15,14 @@
 package ip_test
 
 import (
+	"bytes"
+	"reflect"
 	"testing"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
 	"github.com/google/netstack/tcpip/link/loopback"
 	"github.com/google/netstack/tcpip/network/ipv4"
 	"github.com/google/netstack/tcpip/network/ipv6"
@@ -94,15 +97,20 @@ func (t *testObject) checkValues(protocol tcpip.TransportProtocolNumber, vv buff
 // DeliverTransportPacket is called by network endpoints after parsing incoming
 // packets. This is used by the test object to verify that the results of the
 // parsing are expected.
-func (t *testObject) DeliverTransportPacket(r *stack.Route, protocol tcpip.TransportProtocolNumber, netHeader buffer.View, vv buffer.VectorisedView) {
-	t.checkValues(protocol, vv, r.RemoteAddress, r.LocalAddress)
+func (t *testObject) DeliverTransportPacket(r *stack.Route, protocol tcpip.TransportProtocolNumber, pkt *stack.PacketBuffer) {
+	t.checkValues(protocol, pkt.Data, r.RemoteAddress, r.LocalAddress)
 	t.dataCalls++
 }
 
+// DeliverRawTransportPacket is called by network endpoints for the packets
+// that only raw endpoints receive, which the test object ignores.
+func (*testObject) DeliverRawTransportPacket(*stack.Route, tcpip.TransportProtocolNumber, *stack.PacketBuffer) {
+}
+
 // DeliverTransportControlPacket is called by network endpoints after parsing
 // incoming control (ICMP) packets. This is used by the test object to verify
 // that the results of the parsing are expected.
-func (t *testObject) DeliverTransportControlPacket(local, remote tcpip.Address, net tcpip.NetworkProtocolNumber, trans tcpip.TransportProtocolNumber, typ stack.ControlType, extra uint32, vv buffer.VectorisedView) {
+func (t *testObject) DeliverTransportControlPacket(local, remote tcpip.Address, net tcpip.NetworkProtocolNumber, trans tcpip.TransportProtocolNumber, typ stack.ControlType, extra uint32, info stack.ControlInfo, vv buffer.VectorisedView) {
 	t.checkValues(trans, vv, remote, local)
 	if typ != t.typ {
 		t.t.Errorf("typ = %v, want %v", typ, t.typ)
@@ -145,24 +153,24 @@ func (*testObject) LinkAddress() tcpip.LinkAddress {
 // WritePacket is called by network endpoints after producing a packet and
 // writing it to the link endpoint. This is used by the test object to verify
 // that the produced packet is as expected.
-func (t *testObject) WritePacket(_ *stack.Route, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+func (t *testObject) WritePacket(_ *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
 	var prot tcpip.TransportProtocolNumber
 	var srcAddr tcpip.Address
 	var dstAddr tcpip.Address
 
 	if t.v4 {
-		h := header.IPv4(hdr.View())
+		h := header.IPv4(pkt.Header.View())
 		prot = tcpip.TransportProtocolNumber(h.Protocol())
 		srcAddr = h.SourceAddress()
 		dstAddr = h.DestinationAddress()
 
 	} else {
-		h := header.IPv6(hdr.View())
+		h := header.IPv6(pkt.Header.View())
 		prot = tcpip.TransportProtocolNumber(h.NextHeader())
 		srcAddr = h.SourceAddress()
 		dstAddr = h.DestinationAddress()
 	}
-	t.checkValues(prot, payload, srcAddr, dstAddr)
+	t.checkValues(prot, pkt.Data, srcAddr, dstAddr)
 	return nil
 }
 
@@ -197,7 +205,7 @@ func buildIPv6Route(local, remote tcpip.Address) (stack.Route, *tcpip.Error) {
 func TestIPv4Send(t *testing.T) {
 	o := testObject{t: t, v4: true}
 	proto := ipv4.NewProtocol()
-	ep, err := proto.NewEndpoint(1, localIpv4Addr, nil, nil, &o)
+	ep, err := proto.NewEndpoint(1, localIpv4Addr, nil, &tcpip.StdClock{}, nil, &o)
 	if err != nil {
 		t.Fatalf("NewEndpoint failed: %v", err)
 	}
@@ -221,7 +229,9 @@ func TestIPv4Send(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not find route: %v", err)
 	}
-	if err := ep.WritePacket(&r, hdr, payload.ToVectorisedView(), 123, 123, stack.PacketOut); err != nil {
+	pkt := stack.NewOutboundPacketBuffer(hdr, payload.ToVectorisedView())
+	defer pkt.DecRef()
+	if err := ep.WritePacket(&r, pkt, stack.NetworkHeaderParams{Protocol: 123, TTL: 123}, stack.PacketOut); err != nil {
 		t.Fatalf("WritePacket failed: %v", err)
 	}
 }
@@ -229,7 +239,7 @@ func TestIPv4Send(t *testing.T) {
 func TestIPv4Receive(t *testing.T) {
 	o := testObject{t: t, v4: true}
 	proto := ipv4.NewProtocol()
-	ep, err := proto.NewEndpoint(1, localIpv4Addr, nil, &o, nil)
+	ep, err := proto.NewEndpoint(1, localIpv4Addr, nil, &tcpip.StdClock{}, &o, nil)
 	if err != nil {
 		t.Fatalf("NewEndpoint failed: %v", err)
 	}
@@ -261,7 +271,7 @@ func TestIPv4Receive(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not find route: %v", err)
 	}
-	ep.HandlePacket(&r, view.ToVectorisedView())
+	ep.HandlePacket(&r, stack.NewPacketBuffer(view.ToVectorisedView()))
 	if o.dataCalls != 1 {
 		t.Fatalf("Bad number of data calls: got %x, want 1", o.dataCalls)
 	}
@@ -295,7 +305,7 @@ func TestIPv4ReceiveControl(t *testing.T) {
 		t.Run(c.name, func(t *testing.T) {
 			o := testObject{t: t}
 			proto := ipv4.NewProtocol()
-			ep, err := proto.NewEndpoint(1, localIpv4Addr, nil, &o, nil)
+			ep, err := proto.NewEndpoint(1, localIpv4Addr, nil, &tcpip.StdClock{}, &o, nil)
 			if err != nil {
 				t.Fatalf("NewEndpoint failed: %v", err)
 			}
@@ -348,7 +358,7 @@ func TestIPv4ReceiveControl(t *testing.T) {
 			o.extra = c.expectedExtra
 
 			vv := view[:len(view)-c.trunc].ToVectorisedView()
-			ep.HandlePacket(&r, vv)
+			ep.HandlePacket(&r, stack.NewPacketBuffer(vv))
 			if want := c.expectedCount; o.controlCalls != want {
 				t.Fatalf("Bad number of control calls for %q case: got %v, want %v", c.name, o.controlCalls, want)
 			}
@@ -359,7 +369,7 @@ func TestIPv4ReceiveControl(t *testing.T) {
 func TestIPv4FragmentationReceive(t *testing.T) {
 	o := testObject{t: t, v4: true}
 	proto := ipv4.NewProtocol()
-	ep, err := proto.NewEndpoint(1, localIpv4Addr, nil, &o, nil)
+	ep, err := proto.NewEndpoint(1, localIpv4Addr, nil, &tcpip.StdClock{}, &o, nil)
 	if err != nil {
 		t.Fatalf("NewEndpoint failed: %v", err)
 	}
@@ -411,22 +421,652 @@ func TestIPv4FragmentationReceive(t *testing.T) {
 	}
 
 	// Send first segment.
-	ep.HandlePacket(&r, frag1.ToVectorisedView())
+	ep.HandlePacket(&r, stack.NewPacketBuffer(frag1.ToVectorisedView()))
 	if o.dataCalls != 0 {
 		t.Fatalf("Bad number of data calls: got %x, want 0", o.dataCalls)
 	}
 
 	// Send second segment.
-	ep.HandlePacket(&r, frag2.ToVectorisedView())
+	ep.HandlePacket(&r, stack.NewPacketBuffer(frag2.ToVectorisedView()))
 	if o.dataCalls != 1 {
 		t.Fatalf("Bad number of data calls: got %x, want 1", o.dataCalls)
 	}
+
+	stats := r.Stats().IP
+	if got, want := stats.FragmentsReceived.Value(), uint64(2); got != want {
+		t.Errorf("got FragmentsReceived = %d, want = %d", got, want)
+	}
+	if got, want := stats.PacketsReassembled.Value(), uint64(1); got != want {
+		t.Errorf("got PacketsReassembled = %d, want = %d", got, want)
+	}
+}
+
+func TestIPv4MalformedStats(t *testing.T) {
+	o := testObject{t: t, v4: true}
+	proto := ipv4.NewProtocol()
+	ep, err := proto.NewEndpoint(1, localIpv4Addr, nil, &tcpip.StdClock{}, &o, nil)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	r, err := buildIPv4Route(localIpv4Addr, remoteIpv4Addr)
+	if err != nil {
+		t.Fatalf("could not find route: %v", err)
+	}
+
+	// The total length exceeds the size of the packet.
+	view := buffer.NewView(header.IPv4MinimumSize)
+	header.IPv4(view).Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: header.IPv4MinimumSize + 10,
+		TTL:         20,
+		Protocol:    10,
+		SrcAddr:     remoteIpv4Addr,
+		DstAddr:     localIpv4Addr,
+	})
+	ep.HandlePacket(&r, stack.NewPacketBuffer(view.ToVectorisedView()))
+	if o.dataCalls != 0 {
+		t.Fatalf("Bad number of data calls: got %x, want 0", o.dataCalls)
+	}
+	if got, want := r.Stats().IP.MalformedPacketsReceived.Value(), uint64(1); got != want {
+		t.Errorf("got MalformedPacketsReceived = %d, want = %d", got, want)
+	}
+	if got, want := r.Stats().Drops.Malformed.Value(), uint64(1); got != want {
+		t.Errorf("got Drops.Malformed = %d, want = %d", got, want)
+	}
+}
+
+func TestIPv4ForwardingTTL(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, nil, stack.Options{})
+	s.SetForwarding(true)
+	id1, linkEP1 := channel.New(10, 1500, "")
+	if err := s.CreateNIC(1, id1); err != nil {
+		t.Fatalf("CreateNIC #1 failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localIpv4Addr); err != nil {
+		t.Fatalf("AddAddress #1 failed: %v", err)
+	}
+	id2, linkEP2 := channel.New(10, 1500, "")
+	if err := s.CreateNIC(2, id2); err != nil {
+		t.Fatalf("CreateNIC #2 failed: %v", err)
+	}
+	if err := s.AddAddress(2, ipv4.ProtocolNumber, "\x0b\x00\x00\x01"); err != nil {
+		t.Fatalf("AddAddress #2 failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x0b\x00\x00\x00",
+		Mask:        "\xff\xff\xff\x00",
+		NIC:         2,
+	}})
+
+	var drops []tcpip.DropReason
+	s.SetDropHook(func(info stack.DropInfo) {
+		drops = append(drops, info.Reason)
+	})
+
+	send := func(ttl uint8) {
+		view := buffer.NewView(header.IPv4MinimumSize)
+		ip := header.IPv4(view)
+		ip.Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: header.IPv4MinimumSize,
+			TTL:         ttl,
+			Protocol:    10,
+			SrcAddr:     remoteIpv4Addr,
+			DstAddr:     "\x0b\x00\x00\x02",
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		linkEP1.Inject(ipv4.ProtocolNumber, view.ToVectorisedView())
+	}
+
+	// A packet that can take another hop is forwarded with its TTL
+	// decremented.
+	send(2)
+	select {
+	case p := <-linkEP2.C:
+		ip := header.IPv4(p.Header)
+		if got, want := ip.TTL(), uint8(1); got != want {
+			t.Errorf("got forwarded TTL = %d, want = %d", got, want)
+		}
+		if header.Checksum(ip[:ip.HeaderLength()], 0) != 0xffff {
+			t.Errorf("forwarded packet has an invalid checksum")
+		}
+	default:
+		t.Fatal("packet not forwarded")
+	}
+
+	// A packet whose TTL expires is dropped.
+	send(1)
+	select {
+	case <-linkEP2.C:
+		t.Fatal("packet with an expired TTL forwarded")
+	default:
+	}
+	if len(drops) != 1 || drops[0] != tcpip.DropTTLExpired {
+		t.Errorf("got drops = %v, want = [%v]", drops, tcpip.DropTTLExpired)
+	}
+	if got, want := s.Stats().Drops.TTLExpired.Value(), uint64(1); got != want {
+		t.Errorf("got Drops.TTLExpired = %d, want = %d", got, want)
+	}
+}
+
+func TestIPv4RouteTypes(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, nil, stack.Options{})
+	s.SetForwarding(true)
+	id1, linkEP1 := channel.New(10, 1500, "")
+	if err := s.CreateNIC(1, id1); err != nil {
+		t.Fatalf("CreateNIC #1 failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localIpv4Addr); err != nil {
+		t.Fatalf("AddAddress #1 failed: %v", err)
+	}
+	id2, linkEP2 := channel.New(10, 1500, "")
+	if err := s.CreateNIC(2, id2); err != nil {
+		t.Fatalf("CreateNIC #2 failed: %v", err)
+	}
+	if err := s.AddAddress(2, ipv4.ProtocolNumber, "\x0b\x00\x00\x01"); err != nil {
+		t.Fatalf("AddAddress #2 failed: %v", err)
+	}
+	host := tcpip.AddressMask("\xff\xff\xff\xff")
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: ipv4SubnetAddr, Mask: ipv4SubnetMask, NIC: 1},
+		{Destination: "\x0b\x00\x00\x02", Mask: host, Type: tcpip.RouteBlackhole},
+		{Destination: "\x0b\x00\x00\x03", Mask: host, Type: tcpip.RouteUnreachable},
+		{Destination: "\x0b\x00\x00\x04", Mask: host, Type: tcpip.RouteProhibit},
+		{Destination: "\x0b\x00\x00\x00", Mask: "\xff\xff\xff\x00", NIC: 2},
+	})
+
+	for _, test := range []struct {
+		name      string
+		dst       tcpip.Address
+		wantErr   *tcpip.Error
+		forwarded bool
+		icmpCode  byte
+	}{
+		{name: "unicast", dst: "\x0b\x00\x00\x05", forwarded: true},
+		{name: "blackhole", dst: "\x0b\x00\x00\x02", wantErr: tcpip.ErrNoRoute},
+		{name: "unreachable", dst: "\x0b\x00\x00\x03", wantErr: tcpip.ErrHostUnreachable, icmpCode: header.ICMPv4HostUnreachable},
+		{name: "prohibit", dst: "\x0b\x00\x00\x04", wantErr: tcpip.ErrProhibited, icmpCode: header.ICMPv4AdminProhibited},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := s.FindRoute(0, "", test.dst, ipv4.ProtocolNumber, false /* multicastLoop */)
+			if err != test.wantErr {
+				t.Errorf("got FindRoute(...) = %v, want = %v", err, test.wantErr)
+			}
+			if err == nil {
+				r.Release()
+			}
+
+			view := buffer.NewView(header.IPv4MinimumSize + 8)
+			ip := header.IPv4(view)
+			ip.Encode(&header.IPv4Fields{
+				IHL:         header.IPv4MinimumSize,
+				TotalLength: uint16(len(view)),
+				TTL:         20,
+				Protocol:    10,
+				SrcAddr:     remoteIpv4Addr,
+				DstAddr:     test.dst,
+			})
+			ip.SetChecksum(^ip.CalculateChecksum())
+			linkEP1.Inject(ipv4.ProtocolNumber, view.ToVectorisedView())
+
+			select {
+			case <-linkEP2.C:
+				if !test.forwarded {
+					t.Errorf("packet forwarded")
+				}
+			default:
+				if test.forwarded {
+					t.Errorf("packet not forwarded")
+				}
+			}
+
+			select {
+			case p := <-linkEP1.C:
+				if test.icmpCode == 0 {
+					t.Fatalf("got unexpected packet back to the sender")
+				}
+				ip := header.IPv4(p.Header)
+				if got := ip.DestinationAddress(); got != remoteIpv4Addr {
+					t.Errorf("got ICMP error to %v, want to %v", got, remoteIpv4Addr)
+				}
+				icmp := header.ICMPv4(ip[ip.HeaderLength():])
+				if got := icmp.Type(); got != header.ICMPv4DstUnreachable {
+					t.Errorf("got ICMP type = %d, want = %d", got, header.ICMPv4DstUnreachable)
+				}
+				if got := icmp.Code(); got != test.icmpCode {
+					t.Errorf("got ICMP code = %d, want = %d", got, test.icmpCode)
+				}
+				if xsum := header.Checksum(icmp, header.Checksum(p.Payload, 0)); xsum != 0xffff {
+					t.Errorf("ICMP error has an invalid checksum")
+				}
+				if !bytes.Equal(p.Payload, view) {
+					t.Errorf("got quoted packet %x, want %x", p.Payload, view)
+				}
+			default:
+				if test.icmpCode != 0 {
+					t.Errorf("no ICMP error sent")
+				}
+			}
+		})
+	}
+
+	if got, want := s.Stats().ICMP.V4PacketsSent.DstUnreachable.Value(), uint64(2); got != want {
+		t.Errorf("got V4PacketsSent.DstUnreachable = %d, want = %d", got, want)
+	}
+}
+
+func TestIPv4ICMPStats(t *testing.T) {
+	o := testObject{t: t, v4: true}
+	proto := ipv4.NewProtocol()
+	ep, err := proto.NewEndpoint(1, localIpv4Addr, nil, &tcpip.StdClock{}, &o, nil)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	r, err := buildIPv4Route(localIpv4Addr, remoteIpv4Addr)
+	if err != nil {
+		t.Fatalf("could not find route: %v", err)
+	}
+
+	for _, icmp := range []header.ICMPv4{
+		// An echo request, which is answered.
+		header.ICMPv4(buffer.NewView(header.ICMPv4EchoMinimumSize)),
+		// A truncated destination unreachable message.
+		header.ICMPv4(buffer.NewView(header.ICMPv4MinimumSize)),
+	} {
+		typ := header.ICMPv4Echo
+		if len(icmp) == header.ICMPv4MinimumSize {
+			typ = header.ICMPv4DstUnreachable
+		}
+		icmp.SetType(typ)
+		icmp.SetChecksum(^header.Checksum(icmp, 0))
+		view := buffer.NewView(header.IPv4MinimumSize + len(icmp))
+		header.IPv4(view).Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(view)),
+			TTL:         20,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     remoteIpv4Addr,
+			DstAddr:     localIpv4Addr,
+		})
+		copy(view[header.IPv4MinimumSize:], icmp)
+
+		// Echo requests are also delivered to the transport layer.
+		o.protocol = header.ICMPv4ProtocolNumber
+		o.srcAddr = remoteIpv4Addr
+		o.dstAddr = localIpv4Addr
+		o.contents = view[header.IPv4MinimumSize:]
+		ep.HandlePacket(&r, stack.NewPacketBuffer(view.ToVectorisedView()))
+	}
+
+	stats := r.Stats().ICMP
+	for _, c := range []struct {
+		name    string
+		counter *tcpip.StatCounter
+		want    uint64
+	}{
+		{"V4PacketsReceived.Echo", stats.V4PacketsReceived.Echo, 1},
+		{"V4PacketsReceived.DstUnreachable", stats.V4PacketsReceived.DstUnreachable, 1},
+		{"InvalidPacketsReceived", stats.InvalidPacketsReceived, 1},
+		{"V4PacketsSent.EchoReply", stats.V4PacketsSent.EchoReply, 1},
+	} {
+		if got := c.counter.Value(); got != c.want {
+			t.Errorf("got %s = %d, want = %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestIPv4ICMPRateLimit(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, nil, stack.Options{})
+	id, linkEP := channel.New(10, 1500, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localIpv4Addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: ipv4SubnetAddr,
+		Mask:        ipv4SubnetMask,
+		NIC:         1,
+	}})
+	s.SetICMPRateLimit(stack.ICMPRateLimit{
+		PerDestinationRate:  1,
+		PerDestinationBurst: 3,
+	})
+
+	for i := 0; i < 5; i++ {
+		view := buffer.NewView(header.IPv4MinimumSize + header.ICMPv4EchoMinimumSize)
+		header.IPv4(view).Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(view)),
+			TTL:         20,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     remoteIpv4Addr,
+			DstAddr:     localIpv4Addr,
+		})
+		header.IPv4(view).SetChecksum(^header.IPv4(view).CalculateChecksum())
+		icmp := header.ICMPv4(view[header.IPv4MinimumSize:])
+		icmp.SetType(header.ICMPv4Echo)
+		icmp.SetChecksum(^header.Checksum(icmp, 0))
+		linkEP.Inject(ipv4.ProtocolNumber, view.ToVectorisedView())
+	}
+
+	if got := linkEP.Drain(); got != 3 {
+		t.Errorf("got %d echo replies, want = 3", got)
+	}
+	stats := s.Stats().ICMP
+	if got := stats.V4PacketsSent.EchoReply.Value(); got != 3 {
+		t.Errorf("got V4PacketsSent.EchoReply = %d, want = 3", got)
+	}
+	if got := stats.RateLimited.Value(); got != 2 {
+		t.Errorf("got RateLimited = %d, want = 2", got)
+	}
+}
+
+func TestIPv4Redirect(t *testing.T) {
+	const (
+		dst1       = "\x0b\x00\x00\x05"
+		dst2       = "\x0b\x00\x00\x06"
+		newGateway = "\x0a\x00\x00\x04"
+	)
+
+	s := stack.New([]string{ipv4.ProtocolName}, nil, stack.Options{})
+	id, linkEP := channel.New(10, 1500, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localIpv4Addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: ipv4SubnetAddr, Mask: ipv4SubnetMask, NIC: 1},
+		{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Gateway: ipv4Gateway, NIC: 1},
+	})
+
+	redirect := func(src, dst, gateway tcpip.Address) {
+		view := buffer.NewView(header.IPv4MinimumSize + header.ICMPv4RedirectMinimumSize + header.IPv4MinimumSize)
+		header.IPv4(view).Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(view)),
+			TTL:         20,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     src,
+			DstAddr:     localIpv4Addr,
+		})
+		header.IPv4(view).SetChecksum(^header.IPv4(view).CalculateChecksum())
+		icmp := header.ICMPv4(view[header.IPv4MinimumSize:])
+		icmp.SetType(header.ICMPv4Redirect)
+		icmp.SetCode(header.ICMPv4RedirectHost)
+		icmp.SetRedirectGateway(gateway)
+		header.IPv4(icmp[header.ICMPv4RedirectMinimumSize:]).Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: header.IPv4MinimumSize,
+			TTL:         20,
+			Protocol:    10,
+			SrcAddr:     localIpv4Addr,
+			DstAddr:     dst,
+		})
+		icmp.SetChecksum(^header.Checksum(icmp, 0))
+		linkEP.Inject(ipv4.ProtocolNumber, view.ToVectorisedView())
+	}
+	nextHop := func(dst tcpip.Address) tcpip.Address {
+		r, err := s.FindRoute(0, "", dst, ipv4.ProtocolNumber, false /* multicastLoop */)
+		if err != nil {
+			t.Fatalf("FindRoute(%v) failed: %v", dst, err)
+		}
+		defer r.Release()
+		return r.NextHop
+	}
+
+	// Redirects that don't come from the current gateway, or that give a
+	// local address as the new one, are ignored.
+	redirect(remoteIpv4Addr, dst1, newGateway)
+	redirect(ipv4Gateway, dst1, localIpv4Addr)
+	if got := nextHop(dst1); got != ipv4Gateway {
+		t.Errorf("got next hop to %v = %v after invalid redirects, want = %v", dst1, got, ipv4Gateway)
+	}
+
+	// A valid redirect only changes the route to its destination.
+	redirect(ipv4Gateway, dst1, newGateway)
+	if got := nextHop(dst1); got != newGateway {
+		t.Errorf("got next hop to %v = %v, want = %v", dst1, got, newGateway)
+	}
+	if got := nextHop(dst2); got != ipv4Gateway {
+		t.Errorf("got next hop to %v = %v, want = %v", dst2, got, ipv4Gateway)
+	}
+
+	// Redirects are ignored when disabled, or when forwarding.
+	s.SetAcceptRedirects(false)
+	redirect(ipv4Gateway, dst2, newGateway)
+	s.SetAcceptRedirects(true)
+	s.SetForwarding(true)
+	redirect(ipv4Gateway, dst2, newGateway)
+	if got := nextHop(dst2); got != ipv4Gateway {
+		t.Errorf("got next hop to %v = %v after ignored redirects, want = %v", dst2, got, ipv4Gateway)
+	}
+
+	stats := s.Stats().ICMP
+	if got := stats.V4PacketsReceived.Redirect.Value(); got != 5 {
+		t.Errorf("got V4PacketsReceived.Redirect = %d, want = 5", got)
+	}
+	if got := stats.RedirectsIgnored.Value(); got != 4 {
+		t.Errorf("got RedirectsIgnored = %d, want = 4", got)
+	}
+
+	// Setting the route table removes the redirects.
+	s.SetRouteTable(s.GetRouteTable())
+	if got := nextHop(dst1); got != ipv4Gateway {
+		t.Errorf("got next hop to %v = %v after SetRouteTable, want = %v", dst1, got, ipv4Gateway)
+	}
+}
+
+func TestIPv4SendRedirect(t *testing.T) {
+	const dst = "\x0b\x00\x00\x05"
+
+	s := stack.New([]string{ipv4.ProtocolName}, nil, stack.Options{})
+	s.SetForwarding(true)
+	id, linkEP := channel.New(10, 1500, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localIpv4Addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: ipv4SubnetAddr, Mask: ipv4SubnetMask, NIC: 1},
+		{Destination: "\x0b\x00\x00\x00", Mask: "\xff\xff\xff\x00", Gateway: ipv4Gateway, NIC: 1},
+	})
+
+	view := buffer.NewView(header.IPv4MinimumSize + 8)
+	ip := header.IPv4(view)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(view)),
+		TTL:         20,
+		Protocol:    10,
+		SrcAddr:     remoteIpv4Addr,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	// The packet goes back out of the NIC it arrived on, so its sender is
+	// told to use the gateway directly, and it is forwarded. Forwarding
+	// decrements the TTL of view.
+	want := append([]byte(nil), view...)
+	linkEP.Inject(ipv4.ProtocolNumber, view.ToVectorisedView())
+	select {
+	case p := <-linkEP.C:
+		ip := header.IPv4(p.Header)
+		if got := ip.DestinationAddress(); got != remoteIpv4Addr {
+			t.Errorf("got redirect to %v, want to %v", got, remoteIpv4Addr)
+		}
+		icmp := header.ICMPv4(ip[ip.HeaderLength():])
+		if got := icmp.Type(); got != header.ICMPv4Redirect {
+			t.Errorf("got ICMP type = %d, want = %d", got, header.ICMPv4Redirect)
+		}
+		if got := icmp.Code(); got != header.ICMPv4RedirectHost {
+			t.Errorf("got ICMP code = %d, want = %d", got, header.ICMPv4RedirectHost)
+		}
+		if got := icmp.RedirectGateway(); got != ipv4Gateway {
+			t.Errorf("got redirect gateway = %v, want = %v", got, ipv4Gateway)
+		}
+		if xsum := header.Checksum(icmp, header.Checksum(p.Payload, 0)); xsum != 0xffff {
+			t.Errorf("ICMP redirect has an invalid checksum")
+		}
+		if !bytes.Equal(p.Payload, want) {
+			t.Errorf("got quoted packet %x, want %x", p.Payload, want)
+		}
+	default:
+		t.Fatal("no ICMP redirect sent")
+	}
+	select {
+	case p := <-linkEP.C:
+		if got := header.IPv4(p.Header).DestinationAddress(); got != dst {
+			t.Errorf("got forwarded packet to %v, want to %v", got, dst)
+		}
+	default:
+		t.Fatal("packet not forwarded")
+	}
+
+	// No redirect is sent once they are disabled.
+	s.SetSendRedirects(false)
+	ip.SetTTL(20)
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+	linkEP.Inject(ipv4.ProtocolNumber, view.ToVectorisedView())
+	if got := linkEP.Drain(); got != 1 {
+		t.Errorf("got %d packets sent with redirects disabled, want = 1", got)
+	}
+	if got := s.Stats().ICMP.V4PacketsSent.Redirect.Value(); got != 1 {
+		t.Errorf("got V4PacketsSent.Redirect = %d, want = 1", got)
+	}
+}
+
+func TestIPv4MulticastForwarding(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, nil, stack.Options{})
+	s.SetForwarding(true)
+	var linkEPs [4]*channel.Endpoint
+	for nic := tcpip.NICID(1); nic <= 3; nic++ {
+		id, linkEP := channel.New(10, 1500, "")
+		if err := s.CreateNIC(nic, id); err != nil {
+			t.Fatalf("CreateNIC #%d failed: %v", nic, err)
+		}
+		if err := s.AddAddress(nic, ipv4.ProtocolNumber, tcpip.Address([]byte{10, 0, byte(nic), 1})); err != nil {
+			t.Fatalf("AddAddress #%d failed: %v", nic, err)
+		}
+		linkEPs[nic] = linkEP
+	}
+	// Multicast packets must not be forwarded through unicast routes.
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", NIC: 2}})
+
+	const (
+		group      = "\xef\x01\x01\x01"
+		otherGroup = "\xef\x01\x01\x02"
+		localGroup = "\xe0\x00\x00\x05"
+	)
+	route := stack.MulticastRoute{
+		InputNIC: 1,
+		Outputs: []stack.MulticastOutput{
+			{NIC: 1},
+			{NIC: 2},
+			{NIC: 3, TTLThreshold: 5},
+		},
+	}
+	if err := s.AddMulticastRoute(remoteIpv4Addr, group, route); err != nil {
+		t.Fatalf("AddMulticastRoute failed: %v", err)
+	}
+	if err := s.AddMulticastRoute("", localGroup, route); err != nil {
+		t.Fatalf("AddMulticastRoute failed: %v", err)
+	}
+	if err := s.AddMulticastRoute("", remoteIpv4Addr, route); err != tcpip.ErrBadAddress {
+		t.Errorf("got AddMulticastRoute(unicast group) = %v, want = %v", err, tcpip.ErrBadAddress)
+	}
+	if err := s.AddMulticastRoute("", group, stack.MulticastRoute{Outputs: []stack.MulticastOutput{{NIC: 4}}}); err != tcpip.ErrUnknownNICID {
+		t.Errorf("got AddMulticastRoute(unknown NIC) = %v, want = %v", err, tcpip.ErrUnknownNICID)
+	}
+
+	send := func(nic tcpip.NICID, dst tcpip.Address, ttl uint8) {
+		view := buffer.NewView(header.IPv4MinimumSize)
+		ip := header.IPv4(view)
+		ip.Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: header.IPv4MinimumSize,
+			TTL:         ttl,
+			Protocol:    10,
+			SrcAddr:     remoteIpv4Addr,
+			DstAddr:     dst,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		linkEPs[nic].Inject(ipv4.ProtocolNumber, view.ToVectorisedView())
+	}
+	// forwarded returns the TTLs of the packets sent out of each NIC.
+	forwarded := func() [4][]uint8 {
+		var ttls [4][]uint8
+		for nic := 1; nic <= 3; nic++ {
+			for {
+				select {
+				case p := <-linkEPs[nic].C:
+					ip := header.IPv4(p.Header)
+					if got := ip.DestinationAddress(); got != group {
+						t.Errorf("got forwarded destination = %v, want = %v", got, group)
+					}
+					ttls[nic] = append(ttls[nic], ip.TTL())
+					continue
+				default:
+				}
+				break
+			}
+		}
+		return ttls
+	}
+
+	// Packets are only forwarded out of the NICs whose threshold they
+	// exceed, and never back out of the input NIC.
+	send(1, group, 3)
+	if got, want := forwarded(), [4][]uint8{2: {2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got forwarded TTLs = %v, want = %v", got, want)
+	}
+	send(1, group, 10)
+	if got, want := forwarded(), [4][]uint8{2: {9}, 3: {9}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got forwarded TTLs = %v, want = %v", got, want)
+	}
+	if got, want := s.Stats().IP.MulticastPacketsForwarded.Value(), uint64(3); got != want {
+		t.Errorf("got MulticastPacketsForwarded = %d, want = %d", got, want)
+	}
+
+	// Packets arriving on another NIC, to other or link-local groups, or
+	// whose TTL expires, aren't forwarded.
+	send(2, group, 10)
+	send(1, otherGroup, 10)
+	send(1, localGroup, 10)
+	send(1, group, 1)
+	if got, want := forwarded(), [4][]uint8{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got forwarded TTLs = %v, want = %v", got, want)
+	}
+	if got, want := s.Stats().IP.MulticastWrongInput.Value(), uint64(1); got != want {
+		t.Errorf("got MulticastWrongInput = %d, want = %d", got, want)
+	}
+	if got, want := s.Stats().IP.MulticastNoRoute.Value(), uint64(1); got != want {
+		t.Errorf("got MulticastNoRoute = %d, want = %d", got, want)
+	}
+
+	// Packets aren't forwarded once their route is removed.
+	if err := s.RemoveMulticastRoute(remoteIpv4Addr, group); err != nil {
+		t.Fatalf("RemoveMulticastRoute failed: %v", err)
+	}
+	if _, ok := s.MulticastRoute(remoteIpv4Addr, group); ok {
+		t.Errorf("got MulticastRoute after removal = _, true, want = _, false")
+	}
+	send(1, group, 10)
+	if got, want := forwarded(), [4][]uint8{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got forwarded TTLs = %v, want = %v", got, want)
+	}
 }
 
 func TestIPv6Send(t *testing.T) {
 	o := testObject{t: t}
 	proto := ipv6.NewProtocol()
-	ep, err := proto.NewEndpoint(1, localIpv6Addr, nil, nil, &o)
+	ep, err := proto.NewEndpoint(1, localIpv6Addr, nil, &tcpip.StdClock{}, nil, &o)
 	if err != nil {
 		t.Fatalf("NewEndpoint failed: %v", err)
 	}
@@ -450,7 +1090,9 @@ func TestIPv6Send(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not find route: %v", err)
 	}
-	if err := ep.WritePacket(&r, hdr, payload.ToVectorisedView(), 123, 123, stack.PacketOut); err != nil {
+	pkt := stack.NewOutboundPacketBuffer(hdr, payload.ToVectorisedView())
+	defer pkt.DecRef()
+	if err := ep.WritePacket(&r, pkt, stack.NetworkHeaderParams{Protocol: 123, TTL: 123}, stack.PacketOut); err != nil {
 		t.Fatalf("WritePacket failed: %v", err)
 	}
 }
@@ -458,7 +1100,7 @@ func TestIPv6Send(t *testing.T) {
 func TestIPv6Receive(t *testing.T) {
 	o := testObject{t: t}
 	proto := ipv6.NewProtocol()
-	ep, err := proto.NewEndpoint(1, localIpv6Addr, nil, &o, nil)
+	ep, err := proto.NewEndpoint(1, localIpv6Addr, nil, &tcpip.StdClock{}, &o, nil)
 	if err != nil {
 		t.Fatalf("NewEndpoint failed: %v", err)
 	}
@@ -490,7 +1132,7 @@ func TestIPv6Receive(t *testing.T) {
 		t.Fatalf("could not find route: %v", err)
 	}
 
-	ep.HandlePacket(&r, view.ToVectorisedView())
+	ep.HandlePacket(&r, stack.NewPacketBuffer(view.ToVectorisedView()))
 	if o.dataCalls != 1 {
 		t.Fatalf("Bad number of data calls: got %x, want 1", o.dataCalls)
 	}
@@ -529,7 +1171,7 @@ func TestIPv6ReceiveControl(t *testing.T) {
 		t.Run(c.name, func(t *testing.T) {
 			o := testObject{t: t}
 			proto := ipv6.NewProtocol()
-			ep, err := proto.NewEndpoint(1, localIpv6Addr, nil, &o, nil)
+			ep, err := proto.NewEndpoint(1, localIpv6Addr, nil, &tcpip.StdClock{}, &o, nil)
 			if err != nil {
 				t.Fatalf("NewEndpoint failed: %v", err)
 			}
@@ -595,10 +1237,76 @@ func TestIPv6ReceiveControl(t *testing.T) {
 			o.extra = c.expectedExtra
 
 			vv := view[:len(view)-c.trunc].ToVectorisedView()
-			ep.HandlePacket(&r, vv)
+			ep.HandlePacket(&r, stack.NewPacketBuffer(vv))
 			if want := c.expectedCount; o.controlCalls != want {
 				t.Fatalf("Bad number of control calls for %q case: got %v, want %v", c.name, o.controlCalls, want)
 			}
 		})
 	}
 }
+
+func TestIPv6ForwardingHopLimit(t *testing.T) {
+	s := stack.New([]string{ipv6.ProtocolName}, nil, stack.Options{})
+	s.SetForwarding(true)
+	id1, linkEP1 := channel.New(10, 1500, "")
+	if err := s.CreateNIC(1, id1); err != nil {
+		t.Fatalf("CreateNIC #1 failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv6.ProtocolNumber, localIpv6Addr); err != nil {
+		t.Fatalf("AddAddress #1 failed: %v", err)
+	}
+	id2, linkEP2 := channel.New(10, 1500, "")
+	if err := s.CreateNIC(2, id2); err != nil {
+		t.Fatalf("CreateNIC #2 failed: %v", err)
+	}
+	if err := s.AddAddress(2, ipv6.ProtocolNumber, "\x0b\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"); err != nil {
+		t.Fatalf("AddAddress #2 failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x0b\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		Mask:        "\xff\xff\xff\xff\xff\xff\xff\xff\x00\x00\x00\x00\x00\x00\x00\x00",
+		NIC:         2,
+	}})
+
+	var drops []tcpip.DropReason
+	s.SetDropHook(func(info stack.DropInfo) {
+		drops = append(drops, info.Reason)
+	})
+
+	send := func(hopLimit uint8) {
+		view := buffer.NewView(header.IPv6MinimumSize)
+		header.IPv6(view).Encode(&header.IPv6Fields{
+			NextHeader: 10,
+			HopLimit:   hopLimit,
+			SrcAddr:    remoteIpv6Addr,
+			DstAddr:    "\x0b\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02",
+		})
+		linkEP1.Inject(ipv6.ProtocolNumber, view.ToVectorisedView())
+	}
+
+	// A packet that can take another hop is forwarded with its hop limit
+	// decremented.
+	send(2)
+	select {
+	case p := <-linkEP2.C:
+		if got, want := header.IPv6(p.Header).HopLimit(), uint8(1); got != want {
+			t.Errorf("got forwarded hop limit = %d, want = %d", got, want)
+		}
+	default:
+		t.Fatal("packet not forwarded")
+	}
+
+	// A packet whose hop limit runs out is dropped.
+	send(1)
+	select {
+	case <-linkEP2.C:
+		t.Fatal("packet with an exhausted hop limit forwarded")
+	default:
+	}
+	if len(drops) != 1 || drops[0] != tcpip.DropTTLExpired {
+		t.Errorf("got drops = %v, want = [%v]", drops, tcpip.DropTTLExpired)
+	}
+	if got, want := s.Stats().Drops.TTLExpired.Value(), uint64(1); got != want {
+		t.Errorf("got Drops.TTLExpired = %d, want = %d", got, want)
+	}
+}
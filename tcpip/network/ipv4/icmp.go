@@ -17,6 +17,7 @@ package ipv4
 import (
 	"encoding/binary"
 
+	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/stack"
@@ -26,7 +27,7 @@ import (
 // the original packet that caused the ICMP one to be sent. This information is
 // used to find out which transport endpoint must be notified about the ICMP
 // packet.
-func (e *endpoint) handleControl(typ stack.ControlType, extra uint32, vv buffer.VectorisedView) {
+func (e *endpoint) handleControl(typ stack.ControlType, extra uint32, offender tcpip.Address, vv buffer.VectorisedView) {
 	h := header.IPv4(vv.First())
 
 	// We don't use IsValid() here because ICMP only requires that the IP
@@ -48,55 +49,104 @@ func (e *endpoint) handleControl(typ stack.ControlType, extra uint32, vv buffer.
 		return
 	}
 
+	info := stack.ControlInfo{
+		Offender:      offender,
+		NetworkHeader: append(buffer.View(nil), h[:hlen]...),
+	}
+
 	// Skip the ip header, then deliver control message.
 	vv.TrimFront(hlen)
 	p := h.TransportProtocol()
-	e.dispatcher.DeliverTransportControlPacket(e.id.LocalAddress, h.DestinationAddress(), ProtocolNumber, p, typ, extra, vv)
+	e.dispatcher.DeliverTransportControlPacket(e.id.LocalAddress, h.DestinationAddress(), ProtocolNumber, p, typ, extra, info, vv)
 }
 
-func (e *endpoint) handleICMP(r *stack.Route, netHeader buffer.View, vv buffer.VectorisedView) {
+func (e *endpoint) handleICMP(r *stack.Route, pkt *stack.PacketBuffer) {
+	vv := pkt.Data
 	v := vv.First()
+	stats := r.Stats().ICMP
 	if len(v) < header.ICMPv4MinimumSize {
+		stats.InvalidPacketsReceived.Increment()
+		r.RecordDrop(tcpip.DropMalformed, vv)
 		return
 	}
 	h := header.ICMPv4(v)
+	stats.V4PacketsReceived.Record(uint8(h.Type()))
+
+	// Raw endpoints receive every ICMP message. Echo requests and replies
+	// are delivered to them with the echo endpoints below.
+	if t := h.Type(); t != header.ICMPv4Echo && t != header.ICMPv4EchoReply {
+		e.dispatcher.DeliverRawTransportPacket(r, header.ICMPv4ProtocolNumber, pkt)
+	}
+
+	// Messages too short for their type are counted, but dropped.
+	if _, err := header.ParseICMPv4(v, header.ParseLenient); err != nil {
+		stats.InvalidPacketsReceived.Increment()
+		r.RecordDrop(tcpip.DropMalformed, vv)
+		return
+	}
 
 	switch h.Type() {
 	case header.ICMPv4Echo:
-		if len(v) < header.ICMPv4EchoMinimumSize {
+		// It's possible that a raw socket expects to receive this.
+		e.dispatcher.DeliverTransportPacket(r, header.ICMPv4ProtocolNumber, pkt)
+
+		if !r.AllowICMP() {
 			return
 		}
-		// It's possible that a raw socket expects to receive this.
-		e.dispatcher.DeliverTransportPacket(r, header.ICMPv4ProtocolNumber, netHeader, vv)
 
-		vv := vv.Clone(nil)
+		// The reply may be queued by the link endpoint.
+		vv := pkt.OwnedData(nil)
 		vv.TrimFront(header.ICMPv4EchoMinimumSize)
 		hdr := buffer.NewPrependable(int(r.MaxHeaderLength()) + header.ICMPv4EchoMinimumSize)
-		pkt := header.ICMPv4(hdr.Prepend(header.ICMPv4EchoMinimumSize))
-		copy(pkt, h)
-		pkt.SetType(header.ICMPv4EchoReply)
-		pkt.SetChecksum(^header.Checksum(pkt, header.ChecksumVV(vv, 0)))
-		r.WritePacket(hdr, vv, header.ICMPv4ProtocolNumber, r.DefaultTTL())
+		reply := header.ICMPv4(hdr.Prepend(header.ICMPv4EchoMinimumSize))
+		copy(reply, h)
+		reply.SetType(header.ICMPv4EchoReply)
+		reply.SetChecksum(^header.Checksum(reply, header.ChecksumVV(vv, 0)))
+		replyPkt := stack.NewOutboundPacketBuffer(hdr, vv)
+		if err := r.WritePacket(replyPkt, header.ICMPv4ProtocolNumber, r.DefaultTTL()); err != nil {
+			stats.OutgoingPacketErrors.Increment()
+		} else {
+			stats.V4PacketsSent.EchoReply.Increment()
+		}
+		replyPkt.DecRef()
 
 	case header.ICMPv4EchoReply:
-		if len(v) < header.ICMPv4EchoMinimumSize {
-			return
-		}
-		e.dispatcher.DeliverTransportPacket(r, header.ICMPv4ProtocolNumber, netHeader, vv)
+		e.dispatcher.DeliverTransportPacket(r, header.ICMPv4ProtocolNumber, pkt)
 
 	case header.ICMPv4DstUnreachable:
-		if len(v) < header.ICMPv4DstUnreachableMinimumSize {
-			return
-		}
 		vv.TrimFront(header.ICMPv4DstUnreachableMinimumSize)
 		switch h.Code() {
 		case header.ICMPv4PortUnreachable:
-			e.handleControl(stack.ControlPortUnreachable, 0, vv)
+			e.handleControl(stack.ControlPortUnreachable, 0, r.RemoteAddress, vv)
 
 		case header.ICMPv4FragmentationNeeded:
 			mtu := uint32(binary.BigEndian.Uint16(v[header.ICMPv4DstUnreachableMinimumSize-2:]))
-			e.handleControl(stack.ControlPacketTooBig, calculateMTU(mtu), vv)
+			e.handleControl(stack.ControlPacketTooBig, calculateMTU(mtu), r.RemoteAddress, vv)
+		}
+
+	case header.ICMPv4TimeExceeded:
+		vv.TrimFront(header.ICMPv4TimeExceededMinimumSize)
+		e.handleControl(stack.ControlTimeExceeded, uint32(h.Code()), r.RemoteAddress, vv)
+
+	case header.ICMPv4Redirect:
+		if len(v) < header.ICMPv4RedirectMinimumSize+header.IPv4MinimumSize {
+			stats.InvalidPacketsReceived.Increment()
+			r.RecordDrop(tcpip.DropMalformed, vv)
+			return
+		}
+		if header.ChecksumVV(vv, 0) != 0xffff {
+			stats.InvalidPacketsReceived.Increment()
+			r.RecordDrop(tcpip.DropBadChecksum, vv)
+			return
+		}
+		// Network redirects are handled as host redirects, as required
+		// by RFC 1122 section 3.2.2.2.
+		if h.Code() > header.ICMPv4RedirectTOSHost {
+			stats.RedirectsIgnored.Increment()
+			return
 		}
+		dst := header.IPv4(v[header.ICMPv4RedirectMinimumSize:]).DestinationAddress()
+		r.HandleRedirect(dst, h.RedirectGateway())
 	}
 	// TODO: Handle other ICMP types.
 }
@@ -16,6 +16,8 @@ package ipv6
 
 import (
 	"encoding/binary"
+	"math/rand"
+	"time"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
@@ -27,7 +29,7 @@ import (
 // the original packet that caused the ICMP one to be sent. This information is
 // used to find out which transport endpoint must be notified about the ICMP
 // packet.
-func (e *endpoint) handleControl(typ stack.ControlType, extra uint32, vv buffer.VectorisedView) {
+func (e *endpoint) handleControl(typ stack.ControlType, extra uint32, offender tcpip.Address, vv buffer.VectorisedView) {
 	h := header.IPv6(vv.First())
 
 	// We don't use IsValid() here because ICMP only requires that up to
@@ -40,6 +42,11 @@ func (e *endpoint) handleControl(typ stack.ControlType, extra uint32, vv buffer.
 		return
 	}
 
+	info := stack.ControlInfo{
+		Offender:      offender,
+		NetworkHeader: append(buffer.View(nil), h[:header.IPv6MinimumSize]...),
+	}
+
 	// Skip the IP header, then handle the fragmentation header if there
 	// is one.
 	vv.TrimFront(header.IPv6MinimumSize)
@@ -54,57 +61,83 @@ func (e *endpoint) handleControl(typ stack.ControlType, extra uint32, vv buffer.
 
 		// Skip fragmentation header and find out the actual protocol
 		// number.
+		info.NetworkHeader = append(info.NetworkHeader, f[:header.IPv6FragmentHeaderSize]...)
 		vv.TrimFront(header.IPv6FragmentHeaderSize)
 		p = f.TransportProtocol()
 	}
 
 	// Deliver the control packet to the transport endpoint.
-	e.dispatcher.DeliverTransportControlPacket(e.id.LocalAddress, h.DestinationAddress(), ProtocolNumber, p, typ, extra, vv)
+	e.dispatcher.DeliverTransportControlPacket(e.id.LocalAddress, h.DestinationAddress(), ProtocolNumber, p, typ, extra, info, vv)
 }
 
-func (e *endpoint) handleICMP(r *stack.Route, netHeader buffer.View, vv buffer.VectorisedView) {
+func (e *endpoint) handleICMP(r *stack.Route, pkt *stack.PacketBuffer) {
+	vv := pkt.Data
 	v := vv.First()
+	stats := r.Stats().ICMP
 	if len(v) < header.ICMPv6MinimumSize {
+		stats.InvalidPacketsReceived.Increment()
+		r.RecordDrop(tcpip.DropMalformed, vv)
 		return
 	}
 	h := header.ICMPv6(v)
+	stats.V6PacketsReceived.Record(uint8(h.Type()))
+
+	// Raw endpoints receive every ICMPv6 message. Echo replies are
+	// delivered to them with the echo endpoints below.
+	if h.Type() != header.ICMPv6EchoReply {
+		e.dispatcher.DeliverRawTransportPacket(r, header.ICMPv6ProtocolNumber, pkt)
+	}
+
+	// Messages too short for their type are counted, but dropped.
+	if _, err := header.ParseICMPv6(v, header.ParseLenient); err != nil {
+		stats.InvalidPacketsReceived.Increment()
+		r.RecordDrop(tcpip.DropMalformed, vv)
+		return
+	}
 
 	switch h.Type() {
 	case header.ICMPv6PacketTooBig:
-		if len(v) < header.ICMPv6PacketTooBigMinimumSize {
-			return
-		}
 		vv.TrimFront(header.ICMPv6PacketTooBigMinimumSize)
 		mtu := binary.BigEndian.Uint32(v[header.ICMPv6MinimumSize:])
-		e.handleControl(stack.ControlPacketTooBig, calculateMTU(mtu), vv)
+		e.handleControl(stack.ControlPacketTooBig, calculateMTU(mtu), r.RemoteAddress, vv)
 
 	case header.ICMPv6DstUnreachable:
-		if len(v) < header.ICMPv6DstUnreachableMinimumSize {
-			return
-		}
 		vv.TrimFront(header.ICMPv6DstUnreachableMinimumSize)
 		switch h.Code() {
 		case header.ICMPv6PortUnreachable:
-			e.handleControl(stack.ControlPortUnreachable, 0, vv)
+			e.handleControl(stack.ControlPortUnreachable, 0, r.RemoteAddress, vv)
 		}
 
+	case header.ICMPv6TimeExceeded:
+		vv.TrimFront(header.ICMPv6TimeExceededMinimumSize)
+		e.handleControl(stack.ControlTimeExceeded, uint32(h.Code()), r.RemoteAddress, vv)
+
 	case header.ICMPv6NeighborSolicit:
-		if len(v) < header.ICMPv6NeighborSolicitMinimumSize {
-			return
-		}
 		targetAddr := tcpip.Address(v[8 : 8+16])
+		anycast := false
 		if e.linkAddrCache.CheckLocalAddress(e.nicid, ProtocolNumber, targetAddr) == 0 {
-			// We don't have a useful answer; the best we can do is ignore the request.
-			return
+			if !e.linkAddrCache.IsAnycastAddress(e.nicid, ProtocolNumber, targetAddr) {
+				// We don't have a useful answer; the best we can do is ignore the request.
+				return
+			}
+			anycast = true
 		}
 		hdr := buffer.NewPrependable(int(r.MaxHeaderLength()) + header.IPv6MinimumSize + header.ICMPv6NeighborAdvertSize)
-		pkt := header.ICMPv6(hdr.Prepend(header.ICMPv6NeighborAdvertSize))
-		pkt.SetType(header.ICMPv6NeighborAdvert)
-		pkt[icmpV6FlagOffset] = ndpSolicitedFlag | ndpOverrideFlag
-		copy(pkt[icmpV6OptOffset-len(targetAddr):], targetAddr)
-		pkt[icmpV6OptOffset] = ndpOptDstLinkAddr
-		pkt[icmpV6LengthOffset] = 1
-		copy(pkt[icmpV6LengthOffset+1:], r.LocalLinkAddress[:])
+		na := header.ICMPv6(hdr.Prepend(header.ICMPv6NeighborAdvertSize))
+		na.SetType(header.ICMPv6NeighborAdvert)
+		na[icmpV6FlagOffset] = ndpSolicitedFlag | ndpOverrideFlag
+		if anycast {
+			// Other nodes may answer for the same anycast address, so
+			// the advertisement must not override their answers, RFC
+			// 4861 section 7.2.7.
+			na[icmpV6FlagOffset] = ndpSolicitedFlag
+		}
+		copy(na[icmpV6OptOffset-len(targetAddr):], targetAddr)
+		na[icmpV6OptOffset] = ndpOptDstLinkAddr
+		na[icmpV6LengthOffset] = 1
+		copy(na[icmpV6LengthOffset+1:], r.LocalLinkAddress[:])
+
+		e.linkAddrCache.AddLinkAddress(e.nicid, r.RemoteAddress, r.RemoteLinkAddress)
 
 		// ICMPv6 Neighbor Solicit messages are always sent to
 		// specially crafted IPv6 multicast addresses. As a result, the
@@ -112,48 +145,182 @@ func (e *endpoint) handleICMP(r *stack.Route, netHeader buffer.View, vv buffer.V
 		// multicast address. It would be nonsense to claim that our
 		// source address is a multicast address, so we manually set
 		// the source address to the target address requested in the
-		// solicit message. Since that requires mutating the route, we
-		// must first clone it.
+		// solicit message, or to a unicast address of the NIC if the
+		// target is an anycast address. Since that requires mutating
+		// the route, we must first clone it.
 		r := r.Clone()
-		defer r.Release()
-		r.LocalAddress = targetAddr
-		pkt.SetChecksum(icmpChecksum(pkt, r.LocalAddress, r.RemoteAddress, buffer.VectorisedView{}))
-		r.WritePacket(hdr, buffer.VectorisedView{}, header.ICMPv6ProtocolNumber, r.DefaultTTL())
-
-		e.linkAddrCache.AddLinkAddress(e.nicid, r.RemoteAddress, r.RemoteLinkAddress)
-
-	case header.ICMPv6NeighborAdvert:
-		if len(v) < header.ICMPv6NeighborAdvertSize {
+		if anycast {
+			if !r.SetUnicastSource() {
+				r.Release()
+				return
+			}
+		} else {
+			r.LocalAddress = targetAddr
+		}
+		na.SetChecksum(icmpChecksum(na, r.LocalAddress, r.RemoteAddress, buffer.VectorisedView{}))
+		send := func() {
+			defer r.Release()
+			advert := stack.NewOutboundPacketBuffer(hdr, buffer.VectorisedView{})
+			defer advert.DecRef()
+			if err := r.WritePacket(advert, header.ICMPv6ProtocolNumber, r.DefaultTTL()); err != nil {
+				stats.OutgoingPacketErrors.Increment()
+			} else {
+				stats.V6PacketsSent.NeighborAdvert.Increment()
+			}
+		}
+		if !anycast {
+			send()
 			return
 		}
+		// Advertisements for anycast addresses are delayed by a random
+		// time, so that the answers of the nodes sharing the address
+		// don't all arrive at once, RFC 4861 section 7.2.7.
+		e.delayAdvert(&r, time.Duration(rand.Int63n(int64(maxAnycastDelayTime))), send)
+
+	case header.ICMPv6NeighborAdvert:
 		targetAddr := tcpip.Address(v[8 : 8+16])
 		e.linkAddrCache.AddLinkAddress(e.nicid, targetAddr, r.RemoteLinkAddress)
 		if targetAddr != r.RemoteAddress {
 			e.linkAddrCache.AddLinkAddress(e.nicid, r.RemoteAddress, r.RemoteLinkAddress)
 		}
 
+	case header.ICMPv6RedirectMsg:
+		if len(v) < header.ICMPv6RedirectMinimumSize {
+			stats.InvalidPacketsReceived.Increment()
+			r.RecordDrop(tcpip.DropMalformed, vv)
+			return
+		}
+		if !validChecksum(r, vv) {
+			stats.InvalidPacketsReceived.Increment()
+			r.RecordDrop(tcpip.DropBadChecksum, vv)
+			return
+		}
+		// Redirects must come from a neighboring router, and their
+		// target be a router, which is addressed by its link-local
+		// address, or the destination itself, RFC 4861 section 8.1.
+		target, dst := h.RedirectTarget(), h.RedirectDestination()
+		if h.Code() != 0 || pkt.TTL() != header.NDPHopLimit || !header.IsV6LinkLocalAddress(r.RemoteAddress) || (target != dst && !header.IsV6LinkLocalAddress(target)) {
+			stats.RedirectsIgnored.Increment()
+			return
+		}
+		r.HandleRedirect(dst, target)
+
 	case header.ICMPv6EchoRequest:
-		if len(v) < header.ICMPv6EchoMinimumSize {
+		if !validChecksum(r, vv) {
+			stats.InvalidPacketsReceived.Increment()
+			r.RecordDrop(tcpip.DropBadChecksum, vv)
+			return
+		}
+
+		if !r.AllowICMP() {
 			return
 		}
 
+		// Replies to echo requests sent to an anycast address are sent
+		// from a unicast address, RFC 4443 section 2.2.
+		if r.IsAnycast() {
+			c := r.Clone()
+			defer c.Release()
+			if !c.SetUnicastSource() {
+				return
+			}
+			r = &c
+		}
+
+		// The reply may be queued by the link endpoint.
+		vv := pkt.OwnedData(nil)
 		vv.TrimFront(header.ICMPv6EchoMinimumSize)
 		hdr := buffer.NewPrependable(int(r.MaxHeaderLength()) + header.ICMPv6EchoMinimumSize)
-		pkt := header.ICMPv6(hdr.Prepend(header.ICMPv6EchoMinimumSize))
-		copy(pkt, h)
-		pkt.SetType(header.ICMPv6EchoReply)
-		pkt.SetChecksum(icmpChecksum(pkt, r.LocalAddress, r.RemoteAddress, vv))
-		r.WritePacket(hdr, vv, header.ICMPv6ProtocolNumber, r.DefaultTTL())
+		reply := header.ICMPv6(hdr.Prepend(header.ICMPv6EchoMinimumSize))
+		copy(reply, h)
+		reply.SetType(header.ICMPv6EchoReply)
+		reply.SetChecksum(icmpChecksum(reply, r.LocalAddress, r.RemoteAddress, vv))
+		replyPkt := stack.NewOutboundPacketBuffer(hdr, vv)
+		if err := r.WritePacket(replyPkt, header.ICMPv6ProtocolNumber, r.DefaultTTL()); err != nil {
+			stats.OutgoingPacketErrors.Increment()
+		} else {
+			stats.V6PacketsSent.EchoReply.Increment()
+		}
+		replyPkt.DecRef()
+
+	case header.ICMPv6NodeInfoQuery:
+		if len(v) < header.ICMPv6NodeInfoMinimumSize {
+			stats.InvalidPacketsReceived.Increment()
+			r.RecordDrop(tcpip.DropMalformed, vv)
+			return
+		}
+		if !validChecksum(r, vv) {
+			stats.InvalidPacketsReceived.Increment()
+			r.RecordDrop(tcpip.DropBadChecksum, vv)
+			return
+		}
+		e.handleNodeInfoQuery(r, header.ICMPv6(vv.ToView()))
 
 	case header.ICMPv6EchoReply:
-		if len(v) < header.ICMPv6EchoMinimumSize {
+		if !validChecksum(r, vv) {
+			stats.InvalidPacketsReceived.Increment()
+			r.RecordDrop(tcpip.DropBadChecksum, vv)
 			return
 		}
-		e.dispatcher.DeliverTransportPacket(r, header.ICMPv6ProtocolNumber, netHeader, vv)
+		e.dispatcher.DeliverTransportPacket(r, header.ICMPv6ProtocolNumber, pkt)
 
 	}
 }
 
+// maxAnycastDelayTime is the longest time advertisements for anycast addresses
+// are delayed by, MAX_ANYCAST_DELAY_TIME of RFC 4861 section 10.
+const maxAnycastDelayTime = time.Second
+
+// anycastAdvert is a delayed advertisement of an anycast address, sent through
+// route.
+type anycastAdvert struct {
+	timer tcpip.Timer
+	route *stack.Route
+}
+
+// delayAdvert calls send after delay, on the clock of the stack, unless the
+// NIC of the endpoint is removed first. send, or delayAdvert if send isn't
+// called, releases r.
+func (e *endpoint) delayAdvert(r *stack.Route, delay time.Duration, send func()) {
+	a := &anycastAdvert{route: r}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.nicRemoved {
+		r.Release()
+		return
+	}
+	if e.adverts == nil {
+		e.adverts = make(map[*anycastAdvert]struct{})
+	}
+	a.timer = e.clock.AfterFunc(delay, func() {
+		e.mu.Lock()
+		_, ok := e.adverts[a]
+		delete(e.adverts, a)
+		e.mu.Unlock()
+		// The advertisement is no longer pending if the NIC was
+		// removed, which released its route.
+		if ok {
+			send()
+		}
+	})
+	e.adverts[a] = struct{}{}
+}
+
+// HandleNICRemoval implements stack.NICRemovalHandler.HandleNICRemoval. It
+// stops the pending advertisements.
+func (e *endpoint) HandleNICRemoval() {
+	e.mu.Lock()
+	adverts := e.adverts
+	e.adverts = nil
+	e.nicRemoved = true
+	e.mu.Unlock()
+
+	for a := range adverts {
+		a.timer.Stop()
+		a.route.Release()
+	}
+}
+
 const (
 	ndpSolicitedFlag = 1 << 6
 	ndpOverrideFlag  = 1 << 5
@@ -202,7 +369,9 @@ func (*protocol) LinkAddressRequest(addr, localAddr tcpip.Address, linkEP stack.
 		DstAddr:       r.RemoteAddress,
 	})
 
-	return linkEP.WritePacket(r, hdr, buffer.VectorisedView{}, ProtocolNumber)
+	solicit := stack.NewOutboundPacketBuffer(hdr, buffer.VectorisedView{})
+	defer solicit.DecRef()
+	return linkEP.WritePacket(r, solicit, ProtocolNumber)
 }
 
 // ResolveStaticAddress implements stack.LinkAddressResolver.
@@ -229,6 +398,13 @@ func (*protocol) ResolveStaticAddress(addr tcpip.Address) (tcpip.LinkAddress, bo
 	return "", false
 }
 
+// validChecksum reports whether the checksum of the ICMPv6 message vv,
+// received through r, is valid.
+func validChecksum(r *stack.Route, vv buffer.VectorisedView) bool {
+	xsum := header.PseudoHeaderChecksum(header.ICMPv6ProtocolNumber, r.RemoteAddress, r.LocalAddress, uint16(vv.Size()))
+	return header.ChecksumVV(vv, xsum) == 0xffff
+}
+
 func icmpChecksum(h header.ICMPv6, src, dst tcpip.Address, vv buffer.VectorisedView) uint16 {
 	// Calculate the IPv6 pseudo-header upper-layer checksum.
 	xsum := header.Checksum([]byte(src), 0)
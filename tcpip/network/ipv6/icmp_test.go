@@ -21,6 +21,7 @@ import (
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/faketime"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/link/channel"
 	"github.com/google/netstack/tcpip/link/sniffer"
@@ -220,3 +221,410 @@ func TestLinkResolution(t *testing.T) {
 		}
 	}
 }
+
+func TestEchoChecksum(t *testing.T) {
+	s := stack.New([]string{ProtocolName}, []string{icmp.ProtocolName6}, stack.Options{})
+	id, linkEP := channel.New(256, 1280, linkAddr0)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC: %v", err)
+	}
+	if err := s.AddAddress(1, ProtocolNumber, lladdr0); err != nil {
+		t.Fatalf("AddAddress: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: lladdr1,
+		Mask:        tcpip.AddressMask(strings.Repeat("\xff", 16)),
+		NIC:         1,
+	}})
+
+	for _, good := range []bool{true, false} {
+		icmpSize := header.ICMPv6EchoMinimumSize + 4
+		buf := buffer.NewView(header.IPv6MinimumSize + icmpSize)
+		header.IPv6(buf).Encode(&header.IPv6Fields{
+			PayloadLength: uint16(icmpSize),
+			NextHeader:    uint8(header.ICMPv6ProtocolNumber),
+			HopLimit:      255,
+			SrcAddr:       lladdr1,
+			DstAddr:       lladdr0,
+		})
+		pkt := header.ICMPv6(buf[header.IPv6MinimumSize:])
+		pkt.SetType(header.ICMPv6EchoRequest)
+		copy(pkt[header.ICMPv6EchoMinimumSize:], "ping")
+		pkt.SetChecksum(icmpChecksum(pkt, lladdr1, lladdr0, buffer.VectorisedView{}))
+		if !good {
+			pkt.SetChecksum(pkt.Checksum() + 1)
+		}
+
+		linkEP.Inject(ProtocolNumber, buf.ToVectorisedView())
+
+		select {
+		case p := <-linkEP.C:
+			if !good {
+				t.Fatalf("got a reply to a request with a bad checksum")
+			}
+			reply := append(append(buffer.View(nil), p.Header...), p.Payload...)
+			vv := buffer.View(reply[header.IPv6MinimumSize:]).ToVectorisedView()
+			if got := header.ICMPv6(reply[header.IPv6MinimumSize:]).Type(); got != header.ICMPv6EchoReply {
+				t.Fatalf("got reply type = %d, want = %d", got, header.ICMPv6EchoReply)
+			}
+			xsum := header.PseudoHeaderChecksum(header.ICMPv6ProtocolNumber, lladdr0, lladdr1, uint16(vv.Size()))
+			if got := header.ChecksumVV(vv, xsum); got != 0xffff {
+				t.Errorf("got reply checksum sum = %#x, want = 0xffff", got)
+			}
+		default:
+			if good {
+				t.Fatalf("got no reply to a request with a good checksum")
+			}
+		}
+	}
+}
+
+func TestRawEndpoint(t *testing.T) {
+	s := stack.New([]string{ProtocolName}, []string{icmp.ProtocolName6}, stack.Options{})
+	id, linkEP := channel.New(256, 1280, linkAddr0)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC: %v", err)
+	}
+	if err := s.AddAddress(1, ProtocolNumber, lladdr0); err != nil {
+		t.Fatalf("AddAddress: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: lladdr1,
+		Mask:        tcpip.AddressMask(strings.Repeat("\xff", 16)),
+		NIC:         1,
+	}})
+
+	var wq waiter.Queue
+	ep, err := s.NewRawEndpoint(header.ICMPv6ProtocolNumber, ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewRawEndpoint: %v", err)
+	}
+	defer ep.Close()
+
+	// inject injects an ICMPv6 message of type typ from src, and drops
+	// what the stack sends in response.
+	inject := func(src tcpip.Address, typ header.ICMPv6Type) {
+		icmpSize := header.ICMPv6DstUnreachableMinimumSize + 4
+		buf := buffer.NewView(header.IPv6MinimumSize + icmpSize)
+		header.IPv6(buf).Encode(&header.IPv6Fields{
+			PayloadLength: uint16(icmpSize),
+			NextHeader:    uint8(header.ICMPv6ProtocolNumber),
+			HopLimit:      255,
+			SrcAddr:       src,
+			DstAddr:       lladdr0,
+		})
+		pkt := header.ICMPv6(buf[header.IPv6MinimumSize:])
+		pkt.SetType(typ)
+		copy(pkt[header.ICMPv6DstUnreachableMinimumSize:], "ping")
+		pkt.SetChecksum(icmpChecksum(pkt, src, lladdr0, buffer.VectorisedView{}))
+		linkEP.Inject(ProtocolNumber, buf.ToVectorisedView())
+		for len(linkEP.C) > 0 {
+			<-linkEP.C
+		}
+	}
+	// expect checks that the endpoint received a message of type typ from
+	// src, if typ isn't zero, and nothing else.
+	expect := func(src tcpip.Address, typ header.ICMPv6Type) {
+		t.Helper()
+		var addr tcpip.FullAddress
+		v, _, err := ep.Read(&addr)
+		if typ == 0 {
+			if err != tcpip.ErrWouldBlock {
+				t.Fatalf("got Read() = %v, %v, want ErrWouldBlock", v, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if got := header.ICMPv6(v[header.IPv6MinimumSize:]).Type(); got != typ || addr.Addr != src {
+			t.Fatalf("got type %d from %s, want type %d from %s", got, addr.Addr, typ, src)
+		}
+		if _, _, err := ep.Read(nil); err != tcpip.ErrWouldBlock {
+			t.Fatalf("got Read() = %v, want ErrWouldBlock", err)
+		}
+	}
+
+	// Raw endpoints receive the messages that no other endpoint handles.
+	inject(lladdr1, header.ICMPv6DstUnreachable)
+	expect(lladdr1, header.ICMPv6DstUnreachable)
+	inject(lladdr1, header.ICMPv6EchoRequest)
+	expect(lladdr1, header.ICMPv6EchoRequest)
+
+	var filter tcpip.ICMPFilterOption
+	filter.Block(uint8(header.ICMPv6DstUnreachable))
+	if err := ep.SetSockOpt(filter); err != nil {
+		t.Fatalf("SetSockOpt(%v): %v", filter, err)
+	}
+	inject(lladdr1, header.ICMPv6DstUnreachable)
+	expect("", 0)
+
+	// Once connected, they only receive the messages from their peer.
+	if err := ep.Connect(tcpip.FullAddress{NIC: 1, Addr: lladdr1}); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	lladdr2 := header.LinkLocalAddr("\x02\x03\x04\x05\x06\x07")
+	inject(lladdr2, header.ICMPv6EchoRequest)
+	expect("", 0)
+	inject(lladdr1, header.ICMPv6EchoRequest)
+	expect(lladdr1, header.ICMPv6EchoRequest)
+}
+
+func TestAnycast(t *testing.T) {
+	// The Subnet-Router anycast address of 2001:db8::/64.
+	const anycastAddr = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+
+	s := stack.New([]string{ProtocolName}, []string{icmp.ProtocolName6}, stack.Options{})
+	id, linkEP := channel.New(256, 1280, linkAddr0)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC: %v", err)
+	}
+	if err := s.AddAddress(1, ProtocolNumber, lladdr0); err != nil {
+		t.Fatalf("AddAddress: %v", err)
+	}
+	if err := s.AddAnycastAddress(1, ProtocolNumber, anycastAddr); err != nil {
+		t.Fatalf("AddAnycastAddress: %v", err)
+	}
+	if err := s.AddAddress(1, ProtocolNumber, header.SolicitedNodeAddr(anycastAddr)); err != nil {
+		t.Fatalf("AddAddress sn anycastAddr: %v", err)
+	}
+	if err := s.AddAnycastAddress(1, ProtocolNumber, header.SolicitedNodeAddr(lladdr0)); err != tcpip.ErrBadAddress {
+		t.Errorf("got AddAnycastAddress(multicast) = %v, want %v", err, tcpip.ErrBadAddress)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: lladdr1,
+		Mask:        tcpip.AddressMask(strings.Repeat("\xff", 16)),
+		NIC:         1,
+	}})
+
+	// inject injects an ICMPv6 message of type typ from lladdr1 to dst,
+	// and returns the reply of the stack.
+	inject := func(dst tcpip.Address, typ header.ICMPv6Type, size int, body []byte) header.IPv6 {
+		t.Helper()
+		buf := buffer.NewView(header.IPv6MinimumSize + size)
+		header.IPv6(buf).Encode(&header.IPv6Fields{
+			PayloadLength: uint16(size),
+			NextHeader:    uint8(header.ICMPv6ProtocolNumber),
+			HopLimit:      255,
+			SrcAddr:       lladdr1,
+			DstAddr:       dst,
+		})
+		pkt := header.ICMPv6(buf[header.IPv6MinimumSize:])
+		pkt.SetType(typ)
+		copy(pkt[4:], body)
+		pkt.SetChecksum(icmpChecksum(pkt, lladdr1, dst, buffer.VectorisedView{}))
+		linkEP.Inject(ProtocolNumber, buf.ToVectorisedView())
+
+		select {
+		case p := <-linkEP.C:
+			return header.IPv6(append(append(buffer.View(nil), p.Header...), p.Payload...))
+		case <-time.After(2 * maxAnycastDelayTime):
+			t.Fatalf("got no reply to ICMPv6 message of type %d", typ)
+			return nil
+		}
+	}
+
+	// Neighbor advertisements for anycast addresses are sent from a
+	// unicast address, without the override flag.
+	na := inject(header.SolicitedNodeAddr(anycastAddr), header.ICMPv6NeighborSolicit, header.ICMPv6NeighborSolicitMinimumSize, append(make([]byte, 4), anycastAddr...))
+	if got := na.SourceAddress(); got != lladdr0 {
+		t.Errorf("got neighbor advertisement source = %s, want %s", got, lladdr0)
+	}
+	if got := header.ICMPv6(na.Payload()); got.Type() != header.ICMPv6NeighborAdvert || got[icmpV6FlagOffset] != ndpSolicitedFlag {
+		t.Errorf("got message of type %d with flags %#x, want neighbor advertisement with flags %#x", got.Type(), got[icmpV6FlagOffset], ndpSolicitedFlag)
+	}
+
+	// So are echo replies.
+	reply := inject(anycastAddr, header.ICMPv6EchoRequest, header.ICMPv6EchoMinimumSize, nil)
+	if got := reply.SourceAddress(); got != lladdr0 {
+		t.Errorf("got echo reply source = %s, want %s", got, lladdr0)
+	}
+
+	// Anycast addresses can't be used as source.
+	if r, err := s.FindRoute(1, anycastAddr, lladdr1, ProtocolNumber, false /* multicastLoop */); err == nil {
+		r.Release()
+		t.Errorf("got FindRoute from anycast address = %v, want error", r)
+	}
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(header.ICMPv6ProtocolNumber, ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: anycastAddr}); err != tcpip.ErrBadLocalAddress {
+		t.Errorf("got Bind(anycast address) = %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+}
+
+func TestAnycastAdvertClock(t *testing.T) {
+	const anycastAddr = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+
+	clock := faketime.NewManualClock()
+	s := stack.New([]string{ProtocolName}, nil, stack.Options{Clock: clock})
+	id, linkEP := channel.New(256, 1280, linkAddr0)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC: %v", err)
+	}
+	if err := s.AddAddress(1, ProtocolNumber, lladdr0); err != nil {
+		t.Fatalf("AddAddress: %v", err)
+	}
+	if err := s.AddAnycastAddress(1, ProtocolNumber, anycastAddr); err != nil {
+		t.Fatalf("AddAnycastAddress: %v", err)
+	}
+	if err := s.AddAddress(1, ProtocolNumber, header.SolicitedNodeAddr(anycastAddr)); err != nil {
+		t.Fatalf("AddAddress sn anycastAddr: %v", err)
+	}
+
+	solicit := func() {
+		dst := header.SolicitedNodeAddr(anycastAddr)
+		buf := buffer.NewView(header.IPv6MinimumSize + header.ICMPv6NeighborSolicitMinimumSize)
+		header.IPv6(buf).Encode(&header.IPv6Fields{
+			PayloadLength: header.ICMPv6NeighborSolicitMinimumSize,
+			NextHeader:    uint8(header.ICMPv6ProtocolNumber),
+			HopLimit:      255,
+			SrcAddr:       lladdr1,
+			DstAddr:       dst,
+		})
+		pkt := header.ICMPv6(buf[header.IPv6MinimumSize:])
+		pkt.SetType(header.ICMPv6NeighborSolicit)
+		copy(pkt[8:], anycastAddr)
+		pkt.SetChecksum(icmpChecksum(pkt, lladdr1, dst, buffer.VectorisedView{}))
+		linkEP.Inject(ProtocolNumber, buf.ToVectorisedView())
+	}
+
+	// The advertisement is delayed on the clock of the stack.
+	solicit()
+	if _, ok := clock.NextExpiration(); !ok {
+		t.Fatal("got no pending advertisement")
+	}
+	select {
+	case <-linkEP.C:
+		t.Fatal("got advertisement before the clock was advanced")
+	default:
+	}
+	clock.Advance(maxAnycastDelayTime)
+	select {
+	case <-linkEP.C:
+	default:
+		t.Fatal("got no advertisement once the clock was advanced")
+	}
+
+	// Pending advertisements are stopped when the NIC is removed.
+	solicit()
+	if err := s.RemoveNIC(1); err != nil {
+		t.Fatalf("RemoveNIC: %v", err)
+	}
+	if d, ok := clock.NextExpiration(); ok {
+		t.Errorf("got advertisement pending in %s after the NIC was removed", d)
+	}
+	clock.Advance(maxAnycastDelayTime)
+	select {
+	case <-linkEP.C:
+		t.Error("got advertisement after the NIC was removed")
+	default:
+	}
+}
+
+func TestNodeInfo(t *testing.T) {
+	const nodeName = "host.example.com."
+
+	s := stack.New([]string{ProtocolName}, []string{icmp.ProtocolName6}, stack.Options{})
+	id, linkEP := channel.New(256, 1280, linkAddr0)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC: %v", err)
+	}
+	if err := s.AddAddress(1, ProtocolNumber, lladdr0); err != nil {
+		t.Fatalf("AddAddress: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: lladdr1,
+		Mask:        tcpip.AddressMask(strings.Repeat("\xff", 16)),
+		NIC:         1,
+	}})
+	s.SetNodeName(nodeName)
+
+	nonce := []byte("\x01\x02\x03\x04\x05\x06\x07\x08")
+	nameSubject := func(name string) []byte {
+		b, ok := header.AppendNodeInfoName(nil, name)
+		if !ok {
+			t.Fatalf("AppendNodeInfoName(%q) failed", name)
+		}
+		return b
+	}
+	// query injects a node information query from lladdr1, and returns the
+	// reply of the stack, if any.
+	query := func(code byte, qtype uint16, subject []byte) header.ICMPv6 {
+		t.Helper()
+		icmpSize := header.ICMPv6NodeInfoMinimumSize + len(subject)
+		buf := buffer.NewView(header.IPv6MinimumSize + icmpSize)
+		header.IPv6(buf).Encode(&header.IPv6Fields{
+			PayloadLength: uint16(icmpSize),
+			NextHeader:    uint8(header.ICMPv6ProtocolNumber),
+			HopLimit:      64,
+			SrcAddr:       lladdr1,
+			DstAddr:       lladdr0,
+		})
+		pkt := header.ICMPv6(buf[header.IPv6MinimumSize:])
+		pkt.SetType(header.ICMPv6NodeInfoQuery)
+		pkt.SetCode(code)
+		pkt.EncodeNodeInfo(qtype, 0, nonce)
+		copy(pkt.NodeInfoData(), subject)
+		pkt.SetChecksum(icmpChecksum(pkt, lladdr1, lladdr0, buffer.VectorisedView{}))
+		linkEP.Inject(ProtocolNumber, buf.ToVectorisedView())
+
+		select {
+		case p := <-linkEP.C:
+			reply := append(append(buffer.View(nil), p.Header...), p.Payload...)
+			h := header.ICMPv6(reply[header.IPv6MinimumSize:])
+			if h.Type() != header.ICMPv6NodeInfoReply || h.NodeInfoQtype() != qtype || string(h.NodeInfoNonce()) != string(nonce) {
+				t.Fatalf("got message of type %d, qtype %d, nonce %x, want node information reply of qtype %d, nonce %x", h.Type(), h.NodeInfoQtype(), h.NodeInfoNonce(), qtype, nonce)
+			}
+			return h
+		default:
+			return nil
+		}
+	}
+
+	// Queries are ignored until the responder is enabled.
+	if h := query(header.ICMPv6NodeInfoSubjectIPv6, header.ICMPv6NodeInfoNodeName, []byte(lladdr0)); h != nil {
+		t.Fatalf("got a reply with the responder disabled")
+	}
+	s.SetNodeInfoResponder(true)
+
+	for _, tc := range []struct {
+		name    string
+		code    byte
+		subject []byte
+	}{
+		{"address", header.ICMPv6NodeInfoSubjectIPv6, []byte(lladdr0)},
+		{"name", header.ICMPv6NodeInfoSubjectName, nameSubject("HOST.example.com.")},
+		{"first label", header.ICMPv6NodeInfoSubjectName, nameSubject("host")},
+	} {
+		h := query(tc.code, header.ICMPv6NodeInfoNodeName, tc.subject)
+		if h == nil {
+			t.Fatalf("%s: got no reply", tc.name)
+		}
+		if h.Code() != header.ICMPv6NodeInfoSuccess {
+			t.Fatalf("%s: got reply code %d, want %d", tc.name, h.Code(), header.ICMPv6NodeInfoSuccess)
+		}
+		name, _, ok := header.ParseNodeInfoName(h.NodeInfoData()[header.ICMPv6NodeNameTTLSize:])
+		if !ok || name != nodeName {
+			t.Fatalf("%s: got node name %q, %t, want %q", tc.name, name, ok, nodeName)
+		}
+	}
+
+	// Queries about other nodes are ignored.
+	if h := query(header.ICMPv6NodeInfoSubjectIPv6, header.ICMPv6NodeInfoNodeName, []byte(lladdr1)); h != nil {
+		t.Errorf("got a reply to a query about another address")
+	}
+	if h := query(header.ICMPv6NodeInfoSubjectName, header.ICMPv6NodeInfoNodeName, nameSubject("other.example.com.")); h != nil {
+		t.Errorf("got a reply to a query about another name")
+	}
+
+	if h := query(header.ICMPv6NodeInfoSubjectIPv6, header.ICMPv6NodeInfoNoop, nil); h == nil || h.Code() != header.ICMPv6NodeInfoSuccess {
+		t.Errorf("got reply %v to a NOOP query, want success", h)
+	}
+	if h := query(header.ICMPv6NodeInfoSubjectIPv6, header.ICMPv6NodeInfoNodeAddresses, []byte(lladdr0)); h == nil || h.Code() != header.ICMPv6NodeInfoUnknownQtype {
+		t.Errorf("got reply %v to a node addresses query, want unknown qtype", h)
+	}
+}
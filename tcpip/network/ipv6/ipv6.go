@@ -21,6 +21,8 @@
 package ipv6
 
 import (
+	"sync"
+
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
@@ -36,7 +38,7 @@ const (
 
 	// maxTotalSize is maximum size that can be encoded in the 16-bit
 	// PayloadLength field of the ipv6 header.
-	maxPayloadSize = 0xffff
+	maxPayloadSize = header.IPv6MaximumPayloadSize
 
 	// defaultIPv6HopLimit is the default hop limit for IPv6 Packets
 	// egressed by Netstack.
@@ -48,7 +50,16 @@ type endpoint struct {
 	id            stack.NetworkEndpointID
 	linkEP        stack.LinkEndpoint
 	linkAddrCache stack.LinkAddressCache
+	clock         tcpip.Clock
 	dispatcher    stack.TransportDispatcher
+
+	mu sync.Mutex
+	// adverts are the delayed advertisements of anycast addresses waiting
+	// for their timer to fire.
+	adverts map[*anycastAdvert]struct{}
+	// nicRemoved is set once the NIC of the endpoint is removed, after
+	// which no advertisement is delayed anymore.
+	nicRemoved bool
 }
 
 // DefaultTTL is the default hop limit for this endpoint.
@@ -59,7 +70,7 @@ func (e *endpoint) DefaultTTL() uint8 {
 // MTU implements stack.NetworkEndpoint.MTU. It returns the link-layer MTU minus
 // the network layer max header length.
 func (e *endpoint) MTU() uint32 {
-	return calculateMTU(e.linkEP.MTU())
+	return calculateJumboMTU(e.linkEP.MTU())
 }
 
 // NICID returns the ID of the NIC this endpoint belongs to.
@@ -78,58 +89,95 @@ func (e *endpoint) Capabilities() stack.LinkEndpointCapabilities {
 }
 
 // MaxHeaderLength returns the maximum length needed by ipv6 headers (and
-// underlying protocols).
+// underlying protocols). On links that carry jumbograms, it includes the
+// hop-by-hop options header holding their length.
 func (e *endpoint) MaxHeaderLength() uint16 {
-	return e.linkEP.MaxHeaderLength() + header.IPv6MinimumSize
+	l := e.linkEP.MaxHeaderLength() + header.IPv6MinimumSize
+	if carriesJumbograms(e.linkEP.MTU()) {
+		l += header.IPv6JumboPayloadHeaderSize
+	}
+	return l
 }
 
-// WritePacket writes a packet to the given destination address and protocol.
-func (e *endpoint) WritePacket(r *stack.Route, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.TransportProtocolNumber, ttl uint8, loop stack.PacketLooping) *tcpip.Error {
-	length := uint16(hdr.UsedLength() + payload.Size())
-	ip := header.IPv6(hdr.Prepend(header.IPv6MinimumSize))
+// WritePacket writes a packet to the given destination address, prepending a
+// header built from params to pkt.Header. Payloads that don't fit in the payload length field are
+// sent as jumbograms if the link carries them.
+func (e *endpoint) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, params stack.NetworkHeaderParams, loop stack.PacketLooping) *tcpip.Error {
+	length := pkt.Size()
+	next := uint8(params.Protocol)
+	if length > maxPayloadSize {
+		if !carriesJumbograms(e.linkEP.MTU()) {
+			return tcpip.ErrMessageTooLong
+		}
+		// The hop-by-hop options header may not have been reserved
+		// if the MTU grew after pkt.Header was allocated.
+		hbh := header.IPv6HopByHop(pkt.Header.Prepend(header.IPv6JumboPayloadHeaderSize))
+		if hbh == nil {
+			return tcpip.ErrMessageTooLong
+		}
+		length += header.IPv6JumboPayloadHeaderSize
+		hbh.EncodeJumboPayload(next, uint32(length))
+		next = header.IPv6HopByHopOptionsHeader
+		length = 0
+	}
+	ip := header.IPv6(pkt.Header.Prepend(header.IPv6MinimumSize))
 	ip.Encode(&header.IPv6Fields{
-		PayloadLength: length,
-		NextHeader:    uint8(protocol),
-		HopLimit:      ttl,
+		PayloadLength: uint16(length),
+		NextHeader:    next,
+		HopLimit:      params.TTL,
+		TrafficClass:  params.TOS,
+		FlowLabel:     params.FlowLabel,
 		SrcAddr:       r.LocalAddress,
 		DstAddr:       r.RemoteAddress,
 	})
+	pkt.NetworkHeader = buffer.View(ip)
 
 	if loop&stack.PacketLoop != 0 {
-		views := make([]buffer.View, 1, 1+len(payload.Views()))
-		views[0] = hdr.View()
-		views = append(views, payload.Views()...)
-		vv := buffer.NewVectorisedView(len(views[0])+payload.Size(), views)
-		e.HandlePacket(r, vv)
+		looped := stack.NewPacketBuffer(pkt.ToVectorisedView())
+		e.HandlePacket(r, looped)
+		looped.DecRef()
 	}
 	if loop&stack.PacketOut == 0 {
 		return nil
 	}
 
 	r.Stats().IP.PacketsSent.Increment()
-	return e.linkEP.WritePacket(r, hdr, payload, ProtocolNumber)
+	return e.linkEP.WritePacket(r, pkt, ProtocolNumber)
 }
 
 // HandlePacket is called by the link layer when new ipv6 packets arrive for
 // this endpoint.
-func (e *endpoint) HandlePacket(r *stack.Route, vv buffer.VectorisedView) {
-	headerView := vv.First()
-	h := header.IPv6(headerView)
-	if !h.IsValid(vv.Size()) {
+func (e *endpoint) HandlePacket(r *stack.Route, pkt *stack.PacketBuffer) {
+	h, err := header.ParseIPv6Header(pkt.Data.First(), pkt.Data.Size(), header.ParseLenient)
+	if err != nil {
+		r.Stats().IP.MalformedPacketsReceived.Increment()
+		r.RecordDrop(tcpip.DropMalformed, pkt.Data)
 		return
 	}
 
-	vv.TrimFront(header.IPv6MinimumSize)
-	vv.CapLength(int(h.PayloadLength()))
-
+	hlen := header.IPv6MinimumSize
+	plen := int(h.PayloadLength())
 	p := h.TransportProtocol()
+	if jlen, ok := h.JumboPayloadLength(); ok {
+		// The hop-by-hop options header holding the length is part
+		// of the network header.
+		hbh := h.HopByHopOptions()
+		hlen += hbh.Length()
+		plen = int(jlen) - hbh.Length()
+		p = tcpip.TransportProtocolNumber(hbh.NextHeader())
+	}
+
+	pkt.Data.TrimFront(hlen)
+	pkt.Data.CapLength(plen)
+	pkt.NetworkHeader = buffer.View(h[:hlen])
+
 	if p == header.ICMPv6ProtocolNumber {
-		e.handleICMP(r, headerView, vv)
+		e.handleICMP(r, pkt)
 		return
 	}
 
 	r.Stats().IP.PacketsDelivered.Increment()
-	e.dispatcher.DeliverTransportPacket(r, p, headerView, vv)
+	e.dispatcher.DeliverTransportPacket(r, p, pkt)
 }
 
 // Close cleans up resources associated with the endpoint.
@@ -162,12 +210,13 @@ func (*protocol) ParseAddresses(v buffer.View) (src, dst tcpip.Address) {
 }
 
 // NewEndpoint creates a new ipv6 endpoint.
-func (p *protocol) NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, linkAddrCache stack.LinkAddressCache, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) (stack.NetworkEndpoint, *tcpip.Error) {
+func (p *protocol) NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, linkAddrCache stack.LinkAddressCache, clock tcpip.Clock, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) (stack.NetworkEndpoint, *tcpip.Error) {
 	return &endpoint{
 		nicid:         nicid,
 		id:            stack.NetworkEndpointID{LocalAddress: addr},
 		linkEP:        linkEP,
 		linkAddrCache: linkAddrCache,
+		clock:         clock,
 		dispatcher:    dispatcher,
 	}, nil
 }
@@ -192,6 +241,25 @@ func calculateMTU(mtu uint32) uint32 {
 	return maxPayloadSize
 }
 
+// calculateJumboMTU is like calculateMTU, but lets links that carry jumbograms
+// have larger payloads, preceded by a hop-by-hop options header.
+func calculateJumboMTU(mtu uint32) uint32 {
+	if !carriesJumbograms(mtu) {
+		return calculateMTU(mtu)
+	}
+	mtu -= header.IPv6MinimumSize + header.IPv6JumboPayloadHeaderSize
+	if mtu <= maxPayloadSize {
+		return maxPayloadSize
+	}
+	return mtu
+}
+
+// carriesJumbograms returns whether a link with the given MTU can carry
+// jumbograms, per RFC 2675, section 1.
+func carriesJumbograms(linkMTU uint32) bool {
+	return linkMTU > header.IPv6MinimumSize+maxPayloadSize
+}
+
 func init() {
 	stack.RegisterNetworkProtocolFactory(ProtocolName, func() stack.NetworkProtocol {
 		return &protocol{}
@@ -0,0 +1,127 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipv6
+
+import (
+	"strings"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// handleNodeInfoQuery answers the ICMP node information query q, received
+// through r, if the stack's responder is enabled and the query is about this
+// node. Only the NOOP and node name qtypes are supported; the others are
+// answered with the unknown qtype code.
+func (e *endpoint) handleNodeInfoQuery(r *stack.Route, q header.ICMPv6) {
+	name, ok := r.NodeInfo()
+	if !ok {
+		return
+	}
+	qtype := q.NodeInfoQtype()
+	if (qtype != header.ICMPv6NodeInfoNoop || len(q.NodeInfoData()) != 0) && !e.isNodeInfoSubject(q, name) {
+		return
+	}
+	if !r.AllowICMP() {
+		return
+	}
+
+	code := byte(header.ICMPv6NodeInfoSuccess)
+	var data []byte
+	switch qtype {
+	case header.ICMPv6NodeInfoNoop:
+	case header.ICMPv6NodeInfoNodeName:
+		// The TTL of names is unspecified, and always zero.
+		data = make([]byte, header.ICMPv6NodeNameTTLSize)
+		if name != "" {
+			if data, ok = header.AppendNodeInfoName(data, name); !ok {
+				code = header.ICMPv6NodeInfoRefused
+				data = nil
+			}
+		}
+	default:
+		code = header.ICMPv6NodeInfoUnknownQtype
+	}
+
+	// Queries may be sent to multicast or anycast addresses, which aren't
+	// used as source.
+	reply := r.Clone()
+	defer reply.Release()
+	if header.IsV6MulticastAddress(reply.LocalAddress) || reply.IsAnycast() {
+		if !reply.SetUnicastSource() {
+			return
+		}
+	}
+
+	hdr := buffer.NewPrependable(int(reply.MaxHeaderLength()) + header.ICMPv6NodeInfoMinimumSize + len(data))
+	h := header.ICMPv6(hdr.Prepend(header.ICMPv6NodeInfoMinimumSize + len(data)))
+	h.SetType(header.ICMPv6NodeInfoReply)
+	h.SetCode(code)
+	h.EncodeNodeInfo(qtype, 0, q.NodeInfoNonce())
+	copy(h.NodeInfoData(), data)
+	h.SetChecksum(icmpChecksum(h, reply.LocalAddress, reply.RemoteAddress, buffer.VectorisedView{}))
+	stats := reply.Stats().ICMP
+	pkt := stack.NewOutboundPacketBuffer(hdr, buffer.VectorisedView{})
+	defer pkt.DecRef()
+	if err := reply.WritePacket(pkt, header.ICMPv6ProtocolNumber, reply.DefaultTTL()); err != nil {
+		stats.OutgoingPacketErrors.Increment()
+	} else {
+		stats.V6PacketsSent.NodeInfoReply.Increment()
+	}
+}
+
+// isNodeInfoSubject returns whether the subject of the ICMP node information
+// query q is this node, whose name is name: one of the addresses of the NIC it
+// was received on, or its name.
+func (e *endpoint) isNodeInfoSubject(q header.ICMPv6, name string) bool {
+	subject := q.NodeInfoData()
+	switch q.Code() {
+	case header.ICMPv6NodeInfoSubjectIPv6:
+		if len(subject) != header.IPv6AddressSize {
+			return false
+		}
+		addr := tcpip.Address(subject)
+		return e.linkAddrCache.CheckLocalAddress(e.nicid, ProtocolNumber, addr) != 0 || e.linkAddrCache.IsAnycastAddress(e.nicid, ProtocolNumber, addr)
+	case header.ICMPv6NodeInfoSubjectIPv4:
+		if len(subject) != header.IPv4AddressSize {
+			return false
+		}
+		return e.linkAddrCache.CheckLocalAddress(e.nicid, header.IPv4ProtocolNumber, tcpip.Address(subject)) != 0
+	case header.ICMPv6NodeInfoSubjectName:
+		s, _, ok := header.ParseNodeInfoName(subject)
+		return ok && name != "" && nodeNameMatches(s, name)
+	default:
+		return false
+	}
+}
+
+// nodeNameMatches returns whether the subject name of a node information
+// query designates the node named name. Names are compared without regard to
+// case, and a subject that isn't fully qualified also matches the first label
+// of name, as RFC 4620 suggests.
+func nodeNameMatches(subject, name string) bool {
+	if strings.EqualFold(strings.TrimSuffix(subject, "."), strings.TrimSuffix(name, ".")) {
+		return true
+	}
+	if strings.HasSuffix(subject, ".") {
+		return false
+	}
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	return strings.EqualFold(subject, name)
+}
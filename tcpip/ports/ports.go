@@ -16,20 +16,62 @@
 package ports
 
 import (
+	"crypto/sha1"
+	"encoding/binary"
 	"math"
 	"math/rand"
 	"sync"
 
+	cryptorand "github.com/google/netstack/rand"
 	"github.com/google/netstack/tcpip"
 )
 
 const (
-	// FirstEphemeral is the first ephemeral port.
+	// FirstEphemeral is the first ephemeral port of the default range.
 	FirstEphemeral = 16000
 
+	// LastEphemeral is the last ephemeral port of the default range.
+	LastEphemeral = math.MaxUint16
+
 	anyIPAddress tcpip.Address = ""
 )
 
+// Strategy is the way ephemeral ports are picked, as described in RFC 6056.
+type Strategy int
+
+const (
+	// RandomStart starts the search for a free port at a random port of the
+	// ephemeral range. It is the default.
+	RandomStart Strategy = iota
+
+	// HashBased starts the search for a free port at an offset derived from
+	// a keyed hash of the flow the port is for, and a counter incremented
+	// at every search. It is the Simple Hash-Based Port Selection Algorithm
+	// (algorithm 3) of RFC 6056: successive connections to the same peer use
+	// successive ports, which avoids reusing a recent port for the same
+	// flow, while the ports used for other peers can't be predicted.
+	HashBased
+)
+
+// Flow identifies the flow an ephemeral port is picked for. It is the input of
+// the HashBased strategy.
+type Flow struct {
+	LocalAddress  tcpip.Address
+	RemoteAddress tcpip.Address
+	RemotePort    uint16
+}
+
+// Stats are the counters of a PortManager.
+type Stats struct {
+	// EphemeralExhausted is the number of times no ephemeral port was
+	// available.
+	EphemeralExhausted *tcpip.StatCounter
+
+	// InUse is the number of times a port couldn't be reserved because it
+	// was in use.
+	InUse *tcpip.StatCounter
+}
+
 type portDescriptor struct {
 	network   tcpip.NetworkProtocolNumber
 	transport tcpip.TransportProtocolNumber
@@ -40,6 +82,20 @@ type portDescriptor struct {
 type PortManager struct {
 	mu             sync.RWMutex
 	allocatedPorts map[portDescriptor]bindAddresses
+
+	// ephemeralMu protects the ephemeral port range and strategy. It is
+	// separate from mu as ports are picked with mu held by ReservePort.
+	ephemeralMu    sync.Mutex
+	firstEphemeral uint16
+	lastEphemeral  uint16
+	strategy       Strategy
+
+	// secret is the key of the hash of the HashBased strategy, and
+	// counter the number of searches made with it.
+	secret  [16]byte
+	counter uint32
+
+	stats Stats
 }
 
 type portNode struct {
@@ -89,19 +145,91 @@ func (b bindAddresses) isAvailable(addr tcpip.Address, reuse bool) bool {
 
 // NewPortManager creates new PortManager.
 func NewPortManager() *PortManager {
-	return &PortManager{allocatedPorts: make(map[portDescriptor]bindAddresses)}
+	s := &PortManager{
+		allocatedPorts: make(map[portDescriptor]bindAddresses),
+		firstEphemeral: FirstEphemeral,
+		lastEphemeral:  LastEphemeral,
+		stats: Stats{
+			EphemeralExhausted: &tcpip.StatCounter{},
+			InUse:              &tcpip.StatCounter{},
+		},
+	}
+	cryptorand.Read(s.secret[:])
+	return s
 }
 
-// PickEphemeralPort randomly chooses a starting point and iterates over all
-// possible ephemeral ports, allowing the caller to decide whether a given port
-// is suitable for its needs, and stopping when a port is found or an error
-// occurs.
+// SetEphemeralRange sets the range of ephemeral ports, from first to last
+// included. Ports already picked are not affected.
+func (s *PortManager) SetEphemeralRange(first, last uint16) *tcpip.Error {
+	if first == 0 || first > last {
+		return tcpip.ErrInvalidOptionValue
+	}
+	s.ephemeralMu.Lock()
+	defer s.ephemeralMu.Unlock()
+	s.firstEphemeral, s.lastEphemeral = first, last
+	return nil
+}
+
+// EphemeralRange returns the range of ephemeral ports, from first to last
+// included.
+func (s *PortManager) EphemeralRange() (first, last uint16) {
+	s.ephemeralMu.Lock()
+	defer s.ephemeralMu.Unlock()
+	return s.firstEphemeral, s.lastEphemeral
+}
+
+// SetStrategy sets the way ephemeral ports are picked.
+func (s *PortManager) SetStrategy(strategy Strategy) *tcpip.Error {
+	switch strategy {
+	case RandomStart, HashBased:
+	default:
+		return tcpip.ErrInvalidOptionValue
+	}
+	s.ephemeralMu.Lock()
+	defer s.ephemeralMu.Unlock()
+	s.strategy = strategy
+	return nil
+}
+
+// Strategy returns the way ephemeral ports are picked.
+func (s *PortManager) Strategy() Strategy {
+	s.ephemeralMu.Lock()
+	defer s.ephemeralMu.Unlock()
+	return s.strategy
+}
+
+// Stats returns the counters of s.
+func (s *PortManager) Stats() Stats {
+	return s.stats
+}
+
+// PickEphemeralPort chooses a starting point, as set by SetStrategy, and
+// iterates over all possible ephemeral ports, allowing the caller to decide
+// whether a given port is suitable for its needs, and stopping when a port is
+// found or an error occurs.
 func (s *PortManager) PickEphemeralPort(testPort func(p uint16) (bool, *tcpip.Error)) (port uint16, err *tcpip.Error) {
-	count := uint16(math.MaxUint16 - FirstEphemeral + 1)
-	offset := uint16(rand.Int31n(int32(count)))
+	return s.PickEphemeralPortForFlow(Flow{}, testPort)
+}
+
+// PickEphemeralPortForFlow is like PickEphemeralPort, for a port used by the
+// given flow. The flow is only used by the HashBased strategy, callers that
+// know it should pass it.
+func (s *PortManager) PickEphemeralPortForFlow(flow Flow, testPort func(p uint16) (bool, *tcpip.Error)) (port uint16, err *tcpip.Error) {
+	s.ephemeralMu.Lock()
+	first := uint32(s.firstEphemeral)
+	count := uint32(s.lastEphemeral) - first + 1
+	var offset uint32
+	switch s.strategy {
+	case HashBased:
+		offset = s.hashLocked(flow) + s.counter
+		s.counter++
+	default:
+		offset = uint32(rand.Int31n(int32(count)))
+	}
+	s.ephemeralMu.Unlock()
 
-	for i := uint16(0); i < count; i++ {
-		port = FirstEphemeral + (offset+i)%count
+	for i := uint32(0); i < count; i++ {
+		port = uint16(first + (offset+i)%count)
 		ok, err := testPort(port)
 		if err != nil {
 			return 0, err
@@ -112,9 +240,24 @@ func (s *PortManager) PickEphemeralPort(testPort func(p uint16) (bool, *tcpip.Er
 		}
 	}
 
+	s.stats.EphemeralExhausted.Increment()
 	return 0, tcpip.ErrNoPortAvailable
 }
 
+// hashLocked returns the keyed hash of flow used by the HashBased strategy.
+//
+// Precondition: s.ephemeralMu must be held.
+func (s *PortManager) hashLocked(flow Flow) uint32 {
+	h := sha1.New()
+	h.Write(s.secret[:])
+	h.Write([]byte(flow.LocalAddress))
+	h.Write([]byte(flow.RemoteAddress))
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], flow.RemotePort)
+	h.Write(port[:])
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
 // IsPortAvailable tests if the given port is available on all given protocols.
 func (s *PortManager) IsPortAvailable(networks []tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, addr tcpip.Address, port uint16, reuse bool) bool {
 	s.mu.Lock()
@@ -146,6 +289,7 @@ func (s *PortManager) ReservePort(networks []tcpip.NetworkProtocolNumber, transp
 	// protocols.
 	if port != 0 {
 		if !s.reserveSpecificPort(networks, transport, addr, port, reuse) {
+			s.stats.InUse.Increment()
 			return 0, tcpip.ErrPortInUse
 		}
 		return port, nil
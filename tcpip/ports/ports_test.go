@@ -175,3 +175,94 @@ func TestPickEphemeralPort(t *testing.T) {
 		})
 	}
 }
+
+func TestEphemeralRange(t *testing.T) {
+	pm := NewPortManager()
+	if first, last := pm.EphemeralRange(); first != FirstEphemeral || last != LastEphemeral {
+		t.Errorf("got EphemeralRange() = (%d, %d), want (%d, %d)", first, last, FirstEphemeral, LastEphemeral)
+	}
+	for _, r := range [][2]uint16{{0, 10}, {20, 10}} {
+		if err := pm.SetEphemeralRange(r[0], r[1]); err != tcpip.ErrInvalidOptionValue {
+			t.Errorf("got SetEphemeralRange(%d, %d) = %v, want %v", r[0], r[1], err, tcpip.ErrInvalidOptionValue)
+		}
+	}
+
+	for _, strategy := range []Strategy{RandomStart, HashBased} {
+		pm := NewPortManager()
+		if err := pm.SetEphemeralRange(40000, 40009); err != nil {
+			t.Fatalf("SetEphemeralRange failed: %v", err)
+		}
+		if err := pm.SetStrategy(strategy); err != nil {
+			t.Fatalf("SetStrategy(%d) failed: %v", strategy, err)
+		}
+
+		// All the ports of the range are picked once, then none is left.
+		picked := make(map[uint16]bool)
+		for i := 0; i < 10; i++ {
+			port, err := pm.ReservePort([]tcpip.NetworkProtocolNumber{fakeNetworkNumber}, fakeTransNumber, fakeIPAddress, 0, false)
+			if err != nil {
+				t.Fatalf("strategy %d: ReservePort failed: %v", strategy, err)
+			}
+			if port < 40000 || port > 40009 || picked[port] {
+				t.Fatalf("strategy %d: got port %d, already picked or out of range", strategy, port)
+			}
+			picked[port] = true
+		}
+		if _, err := pm.ReservePort([]tcpip.NetworkProtocolNumber{fakeNetworkNumber}, fakeTransNumber, fakeIPAddress, 0, false); err != tcpip.ErrNoPortAvailable {
+			t.Fatalf("strategy %d: got ReservePort() = %v, want %v", strategy, err, tcpip.ErrNoPortAvailable)
+		}
+		if got := pm.Stats().EphemeralExhausted.Value(); got != 1 {
+			t.Errorf("strategy %d: got EphemeralExhausted = %d, want 1", strategy, got)
+		}
+
+		if _, err := pm.ReservePort([]tcpip.NetworkProtocolNumber{fakeNetworkNumber}, fakeTransNumber, fakeIPAddress, 40000, false); err != tcpip.ErrPortInUse {
+			t.Fatalf("strategy %d: got ReservePort(40000) = %v, want %v", strategy, err, tcpip.ErrPortInUse)
+		}
+		if got := pm.Stats().InUse.Value(); got != 1 {
+			t.Errorf("strategy %d: got InUse = %d, want 1", strategy, got)
+		}
+	}
+}
+
+func TestHashBasedStrategy(t *testing.T) {
+	pm := NewPortManager()
+	if err := pm.SetStrategy(HashBased); err != nil {
+		t.Fatalf("SetStrategy failed: %v", err)
+	}
+	accept := func(uint16) (bool, *tcpip.Error) { return true, nil }
+	pick := func(flow Flow) uint16 {
+		port, err := pm.PickEphemeralPortForFlow(flow, accept)
+		if err != nil {
+			t.Fatalf("PickEphemeralPortForFlow failed: %v", err)
+		}
+		return port
+	}
+
+	// Successive searches for the same flow start at successive ports, so
+	// that a port isn't reused right away for the same peer.
+	flow := Flow{LocalAddress: fakeIPAddress, RemoteAddress: fakeIPAddress1, RemotePort: 80}
+	first := pick(flow)
+	for i := 1; i < 5; i++ {
+		want := uint16(FirstEphemeral + (uint32(first-FirstEphemeral)+uint32(i))%(LastEphemeral-FirstEphemeral+1))
+		if got := pick(flow); got != want {
+			t.Fatalf("got port %d for search %d, want %d", got, i, want)
+		}
+	}
+
+	// Managers have different secrets, so their ports can't be predicted
+	// from another's.
+	other := NewPortManager()
+	other.SetStrategy(HashBased)
+	same := 0
+	for i := 0; i < 10; i++ {
+		flow := Flow{RemoteAddress: fakeIPAddress, RemotePort: uint16(i)}
+		p1, _ := pm.PickEphemeralPortForFlow(flow, accept)
+		p2, _ := other.PickEphemeralPortForFlow(flow, accept)
+		if p1 == p2 {
+			same++
+		}
+	}
+	if same == 10 {
+		t.Errorf("got the same ports from managers with different secrets")
+	}
+}
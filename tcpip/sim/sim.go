@@ -0,0 +1,304 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sim wires several stacks into a simulated network, so protocol
+// behavior can be tested reproducibly under scripted network conditions.
+//
+// All the stacks of a Network share a manual clock, and the links between
+// them draw their impairments from random number generators seeded by the
+// network's seed. Packets are only delivered when the simulation runs, at the
+// virtual time their delay expires, so a given seed and script always produce
+// the same packet losses and delivery order, as long as the traffic offered to
+// the network is itself deterministic.
+//
+// A typical simulation creates the stacks with Network.NewStack, connects them
+// with Network.Connect, schedules changes of conditions with Network.At, and
+// then calls Network.Run to let virtual time pass:
+//
+//	n := sim.New(1)
+//	a := n.NewStack([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+//	b := n.NewStack([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+//	l, _ := n.Connect(a, 1, b, 1, 1500)
+//	l.SetConditions(sim.Conditions{Delay: 10 * time.Millisecond, Loss: 0.1})
+//	n.At(5*time.Second, func() { l.SetConditions(sim.Conditions{Down: true}) })
+//	...
+//	n.Run(10 * time.Second)
+package sim
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/faketime"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// DefaultSettleTime is the default real time Run waits for the goroutines of
+// the stacks to react to an event before moving virtual time forward.
+const DefaultSettleTime = time.Millisecond
+
+// Network is a set of stacks connected by simulated links.
+//
+// This struct is safe for concurrent use.
+type Network struct {
+	// Clock is the clock of all the stacks of the network.
+	Clock *faketime.ManualClock
+
+	// SettleTime is the real time Run waits after each event, like the
+	// delivery of a packet or the expiration of a timer, for the stacks to
+	// process it. It trades the speed of simulations for their
+	// reproducibility, as work done by the stacks after virtual time moved
+	// on is done late.
+	SettleTime time.Duration
+
+	mu    sync.Mutex
+	seed  int64
+	links int
+}
+
+// New creates a network whose links draw their impairments from random number
+// generators derived from seed.
+func New(seed int64) *Network {
+	return &Network{
+		Clock:      faketime.NewManualClock(),
+		SettleTime: DefaultSettleTime,
+		seed:       seed,
+	}
+}
+
+// NewStack creates a stack driven by the network's clock with the given
+// protocols, like stack.New.
+func (n *Network) NewStack(network []string, transport []string) *stack.Stack {
+	return stack.New(network, transport, stack.Options{Clock: n.Clock})
+}
+
+// Now returns the virtual time elapsed since the network was created.
+func (n *Network) Now() time.Duration {
+	return n.Clock.Elapsed()
+}
+
+// At schedules f to be called when the virtual time given by Now reaches t, or
+// at the next event if it already has. It is how conditions are scripted.
+func (n *Network) At(t time.Duration, f func()) {
+	n.Clock.AfterFunc(t-n.Now(), f)
+}
+
+// Run lets d of virtual time pass, delivering the packets and firing the
+// timers that are due on the way, in order.
+func (n *Network) Run(d time.Duration) {
+	end := n.Now() + d
+	for {
+		n.settle()
+		next, ok := n.Clock.NextExpiration()
+		if !ok || n.Now()+next > end {
+			n.Clock.Advance(end - n.Now())
+			n.settle()
+			return
+		}
+		n.Clock.AdvanceToNext()
+	}
+}
+
+// settle gives the goroutines of the stacks a chance to process the last
+// event.
+func (n *Network) settle() {
+	runtime.Gosched()
+	if n.SettleTime > 0 {
+		time.Sleep(n.SettleTime)
+	}
+}
+
+// Connect creates a link between a and b, adding a NIC with ID aNIC to a and
+// one with ID bNIC to b. The link initially delivers all packets without
+// delay.
+func (n *Network) Connect(a *stack.Stack, aNIC tcpip.NICID, b *stack.Stack, bNIC tcpip.NICID, mtu uint32) (*Link, *tcpip.Error) {
+	n.mu.Lock()
+	seed := n.seed + int64(n.links)
+	n.links++
+	n.mu.Unlock()
+
+	l := &Link{
+		clock: n.Clock,
+		rand:  rand.New(rand.NewSource(seed)),
+	}
+	for i := range l.ends {
+		l.ends[i] = &linkEndpoint{link: l, dir: i, mtu: mtu}
+	}
+	if err := a.CreateNIC(aNIC, stack.RegisterLinkEndpoint(l.ends[0])); err != nil {
+		return nil, err
+	}
+	if err := b.CreateNIC(bNIC, stack.RegisterLinkEndpoint(l.ends[1])); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Conditions are the impairments applied by a link to the packets sent in one
+// direction. Probabilities are in the range [0, 1].
+type Conditions struct {
+	// Delay is the base delay of every packet.
+	Delay time.Duration
+
+	// Jitter is the amount of uniformly distributed random variation
+	// added to Delay. Packets whose delays overlap may be reordered.
+	Jitter time.Duration
+
+	// Loss is the probability that a packet is lost.
+	Loss float64
+
+	// Duplicate is the probability that a packet is delivered twice.
+	Duplicate float64
+
+	// Down drops all packets, as if the link was unplugged.
+	Down bool
+}
+
+// LinkStats holds the number of packets that went through a link, in one
+// direction.
+type LinkStats struct {
+	Sent       uint64
+	Delivered  uint64
+	Dropped    uint64
+	Duplicated uint64
+}
+
+// Link is a simulated point-to-point link between two stacks. Its first end is
+// the NIC of the first stack passed to Network.Connect.
+type Link struct {
+	clock *faketime.ManualClock
+	ends  [2]*linkEndpoint
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	conds [2]Conditions
+	stats [2]LinkStats
+}
+
+// SetConditions sets the conditions of both directions of the link.
+func (l *Link) SetConditions(c Conditions) {
+	l.SetDirectionalConditions(c, c)
+}
+
+// SetDirectionalConditions sets the conditions of the packets sent from the
+// first end of the link to the second, and of those sent the other way.
+func (l *Link) SetDirectionalConditions(forward, reverse Conditions) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conds = [2]Conditions{forward, reverse}
+}
+
+// Stats returns the packet counts of the packets sent from the first end of
+// the link to the second, and of those sent the other way.
+func (l *Link) Stats() (forward, reverse LinkStats) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats[0], l.stats[1]
+}
+
+// transmit sends a packet from the end dir of the link to the other one.
+func (l *Link) transmit(dir int, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	l.mu.Lock()
+	c := &l.conds[dir]
+	s := &l.stats[dir]
+	s.Sent++
+	if c.Down || (c.Loss > 0 && l.rand.Float64() < c.Loss) {
+		s.Dropped++
+		l.mu.Unlock()
+		return
+	}
+	n := 1
+	if c.Duplicate > 0 && l.rand.Float64() < c.Duplicate {
+		s.Duplicated++
+		n = 2
+	}
+	delays := make([]time.Duration, n)
+	for i := range delays {
+		d := c.Delay
+		if c.Jitter > 0 {
+			d += time.Duration(l.rand.Int63n(2*int64(c.Jitter)+1)) - c.Jitter
+		}
+		if d < 0 {
+			d = 0
+		}
+		delays[i] = d
+	}
+	l.mu.Unlock()
+
+	peer := l.ends[1-dir]
+	for _, d := range delays {
+		// Each delivery gets its own copy, as the receiving stack may
+		// modify the packet.
+		pkt := vv.ToView().ToVectorisedView()
+		l.clock.AfterFunc(d, func() {
+			if peer.dispatcher == nil {
+				return
+			}
+			l.mu.Lock()
+			l.stats[dir].Delivered++
+			l.mu.Unlock()
+			peer.dispatcher.DeliverNetworkPacket(peer, "", "", protocol, pkt)
+		})
+	}
+}
+
+// linkEndpoint is one end of a Link.
+type linkEndpoint struct {
+	link       *Link
+	dir        int
+	mtu        uint32
+	dispatcher stack.NetworkDispatcher
+}
+
+// Attach implements stack.LinkEndpoint.Attach.
+func (e *linkEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+}
+
+// IsAttached implements stack.LinkEndpoint.IsAttached.
+func (e *linkEndpoint) IsAttached() bool {
+	return e.dispatcher != nil
+}
+
+// MTU implements stack.LinkEndpoint.MTU.
+func (e *linkEndpoint) MTU() uint32 {
+	return e.mtu
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities.
+func (*linkEndpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. Simulated
+// links don't have a link header.
+func (*linkEndpoint) MaxHeaderLength() uint16 {
+	return 0
+}
+
+// LinkAddress implements stack.LinkEndpoint.LinkAddress. Simulated links are
+// point-to-point, so don't use link addresses.
+func (*linkEndpoint) LinkAddress() tcpip.LinkAddress {
+	return ""
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. Packets are delivered
+// to the other end of the link when the simulation runs.
+func (e *linkEndpoint) WritePacket(_ *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	e.link.transmit(e.dir, protocol, pkt.ToVectorisedView())
+	return nil
+}
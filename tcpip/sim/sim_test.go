@@ -0,0 +1,260 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/sim"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	addrA = tcpip.Address("\x0a\x00\x00\x01")
+	addrB = tcpip.Address("\x0a\x00\x00\x02")
+	port  = 1234
+)
+
+// newPair returns a network of two stacks with the given transport protocol,
+// and the link between them.
+func newPair(t *testing.T, seed int64, transport string) (*sim.Network, *stack.Stack, *stack.Stack, *sim.Link) {
+	n := sim.New(seed)
+	a := n.NewStack([]string{ipv4.ProtocolName}, []string{transport})
+	b := n.NewStack([]string{ipv4.ProtocolName}, []string{transport})
+	l, err := n.Connect(a, 1, b, 1, 1500)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	for _, c := range []struct {
+		s    *stack.Stack
+		addr tcpip.Address
+	}{{a, addrA}, {b, addrB}} {
+		if err := c.s.AddAddress(1, ipv4.ProtocolNumber, c.addr); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+		c.s.SetRouteTable([]tcpip.Route{{
+			Destination: "\x00\x00\x00\x00",
+			Mask:        "\x00\x00\x00\x00",
+			NIC:         1,
+		}})
+	}
+	return n, a, b, l
+}
+
+// runUDP sends numbered datagrams from a to b over a lossy link with jitter,
+// and returns the numbers of the datagrams received, in order.
+func runUDP(t *testing.T, seed int64) ([]byte, sim.LinkStats) {
+	n, a, b, l := newPair(t, seed, udp.ProtocolName)
+	l.SetConditions(sim.Conditions{
+		Delay:     10 * time.Millisecond,
+		Jitter:    5 * time.Millisecond,
+		Loss:      0.2,
+		Duplicate: 0.1,
+	})
+
+	var wq waiter.Queue
+	rep, err := b.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer rep.Close()
+	if err := rep.Bind(tcpip.FullAddress{Addr: addrB, Port: port}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	sep, err := a.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer sep.Close()
+
+	to := tcpip.FullAddress{Addr: addrB, Port: port}
+	for i := 0; i < 100; i++ {
+		if _, _, err := sep.Write(tcpip.SlicePayload{byte(i)}, tcpip.WriteOptions{To: &to}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		n.Run(time.Millisecond)
+	}
+	n.Run(time.Second)
+
+	var got []byte
+	for {
+		v, _, err := rep.Read(nil)
+		if err == tcpip.ErrWouldBlock {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		got = append(got, v...)
+	}
+	forward, _ := l.Stats()
+	return got, forward
+}
+
+func TestReproducible(t *testing.T) {
+	got1, stats1 := runUDP(t, 1)
+	got2, stats2 := runUDP(t, 1)
+	if !bytes.Equal(got1, got2) {
+		t.Fatalf("got different datagrams with the same seed:\n%v\n%v", got1, got2)
+	}
+	if stats1 != stats2 {
+		t.Fatalf("got different link stats with the same seed: %+v, %+v", stats1, stats2)
+	}
+	if stats1.Sent != 100 || stats1.Dropped == 0 || stats1.Duplicated == 0 {
+		t.Fatalf("got link stats %+v, want 100 packets sent with some dropped and duplicated", stats1)
+	}
+	if want := stats1.Sent - stats1.Dropped + stats1.Duplicated; uint64(len(got1)) != want || stats1.Delivered != want {
+		t.Fatalf("got %d datagrams received and %d delivered, want %d", len(got1), stats1.Delivered, want)
+	}
+
+	// The delays are drawn along with the losses, so a different seed
+	// gives a different outcome.
+	if got3, _ := runUDP(t, 2); bytes.Equal(got1, got3) {
+		t.Fatalf("got the same datagrams with different seeds: %v", got1)
+	}
+}
+
+func TestScriptedConditions(t *testing.T) {
+	n, a, b, l := newPair(t, 1, udp.ProtocolName)
+	n.At(time.Second, func() { l.SetDirectionalConditions(sim.Conditions{Down: true}, sim.Conditions{}) })
+	n.At(2*time.Second, func() { l.SetConditions(sim.Conditions{}) })
+
+	var wq waiter.Queue
+	rep, err := b.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer rep.Close()
+	if err := rep.Bind(tcpip.FullAddress{Addr: addrB, Port: port}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	sep, err := a.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer sep.Close()
+
+	// Send a datagram every 500ms, those sent while the link is down are
+	// lost.
+	to := tcpip.FullAddress{Addr: addrB, Port: port}
+	for i := 0; i < 6; i++ {
+		if _, _, err := sep.Write(tcpip.SlicePayload{byte(i)}, tcpip.WriteOptions{To: &to}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		n.Run(500 * time.Millisecond)
+	}
+	if got, want := n.Now(), 3*time.Second; got != want {
+		t.Fatalf("got Now() = %v, want %v", got, want)
+	}
+
+	var got []byte
+	for {
+		v, _, err := rep.Read(nil)
+		if err != nil {
+			break
+		}
+		got = append(got, v...)
+	}
+	if want := []byte{0, 1, 4, 5}; !bytes.Equal(got, want) {
+		t.Fatalf("got datagrams %v, want %v", got, want)
+	}
+}
+
+func TestTCPRecoveryUnderLoss(t *testing.T) {
+	n, a, b, l := newPair(t, 1, tcp.ProtocolName)
+	l.SetConditions(sim.Conditions{
+		Delay:  20 * time.Millisecond,
+		Jitter: 2 * time.Millisecond,
+		Loss:   0.05,
+	})
+
+	var lwq waiter.Queue
+	lep, err := b.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &lwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer lep.Close()
+	if err := lep.Bind(tcpip.FullAddress{Addr: addrB, Port: port}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := lep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	var cwq waiter.Queue
+	cep, err := a.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &cwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer cep.Close()
+	if err := cep.Connect(tcpip.FullAddress{Addr: addrB, Port: port}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("got Connect() = %v, want %s", err, tcpip.ErrConnectStarted)
+	}
+
+	var rep tcpip.Endpoint
+	for i := 0; rep == nil; i++ {
+		if i == 100 {
+			t.Fatalf("connection not accepted after %v", n.Now())
+		}
+		n.Run(100 * time.Millisecond)
+		rep, _, _ = lep.Accept(nil)
+	}
+	defer rep.Close()
+
+	data := make([]byte, 64<<10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	var written int
+	var got []byte
+	for i := 0; len(got) < len(data); i++ {
+		if i == 600 {
+			t.Fatalf("got %d bytes after %v, want %d", len(got), n.Now(), len(data))
+		}
+		if written < len(data) {
+			w, _, err := cep.Write(tcpip.SlicePayload(data[written:]), tcpip.WriteOptions{})
+			if err != nil && err != tcpip.ErrWouldBlock {
+				t.Fatalf("Write failed: %v", err)
+			}
+			written += int(w)
+		}
+		n.Run(100 * time.Millisecond)
+		for {
+			v, _, err := rep.Read(nil)
+			if err != nil {
+				break
+			}
+			got = append(got, v...)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got corrupted data")
+	}
+
+	forward, _ := l.Stats()
+	if forward.Dropped == 0 {
+		t.Fatalf("no packets were dropped, the test doesn't exercise recovery")
+	}
+	if got := a.Stats().TCP.Retransmits.Value(); got == 0 {
+		t.Fatalf("got %d retransmits, want some", got)
+	}
+}
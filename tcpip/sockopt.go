@@ -0,0 +1,319 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpip
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// A SockOptTable maps socket option types (e.g. BroadcastOption) to the
+// functions that get and set them on some kind of endpoint.
+//
+// Transport protocols consult their table from Endpoint.SetSockOpt and
+// Endpoint.GetSockOpt, so adding an option doesn't require growing those
+// methods' type switches. Embedders can also register options of their own
+// types in a protocol's table to make them available on its endpoints, either
+// with functions of their own or, with RegisterStored, as values held by each
+// endpoint.
+//
+// The zero value is an empty table, ready for use.
+type SockOptTable struct {
+	mu   sync.RWMutex
+	opts map[reflect.Type]sockOptFuncs
+}
+
+type sockOptFuncs struct {
+	get func(ep Endpoint, opt interface{}) *Error
+	set func(ep Endpoint, opt interface{}) *Error
+}
+
+// Register registers the functions that get and set options of the same type
+// as opt. get is passed a pointer to the option to fill in, and set the option
+// itself. Either may be nil if the option can't be read or written.
+//
+// Register panics if the type of opt is already registered.
+func (t *SockOptTable) Register(opt interface{}, get, set func(ep Endpoint, opt interface{}) *Error) {
+	typ := reflect.TypeOf(opt)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.opts[typ]; ok {
+		panic(fmt.Sprintf("socket option %v registered twice", typ))
+	}
+	if t.opts == nil {
+		t.opts = make(map[reflect.Type]sockOptFuncs)
+	}
+	t.opts[typ] = sockOptFuncs{get: get, set: set}
+}
+
+// RegisterInt registers an option whose type is an integer, like
+// SendBufferSizeOption.
+func (t *SockOptTable) RegisterInt(opt interface{}, get func(ep Endpoint) (int, *Error), set func(ep Endpoint, v int) *Error) {
+	if !isIntKind(reflect.TypeOf(opt).Kind()) {
+		panic(fmt.Sprintf("socket option %T isn't an integer", opt))
+	}
+
+	var g, s func(Endpoint, interface{}) *Error
+	if get != nil {
+		g = func(ep Endpoint, opt interface{}) *Error {
+			v, err := get(ep)
+			if err != nil {
+				return err
+			}
+			setInt(reflect.ValueOf(opt).Elem(), int64(v))
+			return nil
+		}
+	}
+	if set != nil {
+		s = func(ep Endpoint, opt interface{}) *Error {
+			return set(ep, int(getInt(reflect.ValueOf(opt))))
+		}
+	}
+	t.Register(opt, g, s)
+}
+
+// RegisterBool registers a boolean option. Its type is either a bool, like
+// MulticastLoopOption, or an integer where non-zero means true, like
+// BroadcastOption. Integer options are read as 0 or 1.
+func (t *SockOptTable) RegisterBool(opt interface{}, get func(ep Endpoint) (bool, *Error), set func(ep Endpoint, v bool) *Error) {
+	kind := reflect.TypeOf(opt).Kind()
+	if kind != reflect.Bool && !isIntKind(kind) {
+		panic(fmt.Sprintf("socket option %T isn't a bool or an integer", opt))
+	}
+
+	var g, s func(Endpoint, interface{}) *Error
+	if get != nil {
+		g = func(ep Endpoint, opt interface{}) *Error {
+			v, err := get(ep)
+			if err != nil {
+				return err
+			}
+			o := reflect.ValueOf(opt).Elem()
+			switch {
+			case kind == reflect.Bool:
+				o.SetBool(v)
+			case v:
+				setInt(o, 1)
+			default:
+				setInt(o, 0)
+			}
+			return nil
+		}
+	}
+	if set != nil {
+		s = func(ep Endpoint, opt interface{}) *Error {
+			o := reflect.ValueOf(opt)
+			if kind == reflect.Bool {
+				return set(ep, o.Bool())
+			}
+			return set(ep, getInt(o) != 0)
+		}
+	}
+	t.Register(opt, g, s)
+}
+
+// RegisterStored registers an option whose value is simply held by each
+// endpoint until it is read back, as embedders' options often are. Reading it
+// from an endpoint it was never set on returns opt. The endpoints of the table
+// must implement SockOptStorer.
+func (t *SockOptTable) RegisterStored(opt interface{}) {
+	typ := reflect.TypeOf(opt)
+	t.Register(opt, func(ep Endpoint, o interface{}) *Error {
+		s, ok := ep.(SockOptStorer)
+		if !ok {
+			return ErrUnknownProtocolOption
+		}
+		reflect.ValueOf(o).Elem().Set(reflect.ValueOf(s.SockOptStore().load(typ, opt)))
+		return nil
+	}, func(ep Endpoint, o interface{}) *Error {
+		s, ok := ep.(SockOptStorer)
+		if !ok {
+			return ErrUnknownProtocolOption
+		}
+		s.SockOptStore().store(typ, o)
+		return nil
+	})
+}
+
+// SockOptStore holds the values of the options registered with
+// SockOptTable.RegisterStored that were set on an endpoint.
+//
+// The zero value is an empty store, ready for use.
+type SockOptStore struct {
+	mu   sync.Mutex
+	vals map[reflect.Type]interface{}
+}
+
+// SockOptStorer is implemented by endpoints that hold stored options.
+type SockOptStorer interface {
+	// SockOptStore returns the store holding the endpoint's options.
+	SockOptStore() *SockOptStore
+}
+
+// load returns the value of the option of type typ, or def if it isn't set.
+func (s *SockOptStore) load(typ reflect.Type, def interface{}) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.vals[typ]; ok {
+		return v
+	}
+	return def
+}
+
+// store sets the value of the option of type typ to v.
+func (s *SockOptStore) store(typ reflect.Type, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.vals == nil {
+		s.vals = make(map[reflect.Type]interface{})
+	}
+	s.vals[typ] = v
+}
+
+// SetSockOpt sets opt on ep with the function registered for its type. It
+// returns ErrUnknownProtocolOption if there is none.
+func (t *SockOptTable) SetSockOpt(ep Endpoint, opt interface{}) *Error {
+	t.mu.RLock()
+	f := t.opts[reflect.TypeOf(opt)]
+	t.mu.RUnlock()
+
+	if f.set == nil {
+		return ErrUnknownProtocolOption
+	}
+	return f.set(ep, opt)
+}
+
+// GetSockOpt gets the option opt points to from ep, with the function
+// registered for its type. It returns ErrUnknownProtocolOption if there is
+// none.
+func (t *SockOptTable) GetSockOpt(ep Endpoint, opt interface{}) *Error {
+	typ := reflect.TypeOf(opt)
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		return ErrUnknownProtocolOption
+	}
+
+	t.mu.RLock()
+	f := t.opts[typ.Elem()]
+	t.mu.RUnlock()
+
+	if f.get == nil {
+		return ErrUnknownProtocolOption
+	}
+	return f.get(ep, opt)
+}
+
+// A SavedSockOpt is the value of a socket option saved by SockOptTable.Save.
+type SavedSockOpt struct {
+	// Type is the name of the type of the option, qualified by the path of
+	// its package.
+	Type string
+
+	// Value is the gob encoding of the value of the option.
+	Value []byte
+}
+
+// Save returns the values of the options of ep that the table can both get and
+// set, ordered by type, so that Restore can set them on another endpoint.
+// Options whose values gob can't encode, like those holding functions, are
+// left out.
+func (t *SockOptTable) Save(ep Endpoint) []SavedSockOpt {
+	t.mu.RLock()
+	var types []reflect.Type
+	for typ, f := range t.opts {
+		if f.get != nil && f.set != nil {
+			types = append(types, typ)
+		}
+	}
+	t.mu.RUnlock()
+
+	var saved []SavedSockOpt
+	for _, typ := range types {
+		v := reflect.New(typ)
+		if err := t.GetSockOpt(ep, v.Interface()); err != nil {
+			continue
+		}
+		var b bytes.Buffer
+		if err := gob.NewEncoder(&b).EncodeValue(v.Elem()); err != nil {
+			continue
+		}
+		saved = append(saved, SavedSockOpt{Type: sockOptTypeName(typ), Value: b.Bytes()})
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Type < saved[j].Type })
+	return saved
+}
+
+// Restore sets the options saved by Save on ep, in order. Options of types the
+// table doesn't hold are ignored.
+func (t *SockOptTable) Restore(ep Endpoint, saved []SavedSockOpt) *Error {
+	t.mu.RLock()
+	types := make(map[string]reflect.Type, len(t.opts))
+	for typ := range t.opts {
+		types[sockOptTypeName(typ)] = typ
+	}
+	t.mu.RUnlock()
+
+	for _, opt := range saved {
+		typ, ok := types[opt.Type]
+		if !ok {
+			continue
+		}
+		v := reflect.New(typ)
+		if err := gob.NewDecoder(bytes.NewReader(opt.Value)).DecodeValue(v); err != nil {
+			return ErrInvalidOptionValue
+		}
+		if err := t.SetSockOpt(ep, v.Elem().Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sockOptTypeName returns the name of typ, qualified by the path of its package.
+func sockOptTypeName(typ reflect.Type) string {
+	return typ.PkgPath() + "." + typ.Name()
+}
+
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func getInt(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint())
+	default:
+		return v.Int()
+	}
+}
+
+func setInt(v reflect.Value, i int64) {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(i))
+	default:
+		v.SetInt(i)
+	}
+}
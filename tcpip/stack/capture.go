@@ -0,0 +1,197 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+)
+
+// CaptureDirection selects the packets passed to a capture sink.
+type CaptureDirection int
+
+const (
+	// CaptureInbound selects the packets received by NICs.
+	CaptureInbound CaptureDirection = 1 << iota
+
+	// CaptureOutbound selects the packets sent through NICs.
+	CaptureOutbound
+
+	// CaptureBoth selects all packets.
+	CaptureBoth = CaptureInbound | CaptureOutbound
+)
+
+// CapturedPacket is a packet passed to a capture sink.
+type CapturedPacket struct {
+	// Timestamp is the time the packet was captured at, in nanoseconds
+	// since the Unix epoch, as given by the stack's clock.
+	Timestamp int64
+
+	// NIC is the NIC the packet was received from or sent through.
+	NIC tcpip.NICID
+
+	// NICName is the name of the NIC, which may be empty.
+	NICName string
+
+	// Inbound is set for received packets.
+	Inbound bool
+
+	// Protocol is the network protocol of the packet.
+	Protocol tcpip.NetworkProtocolNumber
+
+	// Data holds the packet, starting with its network header. It is only
+	// valid for the duration of the call to the sink and must be cloned
+	// to be kept.
+	Data buffer.VectorisedView
+}
+
+// CaptureSink is the function type of sinks passed to AddCapture.
+type CaptureSink func(CapturedPacket)
+
+// capture is a capture sink with the packets it selects.
+type capture struct {
+	id   int
+	nic  tcpip.NICID
+	dir  CaptureDirection
+	sink CaptureSink
+}
+
+// AddCapture registers sink to be passed the packets crossing the NIC with the
+// given ID, or all NICs if it is 0, in the given direction. Unlike sniffer
+// link endpoints, capture sinks can be added and removed at any time. The
+// returned function removes the sink.
+//
+// Sinks are called synchronously from the receive and transmit paths, so they
+// must not block nor call back into the stack.
+func (s *Stack) AddCapture(nic tcpip.NICID, dir CaptureDirection, sink CaptureSink) (remove func()) {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	id := s.nextCapture
+	s.nextCapture++
+	old, _ := s.captures.Load().([]capture)
+	// The slice is copied so that readers never see it change.
+	captures := append(old[:len(old):len(old)], capture{id: id, nic: nic, dir: dir, sink: sink})
+	s.captures.Store(captures)
+
+	return func() {
+		s.captureMu.Lock()
+		defer s.captureMu.Unlock()
+		old, _ := s.captures.Load().([]capture)
+		captures := make([]capture, 0, len(old))
+		for _, c := range old {
+			if c.id != id {
+				captures = append(captures, c)
+			}
+		}
+		s.captures.Store(captures)
+	}
+}
+
+// capturing reports whether any capture sink is registered.
+func (s *Stack) capturing() bool {
+	captures, _ := s.captures.Load().([]capture)
+	return len(captures) != 0
+}
+
+// capture passes a packet to the capture sinks that select it.
+func (n *NIC) capture(inbound bool, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	captures, _ := n.stack.captures.Load().([]capture)
+	if len(captures) == 0 {
+		return
+	}
+	dir := CaptureOutbound
+	if inbound {
+		dir = CaptureInbound
+	}
+	var p *CapturedPacket
+	for _, c := range captures {
+		if c.dir&dir == 0 || (c.nic != 0 && c.nic != n.id) {
+			continue
+		}
+		if p == nil {
+			p = &CapturedPacket{
+				Timestamp: n.stack.clock.NowNanoseconds(),
+				NIC:       n.id,
+				NICName:   n.name,
+				Inbound:   inbound,
+				Protocol:  protocol,
+				Data:      vv,
+			}
+		}
+		c.sink(*p)
+	}
+}
+
+// captureLinkEndpoint wraps the link endpoint of a NIC to pass the packets
+// written to it to the capture sinks. It is what network endpoints and link
+// address resolvers are given to write packets. It also queues the packets
+// whose next hop is being resolved, until it is.
+type captureLinkEndpoint struct {
+	LinkEndpoint
+	nic *NIC
+}
+
+// resolve returns a copy of r with the link address of its next hop, which
+// the caller hasn't resolved. If it's being resolved, a clone of the packet is
+// queued to be sent once it is, and nil is returned with a nil error.
+func (e *captureLinkEndpoint) resolve(r *Route, pkt *PacketBuffer, protocol tcpip.NetworkProtocolNumber) (*Route, *tcpip.Error) {
+	resolved := *r
+	nextAddr := r.NextHop
+	if nextAddr == "" {
+		if r.RemoteAddress == r.LocalAddress {
+			resolved.RemoteLinkAddress = r.LocalLinkAddress
+			return &resolved, nil
+		}
+		nextAddr = r.RemoteAddress
+	}
+
+	s := e.nic.stack
+	k := tcpip.FullAddress{NIC: e.nic.id, Addr: nextAddr}
+	linkAddr, err := s.linkAddrCache.getOrQueue(k, s.linkAddrResolvers[r.NetProto], r.LocalAddress, e, func() pendingPacket {
+		// The caller may reuse the packet's buffers once it returns.
+		return pendingPacket{
+			route:    r.Clone(),
+			pkt:      pkt.Clone(),
+			protocol: protocol,
+		}
+	})
+	switch err {
+	case nil:
+		resolved.RemoteLinkAddress = linkAddr
+		return &resolved, nil
+	case tcpip.ErrWouldBlock:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// WritePacket implements LinkEndpoint.WritePacket.
+func (e *captureLinkEndpoint) WritePacket(r *Route, pkt *PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	if e.nic.loopback && r != nil && e.nic.stack.LoopbackFastPath() {
+		return e.nic.deliverLoopback(r, pkt, protocol)
+	}
+	if r != nil && r.ref != nil && r.IsResolutionRequired() {
+		resolved, err := e.resolve(r, pkt, protocol)
+		if resolved == nil {
+			return err
+		}
+		r = resolved
+	}
+	if e.nic.stack.capturing() {
+		e.nic.capture(false /* inbound */, protocol, pkt.ToVectorisedView())
+	}
+	return e.LinkEndpoint.WritePacket(r, pkt, protocol)
+}
@@ -0,0 +1,581 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/waiter"
+)
+
+// Checkpoint is a snapshot of the state of a stack, taken by Stack.Checkpoint
+// and restored into a fresh stack by Stack.Restore. It can be serialized with
+// Encode and DecodeCheckpoint.
+//
+// Checkpoints hold the NICs of the stack with their addresses, subnets, flags,
+// VRFs, host models and static neighbors, the route table, the multicast
+// forwarding cache, the destination NAT rules, but not the flows they
+// translated, the host models of the stack and the forwarding setting, and
+// the transport endpoints given to Stack.Checkpoint with their queued data
+// and pending timers.
+type Checkpoint struct {
+	NICs            []NICCheckpoint
+	Routes          []tcpip.Route
+	MulticastRoutes []MulticastRouteCheckpoint
+	NATRules        []NATRuleCheckpoint
+	Forwarding      bool
+
+	ReceiveHostModel HostModel
+	SendHostModel    HostModel
+
+	// Endpoints are the transport endpoints, in the order they were given
+	// to Stack.Checkpoint.
+	Endpoints []EndpointCheckpoint
+}
+
+// EndpointCheckpoint is the state of a transport endpoint held in a
+// Checkpoint. State is in a format private to the transport protocol, which
+// restores it with EndpointRestorer.RestoreEndpoint.
+type EndpointCheckpoint struct {
+	TransportProtocol tcpip.TransportProtocolNumber
+	NetworkProtocol   tcpip.NetworkProtocolNumber
+	State             []byte
+}
+
+// CheckpointableEndpoint is a transport endpoint whose state can be held in a
+// Checkpoint.
+type CheckpointableEndpoint interface {
+	tcpip.Endpoint
+
+	// Checkpoint returns the state of the endpoint, which keeps running.
+	// It returns a tcpip.ErrSaveRejection if the endpoint is in a state
+	// that can't be checkpointed.
+	Checkpoint() (EndpointCheckpoint, error)
+}
+
+// EndpointRestorer is implemented by the transport protocols whose endpoints
+// are CheckpointableEndpoints.
+type EndpointRestorer interface {
+	// RestoreEndpoint returns a new endpoint of s in the state held in c,
+	// which notifies waiterQueue of its readiness.
+	RestoreEndpoint(s *Stack, c EndpointCheckpoint, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error)
+}
+
+// NICCheckpoint is the state of a NIC held in a Checkpoint.
+type NICCheckpoint struct {
+	ID          tcpip.NICID
+	Name        string
+	Enabled     bool
+	Loopback    bool
+	Up          bool
+	Promiscuous bool
+	Spoofing    bool
+	Transparent bool
+	MTU         uint32
+	VRF         tcpip.VRFID
+
+	ReceiveHostModel HostModel
+	SendHostModel    HostModel
+
+	// Addresses are the addresses of the NIC, in the order they are to be
+	// added to preserve which one is primary.
+	Addresses []AddressCheckpoint
+
+	Subnets []SubnetCheckpoint
+
+	// Neighbors are the static entries of the neighbor cache of the NIC.
+	Neighbors []NeighborCheckpoint
+}
+
+// AddressCheckpoint is an address of a NIC held in a Checkpoint.
+type AddressCheckpoint struct {
+	Protocol tcpip.NetworkProtocolNumber
+	Address  tcpip.Address
+	Behavior PrimaryEndpointBehavior
+
+	// Anycast is set for the addresses added with AddAnycastAddress.
+	Anycast bool
+}
+
+// SubnetCheckpoint is a subnet of a NIC held in a Checkpoint.
+type SubnetCheckpoint struct {
+	Address tcpip.Address
+	Mask    tcpip.AddressMask
+}
+
+// NATRuleCheckpoint is a destination NAT rule held in a Checkpoint, see
+// NATRule.
+type NATRuleCheckpoint struct {
+	NIC             tcpip.NICID
+	Protocol        tcpip.TransportProtocolNumber
+	Destination     SubnetCheckpoint
+	DestinationPort uint16
+	ToAddress       tcpip.Address
+	ToPort          uint16
+}
+
+// NeighborCheckpoint is a static neighbor of a NIC held in a Checkpoint.
+type NeighborCheckpoint struct {
+	Address     tcpip.Address
+	LinkAddress tcpip.LinkAddress
+}
+
+// MulticastRouteCheckpoint is an entry of the multicast forwarding cache held
+// in a Checkpoint.
+type MulticastRouteCheckpoint struct {
+	Source tcpip.Address
+	Group  tcpip.Address
+	Route  MulticastRoute
+}
+
+// Encode writes c to w in a portable binary format.
+func (c *Checkpoint) Encode(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(c)
+}
+
+// DecodeCheckpoint reads a checkpoint written by Checkpoint.Encode from r.
+func DecodeCheckpoint(r io.Reader) (*Checkpoint, error) {
+	var c Checkpoint
+	if err := gob.NewDecoder(r).Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Checkpoint returns a snapshot of the state of the stack and of eps, which
+// must be CheckpointableEndpoints of the stack. The endpoints registered with
+// the stack that aren't given are left out, like the connections a listening
+// endpoint holds until they are accepted, which are saved along with it.
+//
+// It returns a tcpip.ErrSaveRejection if the stack holds state that can't be
+// checkpointed, like endpoints that aren't CheckpointableEndpoints.
+func (s *Stack) Checkpoint(eps ...tcpip.Endpoint) (*Checkpoint, error) {
+	for _, ep := range s.registeredEndpoints() {
+		if _, ok := ep.(CheckpointableEndpoint); !ok {
+			return nil, tcpip.ErrSaveRejection{Err: fmt.Errorf("endpoint %T can't be checkpointed", ep)}
+		}
+	}
+	c := s.Configuration()
+	for _, ep := range eps {
+		cep, ok := ep.(CheckpointableEndpoint)
+		if !ok {
+			return nil, tcpip.ErrSaveRejection{Err: fmt.Errorf("endpoint %T can't be checkpointed", ep)}
+		}
+		ec, err := cep.Checkpoint()
+		if err != nil {
+			return nil, err
+		}
+		c.Endpoints = append(c.Endpoints, ec)
+	}
+	return c, nil
+}
+
+// registeredEndpoints returns the transport endpoints registered with the
+// stack.
+func (s *Stack) registeredEndpoints() []TransportEndpoint {
+	s.vrfMu.Lock()
+	demuxes := []*transportDemuxer{s.demux}
+	for _, v := range s.vrfs {
+		demuxes = append(demuxes, v.demux)
+	}
+	s.vrfMu.Unlock()
+
+	s.mu.RLock()
+	for _, nic := range s.nics {
+		demuxes = append(demuxes, nic.demux)
+	}
+	s.mu.RUnlock()
+
+	var eps []TransportEndpoint
+	seen := make(map[TransportEndpoint]struct{})
+	for _, d := range demuxes {
+		d.forEachEndpoint(func(_ protocolIDs, _ TransportEndpointID, ep TransportEndpoint, _ bool) {
+			if _, ok := seen[ep]; !ok {
+				seen[ep] = struct{}{}
+				eps = append(eps, ep)
+			}
+		})
+	}
+	return eps
+}
+
+// Configuration returns the part of a checkpoint of the stack that doesn't
+// depend on its transport endpoints: all of it but the endpoints themselves.
+// Unlike Checkpoint, it can be called whatever endpoints are registered.
+func (s *Stack) Configuration() *Checkpoint {
+	s.mu.RLock()
+	c := &Checkpoint{
+		Routes:     append([]tcpip.Route(nil), s.routeTable...),
+		Forwarding: s.forwarding,
+	}
+	c.ReceiveHostModel, c.SendHostModel = s.HostModel()
+	for _, nic := range s.nics {
+		c.NICs = append(c.NICs, nic.checkpoint())
+	}
+	for k, route := range s.multicastRoutes {
+		route.Outputs = append([]MulticastOutput(nil), route.Outputs...)
+		c.MulticastRoutes = append(c.MulticastRoutes, MulticastRouteCheckpoint{Source: k.source, Group: k.group, Route: route})
+	}
+	s.mu.RUnlock()
+
+	for _, r := range s.NATRules() {
+		c.NATRules = append(c.NATRules, NATRuleCheckpoint{
+			NIC:      r.NIC,
+			Protocol: r.Protocol,
+			Destination: SubnetCheckpoint{
+				Address: r.Destination.ID(),
+				Mask:    r.Destination.Mask(),
+			},
+			DestinationPort: r.DestinationPort,
+			ToAddress:       r.ToAddress,
+			ToPort:          r.ToPort,
+		})
+	}
+
+	sort.Slice(c.NICs, func(i, j int) bool { return c.NICs[i].ID < c.NICs[j].ID })
+	sort.Slice(c.MulticastRoutes, func(i, j int) bool {
+		if c.MulticastRoutes[i].Group != c.MulticastRoutes[j].Group {
+			return c.MulticastRoutes[i].Group < c.MulticastRoutes[j].Group
+		}
+		return c.MulticastRoutes[i].Source < c.MulticastRoutes[j].Source
+	})
+
+	// The neighbor cache may send packets once it's unlocked, so it must
+	// not be read with s.mu held.
+	for i := range c.NICs {
+		nc := &c.NICs[i]
+		for _, e := range s.linkAddrCache.entriesOf(nc.ID) {
+			if e.State == NeighborPermanent {
+				nc.Neighbors = append(nc.Neighbors, NeighborCheckpoint{Address: e.Addr, LinkAddress: e.LinkAddr})
+			}
+		}
+		sort.Slice(nc.Neighbors, func(i, j int) bool { return nc.Neighbors[i].Address < nc.Neighbors[j].Address })
+	}
+	return c
+}
+
+// checkpoint returns the state of the NIC.
+func (n *NIC) checkpoint() NICCheckpoint {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	c := NICCheckpoint{
+		ID:          n.id,
+		Name:        n.name,
+		Enabled:     n.linkEP.IsAttached(),
+		Loopback:    n.loopback,
+		Up:          n.up,
+		Promiscuous: n.promiscuous,
+		Spoofing:    n.spoofing,
+		Transparent: n.transparent,
+		MTU:         n.linkEP.MTU(),
+		VRF:         n.vrf,
+
+		ReceiveHostModel: n.rcvHostModel,
+		SendHostModel:    n.sndHostModel,
+	}
+
+	// Primary addresses are listed first, in order of preference, so
+	// that adding them back in order restores the preference.
+	primary := make(map[*referencedNetworkEndpoint]bool)
+	protos := make([]tcpip.NetworkProtocolNumber, 0, len(n.primary))
+	for proto := range n.primary {
+		protos = append(protos, proto)
+	}
+	sort.Slice(protos, func(i, j int) bool { return protos[i] < protos[j] })
+	for _, proto := range protos {
+		for e := n.primary[proto].Front(); e != nil; e = e.Next() {
+			r := e.(*referencedNetworkEndpoint)
+			if !r.holdsInsertRef {
+				continue
+			}
+			primary[r] = true
+			c.Addresses = append(c.Addresses, AddressCheckpoint{
+				Protocol: r.protocol,
+				Address:  r.ep.ID().LocalAddress,
+				Behavior: CanBePrimaryEndpoint,
+			})
+		}
+	}
+	var others []AddressCheckpoint
+	for id, r := range n.endpoints {
+		if !r.holdsInsertRef || primary[r] {
+			continue
+		}
+		others = append(others, AddressCheckpoint{
+			Protocol: r.protocol,
+			Address:  id.LocalAddress,
+			Behavior: NeverPrimaryEndpoint,
+			Anycast:  r.anycast,
+		})
+	}
+	sort.Slice(others, func(i, j int) bool {
+		if others[i].Protocol != others[j].Protocol {
+			return others[i].Protocol < others[j].Protocol
+		}
+		return others[i].Address < others[j].Address
+	})
+	c.Addresses = append(c.Addresses, others...)
+
+	for _, sn := range n.subnets {
+		c.Subnets = append(c.Subnets, SubnetCheckpoint{
+			Address: sn.ID(),
+			Mask:    sn.Mask(),
+		})
+	}
+	return c
+}
+
+// Restore restores the state held in c into the stack. links gives the link
+// endpoint of each NIC of the checkpoint, and waiterQueues the waiter queue of
+// each of its endpoints, as they are provided by the caller and can't be
+// checkpointed. It returns the restored endpoints, in the order of
+// c.Endpoints.
+//
+// The checkpoint is checked before anything is restored, and if restoring it
+// still fails, the NICs created so far are removed and the endpoints closed,
+// and the routes, NAT rules and other stack-wide settings are set back, so
+// that the stack is left as it was.
+func (s *Stack) Restore(c *Checkpoint, links map[tcpip.NICID]tcpip.LinkEndpointID, waiterQueues []*waiter.Queue) ([]tcpip.Endpoint, *tcpip.Error) {
+	settings, err := s.checkCheckpoint(c, links, waiterQueues)
+	if err != nil {
+		return nil, err
+	}
+
+	var nics []tcpip.NICID
+	for _, nc := range c.NICs {
+		nics = append(nics, nc.ID)
+		if err := s.restoreNIC(nc, links[nc.ID]); err != nil {
+			s.removeRestoredNICs(nics)
+			return nil, err
+		}
+	}
+
+	old := s.swapSettings(settings)
+
+	eps := make([]tcpip.Endpoint, 0, len(c.Endpoints))
+	for i, ec := range c.Endpoints {
+		ep, err := s.transportProtocols[ec.TransportProtocol].proto.(EndpointRestorer).RestoreEndpoint(s, ec, waiterQueues[i])
+		if err != nil {
+			for _, ep := range eps {
+				ep.Close()
+			}
+			s.swapSettings(old)
+			s.removeRestoredNICs(nics)
+			return nil, err
+		}
+		eps = append(eps, ep)
+	}
+	return eps, nil
+}
+
+// stackSettings are the stack-wide settings restored from a checkpoint, which
+// are replaced all at once.
+type stackSettings struct {
+	routes          []tcpip.Route
+	multicastRoutes map[multicastRouteKey]MulticastRoute
+	natRules        []NATRule
+	forwarding      bool
+
+	rcvHostModel HostModel
+	sndHostModel HostModel
+}
+
+// checkCheckpoint checks that c can be restored into the stack with the given
+// links and waiter queues, and returns the stack-wide settings it holds.
+func (s *Stack) checkCheckpoint(c *Checkpoint, links map[tcpip.NICID]tcpip.LinkEndpointID, waiterQueues []*waiter.Queue) (stackSettings, *tcpip.Error) {
+	st := stackSettings{
+		routes:       append([]tcpip.Route(nil), c.Routes...),
+		forwarding:   c.Forwarding,
+		rcvHostModel: c.ReceiveHostModel,
+		sndHostModel: c.SendHostModel,
+	}
+
+	nics := make(map[tcpip.NICID]bool)
+	s.mu.RLock()
+	for id := range s.nics {
+		nics[id] = true
+	}
+	s.mu.RUnlock()
+	for _, nc := range c.NICs {
+		if nics[nc.ID] {
+			return st, tcpip.ErrDuplicateNICID
+		}
+		nics[nc.ID] = true
+		if linkEP, ok := links[nc.ID]; !ok || FindLinkEndpoint(linkEP) == nil {
+			return st, tcpip.ErrBadLinkEndpoint
+		}
+		for _, sc := range nc.Subnets {
+			if _, err := tcpip.NewSubnet(sc.Address, sc.Mask); err != nil {
+				return st, tcpip.ErrBadAddress
+			}
+		}
+	}
+
+	for _, mr := range c.MulticastRoutes {
+		if !header.IsV4MulticastAddress(mr.Group) && !header.IsV6MulticastAddress(mr.Group) {
+			return st, tcpip.ErrBadAddress
+		}
+		if mr.Source != "" && (len(mr.Source) != len(mr.Group) || header.IsV4MulticastAddress(mr.Source) || header.IsV6MulticastAddress(mr.Source)) {
+			return st, tcpip.ErrBadAddress
+		}
+		if mr.Route.InputNIC != 0 && !nics[mr.Route.InputNIC] {
+			return st, tcpip.ErrUnknownNICID
+		}
+		for _, out := range mr.Route.Outputs {
+			if !nics[out.NIC] {
+				return st, tcpip.ErrUnknownNICID
+			}
+		}
+		if st.multicastRoutes == nil {
+			st.multicastRoutes = make(map[multicastRouteKey]MulticastRoute)
+		}
+		route := mr.Route
+		route.Outputs = append([]MulticastOutput(nil), route.Outputs...)
+		st.multicastRoutes[multicastRouteKey{mr.Source, mr.Group}] = route
+	}
+
+	for _, rc := range c.NATRules {
+		sn, err := tcpip.NewSubnet(rc.Destination.Address, rc.Destination.Mask)
+		if err != nil {
+			return st, tcpip.ErrBadAddress
+		}
+		if rc.Protocol != header.TCPProtocolNumber && rc.Protocol != header.UDPProtocolNumber {
+			return st, tcpip.ErrUnknownProtocol
+		}
+		if rc.ToAddress != "" && len(rc.ToAddress) != len(sn.ID()) {
+			return st, tcpip.ErrBadAddress
+		}
+		st.natRules = append(st.natRules, NATRule{
+			NIC:             rc.NIC,
+			Protocol:        rc.Protocol,
+			Destination:     sn,
+			DestinationPort: rc.DestinationPort,
+			ToAddress:       rc.ToAddress,
+			ToPort:          rc.ToPort,
+		})
+	}
+
+	if len(waiterQueues) != len(c.Endpoints) {
+		return st, tcpip.ErrInvalidOptionValue
+	}
+	for _, ec := range c.Endpoints {
+		t, ok := s.transportProtocols[ec.TransportProtocol]
+		if !ok {
+			return st, tcpip.ErrUnknownProtocol
+		}
+		if _, ok := t.proto.(EndpointRestorer); !ok {
+			return st, tcpip.ErrNotSupported
+		}
+		if _, ok := s.networkProtocols[ec.NetworkProtocol]; !ok {
+			return st, tcpip.ErrUnknownProtocol
+		}
+	}
+	return st, nil
+}
+
+// restoreNIC creates the NIC held in nc, with linkEP as link endpoint.
+func (s *Stack) restoreNIC(nc NICCheckpoint, linkEP tcpip.LinkEndpointID) *tcpip.Error {
+	if err := s.createNIC(nc.ID, nc.Name, linkEP, nc.Enabled, nc.Loopback); err != nil {
+		return err
+	}
+	if nc.VRF != tcpip.DefaultVRF {
+		if err := s.SetNICVRF(nc.ID, nc.VRF); err != nil {
+			return err
+		}
+	}
+	if err := s.SetNICHostModel(nc.ID, nc.ReceiveHostModel, nc.SendHostModel); err != nil {
+		return err
+	}
+	if nc.MTU != FindLinkEndpoint(linkEP).MTU() {
+		if err := s.SetNICMTU(nc.ID, nc.MTU); err != nil && err != tcpip.ErrNotSupported {
+			return err
+		}
+	}
+	if err := s.SetNICUp(nc.ID, nc.Up); err != nil {
+		return err
+	}
+	if err := s.SetPromiscuousMode(nc.ID, nc.Promiscuous); err != nil {
+		return err
+	}
+	if err := s.SetSpoofing(nc.ID, nc.Spoofing); err != nil {
+		return err
+	}
+	if err := s.SetTransparent(nc.ID, nc.Transparent); err != nil {
+		return err
+	}
+	for _, a := range nc.Addresses {
+		var err *tcpip.Error
+		if a.Anycast {
+			err = s.AddAnycastAddress(nc.ID, a.Protocol, a.Address)
+		} else {
+			err = s.AddAddressWithOptions(nc.ID, a.Protocol, a.Address, a.Behavior)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, sc := range nc.Subnets {
+		// The subnet was checked by checkCheckpoint.
+		sn, _ := tcpip.NewSubnet(sc.Address, sc.Mask)
+		if err := s.AddSubnet(nc.ID, 0, sn); err != nil {
+			return err
+		}
+	}
+	for _, n := range nc.Neighbors {
+		if err := s.AddStaticNeighbor(nc.ID, n.Address, n.LinkAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRestoredNICs removes the NICs with the given IDs that Restore created,
+// leaving their link endpoints open as they belong to the caller.
+func (s *Stack) removeRestoredNICs(ids []tcpip.NICID) {
+	for _, id := range ids {
+		s.removeNIC(id)
+	}
+}
+
+// swapSettings replaces the stack-wide settings of the stack with st, and
+// returns the ones it replaced.
+func (s *Stack) swapSettings(st stackSettings) stackSettings {
+	old := stackSettings{natRules: s.NATRules()}
+	old.rcvHostModel, old.sndHostModel = s.HostModel()
+
+	s.mu.Lock()
+	old.routes, s.routeTable = s.routeTable, st.routes
+	old.multicastRoutes, s.multicastRoutes = s.multicastRoutes, st.multicastRoutes
+	old.forwarding, s.forwarding = s.forwarding, st.forwarding
+	s.redirects = nil
+	s.invalidateRoutes()
+	s.mu.Unlock()
+
+	t := s.nat
+	t.mu.Lock()
+	t.rules = st.natRules
+	t.updateInUseLocked()
+	t.mu.Unlock()
+
+	s.SetHostModel(st.rcvHostModel, st.sndHostModel)
+	s.publish(Event{Type: EventRoutesChanged, Routes: append([]tcpip.Route(nil), st.routes...)})
+	return old
+}
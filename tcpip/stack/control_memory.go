@@ -0,0 +1,54 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"sync/atomic"
+)
+
+// DefaultControlMemoryMax is the default control memory of an endpoint. It is
+// the default of Linux's net.core.optmem_max.
+const DefaultControlMemoryMax = 20480
+
+// SetControlMemoryMax sets the control memory each endpoint may use, like
+// Linux's net.core.optmem_max. It bounds the ancillary data endpoints queue
+// besides their receive buffer, like the entries of their error queue, see
+// tcpip.SockError.ControlSize: once an endpoint used it up, further entries are
+// dropped until some are read. Values lower than 1 are ignored.
+func (s *Stack) SetControlMemoryMax(n int) {
+	if n < 1 {
+		return
+	}
+	if n > int(^uint32(0)>>1) {
+		n = int(^uint32(0) >> 1)
+	}
+	atomic.StoreInt32(&s.controlMemoryMax, int32(n))
+}
+
+// ControlMemoryMax returns the control memory each endpoint may use.
+func (s *Stack) ControlMemoryMax() int {
+	return int(atomic.LoadInt32(&s.controlMemoryMax))
+}
+
+// ChargeControlMemory returns whether an endpoint that uses used bytes of
+// control memory may queue size more. If not, the entry is counted in
+// ControlMemoryErrors and must be dropped.
+func (s *Stack) ChargeControlMemory(used, size int) bool {
+	if used+size > s.ControlMemoryMax() {
+		s.stats.ControlMemoryErrors.Increment()
+		return false
+	}
+	return true
+}
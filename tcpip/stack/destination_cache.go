@@ -0,0 +1,194 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	// maxDestinations is the maximum number of destinations whose metrics
+	// are cached at once.
+	maxDestinations = 1024
+
+	// destinationExpiration is how long the metrics of a destination are
+	// kept after their last update, the same as the default
+	// mtu_expires of Linux.
+	destinationExpiration = 10 * time.Minute
+)
+
+// DestinationMetrics holds the properties of the path to a remote address
+// learned from past traffic. They are shared by all the connections to the
+// address, so that new ones can start with better parameters than the
+// defaults.
+type DestinationMetrics struct {
+	// PathMTU is the smallest MTU reported by ICMP packet too big errors
+	// on the path, as a network-layer payload size like Route.MTU. It is
+	// zero if unknown.
+	PathMTU uint32
+
+	// SRTT and RTTVar are the smoothed round-trip time and its variation,
+	// as measured by past connections. They are zero if unknown.
+	SRTT   time.Duration
+	RTTVar time.Duration
+
+	// Reachable is whether the last attempt to connect to the destination
+	// succeeded. It is only meaningful if HasReachable is set.
+	HasReachable bool
+	Reachable    bool
+}
+
+// destination is an entry of the destination cache.
+type destination struct {
+	metrics DestinationMetrics
+
+	// updated is the monotonic time of the last update.
+	updated int64
+}
+
+// destinationCache holds the metrics of recently used destinations.
+//
+// This struct is safe for concurrent use.
+type destinationCache struct {
+	clock tcpip.Clock
+
+	mu    sync.Mutex
+	dests map[tcpip.Address]*destination
+}
+
+func newDestinationCache(clock tcpip.Clock) *destinationCache {
+	return &destinationCache{
+		clock: clock,
+		dests: make(map[tcpip.Address]*destination),
+	}
+}
+
+// get returns the metrics of addr, if they are cached and not expired.
+func (c *destinationCache) get(addr tcpip.Address) (DestinationMetrics, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d := c.dests[addr]
+	if d == nil {
+		return DestinationMetrics{}, false
+	}
+	if c.expired(d, c.clock.NowMonotonic()) {
+		delete(c.dests, addr)
+		return DestinationMetrics{}, false
+	}
+	return d.metrics, true
+}
+
+// update calls f with the metrics of addr, starting from empty metrics if
+// they aren't cached or have expired.
+func (c *destinationCache) update(addr tcpip.Address, f func(*DestinationMetrics)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.NowMonotonic()
+	d := c.dests[addr]
+	if d == nil || c.expired(d, now) {
+		if d == nil && len(c.dests) >= maxDestinations {
+			c.evictLocked(now)
+		}
+		d = &destination{}
+		c.dests[addr] = d
+	}
+	f(&d.metrics)
+	d.updated = now
+}
+
+// flush forgets all the destinations.
+func (c *destinationCache) flush() {
+	c.mu.Lock()
+	c.dests = make(map[tcpip.Address]*destination)
+	c.mu.Unlock()
+}
+
+func (c *destinationCache) expired(d *destination, now int64) bool {
+	return time.Duration(now-d.updated) >= destinationExpiration
+}
+
+// evictLocked makes room for a new destination. Expired destinations are
+// forgotten, or an arbitrary one if none is.
+//
+// Precondition: c.mu must be held.
+func (c *destinationCache) evictLocked(now int64) {
+	for addr, d := range c.dests {
+		if c.expired(d, now) {
+			delete(c.dests, addr)
+		}
+	}
+	if len(c.dests) < maxDestinations {
+		return
+	}
+	for addr := range c.dests {
+		delete(c.dests, addr)
+		return
+	}
+}
+
+// DestinationMetrics returns the metrics learned for the remote address addr,
+// and whether any are. Metrics expire 10 minutes after their last update.
+func (s *Stack) DestinationMetrics(addr tcpip.Address) (DestinationMetrics, bool) {
+	return s.destinationCache.get(addr)
+}
+
+// UpdatePathMTU lowers the path MTU of addr to mtu, a network-layer payload
+// size. It is called when an ICMP packet too big error is received, and only
+// increases again once the metrics of addr expire.
+func (s *Stack) UpdatePathMTU(addr tcpip.Address, mtu uint32) {
+	s.destinationCache.update(addr, func(m *DestinationMetrics) {
+		if m.PathMTU == 0 || mtu < m.PathMTU {
+			m.PathMTU = mtu
+		}
+	})
+}
+
+// UpdateDestinationRTT records the smoothed round-trip time and its variation
+// measured by a connection to addr, typically when it ends. Like Linux, a
+// larger RTT replaces the cached one right away, while a smaller one is only
+// blended in, as overestimating the RTT is safer than underestimating it.
+func (s *Stack) UpdateDestinationRTT(addr tcpip.Address, srtt, rttvar time.Duration) {
+	s.destinationCache.update(addr, func(m *DestinationMetrics) {
+		if m.SRTT == 0 || srtt > m.SRTT {
+			m.SRTT = srtt
+		} else {
+			m.SRTT -= (m.SRTT - srtt) / 8
+		}
+		if m.RTTVar == 0 || rttvar > m.RTTVar {
+			m.RTTVar = rttvar
+		} else {
+			m.RTTVar -= (m.RTTVar - rttvar) / 4
+		}
+	})
+}
+
+// SetDestinationReachable records whether the last attempt to connect to addr
+// succeeded.
+func (s *Stack) SetDestinationReachable(addr tcpip.Address, reachable bool) {
+	s.destinationCache.update(addr, func(m *DestinationMetrics) {
+		m.HasReachable = true
+		m.Reachable = reachable
+	})
+}
+
+// FlushDestinationCache forgets the metrics of all destinations.
+func (s *Stack) FlushDestinationCache() {
+	s.destinationCache.flush()
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"fmt"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// EventType is the type of an Event.
+type EventType int
+
+// The following are the types of the events published by the stack.
+const (
+	// EventNICAdded is published when a NIC is created, and
+	// EventNICRemoved when it's removed. The addresses of a removed NIC
+	// aren't published as removed.
+	EventNICAdded EventType = iota
+	EventNICRemoved
+
+	// EventNICUp and EventNICDown are published when the operational state
+	// of a NIC changes, like LinkStateEvent.
+	EventNICUp
+	EventNICDown
+
+	// EventAddressAdded and EventAddressRemoved are published when an
+	// address is added to or removed from a NIC.
+	EventAddressAdded
+	EventAddressRemoved
+
+	// EventRoutesChanged is published when the route table changes, either
+	// because it was set or because the routes of a removed NIC were
+	// dropped. The host routes installed by ICMP redirects aren't
+	// published.
+	EventRoutesChanged
+
+	// EventNeighborResolved is published when the link address of a
+	// neighbor is learned or changes, and EventNeighborLost when it
+	// couldn't be resolved or its entry was removed.
+	EventNeighborResolved
+	EventNeighborLost
+)
+
+// String implements fmt.Stringer.
+func (t EventType) String() string {
+	switch t {
+	case EventNICAdded:
+		return "NICAdded"
+	case EventNICRemoved:
+		return "NICRemoved"
+	case EventNICUp:
+		return "NICUp"
+	case EventNICDown:
+		return "NICDown"
+	case EventAddressAdded:
+		return "AddressAdded"
+	case EventAddressRemoved:
+		return "AddressRemoved"
+	case EventRoutesChanged:
+		return "RoutesChanged"
+	case EventNeighborResolved:
+		return "NeighborResolved"
+	case EventNeighborLost:
+		return "NeighborLost"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event describes a change of the state of the stack. The fields that don't
+// apply to its Type are zero.
+type Event struct {
+	// Type is the type of the event.
+	Type EventType
+
+	// NIC is the NIC the event is about. It is zero for EventRoutesChanged.
+	NIC tcpip.NICID
+
+	// Protocol and Address are the network protocol and address of an
+	// address event. Address is also the address of the neighbor of a
+	// neighbor event.
+	Protocol tcpip.NetworkProtocolNumber
+	Address  tcpip.Address
+
+	// LinkAddress is the link address of the neighbor of an
+	// EventNeighborResolved.
+	LinkAddress tcpip.LinkAddress
+
+	// Routes is the new route table of an EventRoutesChanged. It must not
+	// be modified.
+	Routes []tcpip.Route
+}
+
+// Subscribe registers h to be called with the events published when NICs are
+// added, removed, go up or down, when addresses are added or removed, when the
+// route table changes and when neighbors are resolved or lost, so that
+// management planes can follow the state of the stack without polling it. h is
+// called synchronously, in the order the changes were made, without any stack
+// locks held; it must not block. The returned function removes the
+// subscription.
+func (s *Stack) Subscribe(h func(Event)) (cancel func()) {
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+	if s.eventHandlers == nil {
+		s.eventHandlers = make(map[int]func(Event))
+	}
+	id := s.nextEventHandler
+	s.nextEventHandler++
+	s.eventHandlers[id] = h
+	return func() {
+		s.eventMu.Lock()
+		delete(s.eventHandlers, id)
+		s.eventMu.Unlock()
+	}
+}
+
+// publish calls the event subscribers with e.
+func (s *Stack) publish(e Event) {
+	s.eventMu.Lock()
+	handlers := make([]func(Event), 0, len(s.eventHandlers))
+	for _, h := range s.eventHandlers {
+		handlers = append(handlers, h)
+	}
+	s.eventMu.Unlock()
+
+	for _, h := range handlers {
+		h(e)
+	}
+}
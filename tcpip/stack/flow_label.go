@@ -0,0 +1,58 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/network/hash"
+)
+
+// SetAutoFlowLabels enables or disables the generation of flow labels for the
+// IPv6 packets sent by transport endpoints that don't set one explicitly. It
+// is disabled by default.
+func (s *Stack) SetAutoFlowLabels(enable bool) {
+	var v uint32
+	if enable {
+		v = 1
+	}
+	atomic.StoreUint32(&s.autoFlowLabels, v)
+}
+
+// AutoFlowLabels returns whether flow labels are generated for IPv6 flows.
+func (s *Stack) AutoFlowLabels() bool {
+	return atomic.LoadUint32(&s.autoFlowLabels) != 0
+}
+
+// FlowLabel returns the flow label of the IPv6 packets of the flow of a
+// transport endpoint with the given ID, or zero if automatic flow labels are
+// disabled.
+//
+// As recommended by RFC 6437 section 3, the label is a keyed hash of the
+// flow's addresses, ports and protocol: it is the same for all the packets of
+// a flow, but can't be predicted by off-path attackers. It is never zero,
+// which would mean that the flow isn't labeled.
+func (s *Stack) FlowLabel(protocol tcpip.TransportProtocolNumber, id TransportEndpointID) uint32 {
+	if !s.AutoFlowLabels() {
+		return 0
+	}
+	l := hash.TupleHash(id.LocalAddress, id.RemoteAddress, protocol, id.LocalPort, id.RemotePort, s.flowLabelSeed) & header.IPv6FlowLabelMask
+	if l == 0 {
+		l = 1
+	}
+	return l
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// HostModel selects between the strict and weak host models of RFC 1122
+// section 3.3.4.2, which decide whether the addresses of a NIC can be used
+// through another NIC.
+type HostModel uint32
+
+const (
+	// HostModelInherit makes a NIC use the host model of the stack. For the
+	// stack itself, it is the same as HostModelStrict.
+	HostModelInherit HostModel = iota
+
+	// HostModelStrict only accepts the packets received by a NIC that are
+	// destined to its own addresses, and only sends packets out of a NIC
+	// from its own addresses.
+	HostModelStrict
+
+	// HostModelWeak accepts the packets received by a NIC that are
+	// destined to the addresses of any NIC of its VRF, and sends packets
+	// out of a NIC from any of them.
+	HostModelWeak
+)
+
+// SetHostModel sets the host models used to receive and send packets by the
+// NICs that don't have their own. The default is HostModelStrict for both.
+func (s *Stack) SetHostModel(receive, send HostModel) {
+	atomic.StoreUint32((*uint32)(&s.rcvHostModel), uint32(receive))
+	atomic.StoreUint32((*uint32)(&s.sndHostModel), uint32(send))
+	s.invalidateRoutes()
+}
+
+// HostModel returns the host models set with SetHostModel.
+func (s *Stack) HostModel() (receive, send HostModel) {
+	return HostModel(atomic.LoadUint32((*uint32)(&s.rcvHostModel))), HostModel(atomic.LoadUint32((*uint32)(&s.sndHostModel)))
+}
+
+// SetNICHostModel sets the host models used to receive and send packets by the
+// NIC with the given ID. HostModelInherit makes it use the ones of the stack,
+// which is the default.
+func (s *Stack) SetNICHostModel(id tcpip.NICID, receive, send HostModel) *tcpip.Error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+	nic.mu.Lock()
+	nic.rcvHostModel = receive
+	nic.sndHostModel = send
+	nic.mu.Unlock()
+	s.invalidateRoutes()
+	return nil
+}
+
+// NICHostModel returns the host models set with SetNICHostModel for the NIC
+// with the given ID.
+func (s *Stack) NICHostModel(id tcpip.NICID) (receive, send HostModel, err *tcpip.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return 0, 0, tcpip.ErrUnknownNICID
+	}
+	nic.mu.RLock()
+	defer nic.mu.RUnlock()
+	return nic.rcvHostModel, nic.sndHostModel, nil
+}
+
+// weakHost returns whether n uses the weak host model to receive packets, or
+// to send them if send is set.
+func (n *NIC) weakHost(send bool) bool {
+	n.mu.RLock()
+	m := n.rcvHostModel
+	if send {
+		m = n.sndHostModel
+	}
+	n.mu.RUnlock()
+
+	if m == HostModelInherit {
+		rcv, snd := n.stack.HostModel()
+		m = rcv
+		if send {
+			m = snd
+		}
+	}
+	return m == HostModelWeak
+}
+
+// findLocalEndpoint returns the network endpoint of a NIC of the given VRF,
+// other than a loopback one, whose address is addr, if any. Only permanent
+// unicast addresses are considered.
+func (s *Stack) findLocalEndpoint(vrf tcpip.VRFID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) *referencedNetworkEndpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.findLocalEndpointLocked(vrf, protocol, addr)
+}
+
+// findLocalEndpointLocked implements findLocalEndpoint. s.mu must be held.
+func (s *Stack) findLocalEndpointLocked(vrf tcpip.VRFID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) *referencedNetworkEndpoint {
+	if header.IsV4MulticastAddress(addr) || header.IsV6MulticastAddress(addr) || header.IsV6LinkLocalAddress(addr) {
+		return nil
+	}
+
+	for _, nic := range s.nics {
+		if nic.loopback || nic.vrfID() != vrf {
+			continue
+		}
+		nic.mu.RLock()
+		ref, ok := nic.endpoints[NetworkEndpointID{addr}]
+		ok = ok && ref.protocol == protocol && ref.holdsInsertRef && ref.tryIncRef()
+		nic.mu.RUnlock()
+		if ok {
+			return ref
+		}
+	}
+	return nil
+}
+
+// weakSourceEndpointLocked returns a temporary network endpoint of nic with
+// the address localAddr, if nic uses the weak host model to send packets and
+// localAddr is the address of another NIC of its VRF. s.mu must be held.
+func (s *Stack) weakSourceEndpointLocked(nic *NIC, localAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber) *referencedNetworkEndpoint {
+	if !nic.weakHost(true /* send */) {
+		return nil
+	}
+	ref := s.findLocalEndpointLocked(nic.vrfID(), netProto, localAddr)
+	if ref == nil {
+		return nil
+	}
+	ref.decRef()
+	if ref.anycast {
+		return nil
+	}
+	return nic.getTemporaryEndpoint(netProto, localAddr, CanBePrimaryEndpoint)
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// icmpv4ErrorPayloadSize is the largest amount of the offending packet quoted
+// in ICMPv4 errors, so that they fit in the minimum IPv4 datagram size of 576
+// bytes.
+const icmpv4ErrorPayloadSize = 576 - header.IPv4MinimumSize - header.ICMPv4DstUnreachableMinimumSize
+
+// icmpv6ErrorPayloadSize is the same for ICMPv6 errors and the minimum IPv6
+// MTU, as required by RFC 4443 section 2.4.
+const icmpv6ErrorPayloadSize = header.IPv6MinimumMTU - header.IPv6MinimumSize - header.ICMPv6DstUnreachableMinimumSize
+
+// sendUnreachable answers the packet vv, received with the given network
+// protocol in the given VRF and rejected by a route, with an ICMP destination
+// unreachable error. err is the error returned by FindRoute for the packet,
+// which selects
+// the ICMP code. Nothing is sent if the packet must not be answered with an
+// error, as per RFC 1812 section 4.3.2.7 and RFC 4443 section 2.4 (e).
+func (s *Stack) sendUnreachable(vrf tcpip.VRFID, protocol tcpip.NetworkProtocolNumber, err *tcpip.Error, vv buffer.VectorisedView) {
+	h := vv.First()
+	var src tcpip.Address
+	var size int
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(h)
+		src = ip.SourceAddress()
+		if ip.FragmentOffset() != 0 || src == header.IPv4Any || src == header.IPv4Broadcast || header.IsV4MulticastAddress(src) {
+			return
+		}
+		if ip.Protocol() == uint8(header.ICMPv4ProtocolNumber) && len(h) > int(ip.HeaderLength()) && isICMPv4Error(header.ICMPv4Type(h[ip.HeaderLength()])) {
+			return
+		}
+		size = icmpv4ErrorPayloadSize
+	case header.IPv6ProtocolNumber:
+		ip := header.IPv6(h)
+		src = ip.SourceAddress()
+		if src == header.IPv6Any || header.IsV6MulticastAddress(src) {
+			return
+		}
+		// Errors are types 0 to 127, RFC 4443 section 2.1.
+		if ip.NextHeader() == uint8(header.ICMPv6ProtocolNumber) && len(h) > header.IPv6MinimumSize && h[header.IPv6MinimumSize] < 128 {
+			return
+		}
+		size = icmpv6ErrorPayloadSize
+	default:
+		return
+	}
+
+	r, rerr := s.FindRouteInVRF(vrf, 0, "", src, protocol, false /* multicastLoop */)
+	if rerr != nil {
+		return
+	}
+	defer r.Release()
+	if !r.AllowICMP() {
+		return
+	}
+
+	if size > vv.Size() {
+		size = vv.Size()
+	}
+	payload := buffer.NewView(size)
+	copy(payload, vv.ToView())
+	stats := r.Stats().ICMP
+
+	if protocol == header.IPv4ProtocolNumber {
+		hdr := buffer.NewPrependable(int(r.MaxHeaderLength()) + header.ICMPv4DstUnreachableMinimumSize)
+		icmp := header.ICMPv4(hdr.Prepend(header.ICMPv4DstUnreachableMinimumSize))
+		icmp.SetType(header.ICMPv4DstUnreachable)
+		icmp.SetCode(header.ICMPv4HostUnreachable)
+		if err == tcpip.ErrProhibited {
+			icmp.SetCode(header.ICMPv4AdminProhibited)
+		}
+		icmp.SetChecksum(^header.Checksum(icmp, header.Checksum(payload, 0)))
+		pkt := NewOutboundPacketBuffer(hdr, payload.ToVectorisedView())
+		defer pkt.DecRef()
+		if err := r.WritePacket(pkt, header.ICMPv4ProtocolNumber, r.DefaultTTL()); err != nil {
+			stats.OutgoingPacketErrors.Increment()
+			return
+		}
+		stats.V4PacketsSent.DstUnreachable.Increment()
+		return
+	}
+
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()) + header.ICMPv6DstUnreachableMinimumSize)
+	icmp := header.ICMPv6(hdr.Prepend(header.ICMPv6DstUnreachableMinimumSize))
+	icmp.SetType(header.ICMPv6DstUnreachable)
+	icmp.SetCode(header.ICMPv6NoRoute)
+	if err == tcpip.ErrProhibited {
+		icmp.SetCode(header.ICMPv6AdminProhibited)
+	}
+	xsum := header.PseudoHeaderChecksum(header.ICMPv6ProtocolNumber, r.LocalAddress, r.RemoteAddress, uint16(len(icmp)+len(payload)))
+	icmp.SetChecksum(^header.Checksum(icmp, header.Checksum(payload, xsum)))
+	pkt := NewOutboundPacketBuffer(hdr, payload.ToVectorisedView())
+	defer pkt.DecRef()
+	if err := r.WritePacket(pkt, header.ICMPv6ProtocolNumber, r.DefaultTTL()); err != nil {
+		stats.OutgoingPacketErrors.Increment()
+		return
+	}
+	stats.V6PacketsSent.DstUnreachable.Increment()
+}
+
+// isICMPv4Error returns whether ICMPv4 messages of type t are errors.
+func isICMPv4Error(t header.ICMPv4Type) bool {
+	switch t {
+	case header.ICMPv4DstUnreachable, header.ICMPv4SrcQuench, header.ICMPv4Redirect, header.ICMPv4TimeExceeded, header.ICMPv4ParamProblem:
+		return true
+	default:
+		return false
+	}
+}
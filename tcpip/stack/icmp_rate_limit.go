@@ -0,0 +1,180 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// maxICMPRateLimitDestinations is the maximum number of destinations whose
+// ICMP rate is tracked at once.
+const maxICMPRateLimitDestinations = 1024
+
+// ICMPRateLimit holds the limits on the rate of ICMP and ICMPv6 messages
+// generated by the stack, like errors and echo replies. Messages over the
+// limits are not sent, and counted in the RateLimited ICMP stat.
+//
+// Each limit is a token bucket: it allows Burst messages at once, and then
+// Rate messages per second. A zero Rate disables the limit.
+type ICMPRateLimit struct {
+	// Rate and Burst limit the messages sent by the stack to all
+	// destinations.
+	Rate  float64
+	Burst int
+
+	// PerDestinationRate and PerDestinationBurst limit the messages sent by
+	// the stack to each destination.
+	PerDestinationRate  float64
+	PerDestinationBurst int
+}
+
+// DefaultICMPRateLimit is the ICMP rate limit of new stacks, the same as the
+// default icmp_msgs_per_sec and icmp_msgs_burst of Linux.
+var DefaultICMPRateLimit = ICMPRateLimit{
+	Rate:  1000,
+	Burst: 50,
+}
+
+// tokenBucket is the state of a token bucket. Its parameters are held by the
+// user.
+type tokenBucket struct {
+	tokens float64
+
+	// last is the monotonic time of the last refill.
+	last int64
+}
+
+// refill adds the tokens accumulated up to now, and reports whether at least
+// one token is available.
+func (b *tokenBucket) refill(now int64, rate float64, burst int) bool {
+	b.tokens += float64(now-b.last) / float64(time.Second) * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	return b.tokens >= 1
+}
+
+// icmpRateLimiter applies an ICMPRateLimit.
+//
+// This struct is safe for concurrent use.
+type icmpRateLimiter struct {
+	clock tcpip.Clock
+
+	mu     sync.Mutex
+	limit  ICMPRateLimit
+	global tokenBucket
+	dests  map[tcpip.Address]*tokenBucket
+}
+
+func newICMPRateLimiter(clock tcpip.Clock, limit ICMPRateLimit) *icmpRateLimiter {
+	l := &icmpRateLimiter{clock: clock}
+	l.setLimit(limit)
+	return l
+}
+
+// setLimit replaces the limit, resetting the buckets to full.
+func (l *icmpRateLimiter) setLimit(limit ICMPRateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = limit
+	l.global = tokenBucket{
+		tokens: float64(limit.Burst),
+		last:   l.clock.NowMonotonic(),
+	}
+	l.dests = make(map[tcpip.Address]*tokenBucket)
+}
+
+// allow reports whether a message can be sent to dst, and takes the tokens
+// for it if so.
+func (l *icmpRateLimiter) allow(dst tcpip.Address) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.NowMonotonic()
+	if l.limit.Rate > 0 && !l.global.refill(now, l.limit.Rate, l.limit.Burst) {
+		return false
+	}
+
+	var b *tokenBucket
+	if l.limit.PerDestinationRate > 0 {
+		b = l.dests[dst]
+		if b == nil {
+			if len(l.dests) >= maxICMPRateLimitDestinations {
+				l.evictLocked(now)
+			}
+			b = &tokenBucket{tokens: float64(l.limit.PerDestinationBurst), last: now}
+			l.dests[dst] = b
+		}
+		if !b.refill(now, l.limit.PerDestinationRate, l.limit.PerDestinationBurst) {
+			return false
+		}
+		b.tokens--
+	}
+	if l.limit.Rate > 0 {
+		l.global.tokens--
+	}
+	return true
+}
+
+// evictLocked makes room for a new destination. Destinations whose bucket has
+// refilled are forgotten, as they would start again with a full bucket
+// anyway. If none has, an arbitrary one is.
+//
+// Precondition: l.mu must be held.
+func (l *icmpRateLimiter) evictLocked(now int64) {
+	for dst, b := range l.dests {
+		b.refill(now, l.limit.PerDestinationRate, l.limit.PerDestinationBurst)
+		if b.tokens >= float64(l.limit.PerDestinationBurst) {
+			delete(l.dests, dst)
+		}
+	}
+	if len(l.dests) < maxICMPRateLimitDestinations {
+		return
+	}
+	for dst := range l.dests {
+		delete(l.dests, dst)
+		return
+	}
+}
+
+// SetICMPRateLimit sets the limits on the rate of ICMP messages generated by
+// the stack. The limits start with full buckets.
+func (s *Stack) SetICMPRateLimit(limit ICMPRateLimit) {
+	s.icmpRateLimiter.setLimit(limit)
+}
+
+// ICMPRateLimit returns the limits on the rate of ICMP messages generated by
+// the stack.
+func (s *Stack) ICMPRateLimit() ICMPRateLimit {
+	s.icmpRateLimiter.mu.Lock()
+	defer s.icmpRateLimiter.mu.Unlock()
+	return s.icmpRateLimiter.limit
+}
+
+// AllowICMPMessage reports whether the stack's ICMP rate limit allows it to
+// generate an ICMP message to dst, and counts the message against the limit if
+// so. Network protocols call it before sending ICMP errors and echo replies.
+func (s *Stack) AllowICMPMessage(dst tcpip.Address) bool {
+	if s.icmpRateLimiter.allow(dst) {
+		return true
+	}
+	s.stats.ICMP.RateLimited.Increment()
+	return false
+}
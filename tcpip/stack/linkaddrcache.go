@@ -16,6 +16,7 @@ package stack
 
 import (
 	"fmt"
+	"math"
 	"sync"
 	"time"
 
@@ -25,12 +26,20 @@ import (
 
 const linkAddrCacheSize = 512 // max cache entries
 
+// maxPendingPackets is the number of outgoing packets queued for a neighbor
+// while its link address is resolved. When more are sent, the oldest ones are
+// dropped, like Linux does beyond unres_qlen.
+const maxPendingPackets = 32
+
 // linkAddrCache is a fixed-sized cache mapping IP addresses to link addresses.
 //
 // The entries are stored in a ring buffer, oldest entry replaced first.
 //
 // This struct is safe for concurrent use.
 type linkAddrCache struct {
+	// clock is used to expire entries and time out address resolution.
+	clock tcpip.Clock
+
 	// ageLimit is how long a cache entry is valid for.
 	ageLimit time.Duration
 
@@ -42,10 +51,47 @@ type linkAddrCache struct {
 	// resolved before failing.
 	resolutionAttempts int
 
+	// onFailure, if set, is called without c.mu held when the resolution
+	// of an address fails.
+	onFailure func(tcpip.FullAddress)
+
 	mu      sync.Mutex
 	cache   map[tcpip.FullAddress]*linkAddrEntry
 	next    int // array index of next available entry
 	entries [linkAddrCacheSize]linkAddrEntry
+
+	// static holds the permanent entries, which take precedence over the
+	// cache and are never evicted.
+	static map[tcpip.FullAddress]staticLinkAddrEntry
+
+	// released holds the pending packets of the entries that left the
+	// incomplete state, to be sent or dropped by sendReleased once c.mu
+	// is released.
+	released []releasedPackets
+}
+
+// pendingPacket is an outgoing packet waiting for the link address of its next
+// hop to be resolved. It holds a reference to its route, and to its own copy of
+// the packet.
+type pendingPacket struct {
+	route    Route
+	pkt      *PacketBuffer
+	protocol tcpip.NetworkProtocolNumber
+}
+
+// releasedPackets are pending packets to be sent to linkAddr, or dropped for
+// reason if it's empty.
+type releasedPackets struct {
+	packets  []pendingPacket
+	linkAddr tcpip.LinkAddress
+	reason   tcpip.DropReason
+}
+
+// staticLinkAddrEntry is a permanent entry of the linkAddrCache.
+type staticLinkAddrEntry struct {
+	linkAddr tcpip.LinkAddress
+	// added is the monotonic time at which the entry was added.
+	added int64
 }
 
 // entryState controls the state of a single entry in the cache.
@@ -84,20 +130,37 @@ func (s entryState) String() string {
 // A linkAddrEntry is an entry in the linkAddrCache.
 // This struct is thread-compatible.
 type linkAddrEntry struct {
-	addr       tcpip.FullAddress
-	linkAddr   tcpip.LinkAddress
-	expiration time.Time
-	s          entryState
+	addr     tcpip.FullAddress
+	linkAddr tcpip.LinkAddress
+	// expiration is the monotonic time, as given by the cache's clock, at
+	// which the entry expires.
+	expiration int64
+	// updated is the monotonic time at which the entry was created or
+	// last resolved.
+	updated int64
+	s       entryState
+
+	// probing is set while the reachability of the ready entry is checked
+	// again, see linkAddrCache.probe.
+	probing bool
 
 	// wakers is a set of waiters for address resolution result. Anytime
 	// state transitions out of 'incomplete' these waiters are notified.
 	wakers map[*sleep.Waker]struct{}
 
 	done chan struct{}
+
+	// pending holds the packets queued while the entry is incomplete.
+	// They are released to the cache when it transitions out of
+	// 'incomplete'.
+	pending []pendingPacket
+
+	cache *linkAddrCache
 }
 
-func (e *linkAddrEntry) state() entryState {
-	if e.s != expired && time.Now().After(e.expiration) {
+// state returns the state of the entry at monotonic time now.
+func (e *linkAddrEntry) state(now int64) entryState {
+	if e.s != expired && now > e.expiration {
 		// Force the transition to ensure waiters are notified.
 		e.changeState(expired)
 	}
@@ -134,34 +197,68 @@ func (e *linkAddrEntry) changeState(ns entryState) {
 		if e.done != nil {
 			close(e.done)
 		}
+		if len(e.pending) > 0 {
+			r := releasedPackets{packets: e.pending, reason: tcpip.DropResolutionFailed}
+			if ns == ready {
+				r.linkAddr = e.linkAddr
+			}
+			e.cache.released = append(e.cache.released, r)
+			e.pending = nil
+		}
 	}
 	e.s = ns
 }
 
 func (e *linkAddrEntry) addWaker(w *sleep.Waker) {
-	e.wakers[w] = struct{}{}
+	if w != nil {
+		e.wakers[w] = struct{}{}
+	}
+}
+
+// queue adds p to the packets pending on the resolution of e, dropping the
+// oldest one if there are already maxPendingPackets.
+func (e *linkAddrEntry) queue(p pendingPacket) {
+	if len(e.pending) >= maxPendingPackets {
+		e.cache.released = append(e.cache.released, releasedPackets{packets: e.pending[:1], reason: tcpip.DropQueueFull})
+		e.pending = e.pending[1:]
+	}
+	e.pending = append(e.pending, p)
 }
 
 func (e *linkAddrEntry) removeWaker(w *sleep.Waker) {
 	delete(e.wakers, w)
 }
 
-// add adds a k -> v mapping to the cache.
-func (c *linkAddrCache) add(k tcpip.FullAddress, v tcpip.LinkAddress) {
+// add adds a k -> v mapping to the cache. It returns whether the mapping was
+// added, and whether k was mapped to another link address that may be in use.
+func (c *linkAddrCache) add(k tcpip.FullAddress, v tcpip.LinkAddress) (added, changed bool) {
+	defer c.sendReleased()
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if _, ok := c.static[k]; ok {
+		// Permanent entries are not replaced by address resolution.
+		return false, false
+	}
+
 	entry, ok := c.cache[k]
 	if ok {
-		s := entry.state()
+		s := entry.state(c.clock.NowMonotonic())
 		if s != expired && entry.linkAddr == v {
+			if entry.probing {
+				// The neighbor answered the probe, it is still
+				// reachable.
+				c.confirmLocked(entry)
+			}
 			// Disregard repeated calls.
-			return
+			return false, false
 		}
 		// Check if entry is waiting for address resolution.
 		if s == incomplete {
 			entry.linkAddr = v
+			entry.updated = c.clock.NowMonotonic()
 		} else {
+			changed = s == ready && entry.linkAddr != v
 			// Otherwise create a new entry to replace it.
 			entry = c.makeAndAddEntry(k, v)
 		}
@@ -170,6 +267,7 @@ func (c *linkAddrCache) add(k tcpip.FullAddress, v tcpip.LinkAddress) {
 	}
 
 	entry.changeState(ready)
+	return true, changed
 }
 
 // makeAndAddEntry is a helper function to create and add a new
@@ -188,9 +286,11 @@ func (c *linkAddrCache) makeAndAddEntry(k tcpip.FullAddress, v tcpip.LinkAddress
 	*entry = linkAddrEntry{
 		addr:       k,
 		linkAddr:   v,
-		expiration: time.Now().Add(c.ageLimit),
+		expiration: c.expiration(),
+		updated:    c.clock.NowMonotonic(),
 		wakers:     make(map[*sleep.Waker]struct{}),
 		done:       make(chan struct{}),
+		cache:      c,
 	}
 
 	c.cache[k] = entry
@@ -198,18 +298,44 @@ func (c *linkAddrCache) makeAndAddEntry(k tcpip.FullAddress, v tcpip.LinkAddress
 	return entry
 }
 
+// expiration returns the expiration time of an entry added now.
+func (c *linkAddrCache) expiration() int64 {
+	now := c.clock.NowMonotonic()
+	if int64(c.ageLimit) > math.MaxInt64-now {
+		return math.MaxInt64
+	}
+	return now + int64(c.ageLimit)
+}
+
 // get reports any known link address for k.
 func (c *linkAddrCache) get(k tcpip.FullAddress, linkRes LinkAddressResolver, localAddr tcpip.Address, linkEP LinkEndpoint, waker *sleep.Waker) (tcpip.LinkAddress, <-chan struct{}, *tcpip.Error) {
+	return c.lookup(k, linkRes, localAddr, linkEP, waker, nil)
+}
+
+// getOrQueue is like get, but if k is being resolved, the packet returned by
+// pending is queued to be sent once it is, and ErrWouldBlock is returned.
+// pending is called with c.mu held.
+func (c *linkAddrCache) getOrQueue(k tcpip.FullAddress, linkRes LinkAddressResolver, localAddr tcpip.Address, linkEP LinkEndpoint, pending func() pendingPacket) (tcpip.LinkAddress, *tcpip.Error) {
+	addr, _, err := c.lookup(k, linkRes, localAddr, linkEP, nil, pending)
+	return addr, err
+}
+
+// lookup implements get and getOrQueue.
+func (c *linkAddrCache) lookup(k tcpip.FullAddress, linkRes LinkAddressResolver, localAddr tcpip.Address, linkEP LinkEndpoint, waker *sleep.Waker, pending func() pendingPacket) (tcpip.LinkAddress, <-chan struct{}, *tcpip.Error) {
 	if linkRes != nil {
 		if addr, ok := linkRes.ResolveStaticAddress(k.Addr); ok {
 			return addr, nil, nil
 		}
 	}
 
+	defer c.sendReleased()
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if entry, ok := c.static[k]; ok {
+		return entry.linkAddr, nil, nil
+	}
 	if entry, ok := c.cache[k]; ok {
-		switch s := entry.state(); s {
+		switch s := entry.state(c.clock.NowMonotonic()); s {
 		case expired:
 		case ready:
 			return entry.linkAddr, nil, nil
@@ -218,6 +344,9 @@ func (c *linkAddrCache) get(k tcpip.FullAddress, linkRes LinkAddressResolver, lo
 		case incomplete:
 			// Address resolution is still in progress.
 			entry.addWaker(waker)
+			if pending != nil {
+				entry.queue(pending())
+			}
 			return "", entry.done, tcpip.ErrWouldBlock
 		default:
 			panic(fmt.Sprintf("invalid cache entry state: %s", s))
@@ -231,12 +360,242 @@ func (c *linkAddrCache) get(k tcpip.FullAddress, linkRes LinkAddressResolver, lo
 	// Add 'incomplete' entry in the cache to mark that resolution is in progress.
 	e := c.makeAndAddEntry(k, "")
 	e.addWaker(waker)
+	if pending != nil {
+		e.queue(pending())
+	}
 
 	go c.startAddressResolution(k, linkRes, localAddr, linkEP, e.done)
 
 	return "", e.done, tcpip.ErrWouldBlock
 }
 
+// confirm is called when upper layers confirm that the neighbor k is
+// reachable, as described in RFC 4861 section 7.3.1. Its entry, if it's ready,
+// is then valid for another ageLimit, so that its address isn't resolved again
+// in the meantime.
+func (c *linkAddrCache) confirm(k tcpip.FullAddress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.cache[k]; ok && entry.state(c.clock.NowMonotonic()) == ready {
+		c.confirmLocked(entry)
+	}
+}
+
+// confirmLocked renews the ready entry, and stops probing it. c.mu must be
+// held.
+func (c *linkAddrCache) confirmLocked(entry *linkAddrEntry) {
+	entry.probing = false
+	entry.expiration = c.expiration()
+	entry.updated = c.clock.NowMonotonic()
+}
+
+// probe is called when upper layers suspect that the neighbor k is no longer
+// reachable, like when a connection stalls. If its entry is ready, its address
+// is resolved again in the background while the entry is still used. The
+// entry is renewed if the neighbor answers with the same link address, and
+// replaced if it answers with another one. Otherwise, it expires after
+// resolutionAttempts, and onFailure is called.
+func (c *linkAddrCache) probe(k tcpip.FullAddress, linkRes LinkAddressResolver, localAddr tcpip.Address, linkEP LinkEndpoint) {
+	if linkRes == nil {
+		return
+	}
+
+	c.mu.Lock()
+	entry, ok := c.cache[k]
+	if !ok || entry.probing || entry.state(c.clock.NowMonotonic()) != ready {
+		c.mu.Unlock()
+		return
+	}
+	entry.probing = true
+	c.mu.Unlock()
+
+	go c.probeReachability(k, entry, linkRes, localAddr, linkEP)
+}
+
+// probeReachability sends the link requests of the probe of entry, the entry
+// of k, until the neighbor answers or it has sent resolutionAttempts.
+func (c *linkAddrCache) probeReachability(k tcpip.FullAddress, entry *linkAddrEntry, linkRes LinkAddressResolver, localAddr tcpip.Address, linkEP LinkEndpoint) {
+	for i := 0; i < c.resolutionAttempts; i++ {
+		linkRes.LinkAddressRequest(k.Addr, localAddr, linkEP)
+
+		timedOut := make(chan struct{})
+		c.clock.AfterFunc(c.resolutionTimeout, func() { close(timedOut) })
+		<-timedOut
+
+		c.mu.Lock()
+		probing := c.stillProbingLocked(k, entry)
+		c.mu.Unlock()
+		if !probing {
+			return
+		}
+	}
+
+	c.mu.Lock()
+	if !c.stillProbingLocked(k, entry) {
+		c.mu.Unlock()
+		return
+	}
+	entry.probing = false
+	delete(c.cache, k)
+	entry.changeState(expired)
+	c.mu.Unlock()
+
+	if c.onFailure != nil {
+		c.onFailure(k)
+	}
+}
+
+// stillProbingLocked returns whether entry is still the ready entry of k, and
+// is being probed. c.mu must be held.
+func (c *linkAddrCache) stillProbingLocked(k tcpip.FullAddress, entry *linkAddrEntry) bool {
+	return c.cache[k] == entry && entry.probing && entry.state(c.clock.NowMonotonic()) == ready
+}
+
+// removeNIC flushes the entries of the NIC with the given ID. Waiters for
+// their resolution are notified.
+func (c *linkAddrCache) removeNIC(id tcpip.NICID) {
+	defer c.sendReleased()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, entry := range c.cache {
+		if k.NIC == id {
+			delete(c.cache, k)
+			entry.changeState(expired)
+		}
+	}
+	for k := range c.static {
+		if k.NIC == id {
+			delete(c.static, k)
+		}
+	}
+}
+
+// addStatic adds a permanent k -> v mapping to the cache, replacing any
+// existing one. It returns whether k was mapped to another link address that
+// may be in use.
+func (c *linkAddrCache) addStatic(k tcpip.FullAddress, v tcpip.LinkAddress) bool {
+	defer c.sendReleased()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changed := false
+	if entry, ok := c.static[k]; ok {
+		if entry.linkAddr == v {
+			return false
+		}
+		changed = true
+	} else if entry, ok := c.cache[k]; ok {
+		s := entry.state(c.clock.NowMonotonic())
+		changed = s == ready && entry.linkAddr != v
+		if s == incomplete {
+			// Wake up waiters and send the pending packets, as the
+			// address is now resolved.
+			entry.linkAddr = v
+			entry.changeState(ready)
+		}
+		delete(c.cache, k)
+		entry.changeState(expired)
+	}
+	if c.static == nil {
+		c.static = make(map[tcpip.FullAddress]staticLinkAddrEntry)
+	}
+	c.static[k] = staticLinkAddrEntry{linkAddr: v, added: c.clock.NowMonotonic()}
+	return changed
+}
+
+// remove removes the mapping of k, whether permanent or not. It returns
+// whether there was one.
+func (c *linkAddrCache) remove(k tcpip.FullAddress) bool {
+	defer c.sendReleased()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.static[k]; ok {
+		delete(c.static, k)
+		return true
+	}
+	entry, ok := c.cache[k]
+	if !ok {
+		return false
+	}
+	delete(c.cache, k)
+	s := entry.state(c.clock.NowMonotonic())
+	entry.changeState(expired)
+	return s != expired
+}
+
+// entriesOf returns the unexpired entries of the NIC with the given ID.
+func (c *linkAddrCache) entriesOf(id tcpip.NICID) []NeighborEntry {
+	defer c.sendReleased()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.NowMonotonic()
+	var entries []NeighborEntry
+	for k, entry := range c.static {
+		if k.NIC == id {
+			entries = append(entries, NeighborEntry{
+				Addr:     k.Addr,
+				LinkAddr: entry.linkAddr,
+				State:    NeighborPermanent,
+				Age:      time.Duration(now - entry.added),
+			})
+		}
+	}
+	for k, entry := range c.cache {
+		if k.NIC != id {
+			continue
+		}
+		var state NeighborState
+		switch entry.state(now) {
+		case incomplete:
+			state = NeighborIncomplete
+		case ready:
+			state = NeighborReachable
+			if entry.probing {
+				state = NeighborProbe
+			}
+		case failed:
+			state = NeighborFailed
+		default:
+			continue
+		}
+		entries = append(entries, NeighborEntry{
+			Addr:     k.Addr,
+			LinkAddr: entry.linkAddr,
+			State:    state,
+			Age:      time.Duration(now - entry.updated),
+		})
+	}
+	return entries
+}
+
+// sendReleased sends the pending packets released by the entries that were
+// resolved, and drops the others. c.mu must not be held.
+func (c *linkAddrCache) sendReleased() {
+	c.mu.Lock()
+	released := c.released
+	c.released = nil
+	c.mu.Unlock()
+
+	for _, r := range released {
+		for i := range r.packets {
+			p := &r.packets[i]
+			if r.linkAddr == "" {
+				p.route.Stats().IP.OutgoingPacketErrors.Increment()
+				p.route.recordWriteDrop(r.reason, p.pkt)
+			} else {
+				p.route.RemoteLinkAddress = r.linkAddr
+				p.route.writeResolved(p.pkt, p.protocol)
+			}
+			p.pkt.DecRef()
+			p.route.Release()
+		}
+	}
+}
+
 // removeWaker removes a waker previously added through get().
 func (c *linkAddrCache) removeWaker(k tcpip.FullAddress, waker *sleep.Waker) {
 	c.mu.Lock()
@@ -253,12 +612,18 @@ func (c *linkAddrCache) startAddressResolution(k tcpip.FullAddress, linkRes Link
 		// whether the request succeeded.
 		linkRes.LinkAddressRequest(k.Addr, localAddr, linkEP)
 
+		timedOut := make(chan struct{})
+		t := c.clock.AfterFunc(c.resolutionTimeout, func() { close(timedOut) })
 		select {
-		case <-time.After(c.resolutionTimeout):
-			if stop := c.checkLinkRequest(k, i); stop {
+		case <-timedOut:
+			if stop, resolutionFailed := c.checkLinkRequest(k, i); stop {
+				if resolutionFailed && c.onFailure != nil {
+					c.onFailure(k)
+				}
 				return
 			}
 		case <-done:
+			t.Stop()
 			return
 		}
 	}
@@ -266,36 +631,39 @@ func (c *linkAddrCache) startAddressResolution(k tcpip.FullAddress, linkRes Link
 
 // checkLinkRequest checks whether previous attempt to resolve address has succeeded
 // and mark the entry accordingly, e.g. ready, failed, etc. Return true if request
-// can stop, false if another request should be sent.
-func (c *linkAddrCache) checkLinkRequest(k tcpip.FullAddress, attempt int) bool {
+// can stop, false if another request should be sent, and whether the
+// resolution just failed.
+func (c *linkAddrCache) checkLinkRequest(k tcpip.FullAddress, attempt int) (stop, failedNow bool) {
+	defer c.sendReleased()
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	entry, ok := c.cache[k]
 	if !ok {
 		// Entry was evicted from the cache.
-		return true
+		return true, false
 	}
 
-	switch s := entry.state(); s {
+	switch s := entry.state(c.clock.NowMonotonic()); s {
 	case ready, failed, expired:
 		// Entry was made ready by resolver or failed. Either way we're done.
-		return true
+		return true, false
 	case incomplete:
 		if attempt+1 >= c.resolutionAttempts {
 			// Max number of retries reached, mark entry as failed.
 			entry.changeState(failed)
-			return true
+			return true, true
 		}
 		// No response yet, need to send another ARP request.
-		return false
+		return false, false
 	default:
 		panic(fmt.Sprintf("invalid cache entry state: %s", s))
 	}
 }
 
-func newLinkAddrCache(ageLimit, resolutionTimeout time.Duration, resolutionAttempts int) *linkAddrCache {
+func newLinkAddrCache(clock tcpip.Clock, ageLimit, resolutionTimeout time.Duration, resolutionAttempts int) *linkAddrCache {
 	return &linkAddrCache{
+		clock:              clock,
 		ageLimit:           ageLimit,
 		resolutionTimeout:  resolutionTimeout,
 		resolutionAttempts: resolutionAttempts,
@@ -91,7 +91,7 @@ func init() {
 }
 
 func TestCacheOverflow(t *testing.T) {
-	c := newLinkAddrCache(1<<63-1, 1*time.Second, 3)
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, 1*time.Second, 3)
 	for i := len(testaddrs) - 1; i >= 0; i-- {
 		e := testaddrs[i]
 		c.add(e.addr, e.linkAddr)
@@ -124,7 +124,7 @@ func TestCacheOverflow(t *testing.T) {
 }
 
 func TestCacheConcurrent(t *testing.T) {
-	c := newLinkAddrCache(1<<63-1, 1*time.Second, 3)
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, 1*time.Second, 3)
 
 	var wg sync.WaitGroup
 	for r := 0; r < 16; r++ {
@@ -158,7 +158,7 @@ func TestCacheConcurrent(t *testing.T) {
 }
 
 func TestCacheAgeLimit(t *testing.T) {
-	c := newLinkAddrCache(1*time.Millisecond, 1*time.Second, 3)
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1*time.Millisecond, 1*time.Second, 3)
 	e := testaddrs[0]
 	c.add(e.addr, e.linkAddr)
 	time.Sleep(50 * time.Millisecond)
@@ -168,7 +168,7 @@ func TestCacheAgeLimit(t *testing.T) {
 }
 
 func TestCacheReplace(t *testing.T) {
-	c := newLinkAddrCache(1<<63-1, 1*time.Second, 3)
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, 1*time.Second, 3)
 	e := testaddrs[0]
 	l2 := e.linkAddr + "2"
 	c.add(e.addr, e.linkAddr)
@@ -191,7 +191,7 @@ func TestCacheReplace(t *testing.T) {
 }
 
 func TestCacheResolution(t *testing.T) {
-	c := newLinkAddrCache(1<<63-1, 250*time.Millisecond, 1)
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, 250*time.Millisecond, 1)
 	linkRes := &testLinkAddressResolver{cache: c}
 	for i, ta := range testaddrs {
 		got, err := getBlocking(c, ta.addr, linkRes)
@@ -217,7 +217,7 @@ func TestCacheResolution(t *testing.T) {
 }
 
 func TestCacheResolutionFailed(t *testing.T) {
-	c := newLinkAddrCache(1<<63-1, 10*time.Millisecond, 5)
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, 10*time.Millisecond, 5)
 	linkRes := &testLinkAddressResolver{cache: c}
 
 	// First, sanity check that resolution is working...
@@ -239,7 +239,7 @@ func TestCacheResolutionFailed(t *testing.T) {
 func TestCacheResolutionTimeout(t *testing.T) {
 	resolverDelay := 500 * time.Millisecond
 	expiration := resolverDelay / 10
-	c := newLinkAddrCache(expiration, 1*time.Millisecond, 3)
+	c := newLinkAddrCache(&tcpip.StdClock{}, expiration, 1*time.Millisecond, 3)
 	linkRes := &testLinkAddressResolver{cache: c, delay: resolverDelay}
 
 	e := testaddrs[0]
@@ -251,7 +251,7 @@ func TestCacheResolutionTimeout(t *testing.T) {
 // TestStaticResolution checks that static link addresses are resolved immediately and don't
 // send resolution requests.
 func TestStaticResolution(t *testing.T) {
-	c := newLinkAddrCache(1<<63-1, time.Millisecond, 1)
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, time.Millisecond, 1)
 	linkRes := &testLinkAddressResolver{cache: c, delay: time.Minute}
 
 	addr := tcpip.Address("broadcast")
@@ -264,3 +264,136 @@ func TestStaticResolution(t *testing.T) {
 		t.Errorf("c.get(%q)=%q, want %q", string(addr), string(got), string(want))
 	}
 }
+
+func TestCacheStaticEntries(t *testing.T) {
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, 1*time.Second, 3)
+	linkRes := &testLinkAddressResolver{cache: c}
+
+	e := testaddrs[0]
+	if got, err := getBlocking(c, e.addr, linkRes); err != nil || got != e.linkAddr {
+		t.Fatalf("c.get(%q)=%q, %v, want %q, nil", string(e.addr.Addr), got, err, e.linkAddr)
+	}
+
+	const static = tcpip.LinkAddress("static")
+	if !c.addStatic(e.addr, static) {
+		t.Errorf("c.addStatic(%q, %q) = false, want true as it replaces a resolved address", string(e.addr.Addr), static)
+	}
+	// Resolution doesn't replace static entries.
+	c.add(e.addr, e.linkAddr)
+	if got, _, err := c.get(e.addr, linkRes, "", nil, nil); err != nil || got != static {
+		t.Errorf("c.get(%q)=%q, %v, want %q, nil", string(e.addr.Addr), got, err, static)
+	}
+
+	entries := c.entriesOf(e.addr.NIC)
+	if len(entries) != 1 || entries[0].Addr != e.addr.Addr || entries[0].LinkAddr != static || entries[0].State != NeighborPermanent {
+		t.Errorf("got c.entriesOf(%d) = %+v, want a single permanent entry for %q", e.addr.NIC, entries, string(e.addr.Addr))
+	}
+
+	if !c.remove(e.addr) {
+		t.Errorf("c.remove(%q) = false, want true", string(e.addr.Addr))
+	}
+	if c.remove(e.addr) {
+		t.Errorf("second c.remove(%q) = true, want false", string(e.addr.Addr))
+	}
+	if got, err := getBlocking(c, e.addr, linkRes); err != nil || got != e.linkAddr {
+		t.Errorf("c.get(%q)=%q, %v after removal, want %q, nil", string(e.addr.Addr), got, err, e.linkAddr)
+	}
+}
+
+func TestCacheResolutionFailureNotified(t *testing.T) {
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, time.Millisecond, 2)
+	failures := make(chan tcpip.FullAddress, 1)
+	c.onFailure = func(addr tcpip.FullAddress) {
+		failures <- addr
+	}
+	linkRes := &testLinkAddressResolver{cache: c}
+
+	addr := tcpip.FullAddress{NIC: 1, Addr: "unknown"}
+	if _, err := getBlocking(c, addr, linkRes); err != tcpip.ErrNoLinkAddress {
+		t.Fatalf("c.get(%q), got error: %v, want: error ErrNoLinkAddress", string(addr.Addr), err)
+	}
+	select {
+	case got := <-failures:
+		if got != addr {
+			t.Errorf("got failure of %+v, want %+v", got, addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the failure to be notified")
+	}
+
+	entries := c.entriesOf(addr.NIC)
+	if len(entries) != 1 || entries[0].State != NeighborFailed {
+		t.Errorf("got c.entriesOf(%d) = %+v, want a single failed entry", addr.NIC, entries)
+	}
+}
+
+func TestCacheConfirm(t *testing.T) {
+	c := newLinkAddrCache(&tcpip.StdClock{}, 200*time.Millisecond, 1*time.Second, 3)
+	e := testaddrs[0]
+	c.add(e.addr, e.linkAddr)
+	time.Sleep(150 * time.Millisecond)
+	c.confirm(e.addr)
+	time.Sleep(150 * time.Millisecond)
+	if got, _, err := c.get(e.addr, nil, "", nil, nil); err != nil || got != e.linkAddr {
+		t.Errorf("c.get(%q)=%q, %v after confirmation, want %q, nil", string(e.addr.Addr), got, err, e.linkAddr)
+	}
+}
+
+func TestCacheProbe(t *testing.T) {
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, 1*time.Second, 2)
+	failures := make(chan tcpip.FullAddress, 1)
+	c.onFailure = func(addr tcpip.FullAddress) {
+		failures <- addr
+	}
+	linkRes := &testLinkAddressResolver{cache: c, delay: 50 * time.Millisecond}
+
+	// state returns the state of the only entry of the cache.
+	state := func() NeighborState {
+		entries := c.entriesOf(1)
+		if len(entries) != 1 {
+			t.Fatalf("got c.entriesOf(1) = %+v, want a single entry", entries)
+		}
+		return entries[0].State
+	}
+
+	// The entry is used while it's probed, and is reachable again once the
+	// neighbor answers.
+	e := testaddrs[0]
+	c.add(e.addr, e.linkAddr)
+	c.probe(e.addr, linkRes, "", nil)
+	if got := state(); got != NeighborProbe {
+		t.Errorf("got state %s while probing, want %s", got, NeighborProbe)
+	}
+	if got, _, err := c.get(e.addr, nil, "", nil, nil); err != nil || got != e.linkAddr {
+		t.Errorf("c.get(%q)=%q, %v while probing, want %q, nil", string(e.addr.Addr), got, err, e.linkAddr)
+	}
+	for deadline := time.Now().Add(5 * time.Second); state() != NeighborReachable; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the probe to be answered")
+		}
+	}
+	c.remove(e.addr)
+
+	// The entry of a neighbor that doesn't answer is removed. The probes of
+	// another cache time out sooner, as the timeout of c is read by its
+	// goroutines.
+	c = newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, time.Millisecond, 2)
+	c.onFailure = func(addr tcpip.FullAddress) {
+		failures <- addr
+	}
+	linkRes = &testLinkAddressResolver{cache: c, delay: 50 * time.Millisecond}
+	addr := tcpip.FullAddress{NIC: 1, Addr: "gone"}
+	c.add(addr, "gone")
+	c.probe(addr, linkRes, "", nil)
+	select {
+	case got := <-failures:
+		if got != addr {
+			t.Errorf("got failure of %+v, want %+v", got, addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the failure to be notified")
+	}
+	if _, _, err := c.get(addr, nil, "", nil, nil); err != tcpip.ErrNoLinkAddress {
+		t.Errorf("c.get(%q), got error: %v, want: error ErrNoLinkAddress", string(addr.Addr), err)
+	}
+}
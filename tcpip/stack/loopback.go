@@ -0,0 +1,75 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// SetLoopbackFastPath enables or disables the loopback fast path. When it is
+// enabled, the packets network endpoints write to a NIC created with
+// CreateNamedLoopbackNIC are handed straight to the network endpoint of their
+// destination address, instead of going through the link endpoint, which must
+// re-parse them to find it. The packets are still passed to the capture sinks
+// and counted in the NIC stats, but link endpoints wrapping the loopback one,
+// like a sniffer, don't see them.
+func (s *Stack) SetLoopbackFastPath(enable bool) {
+	var v uint32
+	if enable {
+		v = 1
+	}
+	atomic.StoreUint32(&s.loopbackFastPath, v)
+}
+
+// LoopbackFastPath returns whether the loopback fast path is enabled.
+func (s *Stack) LoopbackFastPath() bool {
+	return atomic.LoadUint32(&s.loopbackFastPath) != 0
+}
+
+// deliverLoopback delivers the outbound packet out, written to the loopback NIC
+// n through r, to the network endpoint of its destination.
+func (n *NIC) deliverLoopback(r *Route, out *PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	pkt := NewPacketBuffer(out.ToVectorisedView())
+	defer pkt.DecRef()
+	n.capture(false /* inbound */, protocol, pkt.Data)
+
+	ref := n.getRef(protocol, r.RemoteAddress)
+	if ref == nil || !n.isUp() {
+		// Let the regular path handle the packet, e.g. to forward or
+		// drop it.
+		if ref != nil {
+			ref.decRef()
+		}
+		var c refCache
+		n.deliverPacketBuffer(n.linkEP, "", protocol, pkt, &c)
+		c.release()
+		return nil
+	}
+	defer ref.decRef()
+
+	n.capture(true /* inbound */, protocol, pkt.Data)
+	n.stats.Rx.Packets.Increment()
+	n.stats.Rx.Bytes.IncrementBy(uint64(pkt.Data.Size()))
+	if protocol == header.IPv4ProtocolNumber || protocol == header.IPv6ProtocolNumber {
+		n.stack.stats.IP.PacketsReceived.Increment()
+	}
+
+	rr := makeRoute(protocol, r.RemoteAddress, r.LocalAddress, n.linkEP.LinkAddress(), ref, false /* handleLocal */, false /* multicastLoop */)
+	ref.ep.HandlePacket(&rr, pkt)
+	return nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// MulticastOutput is a NIC a multicast route forwards packets out of.
+type MulticastOutput struct {
+	// NIC is the ID of the NIC.
+	NIC tcpip.NICID
+
+	// TTLThreshold is the TTL, or hop limit, packets must exceed to be
+	// forwarded out of NIC, to limit their scope.
+	TTLThreshold uint8
+}
+
+// MulticastRoute is an entry of the multicast forwarding cache, which tells
+// where the packets from a source to a multicast group are forwarded.
+type MulticastRoute struct {
+	// InputNIC is the ID of the NIC packets must arrive on to be forwarded,
+	// or 0 to accept them from any NIC.
+	InputNIC tcpip.NICID
+
+	// Outputs are the NICs packets are forwarded out of. Packets are never
+	// sent back out of the NIC they arrived on.
+	Outputs []MulticastOutput
+}
+
+// multicastRouteKey identifies an entry of the multicast forwarding cache.
+// The source is empty for the entries of any source.
+type multicastRouteKey struct {
+	source tcpip.Address
+	group  tcpip.Address
+}
+
+// AddMulticastRoute adds to the multicast forwarding cache the route of the
+// packets from source to group, replacing any existing one. An empty source
+// makes the route apply to all sources without a route of their own.
+//
+// Multicast packets are only forwarded, as the cache says, while forwarding
+// is enabled. They are never forwarded through the unicast route table, nor
+// when they are destined to link-local groups.
+func (s *Stack) AddMulticastRoute(source, group tcpip.Address, route MulticastRoute) *tcpip.Error {
+	if !header.IsV4MulticastAddress(group) && !header.IsV6MulticastAddress(group) {
+		return tcpip.ErrBadAddress
+	}
+	if source != "" && (len(source) != len(group) || header.IsV4MulticastAddress(source) || header.IsV6MulticastAddress(source)) {
+		return tcpip.ErrBadAddress
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.nics[route.InputNIC]; route.InputNIC != 0 && !ok {
+		return tcpip.ErrUnknownNICID
+	}
+	for _, out := range route.Outputs {
+		if _, ok := s.nics[out.NIC]; !ok {
+			return tcpip.ErrUnknownNICID
+		}
+	}
+
+	route.Outputs = append([]MulticastOutput(nil), route.Outputs...)
+	if s.multicastRoutes == nil {
+		s.multicastRoutes = make(map[multicastRouteKey]MulticastRoute)
+	}
+	s.multicastRoutes[multicastRouteKey{source, group}] = route
+	return nil
+}
+
+// RemoveMulticastRoute removes the route of the packets from source to group
+// from the multicast forwarding cache.
+func (s *Stack) RemoveMulticastRoute(source, group tcpip.Address) *tcpip.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := multicastRouteKey{source, group}
+	if _, ok := s.multicastRoutes[key]; !ok {
+		return tcpip.ErrBadAddress
+	}
+	delete(s.multicastRoutes, key)
+	return nil
+}
+
+// MulticastRoute returns the route of the packets from source to group in the
+// multicast forwarding cache, if any.
+func (s *Stack) MulticastRoute(source, group tcpip.Address) (MulticastRoute, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	route, ok := s.multicastRoutes[multicastRouteKey{source, group}]
+	route.Outputs = append([]MulticastOutput(nil), route.Outputs...)
+	return route, ok
+}
+
+// forwardMulticast forwards a copy of the multicast packet vv, from src to
+// group and received by the NIC n, out of each NIC its multicast route gives.
+// vv itself is left untouched, so that it can still be delivered locally.
+func (s *Stack) forwardMulticast(n *NIC, protocol tcpip.NetworkProtocolNumber, src, group tcpip.Address, vv buffer.VectorisedView) {
+	if !forwardableMulticast(group) {
+		return
+	}
+	ttl, ok := packetTTL(protocol, vv.First())
+	if !ok {
+		return
+	}
+
+	s.mu.RLock()
+	route, ok := s.multicastRoutes[multicastRouteKey{src, group}]
+	if !ok {
+		route, ok = s.multicastRoutes[multicastRouteKey{"", group}]
+	}
+	s.mu.RUnlock()
+	if !ok {
+		s.stats.IP.MulticastNoRoute.Increment()
+		return
+	}
+	if route.InputNIC != 0 && route.InputNIC != n.id {
+		s.stats.IP.MulticastWrongInput.Increment()
+		return
+	}
+	if ttl <= 1 {
+		n.recordDrop(tcpip.DropTTLExpired, protocol, vv)
+		return
+	}
+
+	vrf := n.vrfID()
+	for _, out := range route.Outputs {
+		if out.NIC == n.id || ttl <= out.TTLThreshold {
+			continue
+		}
+		r, err := s.FindRouteInVRF(vrf, out.NIC, "", group, protocol, false /* multicastLoop */)
+		if err != nil {
+			continue
+		}
+		if _, err := r.Resolve(nil); err == nil {
+			r.ref.nic.forwardMulticastCopy(&r, protocol, vv)
+		}
+		r.Release()
+	}
+}
+
+// forwardMulticastCopy sends a copy of the multicast packet vv out of n
+// through the route r, with its TTL decremented.
+func (n *NIC) forwardMulticastCopy(r *Route, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	v := buffer.NewView(vv.Size())
+	off := 0
+	for _, view := range vv.Views() {
+		off += copy(v[off:], view)
+	}
+	decrementTTL(protocol, v)
+
+	pkt := NewOutboundPacketBuffer(buffer.NewPrependableFromView(v), buffer.VectorisedView{})
+	defer pkt.DecRef()
+	size := pkt.Size()
+	if err := n.writeEP.WritePacket(r, pkt, protocol); err != nil {
+		r.Stats().IP.OutgoingPacketErrors.Increment()
+		n.stats.Tx.Errors.Increment()
+		r.recordWriteDrop(tcpip.DropWriteError, pkt)
+		return
+	}
+	n.stack.stats.IP.MulticastPacketsForwarded.Increment()
+	n.stats.Tx.Packets.Increment()
+	n.stats.Tx.Bytes.IncrementBy(uint64(size))
+}
+
+// forwardableMulticast returns whether packets to the multicast group may be
+// forwarded: those to the groups of the IPv4 local network control block,
+// RFC 5771 section 4, and to IPv6 groups of interface or link-local scope,
+// RFC 4291 section 2.7, never leave their link.
+func forwardableMulticast(group tcpip.Address) bool {
+	if header.IsV4MulticastAddress(group) {
+		return group[0] != 224 || group[1] != 0 || group[2] != 0
+	}
+	return header.IsV6MulticastAddress(group) && group[1]&0xf > 2
+}
+
+// packetTTL returns the TTL or hop limit of the IPv4 or IPv6 packet whose
+// header is in h.
+func packetTTL(protocol tcpip.NetworkProtocolNumber, h buffer.View) (uint8, bool) {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		if len(h) < header.IPv4MinimumSize {
+			return 0, false
+		}
+		return header.IPv4(h).TTL(), true
+	case header.IPv6ProtocolNumber:
+		if len(h) < header.IPv6MinimumSize {
+			return 0, false
+		}
+		return header.IPv6(h).HopLimit(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/flow"
+)
+
+// deadNextHopTimeout is how long the gateway of a multipath route is left out
+// of it after its link address couldn't be resolved, before it's tried again.
+const deadNextHopTimeout = 30 * time.Second
+
+// destinationHash returns the hash used to select the next hop of multipath
+// routes for the packets sent by the stack to dst. It only depends on dst, so
+// that the path of a connection doesn't change when its route is found again
+// once its local address is known.
+func (s *Stack) destinationHash(netProto tcpip.NetworkProtocolNumber, dst tcpip.Address) uint32 {
+	return flow.Key{NetProto: netProto, Dst: dst}.Hash(flow.Addresses, s.multipathSeed)
+}
+
+// selectNextHopLocked returns the route used for the flow with the given hash
+// among the unicast routes of table that have the same Destination and Mask as
+// table[0], the first route matching the flow's destination, and that go
+// through a NIC of the VRF that is up, and is id if it's not zero. Routes
+// whose gateway is dead are left out, unless they all are. Each route gets a
+// share of the flows proportional to its weight. s.mu must be held.
+func (s *Stack) selectNextHopLocked(table []tcpip.Route, vrf tcpip.VRFID, id tcpip.NICID, hash uint32) tcpip.Route {
+	first := table[0]
+	var live, dead []tcpip.Route
+	now := s.clock.NowMonotonic()
+	for _, route := range table {
+		if route.Type != tcpip.RouteUnicast || route.Destination != first.Destination || route.Mask != first.Mask {
+			continue
+		}
+		if (id != 0 && id != route.NIC) || s.nicVRFLocked(route.NIC) != vrf {
+			continue
+		}
+		if nic, ok := s.nics[route.NIC]; !ok || !nic.isUp() {
+			continue
+		}
+		if s.nextHopDeadLocked(route, now) {
+			dead = append(dead, route)
+		} else {
+			live = append(live, route)
+		}
+	}
+	if len(live) == 0 {
+		live = dead
+	}
+	switch len(live) {
+	case 0:
+		return first
+	case 1:
+		return live[0]
+	}
+
+	total := uint32(0)
+	for _, route := range live {
+		total += routeWeight(route)
+	}
+	n := hash % total
+	for _, route := range live {
+		if w := routeWeight(route); n >= w {
+			n -= w
+		} else {
+			return route
+		}
+	}
+	panic("unreachable")
+}
+
+// routeWeight returns the weight of route in its multipath route.
+func routeWeight(route tcpip.Route) uint32 {
+	if route.Weight <= 0 {
+		return 1
+	}
+	return uint32(route.Weight)
+}
+
+// nextHopDeadLocked returns whether the gateway of route is dead at monotonic
+// time now. s.mu must be held.
+func (s *Stack) nextHopDeadLocked(route tcpip.Route, now int64) bool {
+	if route.Gateway == "" {
+		return false
+	}
+	expires, ok := s.deadNextHops[tcpip.FullAddress{NIC: route.NIC, Addr: route.Gateway}]
+	return ok && now < expires
+}
+
+// markNextHopDead is called when the link address of addr couldn't be
+// resolved. If it's the gateway of a multipath route, it's left out of the
+// route until deadNextHopTimeout elapses or it's resolved again.
+func (s *Stack) markNextHopDead(addr tcpip.FullAddress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	multipath := false
+	for i, route := range s.routeTable {
+		if route.Type != tcpip.RouteUnicast || route.NIC != addr.NIC || route.Gateway != addr.Addr {
+			continue
+		}
+		for j, other := range s.routeTable {
+			if j != i && other.Type == tcpip.RouteUnicast && other.Destination == route.Destination && other.Mask == route.Mask {
+				multipath = true
+				break
+			}
+		}
+	}
+	if !multipath {
+		return
+	}
+
+	now := s.clock.NowMonotonic()
+	if s.deadNextHops == nil {
+		s.deadNextHops = make(map[tcpip.FullAddress]int64)
+	}
+	for a, expires := range s.deadNextHops {
+		if now >= expires {
+			delete(s.deadNextHops, a)
+		}
+	}
+	s.deadNextHops[addr] = now + int64(deadNextHopTimeout)
+	s.stats.IP.DeadNextHops.Increment()
+	s.invalidateRoutes()
+}
+
+// reviveNextHop is called when the link address of addr was resolved, so that
+// it is used again by the multipath routes it was left out of.
+func (s *Stack) reviveNextHop(addr tcpip.FullAddress) {
+	s.mu.RLock()
+	_, dead := s.deadNextHops[addr]
+	s.mu.RUnlock()
+	if !dead {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.deadNextHops[addr]; ok {
+		delete(s.deadNextHops, addr)
+		s.invalidateRoutes()
+	}
+}
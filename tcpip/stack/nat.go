@@ -0,0 +1,461 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/flow"
+	"github.com/google/netstack/tcpip/header"
+)
+
+const (
+	// maxNATConns is the maximum number of translated flows tracked at
+	// once. The packets of new flows matching a rule are dropped while the
+	// table is full.
+	maxNATConns = 16384
+
+	// natConnExpiration is how long a translated flow is tracked after its
+	// last packet.
+	natConnExpiration = 5 * time.Minute
+)
+
+// NATRule is a destination NAT rule, the analogue of an iptables DNAT or
+// REDIRECT rule of the nat PREROUTING chain: it rewrites the destination of
+// the TCP or UDP flows it matches as they are received, and their source back
+// in the packets sent in reply.
+type NATRule struct {
+	// NIC is the NIC the packets must be received on, or zero for any.
+	NIC tcpip.NICID
+
+	// Protocol is the transport protocol of the packets, either TCP or
+	// UDP.
+	Protocol tcpip.TransportProtocolNumber
+
+	// Destination is the subnet the destination address of the packets
+	// must be in. Its address also selects the network protocol of the
+	// rule.
+	Destination tcpip.Subnet
+
+	// DestinationPort is the destination port of the packets, or zero for
+	// any.
+	DestinationPort uint16
+
+	// ToAddress is the address the packets are redirected to. If it is
+	// empty, they are redirected to the primary address of the NIC they
+	// were received on, like REDIRECT.
+	ToAddress tcpip.Address
+
+	// ToPort is the port the packets are redirected to, or zero to keep
+	// their destination port.
+	ToPort uint16
+}
+
+// matches returns whether the packet of flow k received on nic matches r.
+func (r *NATRule) matches(nic tcpip.NICID, k flow.Key) bool {
+	return (r.NIC == 0 || r.NIC == nic) &&
+		r.Protocol == k.TransProto &&
+		len(r.Destination.ID()) == len(k.Dst) &&
+		r.Destination.Contains(k.Dst) &&
+		(r.DestinationPort == 0 || r.DestinationPort == k.DstPort)
+}
+
+// natConn is a translated flow.
+type natConn struct {
+	// original is the flow as received, and reply the flow of the packets
+	// sent in reply, from the translated destination.
+	original flow.Key
+	reply    flow.Key
+
+	// updated is the monotonic time of the last packet of the flow.
+	updated int64
+}
+
+// natTable holds the destination NAT rules and the flows they translated, the
+// analogue of conntrack.
+//
+// This struct is safe for concurrent use.
+type natTable struct {
+	clock tcpip.Clock
+
+	// inUse is a boolean (0 is false), set while there are rules or
+	// translated flows, so that packets don't take mu otherwise. It must
+	// be accessed atomically.
+	inUse uint32
+
+	mu    sync.Mutex
+	rules []NATRule
+
+	// conns and replies index the translated flows by their original and
+	// reply keys.
+	conns   map[flow.Key]*natConn
+	replies map[flow.Key]*natConn
+}
+
+func newNATTable(clock tcpip.Clock) *natTable {
+	return &natTable{
+		clock:   clock,
+		conns:   make(map[flow.Key]*natConn),
+		replies: make(map[flow.Key]*natConn),
+	}
+}
+
+func (t *natTable) active() bool {
+	return atomic.LoadUint32(&t.inUse) != 0
+}
+
+// updateInUseLocked updates t.inUse.
+//
+// Precondition: t.mu must be held.
+func (t *natTable) updateInUseLocked() {
+	var v uint32
+	if len(t.rules) != 0 || len(t.conns) != 0 {
+		v = 1
+	}
+	atomic.StoreUint32(&t.inUse, v)
+}
+
+func (t *natTable) expired(c *natConn, now int64) bool {
+	return time.Duration(now-c.updated) >= natConnExpiration
+}
+
+// removeLocked forgets the translated flow c.
+//
+// Precondition: t.mu must be held.
+func (t *natTable) removeLocked(c *natConn) {
+	delete(t.conns, c.original)
+	delete(t.replies, c.reply)
+}
+
+// evictLocked forgets the expired flows.
+//
+// Precondition: t.mu must be held.
+func (t *natTable) evictLocked(now int64) {
+	for _, c := range t.conns {
+		if t.expired(c, now) {
+			t.removeLocked(c)
+		}
+	}
+}
+
+// translate returns the destination address and port the received packet of
+// flow k must be rewritten to, and whether it is translated at all. to is the
+// address redirected to by rules without a ToAddress. ok is false if the
+// packet must be dropped.
+func (t *natTable) translate(nic tcpip.NICID, k flow.Key, to func() tcpip.Address) (dst tcpip.Address, port uint16, translated, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.NowMonotonic()
+	if c := t.conns[k]; c != nil {
+		if !t.expired(c, now) {
+			c.updated = now
+			return c.reply.Src, c.reply.SrcPort, true, true
+		}
+		t.removeLocked(c)
+	}
+
+	var rule *NATRule
+	for i := range t.rules {
+		if t.rules[i].matches(nic, k) {
+			rule = &t.rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		t.updateInUseLocked()
+		return "", 0, false, true
+	}
+
+	dst, port = rule.ToAddress, rule.ToPort
+	if dst == "" {
+		if dst = to(); dst == "" {
+			return "", 0, false, false
+		}
+	}
+	if port == 0 {
+		port = k.DstPort
+	}
+	c := &natConn{
+		original: k,
+		reply: flow.Key{
+			NetProto:   k.NetProto,
+			TransProto: k.TransProto,
+			Src:        dst,
+			Dst:        k.Src,
+			SrcPort:    port,
+			DstPort:    k.SrcPort,
+		},
+		updated: now,
+	}
+
+	// Another flow may already be translated to the same one, which
+	// replies couldn't be told apart from.
+	if o := t.replies[c.reply]; o != nil {
+		if !t.expired(o, now) {
+			return "", 0, false, false
+		}
+		t.removeLocked(o)
+	}
+	if len(t.conns) >= maxNATConns {
+		t.evictLocked(now)
+		if len(t.conns) >= maxNATConns {
+			return "", 0, false, false
+		}
+	}
+	t.conns[k] = c
+	t.replies[c.reply] = c
+	t.updateInUseLocked()
+	return dst, port, true, true
+}
+
+// original returns the original destination of the translated flow whose
+// replies are sent as k.
+func (t *natTable) original(k flow.Key) (tcpip.Address, uint16, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.replies[k]
+	if c == nil {
+		return "", 0, false
+	}
+	now := t.clock.NowMonotonic()
+	if t.expired(c, now) {
+		t.removeLocked(c)
+		t.updateInUseLocked()
+		return "", 0, false
+	}
+	c.updated = now
+	return c.original.Dst, c.original.DstPort, true
+}
+
+// SetNATRules replaces the destination NAT rules of the stack. The first rule
+// matching a packet applies. Flows that were already translated keep their
+// translation until they expire, 5 minutes after their last packet.
+//
+// Only unfragmented packets whose transport header follows the network
+// header directly are translated.
+func (s *Stack) SetNATRules(rules []NATRule) *tcpip.Error {
+	for _, r := range rules {
+		if r.Protocol != header.TCPProtocolNumber && r.Protocol != header.UDPProtocolNumber {
+			return tcpip.ErrUnknownProtocol
+		}
+		if r.ToAddress != "" && len(r.ToAddress) != len(r.Destination.ID()) {
+			return tcpip.ErrBadAddress
+		}
+	}
+
+	t := s.nat
+	t.mu.Lock()
+	t.rules = append([]NATRule(nil), rules...)
+	t.updateInUseLocked()
+	t.mu.Unlock()
+	return nil
+}
+
+// NATRules returns the destination NAT rules of the stack.
+func (s *Stack) NATRules() []NATRule {
+	t := s.nat
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]NATRule(nil), t.rules...)
+}
+
+// OriginalDestination returns the destination address and port that the flow
+// received by a transport endpoint with the given id was sent to, before a
+// destination NAT rule rewrote it, and whether it was rewritten at all. This
+// is what transparent proxies read with SO_ORIGINAL_DST on Linux.
+func (s *Stack) OriginalDestination(netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, id TransportEndpointID) (tcpip.FullAddress, bool) {
+	if !s.nat.active() {
+		return tcpip.FullAddress{}, false
+	}
+	addr, port, ok := s.nat.original(flow.Key{
+		NetProto:   netProto,
+		TransProto: transProto,
+		Src:        id.LocalAddress,
+		Dst:        id.RemoteAddress,
+		SrcPort:    id.LocalPort,
+		DstPort:    id.RemotePort,
+	})
+	if !ok {
+		return tcpip.FullAddress{}, false
+	}
+	return tcpip.FullAddress{Addr: addr, Port: port}, true
+}
+
+// natHeaders returns the network and transport headers of the packet of the
+// given protocol and size, whose first view is b, if it can be translated.
+func natHeaders(protocol tcpip.NetworkProtocolNumber, b []byte, size int) (network, transport []byte, transProto tcpip.TransportProtocolNumber, ok bool) {
+	var off int
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		h := header.IPv4(b)
+		if !h.IsValid(size) || h.Flags()&header.IPv4FlagMoreFragments != 0 || h.FragmentOffset() != 0 {
+			return nil, nil, 0, false
+		}
+		off = int(h.HeaderLength())
+		transProto = h.TransportProtocol()
+	case header.IPv6ProtocolNumber:
+		h := header.IPv6(b)
+		if !h.IsValid(size) {
+			return nil, nil, 0, false
+		}
+		off = header.IPv6MinimumSize
+		transProto = h.TransportProtocol()
+	default:
+		return nil, nil, 0, false
+	}
+
+	switch transProto {
+	case header.TCPProtocolNumber:
+		if len(b)-off < header.TCPMinimumSize {
+			return nil, nil, 0, false
+		}
+	case header.UDPProtocolNumber:
+		if len(b)-off < header.UDPMinimumSize {
+			return nil, nil, 0, false
+		}
+	default:
+		return nil, nil, 0, false
+	}
+	return b[:off], b[off:], transProto, true
+}
+
+// rewritePort rewrites the source or destination port of the transport header
+// b to port, and updates its checksum for that and for the change of the
+// address of the pseudo-header from oldAddr to newAddr.
+func rewritePort(transProto tcpip.TransportProtocolNumber, b []byte, source bool, port uint16, oldAddr, newAddr tcpip.Address) {
+	switch transProto {
+	case header.TCPProtocolNumber:
+		h := header.TCP(b)
+		old := h.DestinationPort()
+		if source {
+			old = h.SourcePort()
+			h.SetSourcePort(port)
+		} else {
+			h.SetDestinationPort(port)
+		}
+		xsum := header.ChecksumUpdateAddress(h.Checksum(), oldAddr, newAddr)
+		h.SetChecksum(header.ChecksumUpdate(xsum, old, port))
+	case header.UDPProtocolNumber:
+		h := header.UDP(b)
+		old := h.DestinationPort()
+		if source {
+			old = h.SourcePort()
+			h.SetSourcePort(port)
+		} else {
+			h.SetDestinationPort(port)
+		}
+		// A zero checksum means that there is none.
+		if xsum := h.Checksum(); xsum != 0 {
+			xsum = header.ChecksumUpdateAddress(xsum, oldAddr, newAddr)
+			xsum = header.ChecksumUpdate(xsum, old, port)
+			if xsum == 0 {
+				xsum = 0xffff
+			}
+			h.SetChecksum(xsum)
+		}
+	}
+}
+
+// translateInbound applies the destination NAT rules to the packet of the given
+// protocol received by the NIC, and returns its destination address after
+// translation. It returns false if the packet must be dropped.
+func (n *NIC) translateInbound(protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView, dst tcpip.Address) (tcpip.Address, bool) {
+	b := vv.First()
+	network, transport, transProto, ok := natHeaders(protocol, b, vv.Size())
+	if !ok {
+		return dst, true
+	}
+	k, ok := flow.Dissect(protocol, b)
+	if !ok || k.TransProto != transProto {
+		return dst, true
+	}
+
+	newDst, port, translated, ok := n.stack.nat.translate(n.id, k, func() tcpip.Address {
+		ref := n.primaryEndpoint(protocol)
+		if ref == nil {
+			return ""
+		}
+		defer ref.decRef()
+		return ref.ep.ID().LocalAddress
+	})
+	if !ok || !translated {
+		return dst, ok
+	}
+
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		h := header.IPv4(network)
+		h.SetChecksum(header.ChecksumUpdateAddress(h.Checksum(), dst, newDst))
+		h.SetDestinationAddress(newDst)
+	case header.IPv6ProtocolNumber:
+		header.IPv6(network).SetDestinationAddress(newDst)
+	}
+	rewritePort(transProto, transport, false /* source */, port, dst, newDst)
+	return newDst, true
+}
+
+// translateOutbound rewrites the source of the packet that r is about to send
+// if it replies to a flow translated by a destination NAT rule. pkt.Header
+// starts with the transport header of the packet. It returns the route to send
+// the packet with, whose local address is the original destination of the
+// flow.
+func (r *Route) translateOutbound(pkt *PacketBuffer, transProto tcpip.TransportProtocolNumber) (Route, bool) {
+	b := pkt.Header.View()
+	var srcPort, dstPort uint16
+	switch transProto {
+	case header.TCPProtocolNumber:
+		if len(b) < header.TCPMinimumSize {
+			return Route{}, false
+		}
+		srcPort, dstPort = header.TCP(b).SourcePort(), header.TCP(b).DestinationPort()
+	case header.UDPProtocolNumber:
+		if len(b) < header.UDPMinimumSize {
+			return Route{}, false
+		}
+		srcPort, dstPort = header.UDP(b).SourcePort(), header.UDP(b).DestinationPort()
+	default:
+		return Route{}, false
+	}
+
+	addr, port, ok := r.ref.nic.stack.nat.original(flow.Key{
+		NetProto:   r.NetProto,
+		TransProto: transProto,
+		Src:        r.LocalAddress,
+		Dst:        r.RemoteAddress,
+		SrcPort:    srcPort,
+		DstPort:    dstPort,
+	})
+	if !ok {
+		return Route{}, false
+	}
+
+	// Checksums are left to the NIC if it offloads them.
+	if r.Capabilities()&CapabilityChecksumOffload == 0 {
+		rewritePort(transProto, b, true /* source */, port, r.LocalAddress, addr)
+	} else if transProto == header.TCPProtocolNumber {
+		header.TCP(b).SetSourcePort(port)
+	} else {
+		header.UDP(b).SetSourcePort(port)
+	}
+	translated := *r
+	translated.LocalAddress = addr
+	return translated, true
+}
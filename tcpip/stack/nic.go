@@ -22,6 +22,7 @@ import (
 	"github.com/google/netstack/ilist"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/flow"
 	"github.com/google/netstack/tcpip/header"
 )
 
@@ -34,14 +35,37 @@ type NIC struct {
 	linkEP   LinkEndpoint
 	loopback bool
 
+	// writeEP wraps linkEP to capture the packets written to it. It is
+	// the endpoint packets are written to.
+	writeEP LinkEndpoint
+
 	demux *transportDemuxer
 
 	mu          sync.RWMutex
+	vrf         tcpip.VRFID
+	vrfDemux    *transportDemuxer
 	spoofing    bool
 	promiscuous bool
-	primary     map[tcpip.NetworkProtocolNumber]*ilist.List
-	endpoints   map[NetworkEndpointID]*referencedNetworkEndpoint
-	subnets     []tcpip.Subnet
+	transparent bool
+
+	// rcvHostModel and sndHostModel are the host models used to receive
+	// and send packets, see Stack.SetNICHostModel.
+	rcvHostModel HostModel
+	sndHostModel HostModel
+
+	primary   map[tcpip.NetworkProtocolNumber]*ilist.List
+	endpoints map[NetworkEndpointID]*referencedNetworkEndpoint
+	subnets   []tcpip.Subnet
+
+	// up is the administrative state of the NIC, as set by Stack.SetNICUp.
+	up bool
+
+	// lowerUp is the carrier state last reported by the link endpoint.
+	lowerUp bool
+
+	// removed is set once the NIC was removed from the stack. A removed NIC
+	// is down and has no addresses.
+	removed bool
 
 	stats NICStats
 }
@@ -56,6 +80,11 @@ type NICStats struct {
 type DirectionStats struct {
 	Packets *tcpip.StatCounter
 	Bytes   *tcpip.StatCounter
+
+	// Errors counts the packets that couldn't be sent, or that were
+	// received but dropped because they were malformed or of an unknown
+	// network protocol.
+	Errors *tcpip.StatCounter
 }
 
 // PrimaryEndpointBehavior is an enumeration of an endpoint's primacy behavior.
@@ -78,26 +107,33 @@ const (
 )
 
 func newNIC(stack *Stack, id tcpip.NICID, name string, ep LinkEndpoint, loopback bool) *NIC {
-	return &NIC{
+	n := &NIC{
 		stack:     stack,
 		id:        id,
 		name:      name,
 		linkEP:    ep,
 		loopback:  loopback,
+		up:        true,
+		lowerUp:   true,
 		demux:     newTransportDemuxer(stack),
+		vrfDemux:  stack.demux,
 		primary:   make(map[tcpip.NetworkProtocolNumber]*ilist.List),
 		endpoints: make(map[NetworkEndpointID]*referencedNetworkEndpoint),
 		stats: NICStats{
 			Tx: DirectionStats{
 				Packets: &tcpip.StatCounter{},
 				Bytes:   &tcpip.StatCounter{},
+				Errors:  &tcpip.StatCounter{},
 			},
 			Rx: DirectionStats{
 				Packets: &tcpip.StatCounter{},
 				Bytes:   &tcpip.StatCounter{},
+				Errors:  &tcpip.StatCounter{},
 			},
 		},
 	}
+	n.writeEP = &captureLinkEndpoint{LinkEndpoint: ep, nic: n}
+	return n
 }
 
 // attachLinkEndpoint attaches the NIC to the endpoint, which will enable it
@@ -127,6 +163,104 @@ func (n *NIC) setSpoofing(enable bool) {
 	n.mu.Unlock()
 }
 
+func (n *NIC) isSpoofing() bool {
+	n.mu.RLock()
+	rv := n.spoofing
+	n.mu.RUnlock()
+	return rv
+}
+
+// setTransparent enables or disables transparent mode.
+func (n *NIC) setTransparent(enable bool) {
+	n.mu.Lock()
+	n.transparent = enable
+	n.mu.Unlock()
+}
+
+func (n *NIC) isTransparent() bool {
+	n.mu.RLock()
+	rv := n.transparent
+	n.mu.RUnlock()
+	return rv
+}
+
+// setVRF assigns the NIC to a VRF, whose endpoints that aren't bound to a NIC
+// are registered with demux.
+func (n *NIC) setVRF(vrf tcpip.VRFID, demux *transportDemuxer) {
+	n.mu.Lock()
+	n.vrf = vrf
+	n.vrfDemux = demux
+	n.mu.Unlock()
+}
+
+// vrfID returns the VRF the NIC belongs to.
+func (n *NIC) vrfID() tcpip.VRFID {
+	n.mu.RLock()
+	rv := n.vrf
+	n.mu.RUnlock()
+	return rv
+}
+
+// transportDemux returns the demuxer of the endpoints of the NIC's VRF that
+// aren't bound to a NIC.
+func (n *NIC) transportDemux() *transportDemuxer {
+	n.mu.RLock()
+	rv := n.vrfDemux
+	n.mu.RUnlock()
+	return rv
+}
+
+// setUp sets the administrative state of the NIC. It returns whether the
+// operational state of the NIC changed as a result.
+func (n *NIC) setUp(up bool) bool {
+	n.mu.Lock()
+	was := n.up && n.lowerUp
+	n.up = up
+	now := n.up && n.lowerUp
+	n.mu.Unlock()
+	return was != now
+}
+
+// isUp returns whether the NIC is operationally up, that is, whether it is
+// administratively up and its link endpoint has carrier.
+func (n *NIC) isUp() bool {
+	n.mu.RLock()
+	rv := n.up && n.lowerUp
+	n.mu.RUnlock()
+	return rv
+}
+
+// linkState returns the administrative and carrier states of the NIC.
+func (n *NIC) linkState() (up, lowerUp bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.up, n.lowerUp
+}
+
+// DeliverLinkState implements LinkStateDispatcher.DeliverLinkState. It records
+// the carrier state of the link endpoint and notifies the stack's link state
+// subscribers if the operational state of the NIC changed.
+func (n *NIC) DeliverLinkState(up bool) {
+	n.mu.Lock()
+	was := n.up && n.lowerUp
+	n.lowerUp = up
+	now := n.up && n.lowerUp
+	n.mu.Unlock()
+	if was != now {
+		n.stack.notifyLinkState(LinkStateEvent{NIC: n.id, Up: now})
+	}
+}
+
+// DeliverLinkDrop implements LinkDropDispatcher.DeliverLinkDrop. It accounts
+// for a frame that the link endpoint dropped before it could be delivered.
+func (n *NIC) DeliverLinkDrop(reason tcpip.DropReason, frame buffer.VectorisedView) {
+	if reason == tcpip.DropMalformed {
+		n.stack.stats.MalformedRcvdFrames.Increment()
+	}
+	n.stats.Rx.Errors.Increment()
+	n.recordDrop(reason, 0 /* protocol */, frame)
+}
+
 func (n *NIC) getMainNICAddress(protocol tcpip.NetworkProtocolNumber) (tcpip.Address, tcpip.Subnet, *tcpip.Error) {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
@@ -204,12 +338,17 @@ func (n *NIC) findEndpoint(protocol tcpip.NetworkProtocolNumber, address tcpip.A
 	if ref != nil || !spoofing {
 		return ref
 	}
+	return n.getTemporaryEndpoint(protocol, address, peb)
+}
+
+// getTemporaryEndpoint returns the endpoint with the given address, creating a
+// new "temporary" one if it doesn't exist. It will only exist while there's a
+// route through it.
+func (n *NIC) getTemporaryEndpoint(protocol tcpip.NetworkProtocolNumber, address tcpip.Address, peb PrimaryEndpointBehavior) *referencedNetworkEndpoint {
+	id := NetworkEndpointID{address}
 
-	// Try again with the lock in exclusive mode. If we still can't get the
-	// endpoint, create a new "temporary" endpoint. It will only exist while
-	// there's a route through it.
 	n.mu.Lock()
-	ref = n.endpoints[id]
+	ref := n.endpoints[id]
 	if ref == nil || !ref.tryIncRef() {
 		ref, _ = n.addAddressLocked(protocol, address, peb, true)
 		if ref != nil {
@@ -227,13 +366,25 @@ func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.
 	}
 
 	// Create the new network endpoint.
-	ep, err := netProto.NewEndpoint(n.id, addr, n.stack, n, n.linkEP)
+	ep, err := netProto.NewEndpoint(n.id, addr, n.stack, n.stack.clock, n, n.writeEP)
 	if err != nil {
 		return nil, err
 	}
 
 	id := *ep.ID()
 	if ref, ok := n.endpoints[id]; ok {
+		// The address was removed but routes still use its endpoint:
+		// revive it instead of closing it under them.
+		if !ref.holdsInsertRef && ref.tryIncRef() {
+			ep.Close()
+			ref.holdsInsertRef = true
+			if l := n.primary[ref.protocol]; ref.Next() != nil || ref.Prev() != nil || ref == l.Front() {
+				l.Remove(ref)
+			}
+			n.insertPrimaryEndpointLocked(ref, peb)
+			return ref, nil
+		}
+
 		if !replace {
 			return nil, tcpip.ErrDuplicateAddress
 		}
@@ -257,21 +408,26 @@ func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.
 	}
 
 	n.endpoints[id] = ref
+	n.insertPrimaryEndpointLocked(ref, peb)
+
+	return ref, nil
+}
 
-	l, ok := n.primary[protocol]
+// insertPrimaryEndpointLocked adds r to the list of primary endpoints of its
+// protocol, as specified by peb.
+func (n *NIC) insertPrimaryEndpointLocked(r *referencedNetworkEndpoint, peb PrimaryEndpointBehavior) {
+	l, ok := n.primary[r.protocol]
 	if !ok {
 		l = &ilist.List{}
-		n.primary[protocol] = l
+		n.primary[r.protocol] = l
 	}
 
 	switch peb {
 	case CanBePrimaryEndpoint:
-		l.PushBack(ref)
+		l.PushBack(r)
 	case FirstPrimaryEndpoint:
-		l.PushFront(ref)
+		l.PushFront(r)
 	}
-
-	return ref, nil
 }
 
 // AddAddress adds a new address to n, so that it starts accepting packets
@@ -287,10 +443,41 @@ func (n *NIC) AddAddressWithOptions(protocol tcpip.NetworkProtocolNumber, addr t
 	n.mu.Lock()
 	_, err := n.addAddressLocked(protocol, addr, peb, false)
 	n.mu.Unlock()
+	if err == nil {
+		n.stack.invalidateRoutes()
+		n.stack.publish(Event{Type: EventAddressAdded, NIC: n.id, Protocol: protocol, Address: addr})
+	}
+
+	return err
+}
+
+// AddAnycastAddress adds a new anycast address to n, so that it starts
+// accepting packets targeted at the given address (and network protocol). It
+// is never primary, and never used as source address.
+func (n *NIC) AddAnycastAddress(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) *tcpip.Error {
+	n.mu.Lock()
+	ref, err := n.addAddressLocked(protocol, addr, NeverPrimaryEndpoint, false)
+	if err == nil {
+		ref.anycast = true
+	}
+	n.mu.Unlock()
+	if err == nil {
+		n.stack.invalidateRoutes()
+		n.stack.publish(Event{Type: EventAddressAdded, NIC: n.id, Protocol: protocol, Address: addr})
+	}
 
 	return err
 }
 
+// isAnycastAddress returns whether addr is an anycast address of n for the
+// given protocol.
+func (n *NIC) isAnycastAddress(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	ref := n.endpoints[NetworkEndpointID{addr}]
+	return ref != nil && ref.protocol == protocol && ref.anycast
+}
+
 // Addresses returns the addresses associated with this NIC.
 func (n *NIC) Addresses() []tcpip.ProtocolAddress {
 	n.mu.RLock()
@@ -311,6 +498,7 @@ func (n *NIC) AddSubnet(protocol tcpip.NetworkProtocolNumber, subnet tcpip.Subne
 	n.mu.Lock()
 	n.subnets = append(n.subnets, subnet)
 	n.mu.Unlock()
+	n.stack.invalidateRoutes()
 }
 
 // RemoveSubnet removes the given subnet from n.
@@ -384,6 +572,41 @@ func (n *NIC) removeEndpoint(r *referencedNetworkEndpoint) {
 	n.mu.Unlock()
 }
 
+// remove marks n as removed from the stack and removes its addresses. The
+// network endpoints are closed once the routes using them are released.
+func (n *NIC) remove() {
+	n.mu.Lock()
+	n.removed = true
+	n.up = false
+	var refs []*referencedNetworkEndpoint
+	var handlers []NICRemovalHandler
+	for _, r := range n.endpoints {
+		if r.holdsInsertRef {
+			r.holdsInsertRef = false
+			refs = append(refs, r)
+		}
+		if h, ok := r.ep.(NICRemovalHandler); ok {
+			handlers = append(handlers, h)
+		}
+	}
+	n.subnets = nil
+	n.mu.Unlock()
+
+	for _, r := range refs {
+		r.decRef()
+	}
+	for _, h := range handlers {
+		h.HandleNICRemoval()
+	}
+}
+
+// isRemoved returns whether n was removed from the stack.
+func (n *NIC) isRemoved() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.removed
+}
+
 // RemoveAddress removes an address from n.
 func (n *NIC) RemoveAddress(addr tcpip.Address) *tcpip.Error {
 	n.mu.Lock()
@@ -397,6 +620,8 @@ func (n *NIC) RemoveAddress(addr tcpip.Address) *tcpip.Error {
 	n.mu.Unlock()
 
 	r.decRef()
+	n.stack.invalidateRoutes()
+	n.stack.publish(Event{Type: EventAddressRemoved, NIC: n.id, Protocol: r.protocol, Address: addr})
 
 	return nil
 }
@@ -407,13 +632,77 @@ func (n *NIC) RemoveAddress(addr tcpip.Address) *tcpip.Error {
 // Note that the ownership of the slice backing vv is retained by the caller.
 // This rule applies only to the slice itself, not to the items of the slice;
 // the ownership of the items is not retained by the caller.
-func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, _ tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	pkt := NewPacketBuffer(vv)
+	n.DeliverPacketBuffer(linkEP, remote, local, protocol, pkt)
+	pkt.DecRef()
+}
+
+// DeliverPacketBuffer implements PacketBufferDispatcher.DeliverPacketBuffer.
+// Network endpoints are handed pkt itself, or a copy of it with its own views
+// slice when there are several of them.
+func (n *NIC) DeliverPacketBuffer(linkEP LinkEndpoint, remote, _ tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt *PacketBuffer) {
+	var c refCache
+	n.deliverPacketBuffer(linkEP, remote, protocol, pkt, &c)
+	c.release()
+}
+
+// DeliverPacketBatch implements BatchDispatcher.DeliverPacketBatch. Runs of
+// packets destined to the same local address are handed to the network
+// endpoint found for the first of them, without looking it up again.
+func (n *NIC) DeliverPacketBatch(linkEP LinkEndpoint, pkts []InboundPacket) {
+	var c refCache
+	for _, p := range pkts {
+		n.deliverPacketBuffer(linkEP, p.Remote, p.Protocol, p.Pkt, &c)
+	}
+	c.release()
+}
+
+// refCache holds a reference on the network endpoint that handled the last
+// packet of a batch, so that it can be reused for the next one.
+type refCache struct {
+	ref      *referencedNetworkEndpoint
+	protocol tcpip.NetworkProtocolNumber
+	dst      tcpip.Address
+}
+
+// getRef is like NIC.getRef, but reuses the cached endpoint if it matches. The
+// returned reference is owned by c.
+func (c *refCache) getRef(n *NIC, protocol tcpip.NetworkProtocolNumber, dst tcpip.Address) *referencedNetworkEndpoint {
+	if c.ref != nil && c.protocol == protocol && c.dst == dst {
+		return c.ref
+	}
+	c.release()
+	if ref := n.getRef(protocol, dst); ref != nil {
+		c.ref, c.protocol, c.dst = ref, protocol, dst
+	}
+	return c.ref
+}
+
+// release drops the cached reference, if any.
+func (c *refCache) release() {
+	if c.ref != nil {
+		c.ref.decRef()
+		c.ref = nil
+	}
+}
+
+func (n *NIC) deliverPacketBuffer(linkEP LinkEndpoint, remote tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt *PacketBuffer, c *refCache) {
+	if !n.isUp() {
+		n.recordDrop(tcpip.DropNetworkDown, protocol, pkt.Data)
+		return
+	}
+
+	vv := pkt.Data
+	n.capture(true /* inbound */, protocol, vv)
 	n.stats.Rx.Packets.Increment()
 	n.stats.Rx.Bytes.IncrementBy(uint64(vv.Size()))
 
 	netProto, ok := n.stack.networkProtocols[protocol]
 	if !ok {
 		n.stack.stats.UnknownProtocolRcvdPackets.Increment()
+		n.stats.Rx.Errors.Increment()
+		n.recordDrop(tcpip.DropUnknownProtocol, protocol, vv)
 		return
 	}
 
@@ -423,6 +712,8 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, _ tcpip.LinkAddr
 
 	if len(vv.First()) < netProto.MinimumPacketSize() {
 		n.stack.stats.MalformedRcvdPackets.Increment()
+		n.stats.Rx.Errors.Increment()
+		n.recordDrop(tcpip.DropMalformed, protocol, vv)
 		return
 	}
 
@@ -430,15 +721,20 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, _ tcpip.LinkAddr
 
 	// If the packet is destined to the IPv4 Broadcast address, then make a
 	// route to each IPv4 network endpoint and let each endpoint handle the
-	// packet.
+	// packet. The endpoints of the multicast groups the NIC joined are left
+	// out, as they don't have unicast addresses of their own.
 	if dst == header.IPv4Broadcast {
 		// n.endpoints is mutex protected so acquire lock.
 		n.mu.RLock()
 		for _, ref := range n.endpoints {
-			if ref.protocol == header.IPv4ProtocolNumber && ref.tryIncRef() {
+			if ref.protocol == header.IPv4ProtocolNumber && !header.IsV4MulticastAddress(ref.ep.ID().LocalAddress) && ref.tryIncRef() {
 				r := makeRoute(protocol, dst, src, linkEP.LinkAddress(), ref, false /* handleLocal */, false /* multicastLoop */)
 				r.RemoteLinkAddress = remote
-				ref.ep.HandlePacket(&r, vv)
+				// HandlePacket consumes the packet's data, so each
+				// endpoint needs its own copy of the views.
+				c := pkt.cloneViews()
+				ref.ep.HandlePacket(&r, c)
+				c.DecRef()
 				ref.decRef()
 			}
 		}
@@ -446,22 +742,67 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, _ tcpip.LinkAddr
 		return
 	}
 
-	if ref := n.getRef(protocol, dst); ref != nil {
+	// Multicast packets are forwarded as the multicast forwarding cache
+	// says, whether or not they are also delivered locally.
+	isMulticast := header.IsV4MulticastAddress(dst) || header.IsV6MulticastAddress(dst)
+	if isMulticast && n.stack.Forwarding() {
+		n.stack.forwardMulticast(n, protocol, src, dst, pkt.Data)
+	}
+
+	// Destination NAT rules may redirect the packet to another address.
+	if n.stack.nat.active() {
+		var ok bool
+		if dst, ok = n.translateInbound(protocol, pkt.Data, dst); !ok {
+			n.recordDrop(tcpip.DropFilter, protocol, pkt.Data)
+			return
+		}
+	}
+
+	if ref := c.getRef(n, protocol, dst); ref != nil {
 		r := makeRoute(protocol, dst, src, linkEP.LinkAddress(), ref, false /* handleLocal */, false /* multicastLoop */)
 		r.RemoteLinkAddress = remote
-		ref.ep.HandlePacket(&r, vv)
-		ref.decRef()
+		ref.ep.HandlePacket(&r, pkt)
 		return
 	}
 
+	// In the weak host model, the packets destined to the addresses of
+	// the other NICs of the VRF are accepted too.
+	if n.weakHost(false /* send */) {
+		if ref := n.stack.findLocalEndpoint(n.vrfID(), protocol, dst); ref != nil {
+			r := makeRoute(protocol, dst, src, linkEP.LinkAddress(), ref, false /* handleLocal */, false /* multicastLoop */)
+			r.RemoteLinkAddress = remote
+			ref.ep.HandlePacket(&r, pkt)
+			ref.decRef()
+			return
+		}
+	}
+
+	// In transparent mode, the packets destined to other addresses are
+	// accepted if a transparent endpoint receives them.
+	if n.isTransparent() && n.transparentEndpointReceives(protocol, pkt.Data.First()) {
+		if ref := n.getTemporaryEndpoint(protocol, dst, CanBePrimaryEndpoint); ref != nil {
+			r := makeRoute(protocol, dst, src, linkEP.LinkAddress(), ref, false /* handleLocal */, false /* multicastLoop */)
+			r.RemoteLinkAddress = remote
+			ref.ep.HandlePacket(&r, pkt)
+			ref.decRef()
+			return
+		}
+	}
+
 	// This NIC doesn't care about the packet. Find a NIC that cares about the
 	// packet and forward it to the NIC.
 	//
 	// TODO: Should we be forwarding the packet even if promiscuous?
-	if n.stack.Forwarding() {
-		r, err := n.stack.FindRoute(0, "", dst, protocol, false /* multicastLoop */)
+	if n.stack.Forwarding() && !isMulticast {
+		// Packets are only forwarded within the VRF of the NIC.
+		vrf := n.vrfID()
+		r, err := n.stack.findForwardingRoute(vrf, dst, protocol, flow.Hash(protocol, pkt.Data.First(), flow.FiveTuple, n.stack.multipathSeed))
 		if err != nil {
 			n.stack.stats.IP.InvalidAddressesReceived.Increment()
+			if err == tcpip.ErrHostUnreachable || err == tcpip.ErrProhibited {
+				n.stack.sendUnreachable(vrf, protocol, err, pkt.Data)
+			}
+			n.recordDrop(tcpip.DropNoRoute, protocol, pkt.Data)
 			return
 		}
 		defer r.Release()
@@ -469,6 +810,12 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, _ tcpip.LinkAddr
 		r.LocalLinkAddress = n.linkEP.LinkAddress()
 		r.RemoteLinkAddress = remote
 
+		// Tell the sender about the better first hop if the packet
+		// leaves through the NIC it arrived on.
+		if r.ref.nic == n {
+			n.stack.sendRedirect(n, &r, pkt.Data)
+		}
+
 		// Found a NIC.
 		n := r.ref.nic
 		n.mu.RLock()
@@ -477,26 +824,80 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, _ tcpip.LinkAddr
 		if ok && ref.tryIncRef() {
 			r.RemoteAddress = src
 			// TODO: Update the source NIC as well.
-			ref.ep.HandlePacket(&r, vv)
+			ref.ep.HandlePacket(&r, pkt)
 			ref.decRef()
 		} else {
 			// n doesn't have a destination endpoint.
-			// Send the packet out of n.
+			// Send the packet out of n. The link endpoint may keep
+			// it after returning, so it must not use pooled views.
+			vv := pkt.OwnedData(nil)
+			if !decrementTTL(protocol, vv.First()) {
+				n.recordDrop(tcpip.DropTTLExpired, protocol, vv)
+				return
+			}
+			n.stack.stats.IP.PacketsForwarded.Increment()
+
 			hdr := buffer.NewPrependableFromView(vv.First())
 			vv.RemoveFirst()
+			out := NewOutboundPacketBuffer(hdr, vv)
+			defer out.DecRef()
+			size := out.Size()
 
 			// TODO: use route.WritePacket.
-			if err := n.linkEP.WritePacket(&r, hdr, vv, protocol); err != nil {
+			if err := n.writeEP.WritePacket(&r, out, protocol); err != nil {
 				r.Stats().IP.OutgoingPacketErrors.Increment()
+				n.stats.Tx.Errors.Increment()
+				r.recordWriteDrop(tcpip.DropWriteError, out)
 			} else {
 				n.stats.Tx.Packets.Increment()
-				n.stats.Tx.Bytes.IncrementBy(uint64(hdr.UsedLength() + vv.Size()))
+				n.stats.Tx.Bytes.IncrementBy(uint64(size))
 			}
 		}
 		return
 	}
 
 	n.stack.stats.IP.InvalidAddressesReceived.Increment()
+	n.recordDrop(tcpip.DropInvalidAddress, protocol, pkt.Data)
+}
+
+// recordDrop records the drop of a packet received by n.
+func (n *NIC) recordDrop(reason tcpip.DropReason, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	n.stack.RecordDrop(DropInfo{
+		Reason:   reason,
+		NIC:      n.id,
+		NetProto: protocol,
+		Packet:   vv,
+	})
+}
+
+// decrementTTL decrements the TTL or hop limit of the IPv4 or IPv6 packet
+// whose header is in h, before it's forwarded. It returns false if the packet
+// can't take another hop and must be dropped. Packets of other protocols are
+// left untouched.
+func decrementTTL(protocol tcpip.NetworkProtocolNumber, h buffer.View) bool {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(h)
+		if len(h) < header.IPv4MinimumSize || len(h) < int(ip.HeaderLength()) {
+			return true
+		}
+		if ip.TTL() <= 1 {
+			return false
+		}
+		ip.SetTTL(ip.TTL() - 1)
+		ip.SetChecksum(0)
+		ip.SetChecksum(^ip.CalculateChecksum())
+	case header.IPv6ProtocolNumber:
+		if len(h) < header.IPv6MinimumSize {
+			return true
+		}
+		ip := header.IPv6(h)
+		if ip.HopLimit() <= 1 {
+			return false
+		}
+		ip.SetHopLimit(ip.HopLimit() - 1)
+	}
+	return true
 }
 
 func (n *NIC) getRef(protocol tcpip.NetworkProtocolNumber, dst tcpip.Address) *referencedNetworkEndpoint {
@@ -541,50 +942,72 @@ func (n *NIC) getRef(protocol tcpip.NetworkProtocolNumber, dst tcpip.Address) *r
 
 // DeliverTransportPacket delivers the packets to the appropriate transport
 // protocol endpoint.
-func (n *NIC) DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, netHeader buffer.View, vv buffer.VectorisedView) {
+func (n *NIC) DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, pkt *PacketBuffer) {
 	state, ok := n.stack.transportProtocols[protocol]
 	if !ok {
 		n.stack.stats.UnknownProtocolRcvdPackets.Increment()
+		r.RecordDrop(tcpip.DropUnknownProtocol, pkt.Data)
 		return
 	}
 
 	transProto := state.proto
-	if len(vv.First()) < transProto.MinimumPacketSize() {
+	if len(pkt.Data.First()) < transProto.MinimumPacketSize() {
 		n.stack.stats.MalformedRcvdPackets.Increment()
+		r.RecordDrop(tcpip.DropMalformed, pkt.Data)
 		return
 	}
 
-	srcPort, dstPort, err := transProto.ParsePorts(vv.First())
+	srcPort, dstPort, err := transProto.ParsePorts(pkt.Data.First())
 	if err != nil {
 		n.stack.stats.MalformedRcvdPackets.Increment()
+		r.RecordDrop(tcpip.DropMalformed, pkt.Data)
 		return
 	}
 
 	id := TransportEndpointID{dstPort, r.LocalAddress, srcPort, r.RemoteAddress}
-	if n.demux.deliverPacket(r, protocol, netHeader, vv, id) {
+	if n.demux.deliverPacket(r, protocol, pkt, id) {
 		return
 	}
-	if n.stack.demux.deliverPacket(r, protocol, netHeader, vv, id) {
+	if n.transportDemux().deliverPacket(r, protocol, pkt, id) {
 		return
 	}
 
 	// Try to deliver to per-stack default handler.
 	if state.defaultHandler != nil {
-		if state.defaultHandler(r, id, netHeader, vv) {
+		if state.defaultHandler(r, id, pkt) {
 			return
 		}
 	}
 
 	// We could not find an appropriate destination for this packet, so
-	// deliver it to the global handler.
-	if !transProto.HandleUnknownDestinationPacket(r, id, vv) {
+	// deliver it to the global handler. The packet is dropped either way,
+	// but the handler may reply to it.
+	vv := pkt.Data.Clone(nil)
+	if !transProto.HandleUnknownDestinationPacket(r, id, pkt) {
 		n.stack.stats.MalformedRcvdPackets.Increment()
+		r.RecordDrop(tcpip.DropMalformed, vv)
+		return
+	}
+	r.RecordDrop(tcpip.DropNoEndpoint, vv)
+}
+
+// DeliverRawTransportPacket delivers the packets to the raw endpoints of the
+// given transport protocol.
+func (n *NIC) DeliverRawTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, pkt *PacketBuffer) {
+	if n.demux.deliverRawPacket(r, protocol, pkt) {
+		return
 	}
+	n.transportDemux().deliverRawPacket(r, protocol, pkt)
 }
 
 // DeliverTransportControlPacket delivers control packets to the appropriate
 // transport protocol endpoint.
-func (n *NIC) DeliverTransportControlPacket(local, remote tcpip.Address, net tcpip.NetworkProtocolNumber, trans tcpip.TransportProtocolNumber, typ ControlType, extra uint32, vv buffer.VectorisedView) {
+func (n *NIC) DeliverTransportControlPacket(local, remote tcpip.Address, net tcpip.NetworkProtocolNumber, trans tcpip.TransportProtocolNumber, typ ControlType, extra uint32, info ControlInfo, vv buffer.VectorisedView) {
+	// The path MTU applies to all the traffic to the destination.
+	if typ == ControlPacketTooBig {
+		n.stack.UpdatePathMTU(remote, extra)
+	}
+
 	state, ok := n.stack.transportProtocols[trans]
 	if !ok {
 		return
@@ -605,10 +1028,10 @@ func (n *NIC) DeliverTransportControlPacket(local, remote tcpip.Address, net tcp
 	}
 
 	id := TransportEndpointID{srcPort, local, dstPort, remote}
-	if n.demux.deliverControlPacket(net, trans, typ, extra, vv, id) {
+	if n.demux.deliverControlPacket(net, trans, typ, extra, info, vv, id) {
 		return
 	}
-	if n.stack.demux.deliverControlPacket(net, trans, typ, extra, vv, id) {
+	if n.transportDemux().deliverControlPacket(net, trans, typ, extra, info, vv, id) {
 		return
 	}
 }
@@ -634,6 +1057,11 @@ type referencedNetworkEndpoint struct {
 	// endpoint. It is reset to false when RemoveAddress is called on the
 	// NIC.
 	holdsInsertRef bool
+
+	// anycast is set if the address of the endpoint is an anycast address,
+	// which is accepted as destination but never used as source. It's set
+	// when the endpoint is added and never changes.
+	anycast bool
 }
 
 // decRef decrements the ref count and cleans up the endpoint once it reaches
@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+// SetNodeName sets the name of the node the stack runs on, as returned by the
+// ICMPv6 node information responder. It may be a fully qualified domain name,
+// ending with a dot, or a single label.
+func (s *Stack) SetNodeName(name string) {
+	s.nodeInfoMu.Lock()
+	s.nodeName = name
+	s.nodeInfoMu.Unlock()
+}
+
+// NodeName returns the name of the node the stack runs on, as set by
+// SetNodeName.
+func (s *Stack) NodeName() string {
+	s.nodeInfoMu.Lock()
+	defer s.nodeInfoMu.Unlock()
+	return s.nodeName
+}
+
+// SetNodeInfoResponder enables or disables the answers to the ICMPv6 node
+// information queries of RFC 4620. It's disabled by default, as the answers
+// reveal the name of the node to anyone who can reach it.
+func (s *Stack) SetNodeInfoResponder(enable bool) {
+	s.nodeInfoMu.Lock()
+	s.nodeInfoResponder = enable
+	s.nodeInfoMu.Unlock()
+}
+
+// NodeInfoResponder returns whether ICMPv6 node information queries are
+// answered.
+func (s *Stack) NodeInfoResponder() bool {
+	s.nodeInfoMu.Lock()
+	defer s.nodeInfoMu.Unlock()
+	return s.nodeInfoResponder
+}
+
+// NodeInfo returns the name of the node, and whether it answers the ICMPv6
+// node information queries received through the route.
+func (r *Route) NodeInfo() (string, bool) {
+	if r.ref == nil {
+		return "", false
+	}
+	s := r.ref.nic.stack
+	s.nodeInfoMu.Lock()
+	defer s.nodeInfoMu.Unlock()
+	return s.nodeName, s.nodeInfoResponder
+}
@@ -0,0 +1,263 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// A PacketBuffer holds a packet as it is handed from one layer of the stack to
+// the next.
+//
+// On the way in, from the link layer to the network layer and on to the
+// transport layer, each layer parses its header from the front of Data,
+// records it in the corresponding header field and trims it from Data, so that
+// the layers above see both their own payload and the headers of the layers
+// below without any of them being copied.
+//
+// On the way out, Data holds the payload, and each layer prepends its header
+// to Header, in the space reserved by the layer that built the packet for the
+// headers of the layers below, so that the headers aren't copied either.
+//
+// PacketBuffers are reference counted and recycled once the last reference is
+// dropped. A layer that hands the packet to another goroutine, or keeps it
+// after returning, must take a reference with IncRef and drop it with DecRef
+// when done.
+//
+// The views of a packet created with NewPooledPacketBuffer are returned to
+// their pool along with the packet, so data that is kept after the last
+// reference is dropped must be obtained with OwnedData. The views of other
+// packets remain valid after the last DecRef.
+type PacketBuffer struct {
+	// Data holds the part of an inbound packet that has not yet been
+	// parsed, or the payload of an outbound packet.
+	Data buffer.VectorisedView
+
+	// Header holds the headers prepended to an outbound packet so far. It
+	// is empty for inbound packets.
+	Header buffer.Prependable
+
+	// NetworkHeader is the network layer header of the packet. It is set
+	// by the network endpoint that handles the packet.
+	NetworkHeader buffer.View
+
+	// TransportHeader is the transport layer header of the packet. It is
+	// set by the transport endpoint that handles the packet, if it needs
+	// it to outlive the call.
+	TransportHeader buffer.View
+
+	// refs is the number of references held on the packet. It must be
+	// accessed atomically.
+	refs int32
+
+	// pool is the pool the packet's views are returned to, or nil if they
+	// are not pooled.
+	pool *buffer.Pool
+
+	// pooled holds the views to return to pool, as originally delivered.
+	// It is empty if the views are returned by another packet, whose
+	// views this one shares.
+	pooled []buffer.View
+
+	// dataViews and pooledViews back Data and pooled, so that recycled
+	// PacketBuffers don't need to allocate them.
+	dataViews   [8]buffer.View
+	pooledViews [8]buffer.View
+
+	// leakID is the leak checking ID of the packet.
+	leakID uint64
+}
+
+var packetBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &PacketBuffer{}
+	},
+}
+
+// NewPacketBuffer returns a PacketBuffer holding data, with one reference held
+// by the caller.
+func NewPacketBuffer(data buffer.VectorisedView) *PacketBuffer {
+	p := packetBufferPool.Get().(*PacketBuffer)
+	p.Data = data
+	p.refs = 1
+	p.leakID = tcpip.TrackObject("packet buffer")
+	return p
+}
+
+// NewOutboundPacketBuffer returns an outbound PacketBuffer, with one reference
+// held by the caller, whose headers are prepended to hdr and followed by
+// payload. hdr must have room for the headers of the lower layers, as given by
+// MaxHeaderLength.
+func NewOutboundPacketBuffer(hdr buffer.Prependable, payload buffer.VectorisedView) *PacketBuffer {
+	p := NewPacketBuffer(payload)
+	p.Header = hdr
+	return p
+}
+
+// NewPooledPacketBuffer returns a PacketBuffer holding data, with one
+// reference held by the caller. The views of data must have been obtained from
+// pool, and are returned to it when the last reference is dropped. The caller
+// retains ownership of the slice backing data, but not of the views.
+func NewPooledPacketBuffer(data buffer.VectorisedView, pool *buffer.Pool) *PacketBuffer {
+	p := packetBufferPool.Get().(*PacketBuffer)
+	p.Data = data.Clone(p.dataViews[:])
+	p.pool = pool
+	p.pooled = append(p.pooledViews[:0], data.Views()...)
+	p.refs = 1
+	p.leakID = tcpip.TrackObject("packet buffer")
+	return p
+}
+
+// IncRef takes a reference on the packet.
+func (p *PacketBuffer) IncRef() {
+	atomic.AddInt32(&p.refs, 1)
+}
+
+// DecRef drops a reference on the packet. When the last reference is dropped,
+// the packet is recycled and must no longer be used.
+func (p *PacketBuffer) DecRef() {
+	switch refs := atomic.AddInt32(&p.refs, -1); {
+	case refs == 0:
+		if p.pool != nil {
+			for _, v := range p.pooled {
+				p.pool.Put(v)
+			}
+		}
+		tcpip.UntrackObject(p.leakID)
+		*p = PacketBuffer{}
+		packetBufferPool.Put(p)
+	case refs < 0:
+		panic(fmt.Sprintf("PacketBuffer %p has negative reference count %d", p, refs))
+	}
+}
+
+// cloneViews returns a new PacketBuffer, with one reference held by the caller,
+// whose data shares p's views but not the slice holding them, so that it can
+// be trimmed independently of p. Its views are pooled if p's are, but are only
+// returned to the pool by p.
+func (p *PacketBuffer) cloneViews() *PacketBuffer {
+	c := packetBufferPool.Get().(*PacketBuffer)
+	c.Data = p.Data.Clone(c.dataViews[:])
+	c.pool = p.pool
+	c.refs = 1
+	c.leakID = tcpip.TrackObject("packet buffer")
+	return c
+}
+
+// OwnedData returns the packet's data in a form that remains valid after the
+// last reference to the packet is dropped. If p returns pooled views to their
+// pool, they are handed off to the caller instead: they are no longer returned
+// to the pool, and p is no longer pooled. The data is only copied if p shares
+// the pooled views of another packet, which still returns them. In either
+// case, the returned VectorisedView can be trimmed without affecting p.Data.
+// As with VectorisedView.Clone, views is used to hold the returned views if it
+// is large enough.
+func (p *PacketBuffer) OwnedData(views []buffer.View) buffer.VectorisedView {
+	if p.pool != nil {
+		if len(p.pooled) == 0 {
+			v := buffer.NewView(p.Data.Size())
+			copy(v, p.Data.ToView())
+			return buffer.NewVectorisedView(len(v), append(views[:0], v))
+		}
+		p.pool = nil
+		p.pooled = nil
+	}
+	return p.Data.Clone(views)
+}
+
+// Size returns the number of bytes of an outbound packet, its headers and its
+// payload.
+func (p *PacketBuffer) Size() int {
+	return p.Header.UsedLength() + p.Data.Size()
+}
+
+// ToVectorisedView returns the headers of an outbound packet followed by its
+// payload, without copying them.
+func (p *PacketBuffer) ToVectorisedView() buffer.VectorisedView {
+	views := make([]buffer.View, 1, 1+len(p.Data.Views()))
+	views[0] = p.Header.View()
+	views = append(views, p.Data.Views()...)
+	return buffer.NewVectorisedView(p.Size(), views)
+}
+
+// TTL returns the TTL or hop limit of the packet's network header, or zero if
+// the network header isn't set or isn't IPv4 or IPv6.
+func (p *PacketBuffer) TTL() uint8 {
+	switch header.IPVersion(p.NetworkHeader) {
+	case header.IPv4Version:
+		if len(p.NetworkHeader) >= header.IPv4MinimumSize {
+			return header.IPv4(p.NetworkHeader).TTL()
+		}
+	case header.IPv6Version:
+		if len(p.NetworkHeader) >= header.IPv6MinimumSize {
+			return header.IPv6(p.NetworkHeader).HopLimit()
+		}
+	}
+	return 0
+}
+
+// TOS returns the type of service or traffic class of the packet's network
+// header, or zero if the network header isn't set or isn't IPv4 or IPv6.
+func (p *PacketBuffer) TOS() uint8 {
+	switch header.IPVersion(p.NetworkHeader) {
+	case header.IPv4Version:
+		if len(p.NetworkHeader) >= header.IPv4MinimumSize {
+			tos, _ := header.IPv4(p.NetworkHeader).TOS()
+			return tos
+		}
+	case header.IPv6Version:
+		if len(p.NetworkHeader) >= header.IPv6MinimumSize {
+			tclass, _ := header.IPv6(p.NetworkHeader).TOS()
+			return tclass
+		}
+	}
+	return 0
+}
+
+// FlowLabel returns the flow label of the packet's network header, or zero if
+// the network header isn't set or isn't IPv6.
+func (p *PacketBuffer) FlowLabel() uint32 {
+	if header.IPVersion(p.NetworkHeader) != header.IPv6Version || len(p.NetworkHeader) < header.IPv6MinimumSize {
+		return 0
+	}
+	_, l := header.IPv6(p.NetworkHeader).TOS()
+	return l
+}
+
+// Clone returns a copy of the packet, with one reference held by the caller.
+// The copy has its own data and headers, so it can be modified independently
+// of p. The Header of the copy has as much room left as that of p.
+func (p *PacketBuffer) Clone() *PacketBuffer {
+	data := buffer.NewView(p.Data.Size())
+	copy(data, p.Data.ToView())
+	c := NewPacketBuffer(data.ToVectorisedView())
+	if size := p.Header.AvailableLength() + p.Header.UsedLength(); size != 0 {
+		c.Header = buffer.NewPrependable(size)
+		copy(c.Header.Prepend(p.Header.UsedLength()), p.Header.View())
+	}
+	if p.NetworkHeader != nil {
+		c.NetworkHeader = buffer.NewViewFromBytes(p.NetworkHeader)
+	}
+	if p.TransportHeader != nil {
+		c.TransportHeader = buffer.NewViewFromBytes(p.TransportHeader)
+	}
+	return c
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/netstack/tcpip/buffer"
+)
+
+func TestPacketBufferClone(t *testing.T) {
+	p := NewPacketBuffer(buffer.View("nethdrpayload").ToVectorisedView())
+	defer p.DecRef()
+	p.NetworkHeader = p.Data.First()[:6]
+	p.Data.TrimFront(6)
+
+	c := p.Clone()
+	defer c.DecRef()
+
+	// Modifying the clone must not affect the original.
+	c.Data.First()[0] = 'P'
+	c.NetworkHeader[0] = 'N'
+	if got, want := p.Data.ToView(), buffer.View("payload"); !bytes.Equal(got, want) {
+		t.Errorf("got original data %q, want %q", got, want)
+	}
+	if got, want := p.NetworkHeader, buffer.View("nethdr"); !bytes.Equal(got, want) {
+		t.Errorf("got original network header %q, want %q", got, want)
+	}
+	if got, want := c.Data.ToView(), buffer.View("Payload"); !bytes.Equal(got, want) {
+		t.Errorf("got cloned data %q, want %q", got, want)
+	}
+}
+
+func TestPacketBufferRefs(t *testing.T) {
+	v := buffer.View("data")
+	p := NewPacketBuffer(v.ToVectorisedView())
+	p.IncRef()
+
+	p.DecRef()
+	if got, want := p.Data.ToView(), v; !bytes.Equal(got, want) {
+		t.Fatalf("got data %q after dropping one of two references, want %q", got, want)
+	}
+
+	p.DecRef()
+	if p.Data.Size() != 0 {
+		t.Errorf("got data %q after dropping the last reference, want none", p.Data.ToView())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("DecRef on a recycled PacketBuffer did not panic")
+		}
+	}()
+	p.DecRef()
+}
+
+func TestPooledPacketBuffer(t *testing.T) {
+	pool := buffer.NewPool([]int{4}, 2)
+	v1, v2 := pool.Get(4), pool.Get(4)
+	copy(v1, "abcd")
+	copy(v2, "efgh")
+
+	p := NewPooledPacketBuffer(buffer.NewVectorisedView(8, []buffer.View{v1, v2}), pool)
+	p.DecRef()
+
+	// Both views are returned to the pool with the packet.
+	if got := pool.Stats().Puts; got != 2 {
+		t.Errorf("got %d views returned to the pool, want 2", got)
+	}
+	if got := pool.Stats().Drops; got != 0 {
+		t.Errorf("got %d views dropped by the pool, want 0", got)
+	}
+}
+
+func TestPooledPacketBufferOwnedData(t *testing.T) {
+	pool := buffer.NewPool([]int{4}, 2)
+	v1, v2 := pool.Get(4), pool.Get(4)
+	copy(v1, "abcd")
+	copy(v2, "efgh")
+
+	p := NewPooledPacketBuffer(buffer.NewVectorisedView(8, []buffer.View{v1, v2}), pool)
+	p.Data.TrimFront(1)
+	p.Data.CapLength(6)
+
+	// A packet that shares the views of p must copy its data, as p still
+	// returns them to the pool.
+	c := p.cloneViews()
+	shared := c.OwnedData(nil)
+	c.DecRef()
+	if len(shared.Views()) != 1 || &shared.First()[0] == &v1[1] {
+		t.Errorf("got owned data of a packet sharing pooled views referring to them")
+	}
+
+	// p hands its views off rather than copying them.
+	owned := p.OwnedData(nil)
+	if &owned.First()[0] != &v1[1] {
+		t.Errorf("got owned data copied, want it to refer to the pooled views")
+	}
+	p.DecRef()
+	if got := pool.Stats().Puts; got != 0 {
+		t.Errorf("got %d views returned to the pool, want 0", got)
+	}
+
+	copy(pool.Get(4), "XXXX")
+	copy(pool.Get(4), "XXXX")
+	for _, vv := range []buffer.VectorisedView{owned, shared} {
+		if got, want := vv.ToView(), buffer.View("bcdefg"); !bytes.Equal(got, want) {
+			t.Errorf("got owned data %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+const (
+	// maxRedirects is the maximum number of host routes installed by ICMP
+	// redirects at once.
+	maxRedirects = 1024
+
+	// redirectExpiration is how long the host route installed by an ICMP
+	// redirect is used, the same as the default gc_timeout of Linux.
+	redirectExpiration = 5 * time.Minute
+
+	// icmpv6RedirectPayloadSize is the largest amount of the offending
+	// packet quoted in ICMPv6 redirects, so that they fit in the minimum
+	// IPv6 MTU. It is a multiple of 8, the unit of NDP option lengths.
+	icmpv6RedirectPayloadSize = (header.IPv6MinimumMTU - header.IPv6MinimumSize - header.ICMPv6RedirectMinimumSize - header.ICMPv6RedirectedHeaderOptionSize) &^ 7
+)
+
+// redirect is a temporary host route installed by an ICMP redirect.
+type redirect struct {
+	nic     tcpip.NICID
+	gateway tcpip.Address
+
+	// expires is the monotonic time after which the route isn't used.
+	expires int64
+}
+
+// SetAcceptRedirects enables or disables the handling of the ICMP redirects
+// received by the stack. When it is enabled, which is the default, a valid
+// redirect installs a host route to its destination through the gateway it
+// gives, which is used for 5 minutes. Redirects are always ignored while
+// forwarding is enabled, as required by RFC 1812 section 5.2.7.2.
+func (s *Stack) SetAcceptRedirects(enable bool) {
+	var v uint32
+	if enable {
+		v = 1
+	}
+	atomic.StoreUint32(&s.acceptRedirects, v)
+}
+
+// AcceptRedirects returns whether the ICMP redirects received by the stack are
+// handled.
+func (s *Stack) AcceptRedirects() bool {
+	return atomic.LoadUint32(&s.acceptRedirects) != 0
+}
+
+// SetSendRedirects enables or disables the ICMP redirects sent by the stack
+// when it forwards a packet out of the NIC it arrived on, to tell its sender
+// about the better first hop. It is enabled by default.
+func (s *Stack) SetSendRedirects(enable bool) {
+	var v uint32
+	if enable {
+		v = 1
+	}
+	atomic.StoreUint32(&s.sendRedirects, v)
+}
+
+// SendRedirects returns whether the stack sends ICMP redirects.
+func (s *Stack) SendRedirects() bool {
+	return atomic.LoadUint32(&s.sendRedirects) != 0
+}
+
+// FlushRedirects removes the host routes installed by ICMP redirects.
+func (s *Stack) FlushRedirects() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.redirects = nil
+	s.invalidateRoutes()
+}
+
+// HandleRedirect handles an ICMP redirect received through the route r, whose
+// remote address is the sender of the redirect, telling that packets to dst
+// must be sent to gateway instead, or directly if gateway is dst. It is called
+// by network endpoints once they have checked the message itself.
+//
+// The redirect is ignored, and false returned, if redirects aren't accepted or
+// if it isn't valid per RFC 1122 section 3.2.2.2 and RFC 4861 section 8.1: it
+// must come from the current first hop to dst, through the NIC it was
+// received by, and gateway must not be one of the addresses of the stack.
+func (r *Route) HandleRedirect(dst, gateway tcpip.Address) bool {
+	if r.ref == nil {
+		return false
+	}
+	s := r.ref.nic.stack
+	if !s.handleRedirect(r.ref.nic, r.NetProto, r.RemoteAddress, dst, gateway) {
+		s.stats.ICMP.RedirectsIgnored.Increment()
+		return false
+	}
+	return true
+}
+
+func (s *Stack) handleRedirect(nic *NIC, netProto tcpip.NetworkProtocolNumber, src, dst, gateway tcpip.Address) bool {
+	if !s.AcceptRedirects() {
+		return false
+	}
+	if len(dst) == 0 || dst == header.IPv4Broadcast || header.IsV4MulticastAddress(dst) || header.IsV6MulticastAddress(dst) {
+		return false
+	}
+	if gateway == dst {
+		gateway = ""
+	} else if len(gateway) != len(dst) || header.IsV4MulticastAddress(gateway) || header.IsV6MulticastAddress(gateway) {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.forwarding {
+		return false
+	}
+	vrf := nic.vrfID()
+	if gateway != "" && s.checkLocalAddressLocked(vrf, nic.id, netProto, gateway) != 0 {
+		return false
+	}
+	r, err := s.findRouteLocked(vrf, 0, "", dst, netProto, false /* multicastLoop */, s.destinationHash(netProto, dst))
+	if err != nil {
+		return false
+	}
+	valid := r.NICID() == nic.id && r.NextHop != "" && r.NextHop == src
+	r.Release()
+	if !valid {
+		return false
+	}
+
+	now := s.clock.NowMonotonic()
+	if _, ok := s.redirects[dst]; !ok && len(s.redirects) >= maxRedirects {
+		for addr, rd := range s.redirects {
+			if now >= rd.expires {
+				delete(s.redirects, addr)
+			}
+		}
+		if len(s.redirects) >= maxRedirects {
+			return false
+		}
+	}
+	if s.redirects == nil {
+		s.redirects = make(map[tcpip.Address]redirect)
+	}
+	s.redirects[dst] = redirect{
+		nic:     nic.id,
+		gateway: gateway,
+		expires: now + int64(redirectExpiration),
+	}
+	s.invalidateRoutes()
+	return true
+}
+
+// routeTableLocked returns the route table used to find a route to dst: the
+// one set with SetRouteTable, preceded by the host route installed by an ICMP
+// redirect for dst, if any. s.mu must be held.
+func (s *Stack) routeTableLocked(dst tcpip.Address) []tcpip.Route {
+	rd, ok := s.redirects[dst]
+	if !ok || s.clock.NowMonotonic() >= rd.expires {
+		return s.routeTable
+	}
+	route := tcpip.Route{
+		Destination: dst,
+		Mask:        tcpip.AddressMask(strings.Repeat("\xff", len(dst))),
+		Gateway:     rd.gateway,
+		NIC:         rd.nic,
+	}
+	return append([]tcpip.Route{route}, s.routeTable...)
+}
+
+// sendRedirect sends an ICMP redirect to the sender of the packet vv, received
+// by the NIC n and about to be forwarded out of it again through the route r,
+// as suggested by RFC 1812 section 5.2.7.2 and RFC 4861 section 8.2. Nothing is
+// sent unless the sender is a neighbor that can use the next hop of r
+// directly.
+func (s *Stack) sendRedirect(n *NIC, r *Route, vv buffer.VectorisedView) {
+	if !s.SendRedirects() {
+		return
+	}
+	h := vv.First()
+	var src, localAddr tcpip.Address
+	switch r.NetProto {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(h)
+		// Packets with options may be source routed, in which case the
+		// sender didn't choose their first hop.
+		if len(h) < header.IPv4MinimumSize || ip.HeaderLength() != header.IPv4MinimumSize {
+			return
+		}
+		src = ip.SourceAddress()
+		if src == header.IPv4Any || src == header.IPv4Broadcast || header.IsV4MulticastAddress(src) {
+			return
+		}
+	case header.IPv6ProtocolNumber:
+		if len(h) < header.IPv6MinimumSize {
+			return
+		}
+		src = header.IPv6(h).SourceAddress()
+		if src == header.IPv6Any || header.IsV6MulticastAddress(src) {
+			return
+		}
+		// Redirects must be sent from a link-local address, RFC 4861
+		// section 8.2.
+		if localAddr = n.linkLocalAddress(); localAddr == "" {
+			return
+		}
+	default:
+		return
+	}
+
+	target := r.NextHop
+	if target == "" {
+		target = r.RemoteAddress
+	}
+	if target == src {
+		return
+	}
+
+	reply, err := s.FindRouteInVRF(n.vrfID(), n.id, localAddr, src, r.NetProto, false /* multicastLoop */)
+	if err != nil {
+		return
+	}
+	defer reply.Release()
+	if reply.NextHop != "" || !reply.AllowICMP() {
+		return
+	}
+	stats := reply.Stats().ICMP
+
+	if r.NetProto == header.IPv4ProtocolNumber {
+		size := icmpv4ErrorPayloadSize
+		if size > vv.Size() {
+			size = vv.Size()
+		}
+		payload := buffer.NewView(size)
+		copy(payload, vv.ToView())
+
+		hdr := buffer.NewPrependable(int(reply.MaxHeaderLength()) + header.ICMPv4RedirectMinimumSize)
+		icmp := header.ICMPv4(hdr.Prepend(header.ICMPv4RedirectMinimumSize))
+		icmp.SetType(header.ICMPv4Redirect)
+		icmp.SetCode(header.ICMPv4RedirectHost)
+		icmp.SetRedirectGateway(target)
+		icmp.SetChecksum(^header.Checksum(icmp, header.Checksum(payload, 0)))
+		pkt := NewOutboundPacketBuffer(hdr, payload.ToVectorisedView())
+		defer pkt.DecRef()
+		if err := reply.WritePacket(pkt, header.ICMPv4ProtocolNumber, reply.DefaultTTL()); err != nil {
+			stats.OutgoingPacketErrors.Increment()
+			return
+		}
+		stats.V4PacketsSent.Redirect.Increment()
+		return
+	}
+
+	// The offending packet is quoted in a redirected header option, padded
+	// to a multiple of 8 bytes.
+	size := icmpv6RedirectPayloadSize
+	if size > vv.Size() {
+		size = vv.Size()
+	}
+	optSize := (header.ICMPv6RedirectedHeaderOptionSize + size + 7) &^ 7
+	payload := buffer.NewView(optSize)
+	payload[0] = header.ICMPv6RedirectedHeaderOption
+	payload[1] = uint8(optSize / 8)
+	copy(payload[header.ICMPv6RedirectedHeaderOptionSize:], vv.ToView()[:size])
+
+	hdr := buffer.NewPrependable(int(reply.MaxHeaderLength()) + header.ICMPv6RedirectMinimumSize)
+	icmp := header.ICMPv6(hdr.Prepend(header.ICMPv6RedirectMinimumSize))
+	icmp.SetType(header.ICMPv6RedirectMsg)
+	icmp.SetCode(0)
+	icmp.EncodeRedirect(target, r.RemoteAddress)
+	xsum := header.PseudoHeaderChecksum(header.ICMPv6ProtocolNumber, reply.LocalAddress, reply.RemoteAddress, uint16(len(icmp)+len(payload)))
+	icmp.SetChecksum(^header.Checksum(icmp, header.Checksum(payload, xsum)))
+	pkt := NewOutboundPacketBuffer(hdr, payload.ToVectorisedView())
+	defer pkt.DecRef()
+	if err := reply.WritePacket(pkt, header.ICMPv6ProtocolNumber, header.NDPHopLimit); err != nil {
+		stats.OutgoingPacketErrors.Increment()
+		return
+	}
+	stats.V6PacketsSent.Redirect.Increment()
+}
+
+// linkLocalAddress returns an IPv6 link-local address of n, or an empty
+// address if it has none.
+func (n *NIC) linkLocalAddress() tcpip.Address {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for id, ref := range n.endpoints {
+		if ref.protocol == header.IPv6ProtocolNumber && ref.holdsInsertRef && header.IsV6LinkLocalAddress(id.LocalAddress) {
+			return id.LocalAddress
+		}
+	}
+	return ""
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/google/netstack/sleep"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/flow"
 	"github.com/google/netstack/waiter"
 )
 
@@ -49,6 +50,20 @@ type TransportEndpointID struct {
 	RemoteAddress tcpip.Address
 }
 
+// Flow returns the key of the flow of the packets received by the endpoint
+// with this ID, using the given protocols. Its Reverse is the key of the flow
+// of the packets it sends.
+func (id TransportEndpointID) Flow(netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber) flow.Key {
+	return flow.Key{
+		NetProto:   netProto,
+		TransProto: transProto,
+		Src:        id.RemoteAddress,
+		Dst:        id.LocalAddress,
+		SrcPort:    id.RemotePort,
+		DstPort:    id.LocalPort,
+	}
+}
+
 // ControlType is the type of network control message.
 type ControlType int
 
@@ -56,19 +71,57 @@ type ControlType int
 const (
 	ControlPacketTooBig ControlType = iota
 	ControlPortUnreachable
+
+	// ControlTimeExceeded is delivered when the TTL (or IPv6 hop limit) of
+	// a packet ran out on its way. The extra argument holds the ICMP code.
+	ControlTimeExceeded
+
+	// ControlMTUChanged is delivered to every transport endpoint that may
+	// be routed through a NIC whose MTU was changed by Stack.SetNICMTU.
+	// The extra argument holds the ID of the NIC, and the endpoint ID and
+	// packet are empty. Endpoints should re-read the MTU of their route.
+	ControlMTUChanged
+
+	// ControlNICRemoved is delivered to every transport endpoint that may
+	// be bound to or routed through a NIC removed by Stack.RemoveNIC. The
+	// extra argument holds the ID of the NIC, and the endpoint ID and
+	// packet are empty. Endpoints should check whether their route is
+	// still usable with Route.Removed.
+	ControlNICRemoved
+
+	// ControlHostUnreachable is delivered to every transport endpoint that
+	// may be routed through a NIC on which the link address of a neighbor
+	// couldn't be resolved. The extra argument holds the ID of the NIC,
+	// ControlInfo.Offender the address of the neighbor, and the endpoint
+	// ID and packet are empty. Endpoints whose route goes through it, as
+	// told by Route.UsesNeighbor, should report tcpip.ErrHostUnreachable.
+	ControlHostUnreachable
 	ControlUnknown
 )
 
+// ControlInfo describes the ICMP message a control packet was derived from.
+type ControlInfo struct {
+	// Offender is the source of the ICMP message.
+	Offender tcpip.Address
+
+	// NetworkHeader is the network header of the offending packet, as
+	// quoted by the ICMP message.
+	NetworkHeader buffer.View
+}
+
 // TransportEndpoint is the interface that needs to be implemented by transport
 // protocol (e.g., tcp, udp) endpoints that can handle packets.
 type TransportEndpoint interface {
 	// HandlePacket is called by the stack when new packets arrive to
-	// this transport endpoint.
-	HandlePacket(r *Route, id TransportEndpointID, netHeader buffer.View, vv buffer.VectorisedView)
+	// this transport endpoint. pkt.Data starts with the transport header
+	// and pkt.NetworkHeader holds the network header. The endpoint must
+	// take a reference on pkt if it keeps it after returning.
+	HandlePacket(r *Route, id TransportEndpointID, pkt *PacketBuffer)
 
 	// HandleControlPacket is called by the stack when new control (e.g.,
-	// ICMP) packets arrive to this transport endpoint.
-	HandleControlPacket(id TransportEndpointID, typ ControlType, extra uint32, vv buffer.VectorisedView)
+	// ICMP) packets arrive to this transport endpoint. vv starts with the
+	// transport header of the offending packet.
+	HandleControlPacket(id TransportEndpointID, typ ControlType, extra uint32, info ControlInfo, vv buffer.VectorisedView)
 }
 
 // TransportProtocol is the interface that needs to be implemented by transport
@@ -98,7 +151,7 @@ type TransportProtocol interface {
 	//
 	// The return value indicates whether the packet was well-formed (for
 	// stats purposes only).
-	HandleUnknownDestinationPacket(r *Route, id TransportEndpointID, vv buffer.VectorisedView) bool
+	HandleUnknownDestinationPacket(r *Route, id TransportEndpointID, pkt *PacketBuffer) bool
 
 	// SetOption allows enabling/disabling protocol specific features.
 	// SetOption returns an error if the option is not supported or the
@@ -116,13 +169,20 @@ type TransportProtocol interface {
 // the network layer.
 type TransportDispatcher interface {
 	// DeliverTransportPacket delivers packets to the appropriate
-	// transport protocol endpoint. It also returns the network layer
-	// header for the enpoint to inspect or pass up the stack.
-	DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, netHeader buffer.View, vv buffer.VectorisedView)
+	// transport protocol endpoint. pkt.NetworkHeader must hold the
+	// network layer header for the endpoint to inspect or pass up the
+	// stack, and pkt.Data the transport layer header and payload.
+	DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, pkt *PacketBuffer)
+
+	// DeliverRawTransportPacket delivers packets to the raw endpoints of
+	// the transport protocol only. Network endpoints use it for the
+	// messages of their control protocol, like ICMP errors, which raw
+	// endpoints receive but no other endpoint handles.
+	DeliverRawTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, pkt *PacketBuffer)
 
 	// DeliverTransportControlPacket delivers control packets to the
 	// appropriate transport protocol endpoint.
-	DeliverTransportControlPacket(local, remote tcpip.Address, net tcpip.NetworkProtocolNumber, trans tcpip.TransportProtocolNumber, typ ControlType, extra uint32, vv buffer.VectorisedView)
+	DeliverTransportControlPacket(local, remote tcpip.Address, net tcpip.NetworkProtocolNumber, trans tcpip.TransportProtocolNumber, typ ControlType, extra uint32, info ControlInfo, vv buffer.VectorisedView)
 }
 
 // PacketLooping specifies where an outbound packet should be sent.
@@ -137,6 +197,22 @@ const (
 	PacketLoop
 )
 
+// NetworkHeaderParams are the parameters of the network header of a packet,
+// given by the transport layer.
+type NetworkHeaderParams struct {
+	// Protocol is the transport protocol of the packet.
+	Protocol tcpip.TransportProtocolNumber
+
+	// TTL is the TTL (or IPv6 hop limit) of the packet.
+	TTL uint8
+
+	// TOS is the type of service (or IPv6 traffic class) of the packet.
+	TOS uint8
+
+	// FlowLabel is the flow label of the packet. It is ignored by IPv4.
+	FlowLabel uint32
+}
+
 // NetworkEndpoint is the interface that needs to be implemented by endpoints
 // of network layer protocols (e.g., ipv4, ipv6).
 type NetworkEndpoint interface {
@@ -159,9 +235,10 @@ type NetworkEndpoint interface {
 	// building.
 	MaxHeaderLength() uint16
 
-	// WritePacket writes a packet to the given destination address and
-	// protocol.
-	WritePacket(r *Route, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.TransportProtocolNumber, ttl uint8, loop PacketLooping) *tcpip.Error
+	// WritePacket writes an outbound packet to the given destination
+	// address, prepending a network header built from params to
+	// pkt.Header. The caller keeps its reference on pkt.
+	WritePacket(r *Route, pkt *PacketBuffer, params NetworkHeaderParams, loop PacketLooping) *tcpip.Error
 
 	// ID returns the network protocol endpoint ID.
 	ID() *NetworkEndpointID
@@ -170,8 +247,10 @@ type NetworkEndpoint interface {
 	NICID() tcpip.NICID
 
 	// HandlePacket is called by the link layer when new packets arrive to
-	// this network endpoint.
-	HandlePacket(r *Route, vv buffer.VectorisedView)
+	// this network endpoint. pkt.Data starts with the network header. The
+	// endpoint must take a reference on pkt if it keeps it after
+	// returning.
+	HandlePacket(r *Route, pkt *PacketBuffer)
 
 	// Close is called when the endpoint is reomved from a stack.
 	Close()
@@ -192,8 +271,9 @@ type NetworkProtocol interface {
 	// packet of this protocol.
 	ParseAddresses(v buffer.View) (src, dst tcpip.Address)
 
-	// NewEndpoint creates a new endpoint of this protocol.
-	NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, linkAddrCache LinkAddressCache, dispatcher TransportDispatcher, sender LinkEndpoint) (NetworkEndpoint, *tcpip.Error)
+	// NewEndpoint creates a new endpoint of this protocol. Its timers run
+	// on clock, the clock of the stack.
+	NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, linkAddrCache LinkAddressCache, clock tcpip.Clock, dispatcher TransportDispatcher, sender LinkEndpoint) (NetworkEndpoint, *tcpip.Error)
 
 	// SetOption allows enabling/disabling protocol specific features.
 	// SetOption returns an error if the option is not supported or the
@@ -215,6 +295,103 @@ type NetworkDispatcher interface {
 	DeliverNetworkPacket(linkEP LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView)
 }
 
+// LinkStateDispatcher is implemented by NetworkDispatchers that want to be
+// told when the carrier of the link endpoint they are attached to comes up or
+// goes down. The NIC implements it, as do link endpoints that wrap another
+// endpoint, so that the notification reaches the NIC.
+type LinkStateDispatcher interface {
+	// DeliverLinkState is called by a link endpoint when its carrier
+	// state changes.
+	DeliverLinkState(up bool)
+}
+
+// DeliverLinkState notifies d of a carrier change if d implements
+// LinkStateDispatcher. Link endpoints that can detect carrier changes should
+// use it to report them to their dispatcher.
+func DeliverLinkState(d NetworkDispatcher, up bool) {
+	if l, ok := d.(LinkStateDispatcher); ok {
+		l.DeliverLinkState(up)
+	}
+}
+
+// LinkDropDispatcher is implemented by NetworkDispatchers that want to be
+// told about frames their link endpoint dropped before it could deliver them,
+// e.g., because they were malformed. The NIC implements it, as do link
+// endpoints that wrap another endpoint.
+type LinkDropDispatcher interface {
+	// DeliverLinkDrop is called by a link endpoint when it drops the
+	// received frame for the given reason. The frame is only valid for the
+	// duration of the call.
+	DeliverLinkDrop(reason tcpip.DropReason, frame buffer.VectorisedView)
+}
+
+// DeliverLinkDrop notifies d of a dropped frame if d implements
+// LinkDropDispatcher.
+func DeliverLinkDrop(d NetworkDispatcher, reason tcpip.DropReason, frame buffer.VectorisedView) {
+	if l, ok := d.(LinkDropDispatcher); ok {
+		l.DeliverLinkDrop(reason, frame)
+	}
+}
+
+// PacketBufferDispatcher is implemented by NetworkDispatchers that accept
+// packets already wrapped in a PacketBuffer, such as packets whose views are
+// pooled. The NIC implements it.
+type PacketBufferDispatcher interface {
+	// DeliverPacketBuffer is like DeliverNetworkPacket, but takes the
+	// packet as a PacketBuffer. The dispatcher takes its own reference on
+	// pkt if it needs one after returning.
+	DeliverPacketBuffer(linkEP LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt *PacketBuffer)
+}
+
+// DeliverPacketBuffer delivers pkt to d. If d doesn't implement
+// PacketBufferDispatcher, the packet's data is delivered with
+// DeliverNetworkPacket instead, copied if its views are pooled. The caller
+// keeps its reference on pkt.
+func DeliverPacketBuffer(d NetworkDispatcher, linkEP LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt *PacketBuffer) {
+	if p, ok := d.(PacketBufferDispatcher); ok {
+		p.DeliverPacketBuffer(linkEP, remote, local, protocol, pkt)
+		return
+	}
+	d.DeliverNetworkPacket(linkEP, remote, local, protocol, pkt.OwnedData(nil))
+}
+
+// An InboundPacket is one of a batch of packets delivered by a link endpoint.
+type InboundPacket struct {
+	// Remote and Local are the link addresses of the packet's sender and
+	// receiver.
+	Remote tcpip.LinkAddress
+	Local  tcpip.LinkAddress
+
+	// Protocol is the network protocol of the packet.
+	Protocol tcpip.NetworkProtocolNumber
+
+	// Pkt is the packet itself.
+	Pkt *PacketBuffer
+}
+
+// BatchDispatcher is implemented by NetworkDispatchers that can process several
+// inbound packets in one call, amortizing per-packet work such as looking up
+// the network endpoint a packet is destined to. The NIC implements it.
+type BatchDispatcher interface {
+	// DeliverPacketBatch delivers pkts in order, as if each was passed to
+	// DeliverPacketBuffer. The dispatcher takes its own references on the
+	// packets it needs after returning.
+	DeliverPacketBatch(linkEP LinkEndpoint, pkts []InboundPacket)
+}
+
+// DeliverPacketBatch delivers pkts to d, in a single call if d implements
+// BatchDispatcher and with DeliverPacketBuffer otherwise. The caller keeps its
+// references on the packets.
+func DeliverPacketBatch(d NetworkDispatcher, linkEP LinkEndpoint, pkts []InboundPacket) {
+	if b, ok := d.(BatchDispatcher); ok {
+		b.DeliverPacketBatch(linkEP, pkts)
+		return
+	}
+	for _, p := range pkts {
+		DeliverPacketBuffer(d, linkEP, p.Remote, p.Local, p.Protocol, p.Pkt)
+	}
+}
+
 // LinkEndpointCapabilities is the type associated with the capabilities
 // supported by a link-layer endpoint. It is a set of bitfields.
 type LinkEndpointCapabilities uint
@@ -252,13 +429,16 @@ type LinkEndpoint interface {
 	// link endpoint.
 	LinkAddress() tcpip.LinkAddress
 
-	// WritePacket writes a packet with the given protocol through the given
-	// route.
+	// WritePacket writes an outbound packet with the given protocol
+	// through the given route. pkt.Header starts with the network header,
+	// and has room for the link header, if any. The caller keeps its
+	// reference on pkt; endpoints that hold the packet after returning must
+	// take their own.
 	//
 	// To participate in transparent bridging, a LinkEndpoint implementation
 	// should call eth.Encode with header.EthernetFields.SrcAddr set to
 	// r.LocalLinkAddress if it is provided.
-	WritePacket(r *Route, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error
+	WritePacket(r *Route, pkt *PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error
 
 	// Attach attaches the data link layer endpoint to the network-layer
 	// dispatcher of the stack.
@@ -269,6 +449,26 @@ type LinkEndpoint interface {
 	IsAttached() bool
 }
 
+// MTUSettableLinkEndpoint is a LinkEndpoint whose MTU can be changed at
+// runtime.
+type MTUSettableLinkEndpoint interface {
+	LinkEndpoint
+
+	// SetMTU sets the MTU of the endpoint. Subsequent calls to MTU return
+	// the new value.
+	SetMTU(mtu uint32) *tcpip.Error
+}
+
+// SetLinkMTU sets the MTU of ep if it implements MTUSettableLinkEndpoint, and
+// returns tcpip.ErrNotSupported otherwise. Link endpoints that wrap another
+// endpoint should use it to forward MTU changes to the wrapped endpoint.
+func SetLinkMTU(ep LinkEndpoint, mtu uint32) *tcpip.Error {
+	if m, ok := ep.(MTUSettableLinkEndpoint); ok {
+		return m.SetMTU(mtu)
+	}
+	return tcpip.ErrNotSupported
+}
+
 // InjectableLinkEndpoint is a LinkEndpoint where inbound packets are
 // delivered via the Inject method.
 type InjectableLinkEndpoint interface {
@@ -283,6 +483,14 @@ type InjectableLinkEndpoint interface {
 	WriteRawPacket(dest tcpip.Address, packet []byte) *tcpip.Error
 }
 
+// A NICRemovalHandler is an extension to a NetworkEndpoint that is told when
+// its NIC is removed from the stack, so that it can stop its timers right
+// away: the endpoint is only closed once the routes using it are released.
+type NICRemovalHandler interface {
+	// HandleNICRemoval is called once the NIC of the endpoint is removed.
+	HandleNICRemoval()
+}
+
 // A LinkAddressResolver is an extension to a NetworkProtocol that
 // can resolve link addresses.
 type LinkAddressResolver interface {
@@ -311,6 +519,10 @@ type LinkAddressCache interface {
 	// does not exist.
 	CheckLocalAddress(nicid tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) tcpip.NICID
 
+	// IsAnycastAddress returns whether addr is an anycast address of the
+	// given NIC, which CheckLocalAddress doesn't report.
+	IsAnycastAddress(nicid tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) bool
+
 	// AddLinkAddress adds a link address to the cache.
 	AddLinkAddress(nicid tcpip.NICID, addr tcpip.Address, linkAddr tcpip.LinkAddress)
 
@@ -15,6 +15,9 @@
 package stack
 
 import (
+	"sync/atomic"
+	"time"
+
 	"github.com/google/netstack/sleep"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
@@ -43,12 +46,24 @@ type Route struct {
 	// NetProto is the network-layer protocol.
 	NetProto tcpip.NetworkProtocolNumber
 
+	// metrics holds the overrides of the route table entry the route was
+	// found with. Only its metric fields are used.
+	metrics tcpip.Route
+
 	// ref a reference to the network endpoint through which the route
 	// starts.
 	ref *referencedNetworkEndpoint
 
 	// loop controls where WritePacket should send packets.
 	loop PacketLooping
+
+	// gen is the generation of the routing state of the stack when the
+	// route was found.
+	gen uint64
+
+	// leakID is the leak checking ID of the route, if it holds a
+	// reference that must be released, as returned by FindRoute or Clone.
+	leakID uint64
 }
 
 // makeRoute initializes a new route. It takes ownership of the provided
@@ -81,15 +96,59 @@ func (r *Route) MaxHeaderLength() uint16 {
 	return r.ref.ep.MaxHeaderLength()
 }
 
+// unboundStats are the stats updated through routes that aren't bound to a
+// NIC, like the ones built to send link address requests.
+var unboundStats = tcpip.Stats{}.FillIn()
+
 // Stats returns a mutable copy of current stats.
 func (r *Route) Stats() tcpip.Stats {
+	if r.ref == nil {
+		return unboundStats
+	}
 	return r.ref.nic.stack.Stats()
 }
 
+// Now returns the current time according to the clock of the stack of the
+// route.
+func (r *Route) Now() time.Time {
+	if r.ref == nil {
+		return time.Now()
+	}
+	return r.ref.nic.stack.Now()
+}
+
+// AllowICMP reports whether the ICMP rate limit of the stack allows an ICMP
+// message to be generated to the remote address of the route. See
+// Stack.AllowICMPMessage.
+func (r *Route) AllowICMP() bool {
+	if r.ref == nil {
+		return true
+	}
+	return r.ref.nic.stack.AllowICMPMessage(r.RemoteAddress)
+}
+
+// RecordDrop records the drop, for the given reason, of a packet received or
+// sent through the route. vv holds the part of the packet that was left to be
+// processed, as described in DropInfo.
+func (r *Route) RecordDrop(reason tcpip.DropReason, vv buffer.VectorisedView) {
+	if r.ref == nil {
+		if c := unboundStats.Drops.Counter(reason); c != nil {
+			c.Increment()
+		}
+		return
+	}
+	r.ref.nic.stack.RecordDrop(DropInfo{
+		Reason:   reason,
+		NIC:      r.ref.nic.id,
+		NetProto: r.NetProto,
+		Packet:   vv,
+	})
+}
+
 // PseudoHeaderChecksum forwards the call to the network endpoint's
-// implementation.
-func (r *Route) PseudoHeaderChecksum(protocol tcpip.TransportProtocolNumber, totalLen uint16) uint16 {
-	return header.PseudoHeaderChecksum(protocol, r.LocalAddress, r.RemoteAddress, totalLen)
+// implementation. totalLen only exceeds 16 bits in IPv6 jumbograms.
+func (r *Route) PseudoHeaderChecksum(protocol tcpip.TransportProtocolNumber, totalLen uint32) uint16 {
+	return header.JumboPseudoHeaderChecksum(protocol, r.LocalAddress, r.RemoteAddress, totalLen)
 }
 
 // Capabilities returns the link-layer capabilities of the route.
@@ -104,6 +163,9 @@ func (r *Route) Capabilities() LinkEndpointCapabilities {
 // If address resolution is required, ErrNoLinkAddress and a notification channel is
 // returned for the top level caller to block. Channel is closed once address resolution
 // is complete (success or not).
+//
+// Callers don't have to wait for the resolution to write packets through the
+// route: the stack queues them until it completes. Waker may then be nil.
 func (r *Route) Resolve(waker *sleep.Waker) (<-chan struct{}, *tcpip.Error) {
 	if !r.IsResolutionRequired() {
 		// Nothing to do if there is no cache (which does the resolution on cache miss) or
@@ -137,32 +199,210 @@ func (r *Route) RemoveWaker(waker *sleep.Waker) {
 	r.ref.linkCache.RemoveWaker(r.ref.nic.ID(), nextAddr, waker)
 }
 
+// UsesNeighbor returns whether the packets written to r are sent to the
+// neighbor addr: its next hop or, if it has none, its destination, on its NIC.
+func (r *Route) UsesNeighbor(addr tcpip.FullAddress) bool {
+	if r.ref == nil || r.NICID() != addr.NIC {
+		return false
+	}
+	nextAddr := r.NextHop
+	if nextAddr == "" {
+		nextAddr = r.RemoteAddress
+	}
+	return nextAddr == addr.Addr
+}
+
+// neighbor returns the neighbor the packets written to r are sent to: its next
+// hop or, if it has none, its destination, on its NIC.
+func (r *Route) neighbor() tcpip.FullAddress {
+	nextAddr := r.NextHop
+	if nextAddr == "" {
+		nextAddr = r.RemoteAddress
+	}
+	return tcpip.FullAddress{NIC: r.ref.nic.ID(), Addr: nextAddr}
+}
+
+// ConfirmReachable tells the stack that the neighbor of the route is
+// reachable, as upper layers showed by making forward progress, like TCP when
+// new data is acknowledged (RFC 4861 section 7.3.1). Its link address then
+// isn't resolved again before the neighbor cache's age limit elapses anew.
+func (r *Route) ConfirmReachable() {
+	if r.ref == nil || r.ref.linkCache == nil {
+		return
+	}
+	r.ref.nic.stack.linkAddrCache.confirm(r.neighbor())
+}
+
+// ProbeReachability tells the stack that the neighbor of the route may no
+// longer be reachable, like when a connection stalls. Its link address is
+// resolved again in the background. If the neighbor answers with another
+// link address, or doesn't answer, the route becomes stale, so that its users
+// find it again; in the latter case, they also get a ControlHostUnreachable
+// control packet.
+func (r *Route) ProbeReachability() {
+	if r.ref == nil || r.ref.linkCache == nil {
+		return
+	}
+	s := r.ref.nic.stack
+	s.linkAddrCache.probe(r.neighbor(), s.linkAddrResolvers[r.NetProto], r.LocalAddress, r.ref.nic.writeEP)
+}
+
 // IsResolutionRequired returns true if Resolve() must be called to resolve
 // the link address before the this route can be written to.
 func (r *Route) IsResolutionRequired() bool {
 	return r.ref.linkCache != nil && r.RemoteLinkAddress == ""
 }
 
-// WritePacket writes the packet through the given route.
-func (r *Route) WritePacket(hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.TransportProtocolNumber, ttl uint8) *tcpip.Error {
-	err := r.ref.ep.WritePacket(r, hdr, payload, protocol, ttl, r.loop)
+// Removed returns whether the NIC of the route was removed from the stack, in
+// which case the route can't be used anymore and another one must be found.
+func (r *Route) Removed() bool {
+	return r.ref != nil && r.ref.nic.isRemoved()
+}
+
+// Stale returns whether the route table, the NICs, their addresses or the
+// link address of a neighbor changed since the route was found, in which case
+// FindRoute may now give a different route. Long-lived users of a route, like
+// connected endpoints, find it again when it's stale, so that they don't keep
+// sending through a path that no longer exists.
+func (r *Route) Stale() bool {
+	return r.ref != nil && (atomic.LoadUint64(&r.ref.nic.stack.routeGen) != r.gen || r.ref.nic.isRemoved())
+}
+
+// WritePacket writes the outbound packet pkt through the given route. pkt.Header
+// starts with the transport header, and must have room for the headers of the
+// lower layers, as given by MaxHeaderLength. The caller keeps its reference on
+// pkt.
+func (r *Route) WritePacket(pkt *PacketBuffer, protocol tcpip.TransportProtocolNumber, ttl uint8) *tcpip.Error {
+	return r.WritePacketWithParams(pkt, NetworkHeaderParams{Protocol: protocol, TTL: ttl})
+}
+
+// WritePacketWithParams is like WritePacket, but takes all the parameters of
+// the network header.
+func (r *Route) WritePacketWithParams(pkt *PacketBuffer, params NetworkHeaderParams) *tcpip.Error {
+	if r.ref.nic.isRemoved() {
+		r.Stats().IP.OutgoingPacketErrors.Increment()
+		r.recordWriteDrop(tcpip.DropNoRoute, pkt)
+		return tcpip.ErrNetworkUnreachable
+	}
+	if !r.ref.nic.isUp() {
+		r.Stats().IP.OutgoingPacketErrors.Increment()
+		r.ref.nic.stats.Tx.Errors.Increment()
+		r.recordWriteDrop(tcpip.DropNetworkDown, pkt)
+		return tcpip.ErrNetworkDown
+	}
+
+	// Replies to flows translated by destination NAT rules are sent from
+	// their original destination.
+	if r.ref.nic.stack.nat.active() {
+		if translated, ok := r.translateOutbound(pkt, params.Protocol); ok {
+			r = &translated
+		}
+	}
+
+	// The bytes sent are those handed to the route, not including the
+	// headers prepended by the lower layers.
+	size := pkt.Size()
+	err := r.ref.ep.WritePacket(r, pkt, params, r.loop)
 	if err != nil {
 		r.Stats().IP.OutgoingPacketErrors.Increment()
+		r.ref.nic.stats.Tx.Errors.Increment()
+		r.recordWriteDrop(tcpip.DropWriteError, pkt)
 	} else {
 		r.ref.nic.stats.Tx.Packets.Increment()
-		r.ref.nic.stats.Tx.Bytes.IncrementBy(uint64(hdr.UsedLength() + payload.Size()))
+		r.ref.nic.stats.Tx.Bytes.IncrementBy(uint64(size))
 	}
 	return err
 }
 
-// DefaultTTL returns the default TTL of the underlying network endpoint.
+// writeResolved writes a packet that was queued while the link address of the
+// next hop of r was resolved, now that it is.
+func (r *Route) writeResolved(pkt *PacketBuffer, protocol tcpip.NetworkProtocolNumber) {
+	if err := r.ref.nic.writeEP.WritePacket(r, pkt, protocol); err != nil {
+		r.Stats().IP.OutgoingPacketErrors.Increment()
+		r.ref.nic.stats.Tx.Errors.Increment()
+		r.recordWriteDrop(tcpip.DropWriteError, pkt)
+	}
+}
+
+// recordWriteDrop records the drop of an outbound packet that couldn't be
+// written.
+func (r *Route) recordWriteDrop(reason tcpip.DropReason, pkt *PacketBuffer) {
+	r.RecordDrop(reason, pkt.ToVectorisedView())
+}
+
+// FlowLabel returns the flow label the stack generates for the IPv6 packets of
+// a flow through the route, or zero if the route isn't IPv6 or automatic flow
+// labels are disabled. See Stack.SetAutoFlowLabels.
+func (r *Route) FlowLabel(protocol tcpip.TransportProtocolNumber, localPort, remotePort uint16) uint32 {
+	if r.NetProto != header.IPv6ProtocolNumber || r.ref == nil {
+		return 0
+	}
+	return r.ref.nic.stack.FlowLabel(protocol, TransportEndpointID{
+		LocalPort:     localPort,
+		LocalAddress:  r.LocalAddress,
+		RemotePort:    remotePort,
+		RemoteAddress: r.RemoteAddress,
+	})
+}
+
+// DefaultTTL returns the default TTL of the route: the hop limit of its route
+// table entry, if it has one, or else the one of the underlying network
+// endpoint.
 func (r *Route) DefaultTTL() uint8 {
+	if r.metrics.HopLimit != 0 {
+		return r.metrics.HopLimit
+	}
 	return r.ref.ep.DefaultTTL()
 }
 
-// MTU returns the MTU of the underlying network endpoint.
+// MTU returns the MTU of the underlying network endpoint, lowered to the MTU of
+// the route table entry of the route if it has one. Like the MTU of the link,
+// the one of the entry includes the network header.
 func (r *Route) MTU() uint32 {
-	return r.ref.ep.MTU()
+	mtu := r.ref.ep.MTU()
+	if m, link := r.metrics.MTU, r.ref.nic.linkEP.MTU(); m != 0 && m < link && link-m < mtu {
+		return mtu - (link - m)
+	}
+	return mtu
+}
+
+// MTULocked returns whether the MTU of the route must not be lowered by path
+// MTU discovery.
+func (r *Route) MTULocked() bool {
+	return r.metrics.LockMTU
+}
+
+// AdvertisedMSS returns the MSS TCP advertises through the route, or zero if
+// it is derived from the MTU.
+func (r *Route) AdvertisedMSS() uint16 {
+	return r.metrics.AdvMSS
+}
+
+// InitialCwnd returns the initial congestion window of the TCP connections
+// through the route, or zero for the default one.
+func (r *Route) InitialCwnd() int {
+	return r.metrics.InitCwnd
+}
+
+// IsAnycast returns whether the local address of the route is an anycast
+// address, which must not be used as source of the packets sent through it.
+func (r *Route) IsAnycast() bool {
+	return r.ref.anycast
+}
+
+// SetUnicastSource makes the route send from the primary address of its NIC
+// instead of its local address. It's used to answer packets sent to anycast
+// or multicast addresses, which aren't used as source. It returns false,
+// leaving the route unchanged, if the NIC has no primary address.
+func (r *Route) SetUnicastSource() bool {
+	ref := r.ref.nic.primaryEndpoint(r.NetProto)
+	if ref == nil {
+		return false
+	}
+	r.ref.decRef()
+	r.ref = ref
+	r.LocalAddress = ref.ep.ID().LocalAddress
+	return true
 }
 
 // Release frees all resources associated with the route.
@@ -170,6 +410,8 @@ func (r *Route) Release() {
 	if r.ref != nil {
 		r.ref.decRef()
 		r.ref = nil
+		tcpip.UntrackObject(r.leakID)
+		r.leakID = 0
 	}
 }
 
@@ -177,5 +419,7 @@ func (r *Route) Release() {
 // one will remain valid.
 func (r *Route) Clone() Route {
 	r.ref.incRef()
-	return *r
+	c := *r
+	c.leakID = tcpip.TrackObject("route")
+	return c
 }
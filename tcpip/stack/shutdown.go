@@ -0,0 +1,158 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// drainPollInterval is how often Shutdown checks whether the connections it
+// drains are finished.
+const drainPollInterval = 10 * time.Millisecond
+
+// DrainableEndpoint is a transport endpoint whose connection can be finished
+// gracefully, or aborted, when the stack is shut down.
+type DrainableEndpoint interface {
+	TransportEndpoint
+
+	// Drain starts finishing the connection of the endpoint, if any, once
+	// the data already written to it is delivered.
+	Drain()
+
+	// Drained returns whether the endpoint has no connection left to
+	// finish.
+	Drained() bool
+
+	// Abort resets the connection of the endpoint, if any.
+	Abort()
+}
+
+// Close shuts the stack down right away, aborting all connections. See
+// Shutdown.
+func (s *Stack) Close() {
+	s.shutdown(nil)
+}
+
+// Shutdown shuts the stack down. The connections of the transport endpoints
+// are first drained, until they are all finished or ctx is done, at which
+// point those that are left are aborted and ErrTimeout is returned. Then all
+// NICs are removed, in increasing order of ID, which closes their link
+// endpoints if they implement Close, and waits for their dispatchers if they
+// also implement Wait. Finally, the routes and caches of the stack are
+// cleared.
+//
+// The endpoints themselves must still be closed by their owners. The stack
+// must not be used once it is shut down; shutting it down again does nothing.
+func (s *Stack) Shutdown(ctx context.Context) *tcpip.Error {
+	return s.shutdown(ctx)
+}
+
+func (s *Stack) shutdown(ctx context.Context) *tcpip.Error {
+	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		return nil
+	}
+
+	var err *tcpip.Error
+	eps := s.drainableEndpoints()
+	if ctx != nil {
+		for _, ep := range eps {
+			ep.Drain()
+		}
+		if !waitDrained(ctx, eps) {
+			err = tcpip.ErrTimeout
+		}
+	}
+	for _, ep := range eps {
+		if !ep.Drained() {
+			ep.Abort()
+		}
+	}
+
+	s.mu.RLock()
+	ids := make([]tcpip.NICID, 0, len(s.nics))
+	for id := range s.nics {
+		ids = append(ids, id)
+	}
+	s.mu.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		linkEP := s.nicLinkEndpoint(id)
+		if s.RemoveNIC(id) != nil {
+			continue
+		}
+		if w, ok := linkEP.(interface {
+			Close()
+			Wait()
+		}); ok {
+			w.Wait()
+		}
+	}
+
+	s.mu.Lock()
+	s.routeTable = nil
+	s.redirects = nil
+	s.multicastRoutes = nil
+	s.invalidateRoutes()
+	s.mu.Unlock()
+	return err
+}
+
+// waitDrained waits until all eps are drained, or ctx is done. It returns
+// whether they were all drained.
+func waitDrained(ctx context.Context, eps []DrainableEndpoint) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		for len(eps) > 0 && eps[0].Drained() {
+			eps = eps[1:]
+		}
+		if len(eps) == 0 {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// nicLinkEndpoint returns the link endpoint of the NIC with the given ID, or
+// nil if there is no such NIC.
+func (s *Stack) nicLinkEndpoint(id tcpip.NICID) LinkEndpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if nic, ok := s.nics[id]; ok {
+		return nic.linkEP
+	}
+	return nil
+}
+
+// drainableEndpoints returns the transport endpoints registered with the stack
+// that implement DrainableEndpoint.
+func (s *Stack) drainableEndpoints() []DrainableEndpoint {
+	var eps []DrainableEndpoint
+	for _, ep := range s.registeredEndpoints() {
+		if d, ok := ep.(DrainableEndpoint); ok {
+			eps = append(eps, d)
+		}
+	}
+	return eps
+}
@@ -0,0 +1,189 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"sort"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// SocketOptions holds the common socket options of an endpoint, as reported in
+// a SocketInfo. Options that the endpoint doesn't support are left zero.
+type SocketOptions struct {
+	ReuseAddress      bool
+	ReusePort         bool
+	V6Only            bool
+	Broadcast         bool
+	KeepAlive         bool
+	NoDelay           bool
+	ReceiveBufferSize int
+	SendBufferSize    int
+}
+
+// SocketInfo describes a transport endpoint registered with the stack, like a
+// line of the output of ss or netstat.
+type SocketInfo struct {
+	// NetProtos are the network protocols the endpoint receives packets
+	// of, in increasing order. Dual-stack endpoints have two.
+	NetProtos []tcpip.NetworkProtocolNumber
+
+	// TransProto is the transport protocol of the endpoint.
+	TransProto tcpip.TransportProtocolNumber
+
+	// NIC is the NIC the endpoint is bound to, or 0 if it receives packets
+	// from all NICs.
+	NIC tcpip.NICID
+
+	// ID holds the local and remote addresses and ports of the endpoint.
+	// It is zero for raw endpoints.
+	ID TransportEndpointID
+
+	// Raw is set for raw endpoints.
+	Raw bool
+
+	// State is the protocol-specific state of the endpoint, like
+	// "LISTEN", or empty if the endpoint doesn't report it.
+	State string
+
+	// RecvQueue is the number of bytes waiting to be read from the
+	// endpoint. For listening endpoints, it is the number of established
+	// connections waiting to be accepted.
+	RecvQueue int
+
+	// SendQueue is the number of bytes written to the endpoint that
+	// haven't been acknowledged by the peer yet. For listening endpoints,
+	// it is the size of the accept backlog.
+	SendQueue int
+
+	// Options holds the socket options of the endpoint.
+	Options SocketOptions
+}
+
+// DiagnosableEndpoint is a transport endpoint that reports its state and queue
+// depths in socket dumps.
+type DiagnosableEndpoint interface {
+	TransportEndpoint
+
+	// Diagnose fills in the State, RecvQueue and SendQueue fields of
+	// info.
+	Diagnose(info *SocketInfo)
+}
+
+// Sockets returns a description of all the transport endpoints registered with
+// the stack, ordered by transport protocol, then local address and port, then
+// remote address and port. Endpoints that were created but not bound nor
+// connected yet aren't registered, so aren't included.
+func (s *Stack) Sockets() []SocketInfo {
+	var infos []*SocketInfo
+	byEP := make(map[TransportEndpoint]*SocketInfo)
+	add := func(nic tcpip.NICID) func(protocolIDs, TransportEndpointID, TransportEndpoint, bool) {
+		return func(ids protocolIDs, id TransportEndpointID, ep TransportEndpoint, raw bool) {
+			if info, ok := byEP[ep]; ok {
+				info.NetProtos = append(info.NetProtos, ids.network)
+				return
+			}
+			info := &SocketInfo{
+				NetProtos:  []tcpip.NetworkProtocolNumber{ids.network},
+				TransProto: ids.transport,
+				NIC:        nic,
+				ID:         id,
+				Raw:        raw,
+			}
+			byEP[ep] = info
+			infos = append(infos, info)
+		}
+	}
+
+	s.mu.RLock()
+	nics := make(map[tcpip.NICID]*NIC, len(s.nics))
+	for id, nic := range s.nics {
+		nics[id] = nic
+	}
+	s.mu.RUnlock()
+
+	s.vrfMu.Lock()
+	demuxes := []*transportDemuxer{s.demux}
+	for _, v := range s.vrfs {
+		demuxes = append(demuxes, v.demux)
+	}
+	s.vrfMu.Unlock()
+
+	for _, d := range demuxes {
+		d.forEachEndpoint(add(0))
+	}
+	for id, nic := range nics {
+		nic.demux.forEachEndpoint(add(id))
+	}
+
+	for ep, info := range byEP {
+		sort.Slice(info.NetProtos, func(i, j int) bool { return info.NetProtos[i] < info.NetProtos[j] })
+		if d, ok := ep.(DiagnosableEndpoint); ok {
+			d.Diagnose(info)
+		}
+		if e, ok := ep.(tcpip.Endpoint); ok {
+			info.Options = socketOptions(e)
+		}
+	}
+	res := make([]SocketInfo, 0, len(infos))
+	for _, info := range infos {
+		res = append(res, *info)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		a, b := &res[i], &res[j]
+		switch {
+		case a.TransProto != b.TransProto:
+			return a.TransProto < b.TransProto
+		case a.ID.LocalAddress != b.ID.LocalAddress:
+			return a.ID.LocalAddress < b.ID.LocalAddress
+		case a.ID.LocalPort != b.ID.LocalPort:
+			return a.ID.LocalPort < b.ID.LocalPort
+		case a.ID.RemoteAddress != b.ID.RemoteAddress:
+			return a.ID.RemoteAddress < b.ID.RemoteAddress
+		default:
+			return a.ID.RemotePort < b.ID.RemotePort
+		}
+	})
+	return res
+}
+
+// socketOptions returns the common socket options of ep.
+func socketOptions(ep tcpip.Endpoint) SocketOptions {
+	var o SocketOptions
+
+	var reuseAddress tcpip.ReuseAddressOption
+	o.ReuseAddress = ep.GetSockOpt(&reuseAddress) == nil && reuseAddress != 0
+	var reusePort tcpip.ReusePortOption
+	o.ReusePort = ep.GetSockOpt(&reusePort) == nil && reusePort != 0
+	var v6Only tcpip.V6OnlyOption
+	o.V6Only = ep.GetSockOpt(&v6Only) == nil && v6Only != 0
+	var broadcast tcpip.BroadcastOption
+	o.Broadcast = ep.GetSockOpt(&broadcast) == nil && broadcast != 0
+	var keepAlive tcpip.KeepaliveEnabledOption
+	o.KeepAlive = ep.GetSockOpt(&keepAlive) == nil && keepAlive != 0
+	// Nagle's algorithm is disabled when the delay option is unset.
+	var delay tcpip.DelayOption
+	o.NoDelay = ep.GetSockOpt(&delay) == nil && delay == 0
+
+	var rcv tcpip.ReceiveBufferSizeOption
+	if ep.GetSockOpt(&rcv) == nil {
+		o.ReceiveBufferSize = int(rcv)
+	}
+	var snd tcpip.SendBufferSizeOption
+	if ep.GetSockOpt(&snd) == nil {
+		o.SendBufferSize = int(snd)
+	}
+	return o
+}
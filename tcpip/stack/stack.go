@@ -25,15 +25,19 @@
 package stack
 
 import (
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/netstack/sleep"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/network/hash"
 	"github.com/google/netstack/tcpip/ports"
 	"github.com/google/netstack/tcpip/seqnum"
+	"github.com/google/netstack/tcpip/timerwheel"
 	"github.com/google/netstack/waiter"
 )
 
@@ -48,7 +52,7 @@ const (
 
 type transportProtocolState struct {
 	proto          TransportProtocol
-	defaultHandler func(r *Route, id TransportEndpointID, netHeader buffer.View, vv buffer.VectorisedView) bool
+	defaultHandler func(r *Route, id TransportEndpointID, pkt *PacketBuffer) bool
 }
 
 // TCPProbeFunc is the expected function type for a TCP probe function to be
@@ -133,6 +137,14 @@ type TCPSenderState struct {
 	// DupAckCount is the number of Duplicate ACK's received.
 	DupAckCount int
 
+	// DupAckThreshold is the number of duplicate ACK's that trigger a
+	// fast retransmit, adapted to the reordering seen on the connection.
+	DupAckThreshold int
+
+	// Reordering is the largest reordering degree seen on the connection,
+	// in segments.
+	Reordering int
+
 	// SndCwnd is the size of the sending congestion window in packets.
 	SndCwnd int
 
@@ -300,26 +312,214 @@ type Stack struct {
 	// destination.
 	routeTable []tcpip.Route
 
+	// redirects holds the host routes installed by ICMP redirects, by
+	// destination.
+	redirects map[tcpip.Address]redirect
+
+	// deadNextHops holds the monotonic time at which the gateways of
+	// multipath routes that couldn't be resolved are used again.
+	deadNextHops map[tcpip.FullAddress]int64
+
+	// multicastRoutes is the multicast forwarding cache.
+	multicastRoutes map[multicastRouteKey]MulticastRoute
+
 	*ports.PortManager
 
 	// If not nil, then any new endpoints will have this probe function
 	// invoked everytime they receive a TCP segment.
 	tcpProbeFunc TCPProbeFunc
 
+	// If not nil, dropHook is invoked with every packet dropped by the
+	// stack.
+	dropHook DropHook
+
 	// clock is used to generate user-visible times.
 	clock tcpip.Clock
 
 	// handleLocal allows non-loopback interfaces to loop packets.
 	handleLocal bool
+
+	// captureMu serializes updates to captures and protects nextCapture.
+	// captures holds a []capture and is read without locking.
+	captureMu   sync.Mutex
+	captures    atomic.Value
+	nextCapture int
+
+	// linkStateMu protects linkStateHandlers and nextLinkStateHandler.
+	linkStateMu          sync.Mutex
+	linkStateHandlers    map[int]func(LinkStateEvent)
+	nextLinkStateHandler int
+
+	// resolutionFailureMu protects resolutionFailureHandlers and
+	// nextResolutionFailureHandler.
+	resolutionFailureMu          sync.Mutex
+	resolutionFailureHandlers    map[int]func(ResolutionFailureEvent)
+	nextResolutionFailureHandler int
+
+	// eventMu protects eventHandlers and nextEventHandler.
+	eventMu          sync.Mutex
+	eventHandlers    map[int]func(Event)
+	nextEventHandler int
+
+	// icmpRateLimiter limits the rate of ICMP messages generated by the
+	// stack.
+	icmpRateLimiter *icmpRateLimiter
+
+	// destinationCache holds the metrics learned for remote addresses.
+	destinationCache *destinationCache
+
+	// nat holds the destination NAT rules and the flows they translated.
+	nat *natTable
+
+	// autoFlowLabels is 1 if flow labels are generated for IPv6 flows. It
+	// must be accessed atomically. flowLabelSeed is the secret key of the
+	// flow label hash.
+	autoFlowLabels uint32
+	flowLabelSeed  uint32
+
+	// multipathSeed is the secret key of the hash selecting the next hop
+	// of multipath routes.
+	multipathSeed uint32
+
+	// loopbackFastPath is 1 if the loopback fast path is enabled. It must
+	// be accessed atomically.
+	loopbackFastPath uint32
+
+	// acceptRedirects and sendRedirects are 1 if ICMP redirects are
+	// handled and sent, respectively. They must be accessed atomically.
+	acceptRedirects uint32
+	sendRedirects   uint32
+
+	// controlMemoryMax is the control memory each endpoint may use. It
+	// must be accessed atomically.
+	controlMemoryMax int32
+
+	// rcvHostModel and sndHostModel are the host models of the NICs that
+	// don't have their own. They must be accessed atomically.
+	rcvHostModel HostModel
+	sndHostModel HostModel
+
+	// closed is 1 once the stack was shut down. It must be accessed
+	// atomically.
+	closed uint32
+
+	// nodeInfoMu protects nodeName and nodeInfoResponder.
+	nodeInfoMu        sync.Mutex
+	nodeName          string
+	nodeInfoResponder bool
+
+	// vrfMu protects vrfs, which holds the state of the VRFs other than
+	// the default one.
+	vrfMu sync.Mutex
+	vrfs  map[tcpip.VRFID]*vrf
+
+	// routeGen is incremented whenever a change to the route table, the
+	// NICs, their addresses or the link address cache may give another
+	// result to FindRoute. It must be accessed atomically.
+	routeGen uint64
+}
+
+// LinkStateEvent describes a change in the operational state of a NIC.
+type LinkStateEvent struct {
+	// NIC is the NIC whose state changed.
+	NIC tcpip.NICID
+
+	// Up is the new operational state of the NIC. A NIC is operationally
+	// up when it is administratively up and its link endpoint has carrier.
+	Up bool
+
+	// Removed is set when the NIC was removed by Stack.RemoveNIC.
+	Removed bool
+}
+
+// NeighborState is the state of an entry of the neighbor (ARP or NDP) cache.
+type NeighborState int
+
+const (
+	// NeighborIncomplete means that the address is being resolved.
+	NeighborIncomplete NeighborState = iota
+
+	// NeighborReachable means that the address was resolved and the entry
+	// hasn't expired yet.
+	NeighborReachable
+
+	// NeighborFailed means that the resolution of the address timed out.
+	// The entry is kept until it expires, so that packets to the address
+	// fail right away.
+	NeighborFailed
+
+	// NeighborPermanent means that the entry was added with
+	// Stack.AddStaticNeighbor. It never expires and is not replaced by
+	// address resolution.
+	NeighborPermanent
+
+	// NeighborProbe means that the entry is reachable, but upper layers
+	// suspect it no longer is, see Route.ProbeReachability. Its address is
+	// being resolved again, and the entry is still used meanwhile.
+	NeighborProbe
+)
+
+// String implements fmt.Stringer.
+func (s NeighborState) String() string {
+	switch s {
+	case NeighborIncomplete:
+		return "INCOMPLETE"
+	case NeighborReachable:
+		return "REACHABLE"
+	case NeighborFailed:
+		return "FAILED"
+	case NeighborPermanent:
+		return "PERMANENT"
+	case NeighborProbe:
+		return "PROBE"
+	default:
+		return fmt.Sprintf("NeighborState(%d)", int(s))
+	}
+}
+
+// NeighborEntry describes an entry of the neighbor cache of a NIC.
+type NeighborEntry struct {
+	// Addr is the network address of the neighbor.
+	Addr tcpip.Address
+
+	// LinkAddr is the link address of the neighbor. It is empty if the
+	// entry is incomplete or failed.
+	LinkAddr tcpip.LinkAddress
+
+	// State is the state of the entry.
+	State NeighborState
+
+	// Age is how long ago the entry was added or last resolved.
+	Age time.Duration
+}
+
+// ResolutionFailureEvent describes a failure to resolve the link address of a
+// neighbor.
+type ResolutionFailureEvent struct {
+	// NIC is the NIC the address was resolved on.
+	NIC tcpip.NICID
+
+	// Addr is the address that couldn't be resolved.
+	Addr tcpip.Address
 }
 
 // Options contains optional Stack configuration.
 type Options struct {
-	// Clock is an optional clock source used for timestampping packets.
+	// Clock is an optional clock source used for timestampping packets and
+	// for the timers of the stack and its protocols. Tests can pass a
+	// manually advanced clock to make timeouts deterministic.
 	//
 	// If no Clock is specified, the clock source will be time.Now.
 	Clock tcpip.Clock
 
+	// TimerResolution, if set, makes the timers of the stack and its
+	// protocols, like the TCP retransmission, delayed ACK and keepalive
+	// timers, share a hierarchical timing wheel of that resolution driven
+	// by Clock, rather than use a timer of Clock each. Timers may then
+	// fire up to one resolution late, but are much cheaper when there are
+	// many of them.
+	TimerResolution time.Duration
+
 	// Stats are optional statistic counters.
 	Stats tcpip.Stats
 
@@ -341,17 +541,28 @@ func New(network []string, transport []string, opts Options) *Stack {
 	if clock == nil {
 		clock = &tcpip.StdClock{}
 	}
+	if opts.TimerResolution > 0 {
+		clock = timerwheel.New(clock, opts.TimerResolution)
+	}
 
 	s := &Stack{
 		transportProtocols: make(map[tcpip.TransportProtocolNumber]*transportProtocolState),
 		networkProtocols:   make(map[tcpip.NetworkProtocolNumber]NetworkProtocol),
 		linkAddrResolvers:  make(map[tcpip.NetworkProtocolNumber]LinkAddressResolver),
 		nics:               make(map[tcpip.NICID]*NIC),
-		linkAddrCache:      newLinkAddrCache(ageLimit, resolutionTimeout, resolutionAttempts),
+		linkAddrCache:      newLinkAddrCache(clock, ageLimit, resolutionTimeout, resolutionAttempts),
 		PortManager:        ports.NewPortManager(),
 		clock:              clock,
 		stats:              opts.Stats.FillIn(),
 		handleLocal:        opts.HandleLocal,
+		icmpRateLimiter:    newICMPRateLimiter(clock, DefaultICMPRateLimit),
+		destinationCache:   newDestinationCache(clock),
+		nat:                newNATTable(clock),
+		flowLabelSeed:      hash.RandN32(1)[0],
+		multipathSeed:      hash.RandN32(1)[0],
+		acceptRedirects:    1,
+		sendRedirects:      1,
+		controlMemoryMax:   DefaultControlMemoryMax,
 	}
 
 	// Add specified network protocols.
@@ -382,6 +593,16 @@ func New(network []string, transport []string, opts Options) *Stack {
 	// Create the global transport demuxer.
 	s.demux = newTransportDemuxer(s)
 
+	s.linkAddrCache.onFailure = func(addr tcpip.FullAddress) {
+		// Routes may hold the link address of a neighbor that was
+		// probed and found unreachable.
+		s.invalidateRoutes()
+		s.markNextHopDead(addr)
+		s.notifyHostUnreachable(addr)
+		s.notifyResolutionFailure(addr)
+		s.publish(Event{Type: EventNeighborLost, NIC: addr.NIC, Address: addr.Addr})
+	}
+
 	return s
 }
 
@@ -446,7 +667,7 @@ func (s *Stack) TransportProtocolOption(transport tcpip.TransportProtocolNumber,
 //
 // It must be called only during initialization of the stack. Changing it as the
 // stack is operating is not supported.
-func (s *Stack) SetTransportProtocolHandler(p tcpip.TransportProtocolNumber, h func(*Route, TransportEndpointID, buffer.View, buffer.VectorisedView) bool) {
+func (s *Stack) SetTransportProtocolHandler(p tcpip.TransportProtocolNumber, h func(*Route, TransportEndpointID, *PacketBuffer) bool) {
 	state := s.transportProtocols[p]
 	if state != nil {
 		state.defaultHandler = h
@@ -458,6 +679,25 @@ func (s *Stack) NowNanoseconds() int64 {
 	return s.clock.NowNanoseconds()
 }
 
+// Clock returns the clock of the stack.
+func (s *Stack) Clock() tcpip.Clock {
+	return s.clock
+}
+
+// Now returns the current time according to the clock of the stack. It is
+// what protocols use instead of time.Now.
+func (s *Stack) Now() time.Time {
+	clock := s.clock
+	if w, ok := clock.(*timerwheel.Wheel); ok {
+		clock = w.Clock()
+	}
+	if _, ok := clock.(*tcpip.StdClock); ok {
+		// Keep the monotonic clock reading of time.Now.
+		return time.Now()
+	}
+	return time.Unix(0, s.clock.NowNanoseconds())
+}
+
 // Stats returns a mutable copy of the current stats.
 //
 // This is not generally exported via the public interface, but is available
@@ -483,12 +723,22 @@ func (s *Stack) Forwarding() bool {
 }
 
 // SetRouteTable assigns the route table to be used by this stack. It
-// specifies which NIC to use for given destination address ranges.
+// specifies which NIC to use for given destination address ranges. The host
+// routes installed by ICMP redirects are removed.
 func (s *Stack) SetRouteTable(table []tcpip.Route) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	s.routeTable = table
+	s.redirects = nil
+	s.invalidateRoutes()
+	s.mu.Unlock()
+
+	s.publish(Event{Type: EventRoutesChanged, Routes: append([]tcpip.Route(nil), table...)})
+}
+
+// invalidateRoutes marks all the routes found so far as stale. See
+// Route.Stale.
+func (s *Stack) invalidateRoutes() {
+	atomic.AddUint64(&s.routeGen, 1)
 }
 
 // GetRouteTable returns the route table which is currently in use.
@@ -529,20 +779,23 @@ func (s *Stack) createNIC(id tcpip.NICID, name string, linkEP tcpip.LinkEndpoint
 	}
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
 	// Make sure id is unique.
 	if _, ok := s.nics[id]; ok {
+		s.mu.Unlock()
 		return tcpip.ErrDuplicateNICID
 	}
 
 	n := newNIC(s, id, name, ep, loopback)
 
 	s.nics[id] = n
+	s.invalidateRoutes()
 	if enabled {
 		n.attachLinkEndpoint()
 	}
+	s.mu.Unlock()
 
+	s.publish(Event{Type: EventNICAdded, NIC: id})
 	return nil
 }
 
@@ -592,6 +845,157 @@ func (s *Stack) EnableNIC(id tcpip.NICID) *tcpip.Error {
 	return nil
 }
 
+// SetNICUp sets the administrative state of the given NIC. Packets are
+// neither sent nor received over a NIC that is down, routes through it are not
+// selected, and writes over existing routes through it fail with
+// tcpip.ErrNetworkDown.
+func (s *Stack) SetNICUp(id tcpip.NICID, up bool) *tcpip.Error {
+	s.mu.RLock()
+	nic := s.nics[id]
+	s.mu.RUnlock()
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	if nic.setUp(up) {
+		s.notifyLinkState(LinkStateEvent{NIC: id, Up: nic.isUp()})
+	}
+	return nil
+}
+
+// SubscribeLinkState registers h to be called whenever the operational state
+// of a NIC changes, either because it was set administratively up or down or
+// because its link endpoint reported a carrier change. h is called without
+// any stack locks held. The returned function removes the subscription.
+func (s *Stack) SubscribeLinkState(h func(LinkStateEvent)) (cancel func()) {
+	s.linkStateMu.Lock()
+	defer s.linkStateMu.Unlock()
+	if s.linkStateHandlers == nil {
+		s.linkStateHandlers = make(map[int]func(LinkStateEvent))
+	}
+	id := s.nextLinkStateHandler
+	s.nextLinkStateHandler++
+	s.linkStateHandlers[id] = h
+	return func() {
+		s.linkStateMu.Lock()
+		delete(s.linkStateHandlers, id)
+		s.linkStateMu.Unlock()
+	}
+}
+
+// notifyLinkState calls the link state subscribers with the new operational
+// state of a NIC.
+func (s *Stack) notifyLinkState(e LinkStateEvent) {
+	s.invalidateRoutes()
+
+	s.linkStateMu.Lock()
+	handlers := make([]func(LinkStateEvent), 0, len(s.linkStateHandlers))
+	for _, h := range s.linkStateHandlers {
+		handlers = append(handlers, h)
+	}
+	s.linkStateMu.Unlock()
+
+	for _, h := range handlers {
+		h(e)
+	}
+
+	switch {
+	case e.Removed:
+		s.publish(Event{Type: EventNICRemoved, NIC: e.NIC})
+	case e.Up:
+		s.publish(Event{Type: EventNICUp, NIC: e.NIC})
+	default:
+		s.publish(Event{Type: EventNICDown, NIC: e.NIC})
+	}
+}
+
+// SetNICMTU changes the MTU of the given NIC's link endpoint at runtime. The
+// link endpoint must implement MTUSettableLinkEndpoint. Routes through the NIC
+// use the new MTU immediately, and transport endpoints are sent a
+// ControlMTUChanged control packet so that established connections can adjust
+// their segment sizes.
+func (s *Stack) SetNICMTU(id tcpip.NICID, mtu uint32) *tcpip.Error {
+	s.mu.RLock()
+	nic := s.nics[id]
+	s.mu.RUnlock()
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	if err := SetLinkMTU(nic.linkEP, mtu); err != nil {
+		return err
+	}
+
+	// Endpoints bound to the NIC are registered with its demuxer, while
+	// those bound to all NICs are registered with the stack's and may be
+	// routed through it.
+	nic.demux.deliverControlPacketToAll(ControlMTUChanged, uint32(id), ControlInfo{})
+	nic.transportDemux().deliverControlPacketToAll(ControlMTUChanged, uint32(id), ControlInfo{})
+	return nil
+}
+
+// RemoveNIC removes the NIC with the given ID from the stack, tearing down its
+// state:
+//
+//   - its addresses are removed, and the routes through it are removed from
+//     the route table;
+//   - routes obtained through it before can't be written to anymore, writes
+//     fail with tcpip.ErrNetworkUnreachable;
+//   - its link address cache entries are flushed;
+//   - transport endpoints that may be using it are sent a ControlNICRemoved
+//     control packet, so that those bound or connected through it can fail;
+//   - link state subscribers are notified;
+//   - its link endpoint stops being used, and is closed if it has a Close
+//     method. Packets it delivers afterwards are dropped.
+//
+// The ID can be reused for a new NIC once RemoveNIC returns.
+func (s *Stack) RemoveNIC(id tcpip.NICID) *tcpip.Error {
+	nic, err := s.removeNIC(id)
+	if err != nil {
+		return err
+	}
+	if c, ok := nic.linkEP.(interface{ Close() }); ok {
+		c.Close()
+	}
+	return nil
+}
+
+// removeNIC is RemoveNIC, but leaves the link endpoint of the NIC open. It
+// returns the removed NIC.
+func (s *Stack) removeNIC(id tcpip.NICID) (*NIC, *tcpip.Error) {
+	s.mu.Lock()
+	nic := s.nics[id]
+	if nic == nil {
+		s.mu.Unlock()
+		return nil, tcpip.ErrUnknownNICID
+	}
+	delete(s.nics, id)
+
+	// The route table may be shared with the caller of SetRouteTable, so
+	// it is not modified in place.
+	table := make([]tcpip.Route, 0, len(s.routeTable))
+	for _, r := range s.routeTable {
+		if r.NIC != id {
+			table = append(table, r)
+		}
+	}
+	routesChanged := len(table) != len(s.routeTable)
+	s.routeTable = table
+	s.invalidateRoutes()
+	s.mu.Unlock()
+
+	nic.remove()
+	s.linkAddrCache.removeNIC(id)
+
+	nic.demux.deliverControlPacketToAll(ControlNICRemoved, uint32(id), ControlInfo{})
+	nic.transportDemux().deliverControlPacketToAll(ControlNICRemoved, uint32(id), ControlInfo{})
+	s.notifyLinkState(LinkStateEvent{NIC: id, Removed: true})
+	if routesChanged {
+		s.publish(Event{Type: EventRoutesChanged, Routes: append([]tcpip.Route(nil), table...)})
+	}
+	return nic, nil
+}
+
 // CheckNIC checks if a NIC is usable.
 func (s *Stack) CheckNIC(id tcpip.NICID) bool {
 	s.mu.RLock()
@@ -628,6 +1032,9 @@ type NICInfo struct {
 	// MTU is the maximum transmission unit.
 	MTU uint32
 
+	// VRF is the VRF the NIC belongs to.
+	VRF tcpip.VRFID
+
 	Stats NICStats
 }
 
@@ -638,10 +1045,13 @@ func (s *Stack) NICInfo() map[tcpip.NICID]NICInfo {
 
 	nics := make(map[tcpip.NICID]NICInfo)
 	for id, nic := range s.nics {
+		up, lowerUp := nic.linkState()
 		flags := NICStateFlags{
-			Up:          true, // Netstack interfaces are always up.
-			Running:     nic.linkEP.IsAttached(),
+			Up:          up,
+			Running:     nic.linkEP.IsAttached() && lowerUp,
 			Promiscuous: nic.isPromiscuousMode(),
+			Spoofing:    nic.isSpoofing(),
+			Transparent: nic.isTransparent(),
 			Loopback:    nic.linkEP.Capabilities()&CapabilityLoopback != 0,
 		}
 		nics[id] = NICInfo{
@@ -650,6 +1060,7 @@ func (s *Stack) NICInfo() map[tcpip.NICID]NICInfo {
 			ProtocolAddresses: nic.Addresses(),
 			Flags:             flags,
 			MTU:               nic.linkEP.MTU(),
+			VRF:               nic.vrfID(),
 			Stats:             nic.stats,
 		}
 	}
@@ -658,15 +1069,23 @@ func (s *Stack) NICInfo() map[tcpip.NICID]NICInfo {
 
 // NICStateFlags holds information about the state of an NIC.
 type NICStateFlags struct {
-	// Up indicates whether the interface is running.
+	// Up indicates whether the interface is administratively up.
 	Up bool
 
-	// Running indicates whether resources are allocated.
+	// Running indicates whether resources are allocated and the link has
+	// carrier.
 	Running bool
 
 	// Promiscuous indicates whether the interface is in promiscuous mode.
 	Promiscuous bool
 
+	// Spoofing indicates whether the interface allows endpoints to use
+	// addresses that weren't added to it as source addresses.
+	Spoofing bool
+
+	// Transparent indicates whether the interface is in transparent mode.
+	Transparent bool
+
 	// Loopback indicates whether the interface is a loopback.
 	Loopback bool
 }
@@ -690,6 +1109,40 @@ func (s *Stack) AddAddressWithOptions(id tcpip.NICID, protocol tcpip.NetworkProt
 	return nic.AddAddressWithOptions(protocol, addr, peb)
 }
 
+// AddAnycastAddress adds an IPv6 anycast address to the specified NIC. The NIC
+// accepts packets destined to it and answers neighbor solicitations for it as
+// RFC 4861 section 7.2.7 requires, but never uses it as source address: it's
+// never primary, and endpoints can't bind to it. There's no duplicate address
+// detection to skip, as the stack doesn't do any.
+func (s *Stack) AddAnycastAddress(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) *tcpip.Error {
+	if protocol != header.IPv6ProtocolNumber {
+		return tcpip.ErrNotSupported
+	}
+	if len(addr) != header.IPv6AddressSize || header.IsV6MulticastAddress(addr) || addr == header.IPv6Any {
+		return tcpip.ErrBadAddress
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.AddAnycastAddress(protocol, addr)
+}
+
+// IsAnycastAddress returns whether addr is an anycast address of the given
+// NIC, added with AddAnycastAddress.
+func (s *Stack) IsAnycastAddress(nicid tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicid]
+	return nic != nil && nic.isAnycastAddress(protocol, addr)
+}
+
 // AddSubnet adds a subnet range to the specified NIC.
 func (s *Stack) AddSubnet(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber, subnet tcpip.Subnet) *tcpip.Error {
 	s.mu.RLock()
@@ -761,30 +1214,115 @@ func (s *Stack) getRefEP(nic *NIC, localAddr tcpip.Address, netProto tcpip.Netwo
 	if len(localAddr) == 0 {
 		return nic.primaryEndpoint(netProto)
 	}
-	return nic.findEndpoint(netProto, localAddr, CanBePrimaryEndpoint)
+	if ref := nic.findEndpoint(netProto, localAddr, CanBePrimaryEndpoint); ref != nil {
+		if ref.anycast {
+			// Anycast addresses are never used as source.
+			ref.decRef()
+			return nil
+		}
+		return ref
+	}
+	if ref := s.weakSourceEndpointLocked(nic, localAddr, netProto); ref != nil {
+		return ref
+	}
+	// Transparent endpoints send from the addresses they were bound to or
+	// accepted connections on, which aren't local.
+	if nic.isTransparent() {
+		return nic.getTemporaryEndpoint(netProto, localAddr, CanBePrimaryEndpoint)
+	}
+	return nil
 }
 
 // FindRoute creates a route to the given destination address, leaving through
 // the given nic and local address (if provided).
+//
+// Routes are looked up in the order of the route table. If the first route
+// matching the destination is a blackhole, unreachable or prohibit route, the
+// error documented by its tcpip.RouteType is returned.
+//
+// IPv6 link-local addresses are only unique within a link, so routes to them
+// must be scoped: id must be the NIC of the link, or ErrNoRoute is returned.
+//
+// The route is found in the VRF of the given NIC, or in the default VRF if
+// none is given.
 func (s *Stack) FindRoute(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber, multicastLoop bool) (Route, *tcpip.Error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	return s.findRouteLocked(s.nicVRFLocked(id), id, localAddr, remoteAddr, netProto, multicastLoop, s.destinationHash(netProto, remoteAddr))
+}
+
+// FindRouteInVRF is like FindRoute, but only considers the NICs of the given
+// VRF and the routes through them. Routes of types other than RouteUnicast
+// that aren't bound to a NIC apply to the default VRF. If a NIC is given, it
+// must belong to the VRF.
+func (s *Stack) FindRouteInVRF(vrf tcpip.VRFID, id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber, multicastLoop bool) (Route, *tcpip.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if id != 0 && s.nicVRFLocked(id) != vrf {
+		return Route{}, tcpip.ErrNoRoute
+	}
+	return s.findRouteLocked(vrf, id, localAddr, remoteAddr, netProto, multicastLoop, s.destinationHash(netProto, remoteAddr))
+}
+
+// findForwardingRoute finds the route used to forward a packet to dst within
+// the given VRF. The next hop of multipath routes is selected with flowHash,
+// the hash of the packet's flow.
+func (s *Stack) findForwardingRoute(vrf tcpip.VRFID, dst tcpip.Address, netProto tcpip.NetworkProtocolNumber, flowHash uint32) (Route, *tcpip.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.findRouteLocked(vrf, 0, "", dst, netProto, false /* multicastLoop */, flowHash)
+}
+
+// findRouteLocked implements FindRouteInVRF. The next hop of multipath routes
+// is selected with flowHash. s.mu must be held.
+func (s *Stack) findRouteLocked(vrf tcpip.VRFID, id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber, multicastLoop bool, flowHash uint32) (Route, *tcpip.Error) {
+	// Changes made while the route is being found make it stale right
+	// away.
+	gen := atomic.LoadUint64(&s.routeGen)
 
 	isBroadcast := remoteAddr == header.IPv4Broadcast
 	isMulticast := header.IsV4MulticastAddress(remoteAddr) || header.IsV6MulticastAddress(remoteAddr)
-	needRoute := !(isBroadcast || isMulticast || header.IsV6LinkLocalAddress(remoteAddr))
+	isLinkLocal := header.IsV6LinkLocalAddress(remoteAddr)
+	if isLinkLocal && id == 0 {
+		return Route{}, tcpip.ErrNoRoute
+	}
+	needRoute := !(isBroadcast || isMulticast || isLinkLocal)
+	down := false
 	if id != 0 && !needRoute {
 		if nic, ok := s.nics[id]; ok {
+			if !nic.isUp() {
+				return Route{}, tcpip.ErrNetworkDown
+			}
 			if ref := s.getRefEP(nic, localAddr, netProto); ref != nil {
-				return makeRoute(netProto, ref.ep.ID().LocalAddress, remoteAddr, nic.linkEP.LinkAddress(), ref, s.handleLocal && !nic.loopback, multicastLoop && !nic.loopback), nil
+				r := makeRoute(netProto, ref.ep.ID().LocalAddress, remoteAddr, nic.linkEP.LinkAddress(), ref, s.handleLocal && !nic.loopback, multicastLoop && !nic.loopback)
+				r.gen = gen
+				r.leakID = tcpip.TrackObject("route")
+				return r, nil
 			}
 		}
 	} else {
-		for _, route := range s.routeTable {
+		table := s.routeTableLocked(remoteAddr)
+		for i, route := range table {
+			if s.nicVRFLocked(route.NIC) != vrf {
+				continue
+			}
+			if route.Type != tcpip.RouteUnicast {
+				if needRoute && len(remoteAddr) != 0 && route.Match(remoteAddr) {
+					return Route{}, routeTypeError(route.Type)
+				}
+				continue
+			}
 			if (id != 0 && id != route.NIC) || (len(remoteAddr) != 0 && !route.Match(remoteAddr)) {
 				continue
 			}
+			if needRoute {
+				route = s.selectNextHopLocked(table[i:], vrf, id, flowHash)
+			}
 			if nic, ok := s.nics[route.NIC]; ok {
+				if !nic.isUp() {
+					down = true
+					continue
+				}
 				if ref := s.getRefEP(nic, localAddr, netProto); ref != nil {
 					if len(remoteAddr) == 0 {
 						// If no remote address was provided, then the route
@@ -796,12 +1334,21 @@ func (s *Stack) FindRoute(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, n
 					if needRoute {
 						r.NextHop = route.Gateway
 					}
+					r.metrics = route
+					r.gen = gen
+					r.leakID = tcpip.TrackObject("route")
 					return r, nil
 				}
 			}
 		}
 	}
 
+	// Only report that the network is down if a route would otherwise
+	// have been found.
+	if down {
+		return Route{}, tcpip.ErrNetworkDown
+	}
+
 	if !needRoute {
 		return Route{}, tcpip.ErrNetworkUnreachable
 	}
@@ -809,6 +1356,19 @@ func (s *Stack) FindRoute(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, n
 	return Route{}, tcpip.ErrNoRoute
 }
 
+// routeTypeError returns the error FindRoute returns for destinations matched
+// by a route of type t, other than RouteUnicast.
+func routeTypeError(t tcpip.RouteType) *tcpip.Error {
+	switch t {
+	case tcpip.RouteUnreachable:
+		return tcpip.ErrHostUnreachable
+	case tcpip.RouteProhibit:
+		return tcpip.ErrProhibited
+	default:
+		return tcpip.ErrNoRoute
+	}
+}
+
 // CheckNetworkProtocol checks if a given network protocol is enabled in the
 // stack.
 func (s *Stack) CheckNetworkProtocol(protocol tcpip.NetworkProtocolNumber) bool {
@@ -819,14 +1379,39 @@ func (s *Stack) CheckNetworkProtocol(protocol tcpip.NetworkProtocolNumber) bool
 // CheckLocalAddress determines if the given local address exists, and if it
 // does, returns the id of the NIC it's bound to. Returns 0 if the address
 // does not exist.
+//
+// IPv6 link-local addresses can be used by several NICs, so they are only
+// found if nicid is given.
+//
+// Anycast addresses can't be used as local address of endpoints, so they
+// aren't found.
+//
+// If no NIC is given, only the NICs of the default VRF are searched.
 func (s *Stack) CheckLocalAddress(nicid tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) tcpip.NICID {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	return s.checkLocalAddressLocked(s.nicVRFLocked(nicid), nicid, protocol, addr)
+}
+
+// CheckLocalAddressInVRF is like CheckLocalAddress, but only searches the NICs
+// of the given VRF.
+func (s *Stack) CheckLocalAddressInVRF(vrf tcpip.VRFID, nicid tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) tcpip.NICID {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.checkLocalAddressLocked(vrf, nicid, protocol, addr)
+}
+
+// checkLocalAddressLocked implements CheckLocalAddressInVRF. s.mu must be
+// held.
+func (s *Stack) checkLocalAddressLocked(vrf tcpip.VRFID, nicid tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) tcpip.NICID {
+	if nicid == 0 && header.IsV6LinkLocalAddress(addr) {
+		return 0
+	}
 
 	// If a NIC is specified, we try to find the address there only.
 	if nicid != 0 {
 		nic := s.nics[nicid]
-		if nic == nil {
+		if nic == nil || nic.vrfID() != vrf {
 			return 0
 		}
 
@@ -836,16 +1421,24 @@ func (s *Stack) CheckLocalAddress(nicid tcpip.NICID, protocol tcpip.NetworkProto
 		}
 
 		ref.decRef()
+		if ref.anycast {
+			return 0
+		}
 
 		return nic.id
 	}
 
-	// Go through all the NICs.
+	// Go through all the NICs of the VRF.
 	for _, nic := range s.nics {
+		if nic.vrfID() != vrf {
+			continue
+		}
 		ref := nic.findEndpoint(protocol, addr, CanBePrimaryEndpoint)
 		if ref != nil {
 			ref.decRef()
-			return nic.id
+			if !ref.anycast {
+				return nic.id
+			}
 		}
 	}
 
@@ -853,6 +1446,12 @@ func (s *Stack) CheckLocalAddress(nicid tcpip.NICID, protocol tcpip.NetworkProto
 }
 
 // SetPromiscuousMode enables or disables promiscuous mode in the given NIC.
+// In promiscuous mode, the NIC accepts packets destined to any address, as if
+// the address had been added to it for as long as they are being processed.
+//
+// Combined with SetSpoofing, it lets endpoints bound to arbitrary addresses
+// receive and reply to the traffic passing through the NIC, which is what
+// transparent proxies and NAT gateways need.
 func (s *Stack) SetPromiscuousMode(nicID tcpip.NICID, enable bool) *tcpip.Error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -868,7 +1467,8 @@ func (s *Stack) SetPromiscuousMode(nicID tcpip.NICID, enable bool) *tcpip.Error
 }
 
 // SetSpoofing enables or disables address spoofing in the given NIC, allowing
-// endpoints to bind to any address in the NIC.
+// endpoints to bind to any address in the NIC and to send packets with any
+// source address through it.
 func (s *Stack) SetSpoofing(nicID tcpip.NICID, enable bool) *tcpip.Error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -886,11 +1486,119 @@ func (s *Stack) SetSpoofing(nicID tcpip.NICID, enable bool) *tcpip.Error {
 // AddLinkAddress adds a link address to the stack link cache.
 func (s *Stack) AddLinkAddress(nicid tcpip.NICID, addr tcpip.Address, linkAddr tcpip.LinkAddress) {
 	fullAddr := tcpip.FullAddress{NIC: nicid, Addr: addr}
-	s.linkAddrCache.add(fullAddr, linkAddr)
+	resolved, changed := s.linkAddrCache.add(fullAddr, linkAddr)
+	if changed {
+		// Routes may hold the previous link address.
+		s.invalidateRoutes()
+	}
+	s.reviveNextHop(fullAddr)
+	if resolved {
+		s.publish(Event{Type: EventNeighborResolved, NIC: nicid, Address: addr, LinkAddress: linkAddr})
+	}
 	// TODO: provide a way for a transport endpoint to receive a signal
 	// that AddLinkAddress for a particular address has been called.
 }
 
+// AddStaticNeighbor adds a permanent entry mapping addr to linkAddr to the
+// neighbor cache of the given NIC, like "arp -s" or "ip neigh add ...
+// nud permanent". It replaces any existing entry for addr, and is not
+// replaced by address resolution.
+func (s *Stack) AddStaticNeighbor(nicid tcpip.NICID, addr tcpip.Address, linkAddr tcpip.LinkAddress) *tcpip.Error {
+	s.mu.RLock()
+	nic := s.nics[nicid]
+	s.mu.RUnlock()
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	if s.linkAddrCache.addStatic(tcpip.FullAddress{NIC: nicid, Addr: addr}, linkAddr) {
+		// Routes may hold the previous link address.
+		s.invalidateRoutes()
+	}
+	s.publish(Event{Type: EventNeighborResolved, NIC: nicid, Address: addr, LinkAddress: linkAddr})
+	return nil
+}
+
+// RemoveNeighbor removes the entry for addr from the neighbor cache of the
+// given NIC, whether permanent or not, so that it is resolved again when
+// needed.
+func (s *Stack) RemoveNeighbor(nicid tcpip.NICID, addr tcpip.Address) *tcpip.Error {
+	s.mu.RLock()
+	nic := s.nics[nicid]
+	s.mu.RUnlock()
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	if !s.linkAddrCache.remove(tcpip.FullAddress{NIC: nicid, Addr: addr}) {
+		return tcpip.ErrBadAddress
+	}
+	s.invalidateRoutes()
+	s.publish(Event{Type: EventNeighborLost, NIC: nicid, Address: addr})
+	return nil
+}
+
+// Neighbors returns the entries of the neighbor cache of the given NIC, in no
+// particular order. Expired entries are omitted.
+func (s *Stack) Neighbors(nicid tcpip.NICID) ([]NeighborEntry, *tcpip.Error) {
+	s.mu.RLock()
+	nic := s.nics[nicid]
+	s.mu.RUnlock()
+	if nic == nil {
+		return nil, tcpip.ErrUnknownNICID
+	}
+
+	return s.linkAddrCache.entriesOf(nicid), nil
+}
+
+// SubscribeResolutionFailure registers h to be called whenever the resolution
+// of a link address fails after all attempts timed out. h is called without
+// any stack locks held. The returned function removes the subscription.
+func (s *Stack) SubscribeResolutionFailure(h func(ResolutionFailureEvent)) (cancel func()) {
+	s.resolutionFailureMu.Lock()
+	defer s.resolutionFailureMu.Unlock()
+	if s.resolutionFailureHandlers == nil {
+		s.resolutionFailureHandlers = make(map[int]func(ResolutionFailureEvent))
+	}
+	id := s.nextResolutionFailureHandler
+	s.nextResolutionFailureHandler++
+	s.resolutionFailureHandlers[id] = h
+	return func() {
+		s.resolutionFailureMu.Lock()
+		delete(s.resolutionFailureHandlers, id)
+		s.resolutionFailureMu.Unlock()
+	}
+}
+
+// notifyResolutionFailure calls the resolution failure subscribers.
+func (s *Stack) notifyResolutionFailure(addr tcpip.FullAddress) {
+	s.resolutionFailureMu.Lock()
+	handlers := make([]func(ResolutionFailureEvent), 0, len(s.resolutionFailureHandlers))
+	for _, h := range s.resolutionFailureHandlers {
+		handlers = append(handlers, h)
+	}
+	s.resolutionFailureMu.Unlock()
+
+	e := ResolutionFailureEvent{NIC: addr.NIC, Addr: addr.Addr}
+	for _, h := range handlers {
+		h(e)
+	}
+}
+
+// notifyHostUnreachable delivers a ControlHostUnreachable control packet to the
+// transport endpoints that may be routed through the neighbor addr.
+func (s *Stack) notifyHostUnreachable(addr tcpip.FullAddress) {
+	s.mu.RLock()
+	nic := s.nics[addr.NIC]
+	s.mu.RUnlock()
+	if nic == nil {
+		return
+	}
+	info := ControlInfo{Offender: addr.Addr}
+	nic.demux.deliverControlPacketToAll(ControlHostUnreachable, uint32(addr.NIC), info)
+	nic.transportDemux().deliverControlPacketToAll(ControlHostUnreachable, uint32(addr.NIC), info)
+}
+
 // GetLinkAddress implements LinkAddressCache.GetLinkAddress.
 func (s *Stack) GetLinkAddress(nicid tcpip.NICID, addr, localAddr tcpip.Address, protocol tcpip.NetworkProtocolNumber, waker *sleep.Waker) (tcpip.LinkAddress, <-chan struct{}, *tcpip.Error) {
 	s.mu.RLock()
@@ -903,7 +1611,7 @@ func (s *Stack) GetLinkAddress(nicid tcpip.NICID, addr, localAddr tcpip.Address,
 
 	fullAddr := tcpip.FullAddress{NIC: nicid, Addr: addr}
 	linkRes := s.linkAddrResolvers[protocol]
-	return s.linkAddrCache.get(fullAddr, linkRes, localAddr, nic.linkEP, waker)
+	return s.linkAddrCache.get(fullAddr, linkRes, localAddr, nic.writeEP, waker)
 }
 
 // RemoveWaker implements LinkAddressCache.RemoveWaker.
@@ -1047,6 +1755,54 @@ func (s *Stack) RemoveTCPProbe() {
 	s.mu.Unlock()
 }
 
+// DropInfo describes a packet dropped by the stack.
+type DropInfo struct {
+	// Reason is the reason why the packet was dropped.
+	Reason tcpip.DropReason
+
+	// NIC is the NIC the packet was received from or sent through, or 0
+	// if it isn't known.
+	NIC tcpip.NICID
+
+	// NetProto is the network protocol of the packet.
+	NetProto tcpip.NetworkProtocolNumber
+
+	// Packet holds the part of the packet that was left to be processed
+	// by the layer that dropped it: the whole packet for drops in the
+	// link and network layers, the transport header and payload for drops
+	// in the transport layer. It is only valid for the duration of the
+	// call to the drop hook and must be cloned to be kept.
+	Packet buffer.VectorisedView
+}
+
+// DropHook is the function type of hooks passed to SetDropHook.
+type DropHook func(DropInfo)
+
+// SetDropHook installs a hook that will be invoked with every packet dropped
+// by the stack, replacing the previous one. A nil hook removes it.
+//
+// The hook is invoked synchronously from the receive and transmit paths, so
+// it must not block nor call back into the stack.
+func (s *Stack) SetDropHook(hook DropHook) {
+	s.mu.Lock()
+	s.dropHook = hook
+	s.mu.Unlock()
+}
+
+// RecordDrop records a dropped packet: it increments the counter of its reason
+// and invokes the drop hook, if one is installed.
+func (s *Stack) RecordDrop(info DropInfo) {
+	if c := s.stats.Drops.Counter(info.Reason); c != nil {
+		c.Increment()
+	}
+	s.mu.RLock()
+	hook := s.dropHook
+	s.mu.RUnlock()
+	if hook != nil {
+		hook(info)
+	}
+}
+
 // JoinGroup joins the given multicast group on the given NIC.
 func (s *Stack) JoinGroup(protocol tcpip.NetworkProtocolNumber, nicID tcpip.NICID, multicastAddr tcpip.Address) *tcpip.Error {
 	// TODO: notify network of subscription via igmp protocol.
@@ -21,13 +21,17 @@ import (
 	"bytes"
 	"fmt"
 	"math"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/faketime"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/link/loopback"
 	"github.com/google/netstack/tcpip/stack"
 )
 
@@ -76,13 +80,15 @@ func (f *fakeNetworkEndpoint) ID() *stack.NetworkEndpointID {
 	return &f.id
 }
 
-func (f *fakeNetworkEndpoint) HandlePacket(r *stack.Route, vv buffer.VectorisedView) {
+func (f *fakeNetworkEndpoint) HandlePacket(r *stack.Route, pkt *stack.PacketBuffer) {
 	// Increment the received packet count in the protocol descriptor.
 	f.proto.packetCount[int(f.id.LocalAddress[0])%len(f.proto.packetCount)]++
 
 	// Consume the network header.
-	b := vv.First()
-	vv.TrimFront(fakeNetHeaderLen)
+	b := pkt.Data.First()
+	pkt.Data.TrimFront(fakeNetHeaderLen)
+	pkt.NetworkHeader = b[:fakeNetHeaderLen]
+	vv := pkt.Data
 
 	// Handle control packets.
 	if b[2] == uint8(fakeControlProtocol) {
@@ -92,12 +98,12 @@ func (f *fakeNetworkEndpoint) HandlePacket(r *stack.Route, vv buffer.VectorisedV
 		}
 
 		vv.TrimFront(fakeNetHeaderLen)
-		f.dispatcher.DeliverTransportControlPacket(tcpip.Address(nb[1:2]), tcpip.Address(nb[0:1]), fakeNetNumber, tcpip.TransportProtocolNumber(nb[2]), stack.ControlPortUnreachable, 0, vv)
+		f.dispatcher.DeliverTransportControlPacket(tcpip.Address(nb[1:2]), tcpip.Address(nb[0:1]), fakeNetNumber, tcpip.TransportProtocolNumber(nb[2]), stack.ControlPortUnreachable, 0, stack.ControlInfo{}, vv)
 		return
 	}
 
 	// Dispatch the packet to the transport protocol.
-	f.dispatcher.DeliverTransportPacket(r, tcpip.TransportProtocolNumber(b[2]), buffer.View([]byte{}), vv)
+	f.dispatcher.DeliverTransportPacket(r, tcpip.TransportProtocolNumber(b[2]), pkt)
 }
 
 func (f *fakeNetworkEndpoint) MaxHeaderLength() uint16 {
@@ -112,29 +118,27 @@ func (f *fakeNetworkEndpoint) Capabilities() stack.LinkEndpointCapabilities {
 	return f.linkEP.Capabilities()
 }
 
-func (f *fakeNetworkEndpoint) WritePacket(r *stack.Route, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.TransportProtocolNumber, _ uint8, loop stack.PacketLooping) *tcpip.Error {
+func (f *fakeNetworkEndpoint) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, params stack.NetworkHeaderParams, loop stack.PacketLooping) *tcpip.Error {
 	// Increment the sent packet count in the protocol descriptor.
 	f.proto.sendPacketCount[int(r.RemoteAddress[0])%len(f.proto.sendPacketCount)]++
 
 	// Add the protocol's header to the packet and send it to the link
 	// endpoint.
-	b := hdr.Prepend(fakeNetHeaderLen)
+	b := pkt.Header.Prepend(fakeNetHeaderLen)
 	b[0] = r.RemoteAddress[0]
 	b[1] = f.id.LocalAddress[0]
-	b[2] = byte(protocol)
+	b[2] = byte(params.Protocol)
 
 	if loop&stack.PacketLoop != 0 {
-		views := make([]buffer.View, 1, 1+len(payload.Views()))
-		views[0] = hdr.View()
-		views = append(views, payload.Views()...)
-		vv := buffer.NewVectorisedView(len(views[0])+payload.Size(), views)
-		f.HandlePacket(r, vv)
+		looped := stack.NewPacketBuffer(pkt.ToVectorisedView())
+		f.HandlePacket(r, looped)
+		looped.DecRef()
 	}
 	if loop&stack.PacketOut == 0 {
 		return nil
 	}
 
-	return f.linkEP.WritePacket(r, hdr, payload, fakeNetNumber)
+	return f.linkEP.WritePacket(r, pkt, fakeNetNumber)
 }
 
 func (*fakeNetworkEndpoint) Close() {}
@@ -170,7 +174,7 @@ func (*fakeNetworkProtocol) ParseAddresses(v buffer.View) (src, dst tcpip.Addres
 	return tcpip.Address(v[1:2]), tcpip.Address(v[0:1])
 }
 
-func (f *fakeNetworkProtocol) NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, linkAddrCache stack.LinkAddressCache, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) (stack.NetworkEndpoint, *tcpip.Error) {
+func (f *fakeNetworkProtocol) NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, linkAddrCache stack.LinkAddressCache, clock tcpip.Clock, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) (stack.NetworkEndpoint, *tcpip.Error) {
 	return &fakeNetworkEndpoint{
 		nicid:      nicid,
 		id:         stack.NetworkEndpointID{addr},
@@ -273,6 +277,14 @@ func TestNetworkReceive(t *testing.T) {
 	}
 }
 
+// writePacket writes a fake transport packet made of hdr and payload through
+// r.
+func writePacket(r *stack.Route, hdr buffer.Prependable, payload buffer.VectorisedView) *tcpip.Error {
+	pkt := stack.NewOutboundPacketBuffer(hdr, payload)
+	defer pkt.DecRef()
+	return r.WritePacket(pkt, fakeTransNumber, 123)
+}
+
 func sendTo(t *testing.T, s *stack.Stack, addr tcpip.Address, payload buffer.View) {
 	r, err := s.FindRoute(0, "", addr, fakeNetNumber, false /* multicastLoop */)
 	if err != nil {
@@ -281,11 +293,47 @@ func sendTo(t *testing.T, s *stack.Stack, addr tcpip.Address, payload buffer.Vie
 	defer r.Release()
 
 	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
-	if err := r.WritePacket(hdr, payload.ToVectorisedView(), fakeTransNumber, 123); err != nil {
+	if err := writePacket(&r, hdr, payload.ToVectorisedView()); err != nil {
 		t.Errorf("WritePacket failed: %v", err)
 	}
 }
 
+func TestNetworkReceiveBatch(t *testing.T) {
+	id, linkEP := channel.New(10, defaultMTU, "")
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x02"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
+
+	var vvs []buffer.VectorisedView
+	for _, dst := range []byte{1, 1, 3, 2, 1} {
+		buf := buffer.NewView(30)
+		buf[0] = dst
+		vvs = append(vvs, buf.ToVectorisedView())
+	}
+	linkEP.InjectBatch(fakeNetNumber, vvs)
+
+	if fakeNet.packetCount[1] != 3 {
+		t.Errorf("packetCount[1] = %d, want %d", fakeNet.packetCount[1], 3)
+	}
+	if fakeNet.packetCount[2] != 1 {
+		t.Errorf("packetCount[2] = %d, want %d", fakeNet.packetCount[2], 1)
+	}
+	if got := s.NICInfo()[1].Stats.Rx.Packets.Value(); got != 5 {
+		t.Errorf("got Rx.Packets = %d, want %d", got, 5)
+	}
+}
+
 func TestNetworkSend(t *testing.T) {
 	// Create a stack with the fake network protocol, one nic, and one
 	// address: 1. The route table sends all packets through the only
@@ -296,7 +344,7 @@ func TestNetworkSend(t *testing.T) {
 		t.Fatalf("NewNIC failed: %v", err)
 	}
 
-	s.SetRouteTable([]tcpip.Route{{"\x00", "\x00", "\x00", 1}})
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
 
 	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
 		t.Fatalf("AddAddress failed: %v", err)
@@ -345,8 +393,8 @@ func TestNetworkSendMultiRoute(t *testing.T) {
 	// addresses through the first NIC, and all even destination address
 	// through the second one.
 	s.SetRouteTable([]tcpip.Route{
-		{"\x01", "\x01", "\x00", 1},
-		{"\x00", "\x01", "\x00", 2},
+		{Destination: "\x01", Mask: "\x01", Gateway: "\x00", NIC: 1},
+		{Destination: "\x00", Mask: "\x01", Gateway: "\x00", NIC: 2},
 	})
 
 	// Send a packet to an odd destination.
@@ -364,6 +412,71 @@ func TestNetworkSendMultiRoute(t *testing.T) {
 	}
 }
 
+func TestMultipathRoutes(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	for _, id := range []tcpip.NICID{1, 2} {
+		linkID, _ := channel.New(10, defaultMTU, "")
+		if err := s.CreateNIC(id, linkID); err != nil {
+			t.Fatalf("CreateNIC(%d) failed: %v", id, err)
+		}
+		if err := s.AddAddress(id, fakeNetNumber, tcpip.Address([]byte{byte(id)})); err != nil {
+			t.Fatalf("AddAddress(%d) failed: %v", id, err)
+		}
+	}
+
+	// NIC 1 gets three times as many flows as NIC 2.
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x01", NIC: 1, Weight: 3},
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x02", NIC: 2},
+	})
+
+	nics := func() map[tcpip.Address]tcpip.NICID {
+		t.Helper()
+		m := make(map[tcpip.Address]tcpip.NICID)
+		for i := 16; i < 256; i++ {
+			dst := tcpip.Address([]byte{byte(i)})
+			r, err := s.FindRoute(0, "", dst, fakeNetNumber, false /* multicastLoop */)
+			if err != nil {
+				t.Fatalf("FindRoute(%v) failed: %v", dst, err)
+			}
+			if want := tcpip.Address([]byte{byte(r.NICID())}); r.NextHop != want {
+				t.Errorf("got NextHop = %v through NIC %d, want %v", r.NextHop, r.NICID(), want)
+			}
+			m[dst] = r.NICID()
+			r.Release()
+		}
+		return m
+	}
+
+	first := nics()
+	counts := make(map[tcpip.NICID]int)
+	for _, id := range first {
+		counts[id]++
+	}
+	if total := len(first); counts[1] < total/2 || counts[1] > total*9/10 {
+		t.Errorf("got %d of %d destinations through NIC 1 with weights 3:1", counts[1], total)
+	}
+	if !reflect.DeepEqual(nics(), first) {
+		t.Error("destinations changed next hop")
+	}
+
+	// Next hops whose NIC is down are left out.
+	if err := s.SetNICUp(2, false); err != nil {
+		t.Fatalf("SetNICUp(2, false) failed: %v", err)
+	}
+	for dst, id := range nics() {
+		if id != 1 {
+			t.Fatalf("got route to %v through NIC %d with NIC 2 down, want NIC 1", dst, id)
+		}
+	}
+	if err := s.SetNICUp(2, true); err != nil {
+		t.Fatalf("SetNICUp(2, true) failed: %v", err)
+	}
+	if !reflect.DeepEqual(nics(), first) {
+		t.Error("destinations didn't get their next hop back once NIC 2 was up")
+	}
+}
+
 func testRoute(t *testing.T, s *stack.Stack, nic tcpip.NICID, srcAddr, dstAddr, expectedSrcAddr tcpip.Address) {
 	r, err := s.FindRoute(nic, srcAddr, dstAddr, fakeNetNumber, false /* multicastLoop */)
 	if err != nil {
@@ -424,8 +537,8 @@ func TestRoutes(t *testing.T) {
 	// addresses through the first NIC, and all even destination address
 	// through the second one.
 	s.SetRouteTable([]tcpip.Route{
-		{"\x01", "\x01", "\x00", 1},
-		{"\x00", "\x01", "\x00", 2},
+		{Destination: "\x01", Mask: "\x01", Gateway: "\x00", NIC: 1},
+		{Destination: "\x00", Mask: "\x01", Gateway: "\x00", NIC: 2},
 	})
 
 	// Test routes to odd address.
@@ -455,6 +568,130 @@ func TestRoutes(t *testing.T) {
 	testNoRoute(t, s, 1, "\x03", "\x06")
 }
 
+func TestVRFRoutes(t *testing.T) {
+	// Create a stack with the fake network protocol and two NICs with the
+	// same address, in different VRFs.
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+
+	for nic := tcpip.NICID(1); nic <= 2; nic++ {
+		id, _ := channel.New(10, defaultMTU, "")
+		if err := s.CreateNIC(nic, id); err != nil {
+			t.Fatalf("CreateNIC failed: %v", err)
+		}
+		if err := s.AddAddress(nic, fakeNetNumber, "\x01"); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+	}
+	if err := s.SetNICVRF(2, 1); err != nil {
+		t.Fatalf("SetNICVRF failed: %v", err)
+	}
+	if vrf, err := s.NICVRF(2); err != nil || vrf != 1 {
+		t.Fatalf("got NICVRF(2) = (%d, %v), want = (1, nil)", vrf, err)
+	}
+	if err := s.SetNICVRF(3, 1); err != tcpip.ErrUnknownNICID {
+		t.Fatalf("got SetNICVRF(3) = %v, want = %v", err, tcpip.ErrUnknownNICID)
+	}
+
+	// Both NICs are routes to all addresses, but each VRF only sees its
+	// own.
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1},
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 2},
+	})
+	for _, test := range []struct {
+		vrf     tcpip.VRFID
+		nic     tcpip.NICID
+		wantNIC tcpip.NICID
+		wantErr *tcpip.Error
+	}{
+		{vrf: tcpip.DefaultVRF, wantNIC: 1},
+		{vrf: 1, wantNIC: 2},
+		{vrf: 2, wantErr: tcpip.ErrNoRoute},
+		{vrf: tcpip.DefaultVRF, nic: 2, wantErr: tcpip.ErrNoRoute},
+		{vrf: 1, nic: 2, wantNIC: 2},
+	} {
+		r, err := s.FindRouteInVRF(test.vrf, test.nic, "", "\x05", fakeNetNumber, false /* multicastLoop */)
+		if err != test.wantErr {
+			t.Errorf("got FindRouteInVRF(%d, %d) = %v, want = %v", test.vrf, test.nic, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := r.NICID(); got != test.wantNIC {
+			t.Errorf("got FindRouteInVRF(%d, %d) through NIC %d, want NIC %d", test.vrf, test.nic, got, test.wantNIC)
+		}
+		r.Release()
+	}
+
+	// FindRoute uses the VRF of the NIC it's given.
+	testRoute(t, s, 2, "", "\x05", "\x01")
+	if got := s.CheckLocalAddressInVRF(1, 0, fakeNetNumber, "\x01"); got != 2 {
+		t.Errorf("got CheckLocalAddressInVRF(1) = %d, want = 2", got)
+	}
+	if got := s.CheckLocalAddressInVRF(2, 0, fakeNetNumber, "\x01"); got != 0 {
+		t.Errorf("got CheckLocalAddressInVRF(2) = %d, want = 0", got)
+	}
+}
+
+func TestHostModel(t *testing.T) {
+	// Create a stack with the fake network protocol and two NICs, with
+	// addresses 1 and 2 respectively. Only the first one has a route.
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+
+	var linkEPs [3]*channel.Endpoint
+	for nic := tcpip.NICID(1); nic <= 2; nic++ {
+		id, linkEP := channel.New(10, defaultMTU, "")
+		if err := s.CreateNIC(nic, id); err != nil {
+			t.Fatalf("CreateNIC failed: %v", err)
+		}
+		if err := s.AddAddress(nic, fakeNetNumber, tcpip.Address([]byte{byte(nic)})); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+		linkEPs[nic] = linkEP
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
+	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
+
+	// In the strict host model, packets to the address of the second NIC
+	// are only accepted through it, and it can't be used as the source of
+	// packets sent through the first NIC.
+	buf := buffer.NewView(30)
+	buf[0] = 2
+	linkEPs[1].Inject(fakeNetNumber, buf.ToVectorisedView())
+	if fakeNet.packetCount[2] != 0 {
+		t.Errorf("packetCount[2] = %d, want %d", fakeNet.packetCount[2], 0)
+	}
+	testNoRoute(t, s, 0, "\x02", "\x05")
+
+	// In the weak host model, they are.
+	if err := s.SetNICHostModel(1, stack.HostModelWeak, stack.HostModelInherit); err != nil {
+		t.Fatalf("SetNICHostModel failed: %v", err)
+	}
+	linkEPs[1].Inject(fakeNetNumber, buf.ToVectorisedView())
+	if fakeNet.packetCount[2] != 1 {
+		t.Errorf("packetCount[2] = %d, want %d", fakeNet.packetCount[2], 1)
+	}
+	testNoRoute(t, s, 0, "\x02", "\x05")
+
+	s.SetHostModel(stack.HostModelStrict, stack.HostModelWeak)
+	testRoute(t, s, 0, "\x02", "\x05", "\x02")
+	testRoute(t, s, 1, "\x02", "\x05", "\x02")
+	testNoRoute(t, s, 0, "\x03", "\x05")
+
+	// The NIC's own setting takes precedence over the stack's.
+	if err := s.SetNICHostModel(1, stack.HostModelStrict, stack.HostModelStrict); err != nil {
+		t.Fatalf("SetNICHostModel failed: %v", err)
+	}
+	if rcv, snd, err := s.NICHostModel(1); err != nil || rcv != stack.HostModelStrict || snd != stack.HostModelStrict {
+		t.Fatalf("got NICHostModel(1) = (%d, %d, %v), want = (%d, %d, nil)", rcv, snd, err, stack.HostModelStrict, stack.HostModelStrict)
+	}
+	testNoRoute(t, s, 0, "\x02", "\x05")
+	if err := s.SetNICHostModel(3, stack.HostModelWeak, stack.HostModelWeak); err != tcpip.ErrUnknownNICID {
+		t.Errorf("got SetNICHostModel(3) = %v, want = %v", err, tcpip.ErrUnknownNICID)
+	}
+}
+
 func TestAddressRemoval(t *testing.T) {
 	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
 
@@ -509,7 +746,7 @@ func TestDelayedRemovalDueToRoute(t *testing.T) {
 	}
 
 	s.SetRouteTable([]tcpip.Route{
-		{"\x00", "\x00", "\x00", 1},
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1},
 	})
 
 	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
@@ -559,6 +796,62 @@ func TestDelayedRemovalDueToRoute(t *testing.T) {
 	}
 }
 
+func TestReAddAddressHeldByRoute(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1},
+	})
+
+	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
+
+	r, err := s.FindRoute(0, "", "\x02", fakeNetNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+
+	// Remove the address while the route keeps its endpoint alive, then
+	// add it back: the endpoint is revived rather than replaced.
+	if err := s.RemoveAddress(1, "\x01"); err != nil {
+		t.Fatalf("RemoveAddress failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress of the removed address failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != tcpip.ErrDuplicateAddress {
+		t.Fatalf("got AddAddress of the added address = %v, want %s", err, tcpip.ErrDuplicateAddress)
+	}
+
+	// The route still sends through the endpoint.
+	if err := writePacket(&r, buffer.NewPrependable(int(r.MaxHeaderLength())), buffer.VectorisedView{}); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	if fakeNet.sendPacketCount[2] != 1 {
+		t.Errorf("sendPacketCount[2] = %d, want %d", fakeNet.sendPacketCount[2], 1)
+	}
+
+	// Releasing the route doesn't remove the address that was added back.
+	r.Release()
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	linkEP.Inject(fakeNetNumber, buf.ToVectorisedView())
+	if fakeNet.packetCount[1] != 1 {
+		t.Errorf("packetCount[1] = %d, want %d", fakeNet.packetCount[1], 1)
+	}
+	if addr, _, err := s.GetMainNICAddress(1, fakeNetNumber); err != nil || addr != "\x01" {
+		t.Errorf("got GetMainNICAddress = %v, %v, want \\x01", addr, err)
+	}
+}
+
 func TestPromiscuousMode(t *testing.T) {
 	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
 
@@ -568,7 +861,7 @@ func TestPromiscuousMode(t *testing.T) {
 	}
 
 	s.SetRouteTable([]tcpip.Route{
-		{"\x00", "\x00", "\x00", 1},
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1},
 	})
 
 	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
@@ -628,7 +921,7 @@ func TestAddressSpoofing(t *testing.T) {
 	}
 
 	s.SetRouteTable([]tcpip.Route{
-		{"\x00", "\x00", "\x00", 1},
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1},
 	})
 
 	// With address spoofing disabled, FindRoute does not permit an address
@@ -791,7 +1084,7 @@ func TestSubnetAcceptsMatchingPacket(t *testing.T) {
 	}
 
 	s.SetRouteTable([]tcpip.Route{
-		{"\x00", "\x00", "\x00", 1},
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1},
 	})
 
 	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
@@ -824,7 +1117,7 @@ func TestSubnetRejectsNonmatchingPacket(t *testing.T) {
 	}
 
 	s.SetRouteTable([]tcpip.Route{
-		{"\x00", "\x00", "\x00", 1},
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1},
 	})
 
 	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
@@ -1065,7 +1358,7 @@ func TestNICStats(t *testing.T) {
 	}
 	// Route all packets for address \x01 to NIC 1.
 	s.SetRouteTable([]tcpip.Route{
-		{"\x01", "\xff", "\x00", 1},
+		{Destination: "\x01", Mask: "\xff", Gateway: "\x00", NIC: 1},
 	})
 
 	// Send a packet to address 1.
@@ -1116,7 +1409,7 @@ func TestNICForwarding(t *testing.T) {
 
 	// Route all packets to address 3 to NIC 2.
 	s.SetRouteTable([]tcpip.Route{
-		{"\x03", "\xff", "\x00", 2},
+		{Destination: "\x03", Mask: "\xff", Gateway: "\x00", NIC: 2},
 	})
 
 	// Send a packet to address 3.
@@ -1138,6 +1431,206 @@ func TestNICForwarding(t *testing.T) {
 	if got, want := s.NICInfo()[2].Stats.Tx.Bytes.Value(), uint64(len(buf)); got != want {
 		t.Errorf("got Tx.Bytes.Value() = %d, want = %d", got, want)
 	}
+
+	if got, want := s.Stats().IP.PacketsForwarded.Value(), uint64(1); got != want {
+		t.Errorf("got IP.PacketsForwarded.Value() = %d, want = %d", got, want)
+	}
+}
+
+func TestNICRxErrors(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	// A packet of an unknown network protocol, then one that is too short
+	// for the fake network protocol.
+	linkEP.Inject(fakeNetNumber-1, buffer.NewView(30).ToVectorisedView())
+	linkEP.Inject(fakeNetNumber, buffer.NewView(fakeNetHeaderLen-1).ToVectorisedView())
+
+	stats := s.NICInfo()[1].Stats
+	if got, want := stats.Rx.Packets.Value(), uint64(2); got != want {
+		t.Errorf("got Rx.Packets.Value() = %d, want = %d", got, want)
+	}
+	if got, want := stats.Rx.Errors.Value(), uint64(2); got != want {
+		t.Errorf("got Rx.Errors.Value() = %d, want = %d", got, want)
+	}
+	if got, want := s.Stats().UnknownProtocolRcvdPackets.Value(), uint64(1); got != want {
+		t.Errorf("got UnknownProtocolRcvdPackets.Value() = %d, want = %d", got, want)
+	}
+	if got, want := s.Stats().MalformedRcvdPackets.Value(), uint64(1); got != want {
+		t.Errorf("got MalformedRcvdPackets.Value() = %d, want = %d", got, want)
+	}
+}
+
+func TestNICTxErrors(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	id, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
+
+	r, err := s.FindRoute(0, "", "\x02", fakeNetNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	defer r.Release()
+
+	if err := s.SetNICUp(1, false); err != nil {
+		t.Fatalf("SetNICUp failed: %v", err)
+	}
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+	if err := writePacket(&r, hdr, buffer.NewView(10).ToVectorisedView()); err != tcpip.ErrNetworkDown {
+		t.Fatalf("got WritePacket = %v, want = %v", err, tcpip.ErrNetworkDown)
+	}
+
+	stats := s.NICInfo()[1].Stats
+	if got, want := stats.Tx.Errors.Value(), uint64(1); got != want {
+		t.Errorf("got Tx.Errors.Value() = %d, want = %d", got, want)
+	}
+	if got := stats.Tx.Packets.Value(); got != 0 {
+		t.Errorf("got Tx.Packets.Value() = %d, want = 0", got)
+	}
+	if got, want := s.Stats().Drops.NetworkDown.Value(), uint64(1); got != want {
+		t.Errorf("got Drops.NetworkDown.Value() = %d, want = %d", got, want)
+	}
+}
+
+func TestDropHook(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	var drops []stack.DropInfo
+	s.SetDropHook(func(info stack.DropInfo) {
+		drops = append(drops, info)
+	})
+
+	// A packet of an unknown network protocol, one that is too short for
+	// the fake network protocol and one for an address that isn't ours.
+	linkEP.Inject(fakeNetNumber-1, buffer.NewView(30).ToVectorisedView())
+	linkEP.Inject(fakeNetNumber, buffer.NewView(fakeNetHeaderLen-1).ToVectorisedView())
+	buf := buffer.NewView(30)
+	buf[0] = 2
+	linkEP.Inject(fakeNetNumber, buf.ToVectorisedView())
+
+	want := []struct {
+		reason   tcpip.DropReason
+		netProto tcpip.NetworkProtocolNumber
+		size     int
+	}{
+		{tcpip.DropUnknownProtocol, fakeNetNumber - 1, 30},
+		{tcpip.DropMalformed, fakeNetNumber, fakeNetHeaderLen - 1},
+		{tcpip.DropInvalidAddress, fakeNetNumber, 30},
+	}
+	if len(drops) != len(want) {
+		t.Fatalf("got %d drops, want = %d", len(drops), len(want))
+	}
+	for i, w := range want {
+		d := drops[i]
+		if d.Reason != w.reason || d.NIC != 1 || d.NetProto != w.netProto || d.Packet.Size() != w.size {
+			t.Errorf("got drops[%d] = {%v, %d, %d, size %d}, want = {%v, 1, %d, size %d}", i, d.Reason, d.NIC, d.NetProto, d.Packet.Size(), w.reason, w.netProto, w.size)
+		}
+	}
+
+	// Drops are still counted once the hook is removed.
+	s.SetDropHook(nil)
+	linkEP.Inject(fakeNetNumber-1, buffer.NewView(30).ToVectorisedView())
+	if len(drops) != len(want) {
+		t.Errorf("got %d drops after removing the hook, want = %d", len(drops), len(want))
+	}
+
+	stats := s.Stats().Drops
+	for _, c := range []struct {
+		name    string
+		counter *tcpip.StatCounter
+		want    uint64
+	}{
+		{"UnknownProtocol", stats.UnknownProtocol, 2},
+		{"Malformed", stats.Malformed, 1},
+		{"InvalidAddress", stats.InvalidAddress, 1},
+		{"NoRoute", stats.NoRoute, 0},
+	} {
+		if got := c.counter.Value(); got != c.want {
+			t.Errorf("got Drops.%s.Value() = %d, want = %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	clock := faketime.NewManualClock()
+	clock.Advance(1234)
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{Clock: clock})
+	id1, linkEP1 := channel.New(10, defaultMTU, "")
+	if err := s.CreateNamedNIC(1, "eth0", id1); err != nil {
+		t.Fatalf("CreateNamedNIC #1 failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress #1 failed: %v", err)
+	}
+	id2, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(2, id2); err != nil {
+		t.Fatalf("CreateNIC #2 failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
+
+	var all, inbound2 []stack.CapturedPacket
+	removeAll := s.AddCapture(0, stack.CaptureBoth, func(p stack.CapturedPacket) {
+		all = append(all, p)
+	})
+	defer s.AddCapture(2, stack.CaptureInbound, func(p stack.CapturedPacket) {
+		inbound2 = append(inbound2, p)
+	})()
+
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	linkEP1.Inject(fakeNetNumber, buf.ToVectorisedView())
+	sendTo(t, s, "\x02", buffer.NewView(10))
+
+	want := []struct {
+		inbound bool
+		size    int
+	}{
+		{true, 30},
+		{false, fakeNetHeaderLen + 10},
+	}
+	if len(all) != len(want) {
+		t.Fatalf("got %d captured packets, want = %d", len(all), len(want))
+	}
+	for i, w := range want {
+		p := all[i]
+		if p.Inbound != w.inbound || p.Data.Size() != w.size || p.NIC != 1 || p.NICName != "eth0" || p.Protocol != fakeNetNumber || p.Timestamp != 1234 {
+			t.Errorf("got packet %d = {Inbound: %t, size: %d, NIC: %d, NICName: %q, Protocol: %d, Timestamp: %d}, want = {Inbound: %t, size: %d, NIC: 1, NICName: \"eth0\", Protocol: %d, Timestamp: 1234}", i, p.Inbound, p.Data.Size(), p.NIC, p.NICName, p.Protocol, p.Timestamp, w.inbound, w.size, fakeNetNumber)
+		}
+	}
+	if len(inbound2) != 0 {
+		t.Errorf("got %d packets captured on NIC 2, want = 0", len(inbound2))
+	}
+
+	removeAll()
+	linkEP1.Inject(fakeNetNumber, buf.ToVectorisedView())
+	if len(all) != len(want) {
+		t.Errorf("got %d captured packets after removing the sink, want = %d", len(all), len(want))
+	}
+}
+
+func TestDropReasonString(t *testing.T) {
+	if got, want := tcpip.DropTTLExpired.String(), "TTL expired"; got != want {
+		t.Errorf("got DropTTLExpired.String() = %q, want = %q", got, want)
+	}
+	if got, want := tcpip.DropReason(-1).String(), "DropReason(-1)"; got != want {
+		t.Errorf("got DropReason(-1).String() = %q, want = %q", got, want)
+	}
 }
 
 func init() {
@@ -1145,3 +1638,686 @@ func init() {
 		return &fakeNetworkProtocol{}
 	})
 }
+
+func TestNICLinkState(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
+
+	var events []stack.LinkStateEvent
+	cancel := s.SubscribeLinkState(func(e stack.LinkStateEvent) {
+		events = append(events, e)
+	})
+	defer cancel()
+
+	r, err := s.FindRoute(0, "", "\x02", fakeNetNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	defer r.Release()
+
+	checkDown := func(down bool) {
+		t.Helper()
+		wantErr := (*tcpip.Error)(nil)
+		if down {
+			wantErr = tcpip.ErrNetworkDown
+		}
+		if _, err := s.FindRoute(0, "", "\x02", fakeNetNumber, false /* multicastLoop */); err != wantErr {
+			t.Errorf("got FindRoute(...) = %v, want = %v", err, wantErr)
+		}
+		hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+		if err := writePacket(&r, hdr, buffer.VectorisedView{}); err != wantErr {
+			t.Errorf("got WritePacket(...) = %v, want = %v", err, wantErr)
+		}
+		linkEP.Drain()
+	}
+
+	// Administratively bring the NIC down and back up.
+	if err := s.SetNICUp(1, false); err != nil {
+		t.Fatalf("SetNICUp(1, false) failed: %v", err)
+	}
+	if flags := s.NICInfo()[1].Flags; flags.Up {
+		t.Errorf("got Flags.Up = true after SetNICUp(1, false)")
+	}
+	checkDown(true)
+	if err := s.SetNICUp(1, true); err != nil {
+		t.Fatalf("SetNICUp(1, true) failed: %v", err)
+	}
+	checkDown(false)
+
+	// Lose and regain carrier.
+	linkEP.SetLinkState(false)
+	if flags := s.NICInfo()[1].Flags; !flags.Up || flags.Running {
+		t.Errorf("got Flags = %+v after carrier loss, want Up and not Running", flags)
+	}
+	checkDown(true)
+
+	// Inbound packets are dropped while the link is down.
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	linkEP.Inject(fakeNetNumber, buf.ToVectorisedView())
+	if got := s.NICInfo()[1].Stats.Rx.Packets.Value(); got != 0 {
+		t.Errorf("got Rx.Packets.Value() = %d, want = 0", got)
+	}
+
+	// Setting the NIC administratively up doesn't help without carrier.
+	if err := s.SetNICUp(1, true); err != nil {
+		t.Fatalf("SetNICUp(1, true) failed: %v", err)
+	}
+	checkDown(true)
+
+	linkEP.SetLinkState(true)
+	checkDown(false)
+
+	want := []stack.LinkStateEvent{
+		{NIC: 1, Up: false},
+		{NIC: 1, Up: true},
+		{NIC: 1, Up: false},
+		{NIC: 1, Up: true},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events = %+v, want = %+v", events, want)
+	}
+
+	if err := s.SetNICUp(2, false); err != tcpip.ErrUnknownNICID {
+		t.Errorf("got SetNICUp(2, false) = %v, want = %v", err, tcpip.ErrUnknownNICID)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	var events []stack.Event
+	cancel := s.Subscribe(func(e stack.Event) {
+		events = append(events, e)
+	})
+
+	id, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	routes := []tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}}
+	s.SetRouteTable(routes)
+	// Repeated resolutions aren't published.
+	s.AddLinkAddress(1, "\x02", "\x0a")
+	s.AddLinkAddress(1, "\x02", "\x0a")
+	if err := s.RemoveNeighbor(1, "\x02"); err != nil {
+		t.Fatalf("RemoveNeighbor failed: %v", err)
+	}
+	if err := s.SetNICUp(1, false); err != nil {
+		t.Fatalf("SetNICUp(1, false) failed: %v", err)
+	}
+	if err := s.SetNICUp(1, true); err != nil {
+		t.Fatalf("SetNICUp(1, true) failed: %v", err)
+	}
+	if err := s.RemoveAddress(1, "\x01"); err != nil {
+		t.Fatalf("RemoveAddress failed: %v", err)
+	}
+	if err := s.RemoveNIC(1); err != nil {
+		t.Fatalf("RemoveNIC failed: %v", err)
+	}
+
+	want := []stack.Event{
+		{Type: stack.EventNICAdded, NIC: 1},
+		{Type: stack.EventAddressAdded, NIC: 1, Protocol: fakeNetNumber, Address: "\x01"},
+		{Type: stack.EventRoutesChanged, Routes: routes},
+		{Type: stack.EventNeighborResolved, NIC: 1, Address: "\x02", LinkAddress: "\x0a"},
+		{Type: stack.EventNeighborLost, NIC: 1, Address: "\x02"},
+		{Type: stack.EventNICDown, NIC: 1},
+		{Type: stack.EventNICUp, NIC: 1},
+		{Type: stack.EventAddressRemoved, NIC: 1, Protocol: fakeNetNumber, Address: "\x01"},
+		{Type: stack.EventNICRemoved, NIC: 1},
+		{Type: stack.EventRoutesChanged},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events = %+v, want = %+v", events, want)
+	}
+
+	cancel()
+	events = nil
+	if err := s.CreateNIC(2, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("got events = %+v after cancelling the subscription, want none", events)
+	}
+}
+
+func TestRemoveNIC(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	id1, linkEP1 := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id1); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	id2, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(2, id2); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	if err := s.AddAddress(2, fakeNetNumber, "\x02"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: "\x00", Mask: "\x01", Gateway: "\x00", NIC: 1},
+		{Destination: "\x01", Mask: "\x01", Gateway: "\x00", NIC: 2},
+	})
+
+	var events []stack.LinkStateEvent
+	cancel := s.SubscribeLinkState(func(e stack.LinkStateEvent) {
+		events = append(events, e)
+	})
+	defer cancel()
+
+	r, err := s.FindRoute(0, "", "\x04", fakeNetNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	defer r.Release()
+
+	if err := s.RemoveNIC(1); err != nil {
+		t.Fatalf("RemoveNIC(1) failed: %v", err)
+	}
+
+	if _, ok := s.NICInfo()[1]; ok {
+		t.Errorf("NIC 1 still listed by NICInfo after removal")
+	}
+	if got := s.CheckLocalAddress(0, fakeNetNumber, "\x01"); got != 0 {
+		t.Errorf("got CheckLocalAddress(0, _, 1) = %d, want = 0", got)
+	}
+	want := []tcpip.Route{{Destination: "\x01", Mask: "\x01", Gateway: "\x00", NIC: 2}}
+	if got := s.GetRouteTable(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got GetRouteTable() = %v, want = %v", got, want)
+	}
+	if _, err := s.FindRoute(0, "", "\x04", fakeNetNumber, false /* multicastLoop */); err != tcpip.ErrNoRoute {
+		t.Errorf("got FindRoute(...) = %v, want = %v", err, tcpip.ErrNoRoute)
+	}
+
+	// The route obtained before the removal can't be used anymore.
+	if !r.Removed() {
+		t.Errorf("got r.Removed() = false, want = true")
+	}
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+	if err := writePacket(&r, hdr, buffer.VectorisedView{}); err != tcpip.ErrNetworkUnreachable {
+		t.Errorf("got WritePacket(...) = %v, want = %v", err, tcpip.ErrNetworkUnreachable)
+	}
+	if c := linkEP1.Drain(); c != 0 {
+		t.Errorf("got %d packets written to the removed NIC, want = 0", c)
+	}
+
+	// Packets delivered by the link endpoint of the removed NIC are dropped.
+	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	linkEP1.Inject(fakeNetNumber, buf.ToVectorisedView())
+	if got := fakeNet.packetCount[1]; got != 0 {
+		t.Errorf("got %d packets delivered through the removed NIC, want = 0", got)
+	}
+
+	// The other NIC is unaffected.
+	if _, err := s.FindRoute(0, "", "\x03", fakeNetNumber, false /* multicastLoop */); err != nil {
+		t.Errorf("FindRoute through NIC 2 failed: %v", err)
+	}
+
+	if want := []stack.LinkStateEvent{{NIC: 1, Removed: true}}; !reflect.DeepEqual(events, want) {
+		t.Errorf("got events = %+v, want = %+v", events, want)
+	}
+
+	if err := s.RemoveNIC(1); err != tcpip.ErrUnknownNICID {
+		t.Errorf("got RemoveNIC(1) = %v, want = %v", err, tcpip.ErrUnknownNICID)
+	}
+
+	// The ID can be reused.
+	id3, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id3); err != nil {
+		t.Fatalf("CreateNIC after removal failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress after removal failed: %v", err)
+	}
+}
+
+func TestRouteStale(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	id1, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id1); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	table := []tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}}
+	s.SetRouteTable(table)
+
+	changes := []struct {
+		name   string
+		change func()
+	}{
+		{"SetRouteTable", func() { s.SetRouteTable(table) }},
+		{"AddAddress", func() { s.AddAddress(1, fakeNetNumber, "\x03") }},
+		{"RemoveAddress", func() { s.RemoveAddress(1, "\x03") }},
+		{"SetNICUp", func() { s.SetNICUp(1, false); s.SetNICUp(1, true) }},
+		{"AddLinkAddress", func() {
+			s.AddLinkAddress(1, "\x04", "\x0a")
+			s.AddLinkAddress(1, "\x04", "\x0b")
+		}},
+	}
+	for _, c := range changes {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := s.FindRoute(0, "", "\x04", fakeNetNumber, false /* multicastLoop */)
+			if err != nil {
+				t.Fatalf("FindRoute failed: %v", err)
+			}
+			defer r.Release()
+			if r.Stale() {
+				t.Fatalf("got r.Stale() = true for a new route, want = false")
+			}
+			c.change()
+			if !r.Stale() {
+				t.Errorf("got r.Stale() = false, want = true")
+			}
+		})
+	}
+
+	// Adding the same link address again changes nothing.
+	r, err := s.FindRoute(0, "", "\x04", fakeNetNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	defer r.Release()
+	s.AddLinkAddress(1, "\x04", "\x0b")
+	if r.Stale() {
+		t.Errorf("got r.Stale() = true after adding the same link address, want = false")
+	}
+}
+
+func TestDestinationMetrics(t *testing.T) {
+	clock := faketime.NewManualClock()
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{Clock: clock})
+	const addr = "\x04"
+
+	if _, ok := s.DestinationMetrics(addr); ok {
+		t.Fatalf("got DestinationMetrics(...) for an unknown destination")
+	}
+
+	// The path MTU only decreases.
+	s.UpdatePathMTU(addr, 1400)
+	s.UpdatePathMTU(addr, 1500)
+	s.UpdatePathMTU(addr, 1280)
+
+	// A larger RTT replaces the cached one, a smaller one is blended in.
+	s.UpdateDestinationRTT(addr, 80*time.Millisecond, 40*time.Millisecond)
+	s.UpdateDestinationRTT(addr, 100*time.Millisecond, 20*time.Millisecond)
+	s.UpdateDestinationRTT(addr, 20*time.Millisecond, 20*time.Millisecond)
+	s.SetDestinationReachable(addr, true)
+
+	want := stack.DestinationMetrics{
+		PathMTU:      1280,
+		SRTT:         90 * time.Millisecond,
+		RTTVar:       31250 * time.Microsecond,
+		HasReachable: true,
+		Reachable:    true,
+	}
+	if got, ok := s.DestinationMetrics(addr); !ok || got != want {
+		t.Errorf("got DestinationMetrics(...) = %+v, %t, want = %+v, true", got, ok, want)
+	}
+
+	// Metrics expire 10 minutes after the last update.
+	clock.Advance(9 * time.Minute)
+	if _, ok := s.DestinationMetrics(addr); !ok {
+		t.Errorf("metrics expired after 9 minutes")
+	}
+	clock.Advance(time.Minute)
+	if got, ok := s.DestinationMetrics(addr); ok {
+		t.Errorf("got DestinationMetrics(...) = %+v after 10 minutes, want none", got)
+	}
+
+	s.UpdatePathMTU(addr, 1500)
+	if got, ok := s.DestinationMetrics(addr); !ok || got.PathMTU != 1500 {
+		t.Errorf("got DestinationMetrics(...) = %+v, %t, want PathMTU = 1500", got, ok)
+	}
+	s.FlushDestinationCache()
+	if got, ok := s.DestinationMetrics(addr); ok {
+		t.Errorf("got DestinationMetrics(...) = %+v after a flush, want none", got)
+	}
+}
+
+func TestICMPRateLimit(t *testing.T) {
+	clock := faketime.NewManualClock()
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{Clock: clock})
+	if got := s.ICMPRateLimit(); got != stack.DefaultICMPRateLimit {
+		t.Errorf("got ICMPRateLimit() = %+v, want = %+v", got, stack.DefaultICMPRateLimit)
+	}
+
+	s.SetICMPRateLimit(stack.ICMPRateLimit{
+		Rate:                10,
+		Burst:               4,
+		PerDestinationRate:  1,
+		PerDestinationBurst: 2,
+	})
+
+	allowed := func(dst tcpip.Address, n int) int {
+		t.Helper()
+		var c int
+		for i := 0; i < n; i++ {
+			if s.AllowICMPMessage(dst) {
+				c++
+			}
+		}
+		return c
+	}
+
+	// Each destination gets its burst, until the stack's burst is spent.
+	if got := allowed("\x01", 5); got != 2 {
+		t.Errorf("got %d messages allowed to 1, want = 2", got)
+	}
+	if got := allowed("\x02", 5); got != 2 {
+		t.Errorf("got %d messages allowed to 2, want = 2", got)
+	}
+	if got := allowed("\x03", 5); got != 0 {
+		t.Errorf("got %d messages allowed to 3, want = 0", got)
+	}
+	if got, want := s.Stats().ICMP.RateLimited.Value(), uint64(11); got != want {
+		t.Errorf("got RateLimited = %d, want = %d", got, want)
+	}
+
+	// The stack's bucket refills faster than those of destinations.
+	clock.Advance(200 * time.Millisecond)
+	if got := allowed("\x01", 5); got != 0 {
+		t.Errorf("got %d messages allowed to 1 after 200ms, want = 0", got)
+	}
+	if got := allowed("\x03", 5); got != 2 {
+		t.Errorf("got %d messages allowed to 3 after 200ms, want = 2", got)
+	}
+	clock.Advance(time.Second)
+	if got := allowed("\x01", 5); got != 1 {
+		t.Errorf("got %d messages allowed to 1 after 1.2s, want = 1", got)
+	}
+
+	// A zero limit allows all messages.
+	s.SetICMPRateLimit(stack.ICMPRateLimit{})
+	if got := allowed("\x01", 100); got != 100 {
+		t.Errorf("got %d messages allowed without limit, want = 100", got)
+	}
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	id1, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNamedNIC(1, "eth0", id1); err != nil {
+		t.Fatalf("CreateNamedNIC failed: %v", err)
+	}
+	id2, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateDisabledNIC(2, id2); err != nil {
+		t.Fatalf("CreateDisabledNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	if err := s.AddAddressWithOptions(1, fakeNetNumber, "\x02", stack.FirstPrimaryEndpoint); err != nil {
+		t.Fatalf("AddAddressWithOptions failed: %v", err)
+	}
+	if err := s.AddAddressWithOptions(1, fakeNetNumber, "\x03", stack.NeverPrimaryEndpoint); err != nil {
+		t.Fatalf("AddAddressWithOptions failed: %v", err)
+	}
+	subnet, err := tcpip.NewSubnet("\x10", "\xf0")
+	if err != nil {
+		t.Fatalf("NewSubnet failed: %v", err)
+	}
+	if err := s.AddSubnet(2, fakeNetNumber, subnet); err != nil {
+		t.Fatalf("AddSubnet failed: %v", err)
+	}
+	if err := s.SetNICUp(2, false); err != nil {
+		t.Fatalf("SetNICUp failed: %v", err)
+	}
+	if err := s.SetPromiscuousMode(1, true); err != nil {
+		t.Fatalf("SetPromiscuousMode failed: %v", err)
+	}
+	routes := []tcpip.Route{
+		{Destination: "\x10", Mask: "\xf0", NIC: 2},
+		{Destination: "\x00", Mask: "\x00", Gateway: "\x04", NIC: 1},
+	}
+	s.SetRouteTable(routes)
+	s.SetForwarding(true)
+	if err := s.SetNICVRF(2, 7); err != nil {
+		t.Fatalf("SetNICVRF failed: %v", err)
+	}
+	if err := s.SetNICHostModel(1, stack.HostModelWeak, stack.HostModelStrict); err != nil {
+		t.Fatalf("SetNICHostModel failed: %v", err)
+	}
+	s.SetHostModel(stack.HostModelStrict, stack.HostModelWeak)
+	mroute := stack.MulticastRoute{InputNIC: 1, Outputs: []stack.MulticastOutput{{NIC: 2, TTLThreshold: 1}}}
+	if err := s.AddMulticastRoute("", "\xe0\x00\x00\x01", mroute); err != nil {
+		t.Fatalf("AddMulticastRoute failed: %v", err)
+	}
+	if err := s.AddStaticNeighbor(1, "\x05", "\x02\x00\x00\x00\x00\x05"); err != nil {
+		t.Fatalf("AddStaticNeighbor failed: %v", err)
+	}
+	natRules := []stack.NATRule{{NIC: 1, Protocol: header.UDPProtocolNumber, Destination: subnet, DestinationPort: 53, ToAddress: "\x01", ToPort: 5353}}
+	if err := s.SetNATRules(natRules); err != nil {
+		t.Fatalf("SetNATRules failed: %v", err)
+	}
+
+	c, err := s.Checkpoint()
+	if err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	var b bytes.Buffer
+	if err := c.Encode(&b); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	c, err = stack.DecodeCheckpoint(&b)
+	if err != nil {
+		t.Fatalf("DecodeCheckpoint failed: %v", err)
+	}
+
+	r := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	rid1, _ := channel.New(10, defaultMTU, "")
+	rid2, _ := channel.New(10, defaultMTU, "")
+	if _, err := r.Restore(c, map[tcpip.NICID]tcpip.LinkEndpointID{1: rid1, 2: rid2}, nil); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	if got := r.GetRouteTable(); !reflect.DeepEqual(got, routes) {
+		t.Errorf("got GetRouteTable() = %v, want %v", got, routes)
+	}
+	if !r.Forwarding() {
+		t.Errorf("got Forwarding() = false, want true")
+	}
+	if addr, _, err := r.GetMainNICAddress(1, fakeNetNumber); err != nil || addr != "\x02" {
+		t.Errorf("got GetMainNICAddress(1) = (%q, %v), want (%q, nil)", addr, err, "\x02")
+	}
+	if ok, err := r.ContainsSubnet(2, subnet); err != nil || !ok {
+		t.Errorf("got ContainsSubnet(2) = (%t, %v), want (true, nil)", ok, err)
+	}
+	if vrf, err := r.NICVRF(2); err != nil || vrf != 7 {
+		t.Errorf("got NICVRF(2) = (%d, %v), want (7, nil)", vrf, err)
+	}
+	if rcv, snd, err := r.NICHostModel(1); err != nil || rcv != stack.HostModelWeak || snd != stack.HostModelStrict {
+		t.Errorf("got NICHostModel(1) = (%d, %d, %v), want (%d, %d, nil)", rcv, snd, err, stack.HostModelWeak, stack.HostModelStrict)
+	}
+	if rcv, snd := r.HostModel(); rcv != stack.HostModelStrict || snd != stack.HostModelWeak {
+		t.Errorf("got HostModel() = (%d, %d), want (%d, %d)", rcv, snd, stack.HostModelStrict, stack.HostModelWeak)
+	}
+	if got, ok := r.MulticastRoute("", "\xe0\x00\x00\x01"); !ok || !reflect.DeepEqual(got, mroute) {
+		t.Errorf("got MulticastRoute = (%+v, %t), want (%+v, true)", got, ok, mroute)
+	}
+	if got := r.NATRules(); !reflect.DeepEqual(got, natRules) {
+		t.Errorf("got NATRules() = %+v, want %+v", got, natRules)
+	}
+	if entries, err := r.Neighbors(1); err != nil || len(entries) != 1 || entries[0].Addr != "\x05" || entries[0].LinkAddr != "\x02\x00\x00\x00\x00\x05" || entries[0].State != stack.NeighborPermanent {
+		t.Errorf("got Neighbors(1) = (%+v, %v), want the static entry of \\x05", entries, err)
+	}
+
+	want, got := s.NICInfo(), r.NICInfo()
+	for id, w := range want {
+		g, ok := got[id]
+		if !ok {
+			t.Errorf("NIC %d not restored", id)
+			continue
+		}
+		if g.Name != w.Name || g.Flags != w.Flags || g.MTU != w.MTU {
+			t.Errorf("got NIC %d restored as %+v, want %+v", id, g, w)
+		}
+		if len(g.ProtocolAddresses) != len(w.ProtocolAddresses) {
+			t.Errorf("got NIC %d addresses %v, want %v", id, g.ProtocolAddresses, w.ProtocolAddresses)
+		}
+	}
+
+	// Restoring over existing NICs fails.
+	if _, err := r.Restore(c, map[tcpip.NICID]tcpip.LinkEndpointID{1: rid1, 2: rid2}, nil); err != tcpip.ErrDuplicateNICID {
+		t.Errorf("got Restore() on a restored stack = %v, want %s", err, tcpip.ErrDuplicateNICID)
+	}
+
+	// A restore failing halfway leaves the stack as it was.
+	c.NICs[1].Addresses = append(c.NICs[1].Addresses, stack.AddressCheckpoint{Protocol: 99, Address: "\x06"})
+	f := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	fid1, _ := channel.New(10, defaultMTU, "")
+	fid2, _ := channel.New(10, defaultMTU, "")
+	if _, err := f.Restore(c, map[tcpip.NICID]tcpip.LinkEndpointID{1: fid1, 2: fid2}, nil); err != tcpip.ErrUnknownProtocol {
+		t.Fatalf("got Restore() with an unknown protocol = %v, want %s", err, tcpip.ErrUnknownProtocol)
+	}
+	if got := f.NICInfo(); len(got) != 0 {
+		t.Errorf("got NICInfo() = %+v after a failed Restore, want no NICs", got)
+	}
+	if got := f.GetRouteTable(); len(got) != 0 {
+		t.Errorf("got GetRouteTable() = %v after a failed Restore, want no routes", got)
+	}
+	if got := f.NATRules(); len(got) != 0 {
+		t.Errorf("got NATRules() = %+v after a failed Restore, want no rules", got)
+	}
+}
+
+func TestStaticNeighbors(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	id, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddStaticNeighbor(2, "\x02", "\x0a"); err != tcpip.ErrUnknownNICID {
+		t.Errorf("got AddStaticNeighbor(2, ...) = %v, want = %v", err, tcpip.ErrUnknownNICID)
+	}
+	if err := s.AddStaticNeighbor(1, "\x02", "\x0a"); err != nil {
+		t.Fatalf("AddStaticNeighbor failed: %v", err)
+	}
+	// Learned addresses don't replace static ones.
+	s.AddLinkAddress(1, "\x02", "\x0b")
+
+	entries, err := s.Neighbors(1)
+	if err != nil {
+		t.Fatalf("Neighbors failed: %v", err)
+	}
+	want := stack.NeighborEntry{Addr: "\x02", LinkAddr: "\x0a", State: stack.NeighborPermanent}
+	if len(entries) != 1 {
+		t.Fatalf("got Neighbors(1) = %+v, want [%+v]", entries, want)
+	}
+	entries[0].Age = 0
+	if entries[0] != want {
+		t.Errorf("got Neighbors(1) = %+v, want [%+v]", entries, want)
+	}
+
+	if err := s.RemoveNeighbor(1, "\x02"); err != nil {
+		t.Fatalf("RemoveNeighbor failed: %v", err)
+	}
+	if err := s.RemoveNeighbor(1, "\x02"); err != tcpip.ErrBadAddress {
+		t.Errorf("got second RemoveNeighbor = %v, want = %v", err, tcpip.ErrBadAddress)
+	}
+	if entries, err := s.Neighbors(1); err != nil || len(entries) != 0 {
+		t.Errorf("got Neighbors(1) = %+v, %v after RemoveNeighbor, want no entries", entries, err)
+	}
+}
+
+func TestLeakCheckInboundRoutes(t *testing.T) {
+	defer tcpip.SetLeakCheck(tcpip.LeakCheckEnabled())
+	tcpip.SetLeakCheck(true)
+
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	// Routes made for received packets don't hold a reference of their
+	// own, so they must not be reported as leaked.
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	linkEP.Inject(fakeNetNumber, buf.ToVectorisedView())
+	for _, o := range tcpip.GetTrackedObjects() {
+		if o.Kind == "route" && strings.Contains(o.Stack, "TestLeakCheckInboundRoutes") {
+			t.Errorf("inbound route reported as leaked, created at:\n%s", o.Stack)
+		}
+	}
+}
+
+// countingLinkEndpoint counts the packets written to the link endpoint it
+// wraps.
+type countingLinkEndpoint struct {
+	stack.LinkEndpoint
+	writes int
+}
+
+func (e *countingLinkEndpoint) WritePacket(r *stack.Route, pkt *stack.PacketBuffer, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	e.writes++
+	return e.LinkEndpoint.WritePacket(r, pkt, protocol)
+}
+
+func TestLoopbackFastPath(t *testing.T) {
+	s := stack.New([]string{"fakeNet"}, nil, stack.Options{})
+	linkEP := &countingLinkEndpoint{LinkEndpoint: stack.FindLinkEndpoint(loopback.New())}
+	if err := s.CreateNamedLoopbackNIC(1, "lo", stack.RegisterLinkEndpoint(linkEP)); err != nil {
+		t.Fatalf("CreateNamedLoopbackNIC failed: %v", err)
+	}
+	for _, addr := range []tcpip.Address{"\x01", "\x02"} {
+		if err := s.AddAddress(1, fakeNetNumber, addr); err != nil {
+			t.Fatalf("AddAddress(%q) failed: %v", addr, err)
+		}
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
+
+	var inbound, outbound int
+	defer s.AddCapture(0, stack.CaptureBoth, func(p stack.CapturedPacket) {
+		if p.Inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	})()
+
+	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
+	for i, fast := range []bool{false, true} {
+		s.SetLoopbackFastPath(fast)
+		if got := s.LoopbackFastPath(); got != fast {
+			t.Fatalf("got LoopbackFastPath() = %t, want = %t", got, fast)
+		}
+
+		sendTo(t, s, "\x02", buffer.NewView(10))
+
+		if got, want := fakeNet.packetCount[2], i+1; got != want {
+			t.Errorf("fast = %t: got packetCount[2] = %d, want = %d", fast, got, want)
+		}
+		if inbound != i+1 || outbound != i+1 {
+			t.Errorf("fast = %t: got %d inbound and %d outbound captured packets, want %d of each", fast, inbound, outbound, i+1)
+		}
+		if got, want := s.NICInfo()[1].Stats.Rx.Packets.Value(), uint64(i+1); got != want {
+			t.Errorf("fast = %t: got Rx.Packets = %d, want = %d", fast, got, want)
+		}
+	}
+	// Only the packet sent without the fast path went through the link
+	// endpoint.
+	if linkEP.writes != 1 {
+		t.Errorf("got %d packets written to the link endpoint, want = 1", linkEP.writes)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stacktest provides helper functions to set up stacks in the tests of
+// the packages built on top of the stack.
+package stacktest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	// NICID is the ID of the NIC of the stacks returned by New.
+	NICID tcpip.NICID = 1
+
+	// NICName is the name of the NIC of the stacks returned by New.
+	NICName = "eth0"
+)
+
+// New returns a stack with the given network and transport protocols, and a
+// NIC with ID NICID and name NICName that uses the link endpoint linkEP.
+func New(t *testing.T, network, transport []string, linkEP tcpip.LinkEndpointID) *stack.Stack {
+	t.Helper()
+	s := stack.New(network, transport, stack.Options{})
+	if err := s.CreateNamedNIC(NICID, NICName, linkEP); err != nil {
+		t.Fatalf("CreateNamedNIC(%d, %q): %v", NICID, NICName, err)
+	}
+	return s
+}
+
+// AddAddresses adds addrs to the NIC of s with ID NICID, as IPv4 or IPv6
+// addresses depending on their length.
+func AddAddresses(t *testing.T, s *stack.Stack, addrs ...tcpip.Address) {
+	t.Helper()
+	for _, addr := range addrs {
+		proto := header.IPv4ProtocolNumber
+		if len(addr) == header.IPv6AddressSize {
+			proto = header.IPv6ProtocolNumber
+		}
+		if err := s.AddAddress(NICID, proto, addr); err != nil {
+			t.Fatalf("AddAddress(%d, %d, %v): %v", NICID, proto, addr, err)
+		}
+	}
+}
+
+// SetDefaultRoutes makes the NIC of s with ID NICID its default IPv4 and IPv6
+// route.
+func SetDefaultRoutes(s *stack.Stack) {
+	s.SetRouteTable([]tcpip.Route{
+		{
+			Destination: tcpip.Address(strings.Repeat("\x00", header.IPv4AddressSize)),
+			Mask:        tcpip.AddressMask(strings.Repeat("\x00", header.IPv4AddressSize)),
+			NIC:         NICID,
+		},
+		{
+			Destination: tcpip.Address(strings.Repeat("\x00", header.IPv6AddressSize)),
+			Mask:        tcpip.AddressMask(strings.Repeat("\x00", header.IPv6AddressSize)),
+			NIC:         NICID,
+		},
+	})
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/flow"
+)
+
+// A TransparentEndpoint is a TransportEndpoint that can be transparent, see
+// tcpip.TransparentOption.
+type TransparentEndpoint interface {
+	TransportEndpoint
+
+	// Transparent returns whether the endpoint receives the packets
+	// destined to addresses that aren't local on the NICs in transparent
+	// mode.
+	Transparent() bool
+}
+
+// SetTransparent enables or disables transparent mode in the given NIC, the
+// analogue of Linux's TPROXY. In transparent mode, the packets the NIC receives
+// for addresses that aren't local are delivered to the transparent endpoints
+// that match them, as if the address had been added to the NIC, instead of
+// being forwarded or dropped; the other ones are handled as usual. Transparent
+// endpoints can also send packets from such addresses through the NIC, to
+// reply to the traffic they intercepted.
+//
+// Only packets whose ports can be found are intercepted, so IP fragments
+// aren't.
+func (s *Stack) SetTransparent(nicID tcpip.NICID, enable bool) *tcpip.Error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	nic.setTransparent(enable)
+
+	return nil
+}
+
+// transparentEndpointReceives returns whether the packet in b, which starts
+// with a network header of the given protocol, would be delivered to a
+// transparent endpoint if its destination was local.
+func (n *NIC) transparentEndpointReceives(protocol tcpip.NetworkProtocolNumber, b []byte) bool {
+	k, ok := flow.Dissect(protocol, b)
+	if !ok || k.DstPort == 0 {
+		return false
+	}
+	id := TransportEndpointID{
+		LocalPort:     k.DstPort,
+		LocalAddress:  k.Dst,
+		RemotePort:    k.SrcPort,
+		RemoteAddress: k.Src,
+	}
+	return n.demux.transparentEndpoint(protocol, k.TransProto, id) || n.transportDemux().transparentEndpoint(protocol, k.TransProto, id)
+}
+
+// transparentEndpoint returns whether the endpoint that receives the packets
+// of the flow identified by id is transparent.
+func (d *transportDemuxer) transparentEndpoint(netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, id TransportEndpointID) bool {
+	eps, ok := d.protocol[protocolIDs{netProto, transProto}]
+	if !ok {
+		return false
+	}
+
+	eps.mu.RLock()
+	ep := d.findEndpointLocked(eps, buffer.VectorisedView{}, id)
+	eps.mu.RUnlock()
+
+	if mpep, ok := ep.(*multiPortEndpoint); ok {
+		ep = mpep.selectEndpoint(id)
+	}
+	tep, ok := ep.(TransparentEndpoint)
+	return ok && tep.Transparent()
+}
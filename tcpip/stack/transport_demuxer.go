@@ -20,7 +20,7 @@ import (
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
-	"github.com/google/netstack/tcpip/hash/jenkins"
+	"github.com/google/netstack/tcpip/flow"
 	"github.com/google/netstack/tcpip/header"
 )
 
@@ -99,7 +99,7 @@ type multiPortEndpoint struct {
 	mu           sync.RWMutex
 	endpointsArr []TransportEndpoint
 	endpointsMap map[TransportEndpoint]int
-	// seed is a random secret for a jenkins hash.
+	// seed is a random secret for the flow hash.
 	seed uint32
 }
 
@@ -112,53 +112,41 @@ func reciprocalScale(val, n uint32) uint32 {
 }
 
 // selectEndpoint calculates a hash of destination and source addresses and
-// ports then uses it to select a socket. In this case, all packets from one
-// address will be sent to same endpoint.
+// ports then uses it to select a socket. In this case, all packets of one flow
+// will be sent to same endpoint.
 func (ep *multiPortEndpoint) selectEndpoint(id TransportEndpointID) TransportEndpoint {
 	ep.mu.RLock()
 	defer ep.mu.RUnlock()
 
-	payload := []byte{
-		byte(id.LocalPort),
-		byte(id.LocalPort >> 8),
-		byte(id.RemotePort),
-		byte(id.RemotePort >> 8),
-	}
-
-	h := jenkins.Sum32(ep.seed)
-	h.Write(payload)
-	h.Write([]byte(id.LocalAddress))
-	h.Write([]byte(id.RemoteAddress))
-	hash := h.Sum32()
-
+	hash := id.Flow(0, 0).Hash(flow.FourTuple, ep.seed)
 	idx := reciprocalScale(hash, uint32(len(ep.endpointsArr)))
 	return ep.endpointsArr[idx]
 }
 
 // HandlePacket is called by the stack when new packets arrive to this transport
 // endpoint.
-func (ep *multiPortEndpoint) HandlePacket(r *Route, id TransportEndpointID, netHeader buffer.View, vv buffer.VectorisedView) {
-	// If this is a broadcast datagram, deliver the datagram to all endpoints
-	// managed by ep.
-	if id.LocalAddress == header.IPv4Broadcast {
+func (ep *multiPortEndpoint) HandlePacket(r *Route, id TransportEndpointID, pkt *PacketBuffer) {
+	// If this is a broadcast or multicast datagram, deliver the datagram to
+	// all endpoints managed by ep.
+	if isGroupAddress(id.LocalAddress) {
 		for i, endpoint := range ep.endpointsArr {
-			// HandlePacket modifies vv, so each endpoint needs its own copy.
+			// HandlePacket modifies pkt, so each endpoint needs its own copy.
 			if i == len(ep.endpointsArr)-1 {
-				endpoint.HandlePacket(r, id, netHeader, vv)
+				endpoint.HandlePacket(r, id, pkt)
 				break
 			}
-			vvCopy := buffer.NewView(vv.Size())
-			copy(vvCopy, vv.ToView())
-			endpoint.HandlePacket(r, id, buffer.NewViewFromBytes(netHeader), vvCopy.ToVectorisedView())
+			c := pkt.Clone()
+			endpoint.HandlePacket(r, id, c)
+			c.DecRef()
 		}
 	} else {
-		ep.selectEndpoint(id).HandlePacket(r, id, netHeader, vv)
+		ep.selectEndpoint(id).HandlePacket(r, id, pkt)
 	}
 }
 
 // HandleControlPacket implements stack.TransportEndpoint.HandleControlPacket.
-func (ep *multiPortEndpoint) HandleControlPacket(id TransportEndpointID, typ ControlType, extra uint32, vv buffer.VectorisedView) {
-	ep.selectEndpoint(id).HandleControlPacket(id, typ, extra, vv)
+func (ep *multiPortEndpoint) HandleControlPacket(id TransportEndpointID, typ ControlType, extra uint32, info ControlInfo, vv buffer.VectorisedView) {
+	ep.selectEndpoint(id).HandleControlPacket(id, typ, extra, info, vv)
 }
 
 func (ep *multiPortEndpoint) singleRegisterEndpoint(t TransportEndpoint) {
@@ -168,7 +156,7 @@ func (ep *multiPortEndpoint) singleRegisterEndpoint(t TransportEndpoint) {
 	// A new endpoint is added into endpointsArr and its index there is
 	// saved in endpointsMap. This will allows to remove endpoint from
 	// the array fast.
-	ep.endpointsMap[ep] = len(ep.endpointsArr)
+	ep.endpointsMap[t] = len(ep.endpointsArr)
 	ep.endpointsArr = append(ep.endpointsArr, t)
 }
 
@@ -256,7 +244,7 @@ var loopbackSubnet = func() tcpip.Subnet {
 // deliverPacket attempts to find one or more matching transport endpoints, and
 // then, if matches are found, delivers the packet to them. Returns true if it
 // found one or more endpoints, false otherwise.
-func (d *transportDemuxer) deliverPacket(r *Route, protocol tcpip.TransportProtocolNumber, netHeader buffer.View, vv buffer.VectorisedView, id TransportEndpointID) bool {
+func (d *transportDemuxer) deliverPacket(r *Route, protocol tcpip.TransportProtocolNumber, pkt *PacketBuffer, id TransportEndpointID) bool {
 	eps, ok := d.protocol[protocolIDs{r.NetProto, protocol}]
 	if !ok {
 		return false
@@ -268,18 +256,19 @@ func (d *transportDemuxer) deliverPacket(r *Route, protocol tcpip.TransportProto
 		return false
 	}
 
-	// If the packet is a broadcast, then find all matching transport endpoints.
-	// Otherwise, try to find a single matching transport endpoint.
+	// If the packet is a UDP broadcast or multicast, then find all matching
+	// transport endpoints, as BSD does. Otherwise, try to find a single
+	// matching transport endpoint.
 	destEps := make([]TransportEndpoint, 0, 1)
 	eps.mu.RLock()
 
-	if protocol == header.UDPProtocolNumber && id.LocalAddress == header.IPv4Broadcast {
+	if protocol == header.UDPProtocolNumber && isGroupAddress(id.LocalAddress) {
 		for epID, endpoint := range eps.endpoints {
-			if epID.LocalPort == id.LocalPort {
+			if epID.matches(id) {
 				destEps = append(destEps, endpoint)
 			}
 		}
-	} else if ep := d.findEndpointLocked(eps, vv, id); ep != nil {
+	} else if ep := d.findEndpointLocked(eps, pkt.Data, id); ep != nil {
 		destEps = append(destEps, ep)
 	}
 
@@ -290,7 +279,9 @@ func (d *transportDemuxer) deliverPacket(r *Route, protocol tcpip.TransportProto
 	for _, rawEP := range eps.rawEndpoints {
 		// Each endpoint gets its own copy of the packet for the sake
 		// of save/restore.
-		rawEP.HandlePacket(r, id, buffer.NewViewFromBytes(netHeader), vv.ToView().ToVectorisedView())
+		c := pkt.Clone()
+		rawEP.HandlePacket(r, id, c)
+		c.DecRef()
 		found = true
 	}
 	eps.mu.RUnlock()
@@ -304,17 +295,63 @@ func (d *transportDemuxer) deliverPacket(r *Route, protocol tcpip.TransportProto
 		return false
 	}
 
-	// Deliver the packet.
-	for _, ep := range destEps {
-		ep.HandlePacket(r, id, netHeader, vv)
+	// Deliver the packet. HandlePacket modifies pkt, so each endpoint but
+	// the last needs its own copy.
+	for i, ep := range destEps {
+		if i == len(destEps)-1 {
+			ep.HandlePacket(r, id, pkt)
+			break
+		}
+		c := pkt.Clone()
+		ep.HandlePacket(r, id, c)
+		c.DecRef()
 	}
 
 	return true
 }
 
+// deliverRawPacket delivers the packet to the raw endpoints of the given
+// protocol only. Returns true if there were any.
+func (d *transportDemuxer) deliverRawPacket(r *Route, protocol tcpip.TransportProtocolNumber, pkt *PacketBuffer) bool {
+	eps, ok := d.protocol[protocolIDs{r.NetProto, protocol}]
+	if !ok {
+		return false
+	}
+
+	id := TransportEndpointID{LocalAddress: r.LocalAddress, RemoteAddress: r.RemoteAddress}
+	found := false
+	eps.mu.RLock()
+	for _, rawEP := range eps.rawEndpoints {
+		c := pkt.Clone()
+		rawEP.HandlePacket(r, id, c)
+		c.DecRef()
+		found = true
+	}
+	eps.mu.RUnlock()
+	return found
+}
+
+// isGroupAddress returns whether addr is the IPv4 broadcast address or a
+// multicast address, which datagrams are delivered to every matching endpoint
+// for.
+func isGroupAddress(addr tcpip.Address) bool {
+	return addr == header.IPv4Broadcast || header.IsV4MulticastAddress(addr) || header.IsV6MulticastAddress(addr)
+}
+
+// matches returns whether an endpoint registered with id receives the packets
+// of the flow identified by pid: each field of id is either equal to the one of
+// pid or, except for the local port, a wildcard. Endpoints bound to the IPv4
+// unspecified address, like DHCP clients, are bound to the wildcard address.
+func (id TransportEndpointID) matches(pid TransportEndpointID) bool {
+	return id.LocalPort == pid.LocalPort &&
+		(id.LocalAddress == "" || id.LocalAddress == header.IPv4Any || id.LocalAddress == pid.LocalAddress) &&
+		(id.RemoteAddress == "" || id.RemoteAddress == pid.RemoteAddress) &&
+		(id.RemotePort == 0 || id.RemotePort == pid.RemotePort)
+}
+
 // deliverControlPacket attempts to deliver the given control packet. Returns
 // true if it found an endpoint, false otherwise.
-func (d *transportDemuxer) deliverControlPacket(net tcpip.NetworkProtocolNumber, trans tcpip.TransportProtocolNumber, typ ControlType, extra uint32, vv buffer.VectorisedView, id TransportEndpointID) bool {
+func (d *transportDemuxer) deliverControlPacket(net tcpip.NetworkProtocolNumber, trans tcpip.TransportProtocolNumber, typ ControlType, extra uint32, info ControlInfo, vv buffer.VectorisedView, id TransportEndpointID) bool {
 	eps, ok := d.protocol[protocolIDs{net, trans}]
 	if !ok {
 		return false
@@ -331,11 +368,60 @@ func (d *transportDemuxer) deliverControlPacket(net tcpip.NetworkProtocolNumber,
 	}
 
 	// Deliver the packet.
-	ep.HandleControlPacket(id, typ, extra, vv)
+	ep.HandleControlPacket(id, typ, extra, info, vv)
 
 	return true
 }
 
+// deliverControlPacketToAll delivers a control packet that isn't associated
+// with a particular flow to every endpoint registered with the demuxer. Each
+// endpoint receives it once, even if it is registered for several network
+// protocols.
+func (d *transportDemuxer) deliverControlPacketToAll(typ ControlType, extra uint32, info ControlInfo) {
+	seen := make(map[TransportEndpoint]struct{})
+	var eps []TransportEndpoint
+	d.forEachEndpoint(func(_ protocolIDs, _ TransportEndpointID, ep TransportEndpoint, raw bool) {
+		if _, ok := seen[ep]; !ok && !raw {
+			seen[ep] = struct{}{}
+			eps = append(eps, ep)
+		}
+	})
+
+	for _, ep := range eps {
+		ep.HandleControlPacket(TransportEndpointID{}, typ, extra, info, buffer.VectorisedView{})
+	}
+}
+
+// forEachEndpoint calls fn with every endpoint registered with the demuxer,
+// along with the protocols and ID it is registered for and whether it is a raw
+// endpoint, once per registration. fn is called with the demuxer's locks held,
+// so it must not call into the demuxer nor the endpoints.
+func (d *transportDemuxer) forEachEndpoint(fn func(ids protocolIDs, id TransportEndpointID, ep TransportEndpoint, raw bool)) {
+	for ids, tes := range d.protocol {
+		tes.mu.RLock()
+		for id, ep := range tes.endpoints {
+			if mpep, ok := ep.(*multiPortEndpoint); ok {
+				mpep.mu.RLock()
+				for _, ep := range mpep.endpointsArr {
+					fn(ids, id, ep, false)
+				}
+				mpep.mu.RUnlock()
+				continue
+			}
+			fn(ids, id, ep, false)
+		}
+		for _, ep := range tes.rawEndpoints {
+			fn(ids, TransportEndpointID{}, ep, true)
+		}
+		tes.mu.RUnlock()
+	}
+}
+
+// findEndpointLocked returns the endpoint that receives the unicast packets of
+// the flow identified by id, among the endpoints of eps that match it. As with
+// BSD sockets, the most specific one wins: connected endpoints take precedence
+// over the ones that are only bound, and endpoints bound to a local address
+// over the ones bound to the wildcard address. eps.mu must be held.
 func (d *transportDemuxer) findEndpointLocked(eps *transportEndpoints, vv buffer.VectorisedView, id TransportEndpointID) TransportEndpoint {
 	// Try to find a match with the id as provided.
 	if ep, ok := eps.endpoints[id]; ok {
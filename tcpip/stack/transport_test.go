@@ -74,7 +74,7 @@ func (f *fakeTransportEndpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions)
 	if err != nil {
 		return 0, nil, err
 	}
-	if err := f.route.WritePacket(hdr, buffer.View(v).ToVectorisedView(), fakeTransNumber, 123); err != nil {
+	if err := writePacket(&f.route, hdr, buffer.View(v).ToVectorisedView()); err != nil {
 		return 0, nil, err
 	}
 
@@ -136,7 +136,7 @@ func (*fakeTransportEndpoint) Listen(int) *tcpip.Error {
 	return nil
 }
 
-func (f *fakeTransportEndpoint) Accept() (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
+func (f *fakeTransportEndpoint) Accept(*tcpip.FullAddress) (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
 	if len(f.acceptQueue) == 0 {
 		return nil, nil, nil
 	}
@@ -168,7 +168,7 @@ func (*fakeTransportEndpoint) GetRemoteAddress() (tcpip.FullAddress, *tcpip.Erro
 	return tcpip.FullAddress{}, nil
 }
 
-func (f *fakeTransportEndpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, _ buffer.View, _ buffer.VectorisedView) {
+func (f *fakeTransportEndpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, _ *stack.PacketBuffer) {
 	// Increment the number of received packets.
 	f.proto.packetCount++
 	if f.acceptQueue != nil {
@@ -183,7 +183,7 @@ func (f *fakeTransportEndpoint) HandlePacket(r *stack.Route, id stack.TransportE
 	}
 }
 
-func (f *fakeTransportEndpoint) HandleControlPacket(stack.TransportEndpointID, stack.ControlType, uint32, buffer.VectorisedView) {
+func (f *fakeTransportEndpoint) HandleControlPacket(stack.TransportEndpointID, stack.ControlType, uint32, stack.ControlInfo, buffer.VectorisedView) {
 	// Increment the number of received control packets.
 	f.proto.controlCount++
 }
@@ -226,7 +226,7 @@ func (*fakeTransportProtocol) ParsePorts(buffer.View) (src, dst uint16, err *tcp
 	return 0, 0, nil
 }
 
-func (*fakeTransportProtocol) HandleUnknownDestinationPacket(*stack.Route, stack.TransportEndpointID, buffer.VectorisedView) bool {
+func (*fakeTransportProtocol) HandleUnknownDestinationPacket(*stack.Route, stack.TransportEndpointID, *stack.PacketBuffer) bool {
 	return true
 }
 
@@ -259,7 +259,7 @@ func TestTransportReceive(t *testing.T) {
 		t.Fatalf("CreateNIC failed: %v", err)
 	}
 
-	s.SetRouteTable([]tcpip.Route{{"\x00", "\x00", "\x00", 1}})
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
 
 	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
 		t.Fatalf("AddAddress failed: %v", err)
@@ -315,7 +315,7 @@ func TestTransportControlReceive(t *testing.T) {
 		t.Fatalf("CreateNIC failed: %v", err)
 	}
 
-	s.SetRouteTable([]tcpip.Route{{"\x00", "\x00", "\x00", 1}})
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
 
 	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
 		t.Fatalf("AddAddress failed: %v", err)
@@ -381,7 +381,7 @@ func TestTransportSend(t *testing.T) {
 		t.Fatalf("AddAddress failed: %v", err)
 	}
 
-	s.SetRouteTable([]tcpip.Route{{"\x00", "\x00", "\x00", 1}})
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
 
 	// Create endpoint and bind it.
 	wq := waiter.Queue{}
@@ -473,8 +473,8 @@ func TestTransportForwarding(t *testing.T) {
 	// Route all packets to address 3 to NIC 2 and all packets to address
 	// 1 to NIC 1.
 	s.SetRouteTable([]tcpip.Route{
-		{"\x03", "\xff", "\x00", 2},
-		{"\x01", "\xff", "\x00", 1},
+		{Destination: "\x03", Mask: "\xff", Gateway: "\x00", NIC: 2},
+		{Destination: "\x01", Mask: "\xff", Gateway: "\x00", NIC: 1},
 	})
 
 	wq := waiter.Queue{}
@@ -494,7 +494,7 @@ func TestTransportForwarding(t *testing.T) {
 	req[2] = byte(fakeTransNumber)
 	linkEP2.Inject(fakeNetNumber, req.ToVectorisedView())
 
-	aep, _, err := ep.Accept()
+	aep, _, err := ep.Accept(nil)
 	if err != nil || aep == nil {
 		t.Fatalf("Accept failed: %v, %v", aep, err)
 	}
@@ -524,3 +524,80 @@ func init() {
 		return &fakeTransportProtocol{}
 	})
 }
+
+func TestTransportMTUChange(t *testing.T) {
+	id, _ := channel.New(10, defaultMTU, "")
+	s := stack.New([]string{"fakeNet"}, []string{"fakeTrans"}, stack.Options{})
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
+
+	// Create a connected endpoint, which caches a route through NIC 1.
+	wq := waiter.Queue{}
+	ep, err := s.NewEndpoint(fakeTransNumber, fakeNetNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	if err := ep.Connect(tcpip.FullAddress{0, "\x02", 0}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	const newMTU = 500
+	if err := s.SetNICMTU(1, newMTU); err != nil {
+		t.Fatalf("SetNICMTU(1, %d) failed: %v", newMTU, err)
+	}
+
+	if got := s.NICInfo()[1].MTU; got != newMTU {
+		t.Errorf("got NICInfo()[1].MTU = %d, want = %d", got, newMTU)
+	}
+
+	fep := ep.(*fakeTransportEndpoint)
+	if got, want := fep.route.MTU(), uint32(newMTU-fakeNetHeaderLen); got != want {
+		t.Errorf("got route.MTU() = %d, want = %d", got, want)
+	}
+
+	fakeTrans := s.TransportProtocolInstance(fakeTransNumber).(*fakeTransportProtocol)
+	if fakeTrans.controlCount != 1 {
+		t.Errorf("controlCount = %d, want %d", fakeTrans.controlCount, 1)
+	}
+
+	if err := s.SetNICMTU(2, newMTU); err != tcpip.ErrUnknownNICID {
+		t.Errorf("got SetNICMTU(2, %d) = %v, want = %v", newMTU, err, tcpip.ErrUnknownNICID)
+	}
+}
+
+func TestCheckpointRejection(t *testing.T) {
+	id, _ := channel.New(10, defaultMTU, "")
+	s := stack.New([]string{"fakeNet"}, []string{"fakeTrans"}, stack.Options{})
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	wq := waiter.Queue{}
+	ep, err := s.NewEndpoint(fakeTransNumber, fakeNetNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Connect(tcpip.FullAddress{0, "\x02", 0}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	if _, err := s.Checkpoint(); err == nil {
+		t.Fatalf("Checkpoint succeeded with a registered endpoint")
+	} else if _, ok := err.(tcpip.ErrSaveRejection); !ok {
+		t.Fatalf("got Checkpoint() = %v, want a tcpip.ErrSaveRejection", err)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/ports"
+)
+
+// vrf holds the state of a VRF: the demuxer of the transport endpoints that
+// are bound to it but not to a particular NIC, and its ports, so that
+// endpoints of different VRFs can use the same addresses and ports.
+type vrf struct {
+	demux *transportDemuxer
+	ports *ports.PortManager
+}
+
+// vrfState returns the state of the given VRF, creating it if needed.
+func (s *Stack) vrfState(id tcpip.VRFID) *vrf {
+	if id == tcpip.DefaultVRF {
+		return &vrf{demux: s.demux, ports: s.PortManager}
+	}
+
+	s.vrfMu.Lock()
+	defer s.vrfMu.Unlock()
+	v, ok := s.vrfs[id]
+	if !ok {
+		v = &vrf{
+			demux: newTransportDemuxer(s),
+			ports: ports.NewPortManager(),
+		}
+		if s.vrfs == nil {
+			s.vrfs = make(map[tcpip.VRFID]*vrf)
+		}
+		s.vrfs[id] = v
+	}
+	return v
+}
+
+// SetNICVRF assigns the NIC with the given ID to a VRF. From then on, the NIC
+// and the routes through it are only used by the endpoints of that VRF, and
+// the packets it receives are only delivered to them. Endpoints bound to the
+// NIC itself keep receiving its packets.
+//
+// Packets are never forwarded between NICs of different VRFs.
+func (s *Stack) SetNICVRF(id tcpip.NICID, vrf tcpip.VRFID) *tcpip.Error {
+	v := s.vrfState(vrf)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+	nic.setVRF(vrf, v.demux)
+	s.invalidateRoutes()
+	return nil
+}
+
+// NICVRF returns the VRF of the NIC with the given ID.
+func (s *Stack) NICVRF(id tcpip.NICID) (tcpip.VRFID, *tcpip.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return 0, tcpip.ErrUnknownNICID
+	}
+	return nic.vrfID(), nil
+}
+
+// VRFPortManager returns the port manager of the given VRF. Transport
+// endpoints bound to a VRF reserve their ports there, rather than with the
+// stack's own port manager, which is that of the default VRF.
+func (s *Stack) VRFPortManager(vrf tcpip.VRFID) *ports.PortManager {
+	return s.vrfState(vrf).ports
+}
+
+// nicVRFLocked returns the VRF the NIC with the given ID belongs to, or the
+// default VRF if id is 0 or unknown. s.mu must be held.
+func (s *Stack) nicVRFLocked(id tcpip.NICID) tcpip.VRFID {
+	if nic, ok := s.nics[id]; ok {
+		return nic.vrfID()
+	}
+	return tcpip.DefaultVRF
+}
+
+// vrfDemuxer returns the demuxer endpoints of the given VRF bound to the NIC
+// with the given ID, or to all NICs of the VRF if id is 0, are registered
+// with. It fails with ErrUnknownNICID if the NIC doesn't exist or belongs to
+// another VRF.
+func (s *Stack) vrfDemuxer(vrf tcpip.VRFID, id tcpip.NICID) (*transportDemuxer, *tcpip.Error) {
+	if id == 0 {
+		return s.vrfState(vrf).demux, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil || nic.vrfID() != vrf {
+		return nil, tcpip.ErrUnknownNICID
+	}
+	return nic.demux, nil
+}
+
+// RegisterTransportEndpointInVRF is like RegisterTransportEndpoint, for an
+// endpoint of the given VRF. If a NIC is specified, it must belong to the VRF.
+func (s *Stack) RegisterTransportEndpointInVRF(vrf tcpip.VRFID, nicID tcpip.NICID, netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint, reusePort bool) *tcpip.Error {
+	d, err := s.vrfDemuxer(vrf, nicID)
+	if err != nil {
+		return err
+	}
+	return d.registerEndpoint(netProtos, protocol, id, ep, reusePort)
+}
+
+// UnregisterTransportEndpointInVRF is like UnregisterTransportEndpoint, for an
+// endpoint of the given VRF.
+func (s *Stack) UnregisterTransportEndpointInVRF(vrf tcpip.VRFID, nicID tcpip.NICID, netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) {
+	// The NIC may have been moved to another VRF since the endpoint was
+	// registered with it.
+	if nicID != 0 {
+		s.UnregisterTransportEndpoint(nicID, netProtos, protocol, id, ep)
+		return
+	}
+	s.vrfState(vrf).demux.unregisterEndpoint(netProtos, protocol, id, ep)
+}
@@ -29,8 +29,11 @@
 package tcpip
 
 import (
+	"bytes"
+	"encoding/gob"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"strconv"
 	"strings"
@@ -99,11 +102,46 @@ var (
 	ErrNoLinkAddress         = &Error{msg: "no remote link address"}
 	ErrBadAddress            = &Error{msg: "bad address"}
 	ErrNetworkUnreachable    = &Error{msg: "network is unreachable"}
+	ErrHostUnreachable       = &Error{msg: "host is unreachable"}
+	ErrNetworkDown           = &Error{msg: "network is down"}
 	ErrMessageTooLong        = &Error{msg: "message too long"}
 	ErrNoBufferSpace         = &Error{msg: "no buffer space available"}
 	ErrBroadcastDisabled     = &Error{msg: "broadcast socket option disabled"}
+	ErrBadBuffer             = &Error{msg: "bad buffer"}
+	ErrProhibited            = &Error{msg: "communication administratively prohibited"}
 )
 
+// errorsByMessage maps the messages of the errors above to them, see
+// ErrorFromMessage.
+var errorsByMessage = func() map[string]*Error {
+	m := make(map[string]*Error)
+	for _, err := range []*Error{
+		ErrUnknownProtocol, ErrUnknownNICID, ErrUnknownDevice,
+		ErrUnknownProtocolOption, ErrDuplicateNICID, ErrDuplicateAddress,
+		ErrNoRoute, ErrBadLinkEndpoint, ErrAlreadyBound,
+		ErrInvalidEndpointState, ErrAlreadyConnecting, ErrAlreadyConnected,
+		ErrNoPortAvailable, ErrPortInUse, ErrBadLocalAddress,
+		ErrClosedForSend, ErrClosedForReceive, ErrWouldBlock,
+		ErrConnectionRefused, ErrTimeout, ErrAborted, ErrConnectStarted,
+		ErrDestinationRequired, ErrNotSupported, ErrQueueSizeNotSupported,
+		ErrNotConnected, ErrConnectionReset, ErrConnectionAborted,
+		ErrNoSuchFile, ErrInvalidOptionValue, ErrNoLinkAddress,
+		ErrBadAddress, ErrNetworkUnreachable, ErrHostUnreachable,
+		ErrNetworkDown, ErrMessageTooLong, ErrNoBufferSpace,
+		ErrBroadcastDisabled, ErrBadBuffer, ErrProhibited,
+	} {
+		m[err.msg] = err
+	}
+	return m
+}()
+
+// ErrorFromMessage returns the error of the network stack whose String is msg,
+// or nil if there is none. It is how saved errors are restored, as errors are
+// compared by identity.
+func ErrorFromMessage(msg string) *Error {
+	return errorsByMessage[msg]
+}
+
 // Errors related to Subnet
 var (
 	errSubnetLengthMismatch = errors.New("subnet length of address and mask differ")
@@ -121,10 +159,11 @@ func (e ErrSaveRejection) Error() string {
 	return "save rejected due to unsupported networking state: " + e.Err.Error()
 }
 
-// A Clock provides the current time.
+// A Clock provides the current time and schedules timers.
 //
-// Times returned by a Clock should always be used for application-visible
-// time, but never for netstack internal timekeeping.
+// The stack uses its clock for application-visible times as well as for its
+// internal timekeeping, like retransmission, reassembly and neighbor cache
+// timeouts, so tests and simulations can control how time passes.
 type Clock interface {
 	// NowNanoseconds returns the current real time as a number of
 	// nanoseconds since the Unix epoch.
@@ -132,6 +171,25 @@ type Clock interface {
 
 	// NowMonotonic returns a monotonic time value.
 	NowMonotonic() int64
+
+	// AfterFunc waits for the duration to elapse according to the clock and
+	// then calls f. f must not assume it is called from any particular
+	// goroutine. The returned Timer can be used to cancel or reschedule
+	// the call.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock, see time.Timer.
+type Timer interface {
+	// Stop prevents the timer from firing. It returns true if the call
+	// stops the timer, false if the timer has already expired or been
+	// stopped.
+	Stop() bool
+
+	// Reset changes the timer to expire after duration d. It returns true
+	// if the timer had been active, false if the timer had expired or been
+	// stopped.
+	Reset(d time.Duration) bool
 }
 
 // Address is a byte slice cast as a string that represents the address of a
@@ -219,6 +277,16 @@ func (s *Subnet) Mask() AddressMask {
 // NICID is a number that uniquely identifies a NIC.
 type NICID int32
 
+// VRFID identifies a virtual routing and forwarding instance (VRF) of a stack.
+// Each NIC, and the routes through it, belongs to a single VRF, and transport
+// endpoints only see the NICs and routes of their own VRF, which allows one
+// stack to host isolated networks.
+type VRFID uint32
+
+// DefaultVRF is the VRF of NICs that weren't assigned to another VRF, and of
+// endpoints that weren't bound to another VRF.
+const DefaultVRF VRFID = 0
+
 // ShutdownFlags represents flags that can be passed to the Shutdown() method
 // of the Endpoint interface.
 type ShutdownFlags int
@@ -237,6 +305,11 @@ const (
 type FullAddress struct {
 	// NIC is the ID of the NIC this address refers to.
 	//
+	// It is the zone of scoped addresses, like IPv6 link-local addresses,
+	// which are only unique within a link: it is required to bind or
+	// connect to them, and set in the scoped addresses reported by
+	// endpoints.
+	//
 	// This may not be used by all endpoint types.
 	NIC NICID
 
@@ -276,6 +349,92 @@ func (s SlicePayload) Size() int {
 	return len(s)
 }
 
+// A VectorisedPayload is a Payload whose data need not be contiguous. Endpoints
+// that support it send the data as it is returned by GetVectorised, rather
+// than first gathering it into a single slice with Get.
+type VectorisedPayload interface {
+	Payload
+
+	// GetVectorised returns a VectorisedView holding exactly
+	// 'min(size, p.Size())' bytes.
+	GetVectorised(size int) (buffer.VectorisedView, *Error)
+}
+
+// VectorPayload implements VectorisedPayload on top of a list of slices, such
+// as the ones passed to writev(2). As with SlicePayload, the endpoint may
+// retain the slices once they are written.
+type VectorPayload [][]byte
+
+// Get implements Payload. It copies the data into a single slice unless it is
+// already held in one.
+func (v VectorPayload) Get(size int) ([]byte, *Error) {
+	vv, _ := v.GetVectorised(size)
+	return vv.ToView(), nil
+}
+
+// GetVectorised implements VectorisedPayload.
+func (v VectorPayload) GetVectorised(size int) (buffer.VectorisedView, *Error) {
+	if s := v.Size(); size > s {
+		size = s
+	}
+	views := make([]buffer.View, 0, len(v))
+	n := 0
+	for _, b := range v {
+		if n == size {
+			break
+		}
+		if len(b) == 0 {
+			continue
+		}
+		if len(b) > size-n {
+			b = b[:size-n]
+		}
+		views = append(views, b)
+		n += len(b)
+	}
+	return buffer.NewVectorisedView(size, views), nil
+}
+
+// Size implements Payload.
+func (v VectorPayload) Size() int {
+	n := 0
+	for _, b := range v {
+		n += len(b)
+	}
+	return n
+}
+
+// ReaderPayload implements Payload on top of an io.Reader holding a known
+// amount of data. Get reads the requested data straight into the slice
+// that is handed to the endpoint, so it is not copied again.
+type ReaderPayload struct {
+	// R is the reader the data is read from.
+	R io.Reader
+
+	// N is the number of bytes left to read from R. It is decremented by
+	// the number of bytes returned by Get.
+	N int
+}
+
+// Get implements Payload. It returns ErrBadBuffer if R holds fewer than the
+// requested number of bytes.
+func (r *ReaderPayload) Get(size int) ([]byte, *Error) {
+	if size > r.N {
+		size = r.N
+	}
+	v := make([]byte, size)
+	if _, err := io.ReadFull(r.R, v); err != nil {
+		return nil, ErrBadBuffer
+	}
+	r.N -= size
+	return v, nil
+}
+
+// Size implements Payload.
+func (r *ReaderPayload) Size() int {
+	return r.N
+}
+
 // A ControlMessages contains socket control messages for IP sockets.
 //
 // +stateify savable
@@ -286,6 +445,251 @@ type ControlMessages struct {
 	// Timestamp is the time (in ns) that the last packed used to create
 	// the read data was received.
 	Timestamp int64
+
+	// HasTOS indicates whether TOS is valid/set. It is only set on IPv4
+	// packets read from endpoints with ReceiveTOSOption enabled.
+	HasTOS bool
+
+	// TOS is the type of service of the packet.
+	TOS uint8
+
+	// HasTClass indicates whether TClass is valid/set. It is only set on
+	// IPv6 packets read from endpoints with ReceiveTClassOption enabled.
+	HasTClass bool
+
+	// TClass is the traffic class of the packet.
+	TClass uint8
+
+	// HasFlowLabel indicates whether FlowLabel is valid/set. It is only
+	// set on IPv6 packets read from endpoints with ReceiveFlowLabelOption
+	// enabled.
+	HasFlowLabel bool
+
+	// FlowLabel is the flow label of the packet.
+	FlowLabel uint32
+
+	// HasInq indicates whether Inq is valid/set. It is only set on reads
+	// from stream endpoints with ReceiveInqOption enabled.
+	HasInq bool
+
+	// Inq is the number of bytes left to read in the receive queue after
+	// the read.
+	Inq int32
+
+	// HasOriginalDstAddress indicates whether OriginalDstAddress is
+	// valid/set. It is only set on datagrams read from endpoints with
+	// ReceiveOriginalDstAddressOption enabled.
+	HasOriginalDstAddress bool
+
+	// OriginalDstAddress is the destination address and port of the
+	// datagram, which isn't the address of the endpoint when it was
+	// received by a transparent endpoint.
+	OriginalDstAddress FullAddress
+}
+
+// A ZeroCopyReader is an Endpoint that can hand out the buffers holding its
+// received data, instead of copying them into buffers provided by the caller.
+// TCP endpoints implement it.
+type ZeroCopyReader interface {
+	Endpoint
+
+	// ReadWithoutCopy consumes up to max bytes of received data and lends
+	// the buffers holding them to the caller. It fails the same way as
+	// Read if no data is available.
+	//
+	// The lent data must not be modified. It keeps occupying the
+	// endpoint's receive buffer, limiting the window advertised to the
+	// peer, until release is called, so callers should release it as soon
+	// as they are done with it. Calling release more than once is
+	// harmless.
+	ReadWithoutCopy(max int) (vv buffer.VectorisedView, release func(), cm ControlMessages, err *Error)
+}
+
+// SockErrOrigin is the origin of a SockError.
+type SockErrOrigin uint8
+
+// The following are the possible origins of a SockError. They have the same
+// meaning as Linux's SO_EE_ORIGIN_* values.
+const (
+	SockErrOriginNone SockErrOrigin = iota
+	SockErrOriginLocal
+	SockErrOriginICMP
+	SockErrOriginICMP6
+	SockErrOriginTimestamping
+)
+
+// TimestampKind is the kind of a transmit timestamp, see TimestampingOption.
+type TimestampKind uint32
+
+// The following are the kinds of transmit timestamps. They have the same
+// meaning as Linux's SCM_TSTAMP_* values.
+const (
+	// TimestampSend is taken once the link endpoint accepted a packet.
+	TimestampSend TimestampKind = iota
+
+	// TimestampSched is taken when a packet is handed to the network
+	// layer.
+	TimestampSched
+
+	// TimestampAck is taken when the peer acknowledged all the data of a
+	// write.
+	TimestampAck
+)
+
+// A SockError is an error held in an endpoint's error queue, together with
+// metadata about the packet that caused it. It is the analogue of Linux's
+// struct sock_extended_err.
+//
+// Transmit timestamps are also reported as SockErrors, with a nil Err.
+type SockError struct {
+	// Err is the error, e.g. ErrConnectionRefused for an ICMP port
+	// unreachable message.
+	Err *Error
+
+	// Origin is where the error comes from.
+	Origin SockErrOrigin
+
+	// Type and Code are the type and code of the ICMP message that
+	// reported the error. They are zero for local errors.
+	Type uint8
+	Code uint8
+
+	// Info holds additional information about the error. For
+	// ErrMessageTooLong, it is the MTU of the path to Dst.
+	Info uint32
+
+	// NetProto is the network protocol of the offending packet.
+	NetProto NetworkProtocolNumber
+
+	// Dst is the destination of the offending packet.
+	Dst FullAddress
+
+	// Offender is the address of the node that sent the ICMP message, e.g.
+	// the router where the packet's TTL ran out.
+	Offender Address
+
+	// NetworkHeader and TransportHeader are the headers of the offending
+	// packet, as quoted by the ICMP message. TransportHeader may be
+	// truncated to 8 bytes.
+	NetworkHeader   buffer.View
+	TransportHeader buffer.View
+
+	// Payload is the payload of the offending packet. For ICMP errors it
+	// only holds as much of it as the ICMP message did. It is empty for
+	// transmit timestamps.
+	Payload buffer.View
+
+	// Timestamp, TimestampKind and Key are only meaningful for transmit
+	// timestamps. Timestamp is the time the event occurred, as reported by
+	// the stack's clock, in nanoseconds. Key identifies the data that was
+	// timestamped: for datagram endpoints, it counts the timestamped
+	// writes, starting from 0; for TCP, it is the offset in the stream of
+	// the last byte of the timestamped data.
+	Timestamp     int64
+	TimestampKind TimestampKind
+	Key           uint32
+}
+
+// sockErrorGob is the form a SockError is encoded in by gob, with its error
+// replaced by its message.
+type sockErrorGob struct {
+	Err             string
+	Origin          SockErrOrigin
+	Type            uint8
+	Code            uint8
+	Info            uint32
+	NetProto        NetworkProtocolNumber
+	Dst             FullAddress
+	Offender        Address
+	NetworkHeader   buffer.View
+	TransportHeader buffer.View
+	Payload         buffer.View
+	Timestamp       int64
+	TimestampKind   TimestampKind
+	Key             uint32
+}
+
+// GobEncode implements gob.GobEncoder.GobEncode, so that SockErrors held in
+// endpoint checkpoints are restored with the same errors.
+func (se SockError) GobEncode() ([]byte, error) {
+	g := sockErrorGob{
+		Origin:          se.Origin,
+		Type:            se.Type,
+		Code:            se.Code,
+		Info:            se.Info,
+		NetProto:        se.NetProto,
+		Dst:             se.Dst,
+		Offender:        se.Offender,
+		NetworkHeader:   se.NetworkHeader,
+		TransportHeader: se.TransportHeader,
+		Payload:         se.Payload,
+		Timestamp:       se.Timestamp,
+		TimestampKind:   se.TimestampKind,
+		Key:             se.Key,
+	}
+	if se.Err != nil {
+		g.Err = se.Err.String()
+	}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(&g); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder.GobDecode.
+func (se *SockError) GobDecode(b []byte) error {
+	var g sockErrorGob
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&g); err != nil {
+		return err
+	}
+	*se = SockError{
+		Origin:          g.Origin,
+		Type:            g.Type,
+		Code:            g.Code,
+		Info:            g.Info,
+		NetProto:        g.NetProto,
+		Dst:             g.Dst,
+		Offender:        g.Offender,
+		NetworkHeader:   g.NetworkHeader,
+		TransportHeader: g.TransportHeader,
+		Payload:         g.Payload,
+		Timestamp:       g.Timestamp,
+		TimestampKind:   g.TimestampKind,
+		Key:             g.Key,
+	}
+	if g.Err != "" {
+		se.Err = ErrorFromMessage(g.Err)
+		if se.Err == nil {
+			return fmt.Errorf("unknown error %q", g.Err)
+		}
+	}
+	return nil
+}
+
+// sockErrorOverhead is the control memory accounted for a SockError in addition
+// to the headers it quotes, so that entries without any aren't free to queue.
+const sockErrorOverhead = 128
+
+// ControlSize returns the control memory se takes while it's queued, see
+// stack.Stack.SetControlMemoryMax: its metadata and the headers it quotes. Its
+// Payload is charged to the receive buffer instead.
+func (se *SockError) ControlSize() int {
+	return sockErrorOverhead + len(se.NetworkHeader) + len(se.TransportHeader)
+}
+
+// An ErrQueueReader is an Endpoint with an error queue, which holds errors
+// reported by ICMP and local transmission errors once RecvErrOption is
+// enabled, as well as the transmit timestamps requested with
+// TimestampingOption. UDP, TCP and ICMP endpoints implement it.
+type ErrQueueReader interface {
+	Endpoint
+
+	// ReadErrQueue dequeues the oldest error in the error queue, like
+	// recvmsg(2) with MSG_ERRQUEUE. It returns ErrWouldBlock if the queue
+	// is empty. The endpoint reports waiter.EventErr while the queue
+	// isn't empty.
+	ReadErrQueue() (*SockError, *Error)
 }
 
 // Endpoint is the interface implemented by transport protocols (e.g., tcp, udp)
@@ -310,6 +714,9 @@ type Endpoint interface {
 	// Write(SlicePayload{data}) returns (n, err), it may retain data[:n], and
 	// the caller should not use data[:n] after Write returns.
 	//
+	// If the Payload is a VectorisedPayload, TCP and UDP endpoints send its
+	// data without gathering it into a single slice.
+	//
 	// Note that unlike io.Writer.Write, it is not an error for Write to
 	// perform a partial write (if n > 0, no error may be returned). Only
 	// stream (TCP) Endpoints may return partial writes, and even then only
@@ -353,7 +760,11 @@ type Endpoint interface {
 	// block if no new connections are available.
 	//
 	// The returned Queue is the wait queue for the newly created endpoint.
-	Accept() (Endpoint, *waiter.Queue, *Error)
+	//
+	// If peerAddr is not nil, it is set to the address of the peer, as
+	// GetRemoteAddress on the new endpoint would return it. This saves a
+	// call for servers that log or filter peers.
+	Accept(peerAddr *FullAddress) (Endpoint, *waiter.Queue, *Error)
 
 	// Bind binds the endpoint to a specific local address and port.
 	// Specifying a NIC is optional.
@@ -389,12 +800,65 @@ type WriteOptions struct {
 
 	// EndOfRecord has the same semantics as Linux's MSG_EOR.
 	EndOfRecord bool
+
+	// TTL, if not zero, is the TTL (or IPv6 hop limit) of the packets sent
+	// by this write, overriding TTLOption. It is only supported by
+	// datagram endpoints.
+	TTL uint8
+
+	// TOS, if HasTOS is set, is the type of service (or IPv6 traffic class)
+	// of the packets sent by this write, overriding IPv4TOSOption and
+	// IPv6TrafficClassOption. It is only supported by datagram endpoints.
+	HasTOS bool
+	TOS    uint8
 }
 
 // ErrorOption is used in GetSockOpt to specify that the last error reported by
-// the endpoint should be cleared and returned.
+// the endpoint should be cleared and returned, like SO_ERROR. Endpoints report
+// the errors of asynchronous failures this way, like a refused connection
+// attempt, a reset, ICMP errors and routes that stopped working, and their
+// Readiness includes waiter.EventErr until it's retrieved.
 type ErrorOption struct{}
 
+// PendingError holds the last error an endpoint reported asynchronously, until
+// it's retrieved with ErrorOption. The zero value holds no error.
+type PendingError struct {
+	mu  sync.Mutex
+	err *Error
+}
+
+// Set makes err the pending error, replacing the one that wasn't retrieved
+// yet, if any.
+func (p *PendingError) Set(err *Error) {
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+}
+
+// Get returns the pending error, or nil if there is none, and clears it.
+func (p *PendingError) Get() *Error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.err
+	p.err = nil
+	return err
+}
+
+// Peek returns the pending error, or nil if there is none, without clearing
+// it.
+func (p *PendingError) Peek() *Error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Pending returns whether there is a pending error.
+func (p *PendingError) Pending() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err != nil
+}
+
 // SendBufferSizeOption is used by SetSockOpt/GetSockOpt to specify the send
 // buffer size option.
 type SendBufferSizeOption int
@@ -403,6 +867,19 @@ type SendBufferSizeOption int
 // receive buffer size option.
 type ReceiveBufferSizeOption int
 
+// ClampBufferSize returns size limited to the range [min, max], the bounds a
+// protocol sets on the sizes given with SendBufferSizeOption and
+// ReceiveBufferSizeOption.
+func ClampBufferSize(size, min, max int) int {
+	if size < min {
+		return min
+	}
+	if size > max {
+		return max
+	}
+	return size
+}
+
 // SendQueueSizeOption is used in GetSockOpt to specify that the number of
 // unread bytes in the output buffer should be returned.
 type SendQueueSizeOption int
@@ -411,6 +888,12 @@ type SendQueueSizeOption int
 // unread bytes in the input buffer should be returned.
 type ReceiveQueueSizeOption int
 
+// SendQueueUnsentSizeOption is used in GetSockOpt to specify that the number
+// of bytes in the output buffer that weren't sent yet should be returned,
+// unlike SendQueueSizeOption which also counts the bytes sent but not
+// acknowledged, like Linux's SIOCOUTQNSD.
+type SendQueueUnsentSizeOption int
+
 // V6OnlyOption is used by SetSockOpt/GetSockOpt to specify whether an IPv6
 // socket is to be restricted to sending and receiving IPv6 packets only.
 type V6OnlyOption int
@@ -432,7 +915,11 @@ type ReuseAddressOption int
 // to be bound to an identical socket address.
 type ReusePortOption int
 
-// QuickAckOption is stubbed out in SetSockOpt/GetSockOpt.
+// QuickAckOption is used by SetSockOpt/GetSockOpt to have the data received by
+// a TCP endpoint acknowledged right away instead of with a delay, like Linux's
+// TCP_QUICKACK. As there, enabling it only lasts for a number of segments,
+// after which acknowledgments are delayed again, and it reads as enabled
+// whenever they aren't delayed.
 type QuickAckOption int
 
 // PasscredOption is used by SetSockOpt/GetSockOpt to specify whether
@@ -467,6 +954,120 @@ type KeepaliveIntervalOption time.Duration
 // closed.
 type KeepaliveCountOption int
 
+// MPTCPOption is used by SetSockOpt/GetSockOpt to specify whether a TCP
+// endpoint offers Multipath TCP (RFC 8684) when connecting, or accepts it when
+// listening. It must be set before Connect or Listen.
+type MPTCPOption int
+
+// MPTCPInfoOption is used by GetSockOpt to expose the Multipath TCP state of a
+// connected TCP endpoint.
+type MPTCPInfoOption struct {
+	// Enabled is true if Multipath TCP was negotiated and the connection
+	// didn't fall back to regular TCP since.
+	Enabled bool
+
+	// LocalKey and RemoteKey are the keys exchanged during the handshake.
+	LocalKey  uint64
+	RemoteKey uint64
+
+	// LocalToken and RemoteToken identify the connection to the local
+	// stack and to the peer respectively.
+	LocalToken  uint32
+	RemoteToken uint32
+}
+
+// TCPListenLimitOption is used by SetSockOpt/GetSockOpt to limit the
+// connection attempts handled by a listening TCP endpoint, to protect it from
+// SYN floods. SYNs over the limits are answered with SYN cookies, so that
+// they don't hold any state, or dropped if Drop is set. The zero value
+// disables the limits.
+type TCPListenLimitOption struct {
+	// Rate and Burst limit the SYNs accepted as a token bucket: Burst SYNs
+	// are accepted at once, and then Rate per second. A zero Rate disables
+	// the limit.
+	Rate  float64
+	Burst int
+
+	// MaxPendingPerSource is the maximum number of connections from a
+	// single remote address in SYN-RCVD state. Zero disables the limit.
+	MaxPendingPerSource int
+
+	// Drop makes SYNs over the limits be dropped rather than answered with
+	// SYN cookies.
+	Drop bool
+}
+
+// TTLOption is used by SetSockOpt/GetSockOpt to control the TTL (or IPv6 hop
+// limit) of unicast packets sent by an endpoint. Zero means the route's
+// default TTL.
+type TTLOption uint8
+
+// MinTTLOption is used by SetSockOpt/GetSockOpt to control the minimum TTL
+// (or IPv6 hop limit) of the packets accepted by an endpoint. Packets with a
+// lower TTL are dropped. Zero disables the check.
+//
+// Together with a TTLOption of 255, it implements the Generalized TTL Security
+// Mechanism of RFC 5082: peers send packets with a TTL of 255 and accept only
+// packets with a TTL of 255, or more generally 255 minus the number of hops to
+// the peer, which remote attackers can't forge.
+type MinTTLOption uint8
+
+// IPv4TOSOption is used by SetSockOpt/GetSockOpt to control the type of
+// service of the IPv4 packets sent by an endpoint, like Linux's IP_TOS. Its
+// upper six bits are the DSCP.
+type IPv4TOSOption uint8
+
+// IPv6TrafficClassOption is used by SetSockOpt/GetSockOpt to control the
+// traffic class of the IPv6 packets sent by an endpoint, like Linux's
+// IPV6_TCLASS.
+type IPv6TrafficClassOption uint8
+
+// ReceiveTOSOption is used by SetSockOpt/GetSockOpt to specify whether the
+// type of service of received IPv4 packets is returned in ControlMessages,
+// like Linux's IP_RECVTOS.
+type ReceiveTOSOption bool
+
+// ReceiveTClassOption is used by SetSockOpt/GetSockOpt to specify whether the
+// traffic class of received IPv6 packets is returned in ControlMessages, like
+// Linux's IPV6_RECVTCLASS.
+type ReceiveTClassOption bool
+
+// ReceiveInqOption is used by SetSockOpt/GetSockOpt to specify whether the
+// number of bytes left in the receive queue is returned in ControlMessages
+// after each read of a stream endpoint, like Linux's TCP_INQ.
+type ReceiveInqOption bool
+
+// IPv6FlowLabelOption is used by SetSockOpt/GetSockOpt to control the flow
+// label of the IPv6 packets sent by an endpoint. Zero means the label the
+// stack generates for each flow, if it's configured to.
+type IPv6FlowLabelOption uint32
+
+// ReceiveFlowLabelOption is used by SetSockOpt/GetSockOpt to specify whether
+// the flow label of received IPv6 packets is returned in ControlMessages, like
+// Linux's IPV6_FLOWINFO.
+type ReceiveFlowLabelOption bool
+
+// TransparentOption is used by SetSockOpt/GetSockOpt to make an endpoint
+// transparent, like Linux's IP_TRANSPARENT. Transparent endpoints may bind to
+// addresses that aren't local, and receive the packets destined to addresses
+// that aren't local on the NICs in transparent mode, see
+// stack.Stack.SetTransparent, which lets them act as transparent proxies. The
+// local address of the TCP connections they accept is the original
+// destination of the connection.
+type TransparentOption bool
+
+// ReceiveOriginalDstAddressOption is used by SetSockOpt/GetSockOpt to specify
+// whether the destination address and port of received datagrams is returned
+// in ControlMessages, like Linux's IP_RECVORIGDSTADDR.
+type ReceiveOriginalDstAddressOption bool
+
+// OriginalDestinationOption is used by GetSockOpt to get the destination
+// address and port a connection was sent to before a destination NAT rule
+// redirected it to the endpoint, like Linux's SO_ORIGINAL_DST, see
+// stack.Stack.SetNATRules. It is only available on connected endpoints, and
+// getting it fails with ErrNoSuchFile if the connection wasn't redirected.
+type OriginalDestinationOption FullAddress
+
 // MulticastTTLOption is used by SetSockOpt/GetSockOpt to control the default
 // TTL value for multicast messages. The default is 1.
 type MulticastTTLOption uint8
@@ -508,6 +1109,60 @@ type OutOfBandInlineOption int
 // datagram sockets are allowed to send packets to a broadcast address.
 type BroadcastOption int
 
+// RecvErrOption is used by SetSockOpt/GetSockOpt to specify whether errors
+// are queued on the endpoint's error queue, see ErrQueueReader. It has the
+// same semantics as Linux's IP_RECVERR.
+type RecvErrOption int
+
+// TimestampingOption is used by SetSockOpt/GetSockOpt to request transmit
+// timestamps, which are reported through the endpoint's error queue (see
+// ErrQueueReader). It is a set of the flags below, and has similar semantics
+// to Linux's SO_TIMESTAMPING.
+//
+// Retransmissions aren't timestamped.
+type TimestampingOption int
+
+// The following are the flags of TimestampingOption.
+const (
+	// TimestampingTxSched requests TimestampSched timestamps.
+	TimestampingTxSched TimestampingOption = 1 << iota
+
+	// TimestampingTxSoftware requests TimestampSend timestamps.
+	TimestampingTxSoftware
+
+	// TimestampingTxAck requests TimestampAck timestamps. Only TCP
+	// endpoints report them.
+	TimestampingTxAck
+)
+
+// VRFOption is used by SetSockOpt/GetSockOpt to specify the VRF of an
+// endpoint. It can only be changed before the endpoint is bound or connected.
+type VRFOption VRFID
+
+// ICMPFilterOption is used by SetSockOpt/GetSockOpt to select the ICMP
+// messages raw ICMP endpoints receive by type, like Linux's ICMP_FILTER and
+// ICMP6_FILTER. The messages whose type is blocked aren't received. The zero
+// value blocks none.
+type ICMPFilterOption struct {
+	// Blocked has the bit of each blocked type set.
+	Blocked [8]uint32
+}
+
+// Block blocks the messages of type typ.
+func (f *ICMPFilterOption) Block(typ uint8) {
+	f.Blocked[typ/32] |= 1 << (typ % 32)
+}
+
+// Pass unblocks the messages of type typ.
+func (f *ICMPFilterOption) Pass(typ uint8) {
+	f.Blocked[typ/32] &^= 1 << (typ % 32)
+}
+
+// IsBlocked returns whether the messages of type typ are blocked.
+func (f *ICMPFilterOption) IsBlocked(typ uint8) bool {
+	return f.Blocked[typ/32]&(1<<(typ%32)) != 0
+}
+
 // Route is a row in the routing table. It specifies through which NIC (and
 // gateway) sets of packets should be routed. A row is considered viable if the
 // masked target address matches the destination adddress in the row.
@@ -525,6 +1180,80 @@ type Route struct {
 
 	// NIC is the id of the nic to be used if this row is viable.
 	NIC NICID
+
+	// Type is the type of the route. Routes of types other than
+	// RouteUnicast don't go through a NIC: Gateway and NIC are ignored.
+	Type RouteType
+
+	// Weight is the share of flows sent through this route when several
+	// unicast routes have the same Destination and Mask, relative to the
+	// weights of the others. Such routes form a multipath route whose
+	// next hop is selected by hashing the flow of each packet. Zero means
+	// a weight of 1.
+	Weight int
+
+	// The following fields override the defaults of the packets and
+	// connections going through the route, like the metrics of "ip route".
+	// They are ignored when they are zero.
+
+	// MTU lowers the MTU of the route below the one of its NIC, like
+	// "mtu". It includes the network header. If LockMTU is set, path MTU
+	// discovery doesn't lower it further, like "mtu lock".
+	MTU     uint32
+	LockMTU bool
+
+	// AdvMSS is the MSS advertised by the TCP connections through the
+	// route, instead of the one derived from its MTU, like "advmss".
+	AdvMSS uint16
+
+	// InitCwnd is the initial congestion window, in segments, of the TCP
+	// connections through the route, like "initcwnd".
+	InitCwnd int
+
+	// HopLimit is the TTL, or IPv6 hop limit, of the packets sent through
+	// the route that don't set one, like "hoplimit".
+	HopLimit uint8
+}
+
+// RouteType is the type of a route, which determines what happens to the
+// packets it matches.
+type RouteType int
+
+// The types of routes.
+const (
+	// RouteUnicast routes send packets through their NIC, to their gateway
+	// if they have one.
+	RouteUnicast RouteType = iota
+
+	// RouteBlackhole routes silently drop the packets they forward. Local
+	// senders are told there's no route, with ErrNoRoute.
+	RouteBlackhole
+
+	// RouteUnreachable routes reject packets as unreachable. Forwarded
+	// packets are answered with an ICMP host unreachable error, and local
+	// senders get ErrHostUnreachable.
+	RouteUnreachable
+
+	// RouteProhibit routes reject packets as administratively prohibited.
+	// Forwarded packets are answered with an ICMP communication
+	// administratively prohibited error, and local senders get
+	// ErrProhibited.
+	RouteProhibit
+)
+
+var routeTypeNames = [...]string{
+	RouteUnicast:     "unicast",
+	RouteBlackhole:   "blackhole",
+	RouteUnreachable: "unreachable",
+	RouteProhibit:    "prohibit",
+}
+
+// String implements the fmt.Stringer interface.
+func (t RouteType) String() string {
+	if t >= 0 && int(t) < len(routeTypeNames) {
+		return routeTypeNames[t]
+	}
+	return fmt.Sprintf("RouteType(%d)", int(t))
 }
 
 // Match determines if r is viable for the given destination address.
@@ -557,9 +1286,27 @@ type TransportProtocolNumber uint32
 // NetworkProtocolNumber is the number of a network protocol.
 type NetworkProtocolNumber uint32
 
+// statCounterShards is the number of shards of a StatCounter. It must be a
+// power of two.
+const statCounterShards = 16
+
+// cacheLineSize is the assumed size of a CPU cache line.
+const cacheLineSize = 64
+
+// A statCounterShard holds part of the count of a StatCounter, padded so that
+// shards updated by different CPUs don't share a cache line.
+type statCounterShard struct {
+	count uint64
+	_     [cacheLineSize - 8]byte
+}
+
 // A StatCounter keeps track of a statistic.
+//
+// The count is spread over shards indexed by the P (see package runtime) of the
+// updating goroutine, so that packets processed concurrently on different
+// CPUs don't contend on a single cache line. Reading the value sums the shards.
 type StatCounter struct {
-	count uint64
+	shards [statCounterShards]statCounterShard
 }
 
 // Increment adds one to the counter.
@@ -569,18 +1316,28 @@ func (s *StatCounter) Increment() {
 
 // Value returns the current value of the counter.
 func (s *StatCounter) Value() uint64 {
-	return atomic.LoadUint64(&s.count)
+	var v uint64
+	for i := range s.shards {
+		v += atomic.LoadUint64(&s.shards[i].count)
+	}
+	return v
 }
 
 // IncrementBy increments the counter by v.
 func (s *StatCounter) IncrementBy(v uint64) {
-	atomic.AddUint64(&s.count, v)
+	atomic.AddUint64(&s.shards[statShard()].count, v)
 }
 
 func (s *StatCounter) String() string {
 	return strconv.FormatUint(s.Value(), 10)
 }
 
+// MarshalJSON implements json.Marshaler, so that counters are marshaled as
+// their value.
+func (s *StatCounter) MarshalJSON() ([]byte, error) {
+	return strconv.AppendUint(nil, s.Value(), 10), nil
+}
+
 // IPStats collects IP-specific stats (both v4 and v6).
 type IPStats struct {
 	// PacketsReceived is the total number of IP packets received from the link
@@ -601,6 +1358,131 @@ type IPStats struct {
 	// OutgoingPacketErrors is the total number of IP packets which failed
 	// to write to a link-layer endpoint.
 	OutgoingPacketErrors *StatCounter
+
+	// MalformedPacketsReceived is the total number of IP packets dropped
+	// because their header was invalid.
+	MalformedPacketsReceived *StatCounter
+
+	// PacketsForwarded is the total number of IP packets received for
+	// another host and forwarded to it.
+	PacketsForwarded *StatCounter
+
+	// DeadNextHops is the total number of times the gateway of a multipath
+	// route was left out of it because its link address couldn't be
+	// resolved.
+	DeadNextHops *StatCounter
+
+	// MulticastPacketsForwarded is the total number of copies of IP
+	// multicast packets forwarded as the multicast forwarding cache says.
+	MulticastPacketsForwarded *StatCounter
+
+	// MulticastNoRoute is the total number of IP multicast packets not
+	// forwarded because the multicast forwarding cache has no route for
+	// them.
+	MulticastNoRoute *StatCounter
+
+	// MulticastWrongInput is the total number of IP multicast packets not
+	// forwarded because they arrived on another NIC than the input NIC of
+	// their multicast route.
+	MulticastWrongInput *StatCounter
+
+	// FragmentsReceived is the total number of IP fragments received.
+	FragmentsReceived *StatCounter
+
+	// PacketsReassembled is the total number of IP packets successfully
+	// reassembled from fragments.
+	PacketsReassembled *StatCounter
+}
+
+// ICMPv4PacketStats enumerates counts for the ICMPv4 message types.
+type ICMPv4PacketStats struct {
+	// Echo is the number of ICMPv4 echo requests.
+	Echo *StatCounter
+
+	// EchoReply is the number of ICMPv4 echo replies.
+	EchoReply *StatCounter
+
+	// DstUnreachable is the number of ICMPv4 destination unreachable
+	// messages.
+	DstUnreachable *StatCounter
+
+	// TimeExceeded is the number of ICMPv4 time exceeded messages.
+	TimeExceeded *StatCounter
+
+	// Redirect is the number of ICMPv4 redirect messages.
+	Redirect *StatCounter
+
+	// Other is the number of ICMPv4 messages of any other type.
+	Other *StatCounter
+}
+
+// ICMPv6PacketStats enumerates counts for the ICMPv6 message types.
+type ICMPv6PacketStats struct {
+	// EchoRequest is the number of ICMPv6 echo requests.
+	EchoRequest *StatCounter
+
+	// EchoReply is the number of ICMPv6 echo replies.
+	EchoReply *StatCounter
+
+	// DstUnreachable is the number of ICMPv6 destination unreachable
+	// messages.
+	DstUnreachable *StatCounter
+
+	// PacketTooBig is the number of ICMPv6 packet too big messages.
+	PacketTooBig *StatCounter
+
+	// TimeExceeded is the number of ICMPv6 time exceeded messages.
+	TimeExceeded *StatCounter
+
+	// NeighborSolicit is the number of ICMPv6 neighbor solicitations.
+	NeighborSolicit *StatCounter
+
+	// NeighborAdvert is the number of ICMPv6 neighbor advertisements.
+	NeighborAdvert *StatCounter
+
+	// Redirect is the number of ICMPv6 redirect messages.
+	Redirect *StatCounter
+
+	// NodeInfoQuery is the number of ICMPv6 node information queries.
+	NodeInfoQuery *StatCounter
+
+	// NodeInfoReply is the number of ICMPv6 node information replies.
+	NodeInfoReply *StatCounter
+
+	// Other is the number of ICMPv6 messages of any other type.
+	Other *StatCounter
+}
+
+// ICMPStats collects ICMP-specific stats (both v4 and v6).
+type ICMPStats struct {
+	// V4PacketsSent counts the ICMPv4 messages sent, by type.
+	V4PacketsSent ICMPv4PacketStats
+
+	// V4PacketsReceived counts the ICMPv4 messages received, by type.
+	V4PacketsReceived ICMPv4PacketStats
+
+	// V6PacketsSent counts the ICMPv6 messages sent, by type.
+	V6PacketsSent ICMPv6PacketStats
+
+	// V6PacketsReceived counts the ICMPv6 messages received, by type.
+	V6PacketsReceived ICMPv6PacketStats
+
+	// OutgoingPacketErrors is the number of ICMP messages that could not
+	// be sent.
+	OutgoingPacketErrors *StatCounter
+
+	// RateLimited is the number of ICMP messages that were not sent
+	// because of the ICMP rate limit of the stack.
+	RateLimited *StatCounter
+
+	// InvalidPacketsReceived is the number of ICMP messages received that
+	// were too short or had an invalid checksum.
+	InvalidPacketsReceived *StatCounter
+
+	// RedirectsIgnored is the number of ICMP redirect messages received
+	// that were ignored, because they were invalid or redirects aren't
+	// accepted.
+	RedirectsIgnored *StatCounter
 }
 
 // TCPStats collects TCP-specific stats.
@@ -655,6 +1537,24 @@ type TCPStats struct {
 
 	// Timeouts is the number of times the RTO expired.
 	Timeouts *StatCounter
+
+	// Reordering is the number of times segments were detected to be
+	// delivered out of order, through SACK or D-SACK.
+	Reordering *StatCounter
+
+	// SpuriousRetransmits is the number of fast retransmits that D-SACKs
+	// showed to be spurious.
+	SpuriousRetransmits *StatCounter
+
+	// ListenLimitedSyns is the number of SYNs received by listening
+	// endpoints over their TCPListenLimitOption, which were answered with
+	// SYN cookies or dropped.
+	ListenLimitedSyns *StatCounter
+
+	// ListenOverflowAckDrops is the number of ACKs completing a handshake
+	// with a SYN cookie that were dropped because the accept queue of the
+	// listening endpoint was full.
+	ListenOverflowAckDrops *StatCounter
 }
 
 // UDPStats collects UDP-specific stats.
@@ -663,6 +1563,10 @@ type UDPStats struct {
 	// HandlePacket.
 	PacketsReceived *StatCounter
 
+	// PacketsDecapsulated is the number of UDP datagrams consumed by the
+	// decapsulation handler of the endpoint they were received by.
+	PacketsDecapsulated *StatCounter
+
 	// UnknownPortErrors is the number of incoming UDP datagrams dropped
 	// because they did not have a known destination port.
 	UnknownPortErrors *StatCounter
@@ -679,6 +1583,160 @@ type UDPStats struct {
 	PacketsSent *StatCounter
 }
 
+// DropReason is the reason why the stack dropped a packet.
+type DropReason int
+
+// The reasons why the stack drops packets.
+const (
+	// DropMalformed is for packets with an invalid or truncated header.
+	DropMalformed DropReason = iota
+
+	// DropUnknownProtocol is for packets of an unsupported network or
+	// transport protocol.
+	DropUnknownProtocol
+
+	// DropBadChecksum is for packets whose checksum doesn't match their
+	// contents.
+	DropBadChecksum
+
+	// DropInvalidAddress is for packets addressed to none of the stack's
+	// addresses, when they aren't forwarded.
+	DropInvalidAddress
+
+	// DropNoRoute is for packets that must be forwarded but have no route
+	// to their destination.
+	DropNoRoute
+
+	// DropNoEndpoint is for packets that no transport endpoint was bound
+	// to receive.
+	DropNoEndpoint
+
+	// DropQueueFull is for packets that didn't fit in a full queue.
+	DropQueueFull
+
+	// DropFilter is for packets rejected by a packet filter.
+	DropFilter
+
+	// DropTTLExpired is for packets that must be forwarded but have
+	// exhausted their TTL or hop limit.
+	DropTTLExpired
+
+	// DropNetworkDown is for packets received by, or routed through, a NIC
+	// that is down.
+	DropNetworkDown
+
+	// DropWriteError is for outgoing packets that the link layer failed to
+	// write.
+	DropWriteError
+
+	// DropMinTTL is for packets whose TTL or hop limit is below the minimum
+	// accepted by their transport endpoint, see MinTTLOption.
+	DropMinTTL
+
+	// DropResolutionFailed is for outgoing packets queued while the link
+	// address of their next hop was resolved, when the resolution failed.
+	DropResolutionFailed
+)
+
+var dropReasonNames = [...]string{
+	DropMalformed:        "malformed",
+	DropUnknownProtocol:  "unknown protocol",
+	DropBadChecksum:      "bad checksum",
+	DropInvalidAddress:   "invalid address",
+	DropNoRoute:          "no route",
+	DropNoEndpoint:       "no endpoint",
+	DropQueueFull:        "queue full",
+	DropFilter:           "filter",
+	DropTTLExpired:       "TTL expired",
+	DropNetworkDown:      "network down",
+	DropWriteError:       "write error",
+	DropMinTTL:           "TTL below minimum",
+	DropResolutionFailed: "resolution failed",
+}
+
+// String implements the fmt.Stringer interface.
+func (r DropReason) String() string {
+	if r >= 0 && int(r) < len(dropReasonNames) {
+		return dropReasonNames[r]
+	}
+	return fmt.Sprintf("DropReason(%d)", int(r))
+}
+
+// DropStats collects the number of packets dropped by the stack, by reason.
+type DropStats struct {
+	// Malformed is the number of packets dropped for DropMalformed.
+	Malformed *StatCounter
+
+	// UnknownProtocol is the number of packets dropped for
+	// DropUnknownProtocol.
+	UnknownProtocol *StatCounter
+
+	// BadChecksum is the number of packets dropped for DropBadChecksum.
+	BadChecksum *StatCounter
+
+	// InvalidAddress is the number of packets dropped for
+	// DropInvalidAddress.
+	InvalidAddress *StatCounter
+
+	// NoRoute is the number of packets dropped for DropNoRoute.
+	NoRoute *StatCounter
+
+	// NoEndpoint is the number of packets dropped for DropNoEndpoint.
+	NoEndpoint *StatCounter
+
+	// QueueFull is the number of packets dropped for DropQueueFull.
+	QueueFull *StatCounter
+
+	// Filter is the number of packets dropped for DropFilter.
+	Filter *StatCounter
+
+	// TTLExpired is the number of packets dropped for DropTTLExpired.
+	TTLExpired *StatCounter
+
+	// NetworkDown is the number of packets dropped for DropNetworkDown.
+	NetworkDown *StatCounter
+
+	// WriteError is the number of packets dropped for DropWriteError.
+	WriteError *StatCounter
+
+	// ResolutionFailed is the number of packets dropped for
+	// DropResolutionFailed.
+	ResolutionFailed *StatCounter
+}
+
+// Counter returns the counter of the packets dropped for reason r, or nil if r
+// isn't a known reason.
+func (s DropStats) Counter(r DropReason) *StatCounter {
+	switch r {
+	case DropMalformed:
+		return s.Malformed
+	case DropUnknownProtocol:
+		return s.UnknownProtocol
+	case DropBadChecksum:
+		return s.BadChecksum
+	case DropInvalidAddress:
+		return s.InvalidAddress
+	case DropNoRoute:
+		return s.NoRoute
+	case DropNoEndpoint:
+		return s.NoEndpoint
+	case DropQueueFull:
+		return s.QueueFull
+	case DropFilter:
+		return s.Filter
+	case DropTTLExpired:
+		return s.TTLExpired
+	case DropNetworkDown:
+		return s.NetworkDown
+	case DropWriteError:
+		return s.WriteError
+	case DropResolutionFailed:
+		return s.ResolutionFailed
+	default:
+		return nil
+	}
+}
+
 // Stats holds statistics about the networking stack.
 //
 // All fields are optional.
@@ -691,17 +1749,33 @@ type Stats struct {
 	// that were deemed malformed.
 	MalformedRcvdPackets *StatCounter
 
+	// MalformedRcvdFrames is the number of frames received by link
+	// endpoints that were deemed malformed before they could be handed to
+	// a network protocol.
+	MalformedRcvdFrames *StatCounter
+
 	// DroppedPackets is the number of packets dropped due to full queues.
 	DroppedPackets *StatCounter
 
+	// ControlMemoryErrors is the number of errors and transmit timestamps
+	// that weren't queued because their endpoint had used up its control
+	// memory.
+	ControlMemoryErrors *StatCounter
+
 	// IP breaks out IP-specific stats (both v4 and v6).
 	IP IPStats
 
+	// ICMP breaks out ICMP-specific stats (both v4 and v6).
+	ICMP ICMPStats
+
 	// TCP breaks out TCP-specific stats.
 	TCP TCPStats
 
 	// UDP breaks out UDP-specific stats.
 	UDP UDPStats
+
+	// Drops breaks out the packets dropped by the stack by reason.
+	Drops DropStats
 }
 
 func fillIn(v reflect.Value) {
@@ -726,6 +1800,54 @@ func (s Stats) FillIn() Stats {
 	return s
 }
 
+// Record increments the counter of the ICMPv4 message type typ in s. The types
+// are those of RFC 792; package header can't be used here as it depends on
+// this package.
+func (s ICMPv4PacketStats) Record(typ uint8) {
+	switch typ {
+	case 8: // Echo
+		s.Echo.Increment()
+	case 0: // Echo Reply
+		s.EchoReply.Increment()
+	case 3: // Destination Unreachable
+		s.DstUnreachable.Increment()
+	case 11: // Time Exceeded
+		s.TimeExceeded.Increment()
+	case 5: // Redirect
+		s.Redirect.Increment()
+	default:
+		s.Other.Increment()
+	}
+}
+
+// Record increments the counter of the ICMPv6 message type typ in s.
+func (s ICMPv6PacketStats) Record(typ uint8) {
+	switch typ {
+	case 128: // Echo Request
+		s.EchoRequest.Increment()
+	case 129: // Echo Reply
+		s.EchoReply.Increment()
+	case 1: // Destination Unreachable
+		s.DstUnreachable.Increment()
+	case 2: // Packet Too Big
+		s.PacketTooBig.Increment()
+	case 3: // Time Exceeded
+		s.TimeExceeded.Increment()
+	case 135: // Neighbor Solicitation
+		s.NeighborSolicit.Increment()
+	case 136: // Neighbor Advertisement
+		s.NeighborAdvert.Increment()
+	case 137: // Redirect
+		s.Redirect.Increment()
+	case 139: // Node Information Query
+		s.NodeInfoQuery.Increment()
+	case 140: // Node Information Reply
+		s.NodeInfoReply.Increment()
+	default:
+		s.Other.Increment()
+	}
+}
+
 // String implements the fmt.Stringer interface.
 func (a Address) String() string {
 	switch len(a) {
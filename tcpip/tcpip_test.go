@@ -15,9 +15,11 @@
 package tcpip
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -215,3 +217,263 @@ func TestStatsString(t *testing.T) {
 		t.Logf(`got = fmt.Sprintf("%%+v", Stats{}.FillIn()) = %q`, got)
 	}
 }
+
+func TestVectorPayload(t *testing.T) {
+	p := VectorPayload{[]byte("ab"), nil, []byte("cde"), []byte("f")}
+	if got, want := p.Size(), 6; got != want {
+		t.Fatalf("got Size() = %d, want %d", got, want)
+	}
+
+	for _, tc := range []struct {
+		size  int
+		want  string
+		views int
+	}{
+		{size: 0, want: "", views: 0},
+		{size: 1, want: "a", views: 1},
+		{size: 4, want: "abcd", views: 2},
+		{size: 6, want: "abcdef", views: 3},
+		{size: 10, want: "abcdef", views: 3},
+	} {
+		vv, err := p.GetVectorised(tc.size)
+		if err != nil {
+			t.Fatalf("GetVectorised(%d) failed: %v", tc.size, err)
+		}
+		if got := string(vv.ToView()); got != tc.want {
+			t.Errorf("got GetVectorised(%d) = %q, want %q", tc.size, got, tc.want)
+		}
+		if got := len(vv.Views()); got != tc.views {
+			t.Errorf("got %d views from GetVectorised(%d), want %d", got, tc.size, tc.views)
+		}
+		b, err := p.Get(tc.size)
+		if err != nil {
+			t.Fatalf("Get(%d) failed: %v", tc.size, err)
+		}
+		if got := string(b); got != tc.want {
+			t.Errorf("got Get(%d) = %q, want %q", tc.size, got, tc.want)
+		}
+	}
+}
+
+func TestReaderPayload(t *testing.T) {
+	p := &ReaderPayload{R: bytes.NewReader([]byte("abcdef")), N: 5}
+	b, err := p.Get(3)
+	if err != nil {
+		t.Fatalf("Get(3) failed: %v", err)
+	}
+	if got, want := string(b), "abc"; got != want {
+		t.Errorf("got Get(3) = %q, want %q", got, want)
+	}
+	if got, want := p.Size(), 2; got != want {
+		t.Errorf("got Size() = %d after Get, want %d", got, want)
+	}
+	if b, err = p.Get(10); err != nil {
+		t.Fatalf("Get(10) failed: %v", err)
+	}
+	if got, want := string(b), "de"; got != want {
+		t.Errorf("got Get(10) = %q, want %q", got, want)
+	}
+
+	p = &ReaderPayload{R: bytes.NewReader([]byte("ab")), N: 3}
+	if _, err := p.Get(3); err != ErrBadBuffer {
+		t.Errorf("got Get(3) from a short reader = %v, want %v", err, ErrBadBuffer)
+	}
+}
+
+func TestStatCounter(t *testing.T) {
+	const goroutines, increments = 8, 1000
+	var s StatCounter
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				s.Increment()
+			}
+			s.IncrementBy(increments)
+		}()
+	}
+	wg.Wait()
+	if got, want := s.Value(), uint64(2*goroutines*increments); got != want {
+		t.Errorf("got s.Value() = %d, want %d", got, want)
+	}
+	if got, want := s.String(), fmt.Sprint(2*goroutines*increments); got != want {
+		t.Errorf("got s.String() = %q, want %q", got, want)
+	}
+}
+
+func BenchmarkStatCounterParallel(b *testing.B) {
+	var s StatCounter
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.Increment()
+		}
+	})
+}
+
+func TestSockOptTable(t *testing.T) {
+	type customOption struct {
+		A, B int
+	}
+
+	var (
+		tbl      SockOptTable
+		loop     bool
+		reuse    bool
+		sndBuf   int
+		custom   customOption
+		endpoint Endpoint
+	)
+	tbl.RegisterBool(MulticastLoopOption(false), func(Endpoint) (bool, *Error) {
+		return loop, nil
+	}, func(_ Endpoint, v bool) *Error {
+		loop = v
+		return nil
+	})
+	tbl.RegisterBool(ReusePortOption(0), func(Endpoint) (bool, *Error) {
+		return reuse, nil
+	}, func(_ Endpoint, v bool) *Error {
+		reuse = v
+		return nil
+	})
+	tbl.RegisterInt(SendBufferSizeOption(0), func(Endpoint) (int, *Error) {
+		return sndBuf, nil
+	}, nil)
+	tbl.Register(customOption{}, func(_ Endpoint, opt interface{}) *Error {
+		*opt.(*customOption) = custom
+		return nil
+	}, func(_ Endpoint, opt interface{}) *Error {
+		custom = opt.(customOption)
+		return nil
+	})
+
+	if err := tbl.SetSockOpt(endpoint, MulticastLoopOption(true)); err != nil || !loop {
+		t.Errorf("got SetSockOpt(MulticastLoopOption(true)) = %v, loop = %t, want nil, true", err, loop)
+	}
+	var lo MulticastLoopOption
+	if err := tbl.GetSockOpt(endpoint, &lo); err != nil || !bool(lo) {
+		t.Errorf("got GetSockOpt(*MulticastLoopOption) = %v, %t, want nil, true", err, lo)
+	}
+
+	if err := tbl.SetSockOpt(endpoint, ReusePortOption(5)); err != nil || !reuse {
+		t.Errorf("got SetSockOpt(ReusePortOption(5)) = %v, reuse = %t, want nil, true", err, reuse)
+	}
+	var ro ReusePortOption
+	if err := tbl.GetSockOpt(endpoint, &ro); err != nil || ro != 1 {
+		t.Errorf("got GetSockOpt(*ReusePortOption) = %v, %d, want nil, 1", err, ro)
+	}
+
+	sndBuf = 1234
+	var so SendBufferSizeOption
+	if err := tbl.GetSockOpt(endpoint, &so); err != nil || so != 1234 {
+		t.Errorf("got GetSockOpt(*SendBufferSizeOption) = %v, %d, want nil, 1234", err, so)
+	}
+	if err := tbl.SetSockOpt(endpoint, SendBufferSizeOption(1)); err != ErrUnknownProtocolOption {
+		t.Errorf("got SetSockOpt(SendBufferSizeOption(1)) = %v on a read-only option, want %v", err, ErrUnknownProtocolOption)
+	}
+
+	want := customOption{A: 1, B: 2}
+	if err := tbl.SetSockOpt(endpoint, want); err != nil {
+		t.Errorf("SetSockOpt(%+v) failed: %v", want, err)
+	}
+	var got customOption
+	if err := tbl.GetSockOpt(endpoint, &got); err != nil || got != want {
+		t.Errorf("got GetSockOpt(*customOption) = %v, %+v, want nil, %+v", err, got, want)
+	}
+
+	// Values of unregistered types and non-pointers are rejected.
+	if err := tbl.SetSockOpt(endpoint, DelayOption(1)); err != ErrUnknownProtocolOption {
+		t.Errorf("got SetSockOpt(DelayOption(1)) = %v, want %v", err, ErrUnknownProtocolOption)
+	}
+	if err := tbl.GetSockOpt(endpoint, so); err != ErrUnknownProtocolOption {
+		t.Errorf("got GetSockOpt(SendBufferSizeOption) = %v, want %v", err, ErrUnknownProtocolOption)
+	}
+}
+
+// storingEndpoint is an endpoint holding stored options.
+type storingEndpoint struct {
+	Endpoint
+	opts SockOptStore
+}
+
+func (e *storingEndpoint) SockOptStore() *SockOptStore {
+	return &e.opts
+}
+
+func TestSockOptTableStored(t *testing.T) {
+	type markOption uint32
+
+	var tbl SockOptTable
+	tbl.RegisterStored(markOption(7))
+
+	ep1, ep2 := &storingEndpoint{}, &storingEndpoint{}
+	if err := tbl.SetSockOpt(ep1, markOption(42)); err != nil {
+		t.Fatalf("SetSockOpt(markOption(42)) failed: %v", err)
+	}
+	var m markOption
+	if err := tbl.GetSockOpt(ep1, &m); err != nil || m != 42 {
+		t.Errorf("got GetSockOpt(*markOption) = %v, %d, want nil, 42", err, m)
+	}
+	// Each endpoint has its own value, which defaults to the registered
+	// one.
+	if err := tbl.GetSockOpt(ep2, &m); err != nil || m != 7 {
+		t.Errorf("got GetSockOpt(*markOption) on another endpoint = %v, %d, want nil, 7", err, m)
+	}
+
+	// Endpoints must hold a store.
+	var ep Endpoint
+	if err := tbl.SetSockOpt(ep, markOption(1)); err != ErrUnknownProtocolOption {
+		t.Errorf("got SetSockOpt(markOption(1)) on an endpoint without a store = %v, want %v", err, ErrUnknownProtocolOption)
+	}
+}
+
+func findTrackedObject(id uint64) (TrackedObject, bool) {
+	for _, o := range GetTrackedObjects() {
+		if o.ID == id {
+			return o, true
+		}
+	}
+	return TrackedObject{}, false
+}
+
+func TestLeakCheck(t *testing.T) {
+	defer SetLeakCheck(LeakCheckEnabled())
+
+	SetLeakCheck(false)
+	if id := TrackObject("widget"); id != 0 {
+		t.Fatalf("TrackObject with leak checking disabled = %d, want = 0", id)
+	}
+
+	SetLeakCheck(true)
+	id := TrackObject("widget")
+	if id == 0 {
+		t.Fatal("TrackObject with leak checking enabled = 0, want non-zero")
+	}
+	o, ok := findTrackedObject(id)
+	if !ok {
+		t.Fatalf("object %d isn't tracked", id)
+	}
+	if o.Kind != "widget" {
+		t.Errorf("got o.Kind = %q, want = %q", o.Kind, "widget")
+	}
+	if !strings.Contains(o.Stack, "TestLeakCheck") {
+		t.Errorf("creation stack doesn't contain the caller:\n%s", o.Stack)
+	}
+
+	var b bytes.Buffer
+	DumpTrackedObjects(&b)
+	if want := fmt.Sprintf("widget #%d created at ", id); !strings.Contains(b.String(), want) {
+		t.Errorf("dump doesn't contain %q:\n%s", want, b.String())
+	}
+
+	// Objects remain tracked after leak checking is disabled.
+	SetLeakCheck(false)
+	if _, ok := findTrackedObject(id); !ok {
+		t.Fatalf("object %d isn't tracked after disabling leak checking", id)
+	}
+	UntrackObject(id)
+	if _, ok := findTrackedObject(id); ok {
+		t.Fatalf("object %d is still tracked after UntrackObject", id)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpip
+
+import (
+	"time"
+)
+
+// AfterFunc implements Clock.AfterFunc.
+func (*StdClock) AfterFunc(d time.Duration, f func()) Timer {
+	return stdTimer{time.AfterFunc(d, f)}
+}
+
+// stdTimer implements Timer with a time.Timer.
+type stdTimer struct {
+	t *time.Timer
+}
+
+// Stop implements Timer.Stop.
+func (t stdTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+// Reset implements Timer.Reset.
+func (t stdTimer) Reset(d time.Duration) bool {
+	return t.t.Reset(d)
+}
@@ -0,0 +1,326 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package timerwheel provides a tcpip.Clock whose timers are kept in a
+// hierarchical timing wheel, so that a large number of them costs a single
+// runtime timer rather than one each.
+package timerwheel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	// slotBits is the log2 of the number of slots of each level.
+	slotBits = 6
+	slots    = 1 << slotBits
+	slotMask = slots - 1
+
+	// levels is the number of levels of the wheel. Level n has slots that
+	// are slots^n ticks wide, so the wheel covers slots^levels ticks,
+	// about 12 days with a 1ms resolution. Timers further away are kept in
+	// the last slot and rescheduled when it is reached.
+	levels = 5
+
+	// maxDelta is the number of ticks the wheel covers.
+	maxDelta = 1<<(slotBits*levels) - 1
+)
+
+// Wheel is a tcpip.Clock that takes its time from another clock, and runs its
+// timers on a hierarchical timing wheel with a fixed resolution. Starting,
+// stopping and resetting a timer are O(1), and the wheel only uses a single
+// timer of the other clock, which runs while it has pending timers and fires at
+// most once per tick.
+//
+// Timers are never called early, but may be called up to one resolution late.
+//
+// This struct is safe for concurrent use.
+type Wheel struct {
+	clock tcpip.Clock
+
+	// resolution is the width of a tick, in nanoseconds.
+	resolution int64
+
+	// start is the monotonic time of clock at which tick 0 started.
+	start int64
+
+	mu sync.Mutex
+
+	// next is the next tick to process.
+	next int64
+
+	// pending is the number of pending timers.
+	pending int
+
+	// slots holds the pending timers, in a list per slot of each level.
+	slots [levels][slots]*wheelTimer
+
+	// driver is the timer of clock that advances the wheel. running is
+	// set while it's scheduled, to fire at tick wakeAt.
+	driver  tcpip.Timer
+	running bool
+	wakeAt  int64
+}
+
+var _ tcpip.Clock = (*Wheel)(nil)
+
+// New returns a timing wheel with the given resolution, which takes its time
+// from clock.
+func New(clock tcpip.Clock, resolution time.Duration) *Wheel {
+	if resolution <= 0 {
+		panic("timerwheel: non-positive resolution")
+	}
+	w := &Wheel{
+		clock:      clock,
+		resolution: int64(resolution),
+		start:      clock.NowMonotonic(),
+	}
+	w.driver = clock.AfterFunc(time.Hour, w.advance)
+	w.driver.Stop()
+	return w
+}
+
+// Clock returns the clock the wheel takes its time from.
+func (w *Wheel) Clock() tcpip.Clock {
+	return w.clock
+}
+
+// NowNanoseconds implements tcpip.Clock.NowNanoseconds.
+func (w *Wheel) NowNanoseconds() int64 {
+	return w.clock.NowNanoseconds()
+}
+
+// NowMonotonic implements tcpip.Clock.NowMonotonic.
+func (w *Wheel) NowMonotonic() int64 {
+	return w.clock.NowMonotonic()
+}
+
+// AfterFunc implements tcpip.Clock.AfterFunc.
+func (w *Wheel) AfterFunc(d time.Duration, f func()) tcpip.Timer {
+	t := &wheelTimer{wheel: w, f: f}
+	t.Reset(d)
+	return t
+}
+
+// Pending returns the number of pending timers.
+func (w *Wheel) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pending
+}
+
+// addLocked adds t to the slot its expiration tick falls in. w.mu must be
+// held.
+func (w *Wheel) addLocked(t *wheelTimer) {
+	delta := t.expires - w.next
+	if delta < 0 {
+		delta = 0
+	}
+	if delta > maxDelta {
+		delta = maxDelta
+	}
+	at := w.next + delta
+	level := 0
+	for delta >= slots {
+		delta >>= slotBits
+		level++
+	}
+	t.level = level
+	t.slot = int((at >> uint(slotBits*level)) & slotMask)
+
+	head := &w.slots[t.level][t.slot]
+	t.prev = nil
+	t.next = *head
+	if *head != nil {
+		(*head).prev = t
+	}
+	*head = t
+	t.pending = true
+	w.pending++
+}
+
+// removeLocked removes the pending timer t from its slot. w.mu must be held.
+func (w *Wheel) removeLocked(t *wheelTimer) {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		w.slots[t.level][t.slot] = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.prev, t.next = nil, nil
+	t.pending = false
+	w.pending--
+}
+
+// takeLocked removes all the timers of a slot and returns them as a list.
+// w.mu must be held.
+func (w *Wheel) takeLocked(level, slot int) *wheelTimer {
+	head := w.slots[level][slot]
+	w.slots[level][slot] = nil
+	for t := head; t != nil; t = t.next {
+		t.pending = false
+		w.pending--
+	}
+	return head
+}
+
+// tick returns the tick the monotonic time now falls in.
+func (w *Wheel) tick(now int64) int64 {
+	return (now - w.start) / w.resolution
+}
+
+// scheduleLocked schedules the driver to fire at the start of the next tick
+// that has something to do: either a slot of the first level with timers, or
+// the end of its rotation, when the upper levels move their timers down. w.mu
+// must be held.
+func (w *Wheel) scheduleLocked() {
+	if w.pending == 0 {
+		return
+	}
+	at := (w.next + slotMask) &^ slotMask
+	for i := int(w.next & slotMask); at != w.next && i < slots; i++ {
+		if w.slots[0][i] != nil {
+			at = (w.next &^ slotMask) + int64(i)
+			break
+		}
+	}
+	if w.running && w.wakeAt <= at {
+		return
+	}
+	w.running = true
+	w.wakeAt = at
+	d := w.start + at*w.resolution - w.clock.NowMonotonic()
+	if d < 0 {
+		d = 0
+	}
+	w.driver.Reset(time.Duration(d))
+}
+
+// advance processes the ticks that started since it last ran, and calls the
+// functions of the timers that expired.
+func (w *Wheel) advance() {
+	w.mu.Lock()
+	w.running = false
+	now := w.tick(w.clock.NowMonotonic())
+	var expired []*wheelTimer
+	for w.next <= now && w.pending > 0 {
+		index := int(w.next & slotMask)
+
+		// Move the timers of the next slot of the upper levels down when
+		// the lower ones wrap around.
+		if index == 0 {
+			for level := 1; level < levels; level++ {
+				slot := int((w.next >> uint(slotBits*level)) & slotMask)
+				for t := w.takeLocked(level, slot); t != nil; {
+					next := t.next
+					w.addLocked(t)
+					t = next
+				}
+				if slot != 0 {
+					break
+				}
+			}
+		}
+
+		for t := w.takeLocked(0, index); t != nil; {
+			next := t.next
+			t.prev, t.next = nil, nil
+			if t.expires <= w.next {
+				expired = append(expired, t)
+			} else {
+				// The timer was further away than the wheel
+				// covers.
+				w.addLocked(t)
+			}
+			t = next
+		}
+		w.next++
+	}
+	if w.pending == 0 && w.next <= now {
+		// Nothing is pending, so the ticks left have nothing to
+		// process.
+		w.next = now + 1
+	}
+	w.scheduleLocked()
+	w.mu.Unlock()
+
+	for _, t := range expired {
+		t.f()
+	}
+}
+
+// wheelTimer implements tcpip.Timer for Wheel.
+type wheelTimer struct {
+	wheel *Wheel
+	f     func()
+
+	// The fields below are protected by wheel.mu.
+
+	// expires is the tick the timer expires at.
+	expires int64
+
+	// pending is set while the timer is in a slot of the wheel, given by
+	// level and slot. prev and next link the timers of the slot.
+	pending     bool
+	level, slot int
+	prev, next  *wheelTimer
+}
+
+// Stop implements tcpip.Timer.Stop.
+func (t *wheelTimer) Stop() bool {
+	w := t.wheel
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !t.pending {
+		return false
+	}
+	w.removeLocked(t)
+	return true
+}
+
+// Reset implements tcpip.Timer.Reset.
+func (t *wheelTimer) Reset(d time.Duration) bool {
+	w := t.wheel
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	active := t.pending
+	if active {
+		w.removeLocked(t)
+	}
+	if d < 0 {
+		d = 0
+	}
+
+	// Round the expiration up to the next tick boundary, so that the
+	// timer never fires early.
+	now := w.clock.NowMonotonic()
+	if w.pending == 0 && !w.running {
+		// Skip the ticks that passed while nothing was pending.
+		if cur := w.tick(now); cur >= w.next {
+			w.next = cur + 1
+		}
+	}
+	t.expires = (now - w.start + int64(d) + w.resolution - 1) / w.resolution
+	if t.expires < w.next {
+		t.expires = w.next
+	}
+	w.addLocked(t)
+	w.scheduleLocked()
+	return active
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package timerwheel_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip/faketime"
+	"github.com/google/netstack/tcpip/timerwheel"
+)
+
+func TestTimers(t *testing.T) {
+	c := faketime.NewManualClock()
+	w := timerwheel.New(c, time.Millisecond)
+
+	var fired []time.Duration
+	record := func() { fired = append(fired, c.Elapsed()) }
+
+	w.AfterFunc(3*time.Second, record)
+	w.AfterFunc(time.Second, record)
+	stopped := w.AfterFunc(1500*time.Millisecond, record)
+	w.AfterFunc(2*time.Second, func() {
+		record()
+		w.AfterFunc(500*time.Microsecond, record)
+	})
+	if !stopped.Stop() {
+		t.Fatal("Stop() = false on a pending timer, want true")
+	}
+	if stopped.Stop() {
+		t.Fatal("Stop() = true on a stopped timer, want false")
+	}
+
+	c.Advance(2500 * time.Millisecond)
+	want := []time.Duration{time.Second, 2 * time.Second, 2001 * time.Millisecond}
+	if len(fired) != len(want) {
+		t.Fatalf("got timers fired at %v, want %v", fired, want)
+	}
+	for i := range want {
+		if fired[i] != want[i] {
+			t.Fatalf("got timers fired at %v, want %v", fired, want)
+		}
+	}
+	if got, want := w.Pending(), 1; got != want {
+		t.Fatalf("got Pending() = %d, want %d", got, want)
+	}
+
+	c.Advance(time.Second)
+	if got, want := len(fired), 4; got != want {
+		t.Fatalf("got %d timers fired, want %d", got, want)
+	}
+	if _, ok := c.NextExpiration(); ok {
+		t.Error("the wheel still runs with no pending timers")
+	}
+}
+
+func TestReset(t *testing.T) {
+	c := faketime.NewManualClock()
+	w := timerwheel.New(c, 10*time.Millisecond)
+
+	n := 0
+	timer := w.AfterFunc(time.Second, func() { n++ })
+	c.Advance(500 * time.Millisecond)
+	if !timer.Reset(time.Second) {
+		t.Fatal("Reset() = false on a pending timer, want true")
+	}
+	c.Advance(time.Second - time.Millisecond)
+	if n != 0 {
+		t.Fatal("timer fired early after Reset")
+	}
+	c.Advance(10 * time.Millisecond)
+	if n != 1 {
+		t.Fatalf("timer fired %d times, want 1", n)
+	}
+	if timer.Reset(time.Minute) {
+		t.Fatal("Reset() = true on an expired timer, want false")
+	}
+	c.Advance(time.Minute + 10*time.Millisecond)
+	if n != 2 {
+		t.Fatalf("timer fired %d times, want 2", n)
+	}
+}
+
+func TestRandomTimers(t *testing.T) {
+	c := faketime.NewManualClock()
+	const resolution = 100 * time.Millisecond
+	w := timerwheel.New(c, resolution)
+
+	// Timers are never called early, nor more than one resolution late,
+	// whichever level of the wheel they start in.
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		max := int64(time.Minute)
+		if i%2 == 0 {
+			max = int64(1000 * time.Hour)
+		}
+		target := c.Elapsed() + time.Duration(rng.Int63n(max))
+		w.AfterFunc(target-c.Elapsed(), func() {
+			if now := c.Elapsed(); now < target || now-target > resolution {
+				t.Errorf("timer for %v fired at %v", target, now)
+			}
+		})
+		if i%10 == 0 {
+			c.Advance(time.Duration(rng.Int63n(int64(time.Second))))
+		}
+	}
+	for w.Pending() > 0 {
+		c.Advance(time.Hour)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package icmp
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+// checkpoint is the state of an endpoint held in a stack.EndpointCheckpoint.
+type checkpoint struct {
+	SockOpts []tcpip.SavedSockOpt
+	Raw      bool
+	State    endpointState
+
+	// BindNICID, BindAddr and LocalPort are the NIC and address the
+	// endpoint is bound to, and its identifier.
+	BindNICID tcpip.NICID
+	BindAddr  tcpip.Address
+	LocalPort uint16
+
+	// Remote is the address the endpoint is connected to, through the NIC
+	// it is registered with, or that of its route for raw endpoints.
+	Remote tcpip.FullAddress
+
+	ShutdownFlags tcpip.ShutdownFlags
+	RcvClosed     bool
+
+	Packets   []packetCheckpoint
+	ErrQueue  []tcpip.SockError
+	LastError string
+}
+
+// packetCheckpoint is a packet of the receive queue held in a checkpoint.
+type packetCheckpoint struct {
+	Sender    tcpip.FullAddress
+	Data      []byte
+	Timestamp int64
+}
+
+// Checkpoint implements stack.CheckpointableEndpoint.Checkpoint.
+func (e *endpoint) Checkpoint() (stack.EndpointCheckpoint, error) {
+	c := checkpoint{
+		SockOpts: SockOpts.Save(e),
+		Raw:      e.raw,
+	}
+
+	e.mu.RLock()
+	c.State = e.state
+	c.BindNICID = e.bindNICID
+	c.BindAddr = e.bindAddr
+	c.LocalPort = e.id.LocalPort
+	if e.state == stateConnected {
+		c.Remote = tcpip.FullAddress{NIC: e.regNICID, Addr: e.id.RemoteAddress}
+		if e.raw {
+			c.Remote.NIC = e.route.NICID()
+		}
+	}
+	c.ShutdownFlags = e.shutdownFlags
+	e.mu.RUnlock()
+
+	e.rcvMu.Lock()
+	c.RcvClosed = e.rcvClosed
+	for p := e.rcvList.Front(); p != nil; p = p.Next() {
+		c.Packets = append(c.Packets, packetCheckpoint{
+			Sender:    p.senderAddress,
+			Data:      p.data.ToView(),
+			Timestamp: p.timestamp,
+		})
+	}
+	for _, se := range e.errQueue {
+		c.ErrQueue = append(c.ErrQueue, *se)
+	}
+	e.rcvMu.Unlock()
+
+	if err := e.lastError.Peek(); err != nil {
+		c.LastError = err.String()
+	}
+
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(&c); err != nil {
+		return stack.EndpointCheckpoint{}, tcpip.ErrSaveRejection{Err: err}
+	}
+	return stack.EndpointCheckpoint{
+		TransportProtocol: e.transProto,
+		NetworkProtocol:   e.netProto,
+		State:             b.Bytes(),
+	}, nil
+}
+
+// RestoreEndpoint implements stack.EndpointRestorer.RestoreEndpoint.
+func (p *protocol) RestoreEndpoint(s *stack.Stack, ec stack.EndpointCheckpoint, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
+	if ec.NetworkProtocol != p.netProto() {
+		return nil, tcpip.ErrUnknownProtocol
+	}
+	var c checkpoint
+	if err := gob.NewDecoder(bytes.NewReader(ec.State)).Decode(&c); err != nil {
+		return nil, tcpip.ErrInvalidOptionValue
+	}
+	e, err := newEndpoint(s, ec.NetworkProtocol, p.number, waiterQueue, c.Raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.restore(&c); err != nil {
+		e.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// restore brings the new endpoint e to the state held in c: it sets its
+// options, binds and connects it again, and refills its queues.
+func (e *endpoint) restore(c *checkpoint) *tcpip.Error {
+	if c.State == stateClosed {
+		e.Close()
+		return nil
+	}
+
+	if err := SockOpts.Restore(e, c.SockOpts); err != nil {
+		return err
+	}
+
+	// Raw endpoints are bound when they're created, and only bound to an
+	// address or NIC if they were given one.
+	bound := c.BindNICID != 0 || c.BindAddr != ""
+	if (!e.raw && c.State != stateInitial) || (e.raw && bound) {
+		if err := e.Bind(tcpip.FullAddress{NIC: c.BindNICID, Addr: c.BindAddr, Port: c.LocalPort}); err != nil {
+			return err
+		}
+	}
+	if c.State == stateConnected {
+		if err := e.Connect(c.Remote); err != nil {
+			return err
+		}
+	}
+
+	e.mu.Lock()
+	e.shutdownFlags = c.ShutdownFlags
+	e.mu.Unlock()
+
+	e.rcvMu.Lock()
+	e.rcvClosed = c.RcvClosed
+	for _, pc := range c.Packets {
+		p := &icmpPacket{
+			senderAddress: pc.Sender,
+			data:          buffer.View(pc.Data).ToVectorisedView(),
+			timestamp:     pc.Timestamp,
+		}
+		e.rcvList.PushBack(p)
+		e.rcvBufSize += p.data.Size()
+	}
+	for i := range c.ErrQueue {
+		se := &c.ErrQueue[i]
+		e.errQueue = append(e.errQueue, se)
+		e.errQueueSize += len(se.Payload)
+		e.errQueueMem += se.ControlSize()
+	}
+	e.rcvMu.Unlock()
+
+	if err := tcpip.ErrorFromMessage(c.LastError); err != nil {
+		e.lastError.Set(err)
+	}
+	return nil
+}
@@ -18,7 +18,6 @@ import (
 	"encoding/binary"
 	"sync"
 
-	"github.com/google/netstack/sleep"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
@@ -26,6 +25,17 @@ import (
 	"github.com/google/netstack/waiter"
 )
 
+const (
+	// maxErrQueueLen is the maximum number of entries in an endpoint's
+	// error queue. Errors that don't fit are dropped.
+	maxErrQueueLen = 256
+
+	// icmpEchoHeaderSize is the size of the ICMP echo header: type, code,
+	// checksum, identifier and sequence number. It is the same for ICMPv4
+	// and ICMPv6.
+	icmpEchoHeaderSize = 8
+)
+
 // +stateify savable
 type icmpPacket struct {
 	icmpPacketEntry
@@ -46,6 +56,13 @@ const (
 	stateClosed
 )
 
+var stateNames = [...]string{
+	stateInitial:   "INITIAL",
+	stateBound:     "BOUND",
+	stateConnected: "CONNECTED",
+	stateClosed:    "CLOSED",
+}
+
 // endpoint represents an ICMP endpoint. This struct serves as the interface
 // between users of the endpoint and the protocol implementation; it is legal to
 // have concurrent goroutines make calls into the endpoint, they are properly
@@ -59,6 +76,7 @@ type endpoint struct {
 	netProto    tcpip.NetworkProtocolNumber
 	transProto  tcpip.TransportProtocolNumber
 	waiterQueue *waiter.Queue
+	leakID      uint64
 	// raw indicates whether the endpoint is intended for use by a raw
 	// socket, which returns the network layer header along with the
 	// payload. It is immutable.
@@ -73,6 +91,31 @@ type endpoint struct {
 	rcvBufSize    int
 	rcvClosed     bool
 
+	// recvErr enables the error queue, errQueue, which holds up to
+	// rcvBufSizeMax bytes of offending payloads, errQueueSize, and up to
+	// the stack's control memory of metadata, errQueueMem. They are
+	// protected by rcvMu.
+	recvErr      bool
+	errQueue     []*tcpip.SockError
+	errQueueSize int
+	errQueueMem  int
+
+	// The following fields select the packets raw endpoints receive. They
+	// are the NIC and local address the endpoint is bound to, the remote
+	// address it is connected to, if any, and the ICMP types it doesn't
+	// receive. They are protected by rcvMu.
+	rawNICID   tcpip.NICID
+	rawLocal   tcpip.Address
+	rawRemote  tcpip.Address
+	icmpFilter tcpip.ICMPFilterOption
+
+	// lastError is the last error the endpoint reported asynchronously.
+	lastError tcpip.PendingError
+
+	// sockOpts holds the values of the options registered in SockOpts with
+	// RegisterStored.
+	sockOpts tcpip.SockOptStore
+
 	// The following fields are protected by the mu mutex.
 	mu         sync.RWMutex
 	sndBufSize int
@@ -84,6 +127,8 @@ type endpoint struct {
 	bindAddr      tcpip.Address
 	regNICID      tcpip.NICID
 	route         stack.Route
+	// ttl is the TTL of outgoing packets, or 0 to use the route's default.
+	ttl uint8
 }
 
 func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, waiterQueue *waiter.Queue, raw bool) (*endpoint, *tcpip.Error) {
@@ -92,11 +137,22 @@ func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, trans
 		netProto:      netProto,
 		transProto:    transProto,
 		waiterQueue:   waiterQueue,
-		rcvBufSizeMax: 32 * 1024,
-		sndBufSize:    32 * 1024,
+		leakID:        tcpip.TrackObject("icmp endpoint"),
+		rcvBufSizeMax: DefaultBufferSize,
+		sndBufSize:    DefaultBufferSize,
 		raw:           raw,
 	}
 
+	var ss SendBufferSizeOption
+	if err := stack.TransportProtocolOption(transProto, &ss); err == nil {
+		e.sndBufSize = ss.Default
+	}
+
+	var rs ReceiveBufferSizeOption
+	if err := stack.TransportProtocolOption(transProto, &rs); err == nil {
+		e.rcvBufSizeMax = rs.Default
+	}
+
 	// Raw endpoints must be immediately bound because they receive all
 	// ICMP traffic starting from when they're created via socket().
 	if raw {
@@ -111,6 +167,8 @@ func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, trans
 // Close puts the endpoint in a closed state and frees all resources
 // associated with it.
 func (e *endpoint) Close() {
+	tcpip.UntrackObject(e.leakID)
+
 	e.mu.Lock()
 	e.shutdownFlags = tcpip.ShutdownRead | tcpip.ShutdownWrite
 	switch e.state {
@@ -130,6 +188,9 @@ func (e *endpoint) Close() {
 		p := e.rcvList.Front()
 		e.rcvList.Remove(p)
 	}
+	e.errQueue = nil
+	e.errQueueSize = 0
+	e.errQueueMem = 0
 	e.rcvMu.Unlock()
 
 	e.route.Release()
@@ -287,14 +348,9 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, <-c
 	}
 
 	if route.IsResolutionRequired() {
-		waker := &sleep.Waker{}
-		if ch, err := route.Resolve(waker); err != nil {
-			if err == tcpip.ErrWouldBlock {
-				// Link address needs to be resolved. Resolution was triggered the
-				// background. Better luck next time.
-				route.RemoveWaker(waker)
-				return 0, ch, tcpip.ErrNoLinkAddress
-			}
+		// If the link address is being resolved, the stack queues the
+		// packet and sends it once it is.
+		if _, err := route.Resolve(nil); err != nil && err != tcpip.ErrWouldBlock {
 			return 0, nil, err
 		}
 	}
@@ -304,12 +360,26 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, <-c
 		return 0, nil, err
 	}
 
+	ttl := route.DefaultTTL()
+	if e.ttl != 0 {
+		ttl = e.ttl
+	}
+	if opts.TTL != 0 {
+		ttl = opts.TTL
+	}
+
 	switch e.netProto {
 	case header.IPv4ProtocolNumber:
-		err = e.send4(route, v)
+		err = e.send4(route, v, ttl)
+		if err == nil && len(v) > 0 {
+			route.Stats().ICMP.V4PacketsSent.Record(v[0])
+		}
 
 	case header.IPv6ProtocolNumber:
-		err = send6(route, e.id.LocalPort, v)
+		err = e.send6(route, v, ttl)
+		if err == nil && len(v) > 0 {
+			route.Stats().ICMP.V6PacketsSent.Record(v[0])
+		}
 	}
 
 	if err != nil {
@@ -324,53 +394,32 @@ func (e *endpoint) Peek([][]byte) (uintptr, tcpip.ControlMessages, *tcpip.Error)
 	return 0, tcpip.ControlMessages{}, nil
 }
 
-// SetSockOpt sets a socket option. Currently not supported.
+// SetSockOpt sets a socket option. Options that aren't registered in SockOpts
+// are ignored.
 func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
+	if err := SockOpts.SetSockOpt(e, opt); err != tcpip.ErrUnknownProtocolOption {
+		return err
+	}
 	return nil
 }
 
+// SockOptStore implements tcpip.SockOptStorer.SockOptStore.
+func (e *endpoint) SockOptStore() *tcpip.SockOptStore {
+	return &e.sockOpts
+}
+
 // GetSockOpt implements tcpip.Endpoint.GetSockOpt.
 func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
-	switch o := opt.(type) {
-	case tcpip.ErrorOption:
-		return nil
-
-	case *tcpip.SendBufferSizeOption:
-		e.mu.Lock()
-		*o = tcpip.SendBufferSizeOption(e.sndBufSize)
-		e.mu.Unlock()
-		return nil
-
-	case *tcpip.ReceiveBufferSizeOption:
-		e.rcvMu.Lock()
-		*o = tcpip.ReceiveBufferSizeOption(e.rcvBufSizeMax)
-		e.rcvMu.Unlock()
-		return nil
-
-	case *tcpip.ReceiveQueueSizeOption:
-		e.rcvMu.Lock()
-		if e.rcvList.Empty() {
-			*o = 0
-		} else {
-			p := e.rcvList.Front()
-			*o = tcpip.ReceiveQueueSizeOption(p.data.Size())
-		}
-		e.rcvMu.Unlock()
-		return nil
-
-	case *tcpip.KeepaliveEnabledOption:
-		*o = 0
-		return nil
-
-	default:
-		return tcpip.ErrUnknownProtocolOption
+	if _, ok := opt.(tcpip.ErrorOption); ok {
+		return e.lastError.Get()
 	}
+	return SockOpts.GetSockOpt(e, opt)
 }
 
-func (e *endpoint) send4(r *stack.Route, data buffer.View) *tcpip.Error {
+func (e *endpoint) send4(r *stack.Route, data buffer.View, ttl uint8) *tcpip.Error {
 	if e.raw {
 		hdr := buffer.NewPrependable(len(data) + int(r.MaxHeaderLength()))
-		return r.WritePacket(hdr, data.ToVectorisedView(), header.ICMPv4ProtocolNumber, r.DefaultTTL())
+		return writePacket(r, hdr, data, header.ICMPv4ProtocolNumber, ttl)
 	}
 
 	if len(data) < header.ICMPv4EchoMinimumSize {
@@ -395,16 +444,29 @@ func (e *endpoint) send4(r *stack.Route, data buffer.View) *tcpip.Error {
 	icmpv4.SetChecksum(0)
 	icmpv4.SetChecksum(^header.Checksum(icmpv4, header.Checksum(data, 0)))
 
-	return r.WritePacket(hdr, data.ToVectorisedView(), header.ICMPv4ProtocolNumber, r.DefaultTTL())
+	return writePacket(r, hdr, data, header.ICMPv4ProtocolNumber, ttl)
 }
 
-func send6(r *stack.Route, ident uint16, data buffer.View) *tcpip.Error {
+func (e *endpoint) send6(r *stack.Route, data buffer.View, ttl uint8) *tcpip.Error {
+	if e.raw {
+		// Like Linux, the checksum of ICMPv6 messages is always computed
+		// by the stack, even on raw endpoints.
+		if len(data) < header.ICMPv6MinimumSize {
+			return tcpip.ErrInvalidEndpointState
+		}
+		hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+		icmpv6 := header.ICMPv6(data)
+		icmpv6.SetChecksum(0)
+		icmpv6.SetChecksum(icmpv6Checksum(r, icmpv6, nil))
+		return writePacket(r, hdr, data, header.ICMPv6ProtocolNumber, ttl)
+	}
+
 	if len(data) < header.ICMPv6EchoMinimumSize {
 		return tcpip.ErrInvalidEndpointState
 	}
 
 	// Set the ident. Sequence number is provided by the user.
-	binary.BigEndian.PutUint16(data[header.ICMPv6MinimumSize:], ident)
+	binary.BigEndian.PutUint16(data[header.ICMPv6MinimumSize:], e.id.LocalPort)
 
 	hdr := buffer.NewPrependable(header.ICMPv6EchoMinimumSize + int(r.MaxHeaderLength()))
 
@@ -417,9 +479,24 @@ func send6(r *stack.Route, ident uint16, data buffer.View) *tcpip.Error {
 	}
 
 	icmpv6.SetChecksum(0)
-	icmpv6.SetChecksum(^header.Checksum(icmpv6, header.Checksum(data, 0)))
+	icmpv6.SetChecksum(icmpv6Checksum(r, icmpv6, data))
+
+	return writePacket(r, hdr, data, header.ICMPv6ProtocolNumber, ttl)
+}
 
-	return r.WritePacket(hdr, data.ToVectorisedView(), header.ICMPv6ProtocolNumber, r.DefaultTTL())
+// writePacket sends the ICMP header in hdr followed by data through r.
+func writePacket(r *stack.Route, hdr buffer.Prependable, data buffer.View, protocol tcpip.TransportProtocolNumber, ttl uint8) *tcpip.Error {
+	pkt := stack.NewOutboundPacketBuffer(hdr, data.ToVectorisedView())
+	defer pkt.DecRef()
+	return r.WritePacket(pkt, protocol, ttl)
+}
+
+// icmpv6Checksum returns the checksum of the ICMPv6 message made of h and
+// data sent through r, which covers the IPv6 pseudo-header. The checksum
+// field of h must be zero.
+func icmpv6Checksum(r *stack.Route, h header.ICMPv6, data buffer.View) uint16 {
+	xsum := header.PseudoHeaderChecksum(header.ICMPv6ProtocolNumber, r.LocalAddress, r.RemoteAddress, uint16(len(h)+len(data)))
+	return ^header.Checksum(h, header.Checksum(data, xsum))
 }
 
 func (e *endpoint) checkV4Mapped(addr *tcpip.FullAddress, allowMismatch bool) (tcpip.NetworkProtocolNumber, *tcpip.Error) {
@@ -439,14 +516,13 @@ func (e *endpoint) checkV4Mapped(addr *tcpip.FullAddress, allowMismatch bool) (t
 
 // Connect connects the endpoint to its peer. Specifying a NIC is optional.
 func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
-	// TODO: We don't yet support connect on a raw socket.
-	if e.raw {
-		return tcpip.ErrNotSupported
-	}
-
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	if e.raw {
+		return e.connectRawLocked(addr)
+	}
+
 	nicid := addr.NIC
 	localPort := uint16(0)
 	switch e.state {
@@ -506,6 +582,45 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
 	return nil
 }
 
+// connectRawLocked connects the raw endpoint to addr: it sends to addr when
+// no destination is given, and only receives the packets from it. Raw
+// endpoints are registered when they're created, so this doesn't change their
+// registration. e.mu must be held.
+func (e *endpoint) connectRawLocked(addr tcpip.FullAddress) *tcpip.Error {
+	if e.state == stateClosed {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	nicid := addr.NIC
+	if e.bindNICID != 0 {
+		if nicid != 0 && nicid != e.bindNICID {
+			return tcpip.ErrInvalidEndpointState
+		}
+		nicid = e.bindNICID
+	}
+
+	netProto, err := e.checkV4Mapped(&addr, false)
+	if err != nil {
+		return err
+	}
+
+	r, err := e.stack.FindRoute(nicid, e.bindAddr, addr.Addr, netProto, false /* multicastLoop */)
+	if err != nil {
+		return err
+	}
+
+	e.route.Release()
+	e.route = r
+	e.id.RemoteAddress = r.RemoteAddress
+	e.state = stateConnected
+
+	e.rcvMu.Lock()
+	e.rawRemote = r.RemoteAddress
+	e.rcvMu.Unlock()
+
+	return nil
+}
+
 // ConnectEndpoint is not supported.
 func (*endpoint) ConnectEndpoint(tcpip.Endpoint) *tcpip.Error {
 	return tcpip.ErrInvalidEndpointState
@@ -533,6 +648,10 @@ func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) *tcpip.Error {
 		}
 	}
 
+	if e.shutdownFlags == tcpip.ShutdownRead|tcpip.ShutdownWrite {
+		e.waiterQueue.Notify(waiter.EventHUp)
+	}
+
 	return nil
 }
 
@@ -542,7 +661,7 @@ func (*endpoint) Listen(int) *tcpip.Error {
 }
 
 // Accept is not supported by UDP, it just fails.
-func (*endpoint) Accept() (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
+func (*endpoint) Accept(*tcpip.FullAddress) (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
 	return nil, nil, tcpip.ErrNotSupported
 }
 
@@ -628,6 +747,10 @@ func (e *endpoint) Bind(addr tcpip.FullAddress) *tcpip.Error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	if e.raw {
+		return e.bindRawLocked(addr)
+	}
+
 	err := e.bindLocked(addr)
 	if err != nil {
 		return err
@@ -639,6 +762,34 @@ func (e *endpoint) Bind(addr tcpip.FullAddress) *tcpip.Error {
 	return nil
 }
 
+// bindRawLocked binds the raw endpoint to addr, after which it only receives
+// the packets sent to addr.Addr through addr.NIC, if they are set, and sends
+// from addr.Addr. Raw endpoints are registered when they're created, so this
+// doesn't change their registration. e.mu must be held.
+func (e *endpoint) bindRawLocked(addr tcpip.FullAddress) *tcpip.Error {
+	if e.state == stateClosed {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	if _, err := e.checkV4Mapped(&addr, false); err != nil {
+		return err
+	}
+	if len(addr.Addr) != 0 && e.stack.CheckLocalAddress(addr.NIC, e.netProto, addr.Addr) == 0 {
+		return tcpip.ErrBadLocalAddress
+	}
+
+	e.id.LocalAddress = addr.Addr
+	e.bindNICID = addr.NIC
+	e.bindAddr = addr.Addr
+
+	e.rcvMu.Lock()
+	e.rawNICID = addr.NIC
+	e.rawLocal = addr.Addr
+	e.rcvMu.Unlock()
+
+	return nil
+}
+
 // GetLocalAddress returns the address to which the endpoint is bound.
 func (e *endpoint) GetLocalAddress() (tcpip.FullAddress, *tcpip.Error) {
 	e.mu.RLock()
@@ -669,27 +820,62 @@ func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, *tcpip.Error) {
 
 // Readiness returns the current readiness of the endpoint. For example, if
 // waiter.EventIn is set, the endpoint is immediately readable.
+//
+// waiter.EventHUp is reported once the endpoint is closed or shut down both
+// ways, whether or not it is in mask.
 func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 	// The endpoint is always writable.
 	result := waiter.EventOut & mask
 
+	e.mu.RLock()
+	if e.state == stateClosed || e.shutdownFlags == tcpip.ShutdownRead|tcpip.ShutdownWrite {
+		result |= waiter.EventHUp
+	}
+	e.mu.RUnlock()
+
 	// Determine if the endpoint is readable if requested.
-	if (mask & waiter.EventIn) != 0 {
-		e.rcvMu.Lock()
-		if !e.rcvList.Empty() || e.rcvClosed {
-			result |= waiter.EventIn
-		}
-		e.rcvMu.Unlock()
+	e.rcvMu.Lock()
+	if (mask&waiter.EventIn) != 0 && (!e.rcvList.Empty() || e.rcvClosed) {
+		result |= waiter.EventIn
+	}
+	if len(e.errQueue) != 0 {
+		result |= waiter.EventErr
+	}
+	e.rcvMu.Unlock()
+
+	if e.lastError.Pending() {
+		result |= waiter.EventErr
 	}
 
 	return result
 }
 
+// Diagnose implements stack.DiagnosableEndpoint.Diagnose.
+func (e *endpoint) Diagnose(info *stack.SocketInfo) {
+	e.mu.RLock()
+	info.State = stateNames[e.state]
+	e.mu.RUnlock()
+
+	e.rcvMu.Lock()
+	info.RecvQueue = e.rcvBufSize
+	e.rcvMu.Unlock()
+}
+
 // HandlePacket is called by the stack when new packets arrive to this transport
 // endpoint.
-func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, netHeader buffer.View, vv buffer.VectorisedView) {
+func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, pkt *stack.PacketBuffer) {
+	// Echo endpoints only receive the replies to their requests.
+	if !e.raw && !isEchoReply(e.netProto, pkt.Data.First()) {
+		return
+	}
+
 	e.rcvMu.Lock()
 
+	if e.raw && !e.rawReceivesLocked(r, id, pkt.Data.First()) {
+		e.rcvMu.Unlock()
+		return
+	}
+
 	// Drop the packet if our buffer is currently full.
 	if !e.rcvReady || e.rcvClosed || e.rcvBufSize >= e.rcvBufSizeMax {
 		e.rcvMu.Unlock()
@@ -699,7 +885,7 @@ func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, ne
 	wasEmpty := e.rcvBufSize == 0
 
 	// Push new packet into receive list and increment the buffer size.
-	pkt := &icmpPacket{
+	p := &icmpPacket{
 		senderAddress: tcpip.FullAddress{
 			NIC:  r.NICID(),
 			Addr: id.RemoteAddress,
@@ -707,17 +893,18 @@ func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, ne
 	}
 
 	if e.raw {
-		combinedVV := netHeader.ToVectorisedView()
-		combinedVV.Append(vv)
-		pkt.data = combinedVV.Clone(pkt.views[:])
+		// Raw endpoints are handed their own copy of the packet.
+		combinedVV := pkt.NetworkHeader.ToVectorisedView()
+		combinedVV.Append(pkt.Data)
+		p.data = combinedVV.Clone(p.views[:])
 	} else {
-		pkt.data = vv.Clone(pkt.views[:])
+		p.data = pkt.OwnedData(p.views[:])
 	}
 
-	e.rcvList.PushBack(pkt)
-	e.rcvBufSize += pkt.data.Size()
+	e.rcvList.PushBack(p)
+	e.rcvBufSize += p.data.Size()
 
-	pkt.timestamp = e.stack.NowNanoseconds()
+	p.timestamp = e.stack.NowNanoseconds()
 
 	e.rcvMu.Unlock()
 
@@ -727,6 +914,164 @@ func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, ne
 	}
 }
 
+// rawReceivesLocked returns whether the raw endpoint receives the packet
+// received through r from id.RemoteAddress to id.LocalAddress, whose ICMP
+// message starts with v. e.rcvMu must be held.
+func (e *endpoint) rawReceivesLocked(r *stack.Route, id stack.TransportEndpointID, v buffer.View) bool {
+	if e.rawNICID != 0 && e.rawNICID != r.NICID() {
+		return false
+	}
+	if e.rawLocal != "" && e.rawLocal != id.LocalAddress {
+		return false
+	}
+	if e.rawRemote != "" && e.rawRemote != id.RemoteAddress {
+		return false
+	}
+	// The type is the first byte of both ICMPv4 and ICMPv6 messages.
+	return len(v) == 0 || !e.icmpFilter.IsBlocked(v[0])
+}
+
+// isEchoReply reports whether v starts with an echo reply of the given
+// network protocol.
+func isEchoReply(netProto tcpip.NetworkProtocolNumber, v buffer.View) bool {
+	switch netProto {
+	case header.IPv4ProtocolNumber:
+		return len(v) >= header.ICMPv4MinimumSize && header.ICMPv4(v).Type() == header.ICMPv4EchoReply
+	case header.IPv6ProtocolNumber:
+		return len(v) >= header.ICMPv6MinimumSize && header.ICMPv6(v).Type() == header.ICMPv6EchoReply
+	}
+	return false
+}
+
 // HandleControlPacket implements stack.TransportEndpoint.HandleControlPacket.
-func (e *endpoint) HandleControlPacket(id stack.TransportEndpointID, typ stack.ControlType, extra uint32, vv buffer.VectorisedView) {
+func (e *endpoint) HandleControlPacket(id stack.TransportEndpointID, typ stack.ControlType, extra uint32, info stack.ControlInfo, vv buffer.VectorisedView) {
+	switch typ {
+	case stack.ControlNICRemoved, stack.ControlHostUnreachable:
+		e.routeFailed(typ, extra, info)
+		return
+	}
+
+	se := &tcpip.SockError{
+		Origin:        tcpip.SockErrOriginICMP,
+		NetProto:      header.IPv4ProtocolNumber,
+		Dst:           tcpip.FullAddress{Addr: id.RemoteAddress},
+		Offender:      info.Offender,
+		NetworkHeader: info.NetworkHeader,
+	}
+	v6 := e.netProto == header.IPv6ProtocolNumber
+	if v6 {
+		se.Origin = tcpip.SockErrOriginICMP6
+		se.NetProto = header.IPv6ProtocolNumber
+	}
+
+	switch typ {
+	case stack.ControlPacketTooBig:
+		se.Err = tcpip.ErrMessageTooLong
+		se.Info = extra
+		se.Type = uint8(header.ICMPv4DstUnreachable)
+		se.Code = header.ICMPv4FragmentationNeeded
+		if v6 {
+			se.Type = uint8(header.ICMPv6PacketTooBig)
+			se.Code = 0
+		}
+
+	case stack.ControlTimeExceeded:
+		se.Err = tcpip.ErrHostUnreachable
+		se.Type = uint8(header.ICMPv4TimeExceeded)
+		se.Code = uint8(extra)
+		if v6 {
+			se.Type = uint8(header.ICMPv6TimeExceeded)
+		}
+
+	default:
+		return
+	}
+
+	// Like Linux, the endpoint doesn't report these errors, which are soft
+	// errors, unless its error queue is enabled.
+	e.rcvMu.Lock()
+	recvErr := e.recvErr
+	e.rcvMu.Unlock()
+	if recvErr {
+		e.reportError(se.Err)
+	}
+
+	// vv starts with the echo header of the offending request, which the
+	// stack checked is there.
+	se.TransportHeader = append(buffer.View(nil), vv.First()[:icmpEchoHeaderSize]...)
+	vv.TrimFront(icmpEchoHeaderSize)
+	se.Payload = append(buffer.View(nil), vv.ToView()...)
+	e.queueError(se)
+}
+
+// routeFailed handles the control packets of type typ telling that routes
+// stopped working, and reports the error if the route of the endpoint is one
+// of them.
+func (e *endpoint) routeFailed(typ stack.ControlType, extra uint32, info stack.ControlInfo) {
+	var err *tcpip.Error
+	e.mu.RLock()
+	if e.state == stateConnected {
+		switch {
+		case typ == stack.ControlNICRemoved && e.route.Removed():
+			err = tcpip.ErrNetworkUnreachable
+		case typ == stack.ControlHostUnreachable && e.route.UsesNeighbor(tcpip.FullAddress{NIC: tcpip.NICID(extra), Addr: info.Offender}):
+			err = tcpip.ErrHostUnreachable
+		}
+	}
+	e.mu.RUnlock()
+
+	if err != nil {
+		e.reportError(err)
+	}
+}
+
+// reportError makes err the pending error of the endpoint, which is retrieved
+// with tcpip.ErrorOption.
+func (e *endpoint) reportError(err *tcpip.Error) {
+	e.lastError.Set(err)
+	e.waiterQueue.Notify(waiter.EventErr)
+}
+
+// queueError adds se to the error queue, if it is enabled and has room for
+// it.
+func (e *endpoint) queueError(se *tcpip.SockError) {
+	e.rcvMu.Lock()
+	full := len(e.errQueue) >= maxErrQueueLen || e.errQueueSize+len(se.Payload) > e.rcvBufSizeMax
+	if !e.recvErr || e.rcvClosed || full || !e.stack.ChargeControlMemory(e.errQueueMem, se.ControlSize()) {
+		e.rcvMu.Unlock()
+		return
+	}
+	wasEmpty := len(e.errQueue) == 0
+	e.errQueue = append(e.errQueue, se)
+	e.errQueueSize += len(se.Payload)
+	e.errQueueMem += se.ControlSize()
+	e.rcvMu.Unlock()
+
+	if wasEmpty {
+		e.waiterQueue.Notify(waiter.EventErr)
+	}
+}
+
+// ReadErrQueue implements tcpip.ErrQueueReader.ReadErrQueue.
+func (e *endpoint) ReadErrQueue() (*tcpip.SockError, *tcpip.Error) {
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+
+	if len(e.errQueue) == 0 {
+		return nil, tcpip.ErrWouldBlock
+	}
+	se := e.errQueue[0]
+	e.errQueue[0] = nil
+	e.errQueue = e.errQueue[1:]
+	e.errQueueSize -= len(se.Payload)
+	e.errQueueMem -= se.ControlSize()
+
+	// As with Linux, the pending error becomes the one of the next queued
+	// error, if any.
+	var next *tcpip.Error
+	if len(e.errQueue) != 0 {
+		next = e.errQueue[0].Err
+	}
+	e.lastError.Set(next)
+	return se, nil
 }
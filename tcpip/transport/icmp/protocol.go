@@ -20,11 +20,21 @@
 // calling stack.New(). Then endpoints can be created by passing
 // icmp.ProtocolNumber or icmp.ProtocolNumber6 as the transport protocol number
 // when calling Stack.NewEndpoint().
+//
+// Endpoints created with Stack.NewEndpoint are datagram endpoints, like
+// Linux's unprivileged ping sockets: they only send echo requests, whose
+// identifier the stack sets to the endpoint's port, and only receive the
+// echo replies with that identifier, and the errors about their requests.
+// Endpoints created with Stack.NewRawEndpoint are raw endpoints: they send
+// the ICMP messages they are given as is, whatever their type, and receive
+// all the ICMP messages reaching the stack with their network header, unless
+// they are bound, connected or filtered with tcpip.ICMPFilterOption.
 package icmp
 
 import (
 	"encoding/binary"
 	"fmt"
+	"sync"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
@@ -45,11 +55,51 @@ const (
 
 	// ProtocolNumber6 is the IPv6-ICMP protocol number.
 	ProtocolNumber6 = header.ICMPv6ProtocolNumber
+
+	// minBufferSize is the smallest size of a receive or send buffer.
+	minBufferSize = 4 << 10 // 4096 bytes.
+
+	// DefaultBufferSize is the default size of the receive and send buffers.
+	DefaultBufferSize = 32 << 10 // 32KB
+
+	// maxBufferSize is the largest size of a receive or send buffer.
+	maxBufferSize = 4 << 20 // 4MB
 )
 
+// SendBufferSizeOption allows the default, min and max send buffer sizes for
+// ICMP endpoints, ping and raw, to be queried or configured. Packets are
+// written to the link as they are sent, so the send buffer size doesn't limit
+// writes.
+type SendBufferSizeOption struct {
+	Min     int
+	Default int
+	Max     int
+}
+
+// ReceiveBufferSizeOption allows the default, min and max receive buffer size
+// for ICMP endpoints, ping and raw, to be queried or configured. Packets
+// received while the receive buffer is full are dropped.
+type ReceiveBufferSizeOption struct {
+	Min     int
+	Default int
+	Max     int
+}
+
 // protocol implements stack.TransportProtocol.
 type protocol struct {
 	number tcpip.TransportProtocolNumber
+
+	mu             sync.Mutex
+	sendBufferSize SendBufferSizeOption
+	recvBufferSize ReceiveBufferSizeOption
+}
+
+func newProtocol(number tcpip.TransportProtocolNumber) *protocol {
+	return &protocol{
+		number:         number,
+		sendBufferSize: SendBufferSizeOption{minBufferSize, DefaultBufferSize, maxBufferSize},
+		recvBufferSize: ReceiveBufferSizeOption{minBufferSize, DefaultBufferSize, maxBufferSize},
+	}
 }
 
 // Number returns the ICMP protocol number.
@@ -98,38 +148,87 @@ func (p *protocol) MinimumPacketSize() int {
 
 // ParsePorts returns the source and destination ports stored in the given icmp
 // packet.
+//
+// The identifier of an echo request is its source port and that of any other
+// message its destination port, so that both echo replies and errors quoting
+// one of our requests are delivered to the endpoint that sent the request.
 func (p *protocol) ParsePorts(v buffer.View) (src, dst uint16, err *tcpip.Error) {
+	var ident uint16
+	var request bool
 	switch p.number {
 	case ProtocolNumber4:
-		return 0, binary.BigEndian.Uint16(v[header.ICMPv4MinimumSize:]), nil
+		ident = binary.BigEndian.Uint16(v[header.ICMPv4MinimumSize:])
+		request = header.ICMPv4(v).Type() == header.ICMPv4Echo
 	case ProtocolNumber6:
-		return 0, binary.BigEndian.Uint16(v[header.ICMPv6MinimumSize:]), nil
+		ident = binary.BigEndian.Uint16(v[header.ICMPv6MinimumSize:])
+		request = header.ICMPv6(v).Type() == header.ICMPv6EchoRequest
+	default:
+		panic(fmt.Sprint("unknown protocol number: ", p.number))
 	}
-	panic(fmt.Sprint("unknown protocol number: ", p.number))
+	if request {
+		return ident, 0, nil
+	}
+	return 0, ident, nil
 }
 
 // HandleUnknownDestinationPacket handles packets targeted at this protocol but
 // that don't match any existing endpoint.
-func (p *protocol) HandleUnknownDestinationPacket(*stack.Route, stack.TransportEndpointID, buffer.VectorisedView) bool {
+func (p *protocol) HandleUnknownDestinationPacket(*stack.Route, stack.TransportEndpointID, *stack.PacketBuffer) bool {
 	return true
 }
 
 // SetOption implements TransportProtocol.SetOption.
 func (p *protocol) SetOption(option interface{}) *tcpip.Error {
-	return tcpip.ErrUnknownProtocolOption
+	switch v := option.(type) {
+	case SendBufferSizeOption:
+		if v.Min <= 0 || v.Default < v.Min || v.Default > v.Max {
+			return tcpip.ErrInvalidOptionValue
+		}
+		p.mu.Lock()
+		p.sendBufferSize = v
+		p.mu.Unlock()
+		return nil
+
+	case ReceiveBufferSizeOption:
+		if v.Min <= 0 || v.Default < v.Min || v.Default > v.Max {
+			return tcpip.ErrInvalidOptionValue
+		}
+		p.mu.Lock()
+		p.recvBufferSize = v
+		p.mu.Unlock()
+		return nil
+
+	default:
+		return tcpip.ErrUnknownProtocolOption
+	}
 }
 
 // Option implements TransportProtocol.Option.
 func (p *protocol) Option(option interface{}) *tcpip.Error {
-	return tcpip.ErrUnknownProtocolOption
+	switch v := option.(type) {
+	case *SendBufferSizeOption:
+		p.mu.Lock()
+		*v = p.sendBufferSize
+		p.mu.Unlock()
+		return nil
+
+	case *ReceiveBufferSizeOption:
+		p.mu.Lock()
+		*v = p.recvBufferSize
+		p.mu.Unlock()
+		return nil
+
+	default:
+		return tcpip.ErrUnknownProtocolOption
+	}
 }
 
 func init() {
 	stack.RegisterTransportProtocolFactory(ProtocolName4, func() stack.TransportProtocol {
-		return &protocol{ProtocolNumber4}
+		return newProtocol(ProtocolNumber4)
 	})
 
 	stack.RegisterTransportProtocolFactory(ProtocolName6, func() stack.TransportProtocol {
-		return &protocol{ProtocolNumber6}
+		return newProtocol(ProtocolNumber6)
 	})
 }
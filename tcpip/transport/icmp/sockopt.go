@@ -0,0 +1,126 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package icmp
+
+import (
+	"github.com/google/netstack/tcpip"
+)
+
+// SockOpts holds the socket options of ICMP endpoints. Embedders may register
+// options of their own types in it, including stored ones.
+var SockOpts tcpip.SockOptTable
+
+func init() {
+	SockOpts.RegisterInt(tcpip.SendBufferSizeOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return e.sndBufSize, nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		e := ep.(*endpoint)
+		var ss SendBufferSizeOption
+		if err := e.stack.TransportProtocolOption(e.transProto, &ss); err == nil {
+			v = tcpip.ClampBufferSize(v, ss.Min, ss.Max)
+		}
+		e.mu.Lock()
+		e.sndBufSize = v
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.ReceiveBufferSizeOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		return e.rcvBufSizeMax, nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		e := ep.(*endpoint)
+		var rs ReceiveBufferSizeOption
+		if err := e.stack.TransportProtocolOption(e.transProto, &rs); err == nil {
+			v = tcpip.ClampBufferSize(v, rs.Min, rs.Max)
+		}
+		e.rcvMu.Lock()
+		e.rcvBufSizeMax = v
+		e.rcvMu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.ReceiveQueueSizeOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		if e.rcvList.Empty() {
+			return 0, nil
+		}
+		return e.rcvList.Front().data.Size(), nil
+	}, nil)
+
+	SockOpts.RegisterInt(tcpip.TTLOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return int(e.ttl), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.ttl = uint8(v)
+		return nil
+	})
+
+	// ICMP doesn't support keepalives.
+	SockOpts.RegisterBool(tcpip.KeepaliveEnabledOption(0), func(tcpip.Endpoint) (bool, *tcpip.Error) {
+		return false, nil
+	}, nil)
+
+	SockOpts.RegisterBool(tcpip.RecvErrOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		return e.recvErr, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		e.recvErr = v
+		if !v {
+			// Like Linux, drop the errors queued so far.
+			e.errQueue = nil
+			e.errQueueSize = 0
+			e.errQueueMem = 0
+		}
+		e.rcvMu.Unlock()
+		return nil
+	})
+
+	SockOpts.Register(tcpip.ICMPFilterOption{}, func(ep tcpip.Endpoint, opt interface{}) *tcpip.Error {
+		e := ep.(*endpoint)
+		if !e.raw {
+			return tcpip.ErrNotSupported
+		}
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		*opt.(*tcpip.ICMPFilterOption) = e.icmpFilter
+		return nil
+	}, func(ep tcpip.Endpoint, opt interface{}) *tcpip.Error {
+		e := ep.(*endpoint)
+		if !e.raw {
+			return tcpip.ErrNotSupported
+		}
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		e.icmpFilter = opt.(tcpip.ICMPFilterOption)
+		return nil
+	})
+}
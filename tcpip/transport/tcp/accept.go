@@ -17,9 +17,8 @@ package tcp
 import (
 	"crypto/sha1"
 	"encoding/binary"
-	"hash"
-	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/netstack/rand"
@@ -74,10 +73,9 @@ func encodeMSS(mss uint16) uint32 {
 }
 
 // syncRcvdCount is the number of endpoints in the SYN-RCVD state. The value is
-// protected by a mutex so that we can increment only when it's guaranteed not
-// to go above a threshold.
+// accessed atomically, and only incremented with a compare-and-swap so that it
+// never goes above the threshold, without a lock shared by all listeners.
 var synRcvdCount struct {
-	sync.Mutex
 	value   uint64
 	pending sync.WaitGroup
 }
@@ -87,46 +85,48 @@ var synRcvdCount struct {
 // and must not be accessed or have its methods called concurrently as they
 // may mutate the stored objects.
 type listenContext struct {
-	stack  *stack.Stack
-	rcvWnd seqnum.Size
-	nonce  [2][sha1.BlockSize]byte
-
-	hasherMu sync.Mutex
-	hasher   hash.Hash
+	stack    *stack.Stack
+	rcvWnd   seqnum.Size
+	nonce    [2][sha1.BlockSize]byte
 	v6only   bool
 	netProto tcpip.NetworkProtocolNumber
+
+	// mptcp is set if Multipath TCP is accepted. Connections completed
+	// with SYN cookies never use it.
+	mptcp bool
+
+	// listenEP is the listening endpoint whose socket options new
+	// endpoints inherit, or nil for the forwarder.
+	listenEP *endpoint
 }
 
-// timeStamp returns an 8-bit timestamp with a granularity of 64 seconds.
-func timeStamp() uint32 {
-	return uint32(time.Now().Unix()>>6) & tsMask
+// timeStamp returns an 8-bit timestamp of now with a granularity of 64
+// seconds.
+func timeStamp(now time.Time) uint32 {
+	return uint32(now.Unix()>>6) & tsMask
 }
 
 // incSynRcvdCount tries to increment the global number of endpoints in SYN-RCVD
 // state. It succeeds if the increment doesn't make the count go beyond the
 // threshold, and fails otherwise.
 func incSynRcvdCount() bool {
-	synRcvdCount.Lock()
-	defer synRcvdCount.Unlock()
-
-	if synRcvdCount.value >= SynRcvdCountThreshold {
-		return false
+	for {
+		v := atomic.LoadUint64(&synRcvdCount.value)
+		if v >= SynRcvdCountThreshold {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&synRcvdCount.value, v, v+1) {
+			synRcvdCount.pending.Add(1)
+			return true
+		}
 	}
-
-	synRcvdCount.pending.Add(1)
-	synRcvdCount.value++
-
-	return true
 }
 
 // decSynRcvdCount atomically decrements the global number of endpoints in
 // SYN-RCVD state. It must only be called if a previous call to incSynRcvdCount
 // succeeded.
 func decSynRcvdCount() {
-	synRcvdCount.Lock()
-	defer synRcvdCount.Unlock()
-
-	synRcvdCount.value--
+	atomic.AddUint64(&synRcvdCount.value, ^uint64(0))
 	synRcvdCount.pending.Done()
 }
 
@@ -135,7 +135,6 @@ func newListenContext(stack *stack.Stack, rcvWnd seqnum.Size, v6only bool, netPr
 	l := &listenContext{
 		stack:    stack,
 		rcvWnd:   rcvWnd,
-		hasher:   sha1.New(),
 		v6only:   v6only,
 		netProto: netProto,
 	}
@@ -147,35 +146,29 @@ func newListenContext(stack *stack.Stack, rcvWnd seqnum.Size, v6only bool, netPr
 }
 
 // cookieHash calculates the cookieHash for the given id, timestamp and nonce
-// index. The hash is used to create and validate cookies.
+// index. The hash is used to create and validate cookies. It is computed on the
+// stack, so that the handshake goroutines and the listen goroutine don't share
+// a hasher and its lock.
 func (l *listenContext) cookieHash(id stack.TransportEndpointID, ts uint32, nonceIndex int) uint32 {
-
-	// Initialize block with fixed-size data: local ports and v.
-	var payload [8]byte
-	binary.BigEndian.PutUint16(payload[0:], id.LocalPort)
-	binary.BigEndian.PutUint16(payload[2:], id.RemotePort)
-	binary.BigEndian.PutUint32(payload[4:], ts)
-
-	// Feed everything to the hasher.
-	l.hasherMu.Lock()
-	l.hasher.Reset()
-	l.hasher.Write(payload[:])
-	l.hasher.Write(l.nonce[nonceIndex][:])
-	io.WriteString(l.hasher, string(id.LocalAddress))
-	io.WriteString(l.hasher, string(id.RemoteAddress))
-
-	// Finalize the calculation of the hash and return the first 4 bytes.
-	h := make([]byte, 0, sha1.Size)
-	h = l.hasher.Sum(h)
-	l.hasherMu.Unlock()
-
+	// Initialize block with fixed-size data: local ports and v, then
+	// append the nonce and the addresses.
+	var buf [8 + sha1.BlockSize + 2*header.IPv6AddressSize]byte
+	binary.BigEndian.PutUint16(buf[0:], id.LocalPort)
+	binary.BigEndian.PutUint16(buf[2:], id.RemotePort)
+	binary.BigEndian.PutUint32(buf[4:], ts)
+	b := append(buf[:8], l.nonce[nonceIndex][:]...)
+	b = append(b, id.LocalAddress...)
+	b = append(b, id.RemoteAddress...)
+
+	// Return the first 4 bytes of the hash.
+	h := sha1.Sum(b)
 	return binary.BigEndian.Uint32(h[:])
 }
 
 // createCookie creates a SYN cookie for the given id and incoming sequence
 // number.
 func (l *listenContext) createCookie(id stack.TransportEndpointID, seq seqnum.Value, data uint32) seqnum.Value {
-	ts := timeStamp()
+	ts := timeStamp(l.stack.Now())
 	v := l.cookieHash(id, 0, 0) + uint32(seq) + (ts << tsOffset)
 	v += (l.cookieHash(id, ts, 1) + data) & hashMask
 	return seqnum.Value(v)
@@ -185,7 +178,7 @@ func (l *listenContext) createCookie(id stack.TransportEndpointID, seq seqnum.Va
 // sequence number. If it is, it also returns the data originally encoded in the
 // cookie when createCookie was called.
 func (l *listenContext) isCookieValid(id stack.TransportEndpointID, cookie seqnum.Value, seq seqnum.Value) (uint32, bool) {
-	ts := timeStamp()
+	ts := timeStamp(l.stack.Now())
 	v := uint32(cookie) - l.cookieHash(id, 0, 0) - uint32(seq)
 	cookieTS := v >> tsOffset
 	if ((ts - cookieTS) & tsMask) > maxTSDiff {
@@ -210,12 +203,22 @@ func (l *listenContext) createConnectedEndpoint(s *segment, iss seqnum.Value, ir
 	n.route = s.route.Clone()
 	n.effectiveNetProtos = []tcpip.NetworkProtocolNumber{s.route.NetProto}
 	n.rcvBufSize = int(l.rcvWnd)
+	if l.listenEP != nil {
+		n.vrf = l.listenEP.vrf
+		atomic.StoreUint32(&n.ttl, atomic.LoadUint32(&l.listenEP.ttl))
+		atomic.StoreUint32(&n.minTTL, atomic.LoadUint32(&l.listenEP.minTTL))
+		atomic.StoreUint32(&n.sendTOS, atomic.LoadUint32(&l.listenEP.sendTOS))
+		atomic.StoreUint32(&n.sendTClass, atomic.LoadUint32(&l.listenEP.sendTClass))
+		atomic.StoreUint32(&n.flowLabel, atomic.LoadUint32(&l.listenEP.flowLabel))
+		atomic.StoreUint32(&n.transparent, atomic.LoadUint32(&l.listenEP.transparent))
+		n.setDelayedAck(l.listenEP.delayedAck())
+	}
 
 	n.maybeEnableTimestamp(rcvdSynOpts)
 	n.maybeEnableSACKPermitted(rcvdSynOpts)
 
 	// Register new endpoint so that packets are routed to it.
-	if err := n.stack.RegisterTransportEndpoint(n.boundNICID, n.effectiveNetProtos, ProtocolNumber, n.id, n, n.reusePort); err != nil {
+	if err := n.stack.RegisterTransportEndpointInVRF(n.vrf, n.boundNICID, n.effectiveNetProtos, ProtocolNumber, n.id, n, n.reusePort); err != nil {
 		n.Close()
 		return nil, err
 	}
@@ -248,11 +251,22 @@ func (l *listenContext) createEndpointAndPerformHandshake(s *segment, opts *head
 	h := newHandshake(ep, l.rcvWnd)
 
 	h.resetToSynRcvd(cookie, irs, opts)
+	if l.mptcp && opts.MPCapable && acceptableMPCapable(&opts.MPTCP) {
+		h.mptcpKey = newMPTCPKey()
+	}
 	if err := h.execute(); err != nil {
 		ep.Close()
 		return nil, err
 	}
 
+	// The sender was created before the handshake, so its maximum payload
+	// size must leave room for the Multipath TCP option if it was
+	// negotiated.
+	if ep.mptcp != nil {
+		ep.snd.maxPayloadSize -= mptcpOptionSpace
+		ep.snd.peerMaxPayloadSize -= mptcpOptionSpace
+	}
+
 	// Update the receive window scaling. We can't do it before the
 	// handshake because it's possible that the peer doesn't support window
 	// scaling.
@@ -261,18 +275,155 @@ func (l *listenContext) createEndpointAndPerformHandshake(s *segment, opts *head
 	return ep, nil
 }
 
-// deliverAccepted delivers the newly-accepted endpoint to the listener. If the
-// endpoint has transitioned out of the listen state, the new endpoint is closed
-// instead.
+// openAcceptQueue prepares the accept queue of the endpoint, which starts
+// listening with the given backlog.
+func (e *endpoint) openAcceptQueue(backlog int) {
+	e.acceptMu.Lock()
+	e.acceptBacklog = backlog
+	e.acceptClosed = false
+	e.acceptMu.Unlock()
+}
+
+// setAcceptBacklog changes the backlog of a listening endpoint, which must not
+// be lower than the number of connections already queued.
+func (e *endpoint) setAcceptBacklog(backlog int) *tcpip.Error {
+	e.acceptMu.Lock()
+	defer e.acceptMu.Unlock()
+
+	if len(e.acceptQueue) > backlog {
+		return tcpip.ErrInvalidEndpointState
+	}
+	e.acceptBacklog = backlog
+	e.acceptCond.Broadcast()
+	return nil
+}
+
+// closeAcceptQueue marks the endpoint as no longer listening, so that the
+// connections completed from now on are closed, and returns the connections
+// that were queued.
+func (e *endpoint) closeAcceptQueue() []*endpoint {
+	e.acceptMu.Lock()
+	defer e.acceptMu.Unlock()
+
+	q := e.acceptQueue
+	e.acceptQueue = nil
+	e.acceptClosed = true
+	e.acceptCond.Broadcast()
+	return q
+}
+
+// acceptQueueFullLocked returns whether the accept queue has no room for
+// another connection. One connection may be queued even with a zero backlog.
+// e.acceptMu must be held.
+func (e *endpoint) acceptQueueFullLocked() bool {
+	return len(e.acceptQueue) > 0 && len(e.acceptQueue) >= e.acceptBacklog
+}
+
+// acceptQueueFull returns whether the accept queue has no room for another
+// connection.
+func (e *endpoint) acceptQueueFull() bool {
+	e.acceptMu.Lock()
+	defer e.acceptMu.Unlock()
+	return e.acceptQueueFullLocked()
+}
+
+// dequeueAccepted returns the first connection of the accept queue, or nil if
+// it's empty.
+func (e *endpoint) dequeueAccepted() *endpoint {
+	e.acceptMu.Lock()
+	defer e.acceptMu.Unlock()
+
+	if len(e.acceptQueue) == 0 {
+		return nil
+	}
+	n := e.acceptQueue[0]
+	e.acceptQueue[0] = nil
+	e.acceptQueue = e.acceptQueue[1:]
+	e.acceptCond.Signal()
+	return n
+}
+
+// deliverAccepted delivers the newly-accepted endpoint to the listener, waiting
+// for room in its accept queue. If the endpoint has transitioned out of the
+// listen state, the new endpoint is closed instead. The listener's mu isn't
+// held, so that handshakes complete concurrently with each other and with
+// calls on the listener.
 func (e *endpoint) deliverAccepted(n *endpoint) {
-	e.mu.RLock()
-	if e.state == stateListen {
-		e.acceptedChan <- n
-		e.waiterQueue.Notify(waiter.EventIn)
-	} else {
+	e.acceptMu.Lock()
+	for !e.acceptClosed && e.acceptQueueFullLocked() {
+		e.acceptCond.Wait()
+	}
+	if e.acceptClosed {
+		e.acceptMu.Unlock()
 		n.Close()
+		return
+	}
+	e.acceptQueue = append(e.acceptQueue, n)
+	e.acceptMu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventIn)
+}
+
+// admitSyn applies the TCPListenLimitOption of the endpoint to a SYN from
+// addr. It returns whether the SYN may be handled by an endpoint in SYN-RCVD
+// state, in which case releaseSyn must be called once the handshake ends, and
+// if not, whether the SYN must be dropped rather than answered with a SYN
+// cookie.
+func (e *endpoint) admitSyn(addr tcpip.Address) (admit, drop bool) {
+	e.listenLimitMu.Lock()
+	defer e.listenLimitMu.Unlock()
+
+	l := &e.listenLimit
+	if l.Rate > 0 {
+		now := e.stack.Clock().NowMonotonic()
+		e.synTokens += float64(now-e.synRefill) / float64(time.Second) * l.Rate
+		if e.synTokens > float64(l.Burst) {
+			e.synTokens = float64(l.Burst)
+		}
+		e.synRefill = now
+		if e.synTokens < 1 {
+			return false, l.Drop
+		}
+	}
+	if l.MaxPendingPerSource > 0 && e.synRcvdBySource[addr] >= l.MaxPendingPerSource {
+		return false, l.Drop
+	}
+
+	if l.Rate > 0 {
+		e.synTokens--
+	}
+	if e.synRcvdBySource == nil {
+		e.synRcvdBySource = make(map[tcpip.Address]int)
 	}
-	e.mu.RUnlock()
+	e.synRcvdBySource[addr]++
+	return true, false
+}
+
+// releaseSyn records the end of the handshake of a connection from addr
+// admitted by admitSyn.
+func (e *endpoint) releaseSyn(addr tcpip.Address) {
+	e.listenLimitMu.Lock()
+	defer e.listenLimitMu.Unlock()
+
+	if e.synRcvdBySource[addr]--; e.synRcvdBySource[addr] <= 0 {
+		delete(e.synRcvdBySource, addr)
+	}
+}
+
+// setListenLimit sets the TCPListenLimitOption of the endpoint. The token
+// bucket starts full.
+func (e *endpoint) setListenLimit(l tcpip.TCPListenLimitOption) *tcpip.Error {
+	if l.Rate < 0 || l.Burst < 0 || l.MaxPendingPerSource < 0 || (l.Rate > 0 && l.Burst < 1) {
+		return tcpip.ErrInvalidOptionValue
+	}
+
+	e.listenLimitMu.Lock()
+	defer e.listenLimitMu.Unlock()
+
+	e.listenLimit = l
+	e.synTokens = float64(l.Burst)
+	e.synRefill = e.stack.Clock().NowMonotonic()
+	return nil
 }
 
 // handleSynSegment is called in its own goroutine once the listening endpoint
@@ -283,6 +434,7 @@ func (e *endpoint) deliverAccepted(n *endpoint) {
 // cookies to accept connections.
 func (e *endpoint) handleSynSegment(ctx *listenContext, s *segment, opts *header.TCPSynOptions) {
 	defer decSynRcvdCount()
+	defer e.releaseSyn(s.id.RemoteAddress)
 	defer s.decRef()
 
 	n, err := ctx.createEndpointAndPerformHandshake(s, opts)
@@ -299,10 +451,20 @@ func (e *endpoint) handleListenSegment(ctx *listenContext, s *segment) {
 	switch s.flags {
 	case header.TCPFlagSyn:
 		opts := parseSynSegmentOptions(s)
-		if incSynRcvdCount() {
+		admit, drop := e.admitSyn(s.id.RemoteAddress)
+		if !admit {
+			e.stack.Stats().TCP.ListenLimitedSyns.Increment()
+			if drop {
+				return
+			}
+		}
+		if admit && incSynRcvdCount() {
 			s.incRef()
 			go e.handleSynSegment(ctx, s, &opts)
 		} else {
+			if admit {
+				e.releaseSyn(s.id.RemoteAddress)
+			}
 			cookie := ctx.createCookie(s.id, s.sequenceNumber, encodeMSS(opts.MSS))
 			// Send SYN with window scaling because we currently
 			// dont't encode this information in the cookie.
@@ -312,14 +474,22 @@ func (e *endpoint) handleListenSegment(ctx *listenContext, s *segment) {
 			synOpts := header.TCPSynOptions{
 				WS:    -1,
 				TS:    opts.TS,
-				TSVal: tcpTimeStamp(timeStampOffset()),
+				TSVal: tcpTimeStamp(e.stack.Now(), timeStampOffset()),
 				TSEcr: opts.TSVal,
 			}
-			sendSynTCP(&s.route, s.id, header.TCPFlagSyn|header.TCPFlagAck, cookie, s.sequenceNumber+1, ctx.rcvWnd, synOpts)
+			sendSynTCP(&s.route, s.id, e.headerParams(&s.route), header.TCPFlagSyn|header.TCPFlagAck, cookie, s.sequenceNumber+1, ctx.rcvWnd, synOpts)
 		}
 
 	case header.TCPFlagAck:
 		if data, ok := ctx.isCookieValid(s.id, s.ackNumber-1, s.sequenceNumber-1); ok && int(data) < len(mssTable) {
+			// Like Linux, drop the ACK while the accept queue is
+			// full rather than blocking the listen goroutine; the
+			// peer retransmits it.
+			if e.acceptQueueFull() {
+				e.stack.Stats().TCP.ListenOverflowAckDrops.Increment()
+				return
+			}
+
 			// Create newly accepted endpoint and deliver it.
 			rcvdSynOptions := &header.TCPSynOptions{
 				MSS: mssTable[data],
@@ -373,9 +543,12 @@ func (e *endpoint) protocolListenLoop(rcvWnd seqnum.Size) *tcpip.Error {
 
 	e.mu.Lock()
 	v6only := e.v6only
+	mptcp := e.mptcpEnabled
 	e.mu.Unlock()
 
 	ctx := newListenContext(e.stack, rcvWnd, v6only, e.netProto)
+	ctx.mptcp = mptcp
+	ctx.listenEP = e
 
 	s := sleep.Sleeper{}
 	s.AddWaker(&e.notificationWaker, wakerForNotification)
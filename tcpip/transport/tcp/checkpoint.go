@@ -0,0 +1,481 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/seqnum"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+// checkpoint is the state of an endpoint held in a stack.EndpointCheckpoint.
+//
+// The connections being established by a listener are left out, their peers
+// send their SYNs again. So are the out-of-order data and SACK information of
+// connections: restored connections resend the data that was in flight, and
+// their peers resend what wasn't acknowledged.
+type checkpoint struct {
+	SockOpts []tcpip.SavedSockOpt
+	NetProto tcpip.NetworkProtocolNumber
+	State    endpointState
+
+	// NICID is the NIC the endpoint is bound to, BindAddress the address
+	// it was bound to by the user, and LocalAddress and LocalPort the ones
+	// of its identifier.
+	NICID        tcpip.NICID
+	BindAddress  tcpip.Address
+	LocalAddress tcpip.Address
+	LocalPort    uint16
+
+	// Remote is the address of the peer, as given to Connect.
+	Remote tcpip.FullAddress
+
+	// Backlog and Accepted are the backlog of a listening endpoint and
+	// the connections waiting in its accept queue.
+	Backlog  int
+	Accepted []checkpoint
+
+	ShutdownFlags     tcpip.ShutdownFlags
+	IsConnectNotified bool
+	HardError         string
+	LastError         string
+
+	RcvClosed bool
+	Rcv       []rcvCheckpoint
+	ErrQueue  []tcpip.SockError
+
+	// Conn is the state of the connection of a connected endpoint.
+	Conn *connCheckpoint
+}
+
+// rcvCheckpoint is data of the receive queue held in a checkpoint.
+type rcvCheckpoint struct {
+	Data     []byte
+	RcvdTime int64
+}
+
+// sndCheckpoint is a segment of the send queue or list held in a checkpoint.
+// Segments without flags weren't sent yet, and those without data are FINs.
+type sndCheckpoint struct {
+	Seq          seqnum.Value
+	Flags        uint8
+	Data         []byte
+	XmitCount    uint32
+	Timestamping tcpip.TimestampingOption
+}
+
+// connCheckpoint is the state of a connection held in a checkpoint.
+type connCheckpoint struct {
+	SendTSOk      bool
+	RecentTS      uint32
+	TSVal         uint32
+	SACKPermitted bool
+
+	// MSS is the MSS advertised by the peer.
+	MSS uint16
+
+	SndUna      seqnum.Value
+	SndNxt      seqnum.Value
+	SndNxtList  seqnum.Value
+	SndWnd      seqnum.Size
+	SndWndScale uint8
+	SndCwnd     int
+	SndSsthresh int
+	RTO         time.Duration
+	SRTT        time.Duration
+	RTTVar      time.Duration
+	SRTTInited  bool
+	MaxSentAck  seqnum.Value
+	TSBase      seqnum.Value
+	SndClosed   bool
+
+	// WriteList and SndQueue are the segments of the send list and send
+	// queue, SndBufUsed and SndBufInFlight the number of bytes of the send
+	// buffer written and sent, and WriteClosed is set once the endpoint is
+	// shut down for writing.
+	WriteList      []sndCheckpoint
+	SndQueue       []sndCheckpoint
+	SndBufUsed     int
+	SndBufInFlight int
+	WriteClosed    bool
+
+	RcvNxt      seqnum.Value
+	RcvAcc      seqnum.Value
+	RcvWndScale uint8
+	RcvClosed   bool
+}
+
+// Checkpoint implements stack.CheckpointableEndpoint.Checkpoint. A connected
+// endpoint is frozen while its connection is saved.
+func (e *endpoint) Checkpoint() (stack.EndpointCheckpoint, error) {
+	c, err := e.checkpoint()
+	if err != nil {
+		return stack.EndpointCheckpoint{}, err
+	}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(c); err != nil {
+		return stack.EndpointCheckpoint{}, tcpip.ErrSaveRejection{Err: err}
+	}
+	return stack.EndpointCheckpoint{
+		TransportProtocol: ProtocolNumber,
+		NetworkProtocol:   e.netProto,
+		State:             b.Bytes(),
+	}, nil
+}
+
+func (e *endpoint) checkpoint() (*checkpoint, error) {
+	c := &checkpoint{SockOpts: SockOpts.Save(e), NetProto: e.netProto}
+
+	// Stop the protocol goroutine of a connection between two segments,
+	// so that its state is consistent. It waits until undrain is closed.
+	e.mu.Lock()
+	if e.mptcp != nil {
+		e.mu.Unlock()
+		return nil, tcpip.ErrSaveRejection{Err: errors.New("multipath TCP connections can't be saved")}
+	}
+	var undrain chan struct{}
+	if e.workerRunning && e.state == stateConnected && e.drainDone == nil {
+		e.drainDone = make(chan struct{})
+		e.undrain = make(chan struct{})
+		undrain = e.undrain
+		drainDone := e.drainDone
+		e.notifyProtocolGoroutine(notifyDrain)
+		e.mu.Unlock()
+		<-drainDone
+		e.mu.Lock()
+	}
+	defer func() {
+		if undrain != nil {
+			e.mu.Lock()
+			e.drainDone = nil
+			e.mu.Unlock()
+			close(undrain)
+		}
+	}()
+
+	c.State = e.state
+	c.NICID = e.boundNICID
+	c.BindAddress = e.bindAddress
+	c.LocalAddress = e.id.LocalAddress
+	c.LocalPort = e.id.LocalPort
+	c.Remote = tcpip.FullAddress{NIC: e.boundNICID, Addr: e.userAddress(e.id.RemoteAddress), Port: e.id.RemotePort}
+	c.ShutdownFlags = e.shutdownFlags
+	c.IsConnectNotified = e.isConnectNotified
+	if e.hardError != nil {
+		c.HardError = e.hardError.String()
+	}
+	// The worker of a connection may have exited while it was frozen, in
+	// which case it isn't connected anymore.
+	if e.state == stateConnected && e.snd != nil {
+		c.Conn = e.connCheckpoint()
+	}
+	e.mu.Unlock()
+
+	if c.State == stateListen {
+		e.acceptMu.Lock()
+		c.Backlog = e.acceptBacklog
+		accepted := append([]*endpoint(nil), e.acceptQueue...)
+		e.acceptMu.Unlock()
+
+		// The accepted endpoints have no protocol goroutine, so they
+		// needn't be frozen.
+		for _, n := range accepted {
+			nc, err := n.checkpoint()
+			if err != nil {
+				return nil, err
+			}
+			c.Accepted = append(c.Accepted, *nc)
+		}
+	}
+
+	e.rcvListMu.Lock()
+	c.RcvClosed = e.rcvClosed
+	for s := e.rcvList.Front(); s != nil; s = s.Next() {
+		for _, v := range s.data.Views()[s.viewToDeliver:] {
+			c.Rcv = append(c.Rcv, rcvCheckpoint{Data: v, RcvdTime: s.rcvdTime.UnixNano()})
+		}
+	}
+	e.rcvListMu.Unlock()
+
+	e.errQueueMu.Lock()
+	for _, se := range e.errQueue {
+		c.ErrQueue = append(c.ErrQueue, *se)
+	}
+	e.errQueueMu.Unlock()
+
+	if err := e.lastError.Peek(); err != nil {
+		c.LastError = err.String()
+	}
+	return c, nil
+}
+
+// connCheckpoint returns the state of the connection of e. e.mu must be held,
+// and the protocol goroutine must be frozen or not running.
+func (e *endpoint) connCheckpoint() *connCheckpoint {
+	s, r := e.snd, e.rcv
+
+	mss := uint16(header.TCPMaxMSS)
+	if s.peerMaxPayloadSize != math.MaxInt32 {
+		mss = uint16(s.peerMaxPayloadSize + e.maxOptionSize())
+	}
+	s.rtt.Lock()
+	srtt, rttvar := s.rtt.srtt, s.rtt.rttvar
+	s.rtt.Unlock()
+
+	c := &connCheckpoint{
+		SendTSOk:      e.sendTSOk,
+		RecentTS:      e.recentTS,
+		TSVal:         e.timestamp(),
+		SACKPermitted: e.sackPermitted,
+		MSS:           mss,
+		SndUna:        s.sndUna,
+		SndNxt:        s.sndNxt,
+		SndNxtList:    s.sndNxtList,
+		SndWnd:        s.sndWnd,
+		SndWndScale:   s.sndWndScale,
+		SndCwnd:       s.sndCwnd,
+		SndSsthresh:   s.sndSsthresh,
+		RTO:           s.rto,
+		SRTT:          srtt,
+		RTTVar:        rttvar,
+		SRTTInited:    s.srttInited,
+		MaxSentAck:    s.maxSentAck,
+		TSBase:        s.tsBase,
+		SndClosed:     s.closed,
+		WriteList:     sndCheckpoints(&s.writeList),
+		RcvNxt:        r.rcvNxt,
+		RcvAcc:        r.rcvAcc,
+		RcvWndScale:   r.rcvWndScale,
+		RcvClosed:     r.closed,
+	}
+
+	e.sndBufMu.Lock()
+	c.SndQueue = sndCheckpoints(&e.sndQueue)
+	c.SndBufUsed = e.sndBufUsed
+	c.SndBufInFlight = e.sndBufInFlight
+	c.WriteClosed = e.sndClosed
+	e.sndBufMu.Unlock()
+
+	return c
+}
+
+// sndCheckpoints returns the segments of l as held in a checkpoint.
+func sndCheckpoints(l *segmentList) []sndCheckpoint {
+	var segs []sndCheckpoint
+	for s := l.Front(); s != nil; s = s.Next() {
+		segs = append(segs, sndCheckpoint{
+			Seq:          s.sequenceNumber,
+			Flags:        s.flags,
+			Data:         s.data.ToView(),
+			XmitCount:    s.xmitCount,
+			Timestamping: s.timestamping,
+		})
+	}
+	return segs
+}
+
+// RestoreEndpoint implements stack.EndpointRestorer.RestoreEndpoint.
+func (*protocol) RestoreEndpoint(s *stack.Stack, ec stack.EndpointCheckpoint, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
+	var c checkpoint
+	if err := gob.NewDecoder(bytes.NewReader(ec.State)).Decode(&c); err != nil {
+		return nil, tcpip.ErrInvalidOptionValue
+	}
+	e := newEndpoint(s, ec.NetworkProtocol, waiterQueue)
+	if err := e.restore(&c, true); err != nil {
+		e.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// restore brings the new endpoint e to the state held in c: it sets its
+// options, binds it, listens or connects again, and refills its queues. The
+// protocol goroutine of a connection is only started if run is true, it isn't
+// for the connections waiting to be accepted.
+func (e *endpoint) restore(c *checkpoint, run bool) *tcpip.Error {
+	if err := SockOpts.Restore(e, c.SockOpts); err != nil {
+		return err
+	}
+
+	// The receive queue is filled first, so that the protocol goroutine
+	// finds it when it starts.
+	e.rcvListMu.Lock()
+	e.rcvClosed = c.RcvClosed
+	for _, rc := range c.Rcv {
+		s := newSegmentFromView(nil, e.id, rc.Data)
+		s.rcvdTime = time.Unix(0, rc.RcvdTime)
+		e.rcvList.PushBack(s)
+		e.rcvBufUsed += len(rc.Data)
+	}
+	e.rcvListMu.Unlock()
+
+	e.errQueueMu.Lock()
+	for i := range c.ErrQueue {
+		se := &c.ErrQueue[i]
+		e.errQueue = append(e.errQueue, se)
+		e.errQueueMem += se.ControlSize()
+	}
+	e.errQueueMu.Unlock()
+
+	if err := tcpip.ErrorFromMessage(c.LastError); err != nil {
+		e.lastError.Set(err)
+	}
+
+	switch c.State {
+	case stateBound, stateListen:
+		if err := e.Bind(tcpip.FullAddress{NIC: c.NICID, Addr: c.BindAddress, Port: c.LocalPort}); err != nil {
+			return err
+		}
+		if c.State == stateBound {
+			break
+		}
+		if err := e.Listen(c.Backlog); err != nil {
+			return err
+		}
+		for i := range c.Accepted {
+			n := newEndpoint(e.stack, c.Accepted[i].NetProto, nil)
+			if err := n.restore(&c.Accepted[i], false); err != nil {
+				n.Close()
+				return err
+			}
+			e.deliverAccepted(n)
+		}
+
+	case stateConnecting, stateConnected:
+		// Connecting from the bound state registers the endpoint with
+		// the identifier it had.
+		e.mu.Lock()
+		e.state = stateBound
+		e.boundNICID = c.NICID
+		e.bindAddress = c.BindAddress
+		e.id.LocalAddress = c.LocalAddress
+		e.id.LocalPort = c.LocalPort
+		if cc := c.Conn; cc != nil {
+			e.sendTSOk = cc.SendTSOk
+			e.recentTS = cc.RecentTS
+			e.tsOffset = cc.TSVal - tcpTimeStamp(e.stack.Now(), 0)
+			e.sackPermitted = cc.SACKPermitted
+		}
+		e.mu.Unlock()
+
+		if err := e.connect(c.Remote, c.Conn, run); err != tcpip.ErrConnectStarted {
+			return err
+		}
+		e.mu.Lock()
+		e.isConnectNotified = c.IsConnectNotified
+		e.mu.Unlock()
+
+	case stateClosed, stateError:
+		e.mu.Lock()
+		e.state = c.State
+		e.hardError = tcpip.ErrorFromMessage(c.HardError)
+		e.mu.Unlock()
+	}
+
+	e.mu.Lock()
+	e.shutdownFlags = c.ShutdownFlags
+	e.mu.Unlock()
+	return nil
+}
+
+// restoreConnectionLocked sets up the connection of e, which has just been
+// routed to its peer, from c instead of a handshake. e.mu must be held.
+//
+// The data in flight is marked to be sent again as soon as the protocol
+// goroutine starts, as if the retransmission timer expired: the packets on the
+// way when the connection was saved are likely lost.
+func (e *endpoint) restoreConnectionLocked(c *connCheckpoint) {
+	s := newSender(e, c.SndUna-1, c.RcvNxt-1, c.SndWnd, c.MSS, int(c.SndWndScale))
+	s.sndNxt = c.SndNxt
+	s.sndNxtList = c.SndNxtList
+	s.sndCwnd = c.SndCwnd
+	s.sndSsthresh = c.SndSsthresh
+	s.rto = c.RTO
+	s.rtt.srtt = c.SRTT
+	s.rtt.rttvar = c.RTTVar
+	s.srttInited = c.SRTTInited
+	s.maxSentAck = c.MaxSentAck
+	s.tsBase = c.TSBase
+	s.closed = c.SndClosed
+	s.rttMeasureSeqNum = c.SndNxt
+	s.fr.last = c.SndNxt - 1
+	now := e.stack.Now()
+	for _, sc := range c.WriteList {
+		seg := e.restoredSegment(sc)
+		if seg.xmitCount != 0 {
+			seg.xmitTime = now
+		}
+		s.writeList.PushBack(seg)
+	}
+	s.writeNext = s.writeList.Front()
+	e.snd = s
+
+	e.rcvListMu.Lock()
+	e.rcv = newReceiver(e, c.RcvNxt-1, c.RcvNxt.Size(c.RcvAcc), c.RcvWndScale)
+	e.rcv.closed = c.RcvClosed
+	e.rcv.pendingBufSize = seqnum.Size(e.rcvBufSize)
+	e.rcvListMu.Unlock()
+
+	e.sndBufMu.Lock()
+	for _, sc := range c.SndQueue {
+		seg := e.restoredSegment(sc)
+		e.sndQueue.PushBack(seg)
+		// FINs take one sequence number.
+		if n := seg.data.Size(); n != 0 {
+			e.sndBufInQueue += seqnum.Size(n)
+		} else {
+			e.sndBufInQueue++
+		}
+	}
+	e.sndBufUsed = c.SndBufUsed
+	e.sndBufInFlight = c.SndBufInFlight
+	e.sndClosed = c.WriteClosed
+	e.sndBufMu.Unlock()
+
+	if !s.writeList.Empty() || !e.sndQueue.Empty() {
+		e.sndWaker.Assert()
+	}
+	if c.WriteClosed && !s.closed {
+		e.sndCloseWaker.Assert()
+	}
+	e.state = stateConnected
+}
+
+// restoredSegment returns the outgoing segment held in c.
+func (e *endpoint) restoredSegment(c sndCheckpoint) *segment {
+	s := newSegmentFromView(&e.route, e.id, c.Data)
+	s.sequenceNumber = c.Seq
+	s.flags = c.Flags
+	s.xmitCount = c.XmitCount
+	s.timestamping = c.Timestamping
+	return s
+}
+
+// userAddress returns addr as users of the endpoint give it: IPv4 addresses
+// are v4-mapped on IPv6 endpoints.
+func (e *endpoint) userAddress(addr tcpip.Address) tcpip.Address {
+	if e.netProto == header.IPv6ProtocolNumber && len(addr) == header.IPv4AddressSize {
+		return "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff" + addr
+	}
+	return addr
+}
@@ -16,6 +16,7 @@ package tcp
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/netstack/rand"
@@ -84,6 +85,10 @@ type handshake struct {
 
 	// rcvWndScale is the receive window scale, as defined in RFC 1323.
 	rcvWndScale int
+
+	// mptcpKey is the local Multipath TCP key offered in the handshake, or
+	// zero if Multipath TCP isn't offered.
+	mptcpKey uint64
 }
 
 func newHandshake(ep *endpoint, rcvWnd seqnum.Size) handshake {
@@ -208,6 +213,13 @@ func (h *handshake) synSentState(s *segment) *tcpip.Error {
 	// If this is a SYN ACK response, we only need to acknowledge the SYN
 	// and the handshake is completed.
 	if s.flagIsSet(header.TCPFlagAck) {
+		// Multipath TCP is negotiated if the peer answered our
+		// MP_CAPABLE option with its key. Our ACK then echoes both
+		// keys.
+		if h.mptcpKey != 0 && rcvSynOpts.MPCapable && rcvSynOpts.MPTCP.SenderKey != 0 && acceptableMPCapable(&rcvSynOpts.MPTCP) {
+			h.ep.mptcp = newMPTCPState(h.mptcpKey, rcvSynOpts.MPTCP.SenderKey, h.iss, h.ackNum-1)
+			h.ep.mptcp.sendKeys = true
+		}
 		h.state = handshakeCompleted
 		h.ep.sendRaw(buffer.VectorisedView{}, header.TCPFlagAck, h.iss+1, h.ackNum, h.rcvWnd>>h.effectiveRcvWndScale())
 		return nil
@@ -215,8 +227,9 @@ func (h *handshake) synSentState(s *segment) *tcpip.Error {
 
 	// A SYN segment was received, but no ACK in it. We acknowledge the SYN
 	// but resend our own SYN and wait for it to be acknowledged in the
-	// SYN-RCVD state.
+	// SYN-RCVD state. Multipath TCP isn't negotiated on simultaneous opens.
 	h.state = handshakeSynRcvd
+	h.mptcpKey = 0
 	synOpts := header.TCPSynOptions{
 		WS:    h.rcvWndScale,
 		TS:    rcvSynOpts.TS,
@@ -228,7 +241,7 @@ func (h *handshake) synSentState(s *segment) *tcpip.Error {
 		// this is the behaviour implemented by Linux.
 		SACKPermitted: rcvSynOpts.SACKPermitted,
 	}
-	sendSynTCP(&s.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
+	sendSynTCP(&s.route, h.ep.id, h.ep.headerParams(&s.route), h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
 
 	return nil
 }
@@ -272,7 +285,7 @@ func (h *handshake) synRcvdState(s *segment) *tcpip.Error {
 			TSEcr:         h.ep.recentTS,
 			SACKPermitted: h.ep.sackPermitted,
 		}
-		sendSynTCP(&s.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
+		sendSynTCP(&s.route, h.ep.id, h.ep.headerParams(&s.route), h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
 		return nil
 	}
 
@@ -292,6 +305,15 @@ func (h *handshake) synRcvdState(s *segment) *tcpip.Error {
 		if h.ep.sendTSOk && s.parsedOptions.TS {
 			h.ep.updateRecentTimestamp(s.parsedOptions.TSVal, h.ackNum, s.sequenceNumber)
 		}
+
+		// Multipath TCP is negotiated if the ACK echoes our key along
+		// with the peer's.
+		if h.mptcpKey != 0 {
+			o := header.ParseMPTCPOptions(s.options)
+			if o.MPCapable && o.Capable.ReceiverKey == h.mptcpKey && o.Capable.SenderKey != 0 {
+				h.ep.mptcp = newMPTCPState(h.mptcpKey, o.Capable.SenderKey, h.iss, h.ackNum-1)
+			}
+		}
 		h.state = handshakeCompleted
 		return nil
 	}
@@ -393,7 +415,7 @@ func (h *handshake) execute() *tcpip.Error {
 	// Initialize the resend timer.
 	resendWaker := sleep.Waker{}
 	timeOut := time.Duration(time.Second)
-	rt := time.AfterFunc(timeOut, func() {
+	rt := h.ep.stack.Clock().AfterFunc(timeOut, func() {
 		resendWaker.Assert()
 	})
 	defer rt.Stop()
@@ -428,8 +450,27 @@ func (h *handshake) execute() *tcpip.Error {
 	if h.state == handshakeSynRcvd {
 		synOpts.TS = h.ep.sendTSOk
 		synOpts.SACKPermitted = h.ep.sackPermitted && bool(sackEnabled)
+	} else {
+		h.ep.mu.RLock()
+		if h.ep.mptcpEnabled {
+			h.mptcpKey = newMPTCPKey()
+		}
+		h.ep.mu.RUnlock()
 	}
-	sendSynTCP(&h.ep.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
+
+	// In a listen context, mptcpKey is only set if the SYN carried an
+	// acceptable MP_CAPABLE option, and the SYN-ACK carries our key.
+	if h.mptcpKey != 0 {
+		synOpts.MPCapable = true
+		synOpts.MPTCP = header.MPCapableOption{
+			Version: header.MPTCPVersion,
+			Flags:   mptcpFlags,
+		}
+		if h.state == handshakeSynRcvd {
+			synOpts.MPTCP.SenderKey = h.mptcpKey
+		}
+	}
+	sendSynTCP(&h.ep.route, h.ep.id, h.ep.headerParams(&h.ep.route), h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
 	for h.state != handshakeCompleted {
 		switch index, _ := s.Fetch(true); index {
 		case wakerForResend:
@@ -438,13 +479,16 @@ func (h *handshake) execute() *tcpip.Error {
 				return tcpip.ErrTimeout
 			}
 			rt.Reset(timeOut)
-			sendSynTCP(&h.ep.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
+			sendSynTCP(&h.ep.route, h.ep.id, h.ep.headerParams(&h.ep.route), h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
 
 		case wakerForNotification:
 			n := h.ep.fetchNotifications()
 			if n&notifyClose != 0 {
 				return tcpip.ErrAborted
 			}
+			if n&notifyNICRemoved != 0 && h.ep.route.Removed() {
+				return tcpip.ErrNetworkUnreachable
+			}
 			if n&notifyDrain != 0 {
 				for !h.ep.segmentQueue.empty() {
 					s := h.ep.segmentQueue.dequeue()
@@ -539,6 +583,11 @@ func makeSynOptions(opts header.TCPSynOptions) []byte {
 		offset += header.EncodeWSOption(opts.WS, options[offset:])
 	}
 
+	// The MP_CAPABLE option is a multiple of 4 bytes in SYNs and SYN-ACKs.
+	if opts.MPCapable {
+		offset += header.EncodeMPCapableOption(opts.MPTCP, options[offset:])
+	}
+
 	// Padding to the end; note that this never apply unless we add a
 	// fastopen option, we always expect the offset to remain the same.
 	if delta := header.AddTCPOptionPadding(options, offset); delta != 0 {
@@ -548,23 +597,31 @@ func makeSynOptions(opts header.TCPSynOptions) []byte {
 	return options[:offset]
 }
 
-func sendSynTCP(r *stack.Route, id stack.TransportEndpointID, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size, opts header.TCPSynOptions) *tcpip.Error {
+func sendSynTCP(r *stack.Route, id stack.TransportEndpointID, params stack.NetworkHeaderParams, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size, opts header.TCPSynOptions) *tcpip.Error {
 	// The MSS in opts is automatically calculated as this function is
 	// called from many places and we don't want every call point being
-	// embedded with the MSS calculation.
+	// embedded with the MSS calculation. The route may override it.
+	if opts.MSS == 0 {
+		opts.MSS = r.AdvertisedMSS()
+	}
 	if opts.MSS == 0 {
-		opts.MSS = uint16(r.MTU() - header.TCPMinimumSize)
+		mss := r.MTU() - header.TCPMinimumSize
+		if mss > header.TCPMaxMSS {
+			mss = header.TCPMaxMSS
+		}
+		opts.MSS = uint16(mss)
 	}
 
 	options := makeSynOptions(opts)
-	err := sendTCP(r, id, buffer.VectorisedView{}, r.DefaultTTL(), flags, seq, ack, rcvWnd, options)
+	err := sendTCP(r, id, buffer.VectorisedView{}, params, flags, seq, ack, rcvWnd, options)
 	putOptions(options)
 	return err
 }
 
 // sendTCP sends a TCP segment with the provided options via the provided
-// network endpoint and under the provided identity.
-func sendTCP(r *stack.Route, id stack.TransportEndpointID, data buffer.VectorisedView, ttl uint8, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size, opts []byte) *tcpip.Error {
+// network endpoint and under the provided identity. The protocol of params is
+// ignored, and the route's automatic flow label is used if it has none.
+func sendTCP(r *stack.Route, id stack.TransportEndpointID, data buffer.VectorisedView, params stack.NetworkHeaderParams, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size, opts []byte) *tcpip.Error {
 	optLen := len(opts)
 	// Allocate a buffer for the TCP header.
 	hdr := buffer.NewPrependable(header.TCPMinimumSize + int(r.MaxHeaderLength()) + optLen)
@@ -588,7 +645,7 @@ func sendTCP(r *stack.Route, id stack.TransportEndpointID, data buffer.Vectorise
 
 	// Only calculate the checksum if offloading isn't supported.
 	if r.Capabilities()&stack.CapabilityChecksumOffload == 0 {
-		length := uint16(hdr.UsedLength() + data.Size())
+		length := uint32(hdr.UsedLength() + data.Size())
 		xsum := r.PseudoHeaderChecksum(ProtocolNumber, length)
 		xsum = header.ChecksumVV(data, xsum)
 
@@ -600,11 +657,18 @@ func sendTCP(r *stack.Route, id stack.TransportEndpointID, data buffer.Vectorise
 		r.Stats().TCP.ResetsSent.Increment()
 	}
 
-	return r.WritePacket(hdr, data, ProtocolNumber, ttl)
+	params.Protocol = ProtocolNumber
+	if params.FlowLabel == 0 {
+		params.FlowLabel = r.FlowLabel(ProtocolNumber, id.LocalPort, id.RemotePort)
+	}
+	pkt := stack.NewOutboundPacketBuffer(hdr, data)
+	defer pkt.DecRef()
+	return r.WritePacketWithParams(pkt, params)
 }
 
-// makeOptions makes an options slice.
-func (e *endpoint) makeOptions(sackBlocks []header.SACKBlock) []byte {
+// makeOptions makes an options slice. mptcpOpt is the encoded Multipath TCP
+// option, if any.
+func (e *endpoint) makeOptions(sackBlocks []header.SACKBlock, mptcpOpt []byte) []byte {
 	options := getOptions()
 	offset := 0
 
@@ -628,7 +692,16 @@ func (e *endpoint) makeOptions(sackBlocks []header.SACKBlock) []byte {
 		offset += header.EncodeNOP(options[offset:])
 		offset += header.EncodeTSOption(e.timestamp(), uint32(e.recentTS), options[offset:])
 	}
-	if e.sackPermitted && len(sackBlocks) > 0 {
+	if len(mptcpOpt) > 0 {
+		if len(mptcpOpt)%4 == 2 {
+			offset += header.EncodeNOP(options[offset:])
+			offset += header.EncodeNOP(options[offset:])
+		}
+		offset += copy(options[offset:], mptcpOpt)
+	}
+	// The SACK blocks are only sent if there is room left for at least one
+	// of them.
+	if e.sackPermitted && len(sackBlocks) > 0 && maxOptionSize-offset >= 4+8 {
 		offset += header.EncodeNOP(options[offset:])
 		offset += header.EncodeNOP(options[offset:])
 		offset += header.EncodeSACKBlocks(sackBlocks, options[offset:])
@@ -648,12 +721,78 @@ func (e *endpoint) sendRaw(data buffer.VectorisedView, flags byte, seq, ack seqn
 	if e.state == stateConnected && e.rcv.pendingBufSize > 0 && (flags&header.TCPFlagAck != 0) {
 		sackBlocks = e.sack.Blocks[:e.sack.NumBlocks]
 	}
-	options := e.makeOptions(sackBlocks)
-	err := sendTCP(&e.route, e.id, data, e.route.DefaultTTL(), flags, seq, ack, rcvWnd, options)
+	var mptcpBuf [mptcpOptionSpace]byte
+	var mptcpOpt []byte
+	if e.mptcp != nil {
+		mptcpOpt = mptcpBuf[:e.mptcp.encodeOption(mptcpBuf[:], flags, seq, ack, data.Size())]
+	}
+	options := e.makeOptions(sackBlocks, mptcpOpt)
+	err := sendTCP(&e.route, e.id, data, e.headerParams(&e.route), flags, seq, ack, rcvWnd, options)
 	putOptions(options)
 	return err
 }
 
+// updateLinkMTU updates the maximum payload size after the MTU of the route
+// changed. It is called by the protocol goroutine.
+func (e *endpoint) updateLinkMTU() {
+	mtu := int(e.route.MTU())
+	e.sndBufMu.Lock()
+	if e.sndMTU < mtu {
+		mtu = e.sndMTU
+	}
+	e.sndBufMu.Unlock()
+
+	e.snd.updateLinkMTU(mtu)
+}
+
+// refreshRoute finds the route of the connection again if it's stale, so that
+// the connection follows changes of the route table, the NICs or the link
+// address of the next hop. It is called by the protocol goroutine.
+//
+// The current route is kept if no route is found, or until the link address
+// of the new one is resolved; sndWaker is asserted once resolution completes,
+// and the route is checked again then.
+func (e *endpoint) refreshRoute() {
+	if !e.route.Stale() {
+		return
+	}
+
+	r, err := e.stack.FindRouteInVRF(e.vrf, e.boundNICID, e.id.LocalAddress, e.id.RemoteAddress, e.route.NetProto, false /* multicastLoop */)
+	if err != nil {
+		return
+	}
+	if r.IsResolutionRequired() {
+		if _, err := r.Resolve(&e.sndWaker); err != nil {
+			r.Release()
+			return
+		}
+	}
+
+	e.mu.Lock()
+	e.route.Release()
+	e.route = r
+	e.mu.Unlock()
+
+	e.updateLinkMTU()
+}
+
+// headerParams returns the network header parameters of the packets sent by
+// the endpoint through r, as set by its socket options.
+func (e *endpoint) headerParams(r *stack.Route) stack.NetworkHeaderParams {
+	params := stack.NetworkHeaderParams{
+		TTL: uint8(atomic.LoadUint32(&e.ttl)),
+		TOS: uint8(atomic.LoadUint32(&e.sendTOS)),
+	}
+	if params.TTL == 0 {
+		params.TTL = r.DefaultTTL()
+	}
+	if r.NetProto == header.IPv6ProtocolNumber {
+		params.TOS = uint8(atomic.LoadUint32(&e.sendTClass))
+		params.FlowLabel = atomic.LoadUint32(&e.flowLabel)
+	}
+	return params
+}
+
 func (e *endpoint) handleWrite() *tcpip.Error {
 	// Move packets from send queue to send list. The queue is accessible
 	// from other goroutines and protected by the send mutex, while the send
@@ -699,6 +838,7 @@ func (e *endpoint) resetConnectionLocked(err *tcpip.Error) {
 
 	e.state = stateError
 	e.hardError = err
+	e.lastError.Set(err)
 }
 
 // completeWorkerLocked is called by the worker goroutine when it's about to
@@ -746,6 +886,12 @@ func (e *endpoint) handleSegments() *tcpip.Error {
 			// information."
 			e.rcv.handleRcvdSegment(s)
 			e.snd.handleRcvdSegment(s)
+
+			// The connection falls back to regular TCP if the peer
+			// sends data without a mapping.
+			if e.mptcp != nil && s.data.Size() > 0 && e.mptcp.active() && !header.ParseMPTCPOptions(s.options).HasDSS {
+				e.mptcp.fallBack()
+			}
 		}
 		s.decRef()
 	}
@@ -756,9 +902,10 @@ func (e *endpoint) handleSegments() *tcpip.Error {
 		e.newSegmentWaker.Assert()
 	}
 
-	// Send an ACK for all processed packets if needed.
+	// Send an ACK for all processed packets if needed, or have it sent
+	// once it's no longer delayed.
 	if e.rcv.rcvNxt != e.snd.maxSentAck {
-		e.snd.sendAck()
+		e.sendOrDelayAck()
 	}
 
 	e.resetKeepaliveTimer(true)
@@ -822,7 +969,7 @@ func (e *endpoint) disableKeepaliveTimer() {
 // goroutine and is responsible for sending segments and handling received
 // segments.
 func (e *endpoint) protocolMainLoop(handshake bool) *tcpip.Error {
-	var closeTimer *time.Timer
+	var closeTimer tcpip.Timer
 	var closeWaker sleep.Waker
 
 	epilogue := func() {
@@ -830,6 +977,7 @@ func (e *endpoint) protocolMainLoop(handshake bool) *tcpip.Error {
 
 		if e.snd != nil {
 			e.snd.resendTimer.cleanup()
+			e.snd.updateDestinationRTT()
 		}
 
 		if closeTimer != nil {
@@ -853,10 +1001,16 @@ func (e *endpoint) protocolMainLoop(handshake bool) *tcpip.Error {
 		// handshake, and then inform potential waiters about its
 		// completion.
 		h := newHandshake(e, seqnum.Size(e.receiveBufferAvailable()))
-		if err := h.execute(); err != nil {
-			e.lastErrorMu.Lock()
-			e.lastError = err
-			e.lastErrorMu.Unlock()
+		err := h.execute()
+		switch err {
+		case nil, tcpip.ErrConnectionRefused:
+			// A refusal means the peer is reachable.
+			e.stack.SetDestinationReachable(e.id.RemoteAddress, true)
+		case tcpip.ErrTimeout:
+			e.stack.SetDestinationReachable(e.id.RemoteAddress, false)
+		}
+		if err != nil {
+			e.lastError.Set(err)
 
 			e.mu.Lock()
 			e.state = stateError
@@ -877,9 +1031,12 @@ func (e *endpoint) protocolMainLoop(handshake bool) *tcpip.Error {
 		e.rcvListMu.Unlock()
 	}
 
-	e.keepalive.timer.init(&e.keepalive.waker)
+	e.keepalive.timer.init(e.stack.Clock(), &e.keepalive.waker)
 	defer e.keepalive.timer.cleanup()
 
+	e.ackTimer.init(e.stack.Clock(), &e.ackWaker)
+	defer e.ackTimer.cleanup()
+
 	// Tell waiters that the endpoint is connected and writable.
 	e.mu.Lock()
 	e.state = stateConnected
@@ -929,6 +1086,10 @@ func (e *endpoint) protocolMainLoop(handshake bool) *tcpip.Error {
 			w: &e.keepalive.waker,
 			f: e.keepaliveTimerExpired,
 		},
+		{
+			w: &e.ackWaker,
+			f: e.delayedAckTimerExpired,
+		},
 		{
 			w: &e.notificationWaker,
 			f: func() *tcpip.Error {
@@ -951,11 +1112,26 @@ func (e *endpoint) protocolMainLoop(handshake bool) *tcpip.Error {
 					e.snd.updateMaxPayloadSize(mtu, count)
 				}
 
+				if n&notifyLinkMTUChanged != 0 {
+					e.updateLinkMTU()
+				}
+
+				if n&notifyQuickAck != 0 && e.rcv.rcvNxt != e.snd.maxSentAck {
+					e.snd.sendAck()
+				}
+
 				if n&notifyReset != 0 {
 					e.mu.Lock()
 					e.resetConnectionLocked(tcpip.ErrConnectionAborted)
 					e.mu.Unlock()
 				}
+
+				// The connection can't go on if the NIC it
+				// was routed through is gone.
+				if n&notifyNICRemoved != 0 && e.route.Removed() {
+					return tcpip.ErrNetworkUnreachable
+				}
+
 				if n&notifyClose != 0 && closeTimer == nil {
 					// Reset the connection 3 seconds after
 					// the endpoint has been closed.
@@ -964,7 +1140,7 @@ func (e *endpoint) protocolMainLoop(handshake bool) *tcpip.Error {
 					// when the endpoint is drained. That's
 					// OK as the loop here will not honor
 					// the firing until the undrain arrives.
-					closeTimer = time.AfterFunc(3*time.Second, func() {
+					closeTimer = e.stack.Clock().AfterFunc(3*time.Second, func() {
 						closeWaker.Assert()
 					})
 				}
@@ -1026,6 +1202,7 @@ func (e *endpoint) protocolMainLoop(handshake bool) *tcpip.Error {
 		e.workMu.Unlock()
 		v, _ := s.Fetch(true)
 		e.workMu.Lock()
+		e.refreshRoute()
 		if err := funcs[v].f(); err != nil {
 			e.mu.Lock()
 			e.resetConnectionLocked(err)
@@ -72,7 +72,7 @@ type cubicState struct {
 // beta and c set and t set to current time.
 func newCubicCC(s *sender) *cubicState {
 	return &cubicState{
-		t:    time.Now(),
+		t:    s.ep.stack.Now(),
 		beta: 0.7,
 		c:    0.4,
 		s:    s,
@@ -90,7 +90,7 @@ func (c *cubicState) enterCongestionAvoidance() {
 	// https://tools.ietf.org/html/rfc8312#section-4.8
 	if c.numCongestionEvents == 0 {
 		c.k = 0
-		c.t = time.Now()
+		c.t = c.s.ep.stack.Now()
 		c.wLastMax = c.wMax
 		c.wMax = float64(c.s.sndCwnd)
 	}
@@ -145,7 +145,7 @@ func (c *cubicState) cubicCwnd(t float64) float64 {
 // getCwnd returns the current congestion window as computed by CUBIC.
 // Refer: https://tools.ietf.org/html/rfc8312#section-4
 func (c *cubicState) getCwnd(packetsAcked, sndCwnd int, srtt time.Duration) int {
-	elapsed := time.Since(c.t).Seconds()
+	elapsed := c.s.ep.stack.Now().Sub(c.t).Seconds()
 
 	// Compute the window as per Cubic after 'elapsed' time
 	// since last congestion event.
@@ -164,7 +164,7 @@ func (c *cubicState) getCwnd(packetsAcked, sndCwnd int, srtt time.Duration) int
 	// In Concave/Convex region of CUBIC, calculate what CUBIC window
 	// will be after 1 RTT and use that to grow congestion window
 	// for every ack.
-	tEst := (time.Since(c.t) + srtt).Seconds()
+	tEst := (c.s.ep.stack.Now().Sub(c.t) + srtt).Seconds()
 	wtRtt := c.cubicCwnd(tEst - c.k)
 	// As per 4.3 for each received ACK cwnd must be incremented
 	// by (w_cubic(t+RTT) - cwnd/cwnd.
@@ -181,7 +181,7 @@ func (c *cubicState) getCwnd(packetsAcked, sndCwnd int, srtt time.Duration) int
 func (c *cubicState) HandleNDupAcks() {
 	// See: https://tools.ietf.org/html/rfc8312#section-4.5
 	c.numCongestionEvents++
-	c.t = time.Now()
+	c.t = c.s.ep.stack.Now()
 	c.wLastMax = c.wMax
 	c.wMax = float64(c.s.sndCwnd)
 
@@ -192,7 +192,7 @@ func (c *cubicState) HandleNDupAcks() {
 // HandleRTOExpired implements congestionContrl.HandleRTOExpired.
 func (c *cubicState) HandleRTOExpired() {
 	// See: https://tools.ietf.org/html/rfc8312#section-4.6
-	c.t = time.Now()
+	c.t = c.s.ep.stack.Now()
 	c.numCongestionEvents = 0
 	c.wLastMax = c.wMax
 	c.wMax = float64(c.s.sndCwnd)
@@ -223,7 +223,7 @@ func (c *cubicState) fastConvergence() {
 
 // PostRecovery implemements congestionControl.PostRecovery.
 func (c *cubicState) PostRecovery() {
-	c.t = time.Now()
+	c.t = c.s.ep.stack.Now()
 }
 
 // reduceSlowStartThreshold returns new SsThresh as described in
@@ -0,0 +1,141 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	// maxDelayedAckTimeout is the longest an acknowledgment may be
+	// delayed, RFC 1122 section 4.2.3.2.
+	maxDelayedAckTimeout = 500 * time.Millisecond
+
+	// defaultDelayedAckSegments is the number of received segments after
+	// which an acknowledgment is sent right away by default, RFC 5681
+	// section 4.2.
+	defaultDelayedAckSegments = 2
+
+	// quickAckSegments is the number of acknowledgments sent right away
+	// after tcpip.QuickAckOption is enabled, before they are delayed
+	// again.
+	quickAckSegments = 16
+)
+
+// DelayedAckOption configures the delayed acknowledgments of RFC 1122 section
+// 4.2.3.2. As a protocol option, it sets the default of new endpoints; as a
+// socket option, it applies to a single endpoint, and is inherited by the
+// endpoints accepted by a listener.
+type DelayedAckOption struct {
+	// Timeout is how long the acknowledgment of received data may be
+	// delayed, at most 500ms. Zero, the default, disables delayed
+	// acknowledgments: every batch of received segments is acknowledged
+	// right away.
+	Timeout time.Duration
+
+	// Segments is the number of received data segments after which an
+	// acknowledgment is sent without waiting for Timeout. Zero means the
+	// default of 2, acknowledging every other segment.
+	Segments int
+}
+
+// check returns o with its defaults filled in, or an error if it's invalid.
+func (o DelayedAckOption) check() (DelayedAckOption, *tcpip.Error) {
+	if o.Timeout < 0 || o.Timeout > maxDelayedAckTimeout || o.Segments < 0 {
+		return o, tcpip.ErrInvalidOptionValue
+	}
+	if o.Segments == 0 {
+		o.Segments = defaultDelayedAckSegments
+	}
+	return o, nil
+}
+
+// setDelayedAck applies o to e.
+func (e *endpoint) setDelayedAck(o DelayedAckOption) {
+	atomic.StoreUint32(&e.delayedAckTimeout, uint32(o.Timeout))
+	atomic.StoreUint32(&e.delayedAckSegments, uint32(o.Segments))
+}
+
+// delayedAck returns the DelayedAckOption of e.
+func (e *endpoint) delayedAck() DelayedAckOption {
+	return DelayedAckOption{
+		Timeout:  time.Duration(atomic.LoadUint32(&e.delayedAckTimeout)),
+		Segments: int(atomic.LoadUint32(&e.delayedAckSegments)),
+	}
+}
+
+// setQuickAck enables or disables the quick acknowledgment mode of e, see
+// tcpip.QuickAckOption.
+func (e *endpoint) setQuickAck(enable bool) {
+	if !enable {
+		atomic.StoreUint32(&e.quickAcks, 0)
+		return
+	}
+	atomic.StoreUint32(&e.quickAcks, quickAckSegments)
+	e.notifyProtocolGoroutine(notifyQuickAck)
+}
+
+// quickAck returns whether e currently acknowledges received data right away.
+func (e *endpoint) quickAck() bool {
+	return atomic.LoadUint32(&e.quickAcks) != 0 || atomic.LoadUint32(&e.delayedAckTimeout) == 0
+}
+
+// consumeQuickAck returns whether e is in quick acknowledgment mode, and
+// counts one more acknowledgment sent in it if so.
+func (e *endpoint) consumeQuickAck() bool {
+	for {
+		n := atomic.LoadUint32(&e.quickAcks)
+		if n == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&e.quickAcks, n, n-1) {
+			return true
+		}
+	}
+}
+
+// sendOrDelayAck acknowledges the data received since the last segment sent,
+// either right away or once the delayed acknowledgment timer expires. It is
+// called by the protocol goroutine.
+func (e *endpoint) sendOrDelayAck() {
+	o := e.delayedAck()
+	if o.Timeout == 0 || e.rcv.ackNow || e.rcv.unackedSegs >= o.Segments || e.consumeQuickAck() {
+		e.snd.sendAck()
+		return
+	}
+	if !e.ackTimer.enabled() {
+		e.ackTimer.enable(o.Timeout)
+	}
+}
+
+// ackSent is called by the protocol goroutine when a segment, which
+// acknowledges all the data received so far, is sent.
+func (e *endpoint) ackSent() {
+	e.rcv.unackedSegs = 0
+	e.rcv.ackNow = false
+	e.ackTimer.disable()
+}
+
+// delayedAckTimerExpired is called by the protocol goroutine when the delayed
+// acknowledgment timer fires.
+func (e *endpoint) delayedAckTimerExpired() *tcpip.Error {
+	if e.ackTimer.checkExpiration() && e.rcv.rcvNxt != e.snd.maxSentAck {
+		e.snd.sendAck()
+	}
+	return nil
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/ports"
 	"github.com/google/netstack/tcpip/seqnum"
 	"github.com/google/netstack/tcpip/stack"
 	"github.com/google/netstack/tmutex"
@@ -43,6 +44,16 @@ const (
 	stateError
 )
 
+var stateNames = [...]string{
+	stateInitial:    "INITIAL",
+	stateBound:      "BOUND",
+	stateListen:     "LISTEN",
+	stateConnecting: "CONNECTING",
+	stateConnected:  "CONNECTED",
+	stateClosed:     "CLOSED",
+	stateError:      "ERROR",
+}
+
 // Reasons for notifying the protocol goroutine.
 const (
 	notifyNonZeroReceiveWindow = 1 << iota
@@ -52,8 +63,15 @@ const (
 	notifyDrain
 	notifyReset
 	notifyKeepaliveChanged
+	notifyLinkMTUChanged
+	notifyNICRemoved
+	notifyQuickAck
 )
 
+// maxErrQueueLen is the maximum number of transmit timestamps held in an
+// endpoint's error queue. Further ones are dropped until it is read.
+const maxErrQueueLen = 256
+
 // SACKInfo holds TCP SACK related information for a given endpoint.
 //
 // +stateify savable
@@ -86,11 +104,10 @@ type endpoint struct {
 	stack       *stack.Stack
 	netProto    tcpip.NetworkProtocolNumber
 	waiterQueue *waiter.Queue
+	leakID      uint64
 
-	// lastError represents the last error that the endpoint reported;
-	// access to it is protected by the following mutex.
-	lastErrorMu sync.Mutex
-	lastError   *tcpip.Error
+	// lastError represents the last error that the endpoint reported.
+	lastError tcpip.PendingError
 
 	// The following fields are used to manage the receive queue. The
 	// protocol goroutine adds ready-for-delivery segments to rcvList,
@@ -106,6 +123,11 @@ type endpoint struct {
 	rcvBufSize int
 	rcvBufUsed int
 
+	// rcvBufLent is the number of bytes handed out by ReadWithoutCopy that
+	// have not been released yet. They are no longer readable, but still
+	// count against the receive buffer.
+	rcvBufLent int
+
 	// The following fields are protected by the mutex.
 	mu                sync.RWMutex
 	id                stack.TransportEndpointID
@@ -113,6 +135,7 @@ type endpoint struct {
 	isPortReserved    bool
 	isRegistered      bool
 	boundNICID        tcpip.NICID
+	vrf               tcpip.VRFID
 	route             stack.Route
 	v6only            bool
 	isConnectNotified bool
@@ -165,6 +188,29 @@ type endpoint struct {
 	// sack holds TCP SACK related information for this endpoint.
 	sack SACKInfo
 
+	// mptcpEnabled is set if Multipath TCP is offered when connecting, or
+	// accepted when listening. It is protected by mu.
+	mptcpEnabled bool
+
+	// mptcp holds the Multipath TCP state of the connection, or nil if it
+	// wasn't negotiated. Like sendTSOk, it is set during the handshake.
+	mptcp *mptcpState
+
+	// listenLimitMu protects listenLimit, synTokens, synRefill and
+	// synRcvdBySource.
+	listenLimitMu sync.Mutex
+	listenLimit   tcpip.TCPListenLimitOption
+
+	// synTokens and synRefill are the state of the token bucket limiting
+	// the rate of SYNs, synRefill being the monotonic time of its last
+	// refill.
+	synTokens float64
+	synRefill int64
+
+	// synRcvdBySource holds the number of connections in SYN-RCVD state
+	// from each remote address.
+	synRcvdBySource map[tcpip.Address]int
+
 	// reusePort is set to true if SO_REUSEPORT is enabled.
 	reusePort bool
 
@@ -178,6 +224,65 @@ type endpoint struct {
 	// cork is a boolean (0 is false) and must be accessed atomically.
 	cork uint32
 
+	// timestamping holds the tcpip.TimestampingOption flags applied to
+	// new writes. It must be accessed atomically.
+	timestamping uint32
+
+	// delayedAckTimeout, in nanoseconds, and delayedAckSegments hold the
+	// DelayedAckOption of the endpoint, and quickAcks the number of
+	// acknowledgments left to send right away, see tcpip.QuickAckOption.
+	// They must be accessed atomically.
+	delayedAckTimeout  uint32
+	delayedAckSegments uint32
+	quickAcks          uint32
+
+	// ackTimer fires when the delayed acknowledgment of received data is
+	// due, asserting ackWaker.
+	ackTimer timer
+	ackWaker sleep.Waker
+
+	// receiveInq is a boolean (0 is false), set when reads report the
+	// bytes left in the receive queue, see tcpip.ReceiveInqOption. It must
+	// be accessed atomically.
+	receiveInq uint32
+
+	// sockOpts holds the values of the options registered in SockOpts with
+	// RegisterStored.
+	sockOpts tcpip.SockOptStore
+
+	// transparent is a boolean (0 is false), set when the endpoint can bind
+	// to addresses that aren't local and receives the connections to them
+	// on the NICs in transparent mode, see tcpip.TransparentOption.
+	// Accepted endpoints inherit it from their listener. It must be
+	// accessed atomically.
+	transparent uint32
+
+	// ttl is the TTL of the packets sent by the endpoint, or zero for the
+	// route's default, and minTTL the minimum TTL of the packets it
+	// accepts, see tcpip.MinTTLOption. Accepted endpoints inherit both from
+	// their listener. They must be accessed atomically.
+	ttl    uint32
+	minTTL uint32
+
+	// sendTOS and sendTClass are the type of service of the IPv4 packets
+	// and the traffic class of the IPv6 packets sent by the endpoint.
+	// Accepted endpoints inherit them from their listener. They must be
+	// accessed atomically.
+	sendTOS    uint32
+	sendTClass uint32
+
+	// flowLabel is the flow label of the IPv6 packets sent by the endpoint,
+	// or zero for the automatic one. Accepted endpoints inherit it from
+	// their listener. It must be accessed atomically.
+	flowLabel uint32
+
+	// errQueue holds the transmit timestamps that haven't been read yet,
+	// and errQueueMem the control memory they use. They are protected by
+	// errQueueMu.
+	errQueueMu  sync.Mutex
+	errQueue    []*tcpip.SockError
+	errQueueMem int
+
 	// scoreboard holds TCP SACK Scoreboard information for this endpoint.
 	scoreboard *SACKScoreboard
 
@@ -186,12 +291,6 @@ type endpoint struct {
 	// options.
 	reuseAddr bool
 
-	// slowAck holds the negated state of quick ack. It is stubbed out and
-	// does nothing.
-	//
-	// slowAck is a boolean (0 is false) and must be accessed atomically.
-	slowAck uint32
-
 	// segmentQueue is used to hand received segments to the protocol
 	// goroutine. Segments are queued as long as the queue is not full,
 	// and dropped when it is.
@@ -212,6 +311,10 @@ type endpoint struct {
 	sndWaker      sleep.Waker
 	sndCloseWaker sleep.Waker
 
+	// sndBufInFlight is the part of sndBufUsed that was sent and waits
+	// to be acknowledged. It is protected by sndBufMu.
+	sndBufInFlight int
+
 	// cc stores the name of the Congestion Control algorithm to use for
 	// this endpoint.
 	cc CongestionControlOption
@@ -242,10 +345,18 @@ type endpoint struct {
 	// without hearing a response, the connection is closed.
 	keepalive keepalive
 
-	// acceptedChan is used by a listening endpoint protocol goroutine to
-	// send newly accepted connections to the endpoint so that they can be
-	// read by Accept() calls.
-	acceptedChan chan *endpoint
+	// acceptQueue holds the connections completed by a listening endpoint,
+	// which are read by Accept() calls, up to acceptBacklog of them. They
+	// are queued by the listen goroutine and the handshake goroutines,
+	// which wait on acceptCond while the queue is full. acceptClosed is set
+	// once the endpoint stopped listening, after which no connection is
+	// queued. They are protected by acceptMu rather than mu, so that
+	// completing handshakes doesn't serialize on the listener's lock.
+	acceptMu      sync.Mutex
+	acceptCond    sync.Cond
+	acceptQueue   []*endpoint
+	acceptBacklog int
+	acceptClosed  bool
 
 	// The following are only used from the protocol goroutine, and
 	// therefore don't need locks to protect them.
@@ -297,6 +408,7 @@ func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waite
 		stack:       stack,
 		netProto:    netProto,
 		waiterQueue: waiterQueue,
+		leakID:      tcpip.TrackObject("tcp endpoint"),
 		rcvBufSize:  DefaultBufferSize,
 		sndBufSize:  DefaultBufferSize,
 		sndMTU:      int(math.MaxInt32),
@@ -324,10 +436,15 @@ func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waite
 		e.cc = cs
 	}
 
+	da := DelayedAckOption{Segments: defaultDelayedAckSegments}
+	stack.TransportProtocolOption(ProtocolNumber, &da)
+	e.setDelayedAck(da)
+
 	if p := stack.GetTCPProbe(); p != nil {
 		e.probe = p
 	}
 
+	e.acceptCond.L = &e.acceptMu
 	e.segmentQueue.setLimit(2 * e.rcvBufSize)
 	e.workMu.Init()
 	e.workMu.Lock()
@@ -337,9 +454,23 @@ func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waite
 
 // Readiness returns the current readiness of the endpoint. For example, if
 // waiter.EventIn is set, the endpoint is immediately readable.
+//
+// waiter.EventErr is reported while the endpoint has a pending error, and
+// waiter.EventHUp once both directions of the connection are closed, whether
+// or not they are in mask.
 func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 	result := waiter.EventMask(0)
 
+	if e.lastError.Pending() {
+		result |= waiter.EventErr
+	}
+
+	e.errQueueMu.Lock()
+	if len(e.errQueue) != 0 {
+		result |= waiter.EventErr
+	}
+	e.errQueueMu.Unlock()
+
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
@@ -347,16 +478,22 @@ func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 	case stateInitial, stateBound, stateConnecting:
 		// Ready for nothing.
 
-	case stateClosed, stateError:
+	case stateClosed:
 		// Ready for anything.
-		result = mask
+		result |= mask | waiter.EventHUp
+
+	case stateError:
+		// Ready for anything, reads and writes fail with hardError.
+		result |= mask | waiter.EventHUp | waiter.EventErr
 
 	case stateListen:
-		// Check if there's anything in the accepted channel.
+		// Check if there's anything in the accept queue.
 		if (mask & waiter.EventIn) != 0 {
-			if len(e.acceptedChan) > 0 {
+			e.acceptMu.Lock()
+			if len(e.acceptQueue) > 0 {
 				result |= waiter.EventIn
 			}
+			e.acceptMu.Unlock()
 		}
 
 	case stateConnected:
@@ -370,18 +507,73 @@ func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 		}
 
 		// Determine if the endpoint is readable if requested.
-		if (mask & waiter.EventIn) != 0 {
-			e.rcvListMu.Lock()
-			if e.rcvBufUsed > 0 || e.rcvClosed {
-				result |= waiter.EventIn
+		e.rcvListMu.Lock()
+		rcvClosed := e.rcvClosed
+		if (mask&waiter.EventIn) != 0 && (e.rcvBufUsed > 0 || rcvClosed) {
+			result |= waiter.EventIn
+		}
+		e.rcvListMu.Unlock()
+
+		// The connection is hung up once it is shut down both ways.
+		if rcvClosed {
+			e.sndBufMu.Lock()
+			if e.sndClosed {
+				result |= waiter.EventHUp
 			}
-			e.rcvListMu.Unlock()
+			e.sndBufMu.Unlock()
 		}
 	}
 
 	return result
 }
 
+// Diagnose implements stack.DiagnosableEndpoint.Diagnose.
+func (e *endpoint) Diagnose(info *stack.SocketInfo) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	info.State = stateNames[e.state]
+	if e.state == stateListen {
+		e.acceptMu.Lock()
+		info.RecvQueue = len(e.acceptQueue)
+		info.SendQueue = e.acceptBacklog
+		e.acceptMu.Unlock()
+		return
+	}
+
+	e.rcvListMu.Lock()
+	info.RecvQueue = e.rcvBufUsed
+	e.rcvListMu.Unlock()
+
+	e.sndBufMu.Lock()
+	info.SendQueue = e.sndBufUsed
+	e.sndBufMu.Unlock()
+}
+
+// Drain implements stack.DrainableEndpoint.Drain. It shuts the connection
+// down for writing, so that a FIN is sent after the queued data.
+func (e *endpoint) Drain() {
+	e.Shutdown(tcpip.ShutdownWrite)
+}
+
+// Drained implements stack.DrainableEndpoint.Drained.
+func (e *endpoint) Drained() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.state != stateConnecting && e.state != stateConnected
+}
+
+// Abort implements stack.DrainableEndpoint.Abort. Connections are reset by
+// the protocol goroutine; those being established fail once their NIC is
+// removed.
+func (e *endpoint) Abort() {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.state == stateConnected {
+		e.notifyProtocolGoroutine(notifyReset)
+	}
+}
+
 func (e *endpoint) fetchNotifications() uint32 {
 	return atomic.SwapUint32(&e.notifyFlags, 0)
 }
@@ -410,6 +602,8 @@ func (e *endpoint) notifyProtocolGoroutine(n uint32) {
 // with it. It must be called only once and with no other concurrent calls to
 // the endpoint.
 func (e *endpoint) Close() {
+	tcpip.UntrackObject(e.leakID)
+
 	// Issue a shutdown so that the peer knows we won't send any more data
 	// if we're connected, or stop accepting if we're listening.
 	e.Shutdown(tcpip.ShutdownWrite | tcpip.ShutdownRead)
@@ -422,11 +616,11 @@ func (e *endpoint) Close() {
 	// in Listen() when trying to register.
 	if e.state == stateListen && e.isPortReserved {
 		if e.isRegistered {
-			e.stack.UnregisterTransportEndpoint(e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
+			e.stack.UnregisterTransportEndpointInVRF(e.vrf, e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
 			e.isRegistered = false
 		}
 
-		e.stack.ReleasePort(e.effectiveNetProtos, ProtocolNumber, e.id.LocalAddress, e.id.LocalPort)
+		e.stack.VRFPortManager(e.vrf).ReleasePort(e.effectiveNetProtos, ProtocolNumber, e.id.LocalAddress, e.id.LocalPort)
 		e.isPortReserved = false
 	}
 
@@ -449,25 +643,21 @@ func (e *endpoint) Close() {
 func (e *endpoint) cleanupLocked() {
 	// Close all endpoints that might have been accepted by TCP but not by
 	// the client.
-	if e.acceptedChan != nil {
-		close(e.acceptedChan)
-		for n := range e.acceptedChan {
-			n.mu.Lock()
-			n.resetConnectionLocked(tcpip.ErrConnectionAborted)
-			n.mu.Unlock()
-			n.Close()
-		}
-		e.acceptedChan = nil
+	for _, n := range e.closeAcceptQueue() {
+		n.mu.Lock()
+		n.resetConnectionLocked(tcpip.ErrConnectionAborted)
+		n.mu.Unlock()
+		n.Close()
 	}
 	e.workerCleanup = false
 
 	if e.isRegistered {
-		e.stack.UnregisterTransportEndpoint(e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
+		e.stack.UnregisterTransportEndpointInVRF(e.vrf, e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
 		e.isRegistered = false
 	}
 
 	if e.isPortReserved {
-		e.stack.ReleasePort(e.effectiveNetProtos, ProtocolNumber, e.id.LocalAddress, e.id.LocalPort)
+		e.stack.VRFPortManager(e.vrf).ReleasePort(e.effectiveNetProtos, ProtocolNumber, e.id.LocalAddress, e.id.LocalPort)
 		e.isPortReserved = false
 	}
 
@@ -494,26 +684,27 @@ func (e *endpoint) Read(*tcpip.FullAddress) (buffer.View, tcpip.ControlMessages,
 		return buffer.View{}, tcpip.ControlMessages{}, tcpip.ErrInvalidEndpointState
 	}
 
-	v, err := e.readLocked()
+	v, cm, err := e.readLocked()
 	e.rcvListMu.Unlock()
 
 	e.mu.RUnlock()
 
-	return v, tcpip.ControlMessages{}, err
+	return v, cm, err
 }
 
-func (e *endpoint) readLocked() (buffer.View, *tcpip.Error) {
+func (e *endpoint) readLocked() (buffer.View, tcpip.ControlMessages, *tcpip.Error) {
 	if e.rcvBufUsed == 0 {
 		if e.rcvClosed || e.state != stateConnected {
-			return buffer.View{}, tcpip.ErrClosedForReceive
+			return buffer.View{}, tcpip.ControlMessages{}, tcpip.ErrClosedForReceive
 		}
-		return buffer.View{}, tcpip.ErrWouldBlock
+		return buffer.View{}, tcpip.ControlMessages{}, tcpip.ErrWouldBlock
 	}
 
 	s := e.rcvList.Front()
 	views := s.data.Views()
 	v := views[s.viewToDeliver]
 	s.viewToDeliver++
+	rcvdTime := s.rcvdTime
 
 	if s.viewToDeliver >= len(views) {
 		e.rcvList.Remove(s)
@@ -527,7 +718,88 @@ func (e *endpoint) readLocked() (buffer.View, *tcpip.Error) {
 		e.notifyProtocolGoroutine(notifyNonZeroReceiveWindow)
 	}
 
-	return v, nil
+	return v, e.controlMessagesLocked(rcvdTime), nil
+}
+
+// controlMessagesLocked returns the control messages of a read whose last byte
+// came from a segment received at rcvdTime. e.rcvListMu must be held, and the
+// read must have been accounted for in e.rcvBufUsed.
+func (e *endpoint) controlMessagesLocked(rcvdTime time.Time) tcpip.ControlMessages {
+	cm := tcpip.ControlMessages{HasTimestamp: true, Timestamp: rcvdTime.UnixNano()}
+	if atomic.LoadUint32(&e.receiveInq) != 0 {
+		cm.HasInq = true
+		cm.Inq = int32(e.rcvBufUsed)
+	}
+	return cm
+}
+
+// ReadWithoutCopy implements tcpip.ZeroCopyReader.ReadWithoutCopy.
+func (e *endpoint) ReadWithoutCopy(max int) (buffer.VectorisedView, func(), tcpip.ControlMessages, *tcpip.Error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	e.rcvListMu.Lock()
+	defer e.rcvListMu.Unlock()
+
+	if s := e.state; s != stateConnected && s != stateClosed && e.rcvBufUsed == 0 {
+		if s == stateError {
+			return buffer.VectorisedView{}, nil, tcpip.ControlMessages{}, e.hardError
+		}
+		return buffer.VectorisedView{}, nil, tcpip.ControlMessages{}, tcpip.ErrInvalidEndpointState
+	}
+	if e.rcvBufUsed == 0 {
+		if e.rcvClosed || e.state != stateConnected {
+			return buffer.VectorisedView{}, nil, tcpip.ControlMessages{}, tcpip.ErrClosedForReceive
+		}
+		return buffer.VectorisedView{}, nil, tcpip.ControlMessages{}, tcpip.ErrWouldBlock
+	}
+
+	var views []buffer.View
+	var rcvdTime time.Time
+	n := 0
+	for n < max {
+		s := e.rcvList.Front()
+		if s == nil {
+			break
+		}
+		rcvdTime = s.rcvdTime
+		segViews := s.data.Views()
+		v := segViews[s.viewToDeliver]
+		if len(v) > max-n {
+			// Lend the front of the view and leave the rest to be
+			// read later.
+			segViews[s.viewToDeliver] = v[max-n:]
+			v = v[:max-n]
+		} else {
+			s.viewToDeliver++
+			if s.viewToDeliver >= len(segViews) {
+				e.rcvList.Remove(s)
+				s.decRef()
+			}
+		}
+		views = append(views, v)
+		n += len(v)
+	}
+
+	// The lent bytes stop being readable, but keep occupying the receive
+	// buffer, and thus the advertised window, until they are released.
+	e.rcvBufUsed -= n
+	e.rcvBufLent += n
+
+	scale := e.rcv.rcvWndScale
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			e.rcvListMu.Lock()
+			wasZero := e.zeroReceiveWindow(scale)
+			e.rcvBufLent -= n
+			if wasZero && !e.zeroReceiveWindow(scale) {
+				e.notifyProtocolGoroutine(notifyNonZeroReceiveWindow)
+			}
+			e.rcvListMu.Unlock()
+		})
+	}
+	return buffer.NewVectorisedView(n, views), release, e.controlMessagesLocked(rcvdTime), nil
 }
 
 // Write writes data to the endpoint's peer.
@@ -569,14 +841,24 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, <-c
 		return 0, nil, tcpip.ErrWouldBlock
 	}
 
-	v, perr := p.Get(avail)
-	if perr != nil {
-		e.sndBufMu.Unlock()
-		return 0, nil, perr
+	var s *segment
+	if vp, ok := p.(tcpip.VectorisedPayload); ok {
+		vv, perr := vp.GetVectorised(avail)
+		if perr != nil {
+			e.sndBufMu.Unlock()
+			return 0, nil, perr
+		}
+		s = newSegmentFromVectorisedView(&e.route, e.id, vv)
+	} else {
+		v, perr := p.Get(avail)
+		if perr != nil {
+			e.sndBufMu.Unlock()
+			return 0, nil, perr
+		}
+		s = newSegmentFromView(&e.route, e.id, v)
 	}
-
-	l := len(v)
-	s := newSegmentFromView(&e.route, e.id, v)
+	s.timestamping = tcpip.TimestampingOption(atomic.LoadUint32(&e.timestamping))
+	l := s.data.Size()
 
 	// Add data to the send queue.
 	e.sndBufUsed += l
@@ -585,7 +867,9 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, <-c
 
 	e.sndBufMu.Unlock()
 
-	if e.workMu.TryLock() {
+	// A stale route is found again by the protocol goroutine before
+	// sending.
+	if !e.route.Stale() && e.workMu.TryLock() {
 		// Do the work inline.
 		e.handleWrite()
 		e.workMu.Unlock()
@@ -653,183 +937,146 @@ func (e *endpoint) Peek(vec [][]byte) (uintptr, tcpip.ControlMessages, *tcpip.Er
 	return num, tcpip.ControlMessages{}, nil
 }
 
+// ReadErrQueue implements tcpip.ErrQueueReader.ReadErrQueue.
+func (e *endpoint) ReadErrQueue() (*tcpip.SockError, *tcpip.Error) {
+	e.errQueueMu.Lock()
+	defer e.errQueueMu.Unlock()
+
+	if len(e.errQueue) == 0 {
+		return nil, tcpip.ErrWouldBlock
+	}
+	se := e.errQueue[0]
+	e.errQueue[0] = nil
+	e.errQueue = e.errQueue[1:]
+	e.errQueueMem -= se.ControlSize()
+	return se, nil
+}
+
+// queueTimestamp adds a transmit timestamp of the given kind to the error
+// queue, unless the queue is full. It is called by the protocol goroutine.
+func (e *endpoint) queueTimestamp(kind tcpip.TimestampKind, key uint32) {
+	se := &tcpip.SockError{
+		Origin:        tcpip.SockErrOriginTimestamping,
+		NetProto:      e.route.NetProto,
+		Dst:           tcpip.FullAddress{NIC: e.route.NICID(), Addr: e.id.RemoteAddress, Port: e.id.RemotePort},
+		Timestamp:     e.stack.NowNanoseconds(),
+		TimestampKind: kind,
+		Key:           key,
+	}
+
+	e.errQueueMu.Lock()
+	if len(e.errQueue) >= maxErrQueueLen || !e.stack.ChargeControlMemory(e.errQueueMem, se.ControlSize()) {
+		e.errQueueMu.Unlock()
+		return
+	}
+	wasEmpty := len(e.errQueue) == 0
+	e.errQueue = append(e.errQueue, se)
+	e.errQueueMem += se.ControlSize()
+	e.errQueueMu.Unlock()
+
+	if wasEmpty {
+		e.waiterQueue.Notify(waiter.EventErr)
+	}
+}
+
 // zeroReceiveWindow checks if the receive window to be announced now would be
 // zero, based on the amount of available buffer and the receive window scaling.
 //
 // It must be called with rcvListMu held.
 func (e *endpoint) zeroReceiveWindow(scale uint8) bool {
-	if e.rcvBufUsed >= e.rcvBufSize {
+	used := e.rcvBufUsed + e.rcvBufLent
+	if used >= e.rcvBufSize {
 		return true
 	}
 
-	return ((e.rcvBufSize - e.rcvBufUsed) >> scale) == 0
+	return ((e.rcvBufSize - used) >> scale) == 0
 }
 
 // SetSockOpt sets a socket option.
 func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
-	switch v := opt.(type) {
-	case tcpip.DelayOption:
-		if v == 0 {
-			atomic.StoreUint32(&e.delay, 0)
-
-			// Handle delayed data.
-			e.sndWaker.Assert()
-		} else {
-			atomic.StoreUint32(&e.delay, 1)
-		}
-		return nil
-
-	case tcpip.CorkOption:
-		if v == 0 {
-			atomic.StoreUint32(&e.cork, 0)
+	if err := SockOpts.SetSockOpt(e, opt); err != tcpip.ErrUnknownProtocolOption {
+		return err
+	}
+	return nil
+}
 
-			// Handle the corked data.
-			e.sndWaker.Assert()
-		} else {
-			atomic.StoreUint32(&e.cork, 1)
-		}
-		return nil
-
-	case tcpip.ReuseAddressOption:
-		e.mu.Lock()
-		e.reuseAddr = v != 0
-		e.mu.Unlock()
-		return nil
-
-	case tcpip.ReusePortOption:
-		e.mu.Lock()
-		e.reusePort = v != 0
-		e.mu.Unlock()
-		return nil
-
-	case tcpip.QuickAckOption:
-		if v == 0 {
-			atomic.StoreUint32(&e.slowAck, 1)
-		} else {
-			atomic.StoreUint32(&e.slowAck, 0)
+// setReceiveBufferSize sets the size of the receive buffer, within the limits
+// of the protocol's ReceiveBufferSizeOption.
+func (e *endpoint) setReceiveBufferSize(size int) {
+	var rs ReceiveBufferSizeOption
+	if err := e.stack.TransportProtocolOption(ProtocolNumber, &rs); err == nil {
+		if size < rs.Min {
+			size = rs.Min
 		}
-		return nil
-
-	case tcpip.ReceiveBufferSizeOption:
-		// Make sure the receive buffer size is within the min and max
-		// allowed.
-		var rs ReceiveBufferSizeOption
-		size := int(v)
-		if err := e.stack.TransportProtocolOption(ProtocolNumber, &rs); err == nil {
-			if size < rs.Min {
-				size = rs.Min
-			}
-			if size > rs.Max {
-				size = rs.Max
-			}
+		if size > rs.Max {
+			size = rs.Max
 		}
+	}
 
-		mask := uint32(notifyReceiveWindowChanged)
-
-		e.rcvListMu.Lock()
-
-		// Make sure the receive buffer size allows us to send a
-		// non-zero window size.
-		scale := uint8(0)
-		if e.rcv != nil {
-			scale = e.rcv.rcvWndScale
-		}
-		if size>>scale == 0 {
-			size = 1 << scale
-		}
+	mask := uint32(notifyReceiveWindowChanged)
 
-		// Make sure 2*size doesn't overflow.
-		if size > math.MaxInt32/2 {
-			size = math.MaxInt32 / 2
-		}
+	e.rcvListMu.Lock()
 
-		wasZero := e.zeroReceiveWindow(scale)
-		e.rcvBufSize = size
-		if wasZero && !e.zeroReceiveWindow(scale) {
-			mask |= notifyNonZeroReceiveWindow
-		}
-		e.rcvListMu.Unlock()
+	// Make sure the receive buffer size allows us to send a
+	// non-zero window size.
+	scale := uint8(0)
+	if e.rcv != nil {
+		scale = e.rcv.rcvWndScale
+	}
+	if size>>scale == 0 {
+		size = 1 << scale
+	}
 
-		e.segmentQueue.setLimit(2 * size)
+	// Make sure 2*size doesn't overflow.
+	if size > math.MaxInt32/2 {
+		size = math.MaxInt32 / 2
+	}
 
-		e.notifyProtocolGoroutine(mask)
-		return nil
+	wasZero := e.zeroReceiveWindow(scale)
+	e.rcvBufSize = size
+	if wasZero && !e.zeroReceiveWindow(scale) {
+		mask |= notifyNonZeroReceiveWindow
+	}
+	e.rcvListMu.Unlock()
 
-	case tcpip.SendBufferSizeOption:
-		// Make sure the send buffer size is within the min and max
-		// allowed.
-		size := int(v)
-		var ss SendBufferSizeOption
-		if err := e.stack.TransportProtocolOption(ProtocolNumber, &ss); err == nil {
-			if size < ss.Min {
-				size = ss.Min
-			}
-			if size > ss.Max {
-				size = ss.Max
-			}
-		}
+	e.segmentQueue.setLimit(2 * size)
 
-		e.sndBufMu.Lock()
-		e.sndBufSize = size
-		e.sndBufMu.Unlock()
-		return nil
+	e.notifyProtocolGoroutine(mask)
+}
 
-	case tcpip.V6OnlyOption:
-		// We only recognize this option on v6 endpoints.
-		if e.netProto != header.IPv6ProtocolNumber {
-			return tcpip.ErrInvalidEndpointState
+// setSendBufferSize sets the size of the send buffer, within the limits of the
+// protocol's SendBufferSizeOption.
+func (e *endpoint) setSendBufferSize(size int) {
+	var ss SendBufferSizeOption
+	if err := e.stack.TransportProtocolOption(ProtocolNumber, &ss); err == nil {
+		if size < ss.Min {
+			size = ss.Min
 		}
-
-		e.mu.Lock()
-		defer e.mu.Unlock()
-
-		// We only allow this to be set when we're in the initial state.
-		if e.state != stateInitial {
-			return tcpip.ErrInvalidEndpointState
+		if size > ss.Max {
+			size = ss.Max
 		}
+	}
 
-		e.v6only = v != 0
-		return nil
-
-	case tcpip.KeepaliveEnabledOption:
-		e.keepalive.Lock()
-		e.keepalive.enabled = v != 0
-		e.keepalive.Unlock()
-		e.notifyProtocolGoroutine(notifyKeepaliveChanged)
-		return nil
-
-	case tcpip.KeepaliveIdleOption:
-		e.keepalive.Lock()
-		e.keepalive.idle = time.Duration(v)
-		e.keepalive.Unlock()
-		e.notifyProtocolGoroutine(notifyKeepaliveChanged)
-		return nil
-
-	case tcpip.KeepaliveIntervalOption:
-		e.keepalive.Lock()
-		e.keepalive.interval = time.Duration(v)
-		e.keepalive.Unlock()
-		e.notifyProtocolGoroutine(notifyKeepaliveChanged)
-		return nil
-
-	case tcpip.KeepaliveCountOption:
-		e.keepalive.Lock()
-		e.keepalive.count = int(v)
-		e.keepalive.Unlock()
-		e.notifyProtocolGoroutine(notifyKeepaliveChanged)
-		return nil
-
-	case tcpip.BroadcastOption:
-		e.mu.Lock()
-		e.broadcast = v != 0
-		e.mu.Unlock()
-		return nil
+	e.sndBufMu.Lock()
+	// Writers waiting for room can go on if the buffer grew.
+	notify := e.sndBufUsed >= e.sndBufSize && e.sndBufUsed < size
+	e.sndBufSize = size
+	e.sndBufMu.Unlock()
 
-	default:
-		return nil
+	if notify {
+		e.waiterQueue.Notify(waiter.EventOut)
 	}
 }
 
+// updateKeepalive changes the keepalive settings of the endpoint with update,
+// and lets the protocol goroutine know.
+func (e *endpoint) updateKeepalive(update func(k *keepalive)) {
+	e.keepalive.Lock()
+	update(&e.keepalive)
+	e.keepalive.Unlock()
+	e.notifyProtocolGoroutine(notifyKeepaliveChanged)
+}
+
 // readyReceiveSize returns the number of bytes ready to be received.
 func (e *endpoint) readyReceiveSize() (int, *tcpip.Error) {
 	e.mu.RLock()
@@ -848,155 +1095,15 @@ func (e *endpoint) readyReceiveSize() (int, *tcpip.Error) {
 
 // GetSockOpt implements tcpip.Endpoint.GetSockOpt.
 func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
-	switch o := opt.(type) {
-	case tcpip.ErrorOption:
-		e.lastErrorMu.Lock()
-		err := e.lastError
-		e.lastError = nil
-		e.lastErrorMu.Unlock()
-		return err
-
-	case *tcpip.SendBufferSizeOption:
-		e.sndBufMu.Lock()
-		*o = tcpip.SendBufferSizeOption(e.sndBufSize)
-		e.sndBufMu.Unlock()
-		return nil
-
-	case *tcpip.ReceiveBufferSizeOption:
-		e.rcvListMu.Lock()
-		*o = tcpip.ReceiveBufferSizeOption(e.rcvBufSize)
-		e.rcvListMu.Unlock()
-		return nil
-
-	case *tcpip.ReceiveQueueSizeOption:
-		v, err := e.readyReceiveSize()
-		if err != nil {
-			return err
-		}
-
-		*o = tcpip.ReceiveQueueSizeOption(v)
-		return nil
-
-	case *tcpip.DelayOption:
-		*o = 0
-		if v := atomic.LoadUint32(&e.delay); v != 0 {
-			*o = 1
-		}
-		return nil
-
-	case *tcpip.CorkOption:
-		*o = 0
-		if v := atomic.LoadUint32(&e.cork); v != 0 {
-			*o = 1
-		}
-		return nil
-
-	case *tcpip.ReuseAddressOption:
-		e.mu.RLock()
-		v := e.reuseAddr
-		e.mu.RUnlock()
-
-		*o = 0
-		if v {
-			*o = 1
-		}
-		return nil
-
-	case *tcpip.ReusePortOption:
-		e.mu.RLock()
-		v := e.reusePort
-		e.mu.RUnlock()
-
-		*o = 0
-		if v {
-			*o = 1
-		}
-		return nil
-
-	case *tcpip.QuickAckOption:
-		*o = 1
-		if v := atomic.LoadUint32(&e.slowAck); v != 0 {
-			*o = 0
-		}
-		return nil
-
-	case *tcpip.V6OnlyOption:
-		// We only recognize this option on v6 endpoints.
-		if e.netProto != header.IPv6ProtocolNumber {
-			return tcpip.ErrUnknownProtocolOption
-		}
-
-		e.mu.Lock()
-		v := e.v6only
-		e.mu.Unlock()
-
-		*o = 0
-		if v {
-			*o = 1
-		}
-		return nil
-
-	case *tcpip.TCPInfoOption:
-		*o = tcpip.TCPInfoOption{}
-		e.mu.RLock()
-		snd := e.snd
-		e.mu.RUnlock()
-		if snd != nil {
-			snd.rtt.Lock()
-			o.RTT = snd.rtt.srtt
-			o.RTTVar = snd.rtt.rttvar
-			snd.rtt.Unlock()
-		}
-		return nil
-
-	case *tcpip.KeepaliveEnabledOption:
-		e.keepalive.Lock()
-		v := e.keepalive.enabled
-		e.keepalive.Unlock()
-
-		*o = 0
-		if v {
-			*o = 1
-		}
-		return nil
-
-	case *tcpip.KeepaliveIdleOption:
-		e.keepalive.Lock()
-		*o = tcpip.KeepaliveIdleOption(e.keepalive.idle)
-		e.keepalive.Unlock()
-		return nil
-
-	case *tcpip.KeepaliveIntervalOption:
-		e.keepalive.Lock()
-		*o = tcpip.KeepaliveIntervalOption(e.keepalive.interval)
-		e.keepalive.Unlock()
-		return nil
-
-	case *tcpip.KeepaliveCountOption:
-		e.keepalive.Lock()
-		*o = tcpip.KeepaliveCountOption(e.keepalive.count)
-		e.keepalive.Unlock()
-		return nil
-
-	case *tcpip.OutOfBandInlineOption:
-		// We don't currently support disabling this option.
-		*o = 1
-		return nil
-
-	case *tcpip.BroadcastOption:
-		e.mu.Lock()
-		v := e.broadcast
-		e.mu.Unlock()
-
-		*o = 0
-		if v {
-			*o = 1
-		}
-		return nil
-
-	default:
-		return tcpip.ErrUnknownProtocolOption
+	if _, ok := opt.(tcpip.ErrorOption); ok {
+		return e.lastError.Get()
 	}
+	return SockOpts.GetSockOpt(e, opt)
+}
+
+// SockOptStore implements tcpip.SockOptStorer.SockOptStore.
+func (e *endpoint) SockOptStore() *tcpip.SockOptStore {
+	return &e.sockOpts
 }
 
 func (e *endpoint) checkV4Mapped(addr *tcpip.FullAddress) (tcpip.NetworkProtocolNumber, *tcpip.Error) {
@@ -1025,16 +1132,14 @@ func (e *endpoint) checkV4Mapped(addr *tcpip.FullAddress) (tcpip.NetworkProtocol
 
 // Connect connects the endpoint to its peer.
 func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
-	return e.connect(addr, true, true)
+	return e.connect(addr, nil, true)
 }
 
-// connect connects the endpoint to its peer. In the normal non-S/R case, the
-// new connection is expected to run the main goroutine and perform handshake.
-// In restore of previously connected endpoints, both ends will be passively
-// created (so no new handshaking is done); for stack-accepted connections not
-// yet accepted by the app, they are restored without running the main goroutine
-// here.
-func (e *endpoint) connect(addr tcpip.FullAddress, handshake bool, run bool) (err *tcpip.Error) {
+// connect connects the endpoint to its peer. A new connection runs the main
+// goroutine, which performs the handshake. A connection restored from a
+// checkpoint is set up from restored instead, and for connections waiting to
+// be accepted, the main goroutine isn't run here.
+func (e *endpoint) connect(addr tcpip.FullAddress, restored *connCheckpoint, run bool) (err *tcpip.Error) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 	defer func() {
@@ -1091,7 +1196,7 @@ func (e *endpoint) connect(addr tcpip.FullAddress, handshake bool, run bool) (er
 	}
 
 	// Find a route to the desired destination.
-	r, err := e.stack.FindRoute(nicid, e.id.LocalAddress, addr.Addr, netProto, false /* multicastLoop */)
+	r, err := e.stack.FindRouteInVRF(e.vrf, nicid, e.id.LocalAddress, addr.Addr, netProto, false /* multicastLoop */)
 	if err != nil {
 		return err
 	}
@@ -1106,7 +1211,7 @@ func (e *endpoint) connect(addr tcpip.FullAddress, handshake bool, run bool) (er
 
 	if e.id.LocalPort != 0 {
 		// The endpoint is bound to a port, attempt to register it.
-		err := e.stack.RegisterTransportEndpoint(nicid, netProtos, ProtocolNumber, e.id, e, e.reusePort)
+		err := e.stack.RegisterTransportEndpointInVRF(e.vrf, nicid, netProtos, ProtocolNumber, e.id, e, e.reusePort)
 		if err != nil {
 			return err
 		}
@@ -1116,17 +1221,22 @@ func (e *endpoint) connect(addr tcpip.FullAddress, handshake bool, run bool) (er
 		// address/port for both local and remote (otherwise this
 		// endpoint would be trying to connect to itself).
 		sameAddr := e.id.LocalAddress == e.id.RemoteAddress
-		if _, err := e.stack.PickEphemeralPort(func(p uint16) (bool, *tcpip.Error) {
+		flow := ports.Flow{
+			LocalAddress:  e.id.LocalAddress,
+			RemoteAddress: e.id.RemoteAddress,
+			RemotePort:    e.id.RemotePort,
+		}
+		if _, err := e.stack.PickEphemeralPortForFlow(flow, func(p uint16) (bool, *tcpip.Error) {
 			if sameAddr && p == e.id.RemotePort {
 				return false, nil
 			}
-			if !e.stack.IsPortAvailable(netProtos, ProtocolNumber, e.id.LocalAddress, p, false) {
+			if !e.stack.VRFPortManager(e.vrf).IsPortAvailable(netProtos, ProtocolNumber, e.id.LocalAddress, p, false) {
 				return false, nil
 			}
 
 			id := e.id
 			id.LocalPort = p
-			switch e.stack.RegisterTransportEndpoint(nicid, netProtos, ProtocolNumber, id, e, e.reusePort) {
+			switch e.stack.RegisterTransportEndpointInVRF(e.vrf, nicid, netProtos, ProtocolNumber, id, e, e.reusePort) {
 			case nil:
 				e.id = id
 				return true, nil
@@ -1144,7 +1254,7 @@ func (e *endpoint) connect(addr tcpip.FullAddress, handshake bool, run bool) (er
 	// before Connect: in such a case we don't want to hold on to
 	// reservations anymore.
 	if e.isPortReserved {
-		e.stack.ReleasePort(e.effectiveNetProtos, ProtocolNumber, origID.LocalAddress, origID.LocalPort)
+		e.stack.VRFPortManager(e.vrf).ReleasePort(e.effectiveNetProtos, ProtocolNumber, origID.LocalAddress, origID.LocalPort)
 		e.isPortReserved = false
 	}
 
@@ -1155,25 +1265,17 @@ func (e *endpoint) connect(addr tcpip.FullAddress, handshake bool, run bool) (er
 	e.effectiveNetProtos = netProtos
 	e.connectingAddress = connectingAddr
 
-	// Connect in the restore phase does not perform handshake. Restore its
-	// connection setting here.
+	// Restored connections don't perform the handshake.
+	handshake := restored == nil
 	if !handshake {
-		e.segmentQueue.mu.Lock()
-		for _, l := range []segmentList{e.segmentQueue.list, e.sndQueue, e.snd.writeList} {
-			for s := l.Front(); s != nil; s = s.Next() {
-				s.id = e.id
-				s.route = r.Clone()
-				e.sndWaker.Assert()
-			}
-		}
-		e.segmentQueue.mu.Unlock()
-		e.snd.updateMaxPayloadSize(int(e.route.MTU()), 0)
-		e.state = stateConnected
+		e.restoreConnectionLocked(restored)
 	}
 
 	if run {
 		e.workerRunning = true
-		e.stack.Stats().TCP.ActiveConnectionOpenings.Increment()
+		if handshake {
+			e.stack.Stats().TCP.ActiveConnectionOpenings.Increment()
+		}
 		go e.protocolMainLoop(handshake)
 	}
 
@@ -1257,24 +1359,11 @@ func (e *endpoint) Listen(backlog int) (err *tcpip.Error) {
 
 	// Allow the backlog to be adjusted if the endpoint is not shutting down.
 	// When the endpoint shuts down, it sets workerCleanup to true, and from
-	// that point onward, acceptedChan is the responsibility of the cleanup()
-	// method (and should not be touched anywhere else, including here).
+	// that point onward, the accept queue is the responsibility of the
+	// cleanup() method (and should not be touched anywhere else, including
+	// here).
 	if e.state == stateListen && !e.workerCleanup {
-		// Adjust the size of the channel iff we can fix existing
-		// pending connections into the new one.
-		if len(e.acceptedChan) > backlog {
-			return tcpip.ErrInvalidEndpointState
-		}
-		if cap(e.acceptedChan) == backlog {
-			return nil
-		}
-		origChan := e.acceptedChan
-		e.acceptedChan = make(chan *endpoint, backlog)
-		close(origChan)
-		for ep := range origChan {
-			e.acceptedChan <- ep
-		}
-		return nil
+		return e.setAcceptBacklog(backlog)
 	}
 
 	// Endpoint must be bound before it can transition to listen mode.
@@ -1283,15 +1372,13 @@ func (e *endpoint) Listen(backlog int) (err *tcpip.Error) {
 	}
 
 	// Register the endpoint.
-	if err := e.stack.RegisterTransportEndpoint(e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e, e.reusePort); err != nil {
+	if err := e.stack.RegisterTransportEndpointInVRF(e.vrf, e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e, e.reusePort); err != nil {
 		return err
 	}
 
 	e.isRegistered = true
 	e.state = stateListen
-	if e.acceptedChan == nil {
-		e.acceptedChan = make(chan *endpoint, backlog)
-	}
+	e.openAcceptQueue(backlog)
 	e.workerRunning = true
 
 	e.stack.Stats().TCP.PassiveConnectionOpenings.Increment()
@@ -1311,7 +1398,7 @@ func (e *endpoint) startAcceptedLoop(waiterQueue *waiter.Queue) {
 
 // Accept returns a new endpoint if a peer has established a connection
 // to an endpoint previously set to listen mode.
-func (e *endpoint) Accept() (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
+func (e *endpoint) Accept(peerAddr *tcpip.FullAddress) (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
@@ -1321,13 +1408,21 @@ func (e *endpoint) Accept() (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
 	}
 
 	// Get the new accepted endpoint.
-	var n *endpoint
-	select {
-	case n = <-e.acceptedChan:
-	default:
+	n := e.dequeueAccepted()
+	if n == nil {
 		return nil, nil, tcpip.ErrWouldBlock
 	}
 
+	if peerAddr != nil {
+		// The accepted endpoint can't change its ID nor NIC, so they
+		// are read without its lock.
+		*peerAddr = tcpip.FullAddress{
+			Addr: n.id.RemoteAddress,
+			Port: n.id.RemotePort,
+			NIC:  n.boundNICID,
+		}
+	}
+
 	// Start the protocol goroutine.
 	wq := &waiter.Queue{}
 	n.startAcceptedLoop(wq)
@@ -1364,7 +1459,7 @@ func (e *endpoint) Bind(addr tcpip.FullAddress) (err *tcpip.Error) {
 		}
 	}
 
-	port, err := e.stack.ReservePort(netProtos, ProtocolNumber, addr.Addr, addr.Port, e.reusePort)
+	port, err := e.stack.VRFPortManager(e.vrf).ReservePort(netProtos, ProtocolNumber, addr.Addr, addr.Port, e.reusePort)
 	if err != nil {
 		return err
 	}
@@ -1376,7 +1471,7 @@ func (e *endpoint) Bind(addr tcpip.FullAddress) (err *tcpip.Error) {
 	// Any failures beyond this point must remove the port registration.
 	defer func() {
 		if err != nil {
-			e.stack.ReleasePort(netProtos, ProtocolNumber, addr.Addr, port)
+			e.stack.VRFPortManager(e.vrf).ReleasePort(netProtos, ProtocolNumber, addr.Addr, port)
 			e.isPortReserved = false
 			e.effectiveNetProtos = nil
 			e.id.LocalPort = 0
@@ -1386,9 +1481,12 @@ func (e *endpoint) Bind(addr tcpip.FullAddress) (err *tcpip.Error) {
 	}()
 
 	// If an address is specified, we must ensure that it's one of our
-	// local addresses.
-	if len(addr.Addr) != 0 {
-		nic := e.stack.CheckLocalAddress(addr.NIC, netProto, addr.Addr)
+	// local addresses, unless the endpoint is transparent.
+	if len(addr.Addr) != 0 && e.Transparent() {
+		e.boundNICID = addr.NIC
+		e.id.LocalAddress = addr.Addr
+	} else if len(addr.Addr) != 0 {
+		nic := e.stack.CheckLocalAddressInVRF(e.vrf, addr.NIC, netProto, addr.Addr)
 		if nic == 0 {
 			return tcpip.ErrBadLocalAddress
 		}
@@ -1403,6 +1501,11 @@ func (e *endpoint) Bind(addr tcpip.FullAddress) (err *tcpip.Error) {
 	return nil
 }
 
+// Transparent implements stack.TransparentEndpoint.Transparent.
+func (e *endpoint) Transparent() bool {
+	return atomic.LoadUint32(&e.transparent) != 0
+}
+
 // GetLocalAddress returns the address to which the endpoint is bound.
 func (e *endpoint) GetLocalAddress() (tcpip.FullAddress, *tcpip.Error) {
 	e.mu.RLock()
@@ -1433,11 +1536,18 @@ func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, *tcpip.Error) {
 
 // HandlePacket is called by the stack when new packets arrive to this transport
 // endpoint.
-func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, netHeader buffer.View, vv buffer.VectorisedView) {
-	s := newSegment(r, id, vv)
+func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, pkt *stack.PacketBuffer) {
+	if min := atomic.LoadUint32(&e.minTTL); min != 0 && uint32(pkt.TTL()) < min {
+		e.stack.Stats().DroppedPackets.Increment()
+		r.RecordDrop(tcpip.DropMinTTL, pkt.Data)
+		return
+	}
+
+	s := newSegment(r, id, pkt)
 	if !s.parse() {
 		e.stack.Stats().MalformedRcvdPackets.Increment()
 		e.stack.Stats().TCP.InvalidSegmentsReceived.Increment()
+		r.RecordDrop(tcpip.DropMalformed, s.data)
 		s.decRef()
 		return
 	}
@@ -1453,14 +1563,21 @@ func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, ne
 	} else {
 		// The queue is full, so we drop the segment.
 		e.stack.Stats().DroppedPackets.Increment()
+		r.RecordDrop(tcpip.DropQueueFull, s.data)
 		s.decRef()
 	}
 }
 
 // HandleControlPacket implements stack.TransportEndpoint.HandleControlPacket.
-func (e *endpoint) HandleControlPacket(id stack.TransportEndpointID, typ stack.ControlType, extra uint32, vv buffer.VectorisedView) {
+func (e *endpoint) HandleControlPacket(id stack.TransportEndpointID, typ stack.ControlType, extra uint32, info stack.ControlInfo, vv buffer.VectorisedView) {
 	switch typ {
 	case stack.ControlPacketTooBig:
+		e.mu.RLock()
+		locked := e.route.MTULocked()
+		e.mu.RUnlock()
+		if locked {
+			return
+		}
 		e.sndBufMu.Lock()
 		e.packetTooBigCount++
 		if v := int(extra); v < e.sndMTU {
@@ -1469,15 +1586,76 @@ func (e *endpoint) HandleControlPacket(id stack.TransportEndpointID, typ stack.C
 		e.sndBufMu.Unlock()
 
 		e.notifyProtocolGoroutine(notifyMTUChanged)
+
+	case stack.ControlMTUChanged:
+		e.notifyProtocolGoroutine(notifyLinkMTUChanged)
+
+	case stack.ControlNICRemoved:
+		e.notifyProtocolGoroutine(notifyNICRemoved)
+
+	// The other errors are soft errors: the connection keeps going, as the
+	// problem may be transient, but they're reported as the pending error.
+	case stack.ControlPortUnreachable:
+		e.reportError(tcpip.ErrConnectionRefused)
+
+	case stack.ControlTimeExceeded:
+		e.reportError(tcpip.ErrHostUnreachable)
+
+	case stack.ControlHostUnreachable:
+		e.mu.RLock()
+		through := e.route.UsesNeighbor(tcpip.FullAddress{NIC: tcpip.NICID(extra), Addr: info.Offender})
+		e.mu.RUnlock()
+		if through {
+			e.reportError(tcpip.ErrHostUnreachable)
+		}
 	}
 }
 
+// reportError makes err the pending error of the endpoint, which is retrieved
+// with tcpip.ErrorOption.
+func (e *endpoint) reportError(err *tcpip.Error) {
+	e.lastError.Set(err)
+	e.waiterQueue.Notify(waiter.EventErr)
+}
+
+// updateSndBufferSent is called by the protocol goroutine when v bytes of the
+// send buffer are sent for the first time.
+func (e *endpoint) updateSndBufferSent(v int) {
+	e.sndBufMu.Lock()
+	e.sndBufInFlight += v
+	e.sndBufMu.Unlock()
+}
+
+// sendQueueSizes returns the number of bytes in the send buffer, and how many
+// of them weren't sent yet.
+func (e *endpoint) sendQueueSizes() (used, unsent int, err *tcpip.Error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	// The endpoint cannot be in listen state.
+	if e.state == stateListen {
+		return 0, 0, tcpip.ErrInvalidEndpointState
+	}
+
+	e.sndBufMu.Lock()
+	defer e.sndBufMu.Unlock()
+
+	unsent = e.sndBufUsed - e.sndBufInFlight
+	if unsent < 0 {
+		unsent = 0
+	}
+	return e.sndBufUsed, unsent, nil
+}
+
 // updateSndBufferUsage is called by the protocol goroutine when room opens up
 // in the send buffer. The number of newly available bytes is v.
 func (e *endpoint) updateSndBufferUsage(v int) {
 	e.sndBufMu.Lock()
 	notify := e.sndBufUsed >= e.sndBufSize>>1
 	e.sndBufUsed -= v
+	if e.sndBufInFlight -= v; e.sndBufInFlight < 0 {
+		e.sndBufInFlight = 0
+	}
 	// We only notify when there is half the sndBufSize available after
 	// a full buffer event occurs. This ensures that we don't wake up
 	// writers to queue just 1-2 segments and go back to sleep.
@@ -1503,6 +1681,11 @@ func (e *endpoint) readyToRead(s *segment) {
 	}
 	e.rcvListMu.Unlock()
 
+	if s == nil {
+		// The endpoint may now be hung up as well, see Readiness.
+		e.waiterQueue.Notify(waiter.EventIn | waiter.EventHUp)
+		return
+	}
 	e.waiterQueue.Notify(waiter.EventIn)
 }
 
@@ -1511,7 +1694,7 @@ func (e *endpoint) readyToRead(s *segment) {
 func (e *endpoint) receiveBufferAvailable() int {
 	e.rcvListMu.Lock()
 	size := e.rcvBufSize
-	used := e.rcvBufUsed
+	used := e.rcvBufUsed + e.rcvBufLent
 	e.rcvListMu.Unlock()
 
 	// We may use more bytes than the buffer size when the receive buffer
@@ -1552,14 +1735,13 @@ func (e *endpoint) maybeEnableTimestamp(synOpts *header.TCPSynOptions) {
 // timestamp returns the timestamp value to be used in the TSVal field of the
 // timestamp option for outgoing TCP segments for a given endpoint.
 func (e *endpoint) timestamp() uint32 {
-	return tcpTimeStamp(e.tsOffset)
+	return tcpTimeStamp(e.stack.Now(), e.tsOffset)
 }
 
 // tcpTimeStamp returns a timestamp offset by the provided offset. This is
 // not inlined above as it's used when SYN cookies are in use and endpoint
 // is not created at the time when the SYN cookie is sent.
-func tcpTimeStamp(offset uint32) uint32 {
-	now := time.Now()
+func tcpTimeStamp(now time.Time, offset uint32) uint32 {
 	return uint32(now.Unix()*1000+int64(now.Nanosecond()/1e6)) + offset
 }
 
@@ -1599,7 +1781,11 @@ func (e *endpoint) maybeEnableSACKPermitted(synOpts *header.TCPSynOptions) {
 // maxOptionSize return the maximum size of TCP options.
 func (e *endpoint) maxOptionSize() (size int) {
 	var maxSackBlocks [header.TCPMaxSACKBlocks]header.SACKBlock
-	options := e.makeOptions(maxSackBlocks[:])
+	var mptcpOpt []byte
+	if e.mptcp != nil {
+		mptcpOpt = make([]byte, mptcpOptionSpace)
+	}
+	options := e.makeOptions(maxSackBlocks[:], mptcpOpt)
 	size = len(options)
 	putOptions(options)
 
@@ -1611,7 +1797,7 @@ func (e *endpoint) maxOptionSize() (size int) {
 // there are intervening syscalls when the state is being copied.
 func (e *endpoint) completeState() stack.TCPEndpointState {
 	var s stack.TCPEndpointState
-	s.SegTime = time.Now()
+	s.SegTime = e.stack.Now()
 
 	// Copy EndpointID.
 	e.mu.Lock()
@@ -1655,8 +1841,10 @@ func (e *endpoint) completeState() stack.TCPEndpointState {
 
 	// Copy sender state.
 	s.Sender = stack.TCPSenderState{
-		LastSendTime: e.snd.lastSendTime,
-		DupAckCount:  e.snd.dupAckCount,
+		LastSendTime:    e.snd.lastSendTime,
+		DupAckCount:     e.snd.dupAckCount,
+		DupAckThreshold: e.snd.dupAckThreshold,
+		Reordering:      e.snd.reordering,
 		FastRecovery: stack.TCPFastRecoveryState{
 			Active:  e.snd.fr.active,
 			First:   e.snd.fr.first,
@@ -1688,7 +1876,7 @@ func (e *endpoint) completeState() stack.TCPEndpointState {
 			WMax:                    cubic.wMax,
 			WLastMax:                cubic.wLastMax,
 			T:                       cubic.t,
-			TimeSinceLastCongestion: time.Since(cubic.t),
+			TimeSinceLastCongestion: e.stack.Now().Sub(cubic.t),
 			C:                       cubic.c,
 			K:                       cubic.k,
 			Beta:                    cubic.beta,
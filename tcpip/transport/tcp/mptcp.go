@@ -0,0 +1,166 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/seqnum"
+)
+
+const (
+	// mptcpFlags are the MP_CAPABLE flags we send. DSS checksums aren't
+	// supported, so we never require them.
+	mptcpFlags = header.MPCapableHMACSHA256
+
+	// mptcpOptionSpace is the room taken by the Multipath TCP option of
+	// segments sent once connected: a DSS option, padded to a multiple of
+	// 4 bytes.
+	mptcpOptionSpace = (header.DSSMaxSize + 3) &^ 3
+)
+
+// mptcpState is the connection-level state of a Multipath TCP connection, as
+// defined in RFC 8684. Only the initial subflow is supported, so the data
+// sequence space maps one-to-one onto the subflow's sequence space.
+//
+// +stateify savable
+type mptcpState struct {
+	// The keys are immutable.
+	localKey  uint64
+	remoteKey uint64
+
+	// The following fields are only accessed by the protocol goroutine.
+
+	// sendKeys is set on the active side until the ACK completing the
+	// handshake, which echoes both keys, was sent.
+	sendKeys bool
+
+	// iss is the initial sequence number of the subflow, which subflow
+	// sequence numbers in mappings are relative to.
+	iss seqnum.Value
+
+	// sndDSN is the data sequence number of the subflow sequence number
+	// sndSeq. They are used to extend the 32-bit sequence numbers sent to
+	// 64-bit data sequence numbers. rcvSeq and rcvDSN do the same for the
+	// sequence numbers acknowledged.
+	sndSeq seqnum.Value
+	sndDSN uint64
+	rcvSeq seqnum.Value
+	rcvDSN uint64
+
+	// fallback is set once the peer stopped sending Multipath TCP options
+	// and the connection fell back to regular TCP. It is accessed
+	// atomically.
+	fallback uint32
+}
+
+// newMPTCPKey returns a random, non-zero key.
+func newMPTCPKey() uint64 {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		if k := binary.LittleEndian.Uint64(b[:]); k != 0 {
+			return k
+		}
+	}
+}
+
+// acceptableMPCapable reports whether Multipath TCP can be negotiated with a
+// peer that sent the MP_CAPABLE option o.
+func acceptableMPCapable(o *header.MPCapableOption) bool {
+	return o.Version == header.MPTCPVersion && o.Flags&header.MPCapableHMACSHA256 != 0 && o.Flags&header.MPCapableChecksum == 0
+}
+
+// newMPTCPState returns the state of a connection negotiated with the given
+// keys on a subflow with the given initial sequence numbers.
+func newMPTCPState(localKey, remoteKey uint64, iss, irs seqnum.Value) *mptcpState {
+	// Like in the subflow, the first data byte is numbered IDSN+1.
+	return &mptcpState{
+		localKey:  localKey,
+		remoteKey: remoteKey,
+		iss:       iss,
+		sndSeq:    iss,
+		sndDSN:    header.MPTCPIDSN(localKey),
+		rcvSeq:    irs,
+		rcvDSN:    header.MPTCPIDSN(remoteKey),
+	}
+}
+
+// active reports whether the connection still uses Multipath TCP.
+func (m *mptcpState) active() bool {
+	return atomic.LoadUint32(&m.fallback) == 0
+}
+
+// fallBack makes the connection fall back to regular TCP.
+func (m *mptcpState) fallBack() {
+	atomic.StoreUint32(&m.fallback, 1)
+}
+
+// extendSeq returns the 64-bit sequence number of seq, given that ref is
+// numbered *base. ref and base move forward with seq.
+func extendSeq(ref *seqnum.Value, base *uint64, seq seqnum.Value) uint64 {
+	if ref.LessThanEq(seq) {
+		*base += uint64(ref.Size(seq))
+		*ref = seq
+		return *base
+	}
+	return *base - uint64(seq.Size(*ref))
+}
+
+// encodeOption encodes in b the Multipath TCP option of a segment with the
+// given flags, sequence and acknowledgement numbers and data length. It
+// returns the number of bytes written, which is zero if the segment needs no
+// option.
+func (m *mptcpState) encodeOption(b []byte, flags byte, seq, ack seqnum.Value, dataLen int) int {
+	if !m.active() || flags&header.TCPFlagRst != 0 {
+		return 0
+	}
+
+	if m.sendKeys {
+		m.sendKeys = false
+		return header.EncodeMPCapableOption(header.MPCapableOption{
+			Version:     header.MPTCPVersion,
+			Flags:       mptcpFlags,
+			SenderKey:   m.localKey,
+			ReceiverKey: m.remoteKey,
+		}, b)
+	}
+
+	var dss header.DSSOption
+	if flags&header.TCPFlagAck != 0 {
+		dss.HasDataAck = true
+		dss.DataAck = extendSeq(&m.rcvSeq, &m.rcvDSN, ack)
+	}
+	if dataLen > 0 || flags&header.TCPFlagFin != 0 {
+		dss.HasMapping = true
+		dss.DSN = extendSeq(&m.sndSeq, &m.sndDSN, seq)
+		dss.DataLen = uint16(dataLen)
+		if dataLen > 0 {
+			dss.SSN = uint32(m.iss.Size(seq))
+		}
+		// The DATA_FIN goes with the subflow's FIN, and takes one
+		// data sequence number like it.
+		if flags&header.TCPFlagFin != 0 {
+			dss.DataFin = true
+			dss.DataLen++
+		}
+	}
+	return header.EncodeDSSOption(dss, b)
+}
@@ -0,0 +1,206 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/tcp/testing/context"
+	"github.com/google/netstack/waiter"
+)
+
+// connectMPTCP connects two endpoints over a loopback stack, with Multipath
+// TCP enabled on the listener and the client as requested, and exchanges data
+// over the connection. It returns the client and accepted endpoints.
+func connectMPTCP(t *testing.T, listener, client bool) (tcpip.Endpoint, tcpip.Endpoint) {
+	t.Helper()
+	s, err := makeStack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lwq waiter.Queue
+	lep, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &lwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer lep.Close()
+	if listener {
+		if err := lep.SetSockOpt(tcpip.MPTCPOption(1)); err != nil {
+			t.Fatalf("SetSockOpt(MPTCPOption(1)) failed: %v", err)
+		}
+	}
+	if err := lep.Bind(tcpip.FullAddress{Port: context.StackPort}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := lep.Listen(1); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	var cwq waiter.Queue
+	cep, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &cwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if client {
+		if err := cep.SetSockOpt(tcpip.MPTCPOption(1)); err != nil {
+			t.Fatalf("SetSockOpt(MPTCPOption(1)) failed: %v", err)
+		}
+	}
+	we, ch := waiter.NewChannelEntry(nil)
+	cwq.EventRegister(&we, waiter.EventOut)
+	if err := cep.Connect(tcpip.FullAddress{Addr: context.StackAddr, Port: context.StackPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("got cep.Connect(...) = %v, want = %v", err, tcpip.ErrConnectStarted)
+	}
+	<-ch
+	cwq.EventUnregister(&we)
+	if err := cep.GetSockOpt(tcpip.ErrorOption{}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	lwe, lch := waiter.NewChannelEntry(nil)
+	lwq.EventRegister(&lwe, waiter.EventIn)
+	defer lwq.EventUnregister(&lwe)
+	aep, awq, err := lep.Accept(nil)
+	if err == tcpip.ErrWouldBlock {
+		select {
+		case <-lch:
+			aep, awq, err = lep.Accept(nil)
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for accept")
+		}
+	}
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	transfer(t, cep, aep, awq)
+	transfer(t, aep, cep, &cwq)
+	return cep, aep
+}
+
+// transfer writes data to from, and reads it back from to.
+func transfer(t *testing.T, from, to tcpip.Endpoint, wq *waiter.Queue) {
+	t.Helper()
+	data := buffer.NewView(3000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, _, err := from.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+	var got buffer.View
+	for len(got) < len(data) {
+		v, _, err := to.Read(nil)
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-ch:
+				continue
+			case <-time.After(time.Second):
+				t.Fatalf("Timed out waiting for data, got %d bytes", len(got))
+			}
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		got = append(got, v...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got data = %v, want = %v", got, data)
+	}
+}
+
+func TestMPTCPNegotiated(t *testing.T) {
+	cep, aep := connectMPTCP(t, true, true)
+	defer cep.Close()
+	defer aep.Close()
+
+	var cinfo, ainfo tcpip.MPTCPInfoOption
+	if err := cep.GetSockOpt(&cinfo); err != nil {
+		t.Fatalf("GetSockOpt(&MPTCPInfoOption{}) failed: %v", err)
+	}
+	if err := aep.GetSockOpt(&ainfo); err != nil {
+		t.Fatalf("GetSockOpt(&MPTCPInfoOption{}) failed: %v", err)
+	}
+	if !cinfo.Enabled || !ainfo.Enabled {
+		t.Fatalf("got client info = %+v, accepted info = %+v, want Multipath TCP enabled on both", cinfo, ainfo)
+	}
+	if cinfo.LocalKey == 0 || cinfo.LocalKey != ainfo.RemoteKey || cinfo.RemoteKey != ainfo.LocalKey {
+		t.Errorf("got client info = %+v, accepted info = %+v, want matching keys", cinfo, ainfo)
+	}
+	if want := header.MPTCPToken(cinfo.LocalKey); cinfo.LocalToken != want || ainfo.RemoteToken != want {
+		t.Errorf("got client info = %+v, accepted info = %+v, want client token = %#x", cinfo, ainfo, want)
+	}
+}
+
+func TestMPTCPNotNegotiated(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		listener, client bool
+	}{
+		{"listener only", true, false},
+		{"client only", false, true},
+		{"neither", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cep, aep := connectMPTCP(t, tc.listener, tc.client)
+			defer cep.Close()
+			defer aep.Close()
+
+			for _, ep := range []tcpip.Endpoint{cep, aep} {
+				var info tcpip.MPTCPInfoOption
+				if err := ep.GetSockOpt(&info); err != nil {
+					t.Fatalf("GetSockOpt(&MPTCPInfoOption{}) failed: %v", err)
+				}
+				if info != (tcpip.MPTCPInfoOption{}) {
+					t.Errorf("got info = %+v, want Multipath TCP disabled", info)
+				}
+			}
+		})
+	}
+}
+
+func TestMPTCPInfoNotConnected(t *testing.T) {
+	s, err := makeStack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	var v tcpip.MPTCPOption
+	if err := ep.GetSockOpt(&v); err != nil || v != 0 {
+		t.Fatalf("got GetSockOpt(&MPTCPOption) = %d, %v, want = 0, nil", v, err)
+	}
+	var info tcpip.MPTCPInfoOption
+	if err := ep.GetSockOpt(&info); err != tcpip.ErrNotConnected {
+		t.Fatalf("got GetSockOpt(&MPTCPInfoOption{}) = %v, want = %v", err, tcpip.ErrNotConnected)
+	}
+}
@@ -87,6 +87,7 @@ type protocol struct {
 	sendBufferSize             SendBufferSizeOption
 	recvBufferSize             ReceiveBufferSizeOption
 	congestionControl          string
+	delayedAck                 DelayedAckOption
 	availableCongestionControl []string
 	allowedCongestionControl   []string
 }
@@ -126,8 +127,8 @@ func (*protocol) ParsePorts(v buffer.View) (src, dst uint16, err *tcpip.Error) {
 // a reset is sent in response to any incoming segment except another reset. In
 // particular, SYNs addressed to a non-existent connection are rejected by this
 // means."
-func (*protocol) HandleUnknownDestinationPacket(r *stack.Route, id stack.TransportEndpointID, vv buffer.VectorisedView) bool {
-	s := newSegment(r, id, vv)
+func (*protocol) HandleUnknownDestinationPacket(r *stack.Route, id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+	s := newSegment(r, id, pkt)
 	defer s.decRef()
 
 	if !s.parse() {
@@ -153,7 +154,7 @@ func replyWithReset(s *segment) {
 
 	ack := s.sequenceNumber.Add(s.logicalLen())
 
-	sendTCP(&s.route, s.id, buffer.VectorisedView{}, s.route.DefaultTTL(), header.TCPFlagRst|header.TCPFlagAck, seq, ack, 0, nil)
+	sendTCP(&s.route, s.id, buffer.VectorisedView{}, stack.NetworkHeaderParams{TTL: s.route.DefaultTTL()}, header.TCPFlagRst|header.TCPFlagAck, seq, ack, 0, nil)
 }
 
 // SetOption implements TransportProtocol.SetOption.
@@ -193,6 +194,17 @@ func (p *protocol) SetOption(option interface{}) *tcpip.Error {
 			}
 		}
 		return tcpip.ErrInvalidOptionValue
+
+	case DelayedAckOption:
+		v, err := v.check()
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.delayedAck = v
+		p.mu.Unlock()
+		return nil
+
 	default:
 		return tcpip.ErrUnknownProtocolOption
 	}
@@ -228,6 +240,11 @@ func (p *protocol) Option(option interface{}) *tcpip.Error {
 		*v = AvailableCongestionControlOption(strings.Join(p.availableCongestionControl, " "))
 		p.mu.Unlock()
 		return nil
+	case *DelayedAckOption:
+		p.mu.Lock()
+		*v = p.delayedAck
+		p.mu.Unlock()
+		return nil
 	default:
 		return tcpip.ErrUnknownProtocolOption
 	}
@@ -239,6 +256,7 @@ func init() {
 			sendBufferSize:             SendBufferSizeOption{minBufferSize, DefaultBufferSize, maxBufferSize},
 			recvBufferSize:             ReceiveBufferSizeOption{minBufferSize, DefaultBufferSize, maxBufferSize},
 			congestionControl:          ccReno,
+			delayedAck:                 DelayedAckOption{Segments: defaultDelayedAckSegments},
 			availableCongestionControl: []string{ccReno, ccCubic},
 		}
 	})
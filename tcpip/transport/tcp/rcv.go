@@ -45,6 +45,12 @@ type receiver struct {
 	pendingRcvdSegments segmentHeap
 	pendingBufUsed      seqnum.Size
 	pendingBufSize      seqnum.Size
+
+	// unackedSegs is the number of data segments consumed since the last
+	// acknowledgment was sent, and ackNow is set when the next one must
+	// not be delayed, see endpoint.sendOrDelayAck.
+	unackedSegs int
+	ackNow      bool
 }
 
 func newReceiver(ep *endpoint, irs seqnum.Value, rcvWnd seqnum.Size, rcvWndScale uint8) *receiver {
@@ -122,6 +128,7 @@ func (r *receiver) consumeSegment(s *segment, segSeq seqnum.Value, segLen seqnum
 
 		// Move segment to ready-to-deliver list. Wakeup any waiters.
 		r.ep.readyToRead(s)
+		r.unackedSegs++
 
 	} else if segSeq != r.rcvNxt {
 		return false
@@ -202,7 +209,11 @@ func (r *receiver) handleRcvdSegment(s *segment) {
 
 	// By consuming the current segment, we may have filled a gap in the
 	// sequence number domain that allows pending segments to be consumed
-	// now. So try to do it.
+	// now. So try to do it. The peer is told right away, as required by
+	// RFC 5681 section 4.2.
+	if r.pendingRcvdSegments.Len() > 0 {
+		r.ackNow = true
+	}
 	for !r.closed && r.pendingRcvdSegments.Len() > 0 {
 		s := r.pendingRcvdSegments[0]
 		segLen := seqnum.Size(s.data.Size())
@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/seqnum"
+)
+
+// maxDupAckThreshold is the largest the duplicate ACK threshold of a
+// connection grows to with the reordering seen on it, the default of Linux's
+// tcp_max_reordering.
+const maxDupAckThreshold = 300
+
+// noteReordering records that data was delivered out of order, with degree
+// segments from its start to the end of the data delivered before it, and
+// raises the duplicate ACK threshold so that as much reordering no longer
+// triggers a fast retransmit, as suggested by RFC 4653. Such data causes at most
+// degree-1 duplicate ACKs.
+func (s *sender) noteReordering(degree int) {
+	if degree <= 1 {
+		return
+	}
+	s.ep.stack.Stats().TCP.Reordering.Increment()
+	if degree > s.reordering {
+		s.reordering = degree
+	}
+	if t := degree; t > s.dupAckThreshold {
+		if t > maxDupAckThreshold {
+			t = maxDupAckThreshold
+		}
+		s.dupAckThreshold = t
+	}
+}
+
+// segmentsBetween returns the number of full-sized segments, rounded up, from
+// start to end.
+func (s *sender) segmentsBetween(start, end seqnum.Value) int {
+	n := int(start.Size(end))
+	if n == 0 {
+		return 0
+	}
+	return (n-1)/s.maxPayloadSize + 1
+}
+
+// retransmitted returns whether any of the data of sb, which must be in the
+// write list, was sent more than once.
+func (s *sender) retransmitted(sb header.SACKBlock) bool {
+	for seg := s.writeList.Front(); seg != nil && seg.sequenceNumber.LessThan(sb.End); seg = seg.Next() {
+		if seg.xmitCount > 1 && sb.Start.LessThan(seg.sequenceNumber.Add(seg.logicalLen())) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSACKReordering is called for each block newly inserted in the SACK
+// scoreboard, whose highest SACKed sequence number was fack before the
+// segment that carried it. Data SACKed below data that was already SACKed
+// arrived out of order, unless it was retransmitted.
+func (s *sender) checkSACKReordering(sb header.SACKBlock, fack seqnum.Value) {
+	if sb.Start.LessThan(fack) && !s.retransmitted(sb) {
+		s.noteReordering(s.segmentsBetween(sb.Start, fack))
+	}
+}
+
+// checkDSACK handles the first SACK block of a segment acknowledging up to
+// ack, which is a D-SACK block if it's below ack, RFC 2883 section 4. A D-SACK
+// for the segment resent by the last fast retransmit shows that the original
+// was only delayed, and the retransmission spurious.
+func (s *sender) checkDSACK(sb header.SACKBlock, ack seqnum.Value) {
+	if !sb.End.LessThanEq(ack) || s.fastRtx.Start == s.fastRtx.End {
+		return
+	}
+	if s.fastRtx.Start.LessThanEq(sb.Start) && sb.End.LessThanEq(s.fastRtx.End) {
+		s.fastRtx = header.SACKBlock{}
+		s.ep.stack.Stats().TCP.SpuriousRetransmits.Increment()
+		// The original arrived after at least as many segments as it
+		// took to trigger the retransmission.
+		s.noteReordering(s.dupAckThreshold + 1)
+	}
+}
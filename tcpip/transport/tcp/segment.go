@@ -15,9 +15,11 @@
 package tcp
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/seqnum"
@@ -54,43 +56,68 @@ type segment struct {
 	// xmitTime is the last transmit time of this segment. A zero value
 	// indicates that the segment has yet to be transmitted.
 	xmitTime time.Time
+	// xmitCount is the number of times this segment was transmitted.
+	xmitCount uint32
+
+	// timestamping holds the transmit timestamps requested for the data of
+	// this outgoing segment.
+	timestamping tcpip.TimestampingOption
+}
+
+// segmentPool recycles segments once their last reference is dropped, as one
+// is allocated for every packet sent or received.
+var segmentPool = sync.Pool{
+	New: func() interface{} {
+		return &segment{}
+	},
 }
 
-func newSegment(r *stack.Route, id stack.TransportEndpointID, vv buffer.VectorisedView) *segment {
-	s := &segment{
-		refCnt: 1,
-		id:     id,
-		route:  r.Clone(),
+// allocSegment returns a zeroed segment with a single reference, stamped with
+// the current time of the stack of r. r may be nil for segments that are
+// neither sent nor answered, like the received data restored from a
+// checkpoint, which keep the time they were received at.
+func allocSegment(r *stack.Route, id stack.TransportEndpointID) *segment {
+	s := segmentPool.Get().(*segment)
+	s.refCnt = 1
+	s.id = id
+	if r != nil {
+		s.route = r.Clone()
+		s.rcvdTime = r.Now()
 	}
-	s.data = vv.Clone(s.views[:])
-	s.rcvdTime = time.Now()
+	return s
+}
+
+func newSegment(r *stack.Route, id stack.TransportEndpointID, pkt *stack.PacketBuffer) *segment {
+	s := allocSegment(r, id)
+	s.data = pkt.OwnedData(s.views[:])
 	return s
 }
 
 func newSegmentFromView(r *stack.Route, id stack.TransportEndpointID, v buffer.View) *segment {
-	s := &segment{
-		refCnt: 1,
-		id:     id,
-		route:  r.Clone(),
-	}
+	s := allocSegment(r, id)
 	s.views[0] = v
 	s.data = buffer.NewVectorisedView(len(v), s.views[:1])
-	s.rcvdTime = time.Now()
+	return s
+}
+
+// newSegmentFromVectorisedView creates a segment holding vv without copying
+// its views.
+func newSegmentFromVectorisedView(r *stack.Route, id stack.TransportEndpointID, vv buffer.VectorisedView) *segment {
+	s := allocSegment(r, id)
+	s.data = vv.Clone(s.views[:])
 	return s
 }
 
 func (s *segment) clone() *segment {
-	t := &segment{
-		refCnt:         1,
-		id:             s.id,
-		sequenceNumber: s.sequenceNumber,
-		ackNumber:      s.ackNumber,
-		flags:          s.flags,
-		window:         s.window,
-		route:          s.route.Clone(),
-		viewToDeliver:  s.viewToDeliver,
-		rcvdTime:       s.rcvdTime,
-	}
+	t := allocSegment(&s.route, s.id)
+	t.sequenceNumber = s.sequenceNumber
+	t.ackNumber = s.ackNumber
+	t.flags = s.flags
+	t.window = s.window
+	t.viewToDeliver = s.viewToDeliver
+	t.rcvdTime = s.rcvdTime
+	t.xmitCount = s.xmitCount
+	t.timestamping = s.timestamping
 	t.data = s.data.Clone(t.views[:])
 	return t
 }
@@ -99,9 +126,14 @@ func (s *segment) flagIsSet(flag uint8) bool {
 	return (s.flags & flag) != 0
 }
 
+// decRef drops a reference on the segment. Once the last one is dropped, the
+// segment is recycled and must no longer be used, though views previously
+// obtained from its data remain valid.
 func (s *segment) decRef() {
 	if atomic.AddInt32(&s.refCnt, -1) == 0 {
 		s.route.Release()
+		*s = segment{}
+		segmentPool.Put(s)
 	}
 }
 
@@ -126,22 +158,14 @@ func (s *segment) logicalLen() seqnum.Size {
 // segment from the TCP header stored in the data. It then updates the view to
 // skip the data. Returns boolean indicating if the parsing was successful.
 func (s *segment) parse() bool {
-	h := header.TCP(s.data.First())
-
-	// h is the header followed by the payload. We check that the offset to
-	// the data respects the following constraints:
-	// 1. That it's at least the minimum header size; if we don't do this
-	//    then part of the header would be delivered to user.
-	// 2. That the header fits within the buffer; if we don't do this, we
-	//    would panic when we tried to access data beyond the buffer.
-	//
-	// N.B. The segment has already been validated as having at least the
-	//      minimum TCP size before reaching here, so it's safe to read the
-	//      fields.
-	offset := int(h.DataOffset())
-	if offset < header.TCPMinimumSize || offset > len(h) {
+	// The header must fit within the first view, with a data offset of at
+	// least the minimum header size, so that no part of it is delivered to
+	// the user.
+	h, err := header.ParseTCP(s.data.First(), header.ParseLenient)
+	if err != nil {
 		return false
 	}
+	offset := int(h.DataOffset())
 
 	s.options = []byte(h[header.TCPMinimumSize:offset])
 	s.parsedOptions = header.ParseTCPOptions(s.options)
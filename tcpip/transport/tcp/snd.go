@@ -34,16 +34,21 @@ const (
 	// InitialCwnd is the initial congestion window.
 	InitialCwnd = 10
 
-	// nDupAckThreshold is the number of duplicate ACK's required
-	// before fast-retransmit is entered.
+	// nDupAckThreshold is the initial number of duplicate ACK's required
+	// before fast-retransmit is entered, see sender.dupAckThreshold.
 	nDupAckThreshold = 3
+
+	// neighborConfirmInterval is the shortest interval between the
+	// confirmations of the reachability of the next hop, see
+	// sender.confirmNeighbor.
+	neighborConfirmInterval = time.Second
 )
 
 // congestionControl is an interface that must be implemented by any supported
 // congestion control algorithm.
 type congestionControl interface {
-	// HandleNDupAcks is invoked when sender.dupAckCount >= nDupAckThreshold
-	// just before entering fast retransmit.
+	// HandleNDupAcks is invoked when sender.dupAckCount reaches
+	// sender.dupAckThreshold just before entering fast retransmit.
 	HandleNDupAcks()
 
 	// HandleRTOExpired is invoked when the retransmit timer expires.
@@ -73,12 +78,27 @@ type sender struct {
 	// fast retransmit.
 	dupAckCount int
 
+	// dupAckThreshold is the number of duplicate acks that trigger a fast
+	// retransmit. It starts at nDupAckThreshold, and grows with the
+	// largest reordering degree seen on the connection, reordering, see
+	// noteReordering.
+	dupAckThreshold int
+	reordering      int
+
+	// fastRtx is the data resent by the last fast retransmit, until a
+	// D-SACK shows it was resent spuriously.
+	fastRtx header.SACKBlock
+
 	// fr holds state related to fast recovery.
 	fr fastRecovery
 
 	// sndCwnd is the congestion window, in packets.
 	sndCwnd int
 
+	// initialCwnd is the initial congestion window, in packets: the one of
+	// the route, or InitialCwnd.
+	initialCwnd int
+
 	// sndSsthresh is the threshold between slow start and congestion
 	// avoidance.
 	sndSsthresh int
@@ -112,6 +132,10 @@ type sender struct {
 	// rttMeasureTime is the time when the rttMeasureSeqNum was sent.
 	rttMeasureTime time.Time
 
+	// neighborConfirmed is the last time the acknowledgement of new data
+	// confirmed that the next hop is reachable, see confirmNeighbor.
+	neighborConfirmed time.Time
+
 	closed      bool
 	writeNext   *segment
 	writeList   segmentList
@@ -129,6 +153,10 @@ type sender struct {
 	// It is initialized on demand.
 	maxPayloadSize int
 
+	// peerMaxPayloadSize is the largest payload allowed by the MSS
+	// advertised by the peer. maxPayloadSize never exceeds it.
+	peerMaxPayloadSize int
+
 	// sndWndScale is the number of bits to shift left when reading the send
 	// window size from a segment.
 	sndWndScale uint8
@@ -138,6 +166,25 @@ type sender struct {
 
 	// cc is the congestion control algorithm in use for this sender.
 	cc congestionControl
+
+	// tsBase is the sequence number of the first byte of the stream, from
+	// which the keys of transmit timestamps are counted.
+	tsBase seqnum.Value
+
+	// tsAcks holds the sent data that is waiting to be acknowledged to be
+	// timestamped, in sequence number order.
+	tsAcks []tsAck
+}
+
+// tsAck is data awaiting a TimestampAck transmit timestamp.
+//
+// +stateify savable
+type tsAck struct {
+	// end is the sequence number following the data.
+	end seqnum.Value
+
+	// key is the key of the timestamp.
+	key uint32
 }
 
 // rtt is a synchronization wrapper used to appease stateify. See the comment
@@ -176,20 +223,34 @@ func newSender(ep *endpoint, iss, irs seqnum.Value, sndWnd seqnum.Size, mss uint
 	// TCP options that it is including in the packets that it sends.
 	// See: https://tools.ietf.org/html/rfc6691#section-2
 	maxPayloadSize := int(mss) - ep.maxOptionSize()
+	if mss == header.TCPMaxMSS && ep.route.MTU() > header.TCPMaxMSS {
+		// The peer accepts segments as large as the route allows, which
+		// is checked against the MTU below.
+		maxPayloadSize = math.MaxInt32
+	}
+
+	initialCwnd := InitialCwnd
+	if c := ep.route.InitialCwnd(); c > 0 {
+		initialCwnd = c
+	}
 
 	s := &sender{
-		ep:               ep,
-		sndCwnd:          InitialCwnd,
-		sndSsthresh:      math.MaxInt64,
-		sndWnd:           sndWnd,
-		sndUna:           iss + 1,
-		sndNxt:           iss + 1,
-		sndNxtList:       iss + 1,
-		rto:              1 * time.Second,
-		rttMeasureSeqNum: iss + 1,
-		lastSendTime:     time.Now(),
-		maxPayloadSize:   maxPayloadSize,
-		maxSentAck:       irs + 1,
+		ep:                 ep,
+		sndCwnd:            initialCwnd,
+		initialCwnd:        initialCwnd,
+		dupAckThreshold:    nDupAckThreshold,
+		sndSsthresh:        math.MaxInt64,
+		sndWnd:             sndWnd,
+		sndUna:             iss + 1,
+		sndNxt:             iss + 1,
+		sndNxtList:         iss + 1,
+		rto:                1 * time.Second,
+		rttMeasureSeqNum:   iss + 1,
+		lastSendTime:       ep.stack.Now(),
+		maxPayloadSize:     maxPayloadSize,
+		peerMaxPayloadSize: maxPayloadSize,
+		maxSentAck:         irs + 1,
+		tsBase:             iss + 1,
 		fr: fastRecovery{
 			// See: https://tools.ietf.org/html/rfc6582#section-3.2 Step 1.
 			last: iss,
@@ -206,13 +267,66 @@ func newSender(ep *endpoint, iss, irs seqnum.Value, sndWnd seqnum.Size, mss uint
 
 	// Initialize SACK Scoreboard.
 	s.ep.scoreboard = NewSACKScoreboard(mss, iss)
-	s.resendTimer.init(&s.resendWaker)
+	s.resendTimer.init(ep.stack.Clock(), &s.resendWaker)
+
+	mtu := int(ep.route.MTU())
+
+	// Start with what past connections learned about the path to the
+	// peer. As in Linux, the cached RTT only sets the initial RTO, and
+	// is replaced by the first measurement.
+	if m, ok := ep.stack.DestinationMetrics(ep.id.RemoteAddress); ok {
+		if m.PathMTU != 0 && !ep.route.MTULocked() {
+			ep.sndBufMu.Lock()
+			if int(m.PathMTU) < ep.sndMTU {
+				ep.sndMTU = int(m.PathMTU)
+			}
+			if ep.sndMTU < mtu {
+				mtu = ep.sndMTU
+			}
+			ep.sndBufMu.Unlock()
+		}
+		if m.SRTT != 0 {
+			s.rto = m.SRTT + 4*m.RTTVar
+			if s.rto < minRTO {
+				s.rto = minRTO
+			}
+		}
+	}
 
-	s.updateMaxPayloadSize(int(ep.route.MTU()), 0)
+	s.updateMaxPayloadSize(mtu, 0)
 
 	return s
 }
 
+// updateLinkMTU re-clamps the maximum payload size after the MTU of the NIC
+// used by the endpoint's route changed. mtu is the new network-layer MTU,
+// already limited by any "packet too big" control packets received. Unlike
+// updateMaxPayloadSize, it also grows the payload size if the MTU increased,
+// up to the limit imposed by the peer's MSS.
+func (s *sender) updateLinkMTU(mtu int) {
+	m := mtu - header.TCPMinimumSize - s.ep.maxOptionSize()
+	if m > s.peerMaxPayloadSize {
+		m = s.peerMaxPayloadSize
+	}
+	if m > s.maxPayloadSize {
+		s.maxPayloadSize = m
+		return
+	}
+	s.updateMaxPayloadSize(mtu, 0)
+}
+
+// updateDestinationRTT records the RTT measured by the connection in the
+// destination cache of the stack, for the next connections to the peer.
+func (s *sender) updateDestinationRTT() {
+	if !s.srttInited {
+		return
+	}
+	s.rtt.Lock()
+	srtt, rttvar := s.rtt.srtt, s.rtt.rttvar
+	s.rtt.Unlock()
+	s.ep.stack.UpdateDestinationRTT(s.ep.id.RemoteAddress, srtt, rttvar)
+}
+
 func (s *sender) initCongestionControl(congestionControlName CongestionControlOption) congestionControl {
 	switch congestionControlName {
 	case ccCubic:
@@ -338,6 +452,8 @@ func (s *sender) resendSegment() {
 
 	// Resend the segment.
 	if seg := s.writeList.Front(); seg != nil {
+		seg.xmitCount++
+		s.fastRtx = header.SACKBlock{Start: seg.sequenceNumber, End: seg.sequenceNumber.Add(seg.logicalLen())}
 		s.sendSegment(seg.data, seg.flags, seg.sequenceNumber)
 		s.ep.stack.Stats().TCP.FastRetransmit.Increment()
 		s.ep.stack.Stats().TCP.Retransmits.Increment()
@@ -357,6 +473,11 @@ func (s *sender) retransmitTimerExpired() bool {
 
 	s.ep.stack.Stats().TCP.Timeouts.Increment()
 
+	// The next hop may be gone, or have changed its link address: check
+	// it again. The route becomes stale if it did, see
+	// endpoint.refreshRoute.
+	s.ep.route.ProbeReachability()
+
 	// Give up if we've waited more than a minute since the last resend.
 	if s.rto >= 60*time.Second {
 		return false
@@ -378,6 +499,10 @@ func (s *sender) retransmitTimerExpired() bool {
 	// we were not in fast recovery.
 	s.fr.last = s.sndNxt - 1
 
+	// Fall back to the initial duplicate ack threshold, as waiting for
+	// more duplicates than that may be what made the timer expire.
+	s.dupAckThreshold = nDupAckThreshold
+
 	s.cc.HandleRTOExpired()
 
 	// Mark the next segment to be sent as the first unacknowledged one and
@@ -408,6 +533,18 @@ func (s *sender) retransmitTimerExpired() bool {
 	return true
 }
 
+// confirmNeighbor tells the stack that the next hop is reachable, as the
+// acknowledgement of new data shows. It does so at most once per
+// neighborConfirmInterval, as that takes the lock of the neighbor cache.
+func (s *sender) confirmNeighbor() {
+	now := s.ep.stack.Now()
+	if now.Sub(s.neighborConfirmed) < neighborConfirmInterval {
+		return
+	}
+	s.neighborConfirmed = now
+	s.ep.route.ConfirmReachable()
+}
+
 // sendData sends new data segments. It is called when data becomes available or
 // when the send window opens up.
 func (s *sender) sendData() {
@@ -417,9 +554,9 @@ func (s *sender) sendData() {
 	// "A TCP SHOULD set cwnd to no more than RW before beginning
 	// transmission if the TCP has not sent data in the interval exceeding
 	// the retrasmission timeout."
-	if !s.fr.active && time.Now().Sub(s.lastSendTime) > s.rto {
-		if s.sndCwnd > InitialCwnd {
-			s.sndCwnd = InitialCwnd
+	if !s.fr.active && s.ep.stack.Now().Sub(s.lastSendTime) > s.rto {
+		if s.sndCwnd > s.initialCwnd {
+			s.sndCwnd = s.initialCwnd
 		}
 	}
 
@@ -454,10 +591,13 @@ func (s *sender) sendData() {
 						break
 					}
 
-					seg.data.Append(seg.Next().data)
+					next := seg.Next()
+					seg.data.Append(next.data)
+					seg.timestamping |= next.timestamping
 
 					// Consume the segment that we just merged in.
-					s.writeList.Remove(seg.Next())
+					s.writeList.Remove(next)
+					next.decRef()
 				}
 
 				if !nextTooBig && seg.data.Size() < available {
@@ -516,6 +656,9 @@ func (s *sender) sendData() {
 				nSeg.sequenceNumber.UpdateForward(seqnum.Size(available))
 				s.writeList.InsertAfter(seg, nSeg)
 				seg.data.CapLength(available)
+
+				// The data to timestamp ends in nSeg.
+				seg.timestamping = 0
 			}
 
 			s.outstanding++
@@ -529,19 +672,38 @@ func (s *sender) sendData() {
 			s.ep.disableKeepaliveTimer()
 		}
 
+		ts := seg.timestamping
 		if !seg.xmitTime.IsZero() {
 			s.ep.stack.Stats().TCP.Retransmits.Increment()
 			if s.sndCwnd < s.sndSsthresh {
 				s.ep.stack.Stats().TCP.SlowStartRetransmits.Increment()
 			}
+			ts = 0
 		}
 
-		seg.xmitTime = time.Now()
-		s.sendSegment(seg.data, seg.flags, seg.sequenceNumber)
+		var tsKey uint32
+		if ts != 0 {
+			tsKey = uint32(s.tsBase.Size(segEnd)) - 1
+		}
+		if ts&tcpip.TimestampingTxSched != 0 {
+			s.ep.queueTimestamp(tcpip.TimestampSched, tsKey)
+		}
+
+		seg.xmitTime = s.ep.stack.Now()
+		seg.xmitCount++
+		err := s.sendSegment(seg.data, seg.flags, seg.sequenceNumber)
+
+		if err == nil && ts&tcpip.TimestampingTxSoftware != 0 {
+			s.ep.queueTimestamp(tcpip.TimestampSend, tsKey)
+		}
+		if ts&tcpip.TimestampingTxAck != 0 {
+			s.tsAcks = append(s.tsAcks, tsAck{end: segEnd, key: tsKey})
+		}
 
 		// Update sndNxt if we actually sent new data (as opposed to
 		// retransmitting some previously sent data).
 		if s.sndNxt.LessThan(segEnd) {
+			s.ep.updateSndBufferSent(int(s.sndNxt.Size(segEnd)))
 			s.sndNxt = segEnd
 		}
 	}
@@ -563,9 +725,9 @@ func (s *sender) enterFastRecovery() {
 	s.fr.active = true
 	// Save state to reflect we're now in fast recovery.
 	// See : https://tools.ietf.org/html/rfc5681#section-3.2 Step 3.
-	// We inflat the cwnd by 3 to account for the 3 packets which triggered
-	// the 3 duplicate ACKs and are now not in flight.
-	s.sndCwnd = s.sndSsthresh + 3
+	// We inflate the cwnd to account for the packets which triggered the
+	// duplicate ACKs and are now not in flight.
+	s.sndCwnd = s.sndSsthresh + s.dupAckThreshold
 	s.fr.first = s.sndUna
 	s.fr.last = s.sndNxt - 1
 	s.fr.maxCwnd = s.sndCwnd + s.outstanding
@@ -645,8 +807,8 @@ func (s *sender) checkDuplicateAck(seg *segment) (rtx bool) {
 	}
 
 	s.dupAckCount++
-	// Do not enter fast recovery until we reach nDupAckThreshold.
-	if s.dupAckCount < nDupAckThreshold {
+	// Do not enter fast recovery until we reach dupAckThreshold.
+	if s.dupAckCount < s.dupAckThreshold {
 		return false
 	}
 
@@ -671,7 +833,7 @@ func (s *sender) checkDuplicateAck(seg *segment) (rtx bool) {
 func (s *sender) handleRcvdSegment(seg *segment) {
 	// Check if we can extract an RTT measurement from this ack.
 	if !seg.parsedOptions.TS && s.rttMeasureSeqNum.LessThan(seg.ackNumber) {
-		s.updateRTO(time.Now().Sub(s.rttMeasureTime))
+		s.updateRTO(s.ep.stack.Now().Sub(s.rttMeasureTime))
 		s.rttMeasureSeqNum = s.sndNxt
 	}
 
@@ -680,8 +842,16 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 		s.ep.updateRecentTimestamp(seg.parsedOptions.TSVal, s.maxSentAck, seg.sequenceNumber)
 	}
 
-	// Insert SACKBlock information into our scoreboard.
+	// Insert SACKBlock information into our scoreboard, and look for signs
+	// of reordering in it.
+	fack := s.sndUna
+	if s.ep.sackPermitted && !s.ep.scoreboard.Empty() {
+		fack = s.ep.scoreboard.MaxSACKED()
+	}
 	if s.ep.sackPermitted {
+		if blocks := seg.parsedOptions.SACKBlocks; len(blocks) > 0 {
+			s.checkDSACK(blocks[0], seg.ackNumber)
+		}
 		for _, sb := range seg.parsedOptions.SACKBlocks {
 			// Only insert the SACK block if the following holds
 			// true:
@@ -698,6 +868,7 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 			if seg.ackNumber.LessThan(sb.Start) && s.sndUna.LessThan(sb.Start) && sb.End.LessThanEq(s.sndNxt) && !s.ep.scoreboard.IsSACKED(sb) {
 				s.ep.scoreboard.Insert(sb)
 				seg.hasNewSACKInfo = true
+				s.checkSACKReordering(sb, fack)
 			}
 		}
 	}
@@ -733,9 +904,17 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 		// Remove all acknowledged data from the write list.
 		acked := s.sndUna.Size(ack)
 		s.sndUna = ack
+		s.confirmNeighbor()
+
+		// Timestamp the writes that are now fully acknowledged.
+		for len(s.tsAcks) > 0 && s.tsAcks[0].end.LessThanEq(ack) {
+			s.ep.queueTimestamp(tcpip.TimestampAck, s.tsAcks[0].key)
+			s.tsAcks = s.tsAcks[1:]
+		}
 
 		ackLeft := acked
 		originalOutstanding := s.outstanding
+		reorderChecked := false
 		for ackLeft > 0 {
 			// We use logicalLen here because we can have FIN
 			// segments (which are always at the end of list) that
@@ -743,6 +922,17 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 			seg := s.writeList.Front()
 			datalen := seg.logicalLen()
 
+			// Data sent once that is only now acknowledged, while
+			// data after it was already SACKed, arrived out of
+			// order.
+			if !reorderChecked && seg.sequenceNumber.LessThan(fack) {
+				reorderChecked = true
+				sb := header.SACKBlock{Start: seg.sequenceNumber, End: seg.sequenceNumber.Add(datalen)}
+				if seg.xmitCount == 1 && !s.ep.scoreboard.IsSACKED(sb) {
+					s.noteReordering(s.segmentsBetween(seg.sequenceNumber, fack))
+				}
+			}
+
 			if datalen > ackLeft {
 				seg.data.TrimFront(int(ackLeft))
 				seg.sequenceNumber.UpdateForward(ackLeft)
@@ -794,7 +984,7 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 // sendSegment sends a new segment containing the given payload, flags and
 // sequence number.
 func (s *sender) sendSegment(data buffer.VectorisedView, flags byte, seq seqnum.Value) *tcpip.Error {
-	s.lastSendTime = time.Now()
+	s.lastSendTime = s.ep.stack.Now()
 	if seq == s.rttMeasureSeqNum {
 		s.rttMeasureTime = s.lastSendTime
 	}
@@ -803,6 +993,7 @@ func (s *sender) sendSegment(data buffer.VectorisedView, flags byte, seq seqnum.
 
 	// Remember the max sent ack.
 	s.maxSentAck = rcvNxt
+	s.ep.ackSent()
 
 	return s.ep.sendRaw(data, flags, seq, rcvNxt, rcvWnd)
 }
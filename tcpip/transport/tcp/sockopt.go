@@ -0,0 +1,379 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// SockOpts holds the socket options of TCP endpoints, except for
+// tcpip.ErrorOption. Embedders may register options of their own types in it,
+// including stored ones.
+var SockOpts tcpip.SockOptTable
+
+func init() {
+	SockOpts.RegisterBool(tcpip.DelayOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		return atomic.LoadUint32(&ep.(*endpoint).delay) != 0, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		if v {
+			atomic.StoreUint32(&e.delay, 1)
+			return nil
+		}
+		atomic.StoreUint32(&e.delay, 0)
+
+		// Handle delayed data.
+		e.sndWaker.Assert()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.CorkOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		return atomic.LoadUint32(&ep.(*endpoint).cork) != 0, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		if v {
+			atomic.StoreUint32(&e.cork, 1)
+			return nil
+		}
+		atomic.StoreUint32(&e.cork, 0)
+
+		// Handle the corked data.
+		e.sndWaker.Assert()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.ReuseAddressOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return e.reuseAddr, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.reuseAddr = v
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.ReusePortOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return e.reusePort, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.reusePort = v
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.QuickAckOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		return ep.(*endpoint).quickAck(), nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		ep.(*endpoint).setQuickAck(v)
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.ReceiveBufferSizeOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.rcvListMu.Lock()
+		defer e.rcvListMu.Unlock()
+		return e.rcvBufSize, nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		ep.(*endpoint).setReceiveBufferSize(v)
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.SendBufferSizeOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.sndBufMu.Lock()
+		defer e.sndBufMu.Unlock()
+		return e.sndBufSize, nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		ep.(*endpoint).setSendBufferSize(v)
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.ReceiveQueueSizeOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		return ep.(*endpoint).readyReceiveSize()
+	}, nil)
+
+	// V6OnlyOption is only recognized on IPv6 endpoints, and can only be
+	// set in the initial state.
+	SockOpts.RegisterBool(tcpip.V6OnlyOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		if e.netProto != header.IPv6ProtocolNumber {
+			return false, tcpip.ErrUnknownProtocolOption
+		}
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return e.v6only, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		if e.netProto != header.IPv6ProtocolNumber {
+			return tcpip.ErrInvalidEndpointState
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.state != stateInitial {
+			return tcpip.ErrInvalidEndpointState
+		}
+		e.v6only = v
+		return nil
+	})
+
+	SockOpts.Register(tcpip.TCPInfoOption{}, func(ep tcpip.Endpoint, opt interface{}) *tcpip.Error {
+		e := ep.(*endpoint)
+		o := opt.(*tcpip.TCPInfoOption)
+		*o = tcpip.TCPInfoOption{}
+		e.mu.RLock()
+		snd := e.snd
+		e.mu.RUnlock()
+		if snd != nil {
+			snd.rtt.Lock()
+			o.RTT = snd.rtt.srtt
+			o.RTTVar = snd.rtt.rttvar
+			snd.rtt.Unlock()
+		}
+		return nil
+	}, nil)
+
+	SockOpts.RegisterBool(tcpip.KeepaliveEnabledOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.keepalive.Lock()
+		defer e.keepalive.Unlock()
+		return e.keepalive.enabled, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		ep.(*endpoint).updateKeepalive(func(k *keepalive) { k.enabled = v })
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.KeepaliveIdleOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.keepalive.Lock()
+		defer e.keepalive.Unlock()
+		return int(e.keepalive.idle), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		ep.(*endpoint).updateKeepalive(func(k *keepalive) { k.idle = time.Duration(v) })
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.KeepaliveIntervalOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.keepalive.Lock()
+		defer e.keepalive.Unlock()
+		return int(e.keepalive.interval), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		ep.(*endpoint).updateKeepalive(func(k *keepalive) { k.interval = time.Duration(v) })
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.KeepaliveCountOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.keepalive.Lock()
+		defer e.keepalive.Unlock()
+		return e.keepalive.count, nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		ep.(*endpoint).updateKeepalive(func(k *keepalive) { k.count = v })
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.TimestampingOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		return int(atomic.LoadUint32(&ep.(*endpoint).timestamping)), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		atomic.StoreUint32(&ep.(*endpoint).timestamping, uint32(v))
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.ReceiveInqOption(false), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		return atomic.LoadUint32(&ep.(*endpoint).receiveInq) != 0, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		var b uint32
+		if v {
+			b = 1
+		}
+		atomic.StoreUint32(&ep.(*endpoint).receiveInq, b)
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.SendQueueSizeOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		used, _, err := ep.(*endpoint).sendQueueSizes()
+		return used, err
+	}, nil)
+
+	SockOpts.RegisterInt(tcpip.SendQueueUnsentSizeOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		_, unsent, err := ep.(*endpoint).sendQueueSizes()
+		return unsent, err
+	}, nil)
+
+	SockOpts.RegisterBool(tcpip.TransparentOption(false), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		return ep.(*endpoint).Transparent(), nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		var b uint32
+		if v {
+			b = 1
+		}
+		atomic.StoreUint32(&ep.(*endpoint).transparent, b)
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.TTLOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		return int(atomic.LoadUint32(&ep.(*endpoint).ttl)), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		atomic.StoreUint32(&ep.(*endpoint).ttl, uint32(uint8(v)))
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.MinTTLOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		return int(atomic.LoadUint32(&ep.(*endpoint).minTTL)), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		atomic.StoreUint32(&ep.(*endpoint).minTTL, uint32(uint8(v)))
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.IPv4TOSOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		return int(atomic.LoadUint32(&ep.(*endpoint).sendTOS)), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		atomic.StoreUint32(&ep.(*endpoint).sendTOS, uint32(uint8(v)))
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.IPv6TrafficClassOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		return int(atomic.LoadUint32(&ep.(*endpoint).sendTClass)), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		atomic.StoreUint32(&ep.(*endpoint).sendTClass, uint32(uint8(v)))
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.IPv6FlowLabelOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		return int(atomic.LoadUint32(&ep.(*endpoint).flowLabel)), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		if v < 0 || v > header.IPv6FlowLabelMask {
+			return tcpip.ErrInvalidOptionValue
+		}
+		atomic.StoreUint32(&ep.(*endpoint).flowLabel, uint32(v))
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.BroadcastOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return e.broadcast, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.broadcast = v
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.VRFOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return int(e.vrf), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.state != stateInitial {
+			return tcpip.ErrInvalidEndpointState
+		}
+		e.vrf = tcpip.VRFID(v)
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.MPTCPOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return e.mptcpEnabled, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.mptcpEnabled = v
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.Register(DelayedAckOption{}, func(ep tcpip.Endpoint, opt interface{}) *tcpip.Error {
+		*opt.(*DelayedAckOption) = ep.(*endpoint).delayedAck()
+		return nil
+	}, func(ep tcpip.Endpoint, opt interface{}) *tcpip.Error {
+		o, err := opt.(DelayedAckOption).check()
+		if err != nil {
+			return err
+		}
+		ep.(*endpoint).setDelayedAck(o)
+		return nil
+	})
+
+	SockOpts.Register(tcpip.MPTCPInfoOption{}, func(ep tcpip.Endpoint, opt interface{}) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		if e.state != stateConnected && e.state != stateClosed {
+			return tcpip.ErrNotConnected
+		}
+		o := opt.(*tcpip.MPTCPInfoOption)
+		*o = tcpip.MPTCPInfoOption{}
+		if m := e.mptcp; m != nil {
+			*o = tcpip.MPTCPInfoOption{
+				Enabled:     m.active(),
+				LocalKey:    m.localKey,
+				RemoteKey:   m.remoteKey,
+				LocalToken:  header.MPTCPToken(m.localKey),
+				RemoteToken: header.MPTCPToken(m.remoteKey),
+			}
+		}
+		return nil
+	}, nil)
+
+	SockOpts.Register(tcpip.OriginalDestinationOption{}, func(ep tcpip.Endpoint, opt interface{}) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		if e.state != stateConnected {
+			return tcpip.ErrNotConnected
+		}
+		addr, ok := e.stack.OriginalDestination(e.route.NetProto, ProtocolNumber, e.id)
+		if !ok {
+			return tcpip.ErrNoSuchFile
+		}
+		*opt.(*tcpip.OriginalDestinationOption) = tcpip.OriginalDestinationOption(addr)
+		return nil
+	}, nil)
+
+	SockOpts.Register(tcpip.TCPListenLimitOption{}, func(ep tcpip.Endpoint, opt interface{}) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.listenLimitMu.Lock()
+		*opt.(*tcpip.TCPListenLimitOption) = e.listenLimit
+		e.listenLimitMu.Unlock()
+		return nil
+	}, func(ep tcpip.Endpoint, opt interface{}) *tcpip.Error {
+		return ep.(*endpoint).setListenLimit(opt.(tcpip.TCPListenLimitOption))
+	})
+
+	// We don't currently support disabling this option.
+	SockOpts.RegisterBool(tcpip.OutOfBandInlineOption(0), func(tcpip.Endpoint) (bool, *tcpip.Error) {
+		return true, nil
+	}, nil)
+}
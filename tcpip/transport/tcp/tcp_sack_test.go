@@ -18,7 +18,11 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/checker"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/seqnum"
 	"github.com/google/netstack/tcpip/transport/tcp"
@@ -348,3 +352,104 @@ func TestTrimSackBlockList(t *testing.T) {
 		}
 	}
 }
+
+// sentSegment is the sequence number range of a data segment sent by the
+// endpoint under test.
+type sentSegment struct {
+	start, end seqnum.Value
+}
+
+// receiveSegments receives the segments carrying the next n bytes sent by the
+// endpoint under test.
+func receiveSegments(c *context.Context, n int) []sentSegment {
+	var segs []sentSegment
+	for n > 0 {
+		tcpHdr := header.TCP(header.IPv4(c.GetPacket()).Payload())
+		start := seqnum.Value(tcpHdr.SequenceNumber())
+		size := len(tcpHdr.Payload())
+		segs = append(segs, sentSegment{start, start.Add(seqnum.Size(size))})
+		n -= size
+	}
+	return segs
+}
+
+// TestSackReorderingRaisesDupAckThreshold checks that once SACKs show that a
+// segment was delivered after several segments sent after it, that many
+// duplicate ACKs no longer trigger a fast retransmit.
+func TestSackReorderingRaisesDupAckThreshold(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	setStackSACKPermitted(t, c, true)
+	rep := createConnectedWithSACKPermittedOption(c)
+
+	sackAck := func(ack seqnum.Value, blocks []header.SACKBlock) {
+		var opts []byte
+		if len(blocks) > 0 {
+			opts = make([]byte, 40)
+			offset := header.EncodeNOP(opts)
+			offset += header.EncodeNOP(opts[offset:])
+			offset += header.EncodeSACKBlocks(blocks, opts[offset:])
+			opts = opts[:offset]
+		}
+		c.SendPacket(nil, &context.Headers{
+			SrcPort: rep.SrcPort,
+			DstPort: rep.DstPort,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  rep.NextSeqNum,
+			AckNum:  ack,
+			RcvWnd:  rep.WndSize,
+			TCPOpts: opts,
+		})
+	}
+
+	const size = 3000
+	if _, _, err := c.EP.Write(tcpip.SlicePayload(buffer.NewView(size)), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	segs := receiveSegments(c, size)
+	if len(segs) < 5 {
+		t.Fatalf("got %d segments, want at least 5", len(segs))
+	}
+
+	// The first segment is delivered after the next four.
+	sackAck(segs[0].start, []header.SACKBlock{{segs[1].start, segs[4].end}})
+	sackAck(segs[4].end, nil)
+	for start := time.Now(); c.Stack().Stats().TCP.Reordering.Value() == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("timed out waiting for the reordering to be detected")
+		}
+	}
+
+	if _, _, err := c.EP.Write(tcpip.SlicePayload(buffer.NewView(size)), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	more := receiveSegments(c, size)
+	if len(more) < 5 {
+		t.Fatalf("got %d segments, want at least 5", len(more))
+	}
+
+	// The segment now at the head of the write list may be reordered as
+	// much, so four duplicate ACKs don't retransmit it.
+	una := segs[5].start
+	for i := 0; i < 4; i++ {
+		sackAck(una, []header.SACKBlock{{more[0].start, more[i].end}})
+	}
+	c.CheckNoPacketTimeout("fast retransmit after 4 duplicate ACKs", 50*time.Millisecond)
+
+	sackAck(una, []header.SACKBlock{{more[0].start, more[4].end}})
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(una)),
+		),
+	)
+	for start := time.Now(); c.Stack().Stats().TCP.FastRetransmit.Value() == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("timed out waiting for the fast retransmit to be counted")
+		}
+	}
+	if got := c.Stack().Stats().TCP.Timeouts.Value(); got != 0 {
+		t.Errorf("got stats.TCP.Timeouts.Value = %d, want = 0", got)
+	}
+}
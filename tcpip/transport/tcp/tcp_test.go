@@ -16,6 +16,7 @@ package tcp_test
 
 import (
 	"bytes"
+	stdcontext "context"
 	"fmt"
 	"math"
 	"testing"
@@ -24,7 +25,9 @@ import (
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/checker"
+	"github.com/google/netstack/tcpip/faketime"
 	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
 	"github.com/google/netstack/tcpip/link/loopback"
 	"github.com/google/netstack/tcpip/link/sniffer"
 	"github.com/google/netstack/tcpip/network/ipv4"
@@ -32,6 +35,7 @@ import (
 	"github.com/google/netstack/tcpip/ports"
 	"github.com/google/netstack/tcpip/seqnum"
 	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/timerwheel"
 	"github.com/google/netstack/tcpip/transport/tcp"
 	"github.com/google/netstack/tcpip/transport/tcp/testing/context"
 	"github.com/google/netstack/waiter"
@@ -331,6 +335,96 @@ func TestConnectResetAfterClose(t *testing.T) {
 	}
 }
 
+func TestConnectedNICRemoved(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&we, waiter.EventHUp)
+	defer c.WQ.EventUnregister(&we)
+
+	if err := c.Stack().RemoveNIC(1); err != nil {
+		t.Fatalf("RemoveNIC(1) failed: %v", err)
+	}
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timed out waiting for the connection to fail")
+	}
+
+	if _, _, err := c.EP.Read(nil); err != tcpip.ErrNetworkUnreachable {
+		t.Fatalf("got c.EP.Read(nil) = %v, want = %v", err, tcpip.ErrNetworkUnreachable)
+	}
+}
+
+func TestStackShutdownDrains(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan *tcpip.Error, 1)
+	go func() {
+		done <- c.Stack().Shutdown(ctx)
+	}()
+
+	// The connection is shut down for writing, then finished once the peer
+	// closes it too.
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+1),
+			checker.AckNum(790),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagFin),
+		),
+	)
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck | header.TCPFlagFin,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(2),
+		RcvWnd:  30000,
+	})
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Shutdown")
+	}
+	if c.Stack().CheckNIC(1) {
+		t.Error("NIC 1 still exists after Shutdown")
+	}
+}
+
+func TestStackShutdownTimeout(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	// The peer never closes the connection, so it is aborted.
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Stack().Shutdown(ctx); err != tcpip.ErrTimeout {
+		t.Fatalf("got Shutdown = %v, want = %v", err, tcpip.ErrTimeout)
+	}
+	if c.Stack().CheckNIC(1) {
+		t.Error("NIC 1 still exists after Shutdown")
+	}
+	if err := c.Stack().Shutdown(ctx); err != nil {
+		t.Errorf("got second Shutdown = %v, want = nil", err)
+	}
+}
+
 func TestSimpleReceive(t *testing.T) {
 	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
@@ -383,6 +477,89 @@ func TestSimpleReceive(t *testing.T) {
 	)
 }
 
+func TestDelayedAck(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	if err := c.Stack().SetTransportProtocolOption(tcp.ProtocolNumber, tcp.DelayedAckOption{Timeout: time.Second}); err == nil {
+		t.Fatal("SetTransportProtocolOption accepted a delayed ACK timeout over 500ms")
+	}
+	if err := c.Stack().SetTransportProtocolOption(tcp.ProtocolNumber, tcp.DelayedAckOption{Timeout: 200 * time.Millisecond}); err != nil {
+		t.Fatalf("SetTransportProtocolOption failed: %v", err)
+	}
+
+	c.CreateConnected(789, 30000, nil)
+
+	var o tcp.DelayedAckOption
+	if err := c.EP.GetSockOpt(&o); err != nil {
+		t.Fatalf("GetSockOpt failed: %v", err)
+	}
+	if want := (tcp.DelayedAckOption{Timeout: 200 * time.Millisecond, Segments: 2}); o != want {
+		t.Fatalf("got DelayedAckOption = %+v, want = %+v", o, want)
+	}
+	var quickAck tcpip.QuickAckOption
+	if err := c.EP.GetSockOpt(&quickAck); err != nil || quickAck != 0 {
+		t.Fatalf("got GetSockOpt(&QuickAckOption) = %d, %v, want = 0, nil", quickAck, err)
+	}
+
+	seq := seqnum.Value(790)
+	send := func() {
+		c.SendPacket([]byte{1, 2, 3}, &context.Headers{
+			SrcPort: context.TestPort,
+			DstPort: c.Port,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  seq,
+			AckNum:  c.IRS.Add(1),
+			RcvWnd:  30000,
+		})
+		seq = seq.Add(3)
+	}
+	checkAck := func() {
+		t.Helper()
+		checker.IPv4(t, c.GetPacket(),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.AckNum(uint32(seq)),
+				checker.TCPFlags(header.TCPFlagAck),
+			),
+		)
+	}
+
+	// A single segment is acknowledged once the timeout expires.
+	send()
+	c.CheckNoPacketTimeout("ACK sent before the delayed ACK timeout", 100*time.Millisecond)
+	checkAck()
+
+	// Every other segment is acknowledged right away.
+	send()
+	c.CheckNoPacketTimeout("ACK sent for a single segment", 50*time.Millisecond)
+	send()
+	checkAck()
+
+	// Enabling quick ACKs acknowledges everything right away.
+	send()
+	c.CheckNoPacketTimeout("ACK sent for a single segment", 50*time.Millisecond)
+	if err := c.EP.SetSockOpt(tcpip.QuickAckOption(1)); err != nil {
+		t.Fatalf("SetSockOpt(QuickAckOption(1)) failed: %v", err)
+	}
+	checkAck()
+	send()
+	checkAck()
+
+	// Disabling delayed ACKs on the endpoint does too.
+	if err := c.EP.SetSockOpt(tcpip.QuickAckOption(0)); err != nil {
+		t.Fatalf("SetSockOpt(QuickAckOption(0)) failed: %v", err)
+	}
+	if err := c.EP.SetSockOpt(tcp.DelayedAckOption{}); err != nil {
+		t.Fatalf("SetSockOpt(DelayedAckOption{}) failed: %v", err)
+	}
+	if err := c.EP.GetSockOpt(&quickAck); err != nil || quickAck != 1 {
+		t.Fatalf("got GetSockOpt(&QuickAckOption) = %d, %v, want = 1, nil", quickAck, err)
+	}
+	send()
+	checkAck()
+}
+
 func TestOutOfOrderReceive(t *testing.T) {
 	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
@@ -900,6 +1077,342 @@ func TestSimpleSend(t *testing.T) {
 	})
 }
 
+func TestCheckpointRestore(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	// Leave data to read, and data in flight.
+	rcvd := []byte{1, 2, 3}
+	c.SendPacket(rcvd, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1),
+		RcvWnd:  30000,
+	})
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.AckNum(uint32(790+len(rcvd))),
+		),
+	)
+	sent := []byte{4, 5, 6}
+	if _, _, err := c.EP.Write(tcpip.SlicePayload(sent), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.GetPacket()
+
+	cp, err := c.Stack().Checkpoint(c.EP)
+	if err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	c.Restore(cp, defaultMTU, nil)
+
+	// The data in flight is sent again.
+	b := c.GetPacket()
+	checker.IPv4(t, b,
+		checker.PayloadLen(len(sent)+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+1),
+			checker.AckNum(uint32(790+len(rcvd))),
+			checker.TCPFlagsMatch(header.TCPFlagAck, ^uint8(header.TCPFlagPsh)),
+		),
+	)
+	if p := b[header.IPv4MinimumSize+header.TCPMinimumSize:]; !bytes.Equal(sent, p) {
+		t.Fatalf("got data = %v, want = %v", p, sent)
+	}
+
+	if v, _, err := c.EP.Read(nil); err != nil || !bytes.Equal(v, rcvd) {
+		t.Fatalf("got Read() = (%v, %v), want = (%v, nil)", v, err, rcvd)
+	}
+
+	// The connection goes on.
+	c.SendPacket(rcvd, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  seqnum.Value(790 + len(rcvd)),
+		AckNum:  c.IRS.Add(1 + seqnum.Size(len(sent))),
+		RcvWnd:  30000,
+	})
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+1+uint32(len(sent))),
+			checker.AckNum(uint32(790+2*len(rcvd))),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+}
+
+func TestRouteChange(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	// Route the peer through another NIC with the same address.
+	id2, linkEP2 := channel.New(256, defaultMTU, "")
+	if err := c.Stack().CreateNIC(2, id2); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := c.Stack().AddAddress(2, ipv4.ProtocolNumber, context.StackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	c.Stack().SetRouteTable([]tcpip.Route{
+		{
+			Destination: "\x00\x00\x00\x00",
+			Mask:        "\x00\x00\x00\x00",
+			Gateway:     "",
+			NIC:         2,
+		},
+	})
+
+	data := []byte{1, 2, 3}
+	if _, _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// The data is sent through the new route.
+	select {
+	case p := <-linkEP2.C:
+		b := append(buffer.View(nil), p.Header...)
+		b = append(b, p.Payload...)
+		checker.IPv4(t, b,
+			checker.PayloadLen(len(data)+header.TCPMinimumSize),
+			checker.SrcAddr(context.StackAddr),
+			checker.DstAddr(context.TestAddr),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1),
+			),
+		)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Packet wasn't written to NIC 2")
+	}
+	c.CheckNoPacket("Packet was written to NIC 1 after the route changed")
+}
+
+func TestDestinationPathMTU(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	// A previous connection learned the path MTU to the peer.
+	const pathMTU = 1000
+	c.Stack().UpdatePathMTU(context.TestAddr, pathMTU)
+
+	const mss = 1460
+	c.CreateConnectedWithRawOptions(789, 30000, nil, []byte{
+		header.TCPOptionMSS, 4, byte(mss / 256), byte(mss % 256),
+	})
+
+	data := make([]byte, mss)
+	if _, _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// The first segment fits in the cached path MTU.
+	checker.IPv4(t, c.GetPacket(),
+		checker.PayloadLen(pathMTU),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+1),
+		),
+	)
+}
+
+func TestSendBufferGrowthNotifiesWriters(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	if err := c.EP.SetSockOpt(tcpip.SendBufferSizeOption(1)); err != nil {
+		t.Fatalf("SetSockOpt(SendBufferSizeOption(1)) failed: %v", err)
+	}
+	if _, _, err := c.EP.Write(tcpip.SlicePayload([]byte{1, 2, 3}), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got := c.EP.Readiness(waiter.EventOut); got != 0 {
+		t.Fatalf("got Readiness(EventOut) = %v with a full send buffer, want 0", got)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&we, waiter.EventOut)
+	defer c.WQ.EventUnregister(&we)
+
+	if err := c.EP.SetSockOpt(tcpip.SendBufferSizeOption(10)); err != nil {
+		t.Fatalf("SetSockOpt(SendBufferSizeOption(10)) failed: %v", err)
+	}
+	select {
+	case <-ch:
+	default:
+		t.Fatalf("Writers weren't notified after the send buffer grew")
+	}
+	if got := c.EP.Readiness(waiter.EventOut); got != waiter.EventOut {
+		t.Errorf("got Readiness(EventOut) = %v, want %v", got, waiter.EventOut)
+	}
+}
+
+func TestAcceptPeerAddress(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	wq := &waiter.Queue{}
+	ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	if err := ep.Bind(tcpip.FullAddress{Port: context.StackPort}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	var addr tcpip.FullAddress
+	if _, _, err := ep.Accept(&addr); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got Accept(...) = %v, want = %v", err, tcpip.ErrWouldBlock)
+	}
+	if addr != (tcpip.FullAddress{}) {
+		t.Errorf("got peer address %+v without a connection, want none", addr)
+	}
+
+	// The default receive buffer of 1MB is advertised with a window scale
+	// of 5.
+	c.PassiveConnect(100, 5, header.TCPSynOptions{MSS: defaultIPv4MSS})
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	c.EP, _, err = ep.Accept(&addr)
+	if err == tcpip.ErrWouldBlock {
+		select {
+		case <-ch:
+			c.EP, _, err = ep.Accept(&addr)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("Timed out waiting for accept")
+		}
+	}
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	want, err := c.EP.GetRemoteAddress()
+	if err != nil {
+		t.Fatalf("GetRemoteAddress failed: %v", err)
+	}
+	if addr != want {
+		t.Errorf("got peer address %+v, want = %+v", addr, want)
+	}
+	if addr.Addr != context.TestAddr || addr.Port != context.TestPort {
+		t.Errorf("got peer address %+v, want %s:%d", addr, context.TestAddr, context.TestPort)
+	}
+}
+
+func TestTransmitTimestamps(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	opt := tcpip.TimestampingTxSched | tcpip.TimestampingTxSoftware | tcpip.TimestampingTxAck
+	if err := c.EP.SetSockOpt(opt); err != nil {
+		t.Fatalf("SetSockOpt(%d) failed: %v", opt, err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&we, waiter.EventErr)
+	defer c.WQ.EventUnregister(&we)
+
+	eq := c.EP.(tcpip.ErrQueueReader)
+	readTimestamp := func() *tcpip.SockError {
+		for {
+			se, err := eq.ReadErrQueue()
+			switch err {
+			case nil:
+				if se.Origin != tcpip.SockErrOriginTimestamping {
+					t.Fatalf("got error queue entry from origin %d, want %d", se.Origin, tcpip.SockErrOriginTimestamping)
+				}
+				return se
+			case tcpip.ErrWouldBlock:
+				select {
+				case <-ch:
+				case <-time.After(1 * time.Second):
+					t.Fatalf("Timed out waiting for a timestamp")
+				}
+			default:
+				t.Fatalf("ReadErrQueue failed: %v", err)
+			}
+		}
+	}
+
+	data := []byte{1, 2, 3}
+	if _, _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.GetPacket()
+
+	// The key is the offset of the last byte written.
+	wantKey := uint32(len(data) - 1)
+	for _, kind := range []tcpip.TimestampKind{tcpip.TimestampSched, tcpip.TimestampSend} {
+		if se := readTimestamp(); se.TimestampKind != kind || se.Key != wantKey {
+			t.Fatalf("got timestamp of kind %d with key %d, want kind %d with key %d", se.TimestampKind, se.Key, kind, wantKey)
+		}
+	}
+	if se, err := eq.ReadErrQueue(); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got ReadErrQueue() = %+v, %v before the data is acknowledged, want %v", se, err, tcpip.ErrWouldBlock)
+	}
+
+	// Acknowledge the data.
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1 + seqnum.Size(len(data))),
+		RcvWnd:  30000,
+	})
+
+	if se := readTimestamp(); se.TimestampKind != tcpip.TimestampAck || se.Key != wantKey {
+		t.Fatalf("got timestamp of kind %d with key %d, want kind %d with key %d", se.TimestampKind, se.Key, tcpip.TimestampAck, wantKey)
+	}
+}
+
+func TestVectorisedSend(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	data := []byte{1, 2, 3, 4, 5, 6}
+	if _, _, err := c.EP.Write(tcpip.VectorPayload{data[:1], data[1:4], data[4:]}, tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// Check that data is received in a single segment with a valid checksum.
+	b := c.GetPacket()
+	checker.IPv4(t, b,
+		checker.PayloadLen(len(data)+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+1),
+			checker.AckNum(790),
+		),
+	)
+
+	if p := b[header.IPv4MinimumSize+header.TCPMinimumSize:]; !bytes.Equal(data, p) {
+		t.Fatalf("got data = %v, want = %v", p, data)
+	}
+}
+
 func TestZeroWindowSend(t *testing.T) {
 	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
@@ -1058,12 +1571,12 @@ func TestScaledWindowAccept(t *testing.T) {
 	wq.EventRegister(&we, waiter.EventIn)
 	defer wq.EventUnregister(&we)
 
-	c.EP, _, err = ep.Accept()
+	c.EP, _, err = ep.Accept(nil)
 	if err == tcpip.ErrWouldBlock {
 		// Wait for connection to be established.
 		select {
 		case <-ch:
-			c.EP, _, err = ep.Accept()
+			c.EP, _, err = ep.Accept(nil)
 			if err != nil {
 				t.Fatalf("Accept failed: %v", err)
 			}
@@ -1131,12 +1644,12 @@ func TestNonScaledWindowAccept(t *testing.T) {
 	wq.EventRegister(&we, waiter.EventIn)
 	defer wq.EventUnregister(&we)
 
-	c.EP, _, err = ep.Accept()
+	c.EP, _, err = ep.Accept(nil)
 	if err == tcpip.ErrWouldBlock {
 		// Wait for connection to be established.
 		select {
 		case <-ch:
-			c.EP, _, err = ep.Accept()
+			c.EP, _, err = ep.Accept(nil)
 			if err != nil {
 				t.Fatalf("Accept failed: %v", err)
 			}
@@ -1254,6 +1767,177 @@ func TestZeroScaledWindowReceive(t *testing.T) {
 	)
 }
 
+func TestReadWithoutCopy(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	data := []byte("0123456789")
+	c.SendPacket(data, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1),
+		RcvWnd:  30000,
+	})
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.AckNum(uint32(790+len(data))),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+
+	zc, ok := c.EP.(tcpip.ZeroCopyReader)
+	if !ok {
+		t.Fatalf("TCP endpoint does not implement tcpip.ZeroCopyReader")
+	}
+	vv, release, _, err := zc.ReadWithoutCopy(4)
+	if err != nil {
+		t.Fatalf("ReadWithoutCopy failed: %v", err)
+	}
+	if got, want := vv.ToView(), buffer.View("0123"); !bytes.Equal(got, want) {
+		t.Fatalf("got lent data = %q, want = %q", got, want)
+	}
+
+	// The lent data is no longer readable.
+	var size tcpip.ReceiveQueueSizeOption
+	if err := c.EP.GetSockOpt(&size); err != nil {
+		t.Fatalf("GetSockOpt failed: %v", err)
+	}
+	if got, want := int(size), len(data)-4; got != want {
+		t.Fatalf("got receive queue size = %d, want = %d", got, want)
+	}
+	v, _, err := c.EP.Read(nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got, want := v, buffer.View("456789"); !bytes.Equal(got, want) {
+		t.Fatalf("got data = %q, want = %q", got, want)
+	}
+
+	release()
+	release()
+
+	if _, _, _, err := zc.ReadWithoutCopy(4); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got ReadWithoutCopy on empty endpoint = %v, want = %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+func TestSendQueueSizes(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	// The peer's window is small, so that only part of the data is sent.
+	c.CreateConnected(789, 4, nil)
+
+	data := []byte("0123456789")
+	if _, _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.ReceiveAndCheckPacket(data, 0, 4)
+
+	// checkSizes polls the queue sizes, which are updated by the protocol
+	// goroutine once the packet was sent.
+	checkSizes := func(wantUsed, wantUnsent int) {
+		t.Helper()
+		var used tcpip.SendQueueSizeOption
+		var unsent tcpip.SendQueueUnsentSizeOption
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			if err := c.EP.GetSockOpt(&used); err != nil {
+				t.Fatalf("GetSockOpt(SendQueueSizeOption) failed: %v", err)
+			}
+			if err := c.EP.GetSockOpt(&unsent); err != nil {
+				t.Fatalf("GetSockOpt(SendQueueUnsentSizeOption) failed: %v", err)
+			}
+			if (int(used) == wantUsed && int(unsent) == wantUnsent) || time.Now().After(deadline) {
+				break
+			}
+		}
+		if int(used) != wantUsed || int(unsent) != wantUnsent {
+			t.Fatalf("got send queue sizes = %d, %d unsent, want = %d, %d unsent", used, unsent, wantUsed, wantUnsent)
+		}
+	}
+	checkSizes(len(data), len(data)-4)
+
+	// Acknowledging the data sent frees it, and lets the rest be sent.
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1 + 4),
+		RcvWnd:  30000,
+	})
+	c.ReceiveAndCheckPacket(data, 4, len(data)-4)
+	checkSizes(len(data)-4, 0)
+
+	c.SendAck(790, len(data))
+	checkSizes(0, 0)
+}
+
+func TestReceiveControlMessages(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	if err := c.EP.SetSockOpt(tcpip.ReceiveInqOption(true)); err != nil {
+		t.Fatalf("SetSockOpt(ReceiveInqOption(true)) failed: %v", err)
+	}
+	var inq tcpip.ReceiveInqOption
+	if err := c.EP.GetSockOpt(&inq); err != nil || !inq {
+		t.Fatalf("got GetSockOpt(&ReceiveInqOption) = %t, %v, want = true, nil", inq, err)
+	}
+
+	before := time.Now().UnixNano()
+	data := []byte("0123456789")
+	c.SendPacket(data, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1),
+		RcvWnd:  30000,
+	})
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.AckNum(uint32(790+len(data))),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+
+	zc := c.EP.(tcpip.ZeroCopyReader)
+	_, release, cm, err := zc.ReadWithoutCopy(4)
+	if err != nil {
+		t.Fatalf("ReadWithoutCopy failed: %v", err)
+	}
+	release()
+	if !cm.HasInq || cm.Inq != int32(len(data)-4) {
+		t.Errorf("got HasInq, Inq = %t, %d, want = true, %d", cm.HasInq, cm.Inq, len(data)-4)
+	}
+	if !cm.HasTimestamp || cm.Timestamp < before || cm.Timestamp > time.Now().UnixNano() {
+		t.Errorf("got HasTimestamp, Timestamp = %t, %d, want = true, between %d and now", cm.HasTimestamp, cm.Timestamp, before)
+	}
+
+	if err := c.EP.SetSockOpt(tcpip.ReceiveInqOption(false)); err != nil {
+		t.Fatalf("SetSockOpt(ReceiveInqOption(false)) failed: %v", err)
+	}
+	_, cm2, err := c.EP.Read(nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if cm2.HasInq {
+		t.Errorf("got HasInq = true with ReceiveInqOption disabled")
+	}
+	if cm2.Timestamp != cm.Timestamp {
+		t.Errorf("got Timestamp = %d, want = %d, the same segment", cm2.Timestamp, cm.Timestamp)
+	}
+}
+
 func TestSegmentMerging(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -1634,12 +2318,12 @@ func TestPassiveSendMSSLessThanMTU(t *testing.T) {
 	wq.EventRegister(&we, waiter.EventIn)
 	defer wq.EventUnregister(&we)
 
-	c.EP, _, err = ep.Accept()
+	c.EP, _, err = ep.Accept(nil)
 	if err == tcpip.ErrWouldBlock {
 		// Wait for connection to be established.
 		select {
 		case <-ch:
-			c.EP, _, err = ep.Accept()
+			c.EP, _, err = ep.Accept(nil)
 			if err != nil {
 				t.Fatalf("Accept failed: %v", err)
 			}
@@ -1691,12 +2375,12 @@ func TestSynCookiePassiveSendMSSLessThanMTU(t *testing.T) {
 	wq.EventRegister(&we, waiter.EventIn)
 	defer wq.EventUnregister(&we)
 
-	c.EP, _, err = ep.Accept()
+	c.EP, _, err = ep.Accept(nil)
 	if err == tcpip.ErrWouldBlock {
 		// Wait for connection to be established.
 		select {
 		case <-ch:
-			c.EP, _, err = ep.Accept()
+			c.EP, _, err = ep.Accept(nil)
 			if err != nil {
 				t.Fatalf("Accept failed: %v", err)
 			}
@@ -1710,6 +2394,220 @@ func TestSynCookiePassiveSendMSSLessThanMTU(t *testing.T) {
 	testBrokenUpWrite(t, c, maxPayload)
 }
 
+func TestTOS(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+	const tos = 0xb8
+	if err := c.EP.SetSockOpt(tcpip.IPv4TOSOption(tos)); err != nil {
+		t.Fatalf("SetSockOpt(IPv4TOSOption) failed: %v", err)
+	}
+	var v tcpip.IPv4TOSOption
+	if err := c.EP.GetSockOpt(&v); err != nil || v != tos {
+		t.Fatalf("GetSockOpt(IPv4TOSOption) = %v, %v, want %v, nil", v, err, tos)
+	}
+
+	if _, _, err := c.EP.Write(tcpip.SlicePayload([]byte{1, 2, 3}), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checker.IPv4(t, c.GetPacket(), checker.TOS(tos, 0))
+}
+
+func TestNATRedirect(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	// Connections to port 80 are redirected to the listener.
+	const origPort = 80
+	subnet, err := tcpip.NewSubnet(context.StackAddr, "\xff\xff\xff\xff")
+	if err != nil {
+		t.Fatalf("NewSubnet failed: %v", err)
+	}
+	if err := c.Stack().SetNATRules([]stack.NATRule{{
+		Protocol:        tcp.ProtocolNumber,
+		Destination:     subnet,
+		DestinationPort: origPort,
+		ToPort:          context.StackPort,
+	}}); err != nil {
+		t.Fatalf("SetNATRules failed: %v", err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, terr := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if terr != nil {
+		t.Fatalf("NewEndpoint failed: %v", terr)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Port: context.StackPort}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// The replies come from the original destination.
+	const iss = 789
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: origPort,
+		Flags:   header.TCPFlagSyn,
+		SeqNum:  iss,
+		RcvWnd:  30000,
+	})
+	b := c.GetPacket()
+	checker.IPv4(t, b,
+		checker.SrcAddr(context.StackAddr),
+		checker.TCP(
+			checker.SrcPort(origPort),
+			checker.DstPort(context.TestPort),
+			checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck),
+			checker.AckNum(iss+1),
+		),
+	)
+	tcpHdr := header.TCP(header.IPv4(b).Payload())
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: origPort,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  iss + 1,
+		AckNum:  seqnum.Value(tcpHdr.SequenceNumber()) + 1,
+		RcvWnd:  30000,
+	})
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	c.EP, _, terr = ep.Accept(nil)
+	if terr == tcpip.ErrWouldBlock {
+		select {
+		case <-ch:
+			c.EP, _, terr = ep.Accept(nil)
+			if terr != nil {
+				t.Fatalf("Accept failed: %v", terr)
+			}
+
+		case <-time.After(1 * time.Second):
+			t.Fatalf("Timed out waiting for accept")
+		}
+	}
+
+	// The accepted endpoint is bound to the redirected port, and can tell
+	// the original one.
+	if addr, err := c.EP.GetLocalAddress(); err != nil || addr.Port != context.StackPort {
+		t.Errorf("got GetLocalAddress = %+v, %v, want port %d", addr, err, context.StackPort)
+	}
+	var orig tcpip.OriginalDestinationOption
+	if err := c.EP.GetSockOpt(&orig); err != nil {
+		t.Fatalf("GetSockOpt(OriginalDestinationOption) failed: %v", err)
+	}
+	if want := (tcpip.OriginalDestinationOption{Addr: context.StackAddr, Port: origPort}); orig != want {
+		t.Errorf("got OriginalDestinationOption = %+v, want %+v", orig, want)
+	}
+	if err := ep.GetSockOpt(&orig); err != tcpip.ErrNotConnected {
+		t.Errorf("got GetSockOpt(OriginalDestinationOption) on listener = %v, want %s", err, tcpip.ErrNotConnected)
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	wq := &waiter.Queue{}
+	ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	// Set up GTSM on the listener.
+	if err := ep.SetSockOpt(tcpip.TTLOption(255)); err != nil {
+		t.Fatalf("SetSockOpt(TTLOption(255)) failed: %v", err)
+	}
+	if err := ep.SetSockOpt(tcpip.MinTTLOption(255)); err != nil {
+		t.Fatalf("SetSockOpt(MinTTLOption(255)) failed: %v", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Port: context.StackPort}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// A SYN from a remote host is ignored.
+	const iss = 789
+	syn := &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: context.StackPort,
+		Flags:   header.TCPFlagSyn,
+		SeqNum:  iss,
+		RcvWnd:  30000,
+	}
+	c.SendPacket(nil, syn)
+	c.CheckNoPacketTimeout("SYN with TTL 65 was answered", 100*time.Millisecond)
+
+	// But not one from a neighbor, which is answered with a TTL of 255.
+	syn.TTL = 255
+	c.SendPacket(nil, syn)
+	b := c.GetPacket()
+	checker.IPv4(t, b,
+		checker.TTL(255),
+		checker.TCP(
+			checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck),
+			checker.AckNum(iss+1),
+		),
+	)
+	tcpHdr := header.TCP(header.IPv4(b).Payload())
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: context.StackPort,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  iss + 1,
+		AckNum:  seqnum.Value(tcpHdr.SequenceNumber()) + 1,
+		RcvWnd:  30000,
+		TTL:     255,
+	})
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	c.EP, _, err = ep.Accept(nil)
+	if err == tcpip.ErrWouldBlock {
+		select {
+		case <-ch:
+			c.EP, _, err = ep.Accept(nil)
+			if err != nil {
+				t.Fatalf("Accept failed: %v", err)
+			}
+
+		case <-time.After(1 * time.Second):
+			t.Fatalf("Timed out waiting for accept")
+		}
+	}
+
+	// The accepted endpoint inherits the options.
+	var ttl tcpip.TTLOption
+	if err := c.EP.GetSockOpt(&ttl); err != nil || ttl != 255 {
+		t.Errorf("GetSockOpt(TTLOption) = %v, %v, want 255, nil", ttl, err)
+	}
+	var minTTL tcpip.MinTTLOption
+	if err := c.EP.GetSockOpt(&minTTL); err != nil || minTTL != 255 {
+		t.Errorf("GetSockOpt(MinTTLOption) = %v, %v, want 255, nil", minTTL, err)
+	}
+
+	if _, _, err := c.EP.Write(tcpip.SlicePayload([]byte{1, 2, 3}), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checker.IPv4(t, c.GetPacket(),
+		checker.TTL(255),
+		checker.TCP(
+			checker.TCPFlagsMatch(header.TCPFlagAck, header.TCPFlagAck),
+		),
+	)
+}
+
 func TestForwarderSendMSSLessThanMTU(t *testing.T) {
 	const maxPayload = 100
 	const mtu = 1200
@@ -1893,12 +2791,45 @@ loop:
 	}
 }
 
-func TestSendOnResetConnection(t *testing.T) {
+func TestSendOnResetConnection(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	// Send RST segment.
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagRst,
+		SeqNum:  790,
+		RcvWnd:  30000,
+	})
+
+	// Wait for the RST to be received.
+	time.Sleep(1 * time.Second)
+
+	// Try to write.
+	view := buffer.NewView(10)
+	if _, _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != tcpip.ErrConnectionReset {
+		t.Fatalf("got c.EP.Write(...) = %v, want = %v", err, tcpip.ErrConnectionReset)
+	}
+}
+
+func TestReadinessOnResetConnection(t *testing.T) {
 	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
 
 	c.CreateConnected(789, 30000, nil)
 
+	if got := c.EP.Readiness(0); got != 0 {
+		t.Fatalf("got c.EP.Readiness(0) = %v before reset, want 0", got)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&we, waiter.EventErr)
+	defer c.WQ.EventUnregister(&we)
+
 	// Send RST segment.
 	c.SendPacket(nil, &context.Headers{
 		SrcPort: context.TestPort,
@@ -1908,13 +2839,23 @@ func TestSendOnResetConnection(t *testing.T) {
 		RcvWnd:  30000,
 	})
 
-	// Wait for the RST to be received.
-	time.Sleep(1 * time.Second)
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for reset to arrive")
+	}
 
-	// Try to write.
-	view := buffer.NewView(10)
-	if _, _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != tcpip.ErrConnectionReset {
-		t.Fatalf("got c.EP.Write(...) = %v, want = %v", err, tcpip.ErrConnectionReset)
+	// Errors and hang-ups are reported regardless of the mask.
+	if got, want := c.EP.Readiness(0), waiter.EventErr|waiter.EventHUp; got != want {
+		t.Fatalf("got c.EP.Readiness(0) = %v, want = %v", got, want)
+	}
+
+	// The reset is the pending error, which is only retrieved once.
+	if err := c.EP.GetSockOpt(tcpip.ErrorOption{}); err != tcpip.ErrConnectionReset {
+		t.Errorf("got c.EP.GetSockOpt(tcpip.ErrorOption{}) = %v, want = %v", err, tcpip.ErrConnectionReset)
+	}
+	if err := c.EP.GetSockOpt(tcpip.ErrorOption{}); err != nil {
+		t.Errorf("got c.EP.GetSockOpt(tcpip.ErrorOption{}) = %v after retrieving the error, want = nil", err)
 	}
 }
 
@@ -2015,6 +2956,99 @@ func TestFinRetransmit(t *testing.T) {
 	)
 }
 
+func TestRetransmitManualClock(t *testing.T) {
+	clock := faketime.NewManualClock()
+	c := context.NewWithClock(t, defaultMTU, clock)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	view := buffer.NewView(10)
+	if _, _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	checkData := func() {
+		checker.IPv4(t, c.GetPacket(),
+			checker.PayloadLen(len(view)+header.TCPMinimumSize),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1),
+				checker.AckNum(790),
+			),
+		)
+	}
+	checkData()
+
+	// The data isn't retransmitted as long as the clock doesn't move.
+	c.CheckNoPacketTimeout("Data retransmitted before the clock was advanced", 100*time.Millisecond)
+
+	// The initial RTO is at most a second.
+	clock.Advance(time.Second)
+	checkData()
+}
+
+func TestReceiveTimestampManualClock(t *testing.T) {
+	clock := faketime.NewManualClock()
+	c := context.NewWithClock(t, defaultMTU, clock)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	clock.Advance(5 * time.Second)
+	data := []byte("0123456789")
+	c.SendPacket(data, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1),
+		RcvWnd:  30000,
+	})
+	c.GetPacket()
+
+	_, cm, err := c.EP.Read(nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if want := (5 * time.Second).Nanoseconds(); !cm.HasTimestamp || cm.Timestamp != want {
+		t.Errorf("got HasTimestamp, Timestamp = %t, %d, want = true, %d", cm.HasTimestamp, cm.Timestamp, want)
+	}
+}
+
+func TestRetransmitTimerWheel(t *testing.T) {
+	clock := faketime.NewManualClock()
+	const resolution = 10 * time.Millisecond
+	c := context.NewWithClock(t, defaultMTU, timerwheel.New(clock, resolution))
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	view := buffer.NewView(10)
+	if _, _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	checkData := func() {
+		checker.IPv4(t, c.GetPacket(),
+			checker.PayloadLen(len(view)+header.TCPMinimumSize),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1),
+				checker.AckNum(790),
+			),
+		)
+	}
+	checkData()
+
+	c.CheckNoPacketTimeout("Data retransmitted before the clock was advanced", 100*time.Millisecond)
+
+	// The retransmission timer runs on the wheel, so it may fire up to
+	// one resolution late.
+	clock.Advance(time.Second + resolution)
+	checkData()
+}
+
 func TestFinWithNoPendingData(t *testing.T) {
 	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
@@ -2872,6 +3906,94 @@ func TestUpdateListenBacklog(t *testing.T) {
 	ep.Close()
 }
 
+func TestListenBacklogFull(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	// Create listener.
+	var wq waiter.Queue
+	ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	if err := ep.Bind(tcpip.FullAddress{Port: context.StackPort}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(1); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// Complete two handshakes: the second one waits for room in the
+	// accept queue.
+	const iss = seqnum.Value(789)
+	for port := uint16(context.TestPort); port < context.TestPort+2; port++ {
+		c.SendPacket(nil, &context.Headers{
+			SrcPort: port,
+			DstPort: context.StackPort,
+			Flags:   header.TCPFlagSyn,
+			SeqNum:  iss,
+			RcvWnd:  30000,
+		})
+		b := c.GetPacket()
+		checker.IPv4(t, b, checker.TCP(
+			checker.DstPort(port),
+			checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck),
+		))
+		irs := seqnum.Value(header.TCP(header.IPv4(b).Payload()).SequenceNumber())
+		c.SendPacket(nil, &context.Headers{
+			SrcPort: port,
+			DstPort: context.StackPort,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  iss + 1,
+			AckNum:  irs + 1,
+			RcvWnd:  30000,
+		})
+	}
+
+	// The waiting handshake doesn't hold the listener's lock, so the
+	// backlog can be raised meanwhile.
+	done := make(chan *tcpip.Error, 1)
+	go func() {
+		done <- ep.Listen(2)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Listen failed to update backlog: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Listen blocked by a handshake waiting for the accept queue")
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	var peers []uint16
+	for len(peers) < 2 {
+		var addr tcpip.FullAddress
+		n, _, err := ep.Accept(&addr)
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-ch:
+				continue
+			case <-time.After(1 * time.Second):
+				t.Fatalf("Timed out waiting for accept, got %v", peers)
+			}
+		}
+		if err != nil {
+			t.Fatalf("Accept failed: %v", err)
+		}
+		defer n.Close()
+		peers = append(peers, addr.Port)
+	}
+	if peers[0] != context.TestPort || peers[1] != context.TestPort+1 {
+		t.Errorf("got accepted peers %v, want [%d %d]", peers, context.TestPort, context.TestPort+1)
+	}
+}
+
 func scaledSendWindow(t *testing.T, scale uint8) {
 	// This test ensures that the endpoint is using the right scaling by
 	// sending a buffer that is larger than the window size, and ensuring
@@ -3855,3 +4977,261 @@ func TestKeepalive(t *testing.T) {
 		t.Fatalf("got c.EP.Read(nil) = %v, want = %v", err, tcpip.ErrConnectionReset)
 	}
 }
+
+func TestLinkMTUChange(t *testing.T) {
+	c := context.New(t, 1500)
+	defer c.Cleanup()
+
+	states := make(chan stack.TCPEndpointState, 100)
+	c.Stack().AddTCPProbe(func(s stack.TCPEndpointState) {
+		states <- s
+	})
+
+	// Create new connection with MSS of 1460.
+	const maxPayload = 1500 - header.TCPMinimumSize - header.IPv4MinimumSize
+	c.CreateConnectedWithRawOptions(789, 30000, nil, []byte{
+		header.TCPOptionMSS, 4, byte(maxPayload / 256), byte(maxPayload % 256),
+	})
+
+	acked := 0
+
+	// waitForMaxPayload sends ACKs until the probe reports that the sender
+	// picked up the new MTU, which is done asynchronously.
+	waitForMaxPayload := func(want int) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			c.SendAck(790, acked)
+			if s := <-states; s.Sender.MaxPayloadSize == want {
+				return
+			}
+		}
+		t.Fatalf("MaxPayloadSize never became %d", want)
+	}
+
+	checkSegments := func(want int) {
+		t.Helper()
+		data := buffer.NewView(2 * want)
+		if _, _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			b := c.GetPacket()
+			if got := len(header.TCP(header.IPv4(b).Payload()).Payload()); got != want {
+				t.Fatalf("got segment payload = %d, want = %d", got, want)
+			}
+		}
+		acked += len(data)
+		c.SendAck(790, acked)
+	}
+
+	// Shrink the MTU; segments must be re-clamped.
+	const newMTU = 1000
+	const newMaxPayload = newMTU - header.TCPMinimumSize - header.IPv4MinimumSize
+	if err := c.Stack().SetNICMTU(1, newMTU); err != nil {
+		t.Fatalf("SetNICMTU(1, %d) failed: %v", newMTU, err)
+	}
+	waitForMaxPayload(newMaxPayload)
+	checkSegments(newMaxPayload)
+
+	// Growing the MTU again is limited by the peer's MSS.
+	if err := c.Stack().SetNICMTU(1, 9000); err != nil {
+		t.Fatalf("SetNICMTU(1, 9000) failed: %v", err)
+	}
+	waitForMaxPayload(maxPayload)
+}
+
+func TestSockets(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	// The data isn't acknowledged, so stays in the send queue.
+	data := buffer.NewView(10)
+	if _, _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.GetPacket()
+
+	var wq waiter.Queue
+	ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.SetSockOpt(tcpip.ReuseAddressOption(1)); err != nil {
+		t.Fatalf("SetSockOpt(ReuseAddressOption(1)) failed: %v", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Port: context.StackPort}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(5); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	infos := c.Stack().Sockets()
+	if len(infos) != 2 {
+		t.Fatalf("got %d sockets, want = 2: %+v", len(infos), infos)
+	}
+
+	// The listener is bound to the unspecified address, so comes first.
+	l := infos[0]
+	if l.TransProto != tcp.ProtocolNumber || l.State != "LISTEN" || l.ID.LocalPort != context.StackPort || l.RecvQueue != 0 || l.SendQueue != 5 {
+		t.Errorf("got listener = %+v, want a LISTEN socket on port %d with a backlog of 5", l, context.StackPort)
+	}
+	if !l.Options.ReuseAddress {
+		t.Errorf("got listener Options.ReuseAddress = false, want = true")
+	}
+
+	e := infos[1]
+	if e.State != "CONNECTED" || e.ID.LocalAddress != context.StackAddr || e.ID.RemoteAddress != context.TestAddr || e.ID.RemotePort != context.TestPort {
+		t.Errorf("got connected socket = %+v, want a CONNECTED socket from %v to %v:%d", e, context.StackAddr, context.TestAddr, context.TestPort)
+	}
+	if e.SendQueue != len(data) {
+		t.Errorf("got connected socket SendQueue = %d, want = %d", e.SendQueue, len(data))
+	}
+	if e.Options.ReceiveBufferSize == 0 || e.Options.SendBufferSize == 0 {
+		t.Errorf("got connected socket Options = %+v, want buffer sizes", e.Options)
+	}
+	if len(e.NetProtos) != 1 || e.NetProtos[0] != ipv4.ProtocolNumber {
+		t.Errorf("got connected socket NetProtos = %v, want = [%d]", e.NetProtos, ipv4.ProtocolNumber)
+	}
+}
+
+func TestListenLimit(t *testing.T) {
+	wsOpt := []byte{header.TCPOptionWS, 3, 0, header.TCPOptionNOP}
+	for _, test := range []struct {
+		name  string
+		limit tcpip.TCPListenLimitOption
+	}{
+		{"PerSource", tcpip.TCPListenLimitOption{MaxPendingPerSource: 1}},
+		{"Rate", tcpip.TCPListenLimitOption{Rate: 0.001, Burst: 1}},
+	} {
+		for _, drop := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/Drop=%t", test.name, drop), func(t *testing.T) {
+				c := context.New(t, defaultMTU)
+				defer c.Cleanup()
+
+				ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+				if err != nil {
+					t.Fatalf("NewEndpoint failed: %v", err)
+				}
+				defer ep.Close()
+
+				limit := test.limit
+				limit.Drop = drop
+				if err := ep.SetSockOpt(limit); err != nil {
+					t.Fatalf("SetSockOpt(%+v) failed: %v", limit, err)
+				}
+				var got tcpip.TCPListenLimitOption
+				if err := ep.GetSockOpt(&got); err != nil || got != limit {
+					t.Fatalf("got GetSockOpt(&TCPListenLimitOption{}) = %+v, %v, want = %+v, nil", got, err, limit)
+				}
+				if err := ep.Bind(tcpip.FullAddress{Port: context.StackPort}); err != nil {
+					t.Fatalf("Bind failed: %v", err)
+				}
+				if err := ep.Listen(10); err != nil {
+					t.Fatalf("Listen failed: %v", err)
+				}
+
+				// The first SYN is handled normally, and the
+				// handshake is left incomplete.
+				syn := &context.Headers{
+					SrcPort: context.TestPort,
+					DstPort: context.StackPort,
+					Flags:   header.TCPFlagSyn,
+					SeqNum:  789,
+					RcvWnd:  30000,
+					TCPOpts: wsOpt,
+				}
+				c.SendPacket(nil, syn)
+				b := c.GetPacket()
+				synAck := header.TCP(header.IPv4(b).Payload())
+				if opts := header.ParseSynOptions(synAck.Options(), true); opts.WS == -1 {
+					t.Errorf("SYN-ACK of the first SYN has no window scale option, want one as it isn't a SYN cookie")
+				}
+
+				// The second one is over the limit.
+				syn.SrcPort++
+				c.SendPacket(nil, syn)
+				if drop {
+					c.CheckNoPacketTimeout("SYN over the limit was answered", 100*time.Millisecond)
+				} else {
+					b := c.GetPacket()
+					synAck := header.TCP(header.IPv4(b).Payload())
+					if opts := header.ParseSynOptions(synAck.Options(), true); opts.WS != -1 {
+						t.Errorf("SYN-ACK of the second SYN has a window scale option, want none as it is a SYN cookie")
+					}
+				}
+				if got := c.Stack().Stats().TCP.ListenLimitedSyns.Value(); got != 1 {
+					t.Errorf("got ListenLimitedSyns = %d, want = 1", got)
+				}
+			})
+		}
+	}
+}
+
+func TestListenLimitInvalid(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	for _, limit := range []tcpip.TCPListenLimitOption{
+		{Rate: -1},
+		{Rate: 10},
+		{MaxPendingPerSource: -1},
+	} {
+		if err := ep.SetSockOpt(limit); err != tcpip.ErrInvalidOptionValue {
+			t.Errorf("got SetSockOpt(%+v) = %v, want = %v", limit, err, tcpip.ErrInvalidOptionValue)
+		}
+	}
+}
+
+func TestRouteMetrics(t *testing.T) {
+	const maxPayload = 10
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.Stack().SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+		MTU:         header.IPv4MinimumSize + header.TCPMinimumSize + maxPayload,
+		AdvMSS:      1000,
+		InitCwnd:    4,
+		HopLimit:    7,
+	}})
+
+	// The SYN advertises the MSS of the route and has its hop limit.
+	var wq waiter.Queue
+	ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Connect(tcpip.FullAddress{Addr: context.TestAddr, Port: context.TestPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("got Connect(...) = %v, want %v", err, tcpip.ErrConnectStarted)
+	}
+	b := c.GetPacket()
+	checker.IPv4(t, b, checker.TTL(7), checker.TCP(checker.TCPFlags(header.TCPFlagSyn)))
+	if got, want := header.ParseSynOptions(header.TCP(header.IPv4(b).Payload()).Options(), false).MSS, uint16(1000); got != want {
+		t.Errorf("got advertised MSS %d, want %d", got, want)
+	}
+
+	// The connection starts with the congestion window of the route and
+	// sends segments that fit in its MTU.
+	c.CreateConnected(789, 30000, nil)
+	data := buffer.NewView(8 * maxPayload)
+	if _, _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		c.ReceiveAndCheckPacket(data, i*maxPayload, maxPayload)
+	}
+	c.CheckNoPacketTimeout("more packets sent than the initial congestion window of the route allows", 50*time.Millisecond)
+}
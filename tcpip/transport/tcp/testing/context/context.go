@@ -103,6 +103,9 @@ type Headers struct {
 	// TCPOpts holds the options to be sent in the option field of the TCP
 	// header.
 	TCPOpts []byte
+
+	// TTL is the TTL of the IPv4 packet. Zero means 65.
+	TTL uint8
 }
 
 // Context provides an initialized Network stack and a link layer endpoint
@@ -139,23 +142,14 @@ type Context struct {
 // New allocates and initializes a test context containing a new
 // stack and a link-layer endpoint.
 func New(t *testing.T, mtu uint32) *Context {
-	s := stack.New([]string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{tcp.ProtocolName}, stack.Options{})
-
-	// Allow minimum send/receive buffer sizes to be 1 during tests.
-	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, tcp.SendBufferSizeOption{1, tcp.DefaultBufferSize, tcp.DefaultBufferSize * 10}); err != nil {
-		t.Fatalf("SetTransportProtocolOption failed: %v", err)
-	}
-
-	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, tcp.ReceiveBufferSizeOption{1, tcp.DefaultBufferSize, tcp.DefaultBufferSize * 10}); err != nil {
-		t.Fatalf("SetTransportProtocolOption failed: %v", err)
-	}
+	return NewWithClock(t, mtu, nil)
+}
 
-	// Some of the congestion control tests send up to 640 packets, we so
-	// set the channel size to 1000.
-	id, linkEP := channel.New(1000, mtu, "")
-	if testing.Verbose() {
-		id = sniffer.New(id)
-	}
+// NewWithClock is like New, but the stack uses the given clock, which can be a
+// manual clock to control the TCP timers.
+func NewWithClock(t *testing.T, mtu uint32, clock tcpip.Clock) *Context {
+	s := newStack(t, clock)
+	id, linkEP := newLinkEndpoint(mtu)
 	if err := s.CreateNIC(1, id); err != nil {
 		t.Fatalf("CreateNIC failed: %v", err)
 	}
@@ -190,6 +184,53 @@ func New(t *testing.T, mtu uint32) *Context {
 	}
 }
 
+// newStack returns a new stack using the given clock.
+func newStack(t *testing.T, clock tcpip.Clock) *stack.Stack {
+	s := stack.New([]string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{tcp.ProtocolName}, stack.Options{Clock: clock})
+
+	// Allow minimum send/receive buffer sizes to be 1 during tests.
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, tcp.SendBufferSizeOption{1, tcp.DefaultBufferSize, tcp.DefaultBufferSize * 10}); err != nil {
+		t.Fatalf("SetTransportProtocolOption failed: %v", err)
+	}
+
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, tcp.ReceiveBufferSizeOption{1, tcp.DefaultBufferSize, tcp.DefaultBufferSize * 10}); err != nil {
+		t.Fatalf("SetTransportProtocolOption failed: %v", err)
+	}
+	return s
+}
+
+// newLinkEndpoint returns a new channel link endpoint, sniffed in verbose
+// mode.
+func newLinkEndpoint(mtu uint32) (tcpip.LinkEndpointID, *channel.Endpoint) {
+	// Some of the congestion control tests send up to 640 packets, we so
+	// set the channel size to 1000.
+	id, linkEP := channel.New(1000, mtu, "")
+	if testing.Verbose() {
+		id = sniffer.New(id)
+	}
+	return id, linkEP
+}
+
+// Restore moves the context to a new stack restored from cp on a new link
+// endpoint, with EP the endpoint restored from it. The stack of the context
+// is closed, and its endpoint along with it.
+func (c *Context) Restore(cp *stack.Checkpoint, mtu uint32, clock tcpip.Clock) {
+	s := newStack(c.t, clock)
+	id, linkEP := newLinkEndpoint(mtu)
+	eps, err := s.Restore(cp, map[tcpip.NICID]tcpip.LinkEndpointID{1: id}, []*waiter.Queue{&c.WQ})
+	if err != nil {
+		c.t.Fatalf("Restore failed: %v", err)
+	}
+
+	c.s.Close()
+	if c.EP != nil {
+		c.EP.Close()
+	}
+	c.s = s
+	c.linkEP = linkEP
+	c.EP = eps[0]
+}
+
 // Cleanup closes the context endpoint if required.
 func (c *Context) Cleanup() {
 	if c.EP != nil {
@@ -302,12 +343,17 @@ func (c *Context) BuildSegment(payload []byte, h *Headers) buffer.VectorisedView
 	copy(buf[len(buf)-len(payload):], payload)
 	copy(buf[len(buf)-len(payload)-len(h.TCPOpts):], h.TCPOpts)
 
+	ttl := h.TTL
+	if ttl == 0 {
+		ttl = 65
+	}
+
 	// Initialize the IP header.
 	ip := header.IPv4(buf)
 	ip.Encode(&header.IPv4Fields{
 		IHL:         header.IPv4MinimumSize,
 		TotalLength: uint16(len(buf)),
-		TTL:         65,
+		TTL:         ttl,
 		Protocol:    uint8(tcp.ProtocolNumber),
 		SrcAddr:     TestAddr,
 		DstAddr:     StackAddr,
@@ -809,12 +855,12 @@ func (c *Context) AcceptWithOptions(wndScale int, synOptions header.TCPSynOption
 	wq.EventRegister(&we, waiter.EventIn)
 	defer wq.EventUnregister(&we)
 
-	c.EP, _, err = ep.Accept()
+	c.EP, _, err = ep.Accept(nil)
 	if err == tcpip.ErrWouldBlock {
 		// Wait for connection to be established.
 		select {
 		case <-ch:
-			c.EP, _, err = ep.Accept()
+			c.EP, _, err = ep.Accept(nil)
 			if err != nil {
 				c.t.Fatalf("Accept failed: %v", err)
 			}
@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"github.com/google/netstack/sleep"
+	"github.com/google/netstack/tcpip"
 )
 
 type timerState int
@@ -57,26 +58,30 @@ type timer struct {
 	//                orphaned state.
 	state timerState
 
-	// target is the expiration time of the current timer. It is only
-	// meaningful in the enabled state.
-	target time.Time
+	// clock is the clock the timer is measured against.
+	clock tcpip.Clock
+
+	// target is the expiration time of the current timer, as a monotonic
+	// time of clock. It is only meaningful in the enabled state.
+	target int64
 
 	// runtimeTarget is the expiration time of the runtime timer. It is
 	// meaningful in the enabled and orphaned states.
-	runtimeTarget time.Time
+	runtimeTarget int64
 
 	// timer is the runtime timer used to wait on.
-	timer *time.Timer
+	timer tcpip.Timer
 }
 
-// init initializes the timer. Once it expires, it the given waker will be
-// asserted.
-func (t *timer) init(w *sleep.Waker) {
+// init initializes the timer. Once it expires according to clock, it the
+// given waker will be asserted.
+func (t *timer) init(clock tcpip.Clock, w *sleep.Waker) {
 	t.state = timerStateDisabled
+	t.clock = clock
 
 	// Initialize a runtime timer that will assert the waker, then
 	// immediately stop it.
-	t.timer = time.AfterFunc(time.Hour, func() {
+	t.timer = clock.AfterFunc(time.Hour, func() {
 		w.Assert()
 	})
 	t.timer.Stop()
@@ -101,10 +106,10 @@ func (t *timer) checkExpiration() bool {
 
 	// The timer is enabled, but it may have expired early. Check if that's
 	// the case, and if so, reset the runtime timer to the correct time.
-	now := time.Now()
-	if now.Before(t.target) {
+	now := t.clock.NowMonotonic()
+	if now < t.target {
 		t.runtimeTarget = t.target
-		t.timer.Reset(t.target.Sub(now))
+		t.timer.Reset(time.Duration(t.target - now))
 		return false
 	}
 
@@ -129,10 +134,10 @@ func (t *timer) enabled() bool {
 
 // enable enables the timer, programming the runtime timer if necessary.
 func (t *timer) enable(d time.Duration) {
-	t.target = time.Now().Add(d)
+	t.target = t.clock.NowMonotonic() + int64(d)
 
 	// Check if we need to set the runtime timer.
-	if t.state == timerStateDisabled || t.target.Before(t.runtimeTarget) {
+	if t.state == timerStateDisabled || t.target < t.runtimeTarget {
 		t.runtimeTarget = t.target
 		t.timer.Reset(d)
 	}
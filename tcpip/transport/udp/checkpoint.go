@@ -0,0 +1,230 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+// checkpoint is the state of an endpoint held in a stack.EndpointCheckpoint.
+//
+// Decapsulation handlers are functions, so they aren't held and must be set
+// again on the restored endpoint.
+type checkpoint struct {
+	SockOpts []tcpip.SavedSockOpt
+	V6Only   bool
+
+	MulticastNICID tcpip.NICID
+	MulticastAddr  tcpip.Address
+	Memberships    []membershipCheckpoint
+
+	State endpointState
+
+	// BindNICID, LocalAddress and LocalPort are the NIC the endpoint is
+	// bound to and the address and port it reserved.
+	BindNICID    tcpip.NICID
+	LocalAddress tcpip.Address
+	LocalPort    uint16
+
+	// Remote is the address the endpoint is connected to, through the NIC
+	// it is registered with.
+	Remote tcpip.FullAddress
+
+	ShutdownFlags tcpip.ShutdownFlags
+	RcvClosed     bool
+
+	Packets   []packetCheckpoint
+	ErrQueue  []tcpip.SockError
+	LastError string
+}
+
+// membershipCheckpoint is a multicast group membership held in a checkpoint.
+type membershipCheckpoint struct {
+	NIC  tcpip.NICID
+	Addr tcpip.Address
+}
+
+// packetCheckpoint is a datagram of the receive queue held in a checkpoint.
+type packetCheckpoint struct {
+	Sender      tcpip.FullAddress
+	Destination tcpip.FullAddress
+	Data        []byte
+	Timestamp   int64
+	NetProto    tcpip.NetworkProtocolNumber
+	TOS         uint8
+	FlowLabel   uint32
+}
+
+// Checkpoint implements stack.CheckpointableEndpoint.Checkpoint.
+func (e *endpoint) Checkpoint() (stack.EndpointCheckpoint, error) {
+	c := checkpoint{SockOpts: SockOpts.Save(e)}
+
+	e.mu.RLock()
+	c.V6Only = e.v6only
+	c.MulticastNICID = e.multicastNICID
+	c.MulticastAddr = e.multicastAddr
+	for _, mem := range e.multicastMemberships {
+		c.Memberships = append(c.Memberships, membershipCheckpoint{NIC: mem.nicID, Addr: mem.multicastAddr})
+	}
+	c.State = e.state
+	c.BindNICID = e.bindNICID
+	c.LocalAddress = e.reservedAddr
+	c.LocalPort = e.id.LocalPort
+	if e.state == stateConnected {
+		c.Remote = tcpip.FullAddress{NIC: e.regNICID, Addr: e.id.RemoteAddress, Port: e.dstPort}
+	}
+	c.ShutdownFlags = e.shutdownFlags
+	e.mu.RUnlock()
+
+	e.rcvMu.Lock()
+	c.RcvClosed = e.rcvClosed
+	for p := e.rcvList.Front(); p != nil; p = p.Next() {
+		c.Packets = append(c.Packets, packetCheckpoint{
+			Sender:      p.senderAddress,
+			Destination: p.destinationAddress,
+			Data:        p.data.ToView(),
+			Timestamp:   p.timestamp,
+			NetProto:    p.netProto,
+			TOS:         p.tos,
+			FlowLabel:   p.flowLabel,
+		})
+	}
+	for _, se := range e.errQueue {
+		c.ErrQueue = append(c.ErrQueue, *se)
+	}
+	e.rcvMu.Unlock()
+
+	if err := e.lastError.Peek(); err != nil {
+		c.LastError = err.String()
+	}
+
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(&c); err != nil {
+		return stack.EndpointCheckpoint{}, tcpip.ErrSaveRejection{Err: err}
+	}
+	return stack.EndpointCheckpoint{
+		TransportProtocol: ProtocolNumber,
+		NetworkProtocol:   e.netProto,
+		State:             b.Bytes(),
+	}, nil
+}
+
+// RestoreEndpoint implements stack.EndpointRestorer.RestoreEndpoint.
+func (*protocol) RestoreEndpoint(s *stack.Stack, ec stack.EndpointCheckpoint, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
+	var c checkpoint
+	if err := gob.NewDecoder(bytes.NewReader(ec.State)).Decode(&c); err != nil {
+		return nil, tcpip.ErrInvalidOptionValue
+	}
+	e := newEndpoint(s, ec.NetworkProtocol, waiterQueue)
+	if err := e.restore(&c); err != nil {
+		e.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// restore brings the new endpoint e to the state held in c: it sets its
+// options, binds and connects it again, and refills its queues.
+func (e *endpoint) restore(c *checkpoint) *tcpip.Error {
+	if c.State == stateClosed {
+		e.Close()
+		return nil
+	}
+
+	if err := SockOpts.Restore(e, c.SockOpts); err != nil {
+		return err
+	}
+	if c.V6Only {
+		if err := e.SetSockOpt(tcpip.V6OnlyOption(1)); err != nil {
+			return err
+		}
+	}
+
+	if c.State != stateInitial {
+		e.mu.Lock()
+		err := e.bindLocked(tcpip.FullAddress{NIC: c.BindNICID, Addr: e.userAddress(c.LocalAddress), Port: c.LocalPort})
+		e.bindNICID = c.BindNICID
+		e.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if c.State == stateConnected {
+		if err := e.Connect(tcpip.FullAddress{NIC: c.Remote.NIC, Addr: e.userAddress(c.Remote.Addr), Port: c.Remote.Port}); err != nil {
+			return err
+		}
+	}
+	if c.MulticastNICID != 0 || c.MulticastAddr != "" {
+		if err := e.SetSockOpt(tcpip.MulticastInterfaceOption{NIC: c.MulticastNICID, InterfaceAddr: e.userAddress(c.MulticastAddr)}); err != nil {
+			return err
+		}
+	}
+	for _, mem := range c.Memberships {
+		if err := e.stack.JoinGroup(e.netProto, mem.NIC, mem.Addr); err != nil {
+			return err
+		}
+		e.mu.Lock()
+		e.multicastMemberships = append(e.multicastMemberships, multicastMembership{mem.NIC, mem.Addr})
+		e.mu.Unlock()
+	}
+
+	e.mu.Lock()
+	e.shutdownFlags = c.ShutdownFlags
+	e.mu.Unlock()
+
+	e.rcvMu.Lock()
+	e.rcvClosed = c.RcvClosed
+	for _, pc := range c.Packets {
+		p := &udpPacket{
+			senderAddress:      pc.Sender,
+			destinationAddress: pc.Destination,
+			data:               buffer.View(pc.Data).ToVectorisedView(),
+			timestamp:          pc.Timestamp,
+			netProto:           pc.NetProto,
+			tos:                pc.TOS,
+			flowLabel:          pc.FlowLabel,
+		}
+		e.rcvList.PushBack(p)
+		e.rcvBufSize += p.data.Size()
+	}
+	for i := range c.ErrQueue {
+		se := &c.ErrQueue[i]
+		e.errQueue = append(e.errQueue, se)
+		e.errQueueSize += len(se.Payload)
+		e.errQueueMem += se.ControlSize()
+	}
+	e.rcvMu.Unlock()
+
+	if err := tcpip.ErrorFromMessage(c.LastError); err != nil {
+		e.lastError.Set(err)
+	}
+	return nil
+}
+
+// userAddress returns addr as users of the endpoint give it: IPv4 addresses
+// are v4-mapped on IPv6 endpoints.
+func (e *endpoint) userAddress(addr tcpip.Address) tcpip.Address {
+	if e.netProto == header.IPv6ProtocolNumber && len(addr) == header.IPv4AddressSize {
+		return "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff" + addr
+	}
+	return addr
+}
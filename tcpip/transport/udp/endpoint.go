@@ -17,8 +17,8 @@ package udp
 import (
 	"math"
 	"sync"
+	"sync/atomic"
 
-	"github.com/google/netstack/sleep"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
@@ -26,12 +26,24 @@ import (
 	"github.com/google/netstack/waiter"
 )
 
+// maxErrQueueLen is the maximum number of entries in an endpoint's error
+// queue. Errors that don't fit are dropped.
+const maxErrQueueLen = 256
+
 // +stateify savable
 type udpPacket struct {
 	udpPacketEntry
 	senderAddress tcpip.FullAddress
 	data          buffer.VectorisedView
 	timestamp     int64
+	// netProto, tos and flowLabel are the network protocol of the packet,
+	// its type of service or traffic class, and its IPv6 flow label.
+	netProto  tcpip.NetworkProtocolNumber
+	tos       uint8
+	flowLabel uint32
+	// destinationAddress is the address the packet was sent to, which is
+	// only reported with tcpip.ReceiveOriginalDstAddressOption.
+	destinationAddress tcpip.FullAddress
 	// views is used as buffer for data when its length is large
 	// enough to store a VectorisedView.
 	views [8]buffer.View
@@ -46,6 +58,13 @@ const (
 	stateClosed
 )
 
+var stateNames = [...]string{
+	stateInitial:   "INITIAL",
+	stateBound:     "BOUND",
+	stateConnected: "CONNECTED",
+	stateClosed:    "CLOSED",
+}
+
 // endpoint represents a UDP endpoint. This struct serves as the interface
 // between users of the endpoint and the protocol implementation; it is legal to
 // have concurrent goroutines make calls into the endpoint, they are properly
@@ -58,6 +77,7 @@ type endpoint struct {
 	stack       *stack.Stack
 	netProto    tcpip.NetworkProtocolNumber
 	waiterQueue *waiter.Queue
+	leakID      uint64
 
 	// The following fields are used to manage the receive queue, and are
 	// protected by rcvMu.
@@ -68,6 +88,40 @@ type endpoint struct {
 	rcvBufSize    int
 	rcvClosed     bool
 
+	// recvErr enables the error queue, errQueue, which holds up to
+	// rcvBufSizeMax bytes of offending payloads, errQueueSize, and up to
+	// the stack's control memory of metadata, errQueueMem. They are
+	// protected by rcvMu.
+	recvErr      bool
+	errQueue     []*tcpip.SockError
+	errQueueSize int
+	errQueueMem  int
+
+	// lastError is the last error the endpoint reported asynchronously.
+	lastError tcpip.PendingError
+
+	// sockOpts holds the values of the options registered in SockOpts with
+	// RegisterStored.
+	sockOpts tcpip.SockOptStore
+
+	// minTTL is the minimum TTL of accepted packets, see
+	// tcpip.MinTTLOption. It is protected by rcvMu.
+	minTTL uint8
+
+	// decap is the handler received datagrams are offered to before being
+	// queued, see DecapsulationOption. It is protected by rcvMu.
+	decap DecapsulationHandler
+
+	// receiveTOS, receiveTClass and receiveFlowLabel enable the TOS,
+	// TClass and FlowLabel control messages. They are protected by rcvMu.
+	receiveTOS       bool
+	receiveTClass    bool
+	receiveFlowLabel bool
+
+	// receiveOrigDst enables the OriginalDstAddress control message. It is
+	// protected by rcvMu.
+	receiveOrigDst bool
+
 	// The following fields are protected by the mu mutex.
 	mu             sync.RWMutex
 	sndBufSize     int
@@ -78,12 +132,31 @@ type endpoint struct {
 	route          stack.Route
 	dstPort        uint16
 	v6only         bool
+	ttl            uint8
 	multicastTTL   uint8
+	sendTOS        uint8
+	sendTClass     uint8
+	flowLabel      uint32
 	multicastAddr  tcpip.Address
 	multicastNICID tcpip.NICID
 	multicastLoop  bool
 	reusePort      bool
+	reuseAddr      bool
 	broadcast      bool
+	timestamping   tcpip.TimestampingOption
+	vrf            tcpip.VRFID
+	transparent    bool
+
+	// tsKey is the key of the next transmit timestamp. It must be accessed
+	// atomically.
+	tsKey uint32
+
+	// reservedAddr and reservedNetProtos are the local address and network
+	// protocols the local port was reserved for. They differ from the ones
+	// of id and effectiveNetProtos once an endpoint bound to the wildcard
+	// address is connected. Protected by the mu mutex.
+	reservedAddr      tcpip.Address
+	reservedNetProtos []tcpip.NetworkProtocolNumber
 
 	// shutdownFlags represent the current shutdown state of the endpoint.
 	shutdownFlags tcpip.ShutdownFlags
@@ -108,10 +181,11 @@ type multicastMembership struct {
 }
 
 func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
-	return &endpoint{
+	e := &endpoint{
 		stack:       stack,
 		netProto:    netProto,
 		waiterQueue: waiterQueue,
+		leakID:      tcpip.TrackObject("udp endpoint"),
 		// RFC 1075 section 5.4 recommends a TTL of 1 for membership
 		// requests.
 		//
@@ -126,21 +200,35 @@ func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waite
 		// Linux defaults to TTL=1.
 		multicastTTL:  1,
 		multicastLoop: true,
-		rcvBufSizeMax: 32 * 1024,
-		sndBufSize:    32 * 1024,
+		rcvBufSizeMax: DefaultBufferSize,
+		sndBufSize:    DefaultBufferSize,
+	}
+
+	var ss SendBufferSizeOption
+	if err := stack.TransportProtocolOption(ProtocolNumber, &ss); err == nil {
+		e.sndBufSize = ss.Default
 	}
+
+	var rs ReceiveBufferSizeOption
+	if err := stack.TransportProtocolOption(ProtocolNumber, &rs); err == nil {
+		e.rcvBufSizeMax = rs.Default
+	}
+
+	return e
 }
 
 // Close puts the endpoint in a closed state and frees all resources
 // associated with it.
 func (e *endpoint) Close() {
+	tcpip.UntrackObject(e.leakID)
+
 	e.mu.Lock()
 	e.shutdownFlags = tcpip.ShutdownRead | tcpip.ShutdownWrite
 
 	switch e.state {
 	case stateBound, stateConnected:
-		e.stack.UnregisterTransportEndpoint(e.regNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
-		e.stack.ReleasePort(e.effectiveNetProtos, ProtocolNumber, e.id.LocalAddress, e.id.LocalPort)
+		e.stack.UnregisterTransportEndpointInVRF(e.vrf, e.regNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
+		e.stack.VRFPortManager(e.vrf).ReleasePort(e.reservedNetProtos, ProtocolNumber, e.reservedAddr, e.id.LocalPort)
 	}
 
 	for _, mem := range e.multicastMemberships {
@@ -156,6 +244,9 @@ func (e *endpoint) Close() {
 		p := e.rcvList.Front()
 		e.rcvList.Remove(p)
 	}
+	e.errQueue = nil
+	e.errQueueSize = 0
+	e.errQueueMem = 0
 	e.rcvMu.Unlock()
 
 	e.route.Release()
@@ -186,13 +277,35 @@ func (e *endpoint) Read(addr *tcpip.FullAddress) (buffer.View, tcpip.ControlMess
 	e.rcvList.Remove(p)
 	e.rcvBufSize -= p.data.Size()
 
+	cm := tcpip.ControlMessages{HasTimestamp: true, Timestamp: p.timestamp}
+	switch p.netProto {
+	case header.IPv4ProtocolNumber:
+		if e.receiveTOS {
+			cm.HasTOS = true
+			cm.TOS = p.tos
+		}
+	case header.IPv6ProtocolNumber:
+		if e.receiveTClass {
+			cm.HasTClass = true
+			cm.TClass = p.tos
+		}
+		if e.receiveFlowLabel {
+			cm.HasFlowLabel = true
+			cm.FlowLabel = p.flowLabel
+		}
+	}
+	if e.receiveOrigDst {
+		cm.HasOriginalDstAddress = true
+		cm.OriginalDstAddress = p.destinationAddress
+	}
+
 	e.rcvMu.Unlock()
 
 	if addr != nil {
 		*addr = p.senderAddress
 	}
 
-	return p.data.ToView(), tcpip.ControlMessages{HasTimestamp: true, Timestamp: p.timestamp}, nil
+	return p.data.ToView(), cm, nil
 }
 
 // prepareForWrite prepares the endpoint for sending data. In particular, it
@@ -244,7 +357,7 @@ func (e *endpoint) connectRoute(nicid tcpip.NICID, addr tcpip.FullAddress) (stac
 		return stack.Route{}, 0, 0, err
 	}
 
-	localAddr := e.id.LocalAddress
+	localAddr := e.sourceAddress()
 	if header.IsV4MulticastAddress(addr.Addr) || header.IsV6MulticastAddress(addr.Addr) {
 		if nicid == 0 {
 			nicid = e.multicastNICID
@@ -255,13 +368,46 @@ func (e *endpoint) connectRoute(nicid tcpip.NICID, addr tcpip.FullAddress) (stac
 	}
 
 	// Find a route to the desired destination.
-	r, err := e.stack.FindRoute(nicid, localAddr, addr.Addr, netProto, e.multicastLoop)
+	r, err := e.stack.FindRouteInVRF(e.vrf, nicid, localAddr, addr.Addr, netProto, e.multicastLoop)
 	if err != nil {
 		return stack.Route{}, 0, 0, err
 	}
 	return r, nicid, netProto, nil
 }
 
+// sourceAddress returns the local address of the routes of the endpoint: the
+// address it's bound to, unless it's a multicast or broadcast address, which
+// packets are never sent from. The stack then picks the source address.
+//
+// Precondition: e.mu must be held.
+func (e *endpoint) sourceAddress() tcpip.Address {
+	if isGroupAddress(e.id.LocalAddress) {
+		return ""
+	}
+	return e.id.LocalAddress
+}
+
+// isGroupAddress returns whether addr is the IPv4 broadcast address or a
+// multicast address. Endpoints bound to one only receive the datagrams sent to
+// it.
+func isGroupAddress(addr tcpip.Address) bool {
+	return addr == header.IPv4Broadcast || header.IsV4MulticastAddress(addr) || header.IsV6MulticastAddress(addr)
+}
+
+// refreshRouteLocked finds the route of the connected endpoint again, after
+// the route table, the NICs or the link address of the next hop changed.
+//
+// Precondition: e.mu must be exclusively locked.
+func (e *endpoint) refreshRouteLocked() *tcpip.Error {
+	r, err := e.stack.FindRouteInVRF(e.vrf, e.regNICID, e.sourceAddress(), e.route.RemoteAddress, e.route.NetProto, e.multicastLoop)
+	if err != nil {
+		return err
+	}
+	e.route.Release()
+	e.route = r
+	return nil
+}
+
 // Write writes data to the endpoint's peer. This method does not block
 // if the data cannot be written.
 func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, <-chan struct{}, *tcpip.Error) {
@@ -270,11 +416,6 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, <-c
 		return 0, nil, tcpip.ErrInvalidOptionValue
 	}
 
-	if p.Size() > math.MaxUint16 {
-		// Payload can't possibly fit in a packet.
-		return 0, nil, tcpip.ErrMessageTooLong
-	}
-
 	to := opts.To
 
 	e.mu.RLock()
@@ -303,9 +444,9 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, <-c
 		route = &e.route
 		dstPort = e.dstPort
 
-		if route.IsResolutionRequired() {
+		if route.IsResolutionRequired() || route.Stale() {
 			// Promote lock to exclusive if using a shared route, given that it may need to
-			// change in Route.Resolve() call below.
+			// change in Route.Resolve() call below, or be replaced if stale.
 			e.mu.RUnlock()
 			defer e.mu.RLock()
 
@@ -316,6 +457,12 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, <-c
 			if e.state != stateConnected {
 				return 0, nil, tcpip.ErrInvalidEndpointState
 			}
+
+			if route.Stale() {
+				if err := e.refreshRouteLocked(); err != nil {
+					return 0, nil, err
+				}
+			}
 		}
 	} else {
 		// Reject destination address if it goes through a different
@@ -344,32 +491,94 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, <-c
 	}
 
 	if route.IsResolutionRequired() {
-		waker := &sleep.Waker{}
-		if ch, err := route.Resolve(waker); err != nil {
-			if err == tcpip.ErrWouldBlock {
-				// Link address needs to be resolved. Resolution was triggered the background.
-				// Better luck next time.
-				route.RemoveWaker(waker)
-				return 0, ch, tcpip.ErrNoLinkAddress
-			}
+		// If the link address is being resolved, the stack queues the
+		// packet and sends it once it is.
+		if _, err := route.Resolve(nil); err != nil && err != tcpip.ErrWouldBlock {
 			return 0, nil, err
 		}
 	}
 
-	v, err := p.Get(p.Size())
-	if err != nil {
-		return 0, nil, err
+	if p.Size() > math.MaxUint16 && int(route.MTU()) < header.UDPMinimumSize+p.Size() {
+		// Payload can't possibly fit in a packet. Only IPv6 routes
+		// that carry jumbograms have MTUs above 64k.
+		return 0, nil, tcpip.ErrMessageTooLong
+	}
+
+	var vv buffer.VectorisedView
+	if vp, ok := p.(tcpip.VectorisedPayload); ok {
+		var err *tcpip.Error
+		if vv, err = vp.GetVectorised(p.Size()); err != nil {
+			return 0, nil, err
+		}
+	} else {
+		v, err := p.Get(p.Size())
+		if err != nil {
+			return 0, nil, err
+		}
+		vv = buffer.View(v).ToVectorisedView()
 	}
 
 	ttl := route.DefaultTTL()
 	if header.IsV4MulticastAddress(route.RemoteAddress) || header.IsV6MulticastAddress(route.RemoteAddress) {
 		ttl = e.multicastTTL
+	} else if e.ttl != 0 {
+		ttl = e.ttl
+	}
+	if opts.TTL != 0 {
+		ttl = opts.TTL
+	}
+
+	params := stack.NetworkHeaderParams{
+		Protocol: ProtocolNumber,
+		TTL:      ttl,
+		TOS:      e.sendTOS,
+	}
+	if route.NetProto == header.IPv6ProtocolNumber {
+		params.TOS = e.sendTClass
+		params.FlowLabel = e.flowLabel
+		if params.FlowLabel == 0 {
+			params.FlowLabel = route.FlowLabel(ProtocolNumber, e.id.LocalPort, dstPort)
+		}
+	}
+	if opts.HasTOS {
+		params.TOS = opts.TOS
+	}
+
+	ts := e.timestamping
+	var tsKey uint32
+	if ts&(tcpip.TimestampingTxSched|tcpip.TimestampingTxSoftware) != 0 {
+		tsKey = atomic.AddUint32(&e.tsKey, 1) - 1
+	}
+	if ts&tcpip.TimestampingTxSched != 0 {
+		e.queueTimestamp(route, dstPort, tcpip.TimestampSched, tsKey)
 	}
 
-	if err := sendUDP(route, buffer.View(v).ToVectorisedView(), e.id.LocalPort, dstPort, ttl); err != nil {
+	if err := sendUDP(route, vv, e.id.LocalPort, dstPort, params); err != nil {
+		// The payload is only copied if the error queue is there to
+		// hold it.
+		e.rcvMu.Lock()
+		recvErr := e.recvErr
+		e.rcvMu.Unlock()
+		if recvErr {
+			se := &tcpip.SockError{
+				Err:      err,
+				Origin:   tcpip.SockErrOriginLocal,
+				NetProto: route.NetProto,
+				Dst:      tcpip.FullAddress{NIC: route.NICID(), Addr: route.RemoteAddress, Port: dstPort},
+				Payload:  append(buffer.View(nil), vv.ToView()...),
+			}
+			if err == tcpip.ErrMessageTooLong {
+				se.Info = route.MTU()
+			}
+			e.queueError(se)
+		}
 		return 0, nil, err
 	}
-	return uintptr(len(v)), nil, nil
+
+	if ts&tcpip.TimestampingTxSoftware != 0 {
+		e.queueTimestamp(route, dstPort, tcpip.TimestampSend, tsKey)
+	}
+	return uintptr(vv.Size()), nil, nil
 }
 
 // Peek only returns data from a single datagram, so do nothing here.
@@ -396,11 +605,6 @@ func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
 
 		e.v6only = v != 0
 
-	case tcpip.MulticastTTLOption:
-		e.mu.Lock()
-		e.multicastTTL = uint8(v)
-		e.mu.Unlock()
-
 	case tcpip.MulticastInterfaceOption:
 		e.mu.Lock()
 		defer e.mu.Unlock()
@@ -424,7 +628,7 @@ func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
 				return tcpip.ErrBadLocalAddress
 			}
 		} else {
-			nic = e.stack.CheckLocalAddress(0, netProto, addr)
+			nic = e.stack.CheckLocalAddressInVRF(e.vrf, 0, netProto, addr)
 			if nic == 0 {
 				return tcpip.ErrBadLocalAddress
 			}
@@ -442,17 +646,21 @@ func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
 			return tcpip.ErrInvalidOptionValue
 		}
 
+		e.mu.RLock()
+		vrf := e.vrf
+		e.mu.RUnlock()
+
 		nicID := v.NIC
 		if v.InterfaceAddr == header.IPv4Any {
 			if nicID == 0 {
-				r, err := e.stack.FindRoute(0, "", v.MulticastAddr, header.IPv4ProtocolNumber, false /* multicastLoop */)
+				r, err := e.stack.FindRouteInVRF(vrf, 0, "", v.MulticastAddr, header.IPv4ProtocolNumber, false /* multicastLoop */)
 				if err == nil {
 					nicID = r.NICID()
 					r.Release()
 				}
 			}
 		} else {
-			nicID = e.stack.CheckLocalAddress(nicID, e.netProto, v.InterfaceAddr)
+			nicID = e.stack.CheckLocalAddressInVRF(vrf, nicID, e.netProto, v.InterfaceAddr)
 		}
 		if nicID == 0 {
 			return tcpip.ErrUnknownDevice
@@ -472,17 +680,21 @@ func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
 			return tcpip.ErrInvalidOptionValue
 		}
 
+		e.mu.RLock()
+		vrf := e.vrf
+		e.mu.RUnlock()
+
 		nicID := v.NIC
 		if v.InterfaceAddr == header.IPv4Any {
 			if nicID == 0 {
-				r, err := e.stack.FindRoute(0, "", v.MulticastAddr, header.IPv4ProtocolNumber, false /* multicastLoop */)
+				r, err := e.stack.FindRouteInVRF(vrf, 0, "", v.MulticastAddr, header.IPv4ProtocolNumber, false /* multicastLoop */)
 				if err == nil {
 					nicID = r.NICID()
 					r.Release()
 				}
 			}
 		} else {
-			nicID = e.stack.CheckLocalAddress(nicID, e.netProto, v.InterfaceAddr)
+			nicID = e.stack.CheckLocalAddressInVRF(vrf, nicID, e.netProto, v.InterfaceAddr)
 		}
 		if nicID == 0 {
 			return tcpip.ErrUnknownDevice
@@ -504,43 +716,24 @@ func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
 			}
 		}
 
-	case tcpip.MulticastLoopOption:
-		e.mu.Lock()
-		e.multicastLoop = bool(v)
-		e.mu.Unlock()
-
-	case tcpip.ReusePortOption:
-		e.mu.Lock()
-		e.reusePort = v != 0
-		e.mu.Unlock()
-
-	case tcpip.BroadcastOption:
-		e.mu.Lock()
-		e.broadcast = v != 0
-		e.mu.Unlock()
-
-		return nil
+	default:
+		if err := SockOpts.SetSockOpt(e, opt); err != tcpip.ErrUnknownProtocolOption {
+			return err
+		}
 	}
 	return nil
 }
 
+// SockOptStore implements tcpip.SockOptStorer.SockOptStore.
+func (e *endpoint) SockOptStore() *tcpip.SockOptStore {
+	return &e.sockOpts
+}
+
 // GetSockOpt implements tcpip.Endpoint.GetSockOpt.
 func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
 	switch o := opt.(type) {
 	case tcpip.ErrorOption:
-		return nil
-
-	case *tcpip.SendBufferSizeOption:
-		e.mu.Lock()
-		*o = tcpip.SendBufferSizeOption(e.sndBufSize)
-		e.mu.Unlock()
-		return nil
-
-	case *tcpip.ReceiveBufferSizeOption:
-		e.rcvMu.Lock()
-		*o = tcpip.ReceiveBufferSizeOption(e.rcvBufSizeMax)
-		e.rcvMu.Unlock()
-		return nil
+		return e.lastError.Get()
 
 	case *tcpip.V6OnlyOption:
 		// We only recognize this option on v6 endpoints.
@@ -558,23 +751,6 @@ func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
 		}
 		return nil
 
-	case *tcpip.ReceiveQueueSizeOption:
-		e.rcvMu.Lock()
-		if e.rcvList.Empty() {
-			*o = 0
-		} else {
-			p := e.rcvList.Front()
-			*o = tcpip.ReceiveQueueSizeOption(p.data.Size())
-		}
-		e.rcvMu.Unlock()
-		return nil
-
-	case *tcpip.MulticastTTLOption:
-		e.mu.Lock()
-		*o = tcpip.MulticastTTLOption(e.multicastTTL)
-		e.mu.Unlock()
-		return nil
-
 	case *tcpip.MulticastInterfaceOption:
 		e.mu.Lock()
 		*o = tcpip.MulticastInterfaceOption{
@@ -584,74 +760,45 @@ func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
 		e.mu.Unlock()
 		return nil
 
-	case *tcpip.MulticastLoopOption:
-		e.mu.RLock()
-		v := e.multicastLoop
-		e.mu.RUnlock()
-
-		*o = tcpip.MulticastLoopOption(v)
-		return nil
-
-	case *tcpip.ReusePortOption:
-		e.mu.RLock()
-		v := e.reusePort
-		e.mu.RUnlock()
-
-		*o = 0
-		if v {
-			*o = 1
-		}
-		return nil
-
-	case *tcpip.KeepaliveEnabledOption:
-		*o = 0
-		return nil
-
-	case *tcpip.BroadcastOption:
-		e.mu.RLock()
-		v := e.broadcast
-		e.mu.RUnlock()
-
-		*o = 0
-		if v {
-			*o = 1
-		}
-		return nil
-
 	default:
-		return tcpip.ErrUnknownProtocolOption
+		return SockOpts.GetSockOpt(e, opt)
 	}
 }
 
 // sendUDP sends a UDP segment via the provided network endpoint and under the
-// provided identity.
-func sendUDP(r *stack.Route, data buffer.VectorisedView, localPort, remotePort uint16, ttl uint8) *tcpip.Error {
+// provided identity, with a network header built from params.
+func sendUDP(r *stack.Route, data buffer.VectorisedView, localPort, remotePort uint16, params stack.NetworkHeaderParams) *tcpip.Error {
 	// Allocate a buffer for the UDP header.
 	hdr := buffer.NewPrependable(header.UDPMinimumSize + int(r.MaxHeaderLength()))
 
 	// Initialize the header.
 	udp := header.UDP(hdr.Prepend(header.UDPMinimumSize))
 
-	length := uint16(hdr.UsedLength() + data.Size())
-	udp.Encode(&header.UDPFields{
+	length := uint32(hdr.UsedLength() + data.Size())
+	fields := header.UDPFields{
 		SrcPort: localPort,
 		DstPort: remotePort,
-		Length:  length,
-	})
+	}
+	// The length of datagrams carried by jumbograms doesn't fit in the
+	// header, and is left zero.
+	if length <= header.UDPMaximumSize {
+		fields.Length = uint16(length)
+	}
+	udp.Encode(&fields)
 
 	// Only calculate the checksum if offloading isn't supported.
 	if r.Capabilities()&stack.CapabilityChecksumOffload == 0 {
 		xsum := r.PseudoHeaderChecksum(ProtocolNumber, length)
-		for _, v := range data.Views() {
-			xsum = header.Checksum(v, xsum)
-		}
+		xsum = header.ChecksumVV(data, xsum)
 		udp.SetChecksum(^udp.CalculateChecksum(xsum))
 	}
 
 	// Track count of packets sent.
 	r.Stats().UDP.PacketsSent.Increment()
 
-	return r.WritePacket(hdr, data, ProtocolNumber, ttl)
+	pkt := stack.NewOutboundPacketBuffer(hdr, data)
+	defer pkt.DecRef()
+	return r.WritePacketWithParams(pkt, params)
 }
 
 func (e *endpoint) checkV4Mapped(addr *tcpip.FullAddress, allowMismatch bool) (tcpip.NetworkProtocolNumber, *tcpip.Error) {
@@ -724,6 +871,11 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
 		RemotePort:    addr.Port,
 		RemoteAddress: r.RemoteAddress,
 	}
+	if isGroupAddress(e.id.LocalAddress) {
+		// Like on Linux, endpoints bound to a group address keep
+		// receiving the datagrams sent to it, now from their peer only.
+		id.LocalAddress = e.id.LocalAddress
+	}
 
 	// Even if we're connected, this endpoint can still be used to send
 	// packets on a different network protocol, so we register both even if
@@ -743,7 +895,7 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
 
 	// Remove the old registration.
 	if e.id.LocalPort != 0 {
-		e.stack.UnregisterTransportEndpoint(e.regNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
+		e.stack.UnregisterTransportEndpointInVRF(e.vrf, e.regNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
 	}
 
 	e.id = id
@@ -791,6 +943,10 @@ func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) *tcpip.Error {
 		}
 	}
 
+	if e.shutdownFlags == tcpip.ShutdownRead|tcpip.ShutdownWrite {
+		e.waiterQueue.Notify(waiter.EventHUp)
+	}
+
 	return nil
 }
 
@@ -800,24 +956,41 @@ func (*endpoint) Listen(int) *tcpip.Error {
 }
 
 // Accept is not supported by UDP, it just fails.
-func (*endpoint) Accept() (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
+func (*endpoint) Accept(*tcpip.FullAddress) (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
 	return nil, nil, tcpip.ErrNotSupported
 }
 
+// registerWithStack registers the endpoint with id, reserving a local port
+// first if the endpoint doesn't have one yet. Ports may be shared by endpoints
+// bound to different addresses, like one bound to the wildcard address and
+// others bound to specific ones, if they all set SO_REUSEADDR or SO_REUSEPORT.
 func (e *endpoint) registerWithStack(nicid tcpip.NICID, netProtos []tcpip.NetworkProtocolNumber, id stack.TransportEndpointID) (stack.TransportEndpointID, *tcpip.Error) {
-	if e.id.LocalPort == 0 {
-		port, err := e.stack.ReservePort(netProtos, ProtocolNumber, id.LocalAddress, id.LocalPort, e.reusePort)
+	ports := e.stack.VRFPortManager(e.vrf)
+	reserved := e.id.LocalPort == 0
+	if reserved {
+		port, err := ports.ReservePort(netProtos, ProtocolNumber, id.LocalAddress, id.LocalPort, e.reusePort || e.reuseAddr)
 		if err != nil {
 			return id, err
 		}
 		id.LocalPort = port
 	}
 
-	err := e.stack.RegisterTransportEndpoint(nicid, netProtos, ProtocolNumber, id, e, e.reusePort)
+	// Endpoints bound to the same group address with SO_REUSEADDR share
+	// it like with SO_REUSEPORT: they all receive the datagrams sent to
+	// it, as on BSD and Linux.
+	reusePort := e.reusePort || (e.reuseAddr && isGroupAddress(id.LocalAddress))
+	err := e.stack.RegisterTransportEndpointInVRF(e.vrf, nicid, netProtos, ProtocolNumber, id, e, reusePort)
 	if err != nil {
-		e.stack.ReleasePort(netProtos, ProtocolNumber, id.LocalAddress, id.LocalPort)
+		if reserved {
+			ports.ReleasePort(netProtos, ProtocolNumber, id.LocalAddress, id.LocalPort)
+		}
+		return id, err
+	}
+	if reserved {
+		e.reservedAddr = id.LocalAddress
+		e.reservedNetProtos = netProtos
 	}
-	return id, err
+	return id, nil
 }
 
 func (e *endpoint) bindLocked(addr tcpip.FullAddress) *tcpip.Error {
@@ -844,9 +1017,9 @@ func (e *endpoint) bindLocked(addr tcpip.FullAddress) *tcpip.Error {
 	}
 
 	nicid := addr.NIC
-	if len(addr.Addr) != 0 {
+	if len(addr.Addr) != 0 && !e.transparent && !isGroupAddress(addr.Addr) {
 		// A local address was specified, verify that it's valid.
-		nicid = e.stack.CheckLocalAddress(addr.NIC, netProto, addr.Addr)
+		nicid = e.stack.CheckLocalAddressInVRF(e.vrf, addr.NIC, netProto, addr.Addr)
 		if nicid == 0 {
 			return tcpip.ErrBadLocalAddress
 		}
@@ -877,6 +1050,10 @@ func (e *endpoint) bindLocked(addr tcpip.FullAddress) *tcpip.Error {
 
 // Bind binds the endpoint to a specific local address and port.
 // Specifying a NIC is optional.
+//
+// The address may be a multicast address or the IPv4 broadcast address, in
+// which case the endpoint only receives the datagrams sent to it, and sends
+// from an address of the stack.
 func (e *endpoint) Bind(addr tcpip.FullAddress) *tcpip.Error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -922,34 +1099,75 @@ func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, *tcpip.Error) {
 
 // Readiness returns the current readiness of the endpoint. For example, if
 // waiter.EventIn is set, the endpoint is immediately readable.
+//
+// waiter.EventHUp is reported once the endpoint is closed or shut down both
+// ways, whether or not it is in mask.
 func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 	// The endpoint is always writable.
 	result := waiter.EventOut & mask
 
+	e.mu.RLock()
+	if e.state == stateClosed || e.shutdownFlags == tcpip.ShutdownRead|tcpip.ShutdownWrite {
+		result |= waiter.EventHUp
+	}
+	e.mu.RUnlock()
+
 	// Determine if the endpoint is readable if requested.
-	if (mask & waiter.EventIn) != 0 {
-		e.rcvMu.Lock()
-		if !e.rcvList.Empty() || e.rcvClosed {
-			result |= waiter.EventIn
-		}
-		e.rcvMu.Unlock()
+	e.rcvMu.Lock()
+	if (mask&waiter.EventIn) != 0 && (!e.rcvList.Empty() || e.rcvClosed) {
+		result |= waiter.EventIn
+	}
+	if len(e.errQueue) != 0 {
+		result |= waiter.EventErr
+	}
+	e.rcvMu.Unlock()
+
+	if e.lastError.Pending() {
+		result |= waiter.EventErr
 	}
 
 	return result
 }
 
+// Diagnose implements stack.DiagnosableEndpoint.Diagnose.
+func (e *endpoint) Diagnose(info *stack.SocketInfo) {
+	e.mu.RLock()
+	info.State = stateNames[e.state]
+	e.mu.RUnlock()
+
+	e.rcvMu.Lock()
+	info.RecvQueue = e.rcvBufSize
+	e.rcvMu.Unlock()
+}
+
 // HandlePacket is called by the stack when new packets arrive to this transport
 // endpoint.
-func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, netHeader buffer.View, vv buffer.VectorisedView) {
+func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, pkt *stack.PacketBuffer) {
 	// Get the header then trim it from the view.
-	hdr := header.UDP(vv.First())
-	if int(hdr.Length()) > vv.Size() {
-		// Malformed packet.
+	hdr, err := header.ParseUDPHeader(pkt.Data.First(), pkt.Data.Size(), header.ParseLenient)
+	if err != nil {
 		e.stack.Stats().UDP.MalformedPacketsReceived.Increment()
+		r.RecordDrop(tcpip.DropMalformed, pkt.Data)
 		return
 	}
 
-	vv.TrimFront(header.UDPMinimumSize)
+	pkt.TransportHeader = buffer.View(hdr)
+	pkt.Data.TrimFront(header.UDPMinimumSize)
+
+	e.rcvMu.Lock()
+	minTTL, decap := e.minTTL, e.decap
+	e.rcvMu.Unlock()
+	if minTTL != 0 && pkt.TTL() < minTTL {
+		r.RecordDrop(tcpip.DropMinTTL, pkt.Data)
+		return
+	}
+
+	// Offer the datagram to the decapsulation handler, if any, before it
+	// is copied.
+	if decap != nil && decap(r, id, pkt) {
+		e.stack.Stats().UDP.PacketsDecapsulated.Increment()
+		return
+	}
 
 	e.rcvMu.Lock()
 	e.stack.Stats().UDP.PacketsReceived.Increment()
@@ -958,24 +1176,33 @@ func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, ne
 	if !e.rcvReady || e.rcvClosed || e.rcvBufSize >= e.rcvBufSizeMax {
 		e.stack.Stats().UDP.ReceiveBufferErrors.Increment()
 		e.rcvMu.Unlock()
+		r.RecordDrop(tcpip.DropQueueFull, pkt.Data)
 		return
 	}
 
 	wasEmpty := e.rcvBufSize == 0
 
 	// Push new packet into receive list and increment the buffer size.
-	pkt := &udpPacket{
+	p := &udpPacket{
 		senderAddress: tcpip.FullAddress{
 			NIC:  r.NICID(),
 			Addr: id.RemoteAddress,
 			Port: hdr.SourcePort(),
 		},
+		destinationAddress: tcpip.FullAddress{
+			NIC:  r.NICID(),
+			Addr: id.LocalAddress,
+			Port: hdr.DestinationPort(),
+		},
 	}
-	pkt.data = vv.Clone(pkt.views[:])
-	e.rcvList.PushBack(pkt)
-	e.rcvBufSize += vv.Size()
+	p.data = pkt.OwnedData(p.views[:])
+	e.rcvList.PushBack(p)
+	e.rcvBufSize += p.data.Size()
 
-	pkt.timestamp = e.stack.NowNanoseconds()
+	p.timestamp = e.stack.NowNanoseconds()
+	p.netProto = r.NetProto
+	p.tos = pkt.TOS()
+	p.flowLabel = pkt.FlowLabel()
 
 	e.rcvMu.Unlock()
 
@@ -985,6 +1212,170 @@ func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, ne
 	}
 }
 
+// Transparent implements stack.TransparentEndpoint.Transparent.
+func (e *endpoint) Transparent() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.transparent
+}
+
 // HandleControlPacket implements stack.TransportEndpoint.HandleControlPacket.
-func (e *endpoint) HandleControlPacket(id stack.TransportEndpointID, typ stack.ControlType, extra uint32, vv buffer.VectorisedView) {
+func (e *endpoint) HandleControlPacket(id stack.TransportEndpointID, typ stack.ControlType, extra uint32, info stack.ControlInfo, vv buffer.VectorisedView) {
+	switch typ {
+	case stack.ControlNICRemoved, stack.ControlHostUnreachable:
+		e.routeFailed(typ, extra, info)
+		return
+	}
+
+	se := &tcpip.SockError{
+		Origin:        tcpip.SockErrOriginICMP,
+		NetProto:      header.IPv4ProtocolNumber,
+		Type:          uint8(header.ICMPv4DstUnreachable),
+		Dst:           tcpip.FullAddress{Addr: id.RemoteAddress, Port: id.RemotePort},
+		Offender:      info.Offender,
+		NetworkHeader: info.NetworkHeader,
+	}
+	v6 := len(id.RemoteAddress) == header.IPv6AddressSize
+	if v6 {
+		se.Origin = tcpip.SockErrOriginICMP6
+		se.NetProto = header.IPv6ProtocolNumber
+		se.Type = uint8(header.ICMPv6DstUnreachable)
+	}
+
+	switch typ {
+	case stack.ControlPacketTooBig:
+		se.Err = tcpip.ErrMessageTooLong
+		se.Info = extra
+		se.Code = header.ICMPv4FragmentationNeeded
+		if v6 {
+			se.Type = uint8(header.ICMPv6PacketTooBig)
+			se.Code = 0
+		}
+
+	case stack.ControlPortUnreachable:
+		se.Err = tcpip.ErrConnectionRefused
+		se.Code = header.ICMPv4PortUnreachable
+		if v6 {
+			se.Code = header.ICMPv6PortUnreachable
+		}
+
+	case stack.ControlTimeExceeded:
+		se.Err = tcpip.ErrHostUnreachable
+		se.Type = uint8(header.ICMPv4TimeExceeded)
+		se.Code = uint8(extra)
+		if v6 {
+			se.Type = uint8(header.ICMPv6TimeExceeded)
+		}
+
+	default:
+		return
+	}
+
+	// Like Linux, the endpoint only reports hard errors, for the flow it's
+	// connected to, unless its error queue is enabled.
+	e.rcvMu.Lock()
+	recvErr := e.recvErr
+	e.rcvMu.Unlock()
+	e.mu.RLock()
+	connected := e.state == stateConnected
+	e.mu.RUnlock()
+	if recvErr || (connected && typ == stack.ControlPortUnreachable) {
+		e.reportError(se.Err)
+	}
+	if !recvErr {
+		return
+	}
+
+	// vv starts with the UDP header of the offending packet, which the
+	// stack checked is there.
+	se.TransportHeader = append(buffer.View(nil), vv.First()[:header.UDPMinimumSize]...)
+	vv.TrimFront(header.UDPMinimumSize)
+	se.Payload = append(buffer.View(nil), vv.ToView()...)
+	e.queueError(se)
+}
+
+// queueTimestamp adds a transmit timestamp of the given kind for a packet sent
+// through r to the error queue.
+func (e *endpoint) queueTimestamp(r *stack.Route, dstPort uint16, kind tcpip.TimestampKind, key uint32) {
+	e.queueError(&tcpip.SockError{
+		Origin:        tcpip.SockErrOriginTimestamping,
+		NetProto:      r.NetProto,
+		Dst:           tcpip.FullAddress{NIC: r.NICID(), Addr: r.RemoteAddress, Port: dstPort},
+		Timestamp:     e.stack.NowNanoseconds(),
+		TimestampKind: kind,
+		Key:           key,
+	})
+}
+
+// routeFailed handles the control packets of type typ telling that routes
+// stopped working, and reports the error if the route of the endpoint is one
+// of them.
+func (e *endpoint) routeFailed(typ stack.ControlType, extra uint32, info stack.ControlInfo) {
+	var err *tcpip.Error
+	e.mu.RLock()
+	if e.state == stateConnected {
+		switch {
+		case typ == stack.ControlNICRemoved && e.route.Removed():
+			err = tcpip.ErrNetworkUnreachable
+		case typ == stack.ControlHostUnreachable && e.route.UsesNeighbor(tcpip.FullAddress{NIC: tcpip.NICID(extra), Addr: info.Offender}):
+			err = tcpip.ErrHostUnreachable
+		}
+	}
+	e.mu.RUnlock()
+
+	if err != nil {
+		e.reportError(err)
+	}
+}
+
+// reportError makes err the pending error of the endpoint, which is retrieved
+// with tcpip.ErrorOption.
+func (e *endpoint) reportError(err *tcpip.Error) {
+	e.lastError.Set(err)
+	e.waiterQueue.Notify(waiter.EventErr)
+}
+
+// queueError adds se to the error queue, if the queue has room for it and,
+// unless se is a transmit timestamp, is enabled.
+func (e *endpoint) queueError(se *tcpip.SockError) {
+	e.rcvMu.Lock()
+	enabled := e.recvErr || se.Origin == tcpip.SockErrOriginTimestamping
+	full := len(e.errQueue) >= maxErrQueueLen || e.errQueueSize+len(se.Payload) > e.rcvBufSizeMax
+	if !enabled || e.rcvClosed || full || !e.stack.ChargeControlMemory(e.errQueueMem, se.ControlSize()) {
+		e.rcvMu.Unlock()
+		return
+	}
+	wasEmpty := len(e.errQueue) == 0
+	e.errQueue = append(e.errQueue, se)
+	e.errQueueSize += len(se.Payload)
+	e.errQueueMem += se.ControlSize()
+	e.rcvMu.Unlock()
+
+	if wasEmpty {
+		e.waiterQueue.Notify(waiter.EventErr)
+	}
+}
+
+// ReadErrQueue implements tcpip.ErrQueueReader.ReadErrQueue.
+func (e *endpoint) ReadErrQueue() (*tcpip.SockError, *tcpip.Error) {
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+
+	if len(e.errQueue) == 0 {
+		return nil, tcpip.ErrWouldBlock
+	}
+	se := e.errQueue[0]
+	e.errQueue[0] = nil
+	e.errQueue = e.errQueue[1:]
+	e.errQueueSize -= len(se.Payload)
+	e.errQueueMem -= se.ControlSize()
+
+	// As with Linux, the pending error becomes the one of the next queued
+	// error, if any.
+	var next *tcpip.Error
+	if len(e.errQueue) != 0 {
+		next = e.errQueue[0].Err
+	}
+	e.lastError.Set(next)
+	return se, nil
 }
@@ -0,0 +1,368 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// SockOpts holds the socket options of UDP endpoints that aren't handled
+// directly by their SetSockOpt and GetSockOpt methods. Embedders may register
+// options of their own types in it, including stored ones.
+var SockOpts tcpip.SockOptTable
+
+// A DecapsulationHandler is offered the datagrams received by an endpoint
+// before they are queued, so that protocols carried over UDP, like ESP or
+// WireGuard, can process them without them being copied first.
+//
+// pkt.TransportHeader holds the UDP header and pkt.Data the payload. The
+// handler returns true if it consumed the datagram, in which case it must
+// take a reference on pkt to keep it after returning; otherwise it must leave
+// pkt unmodified, and the datagram is queued as usual.
+type DecapsulationHandler func(r *stack.Route, id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool
+
+// DecapsulationOption is used by SetSockOpt/GetSockOpt to set or get the
+// DecapsulationHandler of an endpoint. A nil Handler removes it.
+type DecapsulationOption struct {
+	Handler DecapsulationHandler
+}
+
+func init() {
+	SockOpts.Register(DecapsulationOption{}, func(ep tcpip.Endpoint, opt interface{}) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		opt.(*DecapsulationOption).Handler = e.decap
+		return nil
+	}, func(ep tcpip.Endpoint, opt interface{}) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		e.decap = opt.(DecapsulationOption).Handler
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.SendBufferSizeOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return e.sndBufSize, nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		e := ep.(*endpoint)
+		var ss SendBufferSizeOption
+		if err := e.stack.TransportProtocolOption(ProtocolNumber, &ss); err == nil {
+			v = tcpip.ClampBufferSize(v, ss.Min, ss.Max)
+		}
+		e.mu.Lock()
+		e.sndBufSize = v
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.ReceiveBufferSizeOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		return e.rcvBufSizeMax, nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		e := ep.(*endpoint)
+		var rs ReceiveBufferSizeOption
+		if err := e.stack.TransportProtocolOption(ProtocolNumber, &rs); err == nil {
+			v = tcpip.ClampBufferSize(v, rs.Min, rs.Max)
+		}
+		e.rcvMu.Lock()
+		e.rcvBufSizeMax = v
+		e.rcvMu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.ReceiveQueueSizeOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		if e.rcvList.Empty() {
+			return 0, nil
+		}
+		return e.rcvList.Front().data.Size(), nil
+	}, nil)
+
+	SockOpts.RegisterInt(tcpip.TTLOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return int(e.ttl), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.ttl = uint8(v)
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.MinTTLOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		return int(e.minTTL), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		e.minTTL = uint8(v)
+		e.rcvMu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.IPv4TOSOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return int(e.sendTOS), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.sendTOS = uint8(v)
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.IPv6TrafficClassOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return int(e.sendTClass), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.sendTClass = uint8(v)
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.ReceiveTOSOption(false), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		return e.receiveTOS, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		e.receiveTOS = v
+		e.rcvMu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.ReceiveTClassOption(false), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		return e.receiveTClass, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		e.receiveTClass = v
+		e.rcvMu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.IPv6FlowLabelOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return int(e.flowLabel), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		if v < 0 || v > header.IPv6FlowLabelMask {
+			return tcpip.ErrInvalidOptionValue
+		}
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.flowLabel = uint32(v)
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.ReceiveFlowLabelOption(false), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		return e.receiveFlowLabel, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		e.receiveFlowLabel = v
+		e.rcvMu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.MulticastTTLOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return int(e.multicastTTL), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.multicastTTL = uint8(v)
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.MulticastLoopOption(false), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return e.multicastLoop, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.multicastLoop = v
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.ReusePortOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return e.reusePort, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.reusePort = v
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.ReuseAddressOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return e.reuseAddr, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.reuseAddr = v
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.BroadcastOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return e.broadcast, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.broadcast = v
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterInt(tcpip.VRFOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return int(e.vrf), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.state != stateInitial {
+			return tcpip.ErrInvalidEndpointState
+		}
+		e.vrf = tcpip.VRFID(v)
+		return nil
+	})
+
+	SockOpts.Register(tcpip.OriginalDestinationOption{}, func(ep tcpip.Endpoint, opt interface{}) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		if e.state != stateConnected {
+			return tcpip.ErrNotConnected
+		}
+		addr, ok := e.stack.OriginalDestination(e.route.NetProto, ProtocolNumber, e.id)
+		if !ok {
+			return tcpip.ErrNoSuchFile
+		}
+		*opt.(*tcpip.OriginalDestinationOption) = tcpip.OriginalDestinationOption(addr)
+		return nil
+	}, nil)
+
+	// UDP doesn't support keepalives.
+	SockOpts.RegisterBool(tcpip.KeepaliveEnabledOption(0), func(tcpip.Endpoint) (bool, *tcpip.Error) {
+		return false, nil
+	}, nil)
+
+	SockOpts.RegisterInt(tcpip.TimestampingOption(0), func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return int(e.timestamping), nil
+	}, func(ep tcpip.Endpoint, v int) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.timestamping = tcpip.TimestampingOption(v)
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.RecvErrOption(0), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		return e.recvErr, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		e.recvErr = v
+		if !v {
+			// Like Linux, drop the errors queued so far.
+			e.errQueue = nil
+			e.errQueueSize = 0
+			e.errQueueMem = 0
+		}
+		e.rcvMu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.TransparentOption(false), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		return e.transparent, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.mu.Lock()
+		e.transparent = v
+		e.mu.Unlock()
+		return nil
+	})
+
+	SockOpts.RegisterBool(tcpip.ReceiveOriginalDstAddressOption(false), func(ep tcpip.Endpoint) (bool, *tcpip.Error) {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		defer e.rcvMu.Unlock()
+		return e.receiveOrigDst, nil
+	}, func(ep tcpip.Endpoint, v bool) *tcpip.Error {
+		e := ep.(*endpoint)
+		e.rcvMu.Lock()
+		e.receiveOrigDst = v
+		e.rcvMu.Unlock()
+		return nil
+	})
+}
@@ -18,6 +18,8 @@ import (
 	"bytes"
 	"math"
 	"math/rand"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -66,8 +68,10 @@ type testContext struct {
 }
 
 type headers struct {
-	srcPort uint16
-	dstPort uint16
+	srcPort   uint16
+	dstPort   uint16
+	tos       uint8
+	flowLabel uint32
 }
 
 func newDualTestContext(t *testing.T, mtu uint32) *testContext {
@@ -180,6 +184,8 @@ func (c *testContext) sendV6Packet(payload []byte, h *headers) {
 	ip := header.IPv6(buf)
 	ip.Encode(&header.IPv6Fields{
 		PayloadLength: uint16(header.UDPMinimumSize + len(payload)),
+		TrafficClass:  h.tos,
+		FlowLabel:     h.flowLabel,
 		NextHeader:    uint8(udp.ProtocolNumber),
 		HopLimit:      65,
 		SrcAddr:       testV6Addr,
@@ -208,6 +214,11 @@ func (c *testContext) sendV6Packet(payload []byte, h *headers) {
 }
 
 func (c *testContext) sendPacket(payload []byte, h *headers) {
+	c.sendPacketTo(payload, h, stackAddr)
+}
+
+// sendPacketTo is like sendPacket, but sends the packet to dst.
+func (c *testContext) sendPacketTo(payload []byte, h *headers, dst tcpip.Address) {
 	// Allocate a buffer for data and headers.
 	buf := buffer.NewView(header.UDPMinimumSize + header.IPv4MinimumSize + len(payload))
 	copy(buf[len(buf)-len(payload):], payload)
@@ -217,10 +228,11 @@ func (c *testContext) sendPacket(payload []byte, h *headers) {
 	ip.Encode(&header.IPv4Fields{
 		IHL:         header.IPv4MinimumSize,
 		TotalLength: uint16(len(buf)),
+		TOS:         h.tos,
 		TTL:         65,
 		Protocol:    uint8(udp.ProtocolNumber),
 		SrcAddr:     testAddr,
-		DstAddr:     stackAddr,
+		DstAddr:     dst,
 	})
 	ip.SetChecksum(^ip.CalculateChecksum())
 
@@ -234,7 +246,7 @@ func (c *testContext) sendPacket(payload []byte, h *headers) {
 
 	// Calculate the UDP pseudo-header checksum.
 	xsum := header.Checksum([]byte(testAddr), 0)
-	xsum = header.Checksum([]byte(stackAddr), xsum)
+	xsum = header.Checksum([]byte(dst), xsum)
 	xsum = header.Checksum([]byte{0, uint8(udp.ProtocolNumber)}, xsum)
 
 	// Calculate the UDP checksum and set it.
@@ -337,6 +349,69 @@ func TestBindPortReuse(t *testing.T) {
 	}
 }
 
+func TestBindPortReuseClose(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var eps [2]tcpip.Endpoint
+	for i := range eps {
+		var wq waiter.Queue
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv6.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		if err := ep.SetSockOpt(tcpip.ReusePortOption(1)); err != nil {
+			t.Fatalf("SetSockOpt failed: %v", err)
+		}
+		if err := ep.Bind(tcpip.FullAddress{Addr: stackV6Addr, Port: stackPort}); err != nil {
+			t.Fatalf("ep.Bind(...) failed: %v", err)
+		}
+		eps[i] = ep
+	}
+	defer eps[1].Close()
+
+	// Once an endpoint of the group is closed, the remaining one gets the
+	// datagrams of all the flows.
+	eps[0].Close()
+	for i := 0; i < 20; i++ {
+		c.sendV6Packet(newPayload(), &headers{
+			srcPort: testPort + uint16(i),
+			dstPort: stackPort,
+		})
+		var addr tcpip.FullAddress
+		if _, _, err := eps[1].Read(&addr); err != nil {
+			t.Fatalf("Read of the datagram from port %d failed: %v", testPort+uint16(i), err)
+		}
+	}
+}
+
+func TestBroadcastDeliveredOnce(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.SetSockOpt(tcpip.AddMembershipOption{InterfaceAddr: header.IPv4Any, MulticastAddr: multicastAddr}); err != nil {
+		t.Fatalf("SetSockOpt(AddMembershipOption) failed: %v", err)
+	}
+
+	// Joining a group doesn't give the NIC another address to receive
+	// broadcasts on.
+	c.sendPacketTo(newPayload(), &headers{srcPort: testPort, dstPort: stackPort}, header.IPv4Broadcast)
+	if _, _, err := ep.Read(nil); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if _, _, err := ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got a second Read = %v, want %s", err, tcpip.ErrWouldBlock)
+	}
+}
+
 func testV4Read(c *testContext) {
 	// Send a packet.
 	payload := newPayload()
@@ -388,6 +463,41 @@ func TestBindEphemeralPort(t *testing.T) {
 	}
 }
 
+func TestReadinessHangUp(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+
+	if err := c.ep.Bind(tcpip.FullAddress{}); err != nil {
+		t.Fatalf("ep.Bind(...) failed: %v", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventHUp)
+	defer c.wq.EventUnregister(&we)
+
+	// Shutting down one way doesn't hang up the endpoint.
+	if err := c.ep.Shutdown(tcpip.ShutdownRead); err != nil {
+		t.Fatalf("ep.Shutdown(ShutdownRead) failed: %v", err)
+	}
+	if got, want := c.ep.Readiness(waiter.EventIn), waiter.EventIn; got != want {
+		t.Fatalf("got ep.Readiness(EventIn) = %v, want = %v", got, want)
+	}
+
+	if err := c.ep.Shutdown(tcpip.ShutdownWrite); err != nil {
+		t.Fatalf("ep.Shutdown(ShutdownWrite) failed: %v", err)
+	}
+	select {
+	case <-ch:
+	default:
+		t.Fatalf("no EventHUp notification after shutting down both ways")
+	}
+	if got, want := c.ep.Readiness(0), waiter.EventHUp; got != want {
+		t.Fatalf("got ep.Readiness(0) = %v, want = %v", got, want)
+	}
+}
+
 func TestBindReservedPort(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
@@ -447,6 +557,163 @@ func TestBindReservedPort(t *testing.T) {
 	}()
 }
 
+func TestDeliveryPrecedence(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// newEndpoint returns an endpoint bound to addr, or nil if it can't be
+	// bound.
+	newEndpoint := func(addr tcpip.Address, reuse bool) tcpip.Endpoint {
+		t.Helper()
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		if reuse {
+			if err := ep.SetSockOpt(tcpip.ReuseAddressOption(1)); err != nil {
+				t.Fatalf("SetSockOpt(ReuseAddressOption(1)) failed: %v", err)
+			}
+		}
+		if err := ep.Bind(tcpip.FullAddress{Addr: addr, Port: stackPort}); err != nil {
+			ep.Close()
+			return nil
+		}
+		return ep
+	}
+	// receiver sends a packet from srcPort and returns which of eps got it.
+	receiver := func(srcPort uint16, eps ...tcpip.Endpoint) int {
+		t.Helper()
+		c.sendPacket(newPayload(), &headers{srcPort: srcPort, dstPort: stackPort})
+		got := -1
+		for i, ep := range eps {
+			if _, _, err := ep.Read(nil); err == nil {
+				if got != -1 {
+					t.Fatalf("both endpoints %d and %d received the packet from port %d", got, i, srcPort)
+				}
+				got = i
+			}
+		}
+		return got
+	}
+
+	wildcard := newEndpoint("", true)
+	if wildcard == nil {
+		t.Fatal("Bind to the wildcard address failed")
+	}
+	defer wildcard.Close()
+
+	// An endpoint bound to a specific address needs SO_REUSEADDR to share
+	// the port of the wildcard endpoint.
+	if ep := newEndpoint(stackAddr, false); ep != nil {
+		ep.Close()
+		t.Fatal("Bind to a specific address succeeded without SO_REUSEADDR")
+	}
+
+	connected := newEndpoint(stackAddr, true)
+	if connected == nil {
+		t.Fatal("Bind to a specific address failed")
+	}
+	defer connected.Close()
+	if err := connected.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	bound := newEndpoint(stackAddr, true)
+	if bound == nil {
+		t.Fatal("Bind to a specific address failed after the other endpoint connected")
+	}
+
+	if got := receiver(testPort, wildcard, bound, connected); got != 2 {
+		t.Errorf("got the packet of the connected flow delivered to endpoint %d, want the connected endpoint", got)
+	}
+	if got := receiver(testPort+1, wildcard, bound, connected); got != 1 {
+		t.Errorf("got the packet of another flow delivered to endpoint %d, want the endpoint bound to the address", got)
+	}
+	bound.Close()
+	if got := receiver(testPort+1, wildcard, connected); got != 0 {
+		t.Errorf("got the packet of another flow delivered to endpoint %d, want the wildcard endpoint", got)
+	}
+
+	// Closing the endpoints releases the port, including the reservation
+	// made when the connected endpoint was bound.
+	wildcard.Close()
+	connected.Close()
+	ep := newEndpoint("", false)
+	if ep == nil {
+		t.Fatal("Bind to the wildcard address failed after the endpoints were closed")
+	}
+	ep.Close()
+}
+
+func TestBindToGroupAddress(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// newEndpoint returns an endpoint with SO_REUSEADDR bound to addr.
+	newEndpoint := func(addr tcpip.Address) tcpip.Endpoint {
+		t.Helper()
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		if err := ep.SetSockOpt(tcpip.ReuseAddressOption(1)); err != nil {
+			t.Fatalf("SetSockOpt(ReuseAddressOption(1)) failed: %v", err)
+		}
+		if err := ep.Bind(tcpip.FullAddress{Addr: addr, Port: stackPort}); err != nil {
+			t.Fatalf("Bind(%s) failed: %v", addr, err)
+		}
+		return ep
+	}
+	// received sends a packet to dst and returns which of eps got it.
+	received := func(dst tcpip.Address, eps ...tcpip.Endpoint) []bool {
+		t.Helper()
+		c.sendPacketTo(newPayload(), &headers{srcPort: testPort, dstPort: stackPort}, dst)
+		got := make([]bool, len(eps))
+		for i, ep := range eps {
+			_, _, err := ep.Read(nil)
+			got[i] = err == nil
+		}
+		return got
+	}
+
+	group1 := newEndpoint(multicastAddr)
+	defer group1.Close()
+	if err := group1.SetSockOpt(tcpip.AddMembershipOption{InterfaceAddr: header.IPv4Any, MulticastAddr: multicastAddr}); err != nil {
+		t.Fatalf("SetSockOpt(AddMembershipOption) failed: %v", err)
+	}
+	group2 := newEndpoint(multicastAddr)
+	defer group2.Close()
+	broadcast := newEndpoint(header.IPv4Broadcast)
+	defer broadcast.Close()
+	unicast := newEndpoint(stackAddr)
+	defer unicast.Close()
+
+	for _, tc := range []struct {
+		dst  tcpip.Address
+		want []bool
+	}{
+		{multicastAddr, []bool{true, true, false, false}},
+		{header.IPv4Broadcast, []bool{false, false, true, false}},
+		{stackAddr, []bool{false, false, false, true}},
+	} {
+		if got := received(tc.dst, group1, group2, broadcast, unicast); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("got the datagram to %s received by %v, want %v", tc.dst, got, tc.want)
+		}
+	}
+
+	// Closed endpoints no longer share the group address.
+	group2.Close()
+	if got, want := received(multicastAddr, group1), []bool{true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got the datagram to %s received by %v after the other endpoint was closed, want %v", multicastAddr, got, want)
+	}
+
+	// Datagrams aren't sent from the group address.
+	if _, _, err := group1.Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: testAddr, Port: testPort}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.getPacket(ipv4.ProtocolNumber, false)
+}
+
 func TestV4ReadOnV6(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
@@ -562,132 +829,800 @@ func TestV4ReadOnV4(t *testing.T) {
 	testV4Read(c)
 }
 
-func testV4Write(c *testContext) uint16 {
-	// Write to V4 mapped address.
-	payload := buffer.View(newPayload())
-	n, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{
-		To: &tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort},
-	})
+func TestDecapsulation(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
 	if err != nil {
-		c.t.Fatalf("Write failed: %v", err)
+		c.t.Fatalf("NewEndpoint failed: %v", err)
 	}
-	if n != uintptr(len(payload)) {
-		c.t.Fatalf("Bad number of bytes written: got %v, want %v", n, len(payload))
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
 	}
 
-	// Check that we received the packet.
-	b := c.getPacket(ipv4.ProtocolNumber, false)
-	udp := header.UDP(header.IPv4(b).Payload())
-	checker.IPv4(c.t, b,
-		checker.UDP(
-			checker.DstPort(testPort),
-		),
-	)
-
-	// Check the payload.
-	if !bytes.Equal(payload, udp.Payload()) {
-		c.t.Fatalf("Bad payload: got %x, want %x", udp.Payload(), payload)
+	// The handler consumes the datagrams whose payload starts with a zero
+	// byte.
+	var consumed [][]byte
+	handler := func(r *stack.Route, id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+		if got := header.UDP(pkt.TransportHeader).SourcePort(); got != testPort {
+			t.Errorf("got source port %d in transport header, want %d", got, testPort)
+		}
+		v := pkt.Data.ToView()
+		if v[0] != 0 {
+			return false
+		}
+		consumed = append(consumed, append([]byte(nil), v...))
+		return true
 	}
-
-	return udp.SourcePort()
-}
-
-func testV6Write(c *testContext) uint16 {
-	// Write to v6 address.
-	payload := buffer.View(newPayload())
-	n, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{
-		To: &tcpip.FullAddress{Addr: testV6Addr, Port: testPort},
-	})
-	if err != nil {
-		c.t.Fatalf("Write failed: %v", err)
+	if err := c.ep.SetSockOpt(udp.DecapsulationOption{Handler: handler}); err != nil {
+		c.t.Fatalf("SetSockOpt(DecapsulationOption) failed: %v", err)
 	}
-	if n != uintptr(len(payload)) {
-		c.t.Fatalf("Bad number of bytes written: got %v, want %v", n, len(payload))
+	var opt udp.DecapsulationOption
+	if err := c.ep.GetSockOpt(&opt); err != nil || opt.Handler == nil {
+		c.t.Fatalf("got GetSockOpt(DecapsulationOption) = (%v, %v), want the handler", opt.Handler == nil, err)
 	}
 
-	// Check that we received the packet.
-	b := c.getPacket(ipv6.ProtocolNumber, false)
-	udp := header.UDP(header.IPv6(b).Payload())
-	checker.IPv6(c.t, b,
-		checker.UDP(
-			checker.DstPort(testPort),
-		),
-	)
-
-	// Check the payload.
-	if !bytes.Equal(payload, udp.Payload()) {
-		c.t.Fatalf("Bad payload: got %x, want %x", udp.Payload(), payload)
+	encapsulated := []byte{0, 1, 2, 3}
+	c.sendPacket(encapsulated, &headers{srcPort: testPort, dstPort: stackPort})
+	if len(consumed) != 1 || !bytes.Equal(consumed[0], encapsulated) {
+		c.t.Fatalf("got consumed datagrams %x, want [%x]", consumed, encapsulated)
+	}
+	if got := c.s.Stats().UDP.PacketsDecapsulated.Value(); got != 1 {
+		c.t.Errorf("got PacketsDecapsulated = %d, want = 1", got)
+	}
+	if _, _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		c.t.Fatalf("got Read() of a consumed datagram = %v, want = %v", err, tcpip.ErrWouldBlock)
 	}
 
-	return udp.SourcePort()
-}
-
-func testDualWrite(c *testContext) uint16 {
-	v4Port := testV4Write(c)
-	v6Port := testV6Write(c)
-	if v4Port != v6Port {
-		c.t.Fatalf("expected v4 and v6 ports to be equal: got v4Port = %d, v6Port = %d", v4Port, v6Port)
+	// Datagrams the handler doesn't consume are delivered as usual.
+	plain := []byte{1, 2, 3}
+	c.sendPacket(plain, &headers{srcPort: testPort, dstPort: stackPort})
+	var from tcpip.FullAddress
+	if v, _, err := c.ep.Read(&from); err != nil || !bytes.Equal(v, plain) {
+		c.t.Fatalf("got Read() = (%x, %v), want = (%x, nil)", v, err, plain)
+	}
+	if want := (tcpip.FullAddress{NIC: 1, Addr: testAddr, Port: testPort}); from != want {
+		c.t.Errorf("got sender address %+v, want %+v", from, want)
 	}
 
-	return v4Port
+	// Without a handler, all datagrams are delivered.
+	if err := c.ep.SetSockOpt(udp.DecapsulationOption{}); err != nil {
+		c.t.Fatalf("SetSockOpt(DecapsulationOption{}) failed: %v", err)
+	}
+	c.sendPacket(encapsulated, &headers{srcPort: testPort, dstPort: stackPort})
+	if v, _, err := c.ep.Read(nil); err != nil || !bytes.Equal(v, encapsulated) {
+		c.t.Fatalf("got Read() = (%x, %v), want = (%x, nil)", v, err, encapsulated)
+	}
+	if len(consumed) != 1 {
+		c.t.Errorf("got %d consumed datagrams, want 1", len(consumed))
+	}
 }
 
-func TestDualWriteUnbound(t *testing.T) {
+func TestTransparentProxy(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	c.createV6Endpoint(false)
-
-	testDualWrite(c)
-}
-
-func TestDualWriteBoundToWildcard(t *testing.T) {
-	c := newDualTestContext(t, defaultMTU)
-	defer c.cleanup()
+	// proxiedAddr is the address of a server the proxy intercepts traffic
+	// to. It isn't an address of the stack.
+	const proxiedAddr = "\x0a\x00\x00\x63"
 
-	c.createV6Endpoint(false)
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
 
-	// Bind to wildcard.
-	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
-		c.t.Fatalf("Bind failed: %v", err)
+	bindAddr := tcpip.FullAddress{Addr: proxiedAddr, Port: stackPort}
+	if err := c.ep.Bind(bindAddr); err != tcpip.ErrBadLocalAddress {
+		c.t.Fatalf("got Bind(%v) = %v, want = %v", bindAddr, err, tcpip.ErrBadLocalAddress)
 	}
 
-	p := testDualWrite(c)
-	if p != stackPort {
-		c.t.Fatalf("Bad port: got %v, want %v", p, stackPort)
+	if err := c.s.SetPromiscuousMode(1, true); err != nil {
+		c.t.Fatalf("SetPromiscuousMode failed: %v", err)
+	}
+	if err := c.s.SetSpoofing(1, true); err != nil {
+		c.t.Fatalf("SetSpoofing failed: %v", err)
+	}
+	if flags := c.s.NICInfo()[1].Flags; !flags.Promiscuous || !flags.Spoofing {
+		c.t.Fatalf("got Flags = %+v, want Promiscuous and Spoofing", flags)
+	}
+	if err := c.ep.Bind(bindAddr); err != nil {
+		c.t.Fatalf("Bind(%v) failed: %v", bindAddr, err)
 	}
-}
 
-func TestDualWriteConnectedToV6(t *testing.T) {
-	c := newDualTestContext(t, defaultMTU)
-	defer c.cleanup()
+	// The endpoint receives the datagrams sent to the proxied address.
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventIn)
+	defer c.wq.EventUnregister(&we)
 
-	c.createV6Endpoint(false)
+	payload := newPayload()
+	c.sendPacketTo(payload, &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+	}, proxiedAddr)
 
-	// Connect to v6 address.
-	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
-		c.t.Fatalf("Bind failed: %v", err)
+	var addr tcpip.FullAddress
+	v, _, err := c.ep.Read(&addr)
+	if err == tcpip.ErrWouldBlock {
+		select {
+		case <-ch:
+			v, _, err = c.ep.Read(&addr)
+		case <-time.After(1 * time.Second):
+			c.t.Fatalf("timed out waiting for data")
+		}
+	}
+	if err != nil {
+		c.t.Fatalf("Read failed: %v", err)
+	}
+	if addr.Addr != testAddr {
+		c.t.Errorf("got sender address %v, want %v", addr.Addr, testAddr)
+	}
+	if !bytes.Equal(payload, v) {
+		c.t.Fatalf("bad payload: got %x, want %x", v, payload)
 	}
 
-	testV6Write(c)
-
-	// Write to V4 mapped address.
-	payload := buffer.View(newPayload())
-	_, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{
-		To: &tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort},
-	})
-	if err != tcpip.ErrNetworkUnreachable {
-		c.t.Fatalf("Write returned unexpected error: got %v, want %v", err, tcpip.ErrNetworkUnreachable)
+	// Replies are sent on behalf of the proxied address.
+	payload = newPayload()
+	if _, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{
+		To: &tcpip.FullAddress{Addr: testAddr, Port: testPort},
+	}); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+	var b []byte
+	select {
+	case p := <-c.linkEP.C:
+		b = append(append(b, p.Header...), p.Payload...)
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("Packet wasn't written out")
+	}
+	checker.IPv4(c.t, b,
+		checker.SrcAddr(proxiedAddr),
+		checker.DstAddr(testAddr),
+		checker.UDP(
+			checker.SrcPort(stackPort),
+			checker.DstPort(testPort),
+		),
+	)
+	if got := header.UDP(header.IPv4(b).Payload()).Payload(); !bytes.Equal(payload, got) {
+		c.t.Fatalf("bad payload: got %x, want %x", got, payload)
 	}
 }
 
-func TestDualWriteConnectedToV4Mapped(t *testing.T) {
+func TestNATRedirect(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	c.createV6Endpoint(false)
+	// Datagrams sent to port 53 of proxiedAddr are redirected to the
+	// endpoint.
+	const (
+		proxiedAddr = "\x0a\x00\x00\x63"
+		proxiedPort = 53
+	)
+	subnet, err := tcpip.NewSubnet(proxiedAddr, "\xff\xff\xff\xff")
+	if err != nil {
+		c.t.Fatalf("NewSubnet failed: %v", err)
+	}
+	if err := c.s.SetNATRules([]stack.NATRule{{
+		Protocol:        udp.ProtocolNumber,
+		Destination:     subnet,
+		DestinationPort: proxiedPort,
+		ToPort:          stackPort,
+	}}); err != nil {
+		c.t.Fatalf("SetNATRules failed: %v", err)
+	}
 
-	// Connect to v4 mapped address.
+	c.createV6Endpoint(false)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %v", err)
+	}
+	var orig tcpip.OriginalDestinationOption
+	if err := c.ep.GetSockOpt(&orig); err != tcpip.ErrNoSuchFile {
+		c.t.Fatalf("got GetSockOpt(OriginalDestinationOption) before redirection = %v, want %s", err, tcpip.ErrNoSuchFile)
+	}
+
+	payload := newPayload()
+	c.sendPacketTo(payload, &headers{
+		srcPort: testPort,
+		dstPort: proxiedPort,
+	}, proxiedAddr)
+	v, _, terr := c.ep.Read(nil)
+	if terr != nil {
+		c.t.Fatalf("Read failed: %v", terr)
+	}
+	if !bytes.Equal(payload, v) {
+		c.t.Fatalf("bad payload: got %x, want %x", v, payload)
+	}
+	if err := c.ep.GetSockOpt(&orig); err != nil {
+		c.t.Fatalf("GetSockOpt(OriginalDestinationOption) failed: %v", err)
+	}
+	if want := (tcpip.OriginalDestinationOption{Addr: proxiedAddr, Port: proxiedPort}); orig != want {
+		c.t.Errorf("got OriginalDestinationOption = %+v, want %+v", orig, want)
+	}
+
+	// Replies are sent from the original destination.
+	payload = newPayload()
+	if _, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{}); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+	var b []byte
+	select {
+	case p := <-c.linkEP.C:
+		b = append(append(b, p.Header...), p.Payload...)
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("Packet wasn't written out")
+	}
+	checker.IPv4(c.t, b,
+		checker.SrcAddr(proxiedAddr),
+		checker.DstAddr(testAddr),
+		checker.UDP(
+			checker.SrcPort(proxiedPort),
+			checker.DstPort(testPort),
+		),
+	)
+	ip := header.IPv4(b)
+	u := header.UDP(ip.Payload())
+	xsum := header.PseudoHeaderChecksum(udp.ProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(u)))
+	if got := u.CalculateChecksum(header.Checksum(u.Payload(), xsum)); got != 0xffff {
+		c.t.Errorf("bad UDP checksum: got %#x, want 0xffff", got)
+	}
+}
+
+func TestTransparentMode(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// proxiedAddr is the address of a server the proxy intercepts traffic
+	// to. It isn't an address of the stack.
+	const proxiedAddr = "\x0a\x00\x00\x63"
+
+	if err := c.s.SetTransparent(1, true); err != nil {
+		c.t.Fatalf("SetTransparent failed: %v", err)
+	}
+	if flags := c.s.NICInfo()[1].Flags; !flags.Transparent {
+		c.t.Fatalf("got Flags = %+v, want Transparent", flags)
+	}
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.ReceiveOriginalDstAddressOption(true)); err != nil {
+		c.t.Fatalf("SetSockOpt(ReceiveOriginalDstAddressOption) failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	// The datagrams sent to the proxied address are only received by
+	// transparent endpoints.
+	c.sendPacketTo(newPayload(), &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+	}, proxiedAddr)
+	if _, _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		c.t.Fatalf("got Read = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+
+	if err := c.ep.SetSockOpt(tcpip.TransparentOption(true)); err != nil {
+		c.t.Fatalf("SetSockOpt(TransparentOption) failed: %v", err)
+	}
+	payload := newPayload()
+	c.sendPacketTo(payload, &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+	}, proxiedAddr)
+
+	var addr tcpip.FullAddress
+	v, cm, err := c.ep.Read(&addr)
+	if err != nil {
+		c.t.Fatalf("Read failed: %v", err)
+	}
+	if addr.Addr != testAddr || addr.Port != testPort {
+		c.t.Errorf("got sender address %+v, want %v:%d", addr, testAddr, testPort)
+	}
+	if !bytes.Equal(payload, v) {
+		c.t.Fatalf("bad payload: got %x, want %x", v, payload)
+	}
+	want := tcpip.FullAddress{NIC: 1, Addr: proxiedAddr, Port: stackPort}
+	if !cm.HasOriginalDstAddress || cm.OriginalDstAddress != want {
+		c.t.Errorf("got OriginalDstAddress = %+v (set: %t), want %+v", cm.OriginalDstAddress, cm.HasOriginalDstAddress, want)
+	}
+
+	// Transparent endpoints can reply on behalf of the proxied address.
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	bindAddr := tcpip.FullAddress{Addr: proxiedAddr, Port: stackPort + 1}
+	if err := ep.Bind(bindAddr); err != tcpip.ErrBadLocalAddress {
+		c.t.Fatalf("got Bind(%v) = %v, want = %v", bindAddr, err, tcpip.ErrBadLocalAddress)
+	}
+	if err := ep.SetSockOpt(tcpip.TransparentOption(true)); err != nil {
+		c.t.Fatalf("SetSockOpt(TransparentOption) failed: %v", err)
+	}
+	if err := ep.Bind(bindAddr); err != nil {
+		c.t.Fatalf("Bind(%v) failed: %v", bindAddr, err)
+	}
+	payload = newPayload()
+	if _, _, err := ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{
+		To: &tcpip.FullAddress{Addr: testAddr, Port: testPort},
+	}); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+	var b []byte
+	select {
+	case p := <-c.linkEP.C:
+		b = append(append(b, p.Header...), p.Payload...)
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("Packet wasn't written out")
+	}
+	checker.IPv4(c.t, b,
+		checker.SrcAddr(proxiedAddr),
+		checker.DstAddr(testAddr),
+		checker.UDP(
+			checker.SrcPort(stackPort+1),
+			checker.DstPort(testPort),
+		),
+	)
+}
+
+func TestLinkLocalZones(t *testing.T) {
+	const (
+		localLinkLocal  = "\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+		remoteLinkLocal = "\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02"
+	)
+
+	// Both NICs have the same link-local address, on different links.
+	s := stack.New([]string{ipv6.ProtocolName}, []string{udp.ProtocolName}, stack.Options{})
+	var linkEPs [3]*channel.Endpoint
+	for nic := tcpip.NICID(1); nic <= 2; nic++ {
+		id, linkEP := channel.New(256, defaultMTU, "")
+		if err := s.CreateNIC(nic, id); err != nil {
+			t.Fatalf("CreateNIC(%d) failed: %v", nic, err)
+		}
+		if err := s.AddAddress(nic, ipv6.ProtocolNumber, localLinkLocal); err != nil {
+			t.Fatalf("AddAddress(%d) failed: %v", nic, err)
+		}
+		linkEPs[nic] = linkEP
+	}
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv6.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	// Link-local addresses can't be used without a zone.
+	to := tcpip.FullAddress{Addr: remoteLinkLocal, Port: testPort}
+	if _, _, err := ep.Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{To: &to}); err != tcpip.ErrNoRoute {
+		t.Fatalf("got Write() without a zone = %v, want = %v", err, tcpip.ErrNoRoute)
+	}
+
+	// Sending honors the zone.
+	to.NIC = 2
+	if _, _, err := ep.Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{To: &to}); err != nil {
+		t.Fatalf("Write to zone 2 failed: %v", err)
+	}
+	select {
+	case <-linkEPs[1].C:
+		t.Fatalf("packet to zone 2 sent through NIC 1")
+	case p := <-linkEPs[2].C:
+		checker.IPv6(t, append(append(buffer.View(nil), p.Header...), p.Payload...),
+			checker.SrcAddr(localLinkLocal),
+			checker.DstAddr(remoteLinkLocal),
+		)
+	case <-time.After(time.Second):
+		t.Fatalf("packet to zone 2 not sent")
+	}
+
+	ep, err = s.NewEndpoint(udp.ProtocolNumber, ipv6.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: localLinkLocal, Port: stackPort}); err != tcpip.ErrBadLocalAddress {
+		t.Fatalf("got Bind() without a zone = %v, want = %v", err, tcpip.ErrBadLocalAddress)
+	}
+	bindAddr := tcpip.FullAddress{NIC: 2, Addr: localLinkLocal, Port: stackPort}
+	if err := ep.Bind(bindAddr); err != nil {
+		t.Fatalf("Bind(%+v) failed: %v", bindAddr, err)
+	}
+	if got, err := ep.GetLocalAddress(); err != nil || got != bindAddr {
+		t.Fatalf("got GetLocalAddress() = (%+v, %v), want = (%+v, nil)", got, err, bindAddr)
+	}
+
+	// Only the datagrams received through the zone the endpoint is bound
+	// to are delivered, and their sender address carries the zone.
+	for nic := tcpip.NICID(1); nic <= 2; nic++ {
+		payload := []byte{byte(nic)}
+		buf := buffer.NewView(header.IPv6MinimumSize + header.UDPMinimumSize + len(payload))
+		copy(buf[header.IPv6MinimumSize+header.UDPMinimumSize:], payload)
+		header.IPv6(buf).Encode(&header.IPv6Fields{
+			PayloadLength: uint16(header.UDPMinimumSize + len(payload)),
+			NextHeader:    uint8(udp.ProtocolNumber),
+			HopLimit:      255,
+			SrcAddr:       remoteLinkLocal,
+			DstAddr:       localLinkLocal,
+		})
+		u := header.UDP(buf[header.IPv6MinimumSize:])
+		u.Encode(&header.UDPFields{
+			SrcPort: testPort,
+			DstPort: stackPort,
+			Length:  uint16(header.UDPMinimumSize + len(payload)),
+		})
+		xsum := header.PseudoHeaderChecksum(udp.ProtocolNumber, remoteLinkLocal, localLinkLocal, uint16(len(u)))
+		u.SetChecksum(^u.CalculateChecksum(header.Checksum(payload, xsum)))
+		linkEPs[nic].Inject(ipv6.ProtocolNumber, buf.ToVectorisedView())
+	}
+
+	var from tcpip.FullAddress
+	v, _, err := ep.Read(&from)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if want := []byte{2}; !bytes.Equal(v, want) {
+		t.Errorf("got datagram %v, want %v", v, want)
+	}
+	if want := (tcpip.FullAddress{NIC: 2, Addr: remoteLinkLocal, Port: testPort}); from != want {
+		t.Errorf("got sender address %+v, want %+v", from, want)
+	}
+	if _, _, err := ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Errorf("got second Read() = %v, want = %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+func TestVRF(t *testing.T) {
+	// Both NICs have the same address, in different VRFs.
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName}, stack.Options{})
+	var cs [3]*testContext
+	for nic := tcpip.NICID(1); nic <= 2; nic++ {
+		id, linkEP := channel.New(256, defaultMTU, "")
+		if err := s.CreateNIC(nic, id); err != nil {
+			t.Fatalf("CreateNIC(%d) failed: %v", nic, err)
+		}
+		if err := s.AddAddress(nic, ipv4.ProtocolNumber, stackAddr); err != nil {
+			t.Fatalf("AddAddress(%d) failed: %v", nic, err)
+		}
+		if err := s.SetNICVRF(nic, tcpip.VRFID(nic)); err != nil {
+			t.Fatalf("SetNICVRF(%d) failed: %v", nic, err)
+		}
+		cs[nic] = &testContext{t: t, linkEP: linkEP, s: s}
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", NIC: 1},
+		{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", NIC: 2},
+	})
+
+	// Endpoints of different VRFs can be bound to the same address and
+	// port.
+	var eps [3]tcpip.Endpoint
+	var wq waiter.Queue
+	for vrf := 1; vrf <= 2; vrf++ {
+		ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		defer ep.Close()
+		if err := ep.SetSockOpt(tcpip.VRFOption(vrf)); err != nil {
+			t.Fatalf("SetSockOpt(VRFOption(%d)) failed: %v", vrf, err)
+		}
+		if err := ep.Bind(tcpip.FullAddress{Addr: stackAddr, Port: stackPort}); err != nil {
+			t.Fatalf("Bind in VRF %d failed: %v", vrf, err)
+		}
+		if err := ep.SetSockOpt(tcpip.VRFOption(0)); err != tcpip.ErrInvalidEndpointState {
+			t.Fatalf("got SetSockOpt(VRFOption(0)) after Bind = %v, want = %v", err, tcpip.ErrInvalidEndpointState)
+		}
+		eps[vrf] = ep
+	}
+
+	// Endpoints of the default VRF see neither NIC.
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: stackAddr, Port: stackPort}); err != tcpip.ErrBadLocalAddress {
+		t.Fatalf("got Bind() in the default VRF = %v, want = %v", err, tcpip.ErrBadLocalAddress)
+	}
+
+	// Datagrams are only delivered to the endpoint of the VRF of the NIC
+	// they're received through, and replies are sent through that NIC.
+	for nic := tcpip.NICID(1); nic <= 2; nic++ {
+		cs[nic].sendPacket([]byte{byte(nic)}, &headers{srcPort: testPort, dstPort: stackPort})
+	}
+	for vrf := 1; vrf <= 2; vrf++ {
+		var from tcpip.FullAddress
+		v, _, err := eps[vrf].Read(&from)
+		if err != nil {
+			t.Fatalf("Read in VRF %d failed: %v", vrf, err)
+		}
+		if want := []byte{byte(vrf)}; !bytes.Equal(v, want) {
+			t.Errorf("got datagram %v in VRF %d, want %v", v, vrf, want)
+		}
+		if _, _, err := eps[vrf].Read(nil); err != tcpip.ErrWouldBlock {
+			t.Errorf("got second Read() in VRF %d = %v, want = %v", vrf, err, tcpip.ErrWouldBlock)
+		}
+
+		if _, _, err := eps[vrf].Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{To: &from}); err != nil {
+			t.Fatalf("Write in VRF %d failed: %v", vrf, err)
+		}
+		select {
+		case <-cs[3-vrf].linkEP.C:
+			t.Fatalf("packet of VRF %d sent through NIC %d", vrf, 3-vrf)
+		case p := <-cs[vrf].linkEP.C:
+			checker.IPv4(t, append(append(buffer.View(nil), p.Header...), p.Payload...),
+				checker.SrcAddr(stackAddr),
+				checker.DstAddr(testAddr),
+			)
+		case <-time.After(time.Second):
+			t.Fatalf("packet of VRF %d not sent", vrf)
+		}
+	}
+}
+
+func TestSockets(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	payload := newPayload()
+	c.sendPacket(payload, &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+	})
+
+	infos := c.s.Sockets()
+	if len(infos) != 1 {
+		t.Fatalf("got %d sockets, want = 1: %+v", len(infos), infos)
+	}
+	info := infos[0]
+	if info.TransProto != udp.ProtocolNumber || info.State != "BOUND" || info.ID.LocalPort != stackPort {
+		t.Errorf("got socket = %+v, want a BOUND socket on port %d", info, stackPort)
+	}
+	if len(info.NetProtos) != 2 || info.NetProtos[0] != ipv4.ProtocolNumber || info.NetProtos[1] != ipv6.ProtocolNumber {
+		t.Errorf("got NetProtos = %v, want = [%d %d]", info.NetProtos, ipv4.ProtocolNumber, ipv6.ProtocolNumber)
+	}
+	if info.RecvQueue != len(payload) {
+		t.Errorf("got RecvQueue = %d, want = %d", info.RecvQueue, len(payload))
+	}
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+	if err := c.ep.SetSockOpt(tcpip.TTLOption(42)); err != nil {
+		t.Fatalf("SetSockOpt(TTLOption) failed: %v", err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.RecvErrOption(1)); err != nil {
+		t.Fatalf("SetSockOpt(RecvErrOption) failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	payload := newPayload()
+	c.sendPacket(payload, &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+	})
+	if _, _, err := c.ep.Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.linkEP.Inject(ipv4.ProtocolNumber, portUnreachable(c.getPacket(ipv4.ProtocolNumber, false)).ToVectorisedView())
+
+	cp, err := c.s.Checkpoint(c.ep)
+	if err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	var b bytes.Buffer
+	if err := cp.Encode(&b); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	cp, err = stack.DecodeCheckpoint(&b)
+	if err != nil {
+		t.Fatalf("DecodeCheckpoint failed: %v", err)
+	}
+
+	// A restore failing on the endpoint leaves the stack as it was.
+	f := stack.New([]string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{udp.ProtocolName}, stack.Options{})
+	var fwq waiter.Queue
+	blocker, tcpipErr := f.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &fwq)
+	if tcpipErr != nil {
+		t.Fatalf("NewEndpoint failed: %v", tcpipErr)
+	}
+	defer blocker.Close()
+	if err := blocker.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	fid, _ := channel.New(256, defaultMTU, "")
+	if _, err := f.Restore(cp, map[tcpip.NICID]tcpip.LinkEndpointID{1: fid}, []*waiter.Queue{&fwq}); err != tcpip.ErrPortInUse {
+		t.Fatalf("got Restore() with the port in use = %v, want %s", err, tcpip.ErrPortInUse)
+	}
+	if got := f.NICInfo(); len(got) != 0 {
+		t.Errorf("got NICInfo() = %+v after a failed Restore, want no NICs", got)
+	}
+	if got := f.GetRouteTable(); len(got) != 0 {
+		t.Errorf("got GetRouteTable() = %v after a failed Restore, want no routes", got)
+	}
+
+	r := &testContext{t: t, s: stack.New([]string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{udp.ProtocolName}, stack.Options{})}
+	var id tcpip.LinkEndpointID
+	id, r.linkEP = channel.New(256, defaultMTU, "")
+	eps, tcpipErr := r.s.Restore(cp, map[tcpip.NICID]tcpip.LinkEndpointID{1: id}, []*waiter.Queue{&r.wq})
+	if tcpipErr != nil {
+		t.Fatalf("Restore failed: %v", tcpipErr)
+	}
+	r.ep = eps[0]
+	defer r.cleanup()
+
+	if addr, err := r.ep.GetRemoteAddress(); err != nil || addr.Addr != testAddr || addr.Port != testPort {
+		t.Errorf("got GetRemoteAddress() = (%+v, %v), want %q:%d", addr, err, testAddr, testPort)
+	}
+	var ttl tcpip.TTLOption
+	if err := r.ep.GetSockOpt(&ttl); err != nil || ttl != 42 {
+		t.Errorf("got GetSockOpt(TTLOption) = (%d, %v), want (42, nil)", ttl, err)
+	}
+	if se, err := r.ep.(tcpip.ErrQueueReader).ReadErrQueue(); err != nil || se.Err != tcpip.ErrConnectionRefused {
+		t.Errorf("got ReadErrQueue() = (%+v, %v), want an entry with %s", se, err, tcpip.ErrConnectionRefused)
+	}
+	if v, _, err := r.ep.Read(nil); err != nil || !bytes.Equal(v, payload) {
+		t.Errorf("got Read() = (%x, %v), want %x", v, err, payload)
+	}
+
+	// The restored endpoint receives the datagrams sent to its port.
+	payload = newPayload()
+	r.sendPacket(payload, &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+	})
+	if v, _, err := r.ep.Read(nil); err != nil || !bytes.Equal(v, payload) {
+		t.Errorf("got Read() = (%x, %v) after Restore, want %x", v, err, payload)
+	}
+}
+
+func testV4Write(c *testContext) uint16 {
+	// Write to V4 mapped address.
+	payload := buffer.View(newPayload())
+	n, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{
+		To: &tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort},
+	})
+	if err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+	if n != uintptr(len(payload)) {
+		c.t.Fatalf("Bad number of bytes written: got %v, want %v", n, len(payload))
+	}
+
+	// Check that we received the packet.
+	b := c.getPacket(ipv4.ProtocolNumber, false)
+	udp := header.UDP(header.IPv4(b).Payload())
+	checker.IPv4(c.t, b,
+		checker.UDP(
+			checker.DstPort(testPort),
+		),
+	)
+
+	// Check the payload.
+	if !bytes.Equal(payload, udp.Payload()) {
+		c.t.Fatalf("Bad payload: got %x, want %x", udp.Payload(), payload)
+	}
+
+	return udp.SourcePort()
+}
+
+func testV6Write(c *testContext) uint16 {
+	// Write to v6 address.
+	payload := buffer.View(newPayload())
+	n, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{
+		To: &tcpip.FullAddress{Addr: testV6Addr, Port: testPort},
+	})
+	if err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+	if n != uintptr(len(payload)) {
+		c.t.Fatalf("Bad number of bytes written: got %v, want %v", n, len(payload))
+	}
+
+	// Check that we received the packet.
+	b := c.getPacket(ipv6.ProtocolNumber, false)
+	udp := header.UDP(header.IPv6(b).Payload())
+	checker.IPv6(c.t, b,
+		checker.UDP(
+			checker.DstPort(testPort),
+		),
+	)
+
+	// Check the payload.
+	if !bytes.Equal(payload, udp.Payload()) {
+		c.t.Fatalf("Bad payload: got %x, want %x", udp.Payload(), payload)
+	}
+
+	return udp.SourcePort()
+}
+
+func testDualWrite(c *testContext) uint16 {
+	v4Port := testV4Write(c)
+	v6Port := testV6Write(c)
+	if v4Port != v6Port {
+		c.t.Fatalf("expected v4 and v6 ports to be equal: got v4Port = %d, v6Port = %d", v4Port, v6Port)
+	}
+
+	return v4Port
+}
+
+func TestDualWriteUnbound(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+
+	testDualWrite(c)
+}
+
+func TestDualWriteBoundToWildcard(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+
+	// Bind to wildcard.
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	p := testDualWrite(c)
+	if p != stackPort {
+		c.t.Fatalf("Bad port: got %v, want %v", p, stackPort)
+	}
+}
+
+func TestDualWriteConnectedToV6(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+
+	// Connect to v6 address.
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	testV6Write(c)
+
+	// Write to V4 mapped address.
+	payload := buffer.View(newPayload())
+	_, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{
+		To: &tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort},
+	})
+	if err != tcpip.ErrNetworkUnreachable {
+		c.t.Fatalf("Write returned unexpected error: got %v, want %v", err, tcpip.ErrNetworkUnreachable)
+	}
+}
+
+func TestDualWriteConnectedToV4Mapped(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+
+	// Connect to v4 mapped address.
 	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort}); err != nil {
 		c.t.Fatalf("Bind failed: %v", err)
 	}
@@ -777,63 +1712,439 @@ func TestV6WriteOnConnected(t *testing.T) {
 	}
 }
 
-func TestV4WriteOnConnected(t *testing.T) {
+func TestV4WriteOnConnected(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+
+	// Connect to v4 mapped address.
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %v", err)
+	}
+
+	// Write without destination.
+	payload := buffer.View(newPayload())
+	n, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{})
+	if err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+	if n != uintptr(len(payload)) {
+		c.t.Fatalf("Bad number of bytes written: got %v, want %v", n, len(payload))
+	}
+
+	// Check that we received the packet.
+	b := c.getPacket(ipv4.ProtocolNumber, false)
+	udp := header.UDP(header.IPv4(b).Payload())
+	checker.IPv4(c.t, b,
+		checker.UDP(
+			checker.DstPort(testPort),
+		),
+	)
+
+	// Check the payload.
+	if !bytes.Equal(payload, udp.Payload()) {
+		c.t.Fatalf("Bad payload: got %x, want %x", udp.Payload(), payload)
+	}
+}
+
+func TestConnectedRouteChange(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	id2, linkEP2 := channel.New(256, defaultMTU, "")
+	if err := c.s.CreateNIC(2, id2); err != nil {
+		c.t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := c.s.AddAddress(2, ipv4.ProtocolNumber, stackAddr); err != nil {
+		c.t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	c.createV6Endpoint(false)
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %v", err)
+	}
+
+	// Route the peer through NIC 2 after the endpoint is connected.
+	c.s.SetRouteTable([]tcpip.Route{
+		{
+			Destination: "\x00\x00\x00\x00",
+			Mask:        "\x00\x00\x00\x00",
+			Gateway:     "",
+			NIC:         2,
+		},
+	})
+
+	payload := buffer.View(newPayload())
+	if _, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{}); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case p := <-linkEP2.C:
+		b := append(buffer.View(nil), p.Header...)
+		b = append(b, p.Payload...)
+		checker.IPv4(c.t, b,
+			checker.SrcAddr(stackAddr),
+			checker.DstAddr(testAddr),
+			checker.UDP(
+				checker.DstPort(testPort),
+			),
+		)
+	default:
+		c.t.Fatalf("Packet wasn't written to NIC 2")
+	}
+	if got := c.linkEP.Drain(); got != 0 {
+		c.t.Errorf("got %d packets written to NIC 1, want = 0", got)
+	}
+
+	// Without a route, writes fail instead of going out of NIC 2.
+	c.s.SetRouteTable(nil)
+	if _, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{}); err != tcpip.ErrNoRoute {
+		c.t.Errorf("got Write(...) = %v, want = %v", err, tcpip.ErrNoRoute)
+	}
+	if got := linkEP2.Drain(); got != 0 {
+		c.t.Errorf("got %d packets written to NIC 2, want = 0", got)
+	}
+}
+
+func TestV4WriteVectorised(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %v", err)
+	}
+
+	// Odd-sized slices, so that the checksum must carry bytes across them.
+	payload := newPayload()
+	n, _, err := c.ep.Write(tcpip.VectorPayload{payload[:3], nil, payload[3:10], payload[10:]}, tcpip.WriteOptions{})
+	if err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+	if n != uintptr(len(payload)) {
+		c.t.Fatalf("Bad number of bytes written: got %v, want %v", n, len(payload))
+	}
+
+	b := c.getPacket(ipv4.ProtocolNumber, false)
+	ip := header.IPv4(b)
+	h := header.UDP(ip.Payload())
+	if !bytes.Equal(payload, h.Payload()) {
+		c.t.Fatalf("Bad payload: got %x, want %x", h.Payload(), payload)
+	}
+	xsum := header.PseudoHeaderChecksum(udp.ProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(h)))
+	if got := header.Checksum(h, xsum); got != 0xffff {
+		c.t.Fatalf("Bad checksum: got sum 0x%x over the datagram, want 0xffff", got)
+	}
+}
+
+func TestV6WriteJumbogram(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		mtu     uint32
+		wantErr *tcpip.Error
+	}{
+		{"jumbo link", 100000, nil},
+		{"regular link", defaultMTU, tcpip.ErrMessageTooLong},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContext(t, test.mtu)
+			defer c.cleanup()
+
+			c.createV6Endpoint(true)
+
+			payload := make([]byte, 70000)
+			rand.Read(payload)
+			_, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{
+				To: &tcpip.FullAddress{Addr: testV6Addr, Port: testPort},
+			})
+			if err != test.wantErr {
+				t.Fatalf("got Write(...) = %v, want = %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			p := <-c.linkEP.C
+			b := append(append([]byte(nil), p.Header...), p.Payload...)
+			ip, perr := header.ParseIPv6(b, header.ParseStrict)
+			if perr != nil {
+				t.Fatalf("ParseIPv6 failed: %v", perr)
+			}
+			hbh := ip.HopByHopOptions()
+			if got, want := hbh.NextHeader(), uint8(udp.ProtocolNumber); got != want {
+				t.Fatalf("got next header = %d, want = %d", got, want)
+			}
+			h := header.UDP(ip.Payload()[hbh.Length():])
+			if got := h.Length(); got != 0 {
+				t.Errorf("got UDP length = %d, want = 0", got)
+			}
+			if !bytes.Equal(payload, h.Payload()) {
+				t.Errorf("Bad payload")
+			}
+			xsum := header.JumboPseudoHeaderChecksum(udp.ProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint32(len(h)))
+			if got := header.Checksum(h, xsum); got != 0xffff {
+				t.Errorf("Bad checksum: got sum 0x%x over the datagram, want 0xffff", got)
+			}
+		})
+	}
+}
+
+func TestReadIncrementsPacketsReceived(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// Create IPv4 UDP endpoint
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	// Bind to wildcard.
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	testV4Read(c)
+
+	var want uint64 = 1
+	if got := c.s.Stats().UDP.PacketsReceived.Value(); got != want {
+		c.t.Fatalf("Read did not increment PacketsReceived: got %v, want %v", got, want)
+	}
+}
+
+func TestTOS(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	const tos = 0xb8
+	const tclass = 0x20
+	if err := c.ep.SetSockOpt(tcpip.IPv4TOSOption(tos)); err != nil {
+		c.t.Fatalf("SetSockOpt(IPv4TOSOption) failed: %v", err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.IPv6TrafficClassOption(tclass)); err != nil {
+		c.t.Fatalf("SetSockOpt(IPv6TrafficClassOption) failed: %v", err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		addr    tcpip.Address
+		proto   tcpip.NetworkProtocolNumber
+		opts    tcpip.WriteOptions
+		wantTOS uint8
+	}{
+		{"v4", testV4MappedAddr, ipv4.ProtocolNumber, tcpip.WriteOptions{}, tos},
+		{"v6", testV6Addr, ipv6.ProtocolNumber, tcpip.WriteOptions{}, tclass},
+		{"v4 per write", testV4MappedAddr, ipv4.ProtocolNumber, tcpip.WriteOptions{HasTOS: true, TOS: 0}, 0},
+		{"v6 per write", testV6Addr, ipv6.ProtocolNumber, tcpip.WriteOptions{HasTOS: true, TOS: 0x48}, 0x48},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := test.opts
+			opts.To = &tcpip.FullAddress{Addr: test.addr, Port: testPort}
+			if _, _, err := c.ep.Write(tcpip.SlicePayload(newPayload()), opts); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			b := c.getPacket(test.proto, false)
+			if test.proto == ipv4.ProtocolNumber {
+				checker.IPv4(t, b, checker.TOS(test.wantTOS, 0))
+			} else {
+				checker.IPv6(t, b, checker.TOS(test.wantTOS, 0))
+			}
+		})
+	}
+
+	// The received TOS is only returned if requested.
+	c.sendPacket(newPayload(), &headers{srcPort: testPort, dstPort: stackPort, tos: 0x28})
+	if _, cm, err := c.ep.Read(nil); err != nil || cm.HasTOS {
+		c.t.Fatalf("got Read = %+v, %v, want no TOS", cm, err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.ReceiveTOSOption(true)); err != nil {
+		c.t.Fatalf("SetSockOpt(ReceiveTOSOption) failed: %v", err)
+	}
+	c.sendPacket(newPayload(), &headers{srcPort: testPort, dstPort: stackPort, tos: 0x28})
+	if _, cm, err := c.ep.Read(nil); err != nil || !cm.HasTOS || cm.TOS != 0x28 || cm.HasTClass {
+		c.t.Fatalf("got Read = %+v, %v, want TOS 0x28", cm, err)
+	}
+
+	c.sendV6Packet(newPayload(), &headers{srcPort: testPort, dstPort: stackPort, tos: 0x30})
+	if _, cm, err := c.ep.Read(nil); err != nil || cm.HasTClass || cm.HasTOS {
+		c.t.Fatalf("got Read = %+v, %v, want no TClass", cm, err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.ReceiveTClassOption(true)); err != nil {
+		c.t.Fatalf("SetSockOpt(ReceiveTClassOption) failed: %v", err)
+	}
+	c.sendV6Packet(newPayload(), &headers{srcPort: testPort, dstPort: stackPort, tos: 0x30})
+	if _, cm, err := c.ep.Read(nil); err != nil || !cm.HasTClass || cm.TClass != 0x30 || cm.HasTOS {
+		c.t.Fatalf("got Read = %+v, %v, want TClass 0x30", cm, err)
+	}
+}
+
+func TestFlowLabel(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	c.createV6Endpoint(false)
+	c.createV6Endpoint(true)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
 
-	// Connect to v4 mapped address.
-	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort}); err != nil {
-		c.t.Fatalf("Connect failed: %v", err)
+	writeLabel := func() uint32 {
+		if _, _, err := c.ep.Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{
+			To: &tcpip.FullAddress{Addr: testV6Addr, Port: testPort},
+		}); err != nil {
+			c.t.Fatalf("Write failed: %v", err)
+		}
+		_, l := header.IPv6(c.getPacket(ipv6.ProtocolNumber, false)).TOS()
+		return l
 	}
 
-	// Write without destination.
-	payload := buffer.View(newPayload())
-	n, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{})
-	if err != nil {
-		c.t.Fatalf("Write failed: %v", err)
+	if l := writeLabel(); l != 0 {
+		c.t.Errorf("got flow label %#x without automatic labels, want 0", l)
 	}
-	if n != uintptr(len(payload)) {
-		c.t.Fatalf("Bad number of bytes written: got %v, want %v", n, len(payload))
+
+	// Automatic labels are the same for all the packets of a flow.
+	c.s.SetAutoFlowLabels(true)
+	l := writeLabel()
+	if l == 0 {
+		c.t.Errorf("got flow label 0 with automatic labels")
+	}
+	if l2 := writeLabel(); l2 != l {
+		c.t.Errorf("got flow label %#x for the second packet of the flow, want %#x", l2, l)
 	}
 
-	// Check that we received the packet.
-	b := c.getPacket(ipv4.ProtocolNumber, false)
-	udp := header.UDP(header.IPv4(b).Payload())
-	checker.IPv4(c.t, b,
-		checker.UDP(
-			checker.DstPort(testPort),
-		),
-	)
+	// An explicit label overrides the automatic one.
+	if err := c.ep.SetSockOpt(tcpip.IPv6FlowLabelOption(header.IPv6FlowLabelMask + 1)); err != tcpip.ErrInvalidOptionValue {
+		c.t.Errorf("got SetSockOpt(IPv6FlowLabelOption) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	if err := c.ep.SetSockOpt(tcpip.IPv6FlowLabelOption(0x12345)); err != nil {
+		c.t.Fatalf("SetSockOpt(IPv6FlowLabelOption) failed: %v", err)
+	}
+	if l := writeLabel(); l != 0x12345 {
+		c.t.Errorf("got flow label %#x, want 0x12345", l)
+	}
 
-	// Check the payload.
-	if !bytes.Equal(payload, udp.Payload()) {
-		c.t.Fatalf("Bad payload: got %x, want %x", udp.Payload(), payload)
+	// The received label is returned if requested.
+	if err := c.ep.SetSockOpt(tcpip.ReceiveFlowLabelOption(true)); err != nil {
+		c.t.Fatalf("SetSockOpt(ReceiveFlowLabelOption) failed: %v", err)
+	}
+	c.sendV6Packet(newPayload(), &headers{srcPort: testPort, dstPort: stackPort, flowLabel: 0xabcde})
+	if _, cm, err := c.ep.Read(nil); err != nil || !cm.HasFlowLabel || cm.FlowLabel != 0xabcde {
+		c.t.Fatalf("got Read = %+v, %v, want flow label 0xabcde", cm, err)
 	}
 }
 
-func TestReadIncrementsPacketsReceived(t *testing.T) {
+func TestMinTTL(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	// Create IPv4 UDP endpoint
 	var err *tcpip.Error
 	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
 	if err != nil {
 		c.t.Fatalf("NewEndpoint failed: %v", err)
 	}
-
-	// Bind to wildcard.
 	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
 		c.t.Fatalf("Bind failed: %v", err)
 	}
 
+	// sendPacket sends packets with a TTL of 65.
+	if err := c.ep.SetSockOpt(tcpip.MinTTLOption(66)); err != nil {
+		c.t.Fatalf("SetSockOpt(MinTTLOption(66)) failed: %v", err)
+	}
+	var v tcpip.MinTTLOption
+	if err := c.ep.GetSockOpt(&v); err != nil || v != 66 {
+		c.t.Fatalf("GetSockOpt(MinTTLOption) = %v, %v, want 66, nil", v, err)
+	}
+	c.sendPacket(newPayload(), &headers{
+		srcPort: testPort,
+		dstPort: stackPort,
+	})
+	if _, _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		c.t.Fatalf("got Read error %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+	if got := c.s.Stats().UDP.PacketsReceived.Value(); got != 0 {
+		c.t.Fatalf("got PacketsReceived = %v, want 0", got)
+	}
+
+	if err := c.ep.SetSockOpt(tcpip.MinTTLOption(65)); err != nil {
+		c.t.Fatalf("SetSockOpt(MinTTLOption(65)) failed: %v", err)
+	}
 	testV4Read(c)
+}
 
-	var want uint64 = 1
-	if got := c.s.Stats().UDP.PacketsReceived.Value(); got != want {
-		c.t.Fatalf("Read did not increment PacketsReceived: got %v, want %v", got, want)
+func TestBufferSizes(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	if err := c.s.SetTransportProtocolOption(udp.ProtocolNumber, udp.ReceiveBufferSizeOption{Min: 1000, Default: 2000, Max: 3000}); err != nil {
+		c.t.Fatalf("SetTransportProtocolOption(ReceiveBufferSizeOption) failed: %v", err)
+	}
+	if err := c.s.SetTransportProtocolOption(udp.ProtocolNumber, udp.SendBufferSizeOption{Min: 1000, Default: 2000, Max: 3000}); err != nil {
+		c.t.Fatalf("SetTransportProtocolOption(SendBufferSizeOption) failed: %v", err)
+	}
+	if err := c.s.SetTransportProtocolOption(udp.ProtocolNumber, udp.SendBufferSizeOption{Min: 1000, Default: 4000, Max: 3000}); err != tcpip.ErrInvalidOptionValue {
+		c.t.Errorf("got SetTransportProtocolOption(SendBufferSizeOption) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	var rcv tcpip.ReceiveBufferSizeOption
+	if err := c.ep.GetSockOpt(&rcv); err != nil || rcv != 2000 {
+		c.t.Errorf("got GetSockOpt(ReceiveBufferSizeOption) = %d, %v, want 2000, nil", rcv, err)
+	}
+	var snd tcpip.SendBufferSizeOption
+	if err := c.ep.GetSockOpt(&snd); err != nil || snd != 2000 {
+		c.t.Errorf("got GetSockOpt(SendBufferSizeOption) = %d, %v, want 2000, nil", snd, err)
+	}
+
+	// Sizes are clamped to the limits of the protocol.
+	for _, test := range []struct{ set, want int }{{500, 1000}, {2500, 2500}, {5000, 3000}} {
+		if err := c.ep.SetSockOpt(tcpip.SendBufferSizeOption(test.set)); err != nil {
+			c.t.Fatalf("SetSockOpt(SendBufferSizeOption(%d)) failed: %v", test.set, err)
+		}
+		if err := c.ep.GetSockOpt(&snd); err != nil || int(snd) != test.want {
+			c.t.Errorf("got GetSockOpt(SendBufferSizeOption) = %d, %v after setting %d, want %d, nil", snd, err, test.set, test.want)
+		}
+		if err := c.ep.SetSockOpt(tcpip.ReceiveBufferSizeOption(test.set)); err != nil {
+			c.t.Fatalf("SetSockOpt(ReceiveBufferSizeOption(%d)) failed: %v", test.set, err)
+		}
+		if err := c.ep.GetSockOpt(&rcv); err != nil || int(rcv) != test.want {
+			c.t.Errorf("got GetSockOpt(ReceiveBufferSizeOption) = %d, %v after setting %d, want %d, nil", rcv, err, test.set, test.want)
+		}
+	}
+
+	// Datagrams received once the receive buffer is full are dropped.
+	if err := c.ep.SetSockOpt(tcpip.ReceiveBufferSizeOption(1000)); err != nil {
+		c.t.Fatalf("SetSockOpt(ReceiveBufferSizeOption(1000)) failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+	payload := make([]byte, 1000)
+	for i := 0; i < 2; i++ {
+		c.sendPacket(payload, &headers{
+			srcPort: testPort,
+			dstPort: stackPort,
+		})
+	}
+	if got := c.s.Stats().UDP.ReceiveBufferErrors.Value(); got != 1 {
+		c.t.Errorf("got ReceiveBufferErrors = %d, want 1", got)
+	}
+	if _, _, err := c.ep.Read(nil); err != nil {
+		c.t.Fatalf("Read failed: %v", err)
+	}
+	if _, _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		c.t.Fatalf("got Read error %v, want %v", err, tcpip.ErrWouldBlock)
 	}
 }
 
@@ -962,14 +2273,14 @@ func TestTTL(t *testing.T) {
 								multicast = false
 								switch variant {
 								case "v4", "mapped":
-									ep, err := ipv4.NewProtocol().NewEndpoint(0, "", nil, nil, nil)
+									ep, err := ipv4.NewProtocol().NewEndpoint(0, "", nil, &tcpip.StdClock{}, nil, nil)
 									if err != nil {
 										t.Fatal(err)
 									}
 									wantTTL = ep.DefaultTTL()
 									ep.Close()
 								case "v6":
-									ep, err := ipv6.NewProtocol().NewEndpoint(0, "", nil, nil, nil)
+									ep, err := ipv6.NewProtocol().NewEndpoint(0, "", nil, &tcpip.StdClock{}, nil, nil)
 									if err != nil {
 										t.Fatal(err)
 									}
@@ -1009,3 +2320,359 @@ func TestTTL(t *testing.T) {
 		})
 	}
 }
+
+// portUnreachable returns an ICMP port unreachable message quoting the packet
+// in b, sent by the test peer.
+func portUnreachable(b []byte) buffer.View {
+	icmpSize := header.IPv4MinimumSize + header.ICMPv4DstUnreachableMinimumSize
+	buf := buffer.NewView(icmpSize + len(b))
+	copy(buf[icmpSize:], b)
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(buf)),
+		TTL:         65,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     testAddr,
+		DstAddr:     stackAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	icmp := header.ICMPv4(buf[header.IPv4MinimumSize:])
+	icmp.SetType(header.ICMPv4DstUnreachable)
+	icmp.SetCode(header.ICMPv4PortUnreachable)
+	icmp.SetChecksum(^header.Checksum(icmp, 0))
+	return buf
+}
+
+func TestPendingError(t *testing.T) {
+	for _, connected := range []bool{false, true} {
+		c := newDualTestContext(t, defaultMTU)
+
+		var err *tcpip.Error
+		c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+		if err != nil {
+			c.t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		var to *tcpip.FullAddress
+		if connected {
+			if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+				c.t.Fatalf("Connect failed: %v", err)
+			}
+		} else {
+			to = &tcpip.FullAddress{Addr: testAddr, Port: testPort}
+		}
+		if _, _, err := c.ep.Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{To: to}); err != nil {
+			c.t.Fatalf("Write failed: %v", err)
+		}
+		c.linkEP.Inject(ipv4.ProtocolNumber, portUnreachable(c.getPacket(ipv4.ProtocolNumber, false)).ToVectorisedView())
+
+		// Like Linux, only connected endpoints report the error when
+		// their error queue isn't enabled.
+		var want *tcpip.Error
+		var wantReadiness waiter.EventMask
+		if connected {
+			want = tcpip.ErrConnectionRefused
+			wantReadiness = waiter.EventErr
+		}
+		if got := c.ep.Readiness(0); got != wantReadiness {
+			t.Errorf("connected = %t: got Readiness(0) = %v, want %v", connected, got, wantReadiness)
+		}
+		if err := c.ep.GetSockOpt(tcpip.ErrorOption{}); err != want {
+			t.Errorf("connected = %t: got GetSockOpt(ErrorOption{}) = %v, want %v", connected, err, want)
+		}
+		if err := c.ep.GetSockOpt(tcpip.ErrorOption{}); err != nil {
+			t.Errorf("connected = %t: got GetSockOpt(ErrorOption{}) = %v after retrieving the error, want nil", connected, err)
+		}
+		if got := c.ep.Readiness(0); got != 0 {
+			t.Errorf("connected = %t: got Readiness(0) = %v after retrieving the error, want 0", connected, got)
+		}
+		c.cleanup()
+	}
+}
+
+func TestErrQueuePortUnreachable(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.RecvErrOption(1)); err != nil {
+		c.t.Fatalf("SetSockOpt(RecvErrOption(1)) failed: %v", err)
+	}
+	eq := c.ep.(tcpip.ErrQueueReader)
+	if _, err := eq.ReadErrQueue(); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got ReadErrQueue() = %v on an empty queue, want %v", err, tcpip.ErrWouldBlock)
+	}
+
+	payload := buffer.View(newPayload())
+	if _, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{
+		To: &tcpip.FullAddress{Addr: testAddr, Port: testPort},
+	}); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+	b := c.getPacket(ipv4.ProtocolNumber, false)
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventErr)
+	defer c.wq.EventUnregister(&we)
+
+	c.linkEP.Inject(ipv4.ProtocolNumber, portUnreachable(b).ToVectorisedView())
+
+	select {
+	case <-ch:
+	default:
+		t.Fatalf("no EventErr notification for the queued error")
+	}
+	if got := c.ep.Readiness(0); got != waiter.EventErr {
+		t.Fatalf("got Readiness(0) = %v, want %v", got, waiter.EventErr)
+	}
+
+	se, err := eq.ReadErrQueue()
+	if err != nil {
+		t.Fatalf("ReadErrQueue failed: %v", err)
+	}
+	if se.Err != tcpip.ErrConnectionRefused || se.Origin != tcpip.SockErrOriginICMP {
+		t.Errorf("got error %v from origin %d, want %v from origin %d", se.Err, se.Origin, tcpip.ErrConnectionRefused, tcpip.SockErrOriginICMP)
+	}
+	if se.Type != uint8(header.ICMPv4DstUnreachable) || se.Code != header.ICMPv4PortUnreachable {
+		t.Errorf("got ICMP type %d, code %d, want %d, %d", se.Type, se.Code, header.ICMPv4DstUnreachable, header.ICMPv4PortUnreachable)
+	}
+	if want := (tcpip.FullAddress{Addr: testAddr, Port: testPort}); se.Dst != want {
+		t.Errorf("got Dst = %+v, want %+v", se.Dst, want)
+	}
+	if !bytes.Equal(se.Payload, payload) {
+		t.Errorf("got Payload = %x, want %x", se.Payload, payload)
+	}
+
+	if _, err := eq.ReadErrQueue(); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got ReadErrQueue() = %v after draining the queue, want %v", err, tcpip.ErrWouldBlock)
+	}
+	if got := c.ep.Readiness(0); got != 0 {
+		t.Fatalf("got Readiness(0) = %v after draining the queue, want 0", got)
+	}
+}
+
+func TestErrQueueControlMemory(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.RecvErrOption(1)); err != nil {
+		c.t.Fatalf("SetSockOpt(RecvErrOption(1)) failed: %v", err)
+	}
+	eq := c.ep.(tcpip.ErrQueueReader)
+
+	// queueErrors makes the endpoint queue n port unreachable errors.
+	queueErrors := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, _, err := c.ep.Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{
+				To: &tcpip.FullAddress{Addr: testAddr, Port: testPort},
+			}); err != nil {
+				c.t.Fatalf("Write failed: %v", err)
+			}
+			c.linkEP.Inject(ipv4.ProtocolNumber, portUnreachable(c.getPacket(ipv4.ProtocolNumber, false)).ToVectorisedView())
+		}
+	}
+	// drain returns the number of errors read from the error queue.
+	drain := func() int {
+		n := 0
+		for {
+			if _, err := eq.ReadErrQueue(); err == tcpip.ErrWouldBlock {
+				return n
+			} else if err != nil {
+				t.Fatalf("ReadErrQueue failed: %v", err)
+			}
+			n++
+		}
+	}
+
+	queueErrors(1)
+	se, err := eq.ReadErrQueue()
+	if err != nil {
+		t.Fatalf("ReadErrQueue failed: %v", err)
+	}
+
+	// Leave room for two errors only.
+	c.s.SetControlMemoryMax(2 * se.ControlSize())
+	queueErrors(3)
+	if got, want := drain(), 2; got != want {
+		t.Errorf("got %d queued errors, want %d", got, want)
+	}
+	if got, want := c.s.Stats().ControlMemoryErrors.Value(), uint64(1); got != want {
+		t.Errorf("got ControlMemoryErrors = %d, want %d", got, want)
+	}
+
+	// Reading the errors released their control memory.
+	queueErrors(2)
+	if got, want := drain(), 2; got != want {
+		t.Errorf("got %d queued errors after draining the queue, want %d", got, want)
+	}
+}
+
+func TestErrQueueTimeExceeded(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.RecvErrOption(1)); err != nil {
+		c.t.Fatalf("SetSockOpt(RecvErrOption(1)) failed: %v", err)
+	}
+	if err := c.ep.SetSockOpt(tcpip.TTLOption(10)); err != nil {
+		c.t.Fatalf("SetSockOpt(TTLOption(10)) failed: %v", err)
+	}
+
+	// The per-write TTL overrides TTLOption.
+	payload := buffer.View(newPayload())
+	if _, _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{
+		To:  &tcpip.FullAddress{Addr: testAddr, Port: testPort},
+		TTL: 2,
+	}); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+	b := c.getPacket(ipv4.ProtocolNumber, false)
+	checker.IPv4(c.t, b, checker.TTL(2))
+
+	// Reply with an ICMP time exceeded message from a router on the path,
+	// quoting the packet.
+	const routerAddr = tcpip.Address("\x0a\x00\x00\xfe")
+	icmpSize := header.IPv4MinimumSize + header.ICMPv4TimeExceededMinimumSize
+	buf := buffer.NewView(icmpSize + len(b))
+	copy(buf[icmpSize:], b)
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(buf)),
+		TTL:         65,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     routerAddr,
+		DstAddr:     stackAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	icmp := header.ICMPv4(buf[header.IPv4MinimumSize:])
+	icmp.SetType(header.ICMPv4TimeExceeded)
+	icmp.SetCode(header.ICMPv4TTLExceeded)
+	icmp.SetChecksum(^header.Checksum(icmp, 0))
+
+	c.linkEP.Inject(ipv4.ProtocolNumber, buf.ToVectorisedView())
+
+	se, err := c.ep.(tcpip.ErrQueueReader).ReadErrQueue()
+	if err != nil {
+		t.Fatalf("ReadErrQueue failed: %v", err)
+	}
+	if se.Err != tcpip.ErrHostUnreachable {
+		t.Errorf("got error %v, want %v", se.Err, tcpip.ErrHostUnreachable)
+	}
+	if se.Type != uint8(header.ICMPv4TimeExceeded) || se.Code != header.ICMPv4TTLExceeded {
+		t.Errorf("got ICMP type %d, code %d, want %d, %d", se.Type, se.Code, header.ICMPv4TimeExceeded, header.ICMPv4TTLExceeded)
+	}
+	if se.Offender != routerAddr {
+		t.Errorf("got Offender = %v, want %v", se.Offender, routerAddr)
+	}
+	if want := (tcpip.FullAddress{Addr: testAddr, Port: testPort}); se.Dst != want {
+		t.Errorf("got Dst = %+v, want %+v", se.Dst, want)
+	}
+	if want := b[:header.IPv4MinimumSize]; !bytes.Equal(se.NetworkHeader, want) {
+		t.Errorf("got NetworkHeader = %x, want %x", se.NetworkHeader, want)
+	}
+	if want := b[header.IPv4MinimumSize:][:header.UDPMinimumSize]; !bytes.Equal(se.TransportHeader, want) {
+		t.Errorf("got TransportHeader = %x, want %x", se.TransportHeader, want)
+	}
+	if !bytes.Equal(se.Payload, payload) {
+		t.Errorf("got Payload = %x, want %x", se.Payload, payload)
+	}
+}
+
+func TestTransmitTimestamps(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+
+	opt := tcpip.TimestampingTxSched | tcpip.TimestampingTxSoftware
+	if err := c.ep.SetSockOpt(opt); err != nil {
+		t.Fatalf("SetSockOpt(%d) failed: %v", opt, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		testV6Write(c)
+	}
+
+	// Timestamps are queued even though RecvErrOption isn't enabled.
+	eq := c.ep.(tcpip.ErrQueueReader)
+	want := []struct {
+		kind tcpip.TimestampKind
+		key  uint32
+	}{
+		{tcpip.TimestampSched, 0},
+		{tcpip.TimestampSend, 0},
+		{tcpip.TimestampSched, 1},
+		{tcpip.TimestampSend, 1},
+	}
+	for _, w := range want {
+		se, err := eq.ReadErrQueue()
+		if err != nil {
+			t.Fatalf("ReadErrQueue failed: %v", err)
+		}
+		if se.Origin != tcpip.SockErrOriginTimestamping || se.TimestampKind != w.kind || se.Key != w.key {
+			t.Fatalf("got entry of origin %d, kind %d, key %d, want origin %d, kind %d, key %d", se.Origin, se.TimestampKind, se.Key, tcpip.SockErrOriginTimestamping, w.kind, w.key)
+		}
+		if want := (tcpip.FullAddress{NIC: 1, Addr: testV6Addr, Port: testPort}); se.Dst != want {
+			t.Errorf("got Dst = %+v, want %+v", se.Dst, want)
+		}
+	}
+	if _, err := eq.ReadErrQueue(); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got ReadErrQueue() = %v after draining the queue, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+func TestLeakCheck(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	defer tcpip.SetLeakCheck(tcpip.LeakCheckEnabled())
+	tcpip.SetLeakCheck(true)
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %v", err)
+	}
+
+	live := func() map[string]int {
+		kinds := make(map[string]int)
+		for _, o := range tcpip.GetTrackedObjects() {
+			if strings.Contains(o.Stack, "TestLeakCheck") {
+				kinds[o.Kind]++
+			}
+		}
+		return kinds
+	}
+	if got := live(); got["udp endpoint"] != 1 || got["route"] != 1 {
+		c.t.Errorf("got live objects = %v, want one udp endpoint and one route", got)
+	}
+
+	c.ep.Close()
+	if got := live(); len(got) != 0 {
+		c.t.Errorf("got live objects = %v after Close, want none", got)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unix
+
+import (
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/waiter"
+)
+
+// connectionedEndpoint is one end of a connected pair of stream or seqpacket
+// endpoints. Each end reads from its own queue and sends to the queue of the
+// other.
+type connectionedEndpoint struct {
+	// The following fields are initialized at creation time and are
+	// immutable.
+	stype       SockType
+	waiterQueue *waiter.Queue
+
+	// rcv holds the data sent to the endpoint, and snd the data it sends,
+	// which is the rcv of its peer. They are immutable.
+	rcv *queue
+	snd *queue
+
+	// The following fields are protected by mu.
+	mu       sync.Mutex
+	passcred bool
+	closed   bool
+}
+
+// NewPair returns two endpoints of type stype connected to each other, as
+// socketpair(2) creates. The endpoints notify waiterQueue1 and waiterQueue2
+// respectively of their readiness.
+func NewPair(stype SockType, waiterQueue1, waiterQueue2 *waiter.Queue) (Endpoint, Endpoint, *tcpip.Error) {
+	switch stype {
+	case SockStream, SockSeqpacket:
+	case SockDgram:
+		a := NewConnectionless(waiterQueue1)
+		b := NewConnectionless(waiterQueue2)
+		a.Connect(b)
+		b.Connect(a)
+		return a, b, nil
+	default:
+		return nil, nil, tcpip.ErrNotSupported
+	}
+	q1 := newQueue(waiterQueue1, waiterQueue2)
+	q2 := newQueue(waiterQueue2, waiterQueue1)
+	a := &connectionedEndpoint{
+		stype:       stype,
+		waiterQueue: waiterQueue1,
+		rcv:         q1,
+		snd:         q2,
+	}
+	b := &connectionedEndpoint{
+		stype:       stype,
+		waiterQueue: waiterQueue2,
+		rcv:         q2,
+		snd:         q1,
+	}
+	return a, b, nil
+}
+
+// Type implements Endpoint.Type.
+func (e *connectionedEndpoint) Type() SockType {
+	return e.stype
+}
+
+// Readiness implements Endpoint.Readiness.
+func (e *connectionedEndpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
+	ready := waiter.EventMask(0)
+	if mask&waiter.EventIn != 0 && e.rcv.readable() {
+		ready |= waiter.EventIn
+	}
+	if mask&waiter.EventOut != 0 && e.snd.writable() {
+		ready |= waiter.EventOut
+	}
+	if mask&waiter.EventHUp != 0 && e.rcv.isClosed() && e.snd.isClosed() {
+		ready |= waiter.EventHUp
+	}
+	return ready
+}
+
+// Close implements Endpoint.Close.
+func (e *connectionedEndpoint) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	e.mu.Unlock()
+
+	e.rcv.close()
+	e.snd.close()
+	e.rcv.reset()
+}
+
+// RecvMsg implements Endpoint.RecvMsg.
+func (e *connectionedEndpoint) RecvMsg(data [][]byte, peek bool) (uintptr, uintptr, ControlMessages, *tcpip.Error) {
+	e.mu.Lock()
+	passcred := e.passcred
+	e.mu.Unlock()
+
+	var (
+		n, msgLen int
+		cm        ControlMessages
+		err       *tcpip.Error
+	)
+	if e.stype == SockStream {
+		n, cm, err = e.rcv.readStream(data, peek, passcred)
+		msgLen = n
+	} else {
+		n, msgLen, cm, _, err = e.rcv.readMessage(data, peek)
+		if !passcred {
+			cm.Credentials = nil
+		}
+	}
+	if err != nil {
+		return 0, 0, ControlMessages{}, err
+	}
+	return uintptr(n), uintptr(msgLen), cm, nil
+}
+
+// SendMsg implements Endpoint.SendMsg.
+func (e *connectionedEndpoint) SendMsg(data [][]byte, c ControlMessages) (uintptr, *tcpip.Error) {
+	v := gather(data)
+	if e.stype == SockStream && len(v) == 0 {
+		// Empty writes send nothing, not even control messages.
+		return 0, nil
+	}
+	n, err := e.snd.enqueue(&message{data: v, control: c}, e.stype == SockStream)
+	return uintptr(n), err
+}
+
+// Shutdown implements Endpoint.Shutdown.
+func (e *connectionedEndpoint) Shutdown(flags tcpip.ShutdownFlags) *tcpip.Error {
+	e.mu.Lock()
+	closed := e.closed
+	e.mu.Unlock()
+	if closed {
+		return tcpip.ErrNotConnected
+	}
+
+	if flags&tcpip.ShutdownRead != 0 {
+		e.rcv.close()
+	}
+	if flags&tcpip.ShutdownWrite != 0 {
+		e.snd.close()
+	}
+	return nil
+}
+
+// SetSockOpt implements Endpoint.SetSockOpt.
+func (e *connectionedEndpoint) SetSockOpt(opt interface{}) *tcpip.Error {
+	switch v := opt.(type) {
+	case tcpip.PasscredOption:
+		e.mu.Lock()
+		e.passcred = v != 0
+		e.mu.Unlock()
+		return nil
+
+	case tcpip.SendBufferSizeOption:
+		if v <= 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		e.snd.setMaxQueued(int(v))
+		return nil
+
+	case tcpip.ReceiveBufferSizeOption:
+		if v <= 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		e.rcv.setMaxQueued(int(v))
+		return nil
+	}
+	return tcpip.ErrUnknownProtocolOption
+}
+
+// GetSockOpt implements Endpoint.GetSockOpt.
+func (e *connectionedEndpoint) GetSockOpt(opt interface{}) *tcpip.Error {
+	switch o := opt.(type) {
+	case tcpip.ErrorOption:
+		return nil
+
+	case *tcpip.PasscredOption:
+		e.mu.Lock()
+		*o = 0
+		if e.passcred {
+			*o = 1
+		}
+		e.mu.Unlock()
+		return nil
+
+	case *tcpip.SendBufferSizeOption:
+		*o = tcpip.SendBufferSizeOption(e.snd.maxQueued())
+		return nil
+
+	case *tcpip.ReceiveBufferSizeOption:
+		*o = tcpip.ReceiveBufferSizeOption(e.rcv.maxQueued())
+		return nil
+
+	case *tcpip.SendQueueSizeOption:
+		*o = tcpip.SendQueueSizeOption(e.snd.queued())
+		return nil
+
+	case *tcpip.ReceiveQueueSizeOption:
+		*o = tcpip.ReceiveQueueSizeOption(e.rcv.queued())
+		return nil
+	}
+	return tcpip.ErrUnknownProtocolOption
+}
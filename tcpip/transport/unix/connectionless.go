@@ -0,0 +1,274 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unix
+
+import (
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/waiter"
+)
+
+// ConnectionlessEndpoint is a datagram endpoint. It receives the datagrams any
+// endpoint sends to it, and sends datagrams to the endpoint they are addressed
+// to, or to its peer once connected.
+type ConnectionlessEndpoint struct {
+	// waiterQueue is notified of the readiness of the endpoint. It is
+	// immutable.
+	waiterQueue *waiter.Queue
+
+	// writers is notified when rcv becomes writable again, so that the
+	// endpoints connected to this one can report it.
+	writers waiter.Queue
+
+	// rcv holds the datagrams sent to the endpoint. It is immutable.
+	rcv *queue
+
+	// The following fields are protected by mu.
+	mu   sync.Mutex
+	peer *ConnectionlessEndpoint
+
+	// peerEntry is registered with the writers of peer, if any, to notify
+	// waiterQueue that the endpoint is writable.
+	peerEntry waiter.Entry
+
+	passcred   bool
+	sendClosed bool
+	closed     bool
+}
+
+// writableCallback notifies a waiter queue that its endpoint is writable.
+type writableCallback struct {
+	waiterQueue *waiter.Queue
+}
+
+// Callback implements waiter.EntryCallback.Callback.
+func (c *writableCallback) Callback(*waiter.Entry) {
+	c.waiterQueue.Notify(waiter.EventOut)
+}
+
+// NewConnectionless returns a new unconnected datagram endpoint, which
+// notifies waiterQueue of its readiness.
+func NewConnectionless(waiterQueue *waiter.Queue) *ConnectionlessEndpoint {
+	e := &ConnectionlessEndpoint{
+		waiterQueue: waiterQueue,
+		peerEntry:   waiter.Entry{Callback: &writableCallback{waiterQueue}},
+	}
+	e.rcv = newQueue(waiterQueue, &e.writers)
+	return e
+}
+
+// Type implements Endpoint.Type.
+func (*ConnectionlessEndpoint) Type() SockType {
+	return SockDgram
+}
+
+// Readiness implements Endpoint.Readiness. An unconnected endpoint is always
+// writable, while a connected one is writable when its peer has room for more
+// datagrams.
+func (e *ConnectionlessEndpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
+	ready := waiter.EventMask(0)
+	if mask&waiter.EventIn != 0 && e.rcv.readable() {
+		ready |= waiter.EventIn
+	}
+	if mask&waiter.EventOut != 0 {
+		e.mu.Lock()
+		peer := e.peer
+		e.mu.Unlock()
+		if peer == nil || peer.rcv.writable() {
+			ready |= waiter.EventOut
+		}
+	}
+	return ready
+}
+
+// Connect sets the default destination of the datagrams the endpoint sends to
+// peer, and makes it report EventOut readiness based on the room left in the
+// queue of peer. It replaces any previous peer.
+func (e *ConnectionlessEndpoint) Connect(peer *ConnectionlessEndpoint) *tcpip.Error {
+	if peer.rcv.isClosed() {
+		return tcpip.ErrConnectionRefused
+	}
+
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return tcpip.ErrInvalidEndpointState
+	}
+	if e.peer != nil {
+		e.peer.writers.EventUnregister(&e.peerEntry)
+	}
+	e.peer = peer
+	peer.writers.EventRegister(&e.peerEntry, waiter.EventOut)
+	e.mu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventOut)
+	return nil
+}
+
+// Disconnect clears the peer of the endpoint, as connecting it to an AF_UNSPEC
+// address does.
+func (e *ConnectionlessEndpoint) Disconnect() {
+	e.mu.Lock()
+	wasConnected := e.disconnectLocked()
+	e.mu.Unlock()
+
+	if wasConnected {
+		e.waiterQueue.Notify(waiter.EventOut)
+	}
+}
+
+// disconnectLocked clears the peer of the endpoint, and returns whether it had
+// one. e.mu must be held.
+func (e *ConnectionlessEndpoint) disconnectLocked() bool {
+	if e.peer == nil {
+		return false
+	}
+	e.peer.writers.EventUnregister(&e.peerEntry)
+	e.peer = nil
+	return true
+}
+
+// Close implements Endpoint.Close.
+func (e *ConnectionlessEndpoint) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	e.disconnectLocked()
+	e.mu.Unlock()
+
+	e.rcv.close()
+	e.rcv.reset()
+}
+
+// RecvMsg implements Endpoint.RecvMsg.
+func (e *ConnectionlessEndpoint) RecvMsg(data [][]byte, peek bool) (uintptr, uintptr, ControlMessages, *tcpip.Error) {
+	recvLen, msgLen, cm, _, err := e.RecvMsgFrom(data, peek)
+	return recvLen, msgLen, cm, err
+}
+
+// RecvMsgFrom is RecvMsg, which also returns the endpoint which sent the
+// datagram.
+func (e *ConnectionlessEndpoint) RecvMsgFrom(data [][]byte, peek bool) (uintptr, uintptr, ControlMessages, *ConnectionlessEndpoint, *tcpip.Error) {
+	n, msgLen, cm, from, err := e.rcv.readMessage(data, peek)
+	if err != nil {
+		return 0, 0, ControlMessages{}, nil, err
+	}
+
+	e.mu.Lock()
+	passcred := e.passcred
+	e.mu.Unlock()
+	if !passcred {
+		cm.Credentials = nil
+	}
+	return uintptr(n), uintptr(msgLen), cm, from, nil
+}
+
+// SendMsg implements Endpoint.SendMsg. It sends a datagram to the peer of the
+// endpoint, and fails with tcpip.ErrDestinationRequired if it isn't
+// connected.
+func (e *ConnectionlessEndpoint) SendMsg(data [][]byte, c ControlMessages) (uintptr, *tcpip.Error) {
+	e.mu.Lock()
+	peer := e.peer
+	e.mu.Unlock()
+	if peer == nil {
+		return 0, tcpip.ErrDestinationRequired
+	}
+	return e.SendMsgTo(data, c, peer)
+}
+
+// SendMsgTo is SendMsg, which sends the datagram to the endpoint to instead of
+// the peer of the endpoint.
+func (e *ConnectionlessEndpoint) SendMsgTo(data [][]byte, c ControlMessages, to *ConnectionlessEndpoint) (uintptr, *tcpip.Error) {
+	e.mu.Lock()
+	sendClosed := e.sendClosed
+	e.mu.Unlock()
+	if sendClosed {
+		return 0, tcpip.ErrClosedForSend
+	}
+
+	n, err := to.rcv.enqueue(&message{data: gather(data), control: c, from: e}, false)
+	if err == tcpip.ErrClosedForSend {
+		// The error is about the destination, not the endpoint.
+		err = tcpip.ErrConnectionRefused
+	}
+	return uintptr(n), err
+}
+
+// Shutdown implements Endpoint.Shutdown.
+func (e *ConnectionlessEndpoint) Shutdown(flags tcpip.ShutdownFlags) *tcpip.Error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return tcpip.ErrNotConnected
+	}
+	if flags&tcpip.ShutdownWrite != 0 {
+		e.sendClosed = true
+	}
+	e.mu.Unlock()
+
+	if flags&tcpip.ShutdownRead != 0 {
+		e.rcv.close()
+	}
+	return nil
+}
+
+// SetSockOpt implements Endpoint.SetSockOpt.
+func (e *ConnectionlessEndpoint) SetSockOpt(opt interface{}) *tcpip.Error {
+	switch v := opt.(type) {
+	case tcpip.PasscredOption:
+		e.mu.Lock()
+		e.passcred = v != 0
+		e.mu.Unlock()
+		return nil
+
+	case tcpip.ReceiveBufferSizeOption:
+		if v <= 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		e.rcv.setMaxQueued(int(v))
+		return nil
+	}
+	return tcpip.ErrUnknownProtocolOption
+}
+
+// GetSockOpt implements Endpoint.GetSockOpt.
+func (e *ConnectionlessEndpoint) GetSockOpt(opt interface{}) *tcpip.Error {
+	switch o := opt.(type) {
+	case tcpip.ErrorOption:
+		return nil
+
+	case *tcpip.PasscredOption:
+		e.mu.Lock()
+		*o = 0
+		if e.passcred {
+			*o = 1
+		}
+		e.mu.Unlock()
+		return nil
+
+	case *tcpip.ReceiveBufferSizeOption:
+		*o = tcpip.ReceiveBufferSizeOption(e.rcv.maxQueued())
+		return nil
+
+	case *tcpip.ReceiveQueueSizeOption:
+		*o = tcpip.ReceiveQueueSizeOption(e.rcv.queued())
+		return nil
+	}
+	return tcpip.ErrUnknownProtocolOption
+}
@@ -0,0 +1,320 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unix
+
+import (
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/waiter"
+)
+
+// message is the data of a single send queued for an endpoint to read, with
+// the control messages sent along with it.
+type message struct {
+	messageEntry
+	data    []byte
+	control ControlMessages
+
+	// from is the endpoint which sent the message, if it is a datagram.
+	from *ConnectionlessEndpoint
+
+	// controlSize is the control memory charged for the message, the size
+	// of its control messages.
+	controlSize int
+
+	// credsBoundary is true if the credentials of the message differ from
+	// those of the message queued before it. Stream reads returning
+	// credentials don't coalesce data across such boundaries.
+	credsBoundary bool
+}
+
+// queue holds the messages sent to an endpoint until it reads them. Senders are
+// throttled by the number of bytes it holds, and the size of the control
+// messages sent along with them.
+type queue struct {
+	// readerQueue and writerQueue are notified when the queue becomes
+	// readable and writable respectively. They are immutable.
+	readerQueue *waiter.Queue
+	writerQueue *waiter.Queue
+
+	// The following fields are protected by mu.
+	mu          sync.Mutex
+	closed      bool
+	used        int
+	limit       int
+	controlUsed int
+	list        messageList
+}
+
+func newQueue(readerQueue, writerQueue *waiter.Queue) *queue {
+	return &queue{
+		readerQueue: readerQueue,
+		writerQueue: writerQueue,
+		limit:       DefaultBufferSize,
+	}
+}
+
+// close closes the queue for sending. The messages it holds can still be read,
+// after which reading returns tcpip.ErrClosedForReceive.
+func (q *queue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	q.readerQueue.Notify(waiter.EventIn | waiter.EventHUp)
+	q.writerQueue.Notify(waiter.EventOut | waiter.EventHUp)
+}
+
+// reset discards the messages held by the queue.
+func (q *queue) reset() {
+	q.mu.Lock()
+	for m := q.list.Front(); m != nil; m = m.Next() {
+		m.control.Release()
+	}
+	q.list.Reset()
+	q.used = 0
+	q.controlUsed = 0
+	q.mu.Unlock()
+
+	q.writerQueue.Notify(waiter.EventOut)
+}
+
+// isClosed returns true if the queue is closed for sending.
+func (q *queue) isClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// readable returns true if reading from the queue doesn't block.
+func (q *queue) readable() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed || !q.list.Empty()
+}
+
+// writable returns true if sending to the queue doesn't block.
+func (q *queue) writable() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed || q.used < q.limit
+}
+
+// queued returns the number of bytes held by the queue.
+func (q *queue) queued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.used
+}
+
+// maxQueued returns the limit of the number of bytes held by the queue.
+func (q *queue) maxQueued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limit
+}
+
+// setMaxQueued sets the limit of the number of bytes held by the queue.
+func (q *queue) setMaxQueued(limit int) {
+	q.mu.Lock()
+	wasWritable := q.used < q.limit
+	q.limit = limit
+	notify := !wasWritable && q.used < q.limit
+	q.mu.Unlock()
+
+	if notify {
+		q.writerQueue.Notify(waiter.EventOut)
+	}
+}
+
+// enqueue appends m to the queue and returns the number of bytes queued. If
+// truncate is true, the data of m is truncated to the room left in the queue;
+// otherwise m is only queued if all of it fits.
+func (q *queue) enqueue(m *message, truncate bool) (int, *tcpip.Error) {
+	if m.control.Rights != nil && m.control.Rights.Len() > MaxRights {
+		return 0, tcpip.ErrInvalidOptionValue
+	}
+	m.controlSize = m.control.size()
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return 0, tcpip.ErrClosedForSend
+	}
+	if q.controlUsed+m.controlSize > DefaultControlMemoryMax {
+		q.mu.Unlock()
+		return 0, tcpip.ErrNoBufferSpace
+	}
+	if !truncate && len(m.data) > q.limit {
+		q.mu.Unlock()
+		return 0, tcpip.ErrMessageTooLong
+	}
+	free := q.limit - q.used
+	if free <= 0 || (!truncate && len(m.data) > free) {
+		q.mu.Unlock()
+		return 0, tcpip.ErrWouldBlock
+	}
+	if len(m.data) > free {
+		m.data = m.data[:free]
+	}
+	notify := q.list.Empty()
+	if last := q.list.Back(); last == nil || !equalCredentials(last.control.Credentials, m.control.Credentials) {
+		m.credsBoundary = true
+	}
+	q.list.PushBack(m)
+	q.used += len(m.data)
+	q.controlUsed += m.controlSize
+	n := len(m.data)
+	q.mu.Unlock()
+
+	if notify {
+		q.readerQueue.Notify(waiter.EventIn)
+	}
+	return n, nil
+}
+
+// dequeueLocked removes n bytes of data from the front of the queue, or all of
+// the first message if n is negative. It returns whether the queue became
+// writable. q.mu must be held.
+func (q *queue) dequeueLocked(n int) bool {
+	wasWritable := q.used < q.limit
+	m := q.list.Front()
+	if n < 0 || n == len(m.data) {
+		n = len(m.data)
+		q.list.Remove(m)
+		q.controlUsed -= m.controlSize
+	} else {
+		m.data = m.data[n:]
+	}
+	q.used -= n
+	return !wasWritable && q.used < q.limit
+}
+
+// errLocked returns the error of a read from the queue when it is empty. q.mu
+// must be held.
+func (q *queue) errLocked() *tcpip.Error {
+	if q.closed {
+		return tcpip.ErrClosedForReceive
+	}
+	return tcpip.ErrWouldBlock
+}
+
+// readMessage reads the first message of the queue into dst. It returns the
+// number of bytes read, the length of the message, its control messages and
+// its sender. The message is removed from the queue unless peek is true, in
+// which case the control messages are a copy of those of the message.
+func (q *queue) readMessage(dst [][]byte, peek bool) (int, int, ControlMessages, *ConnectionlessEndpoint, *tcpip.Error) {
+	q.mu.Lock()
+	m := q.list.Front()
+	if m == nil {
+		err := q.errLocked()
+		q.mu.Unlock()
+		return 0, 0, ControlMessages{}, nil, err
+	}
+	n := scatter(dst, 0, m.data)
+	msgLen := len(m.data)
+	cm := m.control
+	from := m.from
+	notify := false
+	if peek {
+		cm = m.control.Clone()
+	} else {
+		notify = q.dequeueLocked(-1)
+	}
+	q.mu.Unlock()
+
+	if notify {
+		q.writerQueue.Notify(waiter.EventOut)
+	}
+	return n, msgLen, cm, from, nil
+}
+
+// readStream reads the data at the front of the queue into dst, coalescing the
+// data of consecutive messages, and returns the number of bytes read along
+// with the control messages sent with it. The data read is removed from the
+// queue unless peek is true, in which case the control messages are a copy.
+//
+// As on Linux, a read stops after the data of a message passing rights, so
+// that the rights of a single message are returned at a time. If creds is
+// true, the read returns the credentials of the first message read, and stops
+// before data sent with other credentials.
+func (q *queue) readStream(dst [][]byte, peek, creds bool) (int, ControlMessages, *tcpip.Error) {
+	q.mu.Lock()
+	m := q.list.Front()
+	if m == nil {
+		err := q.errLocked()
+		q.mu.Unlock()
+		return 0, ControlMessages{}, err
+	}
+
+	want := size(dst)
+	if want == 0 {
+		q.mu.Unlock()
+		return 0, ControlMessages{}, nil
+	}
+
+	var cm ControlMessages
+	if creds {
+		cm.Credentials = m.control.Credentials
+	}
+	copied := 0
+	notify := false
+	for m != nil && copied < want {
+		if copied > 0 && creds && m.credsBoundary {
+			break
+		}
+		next := m.Next()
+		if r := m.control.Rights; r != nil {
+			if peek {
+				cm.Rights = r.Clone()
+			} else {
+				// The rest of the message keeps its credentials,
+				// but the rights now belong to the reader.
+				cm.Rights = r
+				m.control.Rights = nil
+				q.controlUsed -= m.controlSize
+				m.controlSize = m.control.size()
+				q.controlUsed += m.controlSize
+			}
+			next = nil
+		}
+		n := scatter(dst, copied, m.data)
+		copied += n
+		if n < len(m.data) {
+			next = nil
+		}
+		if !peek {
+			if q.dequeueLocked(n) {
+				notify = true
+			}
+		}
+		m = next
+	}
+	q.mu.Unlock()
+
+	if notify {
+		q.writerQueue.Notify(waiter.EventOut)
+	}
+	return copied, cm, nil
+}
+
+// equalCredentials returns true if a and b hold the same credentials, or none.
+func equalCredentials(a, b CredentialsControlMessage) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equals(b)
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package unix contains the implementation of Unix domain socket endpoints.
+//
+// Unix endpoints aren't attached to a stack: they exchange messages through
+// in-memory queues. Naming endpoints, as binding them to paths does, is left
+// to the embedder.
+package unix
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/waiter"
+)
+
+// DefaultBufferSize is the default limit of the number of bytes queued for an
+// endpoint to read.
+const DefaultBufferSize = 208 * 1024
+
+// DefaultControlMemoryMax is the limit of the size of the control messages
+// queued for an endpoint to read, see ControlMessages. It is the default of
+// Linux's net.core.optmem_max.
+const DefaultControlMemoryMax = 20480
+
+// MaxRights is the maximum number of resources a single RightsControlMessage
+// may pass, as SCM_MAX_FD on Linux.
+const MaxRights = 253
+
+// Sizes of the control messages accounted against DefaultControlMemoryMax,
+// those of the corresponding cmsg(3) on Linux.
+const (
+	controlHeaderSize = 16
+	rightSize         = 4
+	credentialsSize   = 12
+)
+
+// SockType is the type of a Unix endpoint. Its values are those of the
+// corresponding SOCK_* constants of Linux.
+type SockType int
+
+const (
+	// SockStream is the type of connected endpoints exchanging a byte
+	// stream.
+	SockStream SockType = 1
+
+	// SockDgram is the type of connectionless endpoints exchanging
+	// datagrams.
+	SockDgram SockType = 2
+
+	// SockSeqpacket is the type of connected endpoints exchanging
+	// messages.
+	SockSeqpacket SockType = 5
+)
+
+// A RightsControlMessage is a control message passing resources, such as file
+// descriptors with SCM_RIGHTS.
+type RightsControlMessage interface {
+	// Len returns the number of resources passed by the message.
+	Len() int
+
+	// Clone returns a copy of the message, which holds its own references
+	// to the resources.
+	Clone() RightsControlMessage
+
+	// Release releases the references to the resources held by the
+	// message.
+	Release()
+}
+
+// A CredentialsControlMessage is a control message passing the credentials of
+// the sender, as with SCM_CREDENTIALS.
+type CredentialsControlMessage interface {
+	// Equals returns true if the two messages hold the same credentials.
+	Equals(CredentialsControlMessage) bool
+}
+
+// ControlMessages holds the control messages sent along with data.
+type ControlMessages struct {
+	Rights      RightsControlMessage
+	Credentials CredentialsControlMessage
+}
+
+// Empty returns true if c holds no control message.
+func (c *ControlMessages) Empty() bool {
+	return c.Rights == nil && c.Credentials == nil
+}
+
+// Clone returns a copy of c, which holds its own references to the resources
+// passed by c.
+func (c *ControlMessages) Clone() ControlMessages {
+	cm := ControlMessages{Credentials: c.Credentials}
+	if c.Rights != nil {
+		cm.Rights = c.Rights.Clone()
+	}
+	return cm
+}
+
+// size returns the control memory c takes while it's queued.
+func (c *ControlMessages) size() int {
+	n := 0
+	if c.Rights != nil {
+		n += controlHeaderSize + rightSize*c.Rights.Len()
+	}
+	if c.Credentials != nil {
+		n += controlHeaderSize + credentialsSize
+	}
+	return n
+}
+
+// Release releases the references held by c and empties it.
+func (c *ControlMessages) Release() {
+	if c.Rights != nil {
+		c.Rights.Release()
+	}
+	*c = ControlMessages{}
+}
+
+// Endpoint is a Unix domain socket endpoint. It is legal to have concurrent
+// goroutines make calls into it.
+type Endpoint interface {
+	// Readiness returns the current readiness of the endpoint. For
+	// example, if waiter.EventIn is set, the endpoint is immediately
+	// readable.
+	Readiness(mask waiter.EventMask) waiter.EventMask
+
+	// Close puts the endpoint in a closed state and frees all resources
+	// associated with it. The data it hasn't read is discarded.
+	Close()
+
+	// RecvMsg reads data into the buffers of data, and returns the control
+	// messages sent with it. Credentials are only returned if
+	// tcpip.PasscredOption is set.
+	//
+	// recvLen is the number of bytes read into data and msgLen the length
+	// of the message read, which is larger if the message was truncated.
+	// Stream endpoints don't truncate messages, but don't coalesce data
+	// across control message boundaries either. If peek is true, the data
+	// is left in the queue.
+	RecvMsg(data [][]byte, peek bool) (recvLen, msgLen uintptr, cm ControlMessages, err *tcpip.Error)
+
+	// SendMsg sends the data held in the buffers of data to the peer,
+	// along with the control messages c, which it takes ownership of on
+	// success. It fails with tcpip.ErrInvalidOptionValue if c passes more
+	// than MaxRights resources, and with tcpip.ErrNoBufferSpace if the
+	// control messages queued for the peer would exceed
+	// DefaultControlMemoryMax.
+	//
+	// Stream endpoints may only send the beginning of data, and return
+	// the number of bytes sent. Other endpoints send all of it or none.
+	SendMsg(data [][]byte, c ControlMessages) (uintptr, *tcpip.Error)
+
+	// Shutdown closes the read and/or write end of the endpoint.
+	Shutdown(flags tcpip.ShutdownFlags) *tcpip.Error
+
+	// Type returns the type of the endpoint.
+	Type() SockType
+
+	// SetSockOpt sets a socket option. opt should be one of the
+	// tcpip.*Option types.
+	SetSockOpt(opt interface{}) *tcpip.Error
+
+	// GetSockOpt gets a socket option. opt should be a pointer to one of
+	// the tcpip.*Option types.
+	GetSockOpt(opt interface{}) *tcpip.Error
+}
+
+// gather returns the concatenation of the buffers of data.
+func gather(data [][]byte) []byte {
+	v := make([]byte, 0, size(data))
+	for _, b := range data {
+		v = append(v, b...)
+	}
+	return v
+}
+
+// scatter copies src into the buffers of dst, skipping the first off bytes of
+// them, and returns the number of bytes copied.
+func scatter(dst [][]byte, off int, src []byte) int {
+	copied := 0
+	for _, b := range dst {
+		if off >= len(b) {
+			off -= len(b)
+			continue
+		}
+		n := copy(b[off:], src[copied:])
+		off = 0
+		copied += n
+		if copied == len(src) {
+			break
+		}
+	}
+	return copied
+}
+
+// size returns the total size of the buffers of data.
+func size(data [][]byte) int {
+	n := 0
+	for _, b := range data {
+		n += len(b)
+	}
+	return n
+}
@@ -0,0 +1,528 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unix
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/waiter"
+)
+
+// rights is a RightsControlMessage counting its references.
+type rights struct {
+	refs *int
+	n    int
+}
+
+func newRights() rights {
+	return rights{refs: new(int), n: 1}
+}
+
+func (r rights) Len() int {
+	return r.n
+}
+
+func (r rights) Clone() RightsControlMessage {
+	*r.refs++
+	return r
+}
+
+func (r rights) Release() {
+	*r.refs--
+}
+
+// creds is a CredentialsControlMessage holding a user ID.
+type creds int
+
+func (c creds) Equals(o CredentialsControlMessage) bool {
+	oc, ok := o.(creds)
+	return ok && oc == c
+}
+
+func newPair(t *testing.T, stype SockType) (Endpoint, Endpoint, *waiter.Queue, *waiter.Queue) {
+	t.Helper()
+	var wq1, wq2 waiter.Queue
+	a, b, err := NewPair(stype, &wq1, &wq2)
+	if err != nil {
+		t.Fatalf("NewPair(%d) failed: %v", stype, err)
+	}
+	return a, b, &wq1, &wq2
+}
+
+func send(t *testing.T, e Endpoint, data string, c ControlMessages) {
+	t.Helper()
+	n, err := e.SendMsg([][]byte{[]byte(data)}, c)
+	if err != nil {
+		t.Fatalf("SendMsg(%q) failed: %v", data, err)
+	}
+	if int(n) != len(data) {
+		t.Fatalf("got SendMsg(%q) = %d, want %d", data, n, len(data))
+	}
+}
+
+func recv(t *testing.T, e Endpoint, n int) (string, uintptr, ControlMessages) {
+	t.Helper()
+	b := make([]byte, n)
+	recvLen, msgLen, cm, err := e.RecvMsg([][]byte{b[:n/2], b[n/2:]}, false)
+	if err != nil {
+		t.Fatalf("RecvMsg failed: %v", err)
+	}
+	return string(b[:recvLen]), msgLen, cm
+}
+
+func TestNewPairDatagrams(t *testing.T) {
+	a, b, _, _ := newPair(t, SockDgram)
+	defer a.Close()
+	defer b.Close()
+
+	send(t, a, "ping", ControlMessages{})
+	send(t, b, "pong", ControlMessages{})
+	if got, _, _ := recv(t, b, 8); got != "ping" {
+		t.Errorf("got %q, want %q", got, "ping")
+	}
+	if got, _, _ := recv(t, a, 8); got != "pong" {
+		t.Errorf("got %q, want %q", got, "pong")
+	}
+}
+
+func TestNewPairRejectsUnknownTypes(t *testing.T) {
+	var wq1, wq2 waiter.Queue
+	if _, _, err := NewPair(SockType(3), &wq1, &wq2); err != tcpip.ErrNotSupported {
+		t.Fatalf("got NewPair(3) = %v, want %s", err, tcpip.ErrNotSupported)
+	}
+}
+
+func TestStream(t *testing.T) {
+	a, b, _, _ := newPair(t, SockStream)
+	defer a.Close()
+	defer b.Close()
+
+	if _, _, _, err := b.RecvMsg([][]byte{make([]byte, 10)}, false); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got RecvMsg on empty queue = %v, want %s", err, tcpip.ErrWouldBlock)
+	}
+
+	// Consecutive sends are coalesced, and partially read.
+	send(t, a, "hello ", ControlMessages{})
+	send(t, a, "world", ControlMessages{})
+	if got, _, _ := recv(t, b, 8); got != "hello wo" {
+		t.Errorf("got %q, want %q", got, "hello wo")
+	}
+	if got, _, _ := recv(t, b, 8); got != "rld" {
+		t.Errorf("got %q, want %q", got, "rld")
+	}
+
+	// Both ends can send.
+	send(t, b, "pong", ControlMessages{})
+	if got, _, _ := recv(t, a, 8); got != "pong" {
+		t.Errorf("got %q, want %q", got, "pong")
+	}
+}
+
+func TestSeqpacket(t *testing.T) {
+	a, b, _, _ := newPair(t, SockSeqpacket)
+	defer a.Close()
+	defer b.Close()
+
+	send(t, a, "hello", ControlMessages{})
+	send(t, a, "world", ControlMessages{})
+
+	// Messages aren't coalesced, and the rest of a truncated message is
+	// discarded.
+	got, msgLen, _ := recv(t, b, 2)
+	if got != "he" || msgLen != 5 {
+		t.Errorf("got (%q, %d), want (%q, 5)", got, msgLen, "he")
+	}
+	got, msgLen, _ = recv(t, b, 10)
+	if got != "world" || msgLen != 5 {
+		t.Errorf("got (%q, %d), want (%q, 5)", got, msgLen, "world")
+	}
+}
+
+func TestPeek(t *testing.T) {
+	a, b, _, _ := newPair(t, SockStream)
+	defer a.Close()
+	defer b.Close()
+
+	r := newRights()
+	send(t, a, "data", ControlMessages{Rights: r})
+	buf := make([]byte, 10)
+	n, _, cm, err := b.RecvMsg([][]byte{buf}, true)
+	if err != nil {
+		t.Fatalf("RecvMsg failed: %v", err)
+	}
+	if string(buf[:n]) != "data" || cm.Rights == nil {
+		t.Errorf("got peek (%q, %+v), want (%q, rights)", buf[:n], cm, "data")
+	}
+	cm.Release()
+
+	// The data and rights are still there.
+	got, _, cm := recv(t, b, 10)
+	if got != "data" || cm.Rights == nil {
+		t.Errorf("got (%q, %+v), want (%q, rights)", got, cm, "data")
+	}
+	cm.Release()
+	if *r.refs != -1 {
+		t.Errorf("got %d references after release, want -1", *r.refs)
+	}
+}
+
+func TestStreamRights(t *testing.T) {
+	a, b, _, _ := newPair(t, SockStream)
+	defer a.Close()
+	defer b.Close()
+
+	r := newRights()
+	send(t, a, "one", ControlMessages{})
+	send(t, a, "two", ControlMessages{Rights: r})
+	send(t, a, "three", ControlMessages{})
+
+	// A read stops after the data sent with rights.
+	got, _, cm := recv(t, b, 20)
+	if got != "onetwo" || cm.Rights != r {
+		t.Errorf("got (%q, %+v), want (%q, rights)", got, cm, "onetwo")
+	}
+	got, _, cm = recv(t, b, 20)
+	if got != "three" || cm.Rights != nil {
+		t.Errorf("got (%q, %+v), want (%q, no rights)", got, cm, "three")
+	}
+}
+
+func TestStreamCredentials(t *testing.T) {
+	for _, passcred := range []bool{false, true} {
+		a, b, _, _ := newPair(t, SockStream)
+		if passcred {
+			if err := b.SetSockOpt(tcpip.PasscredOption(1)); err != nil {
+				t.Fatalf("SetSockOpt(PasscredOption(1)) failed: %v", err)
+			}
+		}
+
+		send(t, a, "a", ControlMessages{Credentials: creds(1)})
+		send(t, a, "b", ControlMessages{Credentials: creds(1)})
+		send(t, a, "c", ControlMessages{Credentials: creds(2)})
+		send(t, a, "d", ControlMessages{})
+
+		// Data sent with different credentials is only coalesced if
+		// they aren't returned.
+		want := []struct {
+			data  string
+			creds CredentialsControlMessage
+		}{{"abcd", nil}}
+		if passcred {
+			want = []struct {
+				data  string
+				creds CredentialsControlMessage
+			}{{"ab", creds(1)}, {"c", creds(2)}, {"d", nil}}
+		}
+		for _, w := range want {
+			got, _, cm := recv(t, b, 20)
+			if got != w.data || cm.Credentials != w.creds {
+				t.Errorf("passcred %t: got (%q, %v), want (%q, %v)", passcred, got, cm.Credentials, w.data, w.creds)
+			}
+		}
+
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestPasscred(t *testing.T) {
+	a, b, _, _ := newPair(t, SockSeqpacket)
+	defer a.Close()
+	defer b.Close()
+
+	send(t, a, "x", ControlMessages{Credentials: creds(1)})
+	if _, _, cm := recv(t, b, 10); cm.Credentials != nil {
+		t.Errorf("got credentials %v without PasscredOption, want none", cm.Credentials)
+	}
+
+	if err := b.SetSockOpt(tcpip.PasscredOption(1)); err != nil {
+		t.Fatalf("SetSockOpt(PasscredOption(1)) failed: %v", err)
+	}
+	var v tcpip.PasscredOption
+	if err := b.GetSockOpt(&v); err != nil || v != 1 {
+		t.Fatalf("got GetSockOpt(PasscredOption) = (%d, %v), want (1, nil)", v, err)
+	}
+	send(t, a, "x", ControlMessages{Credentials: creds(1)})
+	if _, _, cm := recv(t, b, 10); cm.Credentials != creds(1) {
+		t.Errorf("got credentials %v, want %v", cm.Credentials, creds(1))
+	}
+}
+
+func TestBufferLimit(t *testing.T) {
+	for _, stype := range []SockType{SockStream, SockSeqpacket} {
+		a, b, wq1, _ := newPair(t, stype)
+
+		if err := a.SetSockOpt(tcpip.SendBufferSizeOption(10)); err != nil {
+			t.Fatalf("SetSockOpt(SendBufferSizeOption(10)) failed: %v", err)
+		}
+		send(t, a, "12345678", ControlMessages{})
+
+		// Streams send what fits, other endpoints all or nothing.
+		n, err := a.SendMsg([][]byte{[]byte("abcd")}, ControlMessages{})
+		if stype == SockStream {
+			if err != nil || n != 2 {
+				t.Errorf("got SendMsg = (%d, %v), want (2, nil)", n, err)
+			}
+			if got := a.Readiness(waiter.EventOut); got != 0 {
+				t.Errorf("got Readiness of full queue = %x, want 0", got)
+			}
+		} else if err != tcpip.ErrWouldBlock {
+			t.Errorf("got SendMsg = (%d, %v), want %s", n, err, tcpip.ErrWouldBlock)
+		}
+
+		var q tcpip.ReceiveQueueSizeOption
+		if err := b.GetSockOpt(&q); err != nil || int(q) != 8+int(n) {
+			t.Errorf("got ReceiveQueueSizeOption = (%d, %v), want (%d, nil)", q, err, 8+n)
+		}
+
+		// Reading makes the sender writable again.
+		e, ch := waiter.NewChannelEntry(nil)
+		wq1.EventRegister(&e, waiter.EventOut)
+		recv(t, b, 20)
+		if stype == SockStream {
+			select {
+			case <-ch:
+			default:
+				t.Errorf("sender not notified once writable")
+			}
+		}
+		wq1.EventUnregister(&e)
+		if got := a.Readiness(waiter.EventOut); got != waiter.EventOut {
+			t.Errorf("got Readiness after read = %x, want %x", got, waiter.EventOut)
+		}
+
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestMessageTooLong(t *testing.T) {
+	a, b, _, _ := newPair(t, SockSeqpacket)
+	defer a.Close()
+	defer b.Close()
+
+	if err := a.SetSockOpt(tcpip.SendBufferSizeOption(10)); err != nil {
+		t.Fatalf("SetSockOpt(SendBufferSizeOption(10)) failed: %v", err)
+	}
+	if _, err := a.SendMsg([][]byte{make([]byte, 11)}, ControlMessages{}); err != tcpip.ErrMessageTooLong {
+		t.Errorf("got SendMsg of 11 bytes = %v, want %s", err, tcpip.ErrMessageTooLong)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	a, b, wq1, _ := newPair(t, SockStream)
+	defer a.Close()
+	defer b.Close()
+
+	send(t, a, "last", ControlMessages{})
+	if err := a.Shutdown(tcpip.ShutdownWrite); err != nil {
+		t.Fatalf("Shutdown(ShutdownWrite) failed: %v", err)
+	}
+	if _, err := a.SendMsg([][]byte{[]byte("x")}, ControlMessages{}); err != tcpip.ErrClosedForSend {
+		t.Errorf("got SendMsg after shutdown = %v, want %s", err, tcpip.ErrClosedForSend)
+	}
+
+	// The peer reads the queued data, then end of file.
+	if got, _, _ := recv(t, b, 10); got != "last" {
+		t.Errorf("got %q, want %q", got, "last")
+	}
+	if _, _, _, err := b.RecvMsg([][]byte{make([]byte, 10)}, false); err != tcpip.ErrClosedForReceive {
+		t.Errorf("got RecvMsg after peer shutdown = %v, want %s", err, tcpip.ErrClosedForReceive)
+	}
+
+	// Closing the peer hangs the endpoint up.
+	e, ch := waiter.NewChannelEntry(nil)
+	wq1.EventRegister(&e, waiter.EventHUp)
+	defer wq1.EventUnregister(&e)
+	b.Close()
+	select {
+	case <-ch:
+	default:
+		t.Errorf("endpoint not notified of peer close")
+	}
+	if got := a.Readiness(waiter.EventHUp | waiter.EventIn); got != waiter.EventHUp|waiter.EventIn {
+		t.Errorf("got Readiness = %x, want %x", got, waiter.EventHUp|waiter.EventIn)
+	}
+}
+
+func TestCloseReleasesRights(t *testing.T) {
+	a, b, _, _ := newPair(t, SockSeqpacket)
+	defer a.Close()
+
+	r := newRights()
+	send(t, a, "x", ControlMessages{Rights: r.Clone()})
+	b.Close()
+	if *r.refs != 0 {
+		t.Errorf("got %d references after close, want 0", *r.refs)
+	}
+	if _, err := a.SendMsg([][]byte{[]byte("x")}, ControlMessages{}); err != tcpip.ErrClosedForSend {
+		t.Errorf("got SendMsg to closed peer = %v, want %s", err, tcpip.ErrClosedForSend)
+	}
+}
+
+func TestScatter(t *testing.T) {
+	dst := [][]byte{make([]byte, 2), make([]byte, 3), make([]byte, 4)}
+	if n := scatter(dst, 1, []byte("abcdef")); n != 6 {
+		t.Errorf("got scatter = %d, want 6", n)
+	}
+	if got, want := gather(dst), []byte("\x00abcdef\x00\x00"); !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestConnectionless(t *testing.T) {
+	var wq1, wq2, wq3 waiter.Queue
+	a := NewConnectionless(&wq1)
+	defer a.Close()
+	b := NewConnectionless(&wq2)
+	defer b.Close()
+	c := NewConnectionless(&wq3)
+	defer c.Close()
+
+	if _, err := a.SendMsg([][]byte{[]byte("x")}, ControlMessages{}); err != tcpip.ErrDestinationRequired {
+		t.Fatalf("got unconnected SendMsg = %v, want %s", err, tcpip.ErrDestinationRequired)
+	}
+
+	// Datagrams can be sent to any endpoint, which learns the sender.
+	for _, from := range []*ConnectionlessEndpoint{a, c} {
+		if _, err := from.SendMsgTo([][]byte{[]byte("hello")}, ControlMessages{}, b); err != nil {
+			t.Fatalf("SendMsgTo failed: %v", err)
+		}
+		buf := make([]byte, 3)
+		n, msgLen, _, got, err := b.RecvMsgFrom([][]byte{buf}, false)
+		if err != nil {
+			t.Fatalf("RecvMsgFrom failed: %v", err)
+		}
+		if string(buf[:n]) != "hel" || msgLen != 5 || got != from {
+			t.Errorf("got RecvMsgFrom = (%q, %d, %p), want (%q, 5, %p)", buf[:n], msgLen, got, "hel", from)
+		}
+	}
+
+	// Once connected, datagrams go to the peer by default.
+	if err := a.Connect(b); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	send(t, a, "ping", ControlMessages{})
+	if got, _, _ := recv(t, b, 8); got != "ping" {
+		t.Errorf("got %q, want %q", got, "ping")
+	}
+
+	a.Disconnect()
+	if _, err := a.SendMsg([][]byte{[]byte("x")}, ControlMessages{}); err != tcpip.ErrDestinationRequired {
+		t.Errorf("got SendMsg after Disconnect = %v, want %s", err, tcpip.ErrDestinationRequired)
+	}
+
+	// Sending to a closed endpoint is refused.
+	c.Close()
+	if _, err := a.SendMsgTo([][]byte{[]byte("x")}, ControlMessages{}, c); err != tcpip.ErrConnectionRefused {
+		t.Errorf("got SendMsgTo closed endpoint = %v, want %s", err, tcpip.ErrConnectionRefused)
+	}
+	if err := a.Connect(c); err != tcpip.ErrConnectionRefused {
+		t.Errorf("got Connect to closed endpoint = %v, want %s", err, tcpip.ErrConnectionRefused)
+	}
+}
+
+func TestConnectionlessWritability(t *testing.T) {
+	var wq1, wq2 waiter.Queue
+	a := NewConnectionless(&wq1)
+	defer a.Close()
+	b := NewConnectionless(&wq2)
+	defer b.Close()
+
+	if err := b.SetSockOpt(tcpip.ReceiveBufferSizeOption(10)); err != nil {
+		t.Fatalf("SetSockOpt(ReceiveBufferSizeOption(10)) failed: %v", err)
+	}
+	if err := a.Connect(b); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	send(t, a, "0123456789", ControlMessages{})
+
+	// A connected endpoint is writable when its peer has room.
+	if got := a.Readiness(waiter.EventOut); got != 0 {
+		t.Errorf("got Readiness with full peer = %x, want 0", got)
+	}
+	if _, err := a.SendMsg([][]byte{[]byte("x")}, ControlMessages{}); err != tcpip.ErrWouldBlock {
+		t.Errorf("got SendMsg to full peer = %v, want %s", err, tcpip.ErrWouldBlock)
+	}
+
+	e, ch := waiter.NewChannelEntry(nil)
+	wq1.EventRegister(&e, waiter.EventOut)
+	defer wq1.EventUnregister(&e)
+	recv(t, b, 20)
+	select {
+	case <-ch:
+	default:
+		t.Errorf("sender not notified once the peer is writable")
+	}
+	if got := a.Readiness(waiter.EventOut); got != waiter.EventOut {
+		t.Errorf("got Readiness after read = %x, want %x", got, waiter.EventOut)
+	}
+
+	// A disconnected endpoint is always writable, and no longer notified
+	// of the writability of its former peer.
+	send(t, a, "0123456789", ControlMessages{})
+	a.Disconnect()
+	if got := a.Readiness(waiter.EventOut); got != waiter.EventOut {
+		t.Errorf("got Readiness after Disconnect = %x, want %x", got, waiter.EventOut)
+	}
+	select {
+	case <-ch:
+	default:
+	}
+	recv(t, b, 20)
+	select {
+	case <-ch:
+		t.Errorf("disconnected sender notified of the writability of its former peer")
+	default:
+	}
+}
+
+func TestControlMemory(t *testing.T) {
+	a, b, _, _ := newPair(t, SockSeqpacket)
+	defer a.Close()
+	defer b.Close()
+
+	r := rights{refs: new(int), n: MaxRights + 1}
+	if _, err := a.SendMsg([][]byte{[]byte("x")}, ControlMessages{Rights: r}); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("got SendMsg with %d rights = %v, want %s", r.n, err, tcpip.ErrInvalidOptionValue)
+	}
+
+	// Control messages are queued until they use up the control memory of
+	// the peer, while data alone can still be sent.
+	r.n = MaxRights
+	sent := 0
+	for {
+		_, err := a.SendMsg([][]byte{[]byte("x")}, ControlMessages{Rights: r})
+		if err == tcpip.ErrNoBufferSpace {
+			break
+		}
+		if err != nil {
+			t.Fatalf("SendMsg failed: %v", err)
+		}
+		sent++
+	}
+	if want := DefaultControlMemoryMax / (controlHeaderSize + rightSize*MaxRights); sent != want {
+		t.Errorf("got %d messages with rights queued, want %d", sent, want)
+	}
+	send(t, a, "data", ControlMessages{})
+
+	// Reading frees control memory.
+	recv(t, b, 8)
+	if _, err := a.SendMsg([][]byte{[]byte("x")}, ControlMessages{Rights: r}); err != nil {
+		t.Errorf("SendMsg after read failed: %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package traceroute discovers the routers on the path to a destination by
+// sending probes with increasing TTLs over a stack and collecting the ICMP
+// Time Exceeded errors they trigger.
+package traceroute
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/icmp"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	defaultMaxHops = 30
+	defaultProbes  = 3
+	defaultTimeout = time.Second
+
+	// DefaultPort is the destination port of the first UDP probe, as used
+	// by the traditional traceroute.
+	DefaultPort = 33434
+
+	// echoHeaderSize is the size of the ICMP echo header: type, code,
+	// checksum, identifier and sequence number. It is the same for ICMPv4
+	// and ICMPv6.
+	echoHeaderSize = 8
+)
+
+// Config configures a trace.
+type Config struct {
+	// NIC is the NIC to send the probes from. If 0, it is chosen by the
+	// route table.
+	NIC tcpip.NICID
+
+	// MaxHops is the largest TTL probed. Zero means 30.
+	MaxHops int
+
+	// Probes is the number of probes sent per TTL. Zero means 3.
+	Probes int
+
+	// Timeout is how long to wait for the answer to each probe. Zero means
+	// 1 second.
+	Timeout time.Duration
+
+	// Port is the destination port of the first UDP probe; each probe uses
+	// the next port. Zero means DefaultPort. It is ignored by ICMP traces.
+	Port uint16
+
+	// ICMP selects ICMP echo requests as probes instead of UDP datagrams.
+	ICMP bool
+
+	// OnHop, if set, is called for each hop once all its probes are done.
+	OnHop func(Hop)
+}
+
+// Hop holds the answers to the probes sent with one TTL.
+type Hop struct {
+	TTL    int
+	Probes []Probe
+}
+
+// Probe is the answer to a single probe.
+type Probe struct {
+	// Addr is the address the answer came from, or empty if no answer
+	// arrived in time.
+	Addr tcpip.Address
+
+	// RTT is the time between sending the probe and receiving the answer.
+	RTT time.Duration
+}
+
+// answer is a response matched to a probe.
+type answer struct {
+	from    tcpip.Address
+	reached bool
+}
+
+// prober sends probes and matches the responses to them.
+type prober interface {
+	// send sends the probe with the given sequence number and TTL.
+	send(seq uint16, ttl uint8) error
+
+	// receive returns the answer to the probe with the given sequence
+	// number, if one is pending; responses to other probes are dropped.
+	receive(seq uint16) (answer, bool)
+}
+
+// Trace sends probes with TTLs from 1 up to cfg.MaxHops towards dst, an IPv4
+// or IPv6 address, and returns the answers for each TTL. It stops after the
+// first TTL for which dst itself answered: with a port unreachable error for
+// UDP probes, or an echo reply for ICMP ones. If ctx is done first, the hops
+// traced so far are returned along with ctx.Err().
+func Trace(ctx context.Context, s *stack.Stack, dst tcpip.Address, cfg Config) ([]Hop, error) {
+	if cfg.MaxHops <= 0 {
+		cfg.MaxHops = defaultMaxHops
+	}
+	if cfg.Probes <= 0 {
+		cfg.Probes = defaultProbes
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.Port == 0 {
+		cfg.Port = DefaultPort
+	}
+
+	var netProto tcpip.NetworkProtocolNumber
+	switch len(dst) {
+	case header.IPv4AddressSize:
+		netProto = ipv4.ProtocolNumber
+	case header.IPv6AddressSize:
+		netProto = ipv6.ProtocolNumber
+	default:
+		return nil, fmt.Errorf("traceroute: invalid address %q", dst)
+	}
+
+	var (
+		wq  waiter.Queue
+		ep  tcpip.Endpoint
+		p   prober
+		err error
+	)
+	if cfg.ICMP {
+		ep, p, err = newICMPProber(s, netProto, &wq, dst, cfg)
+	} else {
+		ep, p, err = newUDPProber(s, netProto, &wq, dst, cfg)
+	}
+	if ep != nil {
+		defer ep.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn|waiter.EventErr)
+	defer wq.EventUnregister(&we)
+
+	var (
+		hops []Hop
+		seq  uint16
+	)
+	for ttl := 1; ttl <= cfg.MaxHops; ttl++ {
+		hop := Hop{TTL: ttl}
+		reached := false
+		for i := 0; i < cfg.Probes; i++ {
+			start := time.Now()
+			if err := p.send(seq, uint8(ttl)); err != nil {
+				return hops, err
+			}
+			a, err := wait(ctx, p, seq, ch, cfg.Timeout)
+			if err != nil {
+				return hops, err
+			}
+			probe := Probe{Addr: a.from}
+			if a.from != "" {
+				probe.RTT = time.Since(start)
+			}
+			reached = reached || a.reached
+			hop.Probes = append(hop.Probes, probe)
+			seq++
+		}
+		hops = append(hops, hop)
+		if cfg.OnHop != nil {
+			cfg.OnHop(hop)
+		}
+		if reached {
+			break
+		}
+	}
+	return hops, nil
+}
+
+// wait waits up to timeout for the answer to probe seq. If none arrives, it
+// returns the zero answer.
+func wait(ctx context.Context, p prober, seq uint16, ch <-chan struct{}, timeout time.Duration) (answer, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		if a, ok := p.receive(seq); ok {
+			return a, nil
+		}
+		select {
+		case <-ch:
+		case <-timer.C:
+			return answer{}, nil
+		case <-ctx.Done():
+			return answer{}, ctx.Err()
+		}
+	}
+}
+
+// udpProber sends UDP datagrams to consecutive ports, so that the port quoted
+// in an error identifies the probe that triggered it.
+type udpProber struct {
+	ep   tcpip.Endpoint
+	eq   tcpip.ErrQueueReader
+	dst  tcpip.Address
+	nic  tcpip.NICID
+	port uint16
+}
+
+func newUDPProber(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, wq *waiter.Queue, dst tcpip.Address, cfg Config) (tcpip.Endpoint, prober, error) {
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, netProto, wq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("traceroute: NewEndpoint(): %s", err)
+	}
+	if err := ep.SetSockOpt(tcpip.RecvErrOption(1)); err != nil {
+		return ep, nil, fmt.Errorf("traceroute: SetSockOpt(RecvErrOption): %s", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{NIC: cfg.NIC}); err != nil {
+		return ep, nil, fmt.Errorf("traceroute: Bind(): %s", err)
+	}
+	return ep, &udpProber{
+		ep:   ep,
+		eq:   ep.(tcpip.ErrQueueReader),
+		dst:  dst,
+		nic:  cfg.NIC,
+		port: cfg.Port,
+	}, nil
+}
+
+func (u *udpProber) send(seq uint16, ttl uint8) error {
+	_, _, err := u.ep.Write(tcpip.SlicePayload(buffer.NewView(0)), tcpip.WriteOptions{
+		To:  &tcpip.FullAddress{NIC: u.nic, Addr: u.dst, Port: u.port + seq},
+		TTL: ttl,
+	})
+	if err != nil {
+		return fmt.Errorf("traceroute: Write(): %s", err)
+	}
+	return nil
+}
+
+func (u *udpProber) receive(seq uint16) (answer, bool) {
+	// Drain any datagram the destination might send back.
+	for {
+		if _, _, err := u.ep.Read(nil); err != nil {
+			break
+		}
+	}
+	for {
+		se, err := u.eq.ReadErrQueue()
+		if err != nil {
+			return answer{}, false
+		}
+		if se.Dst.Port != u.port+seq {
+			continue
+		}
+		switch se.Err {
+		case tcpip.ErrHostUnreachable:
+			return answer{from: se.Offender}, true
+		case tcpip.ErrConnectionRefused:
+			return answer{from: se.Offender, reached: true}, true
+		}
+	}
+}
+
+// icmpProber sends echo requests, matching the answers by sequence number.
+type icmpProber struct {
+	ep        tcpip.Endpoint
+	eq        tcpip.ErrQueueReader
+	echoType  byte
+	replyType byte
+}
+
+func newICMPProber(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, wq *waiter.Queue, dst tcpip.Address, cfg Config) (tcpip.Endpoint, prober, error) {
+	p := &icmpProber{
+		echoType:  byte(header.ICMPv4Echo),
+		replyType: byte(header.ICMPv4EchoReply),
+	}
+	transProto := icmp.ProtocolNumber4
+	if netProto == ipv6.ProtocolNumber {
+		transProto = icmp.ProtocolNumber6
+		p.echoType, p.replyType = byte(header.ICMPv6EchoRequest), byte(header.ICMPv6EchoReply)
+	}
+
+	ep, err := s.NewEndpoint(transProto, netProto, wq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("traceroute: NewEndpoint(): %s", err)
+	}
+	if err := ep.SetSockOpt(tcpip.RecvErrOption(1)); err != nil {
+		return ep, nil, fmt.Errorf("traceroute: SetSockOpt(RecvErrOption): %s", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{NIC: cfg.NIC}); err != nil {
+		return ep, nil, fmt.Errorf("traceroute: Bind(): %s", err)
+	}
+	if err := ep.Connect(tcpip.FullAddress{NIC: cfg.NIC, Addr: dst}); err != nil {
+		return ep, nil, fmt.Errorf("traceroute: Connect(): %s", err)
+	}
+	p.ep = ep
+	p.eq = ep.(tcpip.ErrQueueReader)
+	return ep, p, nil
+}
+
+func (i *icmpProber) send(seq uint16, ttl uint8) error {
+	v := buffer.NewView(echoHeaderSize)
+	v[0] = i.echoType
+	// The identifier is filled in by the endpoint.
+	binary.BigEndian.PutUint16(v[6:], seq)
+	if _, _, err := i.ep.Write(tcpip.SlicePayload(v), tcpip.WriteOptions{TTL: ttl}); err != nil {
+		return fmt.Errorf("traceroute: Write(): %s", err)
+	}
+	return nil
+}
+
+func (i *icmpProber) receive(seq uint16) (answer, bool) {
+	for {
+		var from tcpip.FullAddress
+		v, _, err := i.ep.Read(&from)
+		if err != nil {
+			break
+		}
+		if len(v) >= echoHeaderSize && v[0] == i.replyType && binary.BigEndian.Uint16(v[6:]) == seq {
+			return answer{from: from.Addr, reached: true}, true
+		}
+	}
+	for {
+		se, err := i.eq.ReadErrQueue()
+		if err != nil {
+			return answer{}, false
+		}
+		if se.Err != tcpip.ErrHostUnreachable || len(se.TransportHeader) < echoHeaderSize {
+			continue
+		}
+		if binary.BigEndian.Uint16(se.TransportHeader[6:]) == seq {
+			return answer{from: se.Offender}, true
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package traceroute
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/stack/stacktest"
+	"github.com/google/netstack/tcpip/transport/icmp"
+	"github.com/google/netstack/tcpip/transport/udp"
+)
+
+// distance is the number of hops to the simulated destinations.
+const distance = 3
+
+var (
+	stackAddr4 = tcpip.Address("\x0a\x00\x00\x01")
+	dstAddr4   = tcpip.Address("\x0a\x00\x02\x01")
+	stackAddr6 = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+	dstAddr6   = tcpip.Address("\x20\x01\x0d\xb8\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+)
+
+// routerAddr returns the address of the router ttl hops away on the path to
+// the simulated destination of the given family.
+func routerAddr(v6 bool, ttl uint8) tcpip.Address {
+	if v6 {
+		return tcpip.Address("\x20\x01\x0d\xb8\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00" + string(ttl))
+	}
+	return tcpip.Address("\x0a\x00\x01" + string(ttl))
+}
+
+// newStack returns a stack whose NIC is connected to a simulated network in
+// which dstAddr4 and dstAddr6 are distance hops away, and a function that
+// shuts the network down.
+func newStack(t *testing.T) (*stack.Stack, func()) {
+	id, linkEP := channel.New(256, 1500, "")
+	s := stacktest.New(t, []string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{udp.ProtocolName, icmp.ProtocolName4, icmp.ProtocolName6}, id)
+	stacktest.AddAddresses(t, s, stackAddr4, stackAddr6)
+	stacktest.SetDefaultRoutes(s)
+
+	done := make(chan struct{})
+	go simulate(linkEP, done)
+	return s, func() { close(done) }
+}
+
+// simulate answers the probes sent through linkEP until done is closed.
+func simulate(linkEP *channel.Endpoint, done <-chan struct{}) {
+	for {
+		select {
+		case p := <-linkEP.C:
+			pkt := append(append(buffer.View(nil), p.Header...), p.Payload...)
+			var resp buffer.View
+			switch p.Proto {
+			case ipv4.ProtocolNumber:
+				resp = answer4(pkt)
+			case ipv6.ProtocolNumber:
+				resp = answer6(pkt)
+			}
+			if resp != nil {
+				linkEP.Inject(p.Proto, resp.ToVectorisedView())
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// answer4 returns the response of the simulated network to the IPv4 packet
+// pkt, or nil if there is none.
+func answer4(pkt buffer.View) buffer.View {
+	ip := header.IPv4(pkt)
+	if len(pkt) < header.IPv4MinimumSize || ip.DestinationAddress() != dstAddr4 {
+		return nil
+	}
+	quote := pkt[:int(ip.HeaderLength())+8]
+
+	var from tcpip.Address
+	var msg header.ICMPv4
+	switch {
+	case ip.TTL() < distance:
+		from = routerAddr(false, ip.TTL())
+		msg = header.ICMPv4(append(buffer.NewView(header.ICMPv4TimeExceededMinimumSize), quote...))
+		msg.SetType(header.ICMPv4TimeExceeded)
+		msg.SetCode(header.ICMPv4TTLExceeded)
+	case ip.TransportProtocol() == udp.ProtocolNumber:
+		from = dstAddr4
+		msg = header.ICMPv4(append(buffer.NewView(header.ICMPv4DstUnreachableMinimumSize), quote...))
+		msg.SetType(header.ICMPv4DstUnreachable)
+		msg.SetCode(header.ICMPv4PortUnreachable)
+	case ip.TransportProtocol() == header.ICMPv4ProtocolNumber:
+		from = dstAddr4
+		msg = header.ICMPv4(append(buffer.View(nil), ip.Payload()...))
+		msg.SetType(header.ICMPv4EchoReply)
+		msg.SetChecksum(0)
+	default:
+		return nil
+	}
+	msg.SetChecksum(^header.Checksum(msg, 0))
+
+	resp := buffer.NewView(header.IPv4MinimumSize + len(msg))
+	copy(resp[header.IPv4MinimumSize:], msg)
+	rip := header.IPv4(resp)
+	rip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(resp)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     from,
+		DstAddr:     ip.SourceAddress(),
+	})
+	rip.SetChecksum(^rip.CalculateChecksum())
+	return resp
+}
+
+// answer6 returns the response of the simulated network to the IPv6 packet
+// pkt, or nil if there is none.
+func answer6(pkt buffer.View) buffer.View {
+	ip := header.IPv6(pkt)
+	if len(pkt) < header.IPv6MinimumSize || ip.DestinationAddress() != dstAddr6 {
+		return nil
+	}
+	quote := pkt[:header.IPv6MinimumSize+8]
+
+	var from tcpip.Address
+	var msg header.ICMPv6
+	switch {
+	case ip.HopLimit() < distance:
+		from = routerAddr(true, ip.HopLimit())
+		msg = header.ICMPv6(append(buffer.NewView(header.ICMPv6TimeExceededMinimumSize), quote...))
+		msg.SetType(header.ICMPv6TimeExceeded)
+		msg.SetCode(header.ICMPv6HopLimitExceeded)
+	case ip.TransportProtocol() == udp.ProtocolNumber:
+		from = dstAddr6
+		msg = header.ICMPv6(append(buffer.NewView(header.ICMPv6DstUnreachableMinimumSize), quote...))
+		msg.SetType(header.ICMPv6DstUnreachable)
+		msg.SetCode(header.ICMPv6PortUnreachable)
+	case ip.TransportProtocol() == header.ICMPv6ProtocolNumber:
+		from = dstAddr6
+		msg = header.ICMPv6(append(buffer.View(nil), ip.Payload()...))
+		msg.SetType(header.ICMPv6EchoReply)
+		msg.SetChecksum(0)
+	default:
+		return nil
+	}
+	xsum := header.PseudoHeaderChecksum(header.ICMPv6ProtocolNumber, from, ip.SourceAddress(), uint16(len(msg)))
+	msg.SetChecksum(^header.Checksum(msg, xsum))
+
+	resp := buffer.NewView(header.IPv6MinimumSize + len(msg))
+	copy(resp[header.IPv6MinimumSize:], msg)
+	header.IPv6(resp).Encode(&header.IPv6Fields{
+		PayloadLength: uint16(len(msg)),
+		NextHeader:    uint8(header.ICMPv6ProtocolNumber),
+		HopLimit:      64,
+		SrcAddr:       from,
+		DstAddr:       ip.SourceAddress(),
+	})
+	return resp
+}
+
+func checkHops(t *testing.T, dst tcpip.Address, hops []Hop, probes int) {
+	t.Helper()
+	if len(hops) != distance {
+		t.Fatalf("Trace(%v): got %d hops, want = %d: %+v", dst, len(hops), distance, hops)
+	}
+	for i, hop := range hops {
+		ttl := i + 1
+		want := dst
+		if ttl < distance {
+			want = routerAddr(len(dst) == header.IPv6AddressSize, uint8(ttl))
+		}
+		if hop.TTL != ttl || len(hop.Probes) != probes {
+			t.Errorf("Trace(%v): got hop %d = %+v, want TTL = %d with %d probes", dst, i, hop, ttl, probes)
+			continue
+		}
+		for _, p := range hop.Probes {
+			if p.Addr != want || p.RTT <= 0 {
+				t.Errorf("Trace(%v): got probe %+v at TTL %d, want answer from %v", dst, p, ttl, want)
+			}
+		}
+	}
+}
+
+func TestTraceUDP(t *testing.T) {
+	s, cleanup := newStack(t)
+	defer cleanup()
+	for _, dst := range []tcpip.Address{dstAddr4, dstAddr6} {
+		var seen []Hop
+		hops, err := Trace(context.Background(), s, dst, Config{
+			Probes: 2,
+			OnHop:  func(h Hop) { seen = append(seen, h) },
+		})
+		if err != nil {
+			t.Fatalf("Trace(%v): %v", dst, err)
+		}
+		checkHops(t, dst, hops, 2)
+		if len(seen) != len(hops) {
+			t.Errorf("Trace(%v): OnHop called %d times, want = %d", dst, len(seen), len(hops))
+		}
+	}
+}
+
+func TestTraceICMP(t *testing.T) {
+	s, cleanup := newStack(t)
+	defer cleanup()
+	for _, dst := range []tcpip.Address{dstAddr4, dstAddr6} {
+		hops, err := Trace(context.Background(), s, dst, Config{ICMP: true})
+		if err != nil {
+			t.Fatalf("Trace(%v): %v", dst, err)
+		}
+		checkHops(t, dst, hops, defaultProbes)
+	}
+}
+
+func TestTraceNoAnswer(t *testing.T) {
+	s, cleanup := newStack(t)
+	defer cleanup()
+	// The simulated network drops the probes to this address.
+	dst := tcpip.Address("\x0a\x00\x03\x01")
+	hops, err := Trace(context.Background(), s, dst, Config{
+		MaxHops: 2,
+		Probes:  1,
+		Timeout: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Trace: %v", err)
+	}
+	if len(hops) != 2 {
+		t.Fatalf("got %d hops, want = 2", len(hops))
+	}
+	for _, hop := range hops {
+		if len(hop.Probes) != 1 || hop.Probes[0] != (Probe{}) {
+			t.Errorf("got hop %+v, want a single unanswered probe", hop)
+		}
+	}
+}
+
+func TestTraceCanceled(t *testing.T) {
+	s, cleanup := newStack(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := Trace(ctx, s, "\x0a\x00\x03\x01", Config{}); err != context.DeadlineExceeded {
+		t.Fatalf("got Trace = %v, want = %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package waiter
+
+import (
+	"context"
+	"sync"
+)
+
+// A PollEvent reports the readiness of a Waitable registered with a Poller.
+type PollEvent struct {
+	// Waitable is the ready object.
+	Waitable Waitable
+
+	// Events is the readiness of Waitable. It may include events such as
+	// EventErr and EventHUp that it wasn't registered for.
+	Events EventMask
+
+	// Data is the value Waitable was registered with.
+	Data interface{}
+}
+
+// A Poller monitors the readiness of many Waitables at once, like epoll(7)
+// does for file descriptors, so that a single goroutine can serve them all.
+//
+// Readiness is level-triggered: a Waitable is reported by every call to Wait
+// for as long as it is ready, so callers should consume its events (e.g. read
+// until ErrWouldBlock) before waiting again.
+//
+// A Poller is safe for concurrent use.
+type Poller struct {
+	// notify is signaled when an item is added to ready.
+	notify chan struct{}
+
+	// mu protects the fields below. It may be taken by waiter callbacks,
+	// so it must not be held while calling into a Waitable.
+	mu    sync.Mutex
+	items map[Waitable]*pollItem
+	ready []*pollItem
+}
+
+// pollItem is the registration of a Waitable with a Poller.
+type pollItem struct {
+	p     *Poller
+	w     Waitable
+	entry Entry
+
+	// The following fields are protected by p.mu.
+	mask    EventMask
+	data    interface{}
+	queued  bool
+	removed bool
+}
+
+// Callback implements EntryCallback.Callback.
+func (i *pollItem) Callback(*Entry) {
+	i.p.mu.Lock()
+	i.p.enqueueLocked(i)
+	i.p.mu.Unlock()
+}
+
+// NewPoller creates a new Poller.
+func NewPoller() *Poller {
+	return &Poller{
+		notify: make(chan struct{}, 1),
+		items:  make(map[Waitable]*pollItem),
+	}
+}
+
+// enqueueLocked adds i to the ready list, unless it is already there or was
+// removed. The Waitable's readiness is checked by Wait.
+func (p *Poller) enqueueLocked(i *pollItem) {
+	if i.queued || i.removed {
+		return
+	}
+	i.queued = true
+	p.ready = append(p.ready, i)
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Add starts monitoring w for the events in mask. Wait reports data along
+// with w's readiness. If w is already monitored, its mask and data are
+// replaced.
+func (p *Poller) Add(w Waitable, mask EventMask, data interface{}) {
+	p.mu.Lock()
+	if i, ok := p.items[w]; ok {
+		i.data = data
+		if i.mask == mask {
+			p.enqueueLocked(i)
+			p.mu.Unlock()
+			return
+		}
+		// Registering with a new mask requires going through the
+		// waitable, so start afresh.
+		i.removed = true
+		delete(p.items, w)
+		p.mu.Unlock()
+		w.EventUnregister(&i.entry)
+		p.mu.Lock()
+	}
+	i := &pollItem{p: p, w: w, mask: mask, data: data}
+	i.entry.Callback = i
+	p.items[w] = i
+	// w may already be ready, in which case no notification will come.
+	p.enqueueLocked(i)
+	p.mu.Unlock()
+
+	w.EventRegister(&i.entry, mask)
+}
+
+// Remove stops monitoring w. It does nothing if w isn't monitored.
+func (p *Poller) Remove(w Waitable) {
+	p.mu.Lock()
+	i, ok := p.items[w]
+	if ok {
+		i.removed = true
+		delete(p.items, w)
+	}
+	p.mu.Unlock()
+
+	if ok {
+		w.EventUnregister(&i.entry)
+	}
+}
+
+// Len returns the number of monitored Waitables.
+func (p *Poller) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.items)
+}
+
+// Wait blocks until at least one monitored Waitable is ready or ctx is done,
+// and stores the readiness of up to len(events) ready Waitables in events. It
+// returns the number of events stored, or ctx.Err() if ctx is done first.
+func (p *Poller) Wait(ctx context.Context, events []PollEvent) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+	for {
+		if n := p.poll(events); n != 0 {
+			return n, nil
+		}
+		select {
+		case <-p.notify:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// poll checks the readiness of the queued items, and stores that of up to
+// len(events) ready ones in events. It returns the number of events stored.
+func (p *Poller) poll(events []PollEvent) int {
+	p.mu.Lock()
+	ready := p.ready
+	p.ready = nil
+	p.mu.Unlock()
+
+	n, next := 0, 0
+	for ; next < len(ready) && n < len(events); next++ {
+		i := ready[next]
+		p.mu.Lock()
+		mask, data, removed := i.mask, i.data, i.removed
+		// Clear queued before checking readiness, so that a
+		// notification that races with the check requeues i.
+		i.queued = false
+		p.mu.Unlock()
+		if removed {
+			continue
+		}
+
+		if r := i.w.Readiness(mask); r != 0 {
+			events[n] = PollEvent{Waitable: i.w, Events: r, Data: data}
+			n++
+		}
+	}
+
+	p.mu.Lock()
+	// Items that were reported are checked again by the next call, as
+	// they may still be ready. Those that weren't checked yet keep their
+	// place at the front of the queue.
+	unchecked := ready[next:]
+	rest := p.ready
+	p.ready = nil
+	for _, i := range unchecked {
+		i.queued = false
+	}
+	for _, i := range rest {
+		i.queued = false
+	}
+	for _, i := range unchecked {
+		p.enqueueLocked(i)
+	}
+	for _, e := range events[:n] {
+		if i, ok := p.items[e.Waitable]; ok {
+			p.enqueueLocked(i)
+		}
+	}
+	for _, i := range rest {
+		p.enqueueLocked(i)
+	}
+	p.mu.Unlock()
+
+	return n
+}
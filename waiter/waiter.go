@@ -58,7 +58,10 @@
 package waiter
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/netstack/ilist"
 )
@@ -110,6 +113,25 @@ type EntryCallback interface {
 	Callback(e *Entry)
 }
 
+// EntryMode determines how often a waiter entry is notified of events.
+type EntryMode int
+
+const (
+	// LevelTriggered entries are notified every time one of the events
+	// they wait on is notified. It is the default mode.
+	LevelTriggered EntryMode = iota
+
+	// EdgeTriggered entries are notified of each event only once until
+	// they are re-armed with Entry.Rearm, however many times it is
+	// notified in between. Events that haven't been notified yet still
+	// are.
+	EdgeTriggered
+
+	// OneShot entries are notified once, and then of no event at all until
+	// they are re-armed with Entry.Rearm.
+	OneShot
+)
+
 // Entry represents a waiter that can be add to the a wait queue. It can
 // only be in one queue at a time, and is added "intrusively" to the queue with
 // no extra memory allocations.
@@ -125,11 +147,64 @@ type Entry struct {
 
 	Callback EntryCallback
 
+	// Mode is the notification mode of the entry. It must not be changed
+	// while the entry is registered.
+	Mode EntryMode
+
+	// Exclusive makes the entry an exclusive waiter, like Linux's exclusive
+	// waits and EPOLLEXCLUSIVE: each notification wakes only the first
+	// exclusive entry waiting on its events, in FIFO order, instead of all
+	// of them, so that many waiters blocked on the same object, like the
+	// goroutines accepting connections from one listener, don't all wake
+	// up to compete for each event. Notifications of EventErr or EventHUp
+	// still wake all entries. A waiter woken this way that gives up
+	// without consuming the event should notify the queue again, so that
+	// another waiter gets it. It must not be changed while the entry is
+	// registered.
+	Exclusive bool
+
+	// fired is the set of events the entry was notified of since it was
+	// registered or last re-armed. It is only used by edge-triggered and
+	// one-shot entries, and must be accessed atomically.
+	fired uint32
+
 	// The following fields are protected by the queue lock.
 	mask EventMask
 	ilist.Entry
 }
 
+// Rearm re-arms an edge-triggered or one-shot entry, so that it is notified of
+// events again. Waiters should check the readiness of the object they wait on
+// after re-arming, as events notified while the entry was disarmed are not
+// replayed.
+func (e *Entry) Rearm() {
+	atomic.StoreUint32(&e.fired, 0)
+}
+
+// fire records that the entry is being notified of the events in mask, and
+// reports whether its callback should be called.
+func (e *Entry) fire(mask EventMask) bool {
+	for {
+		old := atomic.LoadUint32(&e.fired)
+		new := old | uint32(mask)
+		switch e.Mode {
+		case EdgeTriggered:
+			if new == old {
+				return false
+			}
+		case OneShot:
+			if old != 0 {
+				return false
+			}
+		default:
+			return true
+		}
+		if atomic.CompareAndSwapUint32(&e.fired, old, new) {
+			return true
+		}
+	}
+}
+
 type channelCallback struct{}
 
 // Callback implements EntryCallback.Callback.
@@ -164,6 +239,10 @@ func NewChannelEntry(c chan struct{}) (Entry, chan struct{}) {
 type Queue struct {
 	list ilist.List
 	mu   sync.RWMutex
+
+	// exclusive is the number of exclusive entries in list. It is protected
+	// by mu.
+	exclusive int
 }
 
 // EventRegister adds a waiter to the wait queue; the waiter will be notified
@@ -171,7 +250,11 @@ type Queue struct {
 func (q *Queue) EventRegister(e *Entry, mask EventMask) {
 	q.mu.Lock()
 	e.mask = mask
+	atomic.StoreUint32(&e.fired, 0)
 	q.list.PushBack(e)
+	if e.Exclusive {
+		q.exclusive++
+	}
 	q.mu.Unlock()
 }
 
@@ -179,22 +262,59 @@ func (q *Queue) EventRegister(e *Entry, mask EventMask) {
 func (q *Queue) EventUnregister(e *Entry) {
 	q.mu.Lock()
 	q.list.Remove(e)
+	if e.Exclusive {
+		q.exclusive--
+	}
 	q.mu.Unlock()
 }
 
 // Notify notifies all waiters in the queue whose masks have at least one bit
-// in common with the notification mask.
+// in common with the notification mask, unless they are edge-triggered or
+// one-shot entries that are disarmed for those events, or exclusive entries
+// other than the first one to notify.
 func (q *Queue) Notify(mask EventMask) {
 	q.mu.RLock()
+	if q.exclusive != 0 && mask&(EventErr|EventHUp) == 0 {
+		q.mu.RUnlock()
+		q.notifyExclusive(mask)
+		return
+	}
 	for it := q.list.Front(); it != nil; it = it.Next() {
 		e := it.(*Entry)
-		if mask&e.mask != 0 {
+		if m := mask & e.mask; m != 0 && e.fire(m) {
 			e.Callback.Callback(e)
 		}
 	}
 	q.mu.RUnlock()
 }
 
+// notifyExclusive is Notify for a queue holding exclusive entries. Only the
+// first of them that is notified has its callback called, and it's then moved
+// to the back of the queue so that the next notification goes to the next
+// one.
+func (q *Queue) notifyExclusive(mask EventMask) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var woken *Entry
+	for it := q.list.Front(); it != nil; it = it.Next() {
+		e := it.(*Entry)
+		if e.Exclusive && woken != nil {
+			continue
+		}
+		if m := mask & e.mask; m != 0 && e.fire(m) {
+			e.Callback.Callback(e)
+			if e.Exclusive {
+				woken = e
+			}
+		}
+	}
+	if woken != nil {
+		q.list.Remove(woken)
+		q.list.PushBack(woken)
+	}
+}
+
 // Events returns the set of events being waited on. It is the union of the
 // masks of all registered entries.
 func (q *Queue) Events() EventMask {
@@ -218,6 +338,48 @@ func (q *Queue) IsEmpty() bool {
 	return q.list.Front() == nil
 }
 
+// Wait blocks until w is ready for at least one of the events in mask, or until
+// ctx is done, whichever happens first.
+//
+// If w became ready, Wait returns its readiness, which may include events such
+// as EventErr and EventHUp that are not in mask, and a nil error. Otherwise it
+// returns ctx.Err(), which tells whether ctx was canceled
+// (context.Canceled) or its deadline passed (context.DeadlineExceeded).
+func Wait(ctx context.Context, w Waitable, mask EventMask) (EventMask, error) {
+	if r := w.Readiness(mask); r != 0 {
+		return r, nil
+	}
+
+	e, ch := NewChannelEntry(nil)
+	w.EventRegister(&e, mask)
+	defer w.EventUnregister(&e)
+
+	for {
+		// Check again after registration, as w may have become ready
+		// in between.
+		if r := w.Readiness(mask); r != 0 {
+			return r, nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// WaitDeadline is like Wait, but gives up once deadline passes instead of when
+// a context is done, in which case it returns context.DeadlineExceeded. A zero
+// deadline means Wait never gives up.
+func WaitDeadline(w Waitable, mask EventMask, deadline time.Time) (EventMask, error) {
+	if deadline.IsZero() {
+		return Wait(context.Background(), w, mask)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	return Wait(ctx, w, mask)
+}
+
 // AlwaysReady implements the Waitable interface but is always ready. Embedding
 // this struct into another struct makes it implement the boilerplate empty
 // functions automatically.
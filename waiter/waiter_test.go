@@ -15,8 +15,11 @@
 package waiter
 
 import (
+	"context"
+	"reflect"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type callbackStub struct {
@@ -190,3 +193,220 @@ func TestConcurrentNotification(t *testing.T) {
 		t.Errorf("cnt = %d, want %d", cnt, concurrency*waiterCount)
 	}
 }
+
+// readyFlag is a Waitable that is ready for EventIn once its flag is set.
+type readyFlag struct {
+	Queue
+	ready uint32
+}
+
+func (r *readyFlag) Readiness(mask EventMask) EventMask {
+	if atomic.LoadUint32(&r.ready) != 0 {
+		return mask & EventIn
+	}
+	return 0
+}
+
+func (r *readyFlag) set() {
+	atomic.StoreUint32(&r.ready, 1)
+	r.Notify(EventIn)
+}
+
+func TestWait(t *testing.T) {
+	var r readyFlag
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.set()
+	}()
+	got, err := Wait(context.Background(), &r, EventIn)
+	if err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if got != EventIn {
+		t.Errorf("got Wait = %v, want %v", got, EventIn)
+	}
+	if !r.IsEmpty() {
+		t.Errorf("Wait left its entry registered")
+	}
+
+	// An object that is already ready doesn't block.
+	if got, err := Wait(context.Background(), &r, EventIn); got != EventIn || err != nil {
+		t.Errorf("got Wait = %v, %v on a ready object, want %v, nil", got, err, EventIn)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	var r readyFlag
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if got, err := Wait(ctx, &r, EventIn); got != 0 || err != context.Canceled {
+		t.Errorf("got Wait = %v, %v, want 0, %v", got, err, context.Canceled)
+	}
+	if !r.IsEmpty() {
+		t.Errorf("Wait left its entry registered")
+	}
+}
+
+func TestWaitDeadline(t *testing.T) {
+	var r readyFlag
+	if got, err := WaitDeadline(&r, EventIn, time.Now().Add(10*time.Millisecond)); got != 0 || err != context.DeadlineExceeded {
+		t.Errorf("got WaitDeadline = %v, %v, want 0, %v", got, err, context.DeadlineExceeded)
+	}
+}
+
+func TestEntryModes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		mode EntryMode
+		// want is the expected number of callbacks after notifying
+		// EventIn twice, EventOut once, re-arming, and notifying EventIn
+		// once more.
+		want []int
+	}{
+		{"LevelTriggered", LevelTriggered, []int{1, 2, 3, 4}},
+		{"EdgeTriggered", EdgeTriggered, []int{1, 1, 2, 3}},
+		{"OneShot", OneShot, []int{1, 1, 1, 2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var q Queue
+			cnt := 0
+			e := Entry{Callback: &callbackStub{func(*Entry) { cnt++ }}, Mode: tc.mode}
+			q.EventRegister(&e, EventIn|EventOut)
+			defer q.EventUnregister(&e)
+
+			steps := []func(){
+				func() { q.Notify(EventIn) },
+				func() { q.Notify(EventIn) },
+				func() { q.Notify(EventOut) },
+				func() { e.Rearm(); q.Notify(EventIn) },
+			}
+			for i, step := range steps {
+				step()
+				if cnt != tc.want[i] {
+					t.Fatalf("got %d callbacks after step %d, want %d", cnt, i, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestExclusive(t *testing.T) {
+	var q Queue
+	var woken []int
+	var entries [3]Entry
+	for i := range entries {
+		i := i
+		entries[i] = Entry{Callback: &callbackStub{func(*Entry) { woken = append(woken, i) }}, Exclusive: true}
+		q.EventRegister(&entries[i], EventIn)
+		defer q.EventUnregister(&entries[i])
+	}
+	cnt := 0
+	shared := Entry{Callback: &callbackStub{func(*Entry) { cnt++ }}}
+	q.EventRegister(&shared, EventIn)
+	defer q.EventUnregister(&shared)
+
+	// Each notification wakes the next exclusive entry, in FIFO order,
+	// and all the other entries.
+	for i := 0; i < 4; i++ {
+		q.Notify(EventIn)
+	}
+	if want := []int{0, 1, 2, 0}; !reflect.DeepEqual(woken, want) {
+		t.Errorf("got exclusive entries %v woken, want %v", woken, want)
+	}
+	if cnt != 4 {
+		t.Errorf("got %d callbacks of the non-exclusive entry, want 4", cnt)
+	}
+
+	// Disarmed entries are skipped.
+	woken = nil
+	entries[1].Mode = OneShot
+	entries[1].fired = uint32(EventIn)
+	q.Notify(EventIn)
+	q.Notify(EventIn)
+	if want := []int{2, 0}; !reflect.DeepEqual(woken, want) {
+		t.Errorf("got exclusive entries %v woken, want %v", woken, want)
+	}
+
+	// Errors wake all entries.
+	woken = nil
+	entries[1].Mode = LevelTriggered
+	q.Notify(EventIn | EventErr)
+	if len(woken) != len(entries) {
+		t.Errorf("got exclusive entries %v woken by an error, want all of them", woken)
+	}
+}
+
+func TestPoller(t *testing.T) {
+	p := NewPoller()
+	var rs [3]readyFlag
+	for i := range rs {
+		p.Add(&rs[i], EventIn, i)
+	}
+	if got := p.Len(); got != len(rs) {
+		t.Fatalf("got p.Len() = %d, want %d", got, len(rs))
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		rs[1].set()
+	}()
+	events := make([]PollEvent, len(rs))
+	n, err := p.Wait(context.Background(), events)
+	if err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if n != 1 || events[0].Waitable != &rs[1] || events[0].Events != EventIn || events[0].Data != 1 {
+		t.Fatalf("got Wait = %+v, want rs[1] ready for EventIn", events[:n])
+	}
+
+	// Readiness is level-triggered, so rs[1] is reported again.
+	rs[2].set()
+	n, err = p.Wait(context.Background(), events)
+	if err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("got Wait = %+v, want rs[1] and rs[2]", events[:n])
+	}
+
+	// Removed waitables are no longer reported.
+	p.Remove(&rs[1])
+	p.Remove(&rs[2])
+	if !rs[1].IsEmpty() || !rs[2].IsEmpty() {
+		t.Errorf("Remove left entries registered")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if n, err := p.Wait(ctx, events); n != 0 || err != context.DeadlineExceeded {
+		t.Errorf("got Wait = %+v, %v, want none, %v", events[:n], err, context.DeadlineExceeded)
+	}
+}
+
+func TestPollerBatch(t *testing.T) {
+	p := NewPoller()
+	rs := make([]readyFlag, 10)
+	for i := range rs {
+		rs[i].set()
+		p.Add(&rs[i], EventIn, nil)
+	}
+
+	// Ready waitables are reported in turn when events is too small to hold
+	// them all.
+	seen := make(map[Waitable]bool)
+	events := make([]PollEvent, 3)
+	for i := 0; i < 4; i++ {
+		n, err := p.Wait(context.Background(), events)
+		if err != nil {
+			t.Fatalf("Wait failed: %v", err)
+		}
+		for _, e := range events[:n] {
+			seen[e.Waitable] = true
+		}
+	}
+	if len(seen) != len(rs) {
+		t.Errorf("got %d waitables reported, want %d", len(seen), len(rs))
+	}
+}